@@ -0,0 +1,15 @@
+fn main() -> Result<(), Box<dyn std::error::Error>> {
+    // the gRPC code is only generated with the grpc feature, it needs protoc
+    #[cfg(feature = "grpc")]
+    tonic_build::compile_protos("proto/ssh_vault.proto")?;
+
+    println!("cargo:rerun-if-changed=proto/ssh_vault.proto");
+
+    // the target of the release archives, used by ssh-vault update
+    println!("cargo:rustc-env=TARGET={}", std::env::var("TARGET")?);
+
+    // the keys the releases are signed with, one per line
+    println!("cargo:rerun-if-env-changed=SSH_VAULT_RELEASE_KEY");
+
+    Ok(())
+}
@@ -0,0 +1,139 @@
+use crate::{config, tools::get_home, webhook};
+use anyhow::Result;
+use std::{
+    env,
+    fs::{self, OpenOptions},
+    io::Write,
+    path::PathBuf,
+    time::SystemTime,
+};
+
+/// Append an entry to the audit log if enabled with `audit: true` in the config
+/// (`SSH_VAULT_AUDIT=true`) and notify the webhooks watching the vault, errors
+/// are reported but never stop the operation
+pub fn log(operation: &str, vault: Option<&str>, fingerprint: &str) {
+    let vault = vault_path(vault);
+
+    if let Err(e) = try_log(operation, vault.as_deref(), fingerprint) {
+        eprintln!("Could not write the audit log: {e}");
+    }
+
+    webhook::notify(operation, vault.as_deref(), fingerprint);
+}
+
+// The absolute path of the vault, None for stdin and stdout
+fn vault_path(vault: Option<&str>) -> Option<String> {
+    vault
+        .filter(|v| *v != "-")
+        .map(|v| fs::canonicalize(v).map_or_else(|_| v.to_string(), |p| p.display().to_string()))
+}
+
+fn try_log(operation: &str, vault: Option<&str>, fingerprint: &str) -> Result<()> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    if !config.get_bool("audit").unwrap_or(false) {
+        return Ok(());
+    }
+
+    let path = config
+        .get_string("audit_log")
+        .map_or_else(|_| get_audit_log_path(), |path| Ok(PathBuf::from(path)))?;
+
+    if let Some(parent_dir) = path.parent() {
+        fs::create_dir_all(parent_dir)?;
+    }
+
+    let mut options = OpenOptions::new();
+    options.create(true).append(true);
+
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+
+    let mut file = options.open(path)?;
+    file.write_all(entry(SystemTime::now(), operation, vault, fingerprint).as_bytes())?;
+
+    Ok(())
+}
+
+// timestamp operation vault fingerprint
+fn entry(time: SystemTime, operation: &str, vault: Option<&str>, fingerprint: &str) -> String {
+    format!(
+        "{}\t{operation}\t{}\t{fingerprint}\n",
+        humantime::format_rfc3339_seconds(time),
+        vault.unwrap_or("-")
+    )
+}
+
+/// Get the path to the audit log $XDG_STATE_HOME/ssh-vault/audit.log
+/// # Errors
+/// Return an error if we can't get the home directory
+fn get_audit_log_path() -> Result<PathBuf> {
+    let state = match env::var("XDG_STATE_HOME") {
+        Ok(dir) if !dir.is_empty() => PathBuf::from(dir),
+        _ => get_home()?.join(".local").join("state"),
+    };
+
+    Ok(state.join("ssh-vault").join("audit.log"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::{Duration, UNIX_EPOCH};
+
+    #[test]
+    fn test_entry() {
+        let time = UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        assert_eq!(
+            entry(time, "view", None, "SHA256:abc"),
+            "2023-11-14T22:13:20Z\tview\t-\tSHA256:abc\n"
+        );
+        assert_eq!(
+            entry(time, "create", Some("/path/does/not/exist"), "SHA256:abc"),
+            "2023-11-14T22:13:20Z\tcreate\t/path/does/not/exist\tSHA256:abc\n"
+        );
+    }
+
+    #[test]
+    fn test_vault_path() {
+        assert_eq!(vault_path(None), None);
+        assert_eq!(vault_path(Some("-")), None);
+        assert_eq!(
+            vault_path(Some("/path/does/not/exist")).as_deref(),
+            Some("/path/does/not/exist")
+        );
+        assert!(vault_path(Some("Cargo.toml")).unwrap().starts_with('/'));
+    }
+
+    #[test]
+    fn test_get_audit_log_path() {
+        temp_env::with_var("XDG_STATE_HOME", Some("/tmp/state"), || {
+            assert_eq!(
+                get_audit_log_path().unwrap(),
+                PathBuf::from("/tmp/state/ssh-vault/audit.log")
+            );
+        });
+    }
+
+    #[test]
+    fn test_log() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_AUDIT", Some("true")),
+                ("SSH_VAULT_AUDIT_LOG", Some(path.to_str().unwrap())),
+            ],
+            || {
+                log("view", None, "SHA256:abc");
+                log("edit", None, "SHA256:abc");
+            },
+        );
+
+        let content = fs::read_to_string(&path).unwrap();
+        assert_eq!(content.lines().count(), 2);
+        assert!(content.contains("\tedit\t-\tSHA256:abc"));
+    }
+}
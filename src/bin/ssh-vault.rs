@@ -1,9 +1,26 @@
 use anyhow::Result;
-use ssh_vault::cli::{actions, actions::Action, start};
+use ssh_vault::{
+    cli::{actions, actions::Action, start},
+    exit, harden, interrupt,
+};
 use std::process;
 
 // Main function
-fn main() -> Result<()> {
+fn main() {
+    // keep the secrets out of core dumps and debuggers
+    harden::process();
+
+    // don't leave the terminal without echo if interrupted while prompting
+    interrupt::install();
+
+    // exit with the code of the kind of failure
+    if let Err(e) = run() {
+        eprintln!("Error: {e:?}");
+        process::exit(exit::code(&e));
+    }
+}
+
+fn run() -> Result<()> {
     // Start the program
     let action = start()?;
 
@@ -18,14 +35,112 @@ fn main() -> Result<()> {
         Action::View { .. } => {
             actions::view::handle(action)?;
         }
+        Action::Direnv { .. } => {
+            actions::direnv::handle(action)?;
+        }
         Action::Edit { .. } => {
             actions::edit::handle(action)?;
         }
+        Action::Export { .. } => {
+            actions::export::handle(action)?;
+        }
+        Action::GitFilter { .. } => {
+            actions::git_filter::handle(action)?;
+        }
+        Action::GitTextconv { .. } => {
+            actions::git_textconv::handle(action)?;
+        }
+        Action::Grpc { .. } => {
+            actions::grpc::handle(action)?;
+        }
+        Action::Import { .. } => {
+            actions::import::handle(action)?;
+        }
+        Action::Info { .. } => {
+            actions::info::handle(action)?;
+        }
+        Action::Merge { .. } => {
+            actions::merge::handle(action)?;
+        }
+        Action::Mount { .. } => {
+            actions::mount::handle(action)?;
+        }
+        Action::Scan { .. } => {
+            actions::scan::handle(action)?;
+        }
+        Action::Server { .. } => {
+            actions::server::handle(action)?;
+        }
+        Action::Share { .. } => {
+            actions::share::handle(action)?;
+        }
+        Action::Values { .. } => {
+            actions::values::handle(action)?;
+        }
+        Action::Agent { .. } => {
+            actions::agent::handle(action)?;
+        }
+        Action::AuditRecipients { .. } => {
+            actions::audit_recipients::handle(action)?;
+        }
+        Action::Check { .. } => {
+            actions::check::handle(action)?;
+        }
+        Action::Repair { .. } => {
+            actions::repair::handle(action)?;
+        }
+        Action::Encrypt { .. } => {
+            actions::encrypt::handle(action)?;
+        }
+        Action::Decrypt { .. } => {
+            actions::decrypt::handle(action)?;
+        }
+        Action::Relabel { .. } => {
+            actions::relabel::handle(action)?;
+        }
+        Action::Keyserver { .. } => {
+            actions::keyserver::handle(action)?;
+        }
+        Action::Index { .. } => {
+            actions::index::handle(action)?;
+        }
+        Action::Run { .. } => {
+            actions::run::handle(action)?;
+        }
+        Action::Pack { .. } => {
+            actions::pack::handle(action)?;
+        }
+        Action::Unpack { .. } => {
+            actions::unpack::handle(action)?;
+        }
+        Action::History { .. } => {
+            actions::history::handle(action)?;
+        }
+        Action::Undo { .. } => {
+            actions::undo::handle(action)?;
+        }
+        Action::Compare { .. } => {
+            actions::compare::handle(action)?;
+        }
+        Action::Update { .. } => {
+            actions::update::handle(action)?;
+        }
+        Action::Watch { .. } => {
+            actions::watch::handle(action)?;
+        }
+        Action::Plugin { .. } => {
+            // the plugin reported its own errors, exit with its status
+            let code = actions::plugin::handle(action)?;
+
+            if code != 0 {
+                process::exit(code);
+            }
+        }
         Action::Help => {
             eprintln!("No command or argument provided, try --help");
 
-            // Exit the program with status code 1
-            process::exit(1);
+            // Exit the program with the status code of usage errors
+            process::exit(exit::Failure::Usage.code());
         }
     }
 
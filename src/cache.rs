@@ -1,4 +1,4 @@
-use crate::tools::get_home;
+use crate::{config, tools::get_home};
 use anyhow::{anyhow, Result};
 use std::{
     fs,
@@ -46,18 +46,72 @@ pub fn put(key: &str, response: &str) -> Result<()> {
     Ok(fs::write(cache, response)?)
 }
 
-/// Get the path to the cache file ~/.ssh/vault/keys/<key>
+/// Load the response from a cache file even if expired, used to revalidate it
+#[must_use]
+pub fn get_stale(key: &str) -> Option<String> {
+    fs::read_to_string(get_cache_path(key).ok()?).ok()
+}
+
+/// Validators of a cached response, sent back to only download it if it changed
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct Validators {
+    pub etag: Option<String>,
+    pub last_modified: Option<String>,
+}
+
+/// Load the validators of a cached response ~/.ssh/vault/keys/<key>.meta
+#[must_use]
+pub fn get_validators(key: &str) -> Option<Validators> {
+    let meta = fs::read_to_string(get_cache_path(&format!("{key}.meta")).ok()?).ok()?;
+    let mut validators = Validators::default();
+
+    for line in meta.lines() {
+        match line.split_once(": ") {
+            Some(("ETag", value)) => validators.etag = Some(value.to_string()),
+            Some(("Last-Modified", value)) => validators.last_modified = Some(value.to_string()),
+            _ => {}
+        }
+    }
+
+    Some(validators)
+}
+
+/// Save the validators of a cached response ~/.ssh/vault/keys/<key>.meta
+/// # Errors
+/// Return an error if the file can't be written
+pub fn put_validators(key: &str, validators: &Validators) -> Result<()> {
+    let mut meta = String::new();
+
+    if let Some(etag) = &validators.etag {
+        meta.push_str(&format!("ETag: {etag}\n"));
+    }
+
+    if let Some(last_modified) = &validators.last_modified {
+        meta.push_str(&format!("Last-Modified: {last_modified}\n"));
+    }
+
+    put(&format!("{key}.meta"), &meta)
+}
+
+/// Get the path to the cache file ~/.ssh/vault/keys/<key>, or
+/// ~/.ssh/vault/profiles/<profile>/keys/<key> with a profile
 /// # Errors
 /// Return an error if we can't get the path to the cache file
 fn get_cache_path(key: &str) -> Result<PathBuf> {
     let ssh_vault = get_ssh_vault_path()?;
-    Ok(ssh_vault.join("keys").join(key))
+
+    let dir = match config::profile()? {
+        Some(profile) => ssh_vault.join("profiles").join(profile),
+        None => ssh_vault,
+    };
+
+    Ok(dir.join("keys").join(key))
 }
 
 /// Get the path to the ssh-vault directory ~/.ssh/vault
 /// # Errors
 /// Return an error if we can't get the path to the ssh-vault directory
-fn get_ssh_vault_path() -> Result<PathBuf> {
+pub fn get_ssh_vault_path() -> Result<PathBuf> {
     let home = get_home()?;
     Ok(Path::new(&home).join(".ssh").join("vault"))
 }
@@ -120,6 +174,19 @@ mod tests {
         put("test-3", "test").unwrap();
         let response = get("test-3").unwrap();
         assert_eq!(response, "test");
+        assert_eq!(get_stale("test-3").unwrap(), "test");
         fs::remove_file(cache).unwrap();
     }
+
+    #[test]
+    fn test_validators() {
+        let validators = Validators {
+            etag: Some("W/\"abc\"".to_string()),
+            last_modified: Some("Wed, 21 Oct 2015 07:28:00 GMT".to_string()),
+        };
+        put_validators("test-4", &validators).unwrap();
+        assert_eq!(get_validators("test-4").unwrap(), validators);
+        assert_eq!(get_validators("test-5"), None);
+        fs::remove_file(get_cache_path("test-4.meta").unwrap()).unwrap();
+    }
 }
@@ -0,0 +1,62 @@
+use crate::cli::actions::Action;
+use crate::vault::{agent, find, ssh::decrypt_private_key, SshKeyType, SshVault};
+use anyhow::Result;
+use std::{net::TcpListener, path::PathBuf};
+
+/// Handle the agent action
+/// # Errors
+/// Will return an error if the agent can't be started or stopped
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Agent {
+            identities,
+            lifetime,
+            metrics,
+            socket,
+            stop,
+        } => {
+            let socket = socket.map_or_else(agent::socket_path, |s| Ok(PathBuf::from(s)))?;
+
+            if stop {
+                return agent::stop(&socket);
+            }
+
+            // the passphrases are asked once, before going to the background
+            let identities = identities
+                .into_iter()
+                .map(identity)
+                .collect::<Result<Vec<_>>>()?;
+
+            let metrics = metrics.map(TcpListener::bind).transpose()?;
+
+            if let Some(listener) = &metrics {
+                eprintln!("Metrics on http://{}/metrics", listener.local_addr()?);
+            }
+
+            // like ssh-agent, print the variables to use it
+            println!(
+                "SSH_VAULT_AGENT_SOCK={}; export SSH_VAULT_AGENT_SOCK;",
+                socket.display()
+            );
+
+            agent::serve(&socket, lifetime, &identities, metrics)?;
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// The private key unlocked
+fn identity(path: String) -> Result<SshVault> {
+    let mut private_key = find::private_key(Some(path), &SshKeyType::Ed25519)?;
+
+    if private_key.is_encrypted() {
+        private_key = decrypt_private_key(&private_key, None)?;
+    }
+
+    SshVault::new(
+        &find::key_type(&private_key.algorithm())?,
+        None,
+        Some(private_key),
+    )
+}
@@ -0,0 +1,366 @@
+use crate::cli::actions::Action;
+use crate::style::{Color, Style};
+use crate::vault::{fingerprint::md5_fingerprint, info, info::VaultInfo, policy::Policy, revoked};
+use anyhow::{anyhow, Result};
+use rsa::RsaPublicKey;
+use serde::Serialize;
+use ssh_key::{HashAlg, PublicKey};
+use std::{
+    collections::{BTreeMap, HashMap},
+    fs,
+    path::{Path, PathBuf},
+};
+
+/// Recipients a policy expects
+#[derive(Debug, Default)]
+struct Expected {
+    policy: String,
+    // SHA256 fingerprints of the keys
+    fingerprints: Vec<String>,
+    // MD5 fingerprint of the RSA keys used by the legacy format to its SHA256
+    aliases: HashMap<String, String>,
+}
+
+#[derive(Debug, Serialize)]
+struct Row {
+    path: String,
+    policy: Option<String>,
+    recipients: Vec<String>,
+    missing: Vec<String>,
+    unexpected: Vec<String>,
+    revoked: Vec<String>,
+}
+
+impl Row {
+    const fn deviates(&self) -> bool {
+        !self.missing.is_empty() || !self.unexpected.is_empty() || !self.revoked.is_empty()
+    }
+}
+
+/// Handle the audit-recipients action
+/// # Errors
+/// Will return an error if a vault can't be read, its recipients deviate from
+/// the policy or include a revoked key
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::AuditRecipients {
+            exclude,
+            include,
+            json,
+            paths,
+        } => {
+            let filter = info::Filter::new(&include, &exclude)?;
+
+            let paths = if paths.is_empty() {
+                vec![String::from(".")]
+            } else {
+                paths
+            };
+
+            let mut vaults = Vec::new();
+
+            for path in paths {
+                let path = PathBuf::from(path);
+
+                if path.is_dir() {
+                    vaults.extend(filter.apply(&path, info::scan(&path)?));
+                } else {
+                    vaults.push(path);
+                }
+            }
+
+            vaults.sort();
+
+            // the keys of a policy are read once, users are fetched from GitHub
+            let mut policies: HashMap<PathBuf, Option<Expected>> = HashMap::new();
+            let revoked = revoked::load()?;
+            let mut labels = BTreeMap::new();
+            let mut rows = Vec::new();
+
+            for vault in vaults {
+                let dir = fs::canonicalize(vault.parent().unwrap_or_else(|| Path::new(".")))?;
+
+                if !policies.contains_key(&dir) {
+                    let expected = match Policy::find(&dir)? {
+                        Some(policy) => {
+                            let keys = policy.public_keys()?;
+
+                            for key in &keys {
+                                labels.insert(
+                                    key.fingerprint(HashAlg::Sha256).to_string(),
+                                    key.comment().to_string(),
+                                );
+                            }
+
+                            Some(expected(&policy.path.display().to_string(), &keys)?)
+                        }
+                        None => None,
+                    };
+
+                    policies.insert(dir.clone(), expected);
+                }
+
+                rows.push(row(
+                    &vault.display().to_string(),
+                    &info::read_file(&vault)?,
+                    policies.get(&dir).and_then(Option::as_ref),
+                    &revoked,
+                ));
+            }
+
+            if json {
+                println!("{}", serde_json::to_string(&rows)?);
+            } else {
+                print!("{}", to_text(&rows, &labels, Style::stdout()));
+            }
+
+            let deviations = rows.iter().filter(|row| row.deviates()).count();
+
+            if deviations > 0 {
+                return Err(anyhow!(
+                    "{deviations} vault(s) deviate from the recipients of their policy or include revoked keys"
+                ));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+fn expected(policy: &str, keys: &[PublicKey]) -> Result<Expected> {
+    let mut expected = Expected {
+        policy: policy.to_string(),
+        ..Expected::default()
+    };
+
+    for key in keys {
+        let fingerprint = key.fingerprint(HashAlg::Sha256).to_string();
+
+        if let Some(key_data) = key.key_data().rsa() {
+            expected.aliases.insert(
+                md5_fingerprint(&RsaPublicKey::try_from(key_data)?)?,
+                fingerprint.clone(),
+            );
+        }
+
+        if !expected.fingerprints.contains(&fingerprint) {
+            expected.fingerprints.push(fingerprint);
+        }
+    }
+
+    Ok(expected)
+}
+
+fn row(path: &str, info: &VaultInfo, expected: Option<&Expected>, revoked: &[String]) -> Row {
+    let mut recipients: Vec<String> = Vec::new();
+    let mut revoked_recipients: Vec<String> = Vec::new();
+
+    for recipient in &info.recipients {
+        let fingerprint = expected
+            .and_then(|expected| expected.aliases.get(&recipient.fingerprint))
+            .unwrap_or(&recipient.fingerprint);
+
+        if (revoked.contains(&recipient.fingerprint) || revoked.contains(fingerprint))
+            && !revoked_recipients.contains(fingerprint)
+        {
+            revoked_recipients.push(fingerprint.clone());
+        }
+
+        if !recipients.contains(fingerprint) {
+            recipients.push(fingerprint.clone());
+        }
+    }
+
+    let (missing, unexpected) = expected.map_or_else(
+        || (Vec::new(), Vec::new()),
+        |expected| {
+            (
+                difference(&expected.fingerprints, &recipients),
+                difference(&recipients, &expected.fingerprints),
+            )
+        },
+    );
+
+    Row {
+        path: path.to_string(),
+        policy: expected.map(|expected| expected.policy.clone()),
+        recipients,
+        missing,
+        unexpected,
+        revoked: revoked_recipients,
+    }
+}
+
+fn difference(a: &[String], b: &[String]) -> Vec<String> {
+    a.iter().filter(|item| !b.contains(item)).cloned().collect()
+}
+
+// matrix of vaults × recipients, x: expected recipient, +: not in the policy,
+// -: in the policy but missing, !: revoked
+fn to_text(rows: &[Row], labels: &BTreeMap<String, String>, style: Style) -> String {
+    let mut columns: Vec<&String> = Vec::new();
+
+    for row in rows {
+        for fingerprint in row.recipients.iter().chain(&row.missing) {
+            if !columns.contains(&fingerprint) {
+                columns.push(fingerprint);
+            }
+        }
+    }
+
+    let mut out = String::from("Recipients:\n");
+
+    // on a terminal the labels start after the longest fingerprint
+    let fingerprint_width = if style.is_terminal() {
+        columns.iter().map(|f| f.len()).max().unwrap_or(0)
+    } else {
+        0
+    };
+
+    for (i, fingerprint) in columns.iter().enumerate() {
+        let label = labels.get(*fingerprint).map_or("", String::as_str);
+        let line = format!("  {:>3}  {fingerprint:fingerprint_width$}", i + 1);
+
+        if label.is_empty() {
+            out.push_str(line.trim_end());
+        } else {
+            out.push_str(&format!("{line} {}", style.paint(label, Color::Cyan)));
+        }
+        out.push('\n');
+    }
+
+    let width = rows.iter().map(|row| row.path.len()).max().unwrap_or(0);
+
+    out.push_str(&format!("\n{:width$}", ""));
+    for i in 0..columns.len() {
+        out.push_str(&format!(" {:>3}", i + 1));
+    }
+    out.push('\n');
+
+    for row in rows {
+        out.push_str(&format!("{:width$}", row.path));
+
+        for fingerprint in &columns {
+            let (cell, color) = if row.revoked.contains(fingerprint) {
+                ("!", Color::Red)
+            } else if row.unexpected.contains(fingerprint) {
+                ("+", Color::Yellow)
+            } else if row.missing.contains(fingerprint) {
+                ("-", Color::Red)
+            } else if row.recipients.contains(fingerprint) {
+                ("x", Color::Green)
+            } else {
+                (".", Color::Dim)
+            };
+            out.push_str(&format!(" {}", style.paint(&format!("{cell:>3}"), color)));
+        }
+
+        let (status, color) = match (&row.policy, row.deviates()) {
+            (None, _) => ("no policy", Color::Dim),
+            (Some(_), true) => ("deviates", Color::Red),
+            (Some(_), false) => ("ok", Color::Green),
+        };
+        out.push_str(&format!("  {}\n", style.paint(status, color)));
+    }
+
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::info::Recipient;
+
+    fn info(fingerprints: &[&str]) -> VaultInfo {
+        VaultInfo {
+            format: "V2".to_string(),
+            label: None,
+            edited: None,
+            expires: None,
+            recipients: fingerprints
+                .iter()
+                .map(|fingerprint| Recipient {
+                    key_type: "X25519".to_string(),
+                    fingerprint: (*fingerprint).to_string(),
+                })
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn test_row() {
+        let mut expected = Expected {
+            policy: ".ssh-vault.yml".to_string(),
+            fingerprints: vec!["SHA256:a".to_string(), "SHA256:b".to_string()],
+            ..Expected::default()
+        };
+        expected
+            .aliases
+            .insert("aa:bb".to_string(), "SHA256:b".to_string());
+
+        let row = row(
+            "ok.vault",
+            &info(&["SHA256:a", "aa:bb"]),
+            Some(&expected),
+            &[],
+        );
+        assert_eq!(row.recipients, vec!["SHA256:a", "SHA256:b"]);
+        assert!(!row.deviates());
+
+        let row = super::row(
+            "bad.vault",
+            &info(&["SHA256:a", "SHA256:c"]),
+            Some(&expected),
+            &[],
+        );
+        assert_eq!(row.missing, vec!["SHA256:b"]);
+        assert_eq!(row.unexpected, vec!["SHA256:c"]);
+        assert!(row.deviates());
+
+        let row = super::row("free.vault", &info(&["SHA256:c"]), None, &[]);
+        assert_eq!(row.policy, None);
+        assert!(!row.deviates());
+
+        // legacy vaults use the MD5 fingerprint of RSA keys
+        let row = super::row("old.vault", &info(&["aa:bb"]), None, &["aa:bb".to_string()]);
+        assert_eq!(row.revoked, vec!["aa:bb"]);
+        assert!(row.deviates());
+    }
+
+    #[test]
+    fn test_to_text() {
+        let expected = Expected {
+            policy: ".ssh-vault.yml".to_string(),
+            fingerprints: vec!["SHA256:a".to_string(), "SHA256:b".to_string()],
+            ..Expected::default()
+        };
+        let rows = vec![
+            row(
+                "a.vault",
+                &info(&["SHA256:a", "SHA256:b"]),
+                Some(&expected),
+                &[],
+            ),
+            row(
+                "bb.vault",
+                &info(&["SHA256:a", "SHA256:c"]),
+                Some(&expected),
+                &["SHA256:a".to_string()],
+            ),
+        ];
+        let labels = BTreeMap::from([("SHA256:a".to_string(), "alice".to_string())]);
+
+        assert_eq!(
+            to_text(&rows, &labels, Style::plain()),
+            "Recipients:
+    1  SHA256:a alice
+    2  SHA256:b
+    3  SHA256:c
+
+           1   2   3
+a.vault    x   x   .  ok
+bb.vault   !   -   +  deviates
+"
+        );
+    }
+}
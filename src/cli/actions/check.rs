@@ -0,0 +1,322 @@
+use crate::cli::actions::Action;
+use crate::style::{Color, Style};
+use crate::vault::{expiry, find, info, ssh::decrypt_private_key, stream, SshKeyType, SshVault};
+use anyhow::{anyhow, Result};
+use std::{
+    fmt, fs,
+    io::BufReader,
+    path::{Path, PathBuf},
+};
+use zeroize::Zeroize;
+
+#[derive(Debug, PartialEq, Eq)]
+enum Status {
+    // fingerprint of the key that opens the vault
+    Open(String),
+    // the key opens the vault but its expiry is past, seconds since the epoch
+    Expired(String, u64),
+    // dual control vault, the key only has a share
+    Share(String),
+    Denied,
+}
+
+impl Status {
+    const fn word(&self) -> (&'static str, Color) {
+        match self {
+            Self::Open(_) => ("ok", Color::Green),
+            Self::Expired(..) => ("EXPIRED", Color::Yellow),
+            Self::Share(_) => ("share", Color::Cyan),
+            Self::Denied => ("FAILED", Color::Red),
+        }
+    }
+
+    fn detail(&self) -> String {
+        match self {
+            Self::Open(fingerprint) => fingerprint.to_string(),
+            Self::Expired(fingerprint, time) => {
+                format!("{fingerprint} on {}", expiry::date(*time))
+            }
+            Self::Share(fingerprint) => {
+                format!("{fingerprint} needs the share of the other recipient")
+            }
+            Self::Denied => "none of the keys can open it".to_string(),
+        }
+    }
+}
+
+impl fmt::Display for Status {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{:<7} {}", self.word().0, self.detail())
+    }
+}
+
+/// Handle the check action
+/// # Errors
+/// Will return an error if no key is found or a vault can't be opened
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Check {
+            exclude,
+            include,
+            keys,
+            paths,
+        } => {
+            let identities = identities(keys)?;
+            let filter = info::Filter::new(&include, &exclude)?;
+
+            let paths = if paths.is_empty() {
+                vec![String::from(".")]
+            } else {
+                paths
+            };
+
+            let mut vaults = Vec::new();
+
+            for path in paths {
+                let path = PathBuf::from(path);
+
+                if path.is_dir() {
+                    vaults.extend(filter.apply(&path, info::scan(&path)?));
+                } else {
+                    vaults.push(path);
+                }
+            }
+
+            vaults.sort();
+
+            let mut denied = 0;
+            let mut expired = 0;
+
+            let style = Style::stdout();
+
+            // on a terminal the statuses start after the longest path
+            let width = if style.is_terminal() {
+                vaults
+                    .iter()
+                    .map(|vault| vault.display().to_string().len() + 1)
+                    .max()
+                    .unwrap_or_default()
+            } else {
+                0
+            };
+
+            for vault in &vaults {
+                let status = check(&identities, vault)?;
+
+                match status {
+                    Status::Denied => denied += 1,
+                    Status::Expired(..) => expired += 1,
+                    _ => {}
+                }
+
+                println!("{}", line(vault, &status, width, style));
+            }
+
+            if expired > 0 {
+                eprintln!("{expired} vault(s) expired, rotate the secrets");
+            }
+
+            if denied > 0 {
+                return Err(anyhow!(
+                    "{denied} of {} vault(s) can't be opened with the keys",
+                    vaults.len()
+                ));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// `path: status fingerprint`, the path padded to the width
+fn line(vault: &Path, status: &Status, width: usize, style: Style) -> String {
+    let (word, color) = status.word();
+
+    format!(
+        "{:width$} {} {}",
+        format!("{}:", vault.display()),
+        style.paint(&format!("{word:<7}"), color),
+        status.detail()
+    )
+}
+
+// the private keys to check, the passphrases cached by the agent are used
+fn identities(keys: Vec<String>) -> Result<Vec<SshVault>> {
+    let keys = if keys.is_empty() {
+        find::default_identities()
+            .iter()
+            .map(|path| path.display().to_string())
+            .collect()
+    } else {
+        keys
+    };
+
+    let mut identities = Vec::new();
+
+    for key in keys {
+        // the key type is only used to find the default key
+        let mut private_key = find::private_key(Some(key.clone()), &SshKeyType::Ed25519)?;
+
+        if private_key.is_encrypted() {
+            private_key = decrypt_private_key(&private_key, None)?;
+        }
+
+        match find::key_type(&private_key.algorithm()) {
+            Ok(key_type) => identities.push(SshVault::new(&key_type, None, Some(private_key))?),
+            Err(e) => eprintln!("Skipping {key}: {e}"),
+        }
+    }
+
+    if identities.is_empty() {
+        return Err(anyhow!("No private keys found, use option -k"));
+    }
+
+    Ok(identities)
+}
+
+// only the key of a streamed vault is decrypted, a legacy vault is decrypted
+// and its plaintext discarded
+fn check(identities: &[SshVault], path: &Path) -> Result<Status> {
+    if !info::is_vault(path) {
+        return Err(anyhow!("{} is not a vault", path.display()));
+    }
+
+    let mut data = fs::read(path)?;
+
+    let status = if data.starts_with(stream::MAGIC.as_bytes()) {
+        let header = stream::Header::read(&mut BufReader::new(&data[..]))?;
+
+        identities
+            .iter()
+            .find_map(|identity| {
+                let fingerprint = identity.fingerprint();
+
+                // the expiry is verified with the vault key
+                if header.unwrap(identity).is_ok() {
+                    match &header.expires {
+                        Some(expiry) if expiry.is_expired() => {
+                            Some(Status::Expired(fingerprint, expiry.time))
+                        }
+                        _ => Some(Status::Open(fingerprint)),
+                    }
+                } else if header
+                    .shares
+                    .iter()
+                    .flatten()
+                    .any(|stanza| stanza.fingerprint == fingerprint)
+                {
+                    Some(Status::Share(fingerprint))
+                } else {
+                    None
+                }
+            })
+            .unwrap_or(Status::Denied)
+    } else {
+        identities
+            .iter()
+            .find_map(|identity| {
+                identity.open(&data).ok().map(|mut plaintext| {
+                    plaintext.zeroize();
+                    Status::Open(identity.fingerprint())
+                })
+            })
+            .unwrap_or(Status::Denied)
+    };
+
+    data.zeroize();
+
+    Ok(status)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{crypto, expiry::Expiry, fips, metadata::Metadata};
+
+    #[test]
+    fn test_check() {
+        let dir = tempfile::tempdir().unwrap();
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+
+        let path = dir.path().join("secret.vault");
+        let mut vault = Vec::new();
+        stream::encrypt(&[recipient], &b"secret"[..], &mut vault).unwrap();
+        fs::write(&path, vault).unwrap();
+
+        let identities = identities(vec!["test_data/ed25519".to_string()]).unwrap();
+        assert_eq!(
+            check(&identities, &path).unwrap(),
+            Status::Open(identities[0].fingerprint())
+        );
+
+        // a vault for another key
+        let path = dir.path().join("other.vault");
+        fs::write(
+            &path,
+            "SSH-VAULT;V2\n-> X25519 SHA256:other c2FsdA== a2V5\n---\n",
+        )
+        .unwrap();
+        assert_eq!(check(&identities, &path).unwrap(), Status::Denied);
+
+        assert!(check(&identities, Path::new("test_data/ed25519.pub")).is_err());
+    }
+
+    #[test]
+    fn test_check_expired() {
+        let dir = tempfile::tempdir().unwrap();
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+        let key = crypto::gen_password().unwrap();
+
+        let header = stream::Header {
+            stanzas: stream::wrap(&[recipient], &key).unwrap(),
+            shares: Vec::new(),
+            cipher: fips::cipher().unwrap(),
+            metadata: Metadata::default(),
+            label: None,
+            edited: None,
+            expires: Some(Expiry::new(1_700_000_000, &key).unwrap()),
+            mac: None,
+        };
+
+        let path = dir.path().join("token.vault");
+        let mut vault = Vec::new();
+        stream::encrypt_with_key(&header, &key, &b"token"[..], &mut vault).unwrap();
+        fs::write(&path, &vault).unwrap();
+
+        let identities = identities(vec!["test_data/ed25519".to_string()]).unwrap();
+        let status = check(&identities, &path).unwrap();
+        assert_eq!(
+            status,
+            Status::Expired(identities[0].fingerprint(), 1_700_000_000)
+        );
+        assert!(status.to_string().ends_with(" on 2023-11-14T22:13:20Z"));
+
+        // postponed without the key
+        let forged = String::from_utf8(vault)
+            .unwrap()
+            .replace(" 1700000000\n", " 4000000000\n");
+        fs::write(&path, forged).unwrap();
+        assert_eq!(check(&identities, &path).unwrap(), Status::Denied);
+    }
+
+    #[test]
+    fn test_line() {
+        let vault = Path::new("db/token.vault");
+
+        assert_eq!(
+            line(vault, &Status::Denied, 0, Style::plain()),
+            "db/token.vault: FAILED  none of the keys can open it"
+        );
+        assert_eq!(
+            line(
+                vault,
+                &Status::Open("SHA256:abc".to_string()),
+                18,
+                Style::aligned()
+            ),
+            "db/token.vault:    ok      SHA256:abc"
+        );
+    }
+}
@@ -0,0 +1,282 @@
+use crate::audit;
+use crate::cli::actions::{open_vault, redacted, unquote, Action};
+use crate::style::{Color, Style};
+use crate::vault::{diff, dio, values};
+use anyhow::{anyhow, Context, Result};
+use std::fs::{self, File};
+use zeroize::Zeroize;
+
+// the keys of a document with their values, in order
+type Values = Vec<(String, String)>;
+
+/// Handle the compare action
+/// # Errors
+/// Will return an error if the vault can't be opened or the file drifted from it
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Compare {
+            diff,
+            file,
+            key,
+            passphrase,
+            vault,
+        } => {
+            let mut plaintext = Vec::new();
+            let (ssh_vault, _, _) = open_vault(
+                File::open(&vault).with_context(|| format!("Could not open {vault}"))?,
+                &mut plaintext,
+                key,
+                passphrase,
+            )?;
+
+            let rs = fs::read(&file)
+                .with_context(|| format!("Could not read {file}"))
+                .map(|mut deployed| {
+                    let report = if diff {
+                        redacted_diff(&plaintext, &deployed, &file, Style::stdout())
+                    } else {
+                        summary(&plaintext, &deployed, &file)
+                    };
+                    deployed.zeroize();
+                    report
+                });
+            plaintext.zeroize();
+            let report = rs?;
+
+            audit::log("compare", Some(&vault), &ssh_vault.fingerprint());
+
+            if report.is_empty() {
+                eprintln!("{file} matches {vault}");
+                return Ok(());
+            }
+
+            print!("{report}");
+
+            Err(anyhow!("{file} has drifted from {vault}"))
+        }
+        _ => unreachable!(),
+    }
+}
+
+// The keys that differ, or the number of lines if the file has no keys
+fn summary(vault: &[u8], deployed: &[u8], path: &str) -> String {
+    if vault == deployed {
+        return String::new();
+    }
+
+    if dio::is_binary(vault) || dio::is_binary(deployed) {
+        return binary(vault, deployed);
+    }
+
+    let (Ok(vault), Ok(deployed)) = (std::str::from_utf8(vault), std::str::from_utf8(deployed))
+    else {
+        return binary(vault, deployed);
+    };
+
+    if let Some((mut ours, mut theirs)) = document_values(vault, deployed, path) {
+        let mut out = String::new();
+
+        for (key, value) in &ours {
+            match theirs.iter().find(|(other, _)| other == key) {
+                Some((_, other)) if other != value => out.push_str(&format!("~ {key}\n")),
+                Some(_) => {}
+                None => out.push_str(&format!("- {key}\n")),
+            }
+        }
+
+        for (key, _) in &theirs {
+            if !ours.iter().any(|(other, _)| other == key) {
+                out.push_str(&format!("+ {key}\n"));
+            }
+        }
+
+        for (_, value) in ours.iter_mut().chain(theirs.iter_mut()) {
+            value.zeroize();
+        }
+
+        if out.is_empty() {
+            out.push_str("The values match, the comments or the layout differ\n");
+        }
+
+        return out;
+    }
+
+    let vault: Vec<&str> = vault.lines().collect();
+    let deployed: Vec<&str> = deployed.lines().collect();
+    let lines = diff::lines(&vault, &deployed);
+
+    let removed = lines
+        .iter()
+        .filter(|line| matches!(line, diff::Line::Removed(_)))
+        .count();
+    let added = lines
+        .iter()
+        .filter(|line| matches!(line, diff::Line::Added(_)))
+        .count();
+
+    if removed == 0 && added == 0 {
+        return String::from("The line endings differ\n");
+    }
+
+    format!("{removed} line(s) only in the vault, {added} line(s) only in {path}\n")
+}
+
+// The lines that differ in the unified format, masked like view --redact
+fn redacted_diff(vault: &[u8], deployed: &[u8], path: &str, style: Style) -> String {
+    if vault == deployed {
+        return String::new();
+    }
+
+    if dio::is_binary(vault) || dio::is_binary(deployed) {
+        return binary(vault, deployed);
+    }
+
+    let (Ok(vault), Ok(deployed)) = (std::str::from_utf8(vault), std::str::from_utf8(deployed))
+    else {
+        return binary(vault, deployed);
+    };
+
+    let mut unified = diff::unified(vault, deployed, 3);
+
+    let out = unified
+        .lines()
+        .map(|line| {
+            let (sign, text) = line.split_at(1);
+
+            let (text, color) = match sign {
+                "@" => (line.to_string(), Color::Cyan),
+                _ if text.trim().is_empty() => (line.to_string(), Color::Dim),
+                _ => (
+                    format!(
+                        "{sign}{}",
+                        redacted(text.as_bytes(), Some(path)).trim_end_matches('\n')
+                    ),
+                    match sign {
+                        "-" => Color::Red,
+                        "+" => Color::Green,
+                        _ => Color::Dim,
+                    },
+                ),
+            };
+
+            format!("{}\n", style.paint(&text, color))
+        })
+        .collect::<String>();
+
+    unified.zeroize();
+
+    if out.is_empty() {
+        return String::from("The line endings differ\n");
+    }
+
+    out
+}
+
+fn binary(vault: &[u8], deployed: &[u8]) -> String {
+    format!(
+        "The binary content differs, {} bytes in the vault and {} deployed\n",
+        vault.len(),
+        deployed.len()
+    )
+}
+
+// The keys and values of both documents in the first format that reads both,
+// the one of the name of the deployed file first
+fn document_values(vault: &str, deployed: &str, path: &str) -> Option<(Values, Values)> {
+    let mut formats: Vec<Box<dyn values::Format>> = Vec::new();
+
+    if let Ok(format) = values::format(None, Some(path)) {
+        formats.push(format);
+    }
+
+    formats.push(Box::new(values::dotenv::Dotenv));
+    formats.push(Box::new(values::json::Json));
+    formats.push(Box::new(values::yaml::Yaml));
+
+    formats.iter().find_map(|format| {
+        let ours = keys(format.as_ref(), vault)?;
+        let theirs = keys(format.as_ref(), deployed)?;
+        Some((ours, theirs))
+    })
+}
+
+// None if the document is not valid or has no keys, a plain text is a YAML
+// scalar without a key
+fn keys(format: &dyn values::Format, doc: &str) -> Option<Values> {
+    let mut keys = Vec::new();
+
+    let mut rs = format.map_values(doc, &mut |key, value| {
+        if !key.is_empty() {
+            keys.push((key.to_string(), unquote(value)));
+        }
+        Ok(value.to_string())
+    });
+
+    if let Ok(doc) = rs.as_mut() {
+        doc.zeroize();
+    }
+
+    if rs.is_ok() && !keys.is_empty() {
+        Some(keys)
+    } else {
+        for (_, value) in &mut keys {
+            value.zeroize();
+        }
+        None
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_summary() {
+        assert_eq!(summary(b"A=1\n", b"A=1\n", "app.env"), "");
+        assert_eq!(
+            summary(
+                b"USER=app\nPASSWORD=hunter2\nOLD=1\n",
+                b"USER=app\nPASSWORD='hunter3'\nNEW=1\n",
+                "app.env"
+            ),
+            "~ PASSWORD\n- OLD\n+ NEW\n"
+        );
+        assert_eq!(
+            summary(b"A=1\n", b"# deployed\nA='1'\n", "app.env"),
+            "The values match, the comments or the layout differ\n"
+        );
+        assert_eq!(
+            summary(
+                b"db:\n  user: app\n  password: a\n",
+                b"db:\n  password: b\n",
+                "config.yml"
+            ),
+            "- db.user\n~ db.password\n"
+        );
+        assert_eq!(
+            summary(b"secret\nsame\n", b"other\nsame\nmore\n", "key.pem"),
+            "1 line(s) only in the vault, 2 line(s) only in key.pem\n"
+        );
+        assert_eq!(
+            summary(b"\0\x01", b"\0\x02\x03", "blob"),
+            "The binary content differs, 2 bytes in the vault and 3 deployed\n"
+        );
+    }
+
+    #[test]
+    fn test_redacted_diff() {
+        let diff = redacted_diff(
+            b"USER=app\nPASSWORD=\"correct horse\"\n",
+            b"USER=app\nPASSWORD=\"correct horses\"\n",
+            "app.env",
+            Style::plain(),
+        );
+
+        assert_eq!(
+            diff,
+            "@@ -1,2 +1,2 @@\n USER=\"******** [3]\"\n-PASSWORD=\"co****se [13]\"\n\
+             +PASSWORD=\"co****es [14]\"\n"
+        );
+        assert!(!diff.contains("correct"));
+    }
+}
@@ -1,10 +1,24 @@
 use crate::cli::actions::{process_input, Action};
-use crate::vault::{crypto, dio, find, online, remote, SshVault};
+use crate::vault::{
+    crypto, dio, dio::InputSource, expiry::Expiry, find, fips, known_keys, label::Label,
+    metadata::Metadata, online, permissions, policy::Policy, remote, revoked, stream,
+    stream::Header, SshVault,
+};
+use crate::{
+    audit,
+    hooks::{self, Stage},
+    progress::Progress,
+};
 use anyhow::{anyhow, Result};
 use secrecy::Secret;
 use serde::{Deserialize, Serialize};
-use ssh_key::PublicKey;
-use std::io::{Read, Write};
+use ssh_key::{HashAlg, PublicKey};
+use std::{
+    env,
+    io::{BufWriter, Write},
+    path::Path,
+};
+use zeroize::Zeroize;
 
 #[derive(Serialize, Deserialize)]
 pub struct JsonVault {
@@ -17,13 +31,24 @@ pub struct JsonVault {
 pub fn handle(action: Action) -> Result<()> {
     match action {
         Action::Create {
+            dual_control,
+            expires,
+            file_mode,
             fingerprint,
             key,
+            recipients,
+            strict,
             user,
             vault,
             json,
             input,
+            label,
+            preserve,
+            quiet,
         } => {
+            // e.g. a policy check, fails before anything is written
+            hooks::run(Stage::Pre, "create", vault.as_deref())?;
+
             // print the url from where to download the key
             let mut helper: Option<String> = None;
 
@@ -41,6 +66,24 @@ pub fn handle(action: Action) -> Result<()> {
                 // search key using -k or -f options
                 let ssh_key = remote::get_user_key(&keys, int_key, fingerprint)?;
 
+                if user != "new" {
+                    // the key must match the fingerprints pinned in the policy of the vault
+                    let dir = env::current_dir()?.join(
+                        vault
+                            .as_deref()
+                            .filter(|path| *path != "-")
+                            .and_then(|path| Path::new(path).parent())
+                            .unwrap_or_else(|| Path::new("")),
+                    );
+
+                    if let Some(policy) = Policy::find(&dir)? {
+                        policy.check_pin(&user, &ssh_key)?;
+                    }
+
+                    // warn or fail if the key changed since it was first used
+                    known_keys::check(&user, &keys, &ssh_key, strict)?;
+                }
+
                 // if user equals "new" then we need to create a new key
                 if let Ok(key) = online::get_private_key_id(&ssh_key, &user) {
                     if !key.is_empty() {
@@ -53,48 +96,142 @@ pub fn handle(action: Action) -> Result<()> {
                 find::public_key(key)?
             };
 
-            let key_type = find::key_type(&ssh_key.algorithm())?;
+            let key_fingerprint = ssh_key.fingerprint(HashAlg::Sha256).to_string();
+            let vault_path = vault.clone();
+
+            let mut keys = vec![ssh_key];
+
+            // the other keys that can open the vault
+            for path in &recipients {
+                keys.extend(find::public_keys(path)?);
+            }
 
-            let v = SshVault::new(&key_type, Some(ssh_key), None)?;
+            revoked::check(&keys)?;
 
-            let mut buffer = Vec::new();
+            let mut ssh_vaults = Vec::new();
+            for key in keys {
+                let key_type = find::key_type(&key.algorithm())?;
+                ssh_vaults.push(SshVault::new(&key_type, Some(key), None)?);
+            }
+
+            let vault_key = crypto::gen_password()?;
+
+            // mode, owner and mtime of the input file to restore it
+            let metadata = match input.as_deref().filter(|path| *path != "-") {
+                Some(path) => {
+                    Metadata::from_file(Path::new(path), &preserve)?.tagged(&vault_key)?
+                }
+                None => Metadata::default(),
+            };
+
+            let label = label
+                .map(|label| Label::new(&label, &vault_key))
+                .transpose()?;
+
+            let expires = expires
+                .map(|duration| Expiry::after(duration, &vault_key))
+                .transpose()?;
+
+            let header = if dual_control {
+                let [first, second] = ssh_vaults.as_slice() else {
+                    return Err(anyhow!(
+                        "Dual control requires a single recipient besides the key"
+                    ));
+                };
+
+                Header {
+                    stanzas: Vec::new(),
+                    shares: vec![stream::wrap_dual(first, second, &vault_key)?],
+                    cipher: fips::cipher()?,
+                    metadata,
+                    label,
+                    edited: None,
+                    expires,
+                    mac: None,
+                }
+            } else {
+                Header {
+                    stanzas: stream::wrap(&ssh_vaults, &vault_key)?,
+                    shares: Vec::new(),
+                    cipher: fips::cipher()?,
+                    metadata,
+                    label,
+                    edited: None,
+                    expires,
+                    mac: None,
+                }
+            };
 
             // check if we need to skip the editor filename == "-"
             let skip_editor = input.as_ref().map_or(false, |stdin| stdin == "-");
 
+            if let Some(path) = vault.as_deref().filter(|path| *path != "-") {
+                permissions::check_vault_dir(Path::new(path));
+            }
+
             // setup Reader(input) and Writer (output)
-            let (mut input, output) = dio::setup_io(input, vault)?;
+            let (input, output) = dio::setup_io_with_mode(input, vault, file_mode)?;
 
             if !output.is_empty()? {
                 return Err(anyhow!("Vault file already exists"));
             }
 
-            if input.is_terminal() {
-                if skip_editor {
-                    input.read_to_end(&mut buffer)?;
-                } else {
-                    // use editor to handle input
-                    process_input(&mut buffer, None)?;
-                }
+            if json || helper.is_some() {
+                // the vault is embedded in the output
+                let mut vault = Vec::new();
+                encrypt(&header, &vault_key, input, skip_editor, quiet, &mut vault)?;
+
+                // return JSON or plain text, the helper is used to decrypt the vault
+                format(output, String::from_utf8(vault)?, json, helper)?;
             } else {
-                // read from stdin
-                input.read_to_end(&mut buffer)?;
+                encrypt(
+                    &header,
+                    &vault_key,
+                    input,
+                    skip_editor,
+                    quiet,
+                    BufWriter::new(output),
+                )?;
             }
 
-            // generate password (32 rand chars)
-            let password: Secret<[u8; 32]> = crypto::gen_password()?;
-
-            // create vault
-            let vault = v.create(password, &mut buffer)?;
+            audit::log("create", vault_path.as_deref(), &key_fingerprint);
 
-            // return JSON or plain text, the helper is used to decrypt the vault
-            format(output, vault, json, helper)?;
+            hooks::run(Stage::Post, "create", vault_path.as_deref())?;
         }
         _ => unreachable!(),
     }
     Ok(())
 }
 
+// Encrypt the input a chunk at a time, using the editor if it's a terminal
+fn encrypt<W: Write>(
+    header: &Header,
+    key: &Secret<[u8; 32]>,
+    input: InputSource,
+    skip_editor: bool,
+    quiet: bool,
+    output: W,
+) -> Result<()> {
+    if input.is_terminal() && !skip_editor {
+        let mut buffer = Vec::new();
+
+        // use editor to handle input
+        process_input(&mut buffer, None, None)?;
+
+        let rs = stream::encrypt_with_key(header, key, buffer.as_slice(), output);
+        buffer.zeroize();
+        return rs;
+    }
+
+    let size = input.size();
+    stream::encrypt_with_key(
+        header,
+        key,
+        Progress::new(input, "Encrypting", size, quiet),
+        output,
+    )
+}
+
 fn format<W: Write>(
     mut output: W,
     vault: String,
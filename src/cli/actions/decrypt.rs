@@ -0,0 +1,87 @@
+use crate::cli::actions::{decrypt_with_metadata, encrypt::EXTENSION, Action};
+use crate::vault::{dio, ssh::prompt};
+use crate::{audit, progress::Progress};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    fs::File,
+    io::{self, BufReader, BufWriter, Write},
+    path::Path,
+};
+use tempfile::NamedTempFile;
+
+/// Handle the decrypt action
+/// # Errors
+/// Will return an error if the vault can't be decrypted or the file exists
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Decrypt {
+            file_mode,
+            force,
+            key,
+            passphrase,
+            quiet,
+            restore_owner,
+            vault,
+        } => {
+            // a filter from stdin to stdout, nothing is asked on the terminal
+            if vault == "-" {
+                prompt::disable();
+
+                let mut output = BufWriter::new(io::stdout().lock());
+
+                let (key_fingerprint, _) =
+                    decrypt_with_metadata(io::stdin().lock(), &mut output, key, passphrase, false)?;
+                output.flush()?;
+
+                audit::log("view", None, &key_fingerprint);
+
+                return Ok(());
+            }
+
+            let file = vault
+                .strip_suffix(EXTENSION)
+                .filter(|file| !file.is_empty() && !file.ends_with('/'))
+                .ok_or_else(|| {
+                    anyhow!("{vault} doesn't end with {EXTENSION}, use view -o to choose the file")
+                })?;
+
+            let path = Path::new(file);
+
+            if path.exists() && !force {
+                return Err(anyhow!("{file} already exists, use --force to replace it"));
+            }
+
+            let input = File::open(&vault).with_context(|| format!("Could not open {vault}"))?;
+            let size = input.metadata()?.len();
+            let input = BufReader::new(Progress::new(input, "Decrypting", Some(size), quiet));
+
+            // decrypt next to the vault, the file is only replaced once complete
+            let dir = path
+                .parent()
+                .filter(|dir| !dir.as_os_str().is_empty())
+                .unwrap_or_else(|| Path::new("."));
+            let mut tmp = NamedTempFile::new_in(dir)?;
+
+            let (key_fingerprint, metadata) =
+                decrypt_with_metadata(input, tmp.as_file_mut(), key, passphrase, false)?;
+            tmp.as_file_mut().flush()?;
+
+            #[cfg(unix)]
+            {
+                use std::os::unix::fs::PermissionsExt;
+                tmp.as_file()
+                    .set_permissions(std::fs::Permissions::from_mode(file_mode))?;
+            }
+
+            metadata.restore(tmp.path(), file_mode, restore_owner)?;
+
+            dio::persist(tmp, path)?;
+
+            audit::log("view", Some(&vault), &key_fingerprint);
+
+            eprintln!("{vault} -> {file}");
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
@@ -0,0 +1,62 @@
+use crate::audit;
+use crate::cli::actions::{decrypt, Action};
+use crate::vault::dotenv;
+use anyhow::{Context, Result};
+use std::{fs::File, io::BufReader};
+use zeroize::Zeroize;
+
+/// Handle the direnv action
+/// # Errors
+/// Will return an error if the vault can't be decrypted or it has invalid lines
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Direnv { key, vault, watch } => {
+            let input = File::open(&vault).with_context(|| format!("Could not open {vault}"))?;
+
+            let mut data = Vec::new();
+            let rs = decrypt(BufReader::new(input), &mut data, key, None)
+                .and_then(|fingerprint| Ok((fingerprint, exports(std::str::from_utf8(&data)?)?)));
+            data.zeroize();
+
+            let (fingerprint, mut exports) = rs?;
+
+            if watch {
+                println!("watch_file {}", shell_words::quote(&vault));
+            }
+
+            print!("{exports}");
+            exports.zeroize();
+
+            audit::log("view", Some(&vault), &fingerprint);
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+/// Export lines of the variables, quoted to be evaluated by the shell
+/// # Errors
+/// Will return an error if a line is not a valid assignment
+pub fn exports(data: &str) -> Result<String> {
+    let mut out = String::new();
+
+    for (key, mut value) in dotenv::parse(data)? {
+        out.push_str(&format!("export {key}={}\n", shell_words::quote(&value)));
+        value.zeroize();
+    }
+
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_exports() {
+        assert_eq!(
+            exports("USER=app\nPASSWORD=\"it's $ecret\"\n").unwrap(),
+            "export USER=app\nexport PASSWORD='it'\\''s $ecret'\n"
+        );
+    }
+}
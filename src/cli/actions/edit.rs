@@ -1,8 +1,22 @@
-use crate::cli::actions::{process_input, Action};
-use crate::vault::{crypto, dio, find, parse, ssh::decrypt_private_key, SshVault};
-use anyhow::Result;
+use crate::cli::actions::{
+    edit_file, edit_file_with, editor_tempfile, merge, open_vault, shred, shred_on_interrupt,
+    Action, EditorTimeout,
+};
+use crate::vault::{dio, history, last_edit::LastEdit, lock::Lock, stream, SshVault};
+use crate::{
+    audit, config,
+    hooks::{self, Stage},
+    interrupt,
+};
+use anyhow::{anyhow, Result};
 use secrecy::Secret;
-use std::io::{Read, Write};
+use sha2::{Digest, Sha256};
+use std::{
+    fs::{self, File},
+    io::{self, BufRead, BufReader, BufWriter, Read},
+    path::Path,
+};
+use tempfile::{Builder, NamedTempFile};
 
 /// Handle the edit action
 /// # Errors
@@ -10,55 +24,325 @@ use std::io::{Read, Write};
 pub fn handle(action: Action) -> Result<()> {
     match action {
         Action::Edit {
+            force,
             key,
-            vault,
+            vault: vault_path,
             passphrase,
+            timeout,
         } => {
-            let mut vault_data = String::new();
+            hooks::run(Stage::Pre, "edit", Some(&vault_path))?;
 
-            // set the R/W streams
-            let (mut input, mut output) = dio::setup_io(Some(vault.clone()), Some(vault))?;
+            // prevent others from editing the vault at the same time
+            let _lock = Lock::acquire(&vault_path)?;
 
-            // read the vault content
-            input.read_to_string(&mut vault_data)?;
+            // new files are created next to the vault so they can be renamed over it
+            let dir = Path::new(&vault_path)
+                .parent()
+                .filter(|dir| !dir.as_os_str().is_empty())
+                .unwrap_or_else(|| Path::new("."));
 
-            // parse the vault
-            let (key_type, fingerprint, password, data) = parse(&vault_data)?;
+            // copy the vault to detect changes made by others while editing
+            let mut base = Builder::new().prefix(".vault-").tempfile_in(dir)?;
+            io::copy(&mut File::open(&vault_path)?, base.as_file_mut())?;
 
-            // find the private_key using the vault header AES256 or CHACHA20-POLY1305
-            let mut private_key = find::private_key_type(key, key_type)?;
+            // the decrypted vault is only on disk while editing
+            let mut tmpfile = editor_tempfile()?;
 
-            // decrypt private_key if encrypted
-            if private_key.is_encrypted() {
-                private_key = decrypt_private_key(&private_key, passphrase)?;
-            }
+            let mut mine = Builder::new().prefix(".vault-").tempfile_in(dir)?;
+
+            // if interrupted the decrypted vault is shredded, the copies and
+            // the lock removed and the vault left untouched
+            let _shred = shred_on_interrupt(&tmpfile);
+            let _remove = {
+                let copies = [base.path().to_path_buf(), mine.path().to_path_buf()];
 
-            // RSA or ED25519
-            let key_type = find::key_type(&private_key.algorithm())?;
+                interrupt::on_interrupt(move || {
+                    for copy in copies {
+                        let _ = fs::remove_file(copy);
+                    }
+                })
+            };
 
-            // initialize the vault
-            let vault = SshVault::new(&key_type, None, Some(private_key))?;
+            let rs = edit(
+                &base,
+                &mut tmpfile,
+                &mut mine,
+                key,
+                passphrase,
+                timeout,
+                force,
+            );
 
-            // decrypt the vault
-            let secret = vault.view(&password, &data, &fingerprint)?;
+            // Fill the file with zeros
+            shred(&tmpfile)?;
 
-            // store the new encrypted data
-            let mut new_secret = Vec::new();
+            let (ssh_vault, changed) = rs?;
+            let key_fingerprint = ssh_vault.fingerprint();
 
-            // use the EDITOR env var to edit the existing secret
-            process_input(&mut new_secret, Some(Secret::new(secret)))?;
+            if !changed {
+                audit::log("edit", Some(&vault_path), &key_fingerprint);
+                eprintln!("unchanged");
+                return Ok(());
+            }
 
-            // generate password (32 rand chars)
-            let password: Secret<[u8; 32]> = crypto::gen_password()?;
+            if same_content(Path::new(&vault_path), base.path())? {
+                // save the vault, keeping its permissions
+                fs::set_permissions(mine.path(), fs::metadata(&vault_path)?.permissions())?;
+                history::persist(mine, Path::new(&vault_path))?;
+            } else {
+                // don't clobber the changes someone else made while editing
+                merge_edits(&vault_path, &ssh_vault, base, mine)?;
+            }
 
-            // create vault
-            let out = vault.create(password, &mut new_secret)?;
+            audit::log("edit", Some(&vault_path), &key_fingerprint);
 
-            // save the vault
-            output.truncate()?;
-            output.write_all(out.as_bytes())?;
+            // e.g. git add, only when the vault changed
+            hooks::run(Stage::Post, "edit", Some(&vault_path))?;
         }
         _ => unreachable!(),
     }
     Ok(())
 }
+
+// Decrypt the vault into the tmpfile, open it with the editor and encrypt it
+// into mine, returns the key used and if mine was written
+#[allow(clippy::too_many_arguments)]
+fn edit(
+    base: &NamedTempFile,
+    tmpfile: &mut NamedTempFile,
+    mine: &mut NamedTempFile,
+    key: Option<String>,
+    passphrase: Option<Secret<String>>,
+    timeout: Option<EditorTimeout>,
+    force: bool,
+) -> Result<(SshVault, bool)> {
+    // keep the header and the key so the stanzas of the vault stay the same
+    let (ssh_vault, mut header, vault_key) =
+        open_vault(base.reopen()?, tmpfile.as_file_mut(), key, passphrase)?;
+
+    let before = digest(tmpfile.path())?;
+
+    let mut sample = Vec::new();
+    tmpfile
+        .reopen()?
+        .take(dio::BINARY_SAMPLE as u64)
+        .read_to_end(&mut sample)?;
+
+    if dio::is_binary(&sample) {
+        // a text editor would corrupt binary data
+        edit_file_with(&hex_editor()?, tmpfile, timeout)?;
+    } else {
+        // use the EDITOR env var to edit the existing secret
+        edit_file(tmpfile, timeout)?;
+    }
+
+    // don't encrypt again if nothing changed, it would only change the ciphertext
+    if !force && digest(tmpfile.path())? == before {
+        return Ok((ssh_vault, false));
+    }
+
+    // the editor may have replaced the file
+    let input = BufReader::new(tmpfile.reopen()?);
+
+    header.edited = Some(LastEdit::now(&ssh_vault, &vault_key)?);
+
+    stream::encrypt_with_key(
+        &header,
+        &vault_key,
+        input,
+        BufWriter::new(mine.as_file_mut()),
+    )?;
+
+    Ok((ssh_vault, true))
+}
+
+// The hex_editor of ~/.config/ssh-vault/config.yml or SSH_VAULT_HEX_EDITOR
+fn hex_editor() -> Result<String> {
+    config::get()?.get_string("hex_editor").map_err(|_| {
+        anyhow!(
+            "The vault contains binary data, set hex_editor in ~/.config/ssh-vault/config.yml \
+            (e.g. hexedit) or replace it with view -o and create -i"
+        )
+    })
+}
+
+// SHA256 of a file, read a block at a time
+fn digest(path: &Path) -> Result<[u8; 32]> {
+    let mut file = BufReader::new(File::open(path)?);
+    let mut hasher = Sha256::new();
+
+    loop {
+        let buf = file.fill_buf()?;
+
+        if buf.is_empty() {
+            return Ok(hasher.finalize().into());
+        }
+
+        hasher.update(buf);
+
+        let n = buf.len();
+        file.consume(n);
+    }
+}
+
+// Compare two files a block at a time
+fn same_content(a: &Path, b: &Path) -> Result<bool> {
+    if fs::metadata(a)?.len() != fs::metadata(b)?.len() {
+        return Ok(false);
+    }
+
+    let mut a = BufReader::new(File::open(a)?);
+    let mut b = BufReader::new(File::open(b)?);
+
+    loop {
+        let (buf_a, buf_b) = (a.fill_buf()?, b.fill_buf()?);
+
+        if buf_a.is_empty() || buf_b.is_empty() {
+            return Ok(buf_a.is_empty() && buf_b.is_empty());
+        }
+
+        let n = buf_a.len().min(buf_b.len());
+
+        if buf_a[..n] != buf_b[..n] {
+            return Ok(false);
+        }
+
+        a.consume(n);
+        b.consume(n);
+    }
+}
+
+// Merge the edits with the changes made to the vault on disk meanwhile, e.g.
+// by a git pull, if they conflict both are kept next to it to merge by hand
+fn merge_edits(
+    vault_path: &str,
+    ssh_vault: &SshVault,
+    base: NamedTempFile,
+    mine: NamedTempFile,
+) -> Result<()> {
+    let dir = Path::new(vault_path)
+        .parent()
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .unwrap_or_else(|| Path::new("."));
+
+    let mut merged = Builder::new().prefix(".vault-").tempfile_in(dir)?;
+
+    let rs = merge::merge_with(
+        ssh_vault,
+        &base.path().to_string_lossy(),
+        &mine.path().to_string_lossy(),
+        vault_path,
+        &mut merged,
+    );
+
+    match rs {
+        Ok(0) => {
+            fs::set_permissions(merged.path(), fs::metadata(vault_path)?.permissions())?;
+            history::persist(merged, Path::new(vault_path))?;
+            eprintln!("{vault_path} was modified while editing, your changes were merged into it");
+            Ok(())
+        }
+        Ok(conflicts) => Err(conflict(
+            vault_path,
+            base,
+            mine,
+            &format!("{conflicts} conflict(s)"),
+        )),
+        Err(e) => Err(conflict(vault_path, base, mine, &e.to_string())),
+    }
+}
+
+// Keep the original and the edited vault next to the one changed on disk
+fn conflict(
+    vault_path: &str,
+    base: NamedTempFile,
+    mine: NamedTempFile,
+    reason: &str,
+) -> anyhow::Error {
+    let base_path = format!("{vault_path}.base");
+    let mine_path = format!("{vault_path}.mine");
+
+    let save = base
+        .persist_noclobber(&base_path)
+        .and_then(|_| mine.persist_noclobber(&mine_path));
+
+    match save {
+        Ok(_) => anyhow!(
+            "{vault_path} was modified while editing and could not be merged with your changes \
+            ({reason}), refusing to overwrite it. Your changes were saved to {mine_path} and the \
+            original vault to {base_path}, merge them with: ssh-vault merge {} {} {} {} \
+            and remove both files",
+            shell_words::quote(&base_path),
+            shell_words::quote(&mine_path),
+            shell_words::quote(vault_path),
+            shell_words::quote(vault_path)
+        ),
+        Err(e) => anyhow!(
+            "{vault_path} was modified while editing, refusing to overwrite it. \
+            Your changes could not be saved: {e}"
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, SshKeyType};
+    use ssh_key::PrivateKey;
+
+    fn identity() -> SshVault {
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap()
+    }
+
+    fn vault(path: &Path, data: &str) -> NamedTempFile {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+
+        let mut file = Builder::new().tempfile_in(path).unwrap();
+        stream::encrypt(&[recipient], data.as_bytes(), file.as_file_mut()).unwrap();
+        file
+    }
+
+    #[test]
+    fn test_merge_edits() {
+        let dir = tempfile::tempdir().unwrap();
+        let vault_path = dir.path().join("db.vault");
+        let vault_str = vault_path.to_str().unwrap();
+
+        // the vault changed on disk while editing another line
+        vault(dir.path(), "a\nb\nC\n").persist(&vault_path).unwrap();
+        let base = vault(dir.path(), "a\nb\nc\n");
+        let mine = vault(dir.path(), "A\nb\nc\n");
+
+        merge_edits(vault_str, &identity(), base, mine).unwrap();
+        assert_eq!(
+            identity().open(&fs::read(&vault_path).unwrap()).unwrap(),
+            b"A\nb\nC\n"
+        );
+        assert!(!Path::new(&format!("{vault_str}.mine")).exists());
+
+        // the same line changed, both are kept to merge by hand
+        vault(dir.path(), "a\nb\nX\n").persist(&vault_path).unwrap();
+        let base = vault(dir.path(), "a\nb\nc\n");
+        let mine = vault(dir.path(), "a\nb\nY\n");
+
+        let e = merge_edits(vault_str, &identity(), base, mine)
+            .unwrap_err()
+            .to_string();
+        assert!(e.contains("1 conflict(s)"));
+        assert!(e.contains(&format!(
+            "ssh-vault merge {vault_str}.base {vault_str}.mine {vault_str} {vault_str}"
+        )));
+        assert_eq!(
+            identity().open(&fs::read(&vault_path).unwrap()).unwrap(),
+            b"a\nb\nX\n"
+        );
+        assert_eq!(
+            identity()
+                .open(&fs::read(format!("{vault_str}.mine")).unwrap())
+                .unwrap(),
+            b"a\nb\nY\n"
+        );
+    }
+}
@@ -0,0 +1,369 @@
+use crate::audit;
+use crate::cli::actions::{create, shred_file, Action};
+use crate::vault::{
+    crypto, find, fips, info, metadata::Metadata, policy, policy::Policy, revoked, ssh::prompt,
+    stream, stream::Header, SshVault,
+};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    fmt,
+    fs::{self, File, OpenOptions},
+    io::{BufReader, BufWriter, Write},
+    num::NonZeroUsize,
+    path::{Path, PathBuf},
+    sync::atomic::{AtomicUsize, Ordering},
+    thread,
+};
+
+/// Extension of the vaults created by encrypt
+pub const EXTENSION: &str = ".vault";
+
+/// Handle the encrypt action
+/// # Errors
+/// Will return an error if the vault can't be created or the file removed
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Encrypt {
+            exclude,
+            file,
+            file_mode,
+            include,
+            jobs,
+            key,
+            quiet,
+            recipients,
+            recursive,
+            remove,
+        } => {
+            // a filter from stdin to stdout, nothing is asked on the terminal
+            if file == "-" {
+                if recursive || remove {
+                    return Err(anyhow!("--recursive and --rm can't be used with stdin"));
+                }
+
+                prompt::disable();
+
+                return create::handle(Action::Create {
+                    dual_control: false,
+                    expires: None,
+                    file_mode,
+                    fingerprint: None,
+                    input: Some(file),
+                    json: false,
+                    key,
+                    label: None,
+                    preserve: Vec::new(),
+                    quiet: true,
+                    recipients,
+                    strict: false,
+                    user: None,
+                    vault: Some("-".to_string()),
+                });
+            }
+
+            if recursive {
+                let summary = encrypt_dir(
+                    Path::new(&file),
+                    &info::Filter::new(&include, &exclude)?,
+                    key,
+                    &recipients,
+                    jobs,
+                    file_mode,
+                    remove,
+                    quiet,
+                )?;
+
+                eprintln!("{summary}");
+
+                if summary.failed > 0 {
+                    return Err(anyhow!("{} file(s) could not be encrypted", summary.failed));
+                }
+
+                return Ok(());
+            }
+
+            if Path::new(&file).is_dir() {
+                return Err(anyhow!("{file} is a directory, use --recursive"));
+            }
+
+            let vault = format!("{file}{EXTENSION}");
+
+            // the vault is created from the file, fails if the vault exists
+            create::handle(Action::Create {
+                dual_control: false,
+                expires: None,
+                file_mode,
+                fingerprint: None,
+                input: Some(file.clone()),
+                json: false,
+                key,
+                label: None,
+                preserve: vec!["mode".to_string()],
+                quiet,
+                recipients,
+                strict: false,
+                user: None,
+                vault: Some(vault.clone()),
+            })?;
+
+            if remove {
+                // overwrite the plaintext before unlinking it
+                shred_file(Path::new(&file))?;
+                fs::remove_file(&file).with_context(|| format!("Could not remove {file}"))?;
+            }
+
+            eprintln!("{file} -> {vault}");
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+#[derive(Debug, Default, PartialEq, Eq)]
+struct Summary {
+    encrypted: usize,
+    // files with a vault already
+    skipped: usize,
+    failed: usize,
+}
+
+impl fmt::Display for Summary {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{} encrypted, {} skipped, {} failed",
+            self.encrypted, self.skipped, self.failed
+        )
+    }
+}
+
+// Encrypt the files of a directory and its subdirectories with a pool of
+// workers, for the keys given or the recipients of the policy of the directory
+#[allow(clippy::too_many_arguments)]
+fn encrypt_dir(
+    dir: &Path,
+    filter: &info::Filter,
+    key: Option<String>,
+    recipients: &[String],
+    jobs: Option<usize>,
+    file_mode: u32,
+    remove: bool,
+    quiet: bool,
+) -> Result<Summary> {
+    if !dir.is_dir() {
+        return Err(anyhow!("{} is not a directory", dir.display()));
+    }
+
+    let keys = if key.is_none() && recipients.is_empty() {
+        Policy::require(dir)?.public_keys()?
+    } else {
+        let mut keys = vec![find::public_key(key)?];
+
+        for path in recipients {
+            keys.extend(find::public_keys(path)?);
+        }
+
+        keys
+    };
+
+    revoked::check(&keys)?;
+
+    let vaults = keys
+        .into_iter()
+        .map(|key| SshVault::new(&find::key_type(&key.algorithm())?, Some(key), None))
+        .collect::<Result<Vec<_>>>()?;
+
+    let (files, skipped) = plaintext_files(dir, filter)?;
+
+    let workers = jobs
+        .unwrap_or_else(|| thread::available_parallelism().map_or(1, NonZeroUsize::get))
+        .clamp(1, files.len().max(1));
+
+    // workers take the next file until there are none left
+    let next = AtomicUsize::new(0);
+
+    let failed: Vec<(PathBuf, anyhow::Error)> = thread::scope(|scope| {
+        let handles: Vec<_> = (0..workers)
+            .map(|_| {
+                scope.spawn(|| {
+                    let mut failed = Vec::new();
+
+                    while let Some(file) = files.get(next.fetch_add(1, Ordering::Relaxed)) {
+                        match encrypt_file(file, &vaults, file_mode, remove) {
+                            Ok(vault) if !quiet => {
+                                eprintln!("{} -> {}", file.display(), vault.display());
+                            }
+                            Ok(_) => {}
+                            Err(e) => failed.push((file.clone(), e)),
+                        }
+                    }
+
+                    failed
+                })
+            })
+            .collect();
+
+        handles
+            .into_iter()
+            .flat_map(|handle| handle.join().unwrap_or_default())
+            .collect()
+    });
+
+    for (file, e) in &failed {
+        eprintln!("{}: {e}", file.display());
+    }
+
+    Ok(Summary {
+        encrypted: files.len() - failed.len(),
+        skipped,
+        failed: failed.len(),
+    })
+}
+
+// The files to encrypt and how many have a vault already, vaults, backups and
+// the policy file are left alone
+fn plaintext_files(dir: &Path, filter: &info::Filter) -> Result<(Vec<PathBuf>, usize)> {
+    let mut files = Vec::new();
+    let mut skipped = 0;
+
+    for path in filter.apply(dir, info::walk(dir)?) {
+        let name = path.file_name().unwrap_or_default().to_string_lossy();
+
+        if name.ends_with(EXTENSION)
+            || name.ends_with(".bak")
+            || name == policy::POLICY_FILE
+            || info::is_vault(&path)
+        {
+            continue;
+        }
+
+        if vault_path(&path).exists() {
+            skipped += 1;
+            continue;
+        }
+
+        files.push(path);
+    }
+
+    Ok((files, skipped))
+}
+
+fn vault_path(file: &Path) -> PathBuf {
+    let mut path = file.as_os_str().to_owned();
+    path.push(EXTENSION);
+    PathBuf::from(path)
+}
+
+// Encrypt a file into <file>.vault with a key of its own, returns the vault
+fn encrypt_file(
+    file: &Path,
+    recipients: &[SshVault],
+    file_mode: u32,
+    remove: bool,
+) -> Result<PathBuf> {
+    let vault = vault_path(file);
+
+    let vault_key = crypto::gen_password()?;
+
+    let header = Header {
+        stanzas: stream::wrap(recipients, &vault_key)?,
+        shares: Vec::new(),
+        cipher: fips::cipher()?,
+        metadata: Metadata::from_file(file, &["mode".to_string()])?.tagged(&vault_key)?,
+        label: None,
+        edited: None,
+        expires: None,
+        mac: None,
+    };
+
+    let input = BufReader::new(File::open(file)?);
+
+    // never replace a vault created meanwhile
+    let mut options = OpenOptions::new();
+    options.write(true).create_new(true);
+
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, file_mode);
+    #[cfg(not(unix))]
+    let _ = file_mode;
+
+    let mut output = BufWriter::new(
+        options
+            .open(&vault)
+            .with_context(|| format!("Could not create {}", vault.display()))?,
+    );
+
+    if let Err(e) = stream::encrypt_with_key(&header, &vault_key, input, &mut output)
+        .and_then(|()| Ok(output.flush()?))
+    {
+        drop(output);
+        let _ = fs::remove_file(&vault);
+        return Err(e);
+    }
+
+    if remove {
+        // overwrite the plaintext before unlinking it
+        shred_file(file)?;
+        fs::remove_file(file)?;
+    }
+
+    audit::log(
+        "create",
+        Some(&vault.display().to_string()),
+        &recipients
+            .first()
+            .map(SshVault::fingerprint)
+            .unwrap_or_default(),
+    );
+
+    Ok(vault)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_plaintext_files() {
+        let dir = tempfile::tempdir().unwrap();
+        let configs = dir.path().join("configs");
+        fs::create_dir_all(configs.join(".git")).unwrap();
+
+        for name in [
+            "app.conf",
+            "db.conf",
+            "db.conf.vault",
+            "old.conf.bak",
+            policy::POLICY_FILE,
+            ".git/config",
+        ] {
+            fs::write(configs.join(name), "secret").unwrap();
+        }
+
+        fs::write(configs.join("legacy"), "SSH-VAULT;AES256;").unwrap();
+
+        let all = info::Filter::new(&[], &[]).unwrap();
+        let (files, skipped) = plaintext_files(&configs, &all).unwrap();
+        assert_eq!(files, vec![configs.join("app.conf")]);
+        assert_eq!(skipped, 1);
+
+        // excluded files are not counted as skipped, even with a vault
+        let filter = info::Filter::new(&["*.conf".to_string()], &["db.*".to_string()]).unwrap();
+        let (files, skipped) = plaintext_files(&configs, &filter).unwrap();
+        assert_eq!(files, vec![configs.join("app.conf")]);
+        assert_eq!(skipped, 0);
+
+        let filter = info::Filter::new(&["*.yml".to_string()], &[]).unwrap();
+        assert!(plaintext_files(&configs, &filter).unwrap().0.is_empty());
+    }
+
+    #[test]
+    fn test_summary() {
+        let summary = Summary {
+            encrypted: 8,
+            skipped: 1,
+            failed: 2,
+        };
+        assert_eq!(summary.to_string(), "8 encrypted, 1 skipped, 2 failed");
+    }
+}
@@ -0,0 +1,171 @@
+use crate::audit;
+use crate::cli::actions::{private_vault, Action};
+use crate::vault::{info, kubeseal, pass};
+use anyhow::{anyhow, Result};
+use std::{
+    ffi::OsString,
+    fs,
+    path::{Path, PathBuf},
+};
+use zeroize::Zeroize;
+
+/// Handle the export action
+/// # Errors
+/// Will return an error if a vault can't be decrypted or an entry can't be written
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Export {
+            cert,
+            force,
+            format,
+            key,
+            namespace,
+            output,
+            path,
+        } => {
+            let dir = Path::new(&path);
+            let vaults = info::scan(dir)?;
+
+            if vaults.is_empty() {
+                return Err(anyhow!("No vaults found in {path}"));
+            }
+
+            // one private key for all the vaults
+            let mut key_types = Vec::new();
+            for vault in &vaults {
+                for recipient in info::read_file(vault)?.recipients {
+                    if !key_types.contains(&recipient.key_type) {
+                        key_types.push(recipient.key_type);
+                    }
+                }
+            }
+
+            let key_types: Vec<&str> = key_types.iter().map(String::as_str).collect();
+            let private = private_vault(key, &key_types, &[], None)?;
+
+            match format.as_str() {
+                "pass" => {
+                    let store = Path::new(&output);
+
+                    for vault in &vaults {
+                        let entry = entry_path(
+                            store,
+                            vault.strip_prefix(dir).unwrap_or(vault),
+                            pass::EXTENSION,
+                        );
+
+                        if !force && entry.exists() {
+                            return Err(anyhow!("{} already exists, use --force", entry.display()));
+                        }
+
+                        let ids = pass::gpg_ids(store, &entry)?;
+
+                        if let Some(parent) = entry.parent() {
+                            fs::create_dir_all(parent)?;
+                        }
+
+                        let mut data = private.open(&fs::read(vault)?)?;
+                        let rs = pass::encrypt(&ids, &data, &entry);
+                        data.zeroize();
+                        rs?;
+
+                        audit::log(
+                            "view",
+                            Some(&vault.display().to_string()),
+                            &private.fingerprint(),
+                        );
+
+                        eprintln!("{}", entry.display());
+                    }
+                }
+                "sealed-secrets" => {
+                    let manifests = Path::new(&output);
+
+                    for vault in &vaults {
+                        let relative = vault.strip_prefix(dir).unwrap_or(vault);
+                        let entry = entry_path(manifests, relative, kubeseal::EXTENSION);
+
+                        if !force && entry.exists() {
+                            return Err(anyhow!("{} already exists, use --force", entry.display()));
+                        }
+
+                        let name = kubeseal::name(relative)?;
+
+                        // the key of a vault that is not KEY=VALUE lines
+                        let file_name = relative.with_extension("");
+                        let file_name = file_name
+                            .file_name()
+                            .map(|name| name.to_string_lossy())
+                            .unwrap_or_default();
+
+                        let mut data = private.open(&fs::read(vault)?)?;
+                        let rs = kubeseal::secret(&name, namespace.as_deref(), &file_name, &data)
+                            .and_then(|mut secret| {
+                                let rs = kubeseal::seal(&secret, cert.as_deref());
+                                secret.zeroize();
+                                rs
+                            });
+                        data.zeroize();
+                        let sealed = rs?;
+
+                        if let Some(parent) = entry.parent() {
+                            fs::create_dir_all(parent)?;
+                        }
+
+                        fs::write(&entry, sealed)?;
+
+                        audit::log(
+                            "view",
+                            Some(&vault.display().to_string()),
+                            &private.fingerprint(),
+                        );
+
+                        eprintln!("{}", entry.display());
+                    }
+                }
+                _ => return Err(anyhow!("Unsupported format: {format}")),
+            }
+
+            eprintln!("Exported {} vaults into {output}", vaults.len());
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// the vault path without the .vault extension and with the extension of the entries
+fn entry_path(store: &Path, vault: &Path, extension: &str) -> PathBuf {
+    let name = if vault.extension().map_or(false, |ext| ext == "vault") {
+        vault.with_extension("")
+    } else {
+        vault.to_path_buf()
+    };
+
+    let mut path = OsString::from(store.join(name));
+    path.push(".");
+    path.push(extension);
+    PathBuf::from(path)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_entry_path() {
+        let store = Path::new("store");
+
+        assert_eq!(
+            entry_path(store, Path::new("web/github.com.vault"), pass::EXTENSION),
+            Path::new("store/web/github.com.gpg")
+        );
+        assert_eq!(
+            entry_path(store, Path::new("notes"), pass::EXTENSION),
+            Path::new("store/notes.gpg")
+        );
+        assert_eq!(
+            entry_path(store, Path::new("prod/db.env.vault"), kubeseal::EXTENSION),
+            Path::new("store/prod/db.env.yaml")
+        );
+    }
+}
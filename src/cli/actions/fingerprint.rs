@@ -1,5 +1,6 @@
 use crate::cli::actions::Action;
-use crate::vault::{fingerprint, remote};
+use crate::style::{Color, Style};
+use crate::vault::{fingerprint, fingerprint::Fingerprint, remote};
 use anyhow::Result;
 
 /// Handle the fingerprint action.
@@ -14,15 +15,7 @@ pub fn handle(action: Action) -> Result<()> {
                 let keys = remote::get_keys(&user)?;
                 let fingerprints = fingerprint::get_remote_fingerprints(&keys, None)?;
 
-                let max_key_length = fingerprints
-                    .iter()
-                    .map(|f| f.key.len())
-                    .max()
-                    .unwrap_or_default();
-
-                for fingerprint in &fingerprints {
-                    println!("{fingerprint:max_key_length$}");
-                }
+                print!("{}", to_text(&fingerprints, Style::stdout()));
             }
             (Some(key), Some(user)) => {
                 let key_number: Result<u32, _> = key.parse();
@@ -32,15 +25,7 @@ pub fn handle(action: Action) -> Result<()> {
                     Ok(key) => {
                         let fingerprints = fingerprint::get_remote_fingerprints(&keys, Some(key))?;
 
-                        let max_key_length = fingerprints
-                            .iter()
-                            .map(|f| f.key.len())
-                            .max()
-                            .unwrap_or_default();
-
-                        for fingerprint in &fingerprints {
-                            println!("{fingerprint:max_key_length$}");
-                        }
+                        print!("{}", to_text(&fingerprints, Style::stdout()));
                     }
                     Err(_) => {
                         eprintln!("When using -u, [-k N] must be a numeric key index.");
@@ -50,18 +35,97 @@ pub fn handle(action: Action) -> Result<()> {
             (None, None) => {
                 let fingerprints = fingerprint::fingerprints()?;
 
-                let max_key_length = fingerprints
-                    .iter()
-                    .map(|f| f.key.len())
-                    .max()
-                    .unwrap_or_default();
-
-                for fingerprint in &fingerprints {
-                    println!("{fingerprint:max_key_length$}");
-                }
+                print!("{}", to_text(&fingerprints, Style::stdout()));
             }
         },
         _ => unreachable!(),
     }
     Ok(())
 }
+
+// The keys right aligned, on a terminal the comments are aligned too
+fn to_text(fingerprints: &[Fingerprint], style: Style) -> String {
+    let max_key_length = fingerprints
+        .iter()
+        .map(|f| f.key.len())
+        .max()
+        .unwrap_or_default();
+
+    if !style.is_terminal() {
+        return fingerprints
+            .iter()
+            .map(|fingerprint| format!("{fingerprint:max_key_length$}\n"))
+            .collect();
+    }
+
+    let max_algorithm_length = fingerprints
+        .iter()
+        .map(|f| f.algorithm.len())
+        .max()
+        .unwrap_or_default();
+
+    let mut out = String::new();
+
+    for fingerprint in fingerprints {
+        out.push_str(&format!(
+            "{} {} {:<max_algorithm_length$} {} {}\n",
+            style.paint(
+                &format!("{:>max_key_length$}", fingerprint.key),
+                Color::Bold
+            ),
+            style.paint("Type:", Color::Dim),
+            fingerprint.algorithm,
+            style.paint("Comment:", Color::Dim),
+            fingerprint.comment
+        ));
+
+        for fp in &fingerprint.fingerprints {
+            out.push_str(&format!(
+                "{:>max_key_length$} {}\n",
+                "",
+                style.paint(fp, Color::Green)
+            ));
+        }
+
+        out.push('\n');
+    }
+
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn fingerprints() -> Vec<Fingerprint> {
+        vec![
+            Fingerprint {
+                key: "1".to_string(),
+                fingerprints: vec!["SHA256:abc".to_string()],
+                comment: "alice@laptop".to_string(),
+                algorithm: "ssh-ed25519".to_string(),
+            },
+            Fingerprint {
+                key: "10".to_string(),
+                fingerprints: vec!["SHA256:def".to_string()],
+                comment: "alice@ci".to_string(),
+                algorithm: "ssh-rsa".to_string(),
+            },
+        ]
+    }
+
+    #[test]
+    fn test_to_text() {
+        assert_eq!(
+            to_text(&fingerprints(), Style::plain()),
+            " 1 Type: ssh-ed25519 Comment: alice@laptop\n   SHA256:abc\n\n\
+             10 Type: ssh-rsa Comment: alice@ci\n   SHA256:def\n\n"
+        );
+
+        assert_eq!(
+            to_text(&fingerprints(), Style::aligned()),
+            " 1 Type: ssh-ed25519 Comment: alice@laptop\n   SHA256:abc\n\n\
+             10 Type: ssh-rsa     Comment: alice@ci\n   SHA256:def\n\n"
+        );
+    }
+}
@@ -0,0 +1,232 @@
+use crate::cli::actions::{decrypt, Action, FilterMode};
+use crate::vault::{find, info, policy::Policy, stream, stream::Header, SshVault};
+use crate::{audit, git};
+use anyhow::Result;
+use sha2::{Digest, Sha256};
+use std::{
+    env,
+    io::{self, BufRead, BufReader, Read, Seek, Write},
+    path::Path,
+};
+use zeroize::Zeroize;
+
+/// Handle the git-filter action
+/// # Errors
+/// Will return an error if there is no policy for the file or it can't be encrypted
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::GitFilter { key, mode, path } => {
+            let input = io::stdin().lock();
+            let output = io::stdout().lock();
+
+            match mode {
+                FilterMode::Clean => clean(input, output, key, path.as_deref())?,
+                FilterMode::Smudge => smudge(input, output, key, path.as_deref())?,
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// Encrypt the file for the recipients of the policy
+fn clean<R: Read, W: Write>(
+    mut input: R,
+    mut output: W,
+    key: Option<String>,
+    path: Option<&str>,
+) -> Result<()> {
+    // keep the file out of memory, it may be large
+    let mut file = tempfile::tempfile()?;
+    let hash = copy_digest(&mut input, &mut file)?;
+    file.rewind()?;
+
+    let mut file = BufReader::new(file);
+
+    // already encrypted, store it as is
+    if file.fill_buf()?.starts_with(info::PREFIX) {
+        io::copy(&mut file, &mut output)?;
+        return Ok(());
+    }
+
+    let dir = match path.and_then(|path| Path::new(path).parent()) {
+        Some(dir) => dir.to_path_buf(),
+        None => env::current_dir()?,
+    };
+
+    let recipients = Policy::require(&dir)?
+        .public_keys()?
+        .into_iter()
+        .map(|key| SshVault::new(&find::key_type(&key.algorithm())?, Some(key), None))
+        .collect::<Result<Vec<_>>>()?;
+
+    // git cleans files again when they are only touched, the staged vault is
+    // reused when nothing changed so the file is not shown as modified
+    if let Some(staged) = path.and_then(git::staged_blob) {
+        if unchanged(&staged, &recipients, &hash, key) {
+            output.write_all(&staged)?;
+            return Ok(());
+        }
+    }
+
+    stream::encrypt(&recipients, file, output)
+}
+
+/// Decrypt a vault, it is left encrypted if there is no key to open it
+/// # Errors
+/// Will return an error if the input can't be read or the output written
+pub fn smudge<R: Read, W: Write>(
+    mut input: R,
+    mut output: W,
+    key: Option<String>,
+    path: Option<&str>,
+) -> Result<()> {
+    let mut vault = Vec::new();
+    input.read_to_end(&mut vault)?;
+
+    if !vault.starts_with(info::PREFIX) {
+        output.write_all(&vault)?;
+        return Ok(());
+    }
+
+    let mut data = Vec::new();
+
+    match decrypt(vault.as_slice(), &mut data, key, None) {
+        Ok(fingerprint) => {
+            let rs = output.write_all(&data);
+            data.zeroize();
+            rs?;
+
+            audit::log("view", path, &fingerprint);
+        }
+        Err(e) => {
+            data.zeroize();
+            eprintln!("Warning: {} left encrypted: {e}", path.unwrap_or("vault"));
+            output.write_all(&vault)?;
+        }
+    }
+
+    Ok(())
+}
+
+// The staged vault has the same content and recipients
+fn unchanged(vault: &[u8], recipients: &[SshVault], hash: &[u8; 32], key: Option<String>) -> bool {
+    let Ok(header) = Header::read(&mut &vault[..]) else {
+        return false;
+    };
+
+    let mut staged: Vec<&str> = header
+        .stanzas
+        .iter()
+        .map(|stanza| stanza.fingerprint.as_str())
+        .collect();
+    staged.sort_unstable();
+
+    let mut wanted: Vec<String> = recipients.iter().map(SshVault::fingerprint).collect();
+    wanted.sort_unstable();
+    wanted.dedup();
+
+    if staged != wanted {
+        return false;
+    }
+
+    let mut hasher = Sha256::new();
+
+    decrypt(vault, &mut hasher, key, None)
+        .is_ok_and(|_| hasher.finalize().as_slice() == hash.as_slice())
+}
+
+// Copy the input returning its SHA256
+fn copy_digest<R: Read, W: Write>(input: &mut R, output: &mut W) -> Result<[u8; 32]> {
+    let mut hasher = Sha256::new();
+    let mut buf = [0u8; 8192];
+
+    loop {
+        let n = input.read(&mut buf)?;
+
+        if n == 0 {
+            return Ok(hasher.finalize().into());
+        }
+
+        hasher.update(&buf[..n]);
+        output.write_all(&buf[..n])?;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::policy::POLICY_FILE;
+    use std::fs;
+
+    const SECRET: &str = "DB_PASSWORD=s3cr3t\n";
+
+    #[test]
+    fn test_clean_smudge() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::write(
+            dir.path().join(POLICY_FILE),
+            format!(
+                "recipients:\n  - {}\n",
+                fs::read_to_string("test_data/ed25519.pub").unwrap().trim()
+            ),
+        )
+        .unwrap();
+
+        let path = dir.path().join("db.env");
+        let path = path.to_str().unwrap();
+
+        let mut vault = Vec::new();
+        clean(SECRET.as_bytes(), &mut vault, None, Some(path)).unwrap();
+        assert!(vault.starts_with(stream::MAGIC.as_bytes()));
+
+        // vaults are not encrypted twice
+        let mut cleaned = Vec::new();
+        clean(vault.as_slice(), &mut cleaned, None, Some(path)).unwrap();
+        assert_eq!(cleaned, vault);
+
+        let mut data = Vec::new();
+        smudge(
+            vault.as_slice(),
+            &mut data,
+            Some("test_data/ed25519".to_string()),
+            Some(path),
+        )
+        .unwrap();
+        assert_eq!(data, SECRET.as_bytes());
+
+        // plain files are left as they are
+        let mut data = Vec::new();
+        smudge(SECRET.as_bytes(), &mut data, None, Some(path)).unwrap();
+        assert_eq!(data, SECRET.as_bytes());
+
+        // same content and recipients
+        let recipients = vec![SshVault::new(
+            &crate::vault::SshKeyType::Ed25519,
+            Some(find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap()),
+            None,
+        )
+        .unwrap()];
+        let hash: [u8; 32] = Sha256::digest(SECRET.as_bytes()).into();
+        let key = Some("test_data/ed25519".to_string());
+        assert!(unchanged(&vault, &recipients, &hash, key.clone()));
+
+        let hash: [u8; 32] = Sha256::digest(b"changed").into();
+        assert!(!unchanged(&vault, &recipients, &hash, key));
+    }
+
+    #[test]
+    fn test_clean_without_policy() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("db.env");
+
+        let mut vault = Vec::new();
+        assert!(clean(
+            SECRET.as_bytes(),
+            &mut vault,
+            None,
+            Some(path.to_str().unwrap())
+        )
+        .is_err());
+    }
+}
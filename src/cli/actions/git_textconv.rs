@@ -0,0 +1,22 @@
+use crate::cli::actions::{git_filter::smudge, Action};
+use anyhow::{Context, Result};
+use std::{
+    fs::File,
+    io::{self, BufWriter},
+};
+
+/// Handle the git-textconv action
+/// # Errors
+/// Will return an error if the file can't be read
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::GitTextconv { key, path } => {
+            // git passes a temporary file with the blob
+            let input = File::open(&path).with_context(|| format!("Could not open {path}"))?;
+
+            smudge(input, BufWriter::new(io::stdout().lock()), key, Some(&path))?;
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
@@ -0,0 +1,39 @@
+use crate::cli::actions::{private_vault, recipient_keys, Action};
+use crate::vault::{grpc, ssh};
+use anyhow::Result;
+use std::path::PathBuf;
+
+/// Handle the grpc action
+/// # Errors
+/// Will return an error if there are no recipients or the socket can't be created
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Grpc {
+            key,
+            recipients,
+            socket,
+        } => {
+            let socket = socket.map_or_else(grpc::socket_path, |s| Ok(PathBuf::from(s)))?;
+
+            let keys = recipient_keys(&recipients)?;
+
+            // without a key of its own the server can only encrypt
+            let key_types = [ssh::ed25519::STANZA, ssh::rsa::STANZA];
+            let private = if key.is_some() {
+                Some(private_vault(key, &key_types, &[], None)?)
+            } else {
+                private_vault(None, &key_types, &[], None).ok()
+            };
+
+            if private.is_none() {
+                eprintln!("Warning: no private key found, Decrypt is disabled");
+            }
+
+            eprintln!("Listening on {}", socket.display());
+
+            grpc::serve(&socket, grpc::Service::new(keys, private)?)?;
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
@@ -0,0 +1,73 @@
+use crate::cli::actions::Action;
+use crate::style::{Color, Style};
+use crate::vault::history::{self, Revision};
+use anyhow::Result;
+use std::path::Path;
+
+/// Handle the history action
+/// # Errors
+/// Will return an error if the revisions can't be read
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::History { vault } => {
+            let revisions = history::list(Path::new(&vault))?;
+
+            if revisions.is_empty() {
+                eprintln!("{vault} has no revisions, set history in the config to keep them");
+                return Ok(());
+            }
+
+            print!("{}", to_text(&revisions, Style::stdout()));
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// The newest first, with the revision to give to view --revision
+fn to_text(revisions: &[Revision], style: Style) -> String {
+    revisions
+        .iter()
+        .rev()
+        .zip(1..)
+        .map(|(revision, back)| {
+            let saved = revision.modified.map_or_else(
+                || String::from("-"),
+                |time| humantime::format_rfc3339_seconds(time).to_string(),
+            );
+
+            format!(
+                "{} {} {} {}\n",
+                style.paint(&format!("{:>3}", format!("-{back}")), Color::Bold),
+                style.paint(&saved, Color::Dim),
+                revision.size,
+                revision.path.display()
+            )
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::{
+        path::PathBuf,
+        time::{Duration, UNIX_EPOCH},
+    };
+
+    #[test]
+    fn test_to_text() {
+        let revisions = [1, 2].map(|number| Revision {
+            number,
+            path: PathBuf::from(format!(".db.vault.d/{number}.vault")),
+            modified: Some(UNIX_EPOCH + Duration::from_secs(1_700_000_000 + number)),
+            size: 100 * number,
+        });
+
+        assert_eq!(
+            to_text(&revisions, Style::plain()),
+            " -1 2023-11-14T22:13:22Z 200 .db.vault.d/2.vault\n \
+             -2 2023-11-14T22:13:21Z 100 .db.vault.d/1.vault\n"
+        );
+    }
+}
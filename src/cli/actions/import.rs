@@ -0,0 +1,179 @@
+use crate::audit;
+use crate::cli::actions::{recipient_keys, Action};
+use crate::vault::{dio::OutputDestination, find, import, pass, stream, SshVault};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    ffi::OsString,
+    fs,
+    path::{Path, PathBuf},
+};
+use zeroize::Zeroize;
+
+/// Handle the import action
+/// # Errors
+/// Will return an error if an entry can't be read or a vault can't be written
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Import {
+            force,
+            format,
+            output,
+            path,
+            recipients,
+            single,
+        } => {
+            let recipients = recipient_keys(&recipients)?
+                .into_iter()
+                .map(|key| SshVault::new(&find::key_type(&key.algorithm())?, Some(key), None))
+                .collect::<Result<Vec<_>>>()?;
+
+            let output = Path::new(&output);
+
+            let count = match format.as_str() {
+                "pass" => import_pass(Path::new(&path), output, &recipients, force)?,
+                "1password" | "bitwarden" | "lastpass" => {
+                    let mut data = fs::read_to_string(&path)
+                        .with_context(|| format!("Could not read {path}"))?;
+
+                    let entries = if data.trim_start().starts_with('{') {
+                        import::parse_bitwarden(&data)
+                    } else {
+                        import::parse_csv(&data)
+                    };
+                    data.zeroize();
+
+                    import_entries(&entries?, output, &recipients, force, single)?
+                }
+                _ => return Err(anyhow!("Unsupported format: {format}")),
+            };
+
+            eprintln!("Imported {count} entries into {}", output.display());
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+fn import_pass(store: &Path, output: &Path, recipients: &[SshVault], force: bool) -> Result<usize> {
+    let entries = pass::entries(store)?;
+
+    if entries.is_empty() {
+        return Err(anyhow!("No entries found in {}", store.display()));
+    }
+
+    for entry in &entries {
+        let vault = vault_path(output, &pass::name(store, entry));
+
+        let mut data = pass::decrypt(entry)?;
+        let rs = write_vault(&vault, recipients, &data, force);
+        data.zeroize();
+        rs?;
+
+        eprintln!("{}", vault.display());
+    }
+
+    Ok(entries.len())
+}
+
+fn import_entries(
+    entries: &[import::Entry],
+    output: &Path,
+    recipients: &[SshVault],
+    force: bool,
+    single: bool,
+) -> Result<usize> {
+    if entries.is_empty() {
+        return Err(anyhow!("No entries found in the export"));
+    }
+
+    if single {
+        let mut data = serde_json::to_string_pretty(entries)?;
+        let rs = write_vault(output, recipients, data.as_bytes(), force);
+        data.zeroize();
+        rs?;
+
+        return Ok(entries.len());
+    }
+
+    for (entry, name) in entries.iter().zip(import::paths(entries)) {
+        let vault = vault_path(output, &name);
+
+        let mut data = entry.render();
+        let rs = write_vault(&vault, recipients, data.as_bytes(), force);
+        data.zeroize();
+        rs?;
+
+        eprintln!("{}", vault.display());
+    }
+
+    Ok(entries.len())
+}
+
+// the name of the entry with the .vault extension, dots in the name are kept
+fn vault_path(output: &Path, name: &Path) -> PathBuf {
+    let mut path = OsString::from(output.join(name));
+    path.push(".vault");
+    PathBuf::from(path)
+}
+
+// encrypt the data to a new vault, existing vaults are only replaced with force
+fn write_vault(path: &Path, recipients: &[SshVault], data: &[u8], force: bool) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+
+    let output = OutputDestination::new(Some(path.display().to_string()))?;
+
+    if !force && !output.is_empty()? {
+        return Err(anyhow!("{} already exists, use --force", path.display()));
+    }
+
+    output.truncate()?;
+
+    stream::encrypt(recipients, data, output)?;
+
+    audit::log(
+        "create",
+        Some(&path.display().to_string()),
+        &recipients
+            .first()
+            .map(SshVault::fingerprint)
+            .unwrap_or_default(),
+    );
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use ssh_key::PrivateKey;
+
+    #[test]
+    fn test_write_vault() {
+        let dir = tempfile::tempdir().unwrap();
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let recipients = [SshVault::new(
+            &find::key_type(&public.algorithm()).unwrap(),
+            Some(public),
+            None,
+        )
+        .unwrap()];
+
+        let vault = vault_path(dir.path(), Path::new("web/github.com"));
+        assert_eq!(vault, dir.path().join("web").join("github.com.vault"));
+
+        write_vault(&vault, &recipients, b"s3cr3t", false).unwrap();
+        assert!(write_vault(&vault, &recipients, b"other", false).is_err());
+        write_vault(&vault, &recipients, b"new", true).unwrap();
+
+        let key = SshVault::new(
+            &find::key_type(&private.algorithm()).unwrap(),
+            None,
+            Some(private),
+        )
+        .unwrap();
+        assert_eq!(key.open(&fs::read(&vault).unwrap()).unwrap(), b"new");
+    }
+}
@@ -0,0 +1,140 @@
+use crate::cli::actions::Action;
+use crate::vault::info::{self, Recipient, VaultInfo};
+use anyhow::{anyhow, Result};
+use serde::Serialize;
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+#[derive(Debug, Serialize)]
+struct Manifest {
+    vaults: Vec<Entry>,
+}
+
+#[derive(Debug, Serialize)]
+struct Entry {
+    path: String,
+    format: String,
+    label: Option<String>,
+    recipients: Vec<Recipient>,
+    // RFC 3339, null when the filesystem doesn't record it
+    created: Option<String>,
+    last_edited: Option<String>,
+    // the key in the header of the vault, vaults edited before it was
+    // recorded only have the modification time of the file
+    edited_by: Option<String>,
+}
+
+/// Handle the index action
+/// # Errors
+/// Will return an error if the directory or a vault can't be read
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Index { dir } => {
+            let dir = PathBuf::from(dir);
+
+            if !dir.is_dir() {
+                return Err(anyhow!("{} is not a directory", dir.display()));
+            }
+
+            let mut vaults = info::scan(&dir)?;
+            vaults.sort();
+
+            let mut entries = Vec::new();
+
+            for vault in vaults {
+                let metadata = fs::metadata(&vault)?;
+
+                entries.push(entry(
+                    vault.strip_prefix(&dir).unwrap_or(&vault),
+                    &info::read_file(&vault)?,
+                    metadata.created().ok(),
+                    metadata.modified().ok(),
+                ));
+            }
+
+            println!(
+                "{}",
+                serde_json::to_string_pretty(&Manifest { vaults: entries })?
+            );
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+fn entry(
+    path: &Path,
+    info: &VaultInfo,
+    created: Option<SystemTime>,
+    modified: Option<SystemTime>,
+) -> Entry {
+    let rfc3339 = |time| humantime::format_rfc3339_seconds(time).to_string();
+
+    let last_edited = info
+        .edited
+        .as_ref()
+        .map(|edited| UNIX_EPOCH + Duration::from_secs(edited.time))
+        .or(modified);
+
+    Entry {
+        path: path.display().to_string(),
+        format: info.format.clone(),
+        label: info.label.clone(),
+        recipients: info.recipients.clone(),
+        created: created.map(rfc3339),
+        last_edited: last_edited.map(rfc3339),
+        edited_by: info
+            .edited
+            .as_ref()
+            .map(|edited| edited.fingerprint.clone()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::info::Edit;
+
+    #[test]
+    fn test_entry() {
+        let mut info = VaultInfo {
+            format: "V2".to_string(),
+            label: Some("prod DB creds".to_string()),
+            edited: None,
+            expires: None,
+            recipients: vec![Recipient {
+                key_type: "X25519".to_string(),
+                fingerprint: "SHA256:a".to_string(),
+            }],
+        };
+
+        let created = UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        let modified = UNIX_EPOCH + Duration::from_secs(1_700_000_060);
+
+        let entry = super::entry(Path::new("db.vault"), &info, Some(created), Some(modified));
+        assert_eq!(entry.path, "db.vault");
+        assert_eq!(entry.created.as_deref(), Some("2023-11-14T22:13:20Z"));
+        assert_eq!(entry.last_edited.as_deref(), Some("2023-11-14T22:14:20Z"));
+        assert_eq!(entry.edited_by, None);
+
+        // the edit recorded in the vault wins over the file
+        info.edited = Some(Edit {
+            fingerprint: "SHA256:a".to_string(),
+            comment: String::new(),
+            time: 1_700_003_600,
+        });
+
+        let entry = super::entry(Path::new("db.vault"), &info, None, Some(modified));
+        assert_eq!(entry.created, None);
+        assert_eq!(entry.last_edited.as_deref(), Some("2023-11-14T23:13:20Z"));
+        assert_eq!(entry.edited_by.as_deref(), Some("SHA256:a"));
+
+        assert_eq!(
+            serde_json::to_value(&entry).unwrap()["recipients"][0]["fingerprint"],
+            "SHA256:a"
+        );
+    }
+}
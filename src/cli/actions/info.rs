@@ -0,0 +1,217 @@
+use crate::cli::actions::Action;
+use crate::style::{Color, Style};
+use crate::vault::{
+    expiry,
+    info::{self, VaultInfo},
+};
+use anyhow::Result;
+use serde::Serialize;
+use std::{
+    path::{Path, PathBuf},
+    time::{Duration, UNIX_EPOCH},
+};
+
+#[derive(Serialize)]
+struct JsonInfo {
+    path: String,
+    #[serde(flatten)]
+    info: VaultInfo,
+}
+
+/// Handle the info action
+/// # Errors
+/// Will return an error if a file is not a vault or a directory can't be read
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Info { json, paths } => {
+            let mut vaults = Vec::new();
+
+            for path in paths {
+                let path = PathBuf::from(path);
+
+                // only the files that look like vaults are read in directories
+                if path.is_dir() {
+                    vaults.extend(info::scan(&path)?);
+                } else {
+                    vaults.push(path);
+                }
+            }
+
+            let infos = vaults
+                .iter()
+                .map(|path| Ok((path.as_path(), info::read_file(path)?)))
+                .collect::<Result<Vec<_>>>()?;
+
+            if json {
+                println!("{}", to_json(&infos)?);
+            } else {
+                print!("{}", to_text(&infos, Style::stdout()));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+fn to_json(infos: &[(&Path, VaultInfo)]) -> Result<String> {
+    let infos: Vec<JsonInfo> = infos
+        .iter()
+        .map(|(path, info)| JsonInfo {
+            path: path.display().to_string(),
+            info: info.clone(),
+        })
+        .collect();
+
+    Ok(serde_json::to_string(&infos)?)
+}
+
+fn to_text(infos: &[(&Path, VaultInfo)], style: Style) -> String {
+    let mut out = String::new();
+
+    // on a terminal the fingerprints start after the longest key type
+    let width = if style.is_terminal() {
+        infos
+            .iter()
+            .flat_map(|(_, info)| &info.recipients)
+            .map(|recipient| recipient.key_type.len())
+            .max()
+            .unwrap_or_default()
+    } else {
+        17
+    };
+
+    for (path, info) in infos {
+        out.push_str(&format!(
+            "{} {}",
+            style.paint(&path.display().to_string(), Color::Bold),
+            style.paint(&format!("({})", info.format), Color::Dim)
+        ));
+
+        if let Some(label) = &info.label {
+            out.push_str(&format!(" {}", style.paint(label, Color::Cyan)));
+        }
+
+        out.push('\n');
+
+        if let Some(edited) = &info.edited {
+            let time = UNIX_EPOCH + Duration::from_secs(edited.time);
+            let by = if edited.comment.is_empty() {
+                edited.fingerprint.clone()
+            } else {
+                format!("{} ({})", edited.fingerprint, edited.comment)
+            };
+
+            out.push_str(&format!(
+                "  edited {} by {by}\n",
+                humantime::format_rfc3339_seconds(time)
+            ));
+        }
+
+        if let Some(expires) = info.expires {
+            let state = if expiry::is_expired(expires) {
+                style.paint("expired", Color::Red)
+            } else {
+                style.paint("expires", Color::Yellow)
+            };
+
+            out.push_str(&format!("  {state} {}\n", expiry::date(expires)));
+        }
+
+        for recipient in &info.recipients {
+            out.push_str(&format!(
+                "  {:<width$} {}\n",
+                recipient.key_type, recipient.fingerprint
+            ));
+        }
+    }
+
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::info::{Edit, Recipient};
+
+    fn infos() -> Vec<(&'static Path, VaultInfo)> {
+        vec![(
+            Path::new("secret.vault"),
+            VaultInfo {
+                format: "V2".to_string(),
+                label: None,
+                edited: None,
+                expires: None,
+                recipients: vec![Recipient {
+                    key_type: "X25519".to_string(),
+                    fingerprint: "SHA256:abc".to_string(),
+                }],
+            },
+        )]
+    }
+
+    #[test]
+    fn test_to_text() {
+        assert_eq!(
+            to_text(&infos(), Style::plain()),
+            "secret.vault (V2)\n  X25519            SHA256:abc\n"
+        );
+
+        // aligned to the longest key type on a terminal
+        assert_eq!(
+            to_text(&infos(), Style::aligned()),
+            "secret.vault (V2)\n  X25519 SHA256:abc\n"
+        );
+    }
+
+    #[test]
+    fn test_to_text_with_label() {
+        let mut infos = infos();
+        infos[0].1.label = Some("prod DB creds".to_string());
+
+        assert_eq!(
+            to_text(&infos, Style::plain()),
+            "secret.vault (V2) prod DB creds\n  X25519            SHA256:abc\n"
+        );
+        assert!(to_json(&infos)
+            .unwrap()
+            .contains(r#""label":"prod DB creds""#));
+    }
+
+    #[test]
+    fn test_to_text_with_last_edit() {
+        let mut infos = infos();
+        infos[0].1.edited = Some(Edit {
+            fingerprint: "SHA256:abc".to_string(),
+            comment: "alice@laptop".to_string(),
+            time: 1_700_000_000,
+        });
+
+        assert_eq!(
+            to_text(&infos, Style::plain()),
+            "secret.vault (V2)\n  edited 2023-11-14T22:13:20Z by SHA256:abc (alice@laptop)\n  X25519            SHA256:abc\n"
+        );
+        assert!(to_json(&infos).unwrap().contains(
+            r#""edited":{"fingerprint":"SHA256:abc","comment":"alice@laptop","time":1700000000}"#
+        ));
+    }
+
+    #[test]
+    fn test_to_text_with_expiry() {
+        let mut infos = infos();
+        infos[0].1.expires = Some(1_700_000_000);
+
+        assert_eq!(
+            to_text(&infos, Style::plain()),
+            "secret.vault (V2)\n  expired 2023-11-14T22:13:20Z\n  X25519            SHA256:abc\n"
+        );
+        assert!(to_json(&infos).unwrap().contains(r#""expires":1700000000"#));
+    }
+
+    #[test]
+    fn test_to_json() {
+        assert_eq!(
+            to_json(&infos()).unwrap(),
+            r#"[{"path":"secret.vault","format":"V2","recipients":[{"key_type":"X25519","fingerprint":"SHA256:abc"}]}]"#
+        );
+    }
+}
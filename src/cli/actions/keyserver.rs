@@ -0,0 +1,47 @@
+use crate::cli::actions::Action;
+use crate::vault::keyserver::{Keyserver, Source};
+use anyhow::{anyhow, Result};
+use std::{net::TcpListener, path::PathBuf};
+
+/// Handle the keyserver action
+/// # Errors
+/// Will return an error if there is no source of keys or the address can't be
+/// used
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Keyserver {
+            from,
+            ldap,
+            ldap_base,
+            ldap_filter,
+            listen,
+            max_age,
+        } => {
+            let source = match (from, ldap, ldap_base) {
+                (Some(dir), _, _) => {
+                    let dir = PathBuf::from(dir);
+
+                    if !dir.is_dir() {
+                        return Err(anyhow!("{} is not a directory", dir.display()));
+                    }
+
+                    Source::Dir(dir)
+                }
+                (None, Some(url), Some(base)) => Source::Ldap {
+                    url,
+                    base,
+                    filter: ldap_filter,
+                },
+                _ => return Err(anyhow!("Use --from or --ldap with --ldap-base")),
+            };
+
+            let listener = TcpListener::bind(&listen)?;
+
+            eprintln!("Listening on http://{}", listener.local_addr()?);
+
+            Keyserver { source, max_age }.serve(&listener)?;
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
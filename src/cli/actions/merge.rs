@@ -0,0 +1,244 @@
+use crate::audit;
+use crate::cli::actions::{editor_tempfile, open_vault, shred, shred_on_interrupt, Action};
+use crate::git;
+use crate::vault::{dio, stream, stream::Header, SshVault};
+use anyhow::{anyhow, Context, Result};
+use secrecy::Secret;
+use std::{
+    fs::{self, File},
+    io::{BufReader, BufWriter, Write},
+    path::Path,
+};
+use tempfile::{Builder, NamedTempFile};
+use zeroize::Zeroize;
+
+/// Handle the merge action
+/// # Errors
+/// Will return an error if a vault can't be decrypted or the merge has conflicts
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Merge {
+            base,
+            install,
+            key,
+            ours,
+            output,
+            theirs,
+        } => {
+            if install {
+                git::config("merge.sshvault.name", "ssh-vault merge driver")?;
+                git::config("merge.sshvault.driver", "ssh-vault merge %O %A %B")?;
+                println!("Add the vaults to .gitattributes, e.g.: *.vault merge=sshvault");
+                return Ok(());
+            }
+
+            let (Some(base), Some(ours), Some(theirs)) = (base, ours, theirs) else {
+                return Err(anyhow!("The base, ours and theirs vaults are required"));
+            };
+
+            // git expects the result in ours
+            let output = output.unwrap_or_else(|| ours.clone());
+
+            let dir = Path::new(&output)
+                .parent()
+                .filter(|dir| !dir.as_os_str().is_empty())
+                .unwrap_or_else(|| Path::new("."));
+
+            let mut merged = Builder::new().prefix(".vault-").tempfile_in(dir)?;
+
+            let (key_fingerprint, conflicts) = merge(&base, &ours, &theirs, &mut merged, key)?;
+
+            dio::persist(merged, Path::new(&output))?;
+
+            audit::log("merge", Some(&output), &key_fingerprint);
+
+            if conflicts > 0 {
+                return Err(anyhow!(
+                    "{output} has {conflicts} conflict(s), resolve them with: ssh-vault edit {output}"
+                ));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// Decrypt the three vaults, merge them and encrypt the result for the
+// recipients of ours, returns the fingerprint of the key and the conflicts
+fn merge(
+    base: &str,
+    ours: &str,
+    theirs: &str,
+    merged: &mut NamedTempFile,
+    key: Option<String>,
+) -> Result<(String, u8)> {
+    with_files(|[base_file, ours_file, theirs_file]| {
+        let input = File::open(ours).with_context(|| format!("Could not open {ours}"))?;
+        let (ssh_vault, header, vault_key) =
+            open_vault(input, &mut ours_file.as_file(), key, None)?;
+
+        let conflicts = merge_files(
+            &ssh_vault,
+            &header,
+            &vault_key,
+            base,
+            theirs,
+            [base_file, ours_file, theirs_file],
+            merged,
+        )?;
+
+        Ok((ssh_vault.fingerprint(), conflicts))
+    })
+}
+
+/// Merge the vaults with an identity that already opened one of them, e.g. the
+/// edits made while the vault changed on disk, the result is encrypted for the
+/// recipients of ours
+/// # Errors
+/// Will return an error if a vault can't be decrypted or git merge-file fails
+pub fn merge_with(
+    ssh_vault: &SshVault,
+    base: &str,
+    ours: &str,
+    theirs: &str,
+    merged: &mut NamedTempFile,
+) -> Result<u8> {
+    with_files(|[base_file, ours_file, theirs_file]| {
+        let mut reader =
+            BufReader::new(File::open(ours).with_context(|| format!("Could not open {ours}"))?);
+        let header = Header::read(&mut reader)?;
+        let vault_key = header.unwrap(ssh_vault)?;
+
+        stream::decrypt_with_key(&header, &vault_key, reader, &mut ours_file.as_file())?;
+
+        merge_files(
+            ssh_vault,
+            &header,
+            &vault_key,
+            base,
+            theirs,
+            [base_file, ours_file, theirs_file],
+            merged,
+        )
+    })
+}
+
+// the decrypted vaults are only on disk while merging
+fn with_files<T, F>(f: F) -> Result<T>
+where
+    F: FnOnce(&[NamedTempFile; 3]) -> Result<T>,
+{
+    let files = [editor_tempfile()?, editor_tempfile()?, editor_tempfile()?];
+    let _interrupted: Vec<_> = files.iter().map(shred_on_interrupt).collect();
+
+    let rs = f(&files);
+
+    for file in &files {
+        shred(file)?;
+    }
+
+    rs
+}
+
+// Merge base and theirs into ours, already decrypted in its file
+fn merge_files(
+    ssh_vault: &SshVault,
+    header: &Header,
+    vault_key: &Secret<[u8; 32]>,
+    base: &str,
+    theirs: &str,
+    files: [&NamedTempFile; 3],
+    merged: &mut NamedTempFile,
+) -> Result<u8> {
+    let [base_file, ours_file, theirs_file] = files;
+
+    // the same key opens the other vaults, git uses an empty base when both
+    // branches added the file
+    for (path, file) in [(base, base_file), (theirs, theirs_file)] {
+        let vault = fs::read(path).with_context(|| format!("Could not open {path}"))?;
+
+        if !vault.is_empty() {
+            let mut plaintext = ssh_vault.open(&vault)?;
+            let rs = file.as_file().write_all(&plaintext);
+            plaintext.zeroize();
+            rs?;
+        }
+    }
+
+    let (mut plaintext, conflicts) =
+        git::merge_file(ours_file.path(), base_file.path(), theirs_file.path())?;
+
+    let rs = stream::encrypt_with_key(
+        header,
+        vault_key,
+        plaintext.as_slice(),
+        BufWriter::new(merged.as_file_mut()),
+    );
+    plaintext.zeroize();
+    rs?;
+
+    Ok(conflicts)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, SshKeyType, SshVault};
+    use ssh_key::PrivateKey;
+
+    fn vault(recipient: &SshVault, data: &str) -> NamedTempFile {
+        let mut file = NamedTempFile::new().unwrap();
+        stream::encrypt(
+            std::slice::from_ref(recipient),
+            data.as_bytes(),
+            file.as_file_mut(),
+        )
+        .unwrap();
+        file
+    }
+
+    #[test]
+    fn test_merge() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+
+        let base = vault(&recipient, "a\nb\nc\n");
+        let ours = vault(&recipient, "A\nb\nc\n");
+        let theirs = vault(&recipient, "a\nb\nC\n");
+
+        let path = |file: &NamedTempFile| file.path().to_str().unwrap().to_string();
+
+        let mut merged = NamedTempFile::new().unwrap();
+        let (_, conflicts) = merge(
+            &path(&base),
+            &path(&ours),
+            &path(&theirs),
+            &mut merged,
+            Some("test_data/ed25519".to_string()),
+        )
+        .unwrap();
+        assert_eq!(conflicts, 0);
+
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let private = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let result = fs::read(merged.path()).unwrap();
+        assert_eq!(private.open(&result).unwrap(), b"A\nb\nC\n");
+
+        // conflicts are kept in the merged vault
+        let theirs = vault(&recipient, "a2\nb\nc\n");
+        let mut merged = NamedTempFile::new().unwrap();
+        let (_, conflicts) = merge(
+            &path(&base),
+            &path(&ours),
+            &path(&theirs),
+            &mut merged,
+            Some("test_data/ed25519".to_string()),
+        )
+        .unwrap();
+        assert_eq!(conflicts, 1);
+
+        let result = private.open(&fs::read(merged.path()).unwrap()).unwrap();
+        assert!(String::from_utf8(result).unwrap().contains("<<<<<<< ours"));
+    }
+}
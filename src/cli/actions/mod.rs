@@ -1,17 +1,62 @@
+pub mod agent;
+pub mod audit_recipients;
+pub mod check;
+pub mod compare;
 pub mod create;
+pub mod decrypt;
+pub mod direnv;
 pub mod edit;
+pub mod encrypt;
+pub mod export;
 pub mod fingerprint;
+pub mod git_filter;
+pub mod git_textconv;
+pub mod grpc;
+pub mod history;
+pub mod import;
+pub mod index;
+pub mod info;
+pub mod keyserver;
+pub mod merge;
+pub mod mount;
+pub mod pack;
+pub mod plugin;
+pub mod relabel;
+pub mod repair;
+pub mod run;
+pub mod scan;
+pub mod server;
+pub mod share;
+pub mod undo;
+pub mod unpack;
+pub mod update;
+pub mod values;
 pub mod view;
+pub mod watch;
 
-use crate::tools;
+use crate::vault::{
+    crypto, dotenv, expiry, find, fips, metadata::Metadata, parse, policy::Policy, revoked,
+    ssh::decrypt_private_key, stream, stream::Header, SshVault,
+};
+use crate::{config, exit::Failure, harden, interrupt, logging, tools};
 use anyhow::{anyhow, Result};
 use secrecy::{ExposeSecret, Secret};
+use slog::debug;
+use ssh_key::PublicKey;
 use std::{
     env,
-    io::{Read, Seek, SeekFrom, Write},
-    process::Command,
+    ffi::OsString,
+    fs::{self, OpenOptions},
+    io::{BufRead, BufReader, Read, Write},
+    path::Path,
+    process::{Child, Command, ExitStatus},
+    thread,
+    time::{Duration, Instant},
 };
-use tempfile::Builder;
+use tempfile::{Builder, NamedTempFile};
+use zeroize::Zeroize;
+
+const SHRED_BLOCK_SIZE: usize = 64 * 1024;
 
 #[derive(Debug)]
 pub enum Action {
@@ -20,66 +65,706 @@ pub enum Action {
         user: Option<String>,
     },
     Create {
+        dual_control: bool,
+        expires: Option<Duration>,
+        file_mode: u32,
         fingerprint: Option<String>,
         input: Option<String>,
         json: bool,
         key: Option<String>,
+        label: Option<String>,
+        preserve: Vec<String>,
+        quiet: bool,
+        recipients: Vec<String>,
+        strict: bool,
         user: Option<String>,
         vault: Option<String>,
     },
     View {
+        exec: Option<String>,
+        file_mode: u32,
+        format: Option<String>,
         key: Option<String>,
+        on: Option<String>,
         output: Option<String>,
         passphrase: Option<Secret<String>>,
+        quiet: bool,
+        raw: bool,
+        redact: bool,
+        restore_owner: bool,
+        revision: Option<i64>,
+        share: Option<String>,
+        strict: bool,
         vault: Option<String>,
     },
+    Direnv {
+        key: Option<String>,
+        vault: String,
+        watch: bool,
+    },
     Edit {
+        force: bool,
+        key: Option<String>,
+        passphrase: Option<Secret<String>>,
+        timeout: Option<EditorTimeout>,
+        vault: String,
+    },
+    Export {
+        cert: Option<String>,
+        force: bool,
+        format: String,
+        key: Option<String>,
+        namespace: Option<String>,
+        output: String,
+        path: String,
+    },
+    GitFilter {
+        key: Option<String>,
+        mode: FilterMode,
+        path: Option<String>,
+    },
+    GitTextconv {
+        key: Option<String>,
+        path: String,
+    },
+    Grpc {
+        key: Option<String>,
+        recipients: Vec<String>,
+        socket: Option<String>,
+    },
+    Import {
+        force: bool,
+        format: String,
+        output: String,
+        path: String,
+        recipients: Vec<String>,
+        single: bool,
+    },
+    Info {
+        json: bool,
+        paths: Vec<String>,
+    },
+    Merge {
+        base: Option<String>,
+        install: bool,
+        key: Option<String>,
+        ours: Option<String>,
+        output: Option<String>,
+        theirs: Option<String>,
+    },
+    Mount {
+        dir: String,
+        key: Option<String>,
+        mountpoint: String,
+        ttl: Duration,
+    },
+    Scan {
+        paths: Vec<String>,
+        patterns: Vec<String>,
+        staged: bool,
+    },
+    Server {
+        acl: Option<String>,
+        listen: String,
+        recipients: Vec<String>,
+        token_file: Option<String>,
+        vaults: Option<String>,
+    },
+    Share {
+        key: Option<String>,
+        output: Option<String>,
+        recipient: Option<String>,
+        ttl: Option<Duration>,
+        vault: String,
+    },
+    Values {
+        decrypt: bool,
+        file: Option<String>,
+        format: Option<String>,
+        in_place: bool,
+        key: Option<String>,
+        recipients: Vec<String>,
+        select: Vec<String>,
+    },
+    Agent {
+        identities: Vec<String>,
+        lifetime: Duration,
+        metrics: Option<String>,
+        socket: Option<String>,
+        stop: bool,
+    },
+    AuditRecipients {
+        exclude: Vec<String>,
+        include: Vec<String>,
+        json: bool,
+        paths: Vec<String>,
+    },
+    Check {
+        exclude: Vec<String>,
+        include: Vec<String>,
+        keys: Vec<String>,
+        paths: Vec<String>,
+    },
+    Repair {
+        key: Option<String>,
+        output: Option<String>,
+        passphrase: Option<Secret<String>>,
+        vault: String,
+    },
+    Encrypt {
+        exclude: Vec<String>,
+        file: String,
+        file_mode: u32,
+        include: Vec<String>,
+        jobs: Option<usize>,
+        key: Option<String>,
+        quiet: bool,
+        recipients: Vec<String>,
+        recursive: bool,
+        remove: bool,
+    },
+    Decrypt {
+        file_mode: u32,
+        force: bool,
+        key: Option<String>,
+        passphrase: Option<Secret<String>>,
+        quiet: bool,
+        restore_owner: bool,
+        vault: String,
+    },
+    Relabel {
+        key: Option<String>,
+        label: Option<String>,
+        passphrase: Option<Secret<String>>,
+        vault: String,
+    },
+    Keyserver {
+        from: Option<String>,
+        ldap: Option<String>,
+        ldap_base: Option<String>,
+        ldap_filter: String,
+        listen: String,
+        max_age: u64,
+    },
+    Index {
+        dir: String,
+    },
+    Run {
+        command: Vec<String>,
+        diff_env: bool,
+        key: Option<String>,
+        ssh: Option<String>,
+        vault: String,
+    },
+    Pack {
+        compress: bool,
+        dir: String,
+        file_mode: u32,
+        key: Option<String>,
+        recipients: Vec<String>,
+        vault: Option<String>,
+    },
+    Unpack {
+        dir: Option<String>,
+        key: Option<String>,
+        passphrase: Option<Secret<String>>,
+        vault: String,
+    },
+    History {
+        vault: String,
+    },
+    Undo {
+        key: Option<String>,
+        passphrase: Option<Secret<String>>,
+        vault: String,
+        yes: bool,
+    },
+    Compare {
+        diff: bool,
+        file: String,
         key: Option<String>,
         passphrase: Option<Secret<String>>,
         vault: String,
     },
+    Update {
+        check: bool,
+        version: Option<String>,
+    },
+    Watch {
+        debounce: Duration,
+        file: String,
+        key: Option<String>,
+        passphrase: Option<Secret<String>>,
+        vault: String,
+    },
+    Plugin {
+        args: Vec<OsString>,
+        log_json: bool,
+        log_level: Option<String>,
+        name: String,
+        profile: Option<String>,
+        socks5: Option<String>,
+    },
     Help,
 }
 
-pub fn process_input(buf: &mut Vec<u8>, data: Option<Secret<String>>) -> Result<usize> {
-    let mut tmpfile = Builder::new()
-        .prefix(".vault-")
-        .suffix(".ssh")
-        .tempfile_in(tools::get_home()?)?;
+/// How long the editor may stay open before warning the user
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct EditorTimeout {
+    pub duration: Duration,
+    // kill the editor and discard the changes instead of only warning
+    pub abort: bool,
+}
+
+/// Direction of the git filter
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FilterMode {
+    // encrypt the working tree file before it's stored in the repository
+    Clean,
+    // decrypt the stored file for the working tree
+    Smudge,
+}
+
+pub fn process_input(
+    buf: &mut Vec<u8>,
+    data: Option<Secret<String>>,
+    timeout: Option<EditorTimeout>,
+) -> Result<usize> {
+    let mut tmpfile = editor_tempfile()?;
+    let _interrupted = shred_on_interrupt(&tmpfile);
 
     if let Some(data) = data {
         write!(tmpfile, "{}", data.expose_secret())?;
     }
 
+    edit_file(&tmpfile, timeout)?;
+
+    // read the file, the editor may have replaced it
+    tmpfile.reopen()?.read_to_end(buf)?;
+
+    // Fill the file with zeros
+    shred(&tmpfile)?;
+
+    Ok(buf.len())
+}
+
+// Temporary file for the editor in the home directory
+fn editor_tempfile() -> Result<NamedTempFile> {
+    Ok(Builder::new()
+        .prefix(".vault-")
+        .suffix(".ssh")
+        .tempfile_in(tools::get_home()?)?)
+}
+
+// Open the file with the EDITOR, the file is shredded if the editor fails
+fn edit_file(tmpfile: &NamedTempFile, timeout: Option<EditorTimeout>) -> Result<()> {
     let editor = env::var("EDITOR").unwrap_or_else(|_| String::from("vi"));
 
-    let editor_parts = shell_words::split(&editor)?;
+    edit_file_with(&editor, tmpfile, timeout)
+}
+
+// Open the file with the editor command, the file is shredded if the editor fails
+fn edit_file_with(
+    editor: &str,
+    tmpfile: &NamedTempFile,
+    timeout: Option<EditorTimeout>,
+) -> Result<()> {
+    let editor_parts = shell_words::split(editor)?;
 
-    let status = Command::new(&editor_parts[0])
+    let mut child = Command::new(&editor_parts[0])
         .args(&editor_parts[1..])
         .arg(tmpfile.path())
-        .status()?;
+        .spawn()?;
+
+    let status = match wait_editor(&mut child, timeout) {
+        Ok(status) => status,
+        Err(e) => {
+            shred(tmpfile)?;
+            return Err(e);
+        }
+    };
 
     if !status.success() {
-        return Err(anyhow!("Editor exited with non-zero status code"));
+        shred(tmpfile)?;
+        return Err(Failure::EditorAborted.error("Editor exited with non-zero status code"));
     }
 
-    // Seek to start
-    tmpfile.seek(SeekFrom::Start(0))?;
+    Ok(())
+}
 
-    // read the file
-    tmpfile.read_to_end(buf)?;
+// Find the private key for the vault key types and decrypt it if needed, without
+// a key the default key that matches the fingerprints of the vault is used
+fn private_vault(
+    key: Option<String>,
+    key_types: &[&str],
+    fingerprints: &[&str],
+    passphrase: Option<Secret<String>>,
+) -> Result<SshVault> {
+    let key = key.or_else(|| find::default_identity(fingerprints));
 
-    // Fill the file with zeros
-    let zeros = vec![0u8; buf.len()];
-    tmpfile.write_all(&zeros)?;
+    let mut private_key = find::private_key_for(key.clone(), key_types)?;
 
-    Ok(buf.len())
+    // decrypt private_key if encrypted
+    if private_key.is_encrypted() {
+        private_key = decrypt_private_key(&private_key, passphrase)?;
+    }
+
+    // RSA or ED25519
+    let key_type = find::key_type(&private_key.algorithm())?;
+
+    let ssh_vault = SshVault::new(&key_type, None, Some(private_key))?;
+
+    debug!(logging::logger(), "private key";
+        "identity" => key.as_deref().unwrap_or("default"),
+        "fingerprint" => ssh_vault.fingerprint());
+
+    Ok(ssh_vault)
+}
+
+// Public keys of the recipient files, of the policy of the current directory
+// or of the `recipients` of the config
+fn recipient_keys(recipients: &[String]) -> Result<Vec<PublicKey>> {
+    let dir = env::current_dir()?;
+
+    let recipients = if recipients.is_empty() && Policy::find(&dir)?.is_none() {
+        config::get()?
+            .get::<Vec<String>>("recipients")
+            .unwrap_or_default()
+            .iter()
+            .map(|path| tools::expand_home(path))
+            .collect()
+    } else {
+        recipients.to_vec()
+    };
+
+    debug!(logging::logger(), "recipients";
+        "source" => if recipients.is_empty() { "policy" } else { "files" },
+        "count" => recipients.len());
+
+    let keys = if recipients.is_empty() {
+        Policy::require(&dir)?.public_keys()?
+    } else {
+        recipients
+            .iter()
+            .map(|path| find::public_keys(path))
+            .collect::<Result<Vec<_>>>()?
+            .concat()
+    };
+
+    revoked::check(&keys)?;
+
+    Ok(keys)
+}
+
+// Decrypt a vault in the streamed or the legacy format, returns the
+// fingerprint of the key used
+fn decrypt<R: BufRead, W: Write>(
+    input: R,
+    output: W,
+    key: Option<String>,
+    passphrase: Option<Secret<String>>,
+) -> Result<String> {
+    decrypt_with_metadata(input, output, key, passphrase, false).map(|(fingerprint, _)| fingerprint)
+}
+
+// Like decrypt, also returns the metadata of the file the vault was created
+// from, empty for vaults created before the streamed format. In strict mode an
+// expired vault is not decrypted
+fn decrypt_with_metadata<R: BufRead, W: Write>(
+    mut input: R,
+    mut output: W,
+    key: Option<String>,
+    passphrase: Option<Secret<String>>,
+    strict: bool,
+) -> Result<(String, Metadata)> {
+    let first_line = stream::read_line(&mut input)?.unwrap_or_default();
+
+    if first_line == stream::MAGIC {
+        let header = Header::read_stanzas(&mut input)?;
+
+        // an agent holding a key of the vault unlocked decrypts the vault key
+        if key.is_none() && passphrase.is_none() {
+            if let Some((fingerprint, vault_key)) = crate::vault::agent::unwrap(&header) {
+                debug!(logging::logger(), "vault key from the agent";
+                    "fingerprint" => &fingerprint);
+                check_expiry(&header, strict)?;
+                stream::decrypt_with_key(&header, &vault_key, input, &mut output)?;
+
+                return Ok((fingerprint, header.metadata));
+            }
+        }
+
+        // find the private_key using the key types of the stanzas
+        let ssh_vault =
+            private_vault(key, &header.key_types(), &header.fingerprints(), passphrase)?;
+
+        let vault_key = header.unwrap(&ssh_vault)?;
+        check_expiry(&header, strict)?;
+
+        // decrypt a chunk at a time
+        stream::decrypt_with_key(&header, &vault_key, input, &mut output)?;
+
+        return Ok((ssh_vault.fingerprint(), header.metadata));
+    }
+
+    // vaults created before the streamed format
+    let mut vault_data = first_line;
+    vault_data.push('\n');
+    input.read_to_string(&mut vault_data)?;
+
+    // parse vault
+    let (key_type, fingerprint, password, data) = parse(&vault_data)?;
+
+    // find the private_key using the vault header AES256 or CHACHA20-POLY1305
+    let ssh_vault = private_vault(key, &[key_type], &[fingerprint.as_str()], passphrase)?;
+
+    let mut data = ssh_vault.view(&password, &data, &fingerprint)?;
+
+    // avoid swapping the secret to disk, unlocked when the process exits
+    let _ = harden::mlock(data.as_bytes());
+
+    let rs = output.write_all(data.as_bytes());
+
+    // zeroize the secret
+    data.zeroize();
+
+    rs?;
+
+    Ok((ssh_vault.fingerprint(), Metadata::default()))
+}
+
+// The expiry is only trusted once the header was checked with the vault key,
+// an expired vault is rejected in strict mode and only warned about otherwise
+fn check_expiry(header: &Header, strict: bool) -> Result<()> {
+    let Some(expiry) = header.expires.as_ref().filter(|expiry| expiry.is_expired()) else {
+        return Ok(());
+    };
+
+    let date = expiry::date(expiry.time);
+
+    if strict {
+        return Err(anyhow!("The vault expired on {date}, rotate the secret"));
+    }
+
+    eprintln!("WARNING: the vault expired on {date}, rotate the secret");
+
+    Ok(())
+}
+
+// Decrypt a vault into the output, returns the vault of the private key and
+// the header and key to encrypt it again, vaults created before the streamed
+// format get a new header and key
+fn open_vault<R: Read, W: Write>(
+    input: R,
+    output: &mut W,
+    key: Option<String>,
+    passphrase: Option<Secret<String>>,
+) -> Result<(SshVault, Header, Secret<[u8; 32]>)> {
+    let mut reader = BufReader::new(input);
+
+    let first_line = stream::read_line(&mut reader)?.unwrap_or_default();
+
+    if first_line == stream::MAGIC {
+        let header = Header::read_stanzas(&mut reader)?;
+
+        // find the private_key using the key types of the stanzas
+        let ssh_vault =
+            private_vault(key, &header.key_types(), &header.fingerprints(), passphrase)?;
+
+        let vault_key = header.unwrap(&ssh_vault)?;
+
+        stream::decrypt_with_key(&header, &vault_key, reader, output)?;
+
+        return Ok((ssh_vault, header, vault_key));
+    }
+
+    let mut vault_data = first_line;
+    vault_data.push('\n');
+    reader.read_to_string(&mut vault_data)?;
+
+    // parse the vault
+    let (key_type, fingerprint, password, data) = parse(&vault_data)?;
+
+    // find the private_key using the vault header AES256 or CHACHA20-POLY1305
+    let ssh_vault = private_vault(key, &[key_type], &[fingerprint.as_str()], passphrase)?;
+
+    // decrypt the vault
+    let mut secret = ssh_vault.view(&password, &data, &fingerprint)?;
+    let rs = output.write_all(secret.as_bytes());
+    secret.zeroize();
+    rs?;
+
+    // upgrade to the streamed format, the previous format can't be written
+    eprintln!(
+        "WARNING: the vault is in the legacy format, saving it upgrades it to {}, older versions of ssh-vault can't read it",
+        stream::MAGIC
+    );
+
+    let vault_key = crypto::gen_password()?;
+    let header = Header {
+        stanzas: vec![ssh_vault.wrap(&vault_key)?],
+        shares: Vec::new(),
+        cipher: fips::cipher()?,
+        metadata: Metadata::default(),
+        label: None,
+        edited: None,
+        expires: None,
+        mac: None,
+    };
+
+    Ok((ssh_vault, header, vault_key))
+}
+
+// Wait for the editor to exit, warning (or aborting) once the timeout is reached
+fn wait_editor(child: &mut Child, timeout: Option<EditorTimeout>) -> Result<ExitStatus> {
+    let Some(timeout) = timeout else {
+        return Ok(child.wait()?);
+    };
+
+    let start = Instant::now();
+    let mut warned = false;
+
+    loop {
+        if let Some(status) = child.try_wait()? {
+            return Ok(status);
+        }
+
+        if !warned && start.elapsed() >= timeout.duration {
+            warned = true;
+
+            if timeout.abort {
+                child.kill()?;
+                child.wait()?;
+                return Err(Failure::EditorAborted.error(format!(
+                    "Editor session timed out after {} minutes, changes discarded",
+                    timeout.duration.as_secs() / 60
+                )));
+            }
+
+            eprintln!(
+                "Warning: the editor has been open for more than {} minutes, the decrypted vault is still on disk",
+                timeout.duration.as_secs() / 60
+            );
+        }
+
+        thread::sleep(Duration::from_millis(200));
+    }
+}
+
+// Shred and remove the temporary file if the process is interrupted, e.g. by
+// Ctrl-C or the terminal closed while the editor is open
+fn shred_on_interrupt(tmpfile: &NamedTempFile) -> interrupt::Guard {
+    let path = tmpfile.path().to_path_buf();
+
+    interrupt::on_interrupt(move || {
+        let _ = shred_file(&path);
+        let _ = fs::remove_file(&path);
+    })
+}
+
+// Overwrite the temporary file with zeros, a block at a time
+fn shred(tmpfile: &NamedTempFile) -> Result<()> {
+    // the editor may have replaced the file, overwrite the one in the path
+    shred_file(tmpfile.path())
+}
+
+// Fill the file with zeros
+fn shred_file(path: &Path) -> Result<()> {
+    let mut file = OpenOptions::new().write(true).open(path)?;
+    let zeros = vec![0u8; SHRED_BLOCK_SIZE];
+
+    let mut len = file.metadata()?.len();
+
+    while len > 0 {
+        let n = usize::try_from(len.min(zeros.len() as u64))?;
+        file.write_all(&zeros[..n])?;
+        len -= n as u64;
+    }
+
+    file.flush()?;
+    Ok(())
+}
+
+// The document with its values masked, or the plaintext masked as a single
+// value if it is not a dotenv, JSON or YAML document
+fn redacted(data: &[u8], path: Option<&str>) -> String {
+    use crate::vault::values;
+
+    let Ok(text) = std::str::from_utf8(data) else {
+        return format!("[{} bytes of binary data]\n", data.len());
+    };
+
+    // by the name of the vault first, then the formats in turn
+    let mut formats: Vec<Box<dyn values::Format>> = Vec::new();
+
+    if let Ok(format) = values::format(None, path.map(|path| path.trim_end_matches(".vault"))) {
+        formats.push(format);
+    }
+
+    formats.push(Box::new(values::dotenv::Dotenv));
+    formats.push(Box::new(values::json::Json));
+    formats.push(Box::new(values::yaml::Yaml));
+
+    for format in formats {
+        let mut masked = 0;
+
+        let rs = format.map_values(text, &mut |key, value| {
+            // a plain text is a YAML scalar without a key
+            if !key.is_empty() {
+                masked += 1;
+            }
+
+            let mut value = unquote(value);
+            let mask = mask(&value);
+            value.zeroize();
+
+            // quoted the same way in dotenv, JSON and YAML
+            Ok(serde_json::to_string(&mask)?)
+        });
+
+        match rs {
+            Ok(doc) if masked > 0 => return doc,
+            Ok(mut doc) => doc.zeroize(),
+            Err(_) => continue,
+        }
+    }
+
+    format!("{}\n", mask(text.trim_end()))
+}
+
+// the first and last 2 characters of the values longer than 8 characters and
+// the length, e.g. s3****1! [14]
+fn mask(value: &str) -> String {
+    let chars: Vec<char> = value.chars().collect();
+
+    if chars.len() > 8 {
+        format!(
+            "{}****{} [{}]",
+            chars[..2].iter().collect::<String>(),
+            chars[chars.len() - 2..].iter().collect::<String>(),
+            chars.len()
+        )
+    } else {
+        format!("******** [{}]", chars.len())
+    }
+}
+
+// the text of a JSON or double quoted string, the others without their quotes
+fn unquote(value: &str) -> String {
+    if value.starts_with('"') {
+        if let Ok(value) = serde_json::from_str::<String>(value) {
+            return value;
+        }
+    }
+
+    dotenv::unquote(value).to_string()
 }
 
 #[cfg(test)]
 mod tests {
+    use super::*;
     use crate::cli::actions::{create, edit, fingerprint, view, Action};
+    use crate::vault::{dio, stream};
     use serde_json::Value;
     use std::io::Write;
     use tempfile::NamedTempFile;
@@ -98,19 +783,19 @@ mod tests {
                 input: "Machs na",
                 public_key: "test_data/ed25519.pub",
                 private_key: "test_data/ed25519",
-                header: "SSH-VAULT;CHACHA20-POLY1305"
+                header: "-> X25519"
             },
             Test {
                 input: "Machs na",
                 public_key: "test_data/id_rsa.pub",
                 private_key: "test_data/id_rsa",
-                header: "SSH-VAULT;AES256"
+                header: "-> RSA-OAEP"
             },
             Test {
                 input: "Arrachera is a Mexican dish made from marinated and grilled skirt steak. The steak is seasoned with a mixture of spices and marinades, giving it a rich and savory flavor. Commonly served in tacos or fajitas, arrachera is known for its tenderness and versatility in Mexican cuisine",
                 public_key: "test_data/ed25519.pub",
                 private_key: "test_data/ed25519",
-                header: "SSH-VAULT;CHACHA20-POLY1305"
+                header: "-> X25519"
             },
         ];
 
@@ -121,25 +806,45 @@ mod tests {
             let vault_file = NamedTempFile::new().unwrap();
 
             let create = Action::Create {
+                dual_control: false,
+                expires: None,
                 fingerprint: None,
                 key: Some(test.public_key.to_string()),
+                label: None,
+                recipients: Vec::new(),
+                strict: false,
                 user: None,
                 vault: Some(vault_file.path().to_str().unwrap().to_string()),
                 json: false,
                 input: Some(temp_file.path().to_str().unwrap().to_string()),
+                preserve: Vec::new(),
+                quiet: false,
+                file_mode: dio::FILE_MODE,
             };
             let vault = create::handle(create);
             assert!(vault.is_ok());
 
             let vault_contents = std::fs::read_to_string(&vault_file).unwrap();
-            assert!(vault_contents.starts_with(test.header));
+            assert!(vault_contents.starts_with(stream::MAGIC));
+            assert!(vault_contents.contains(test.header));
 
             let output = NamedTempFile::new().unwrap();
             let view = Action::View {
+                exec: None,
+                format: None,
+                on: None,
                 key: Some(test.private_key.to_string()),
                 output: Some(output.path().to_str().unwrap().to_string()),
                 passphrase: None,
+                quiet: false,
+                raw: false,
+                redact: false,
+                restore_owner: false,
+                revision: None,
+                share: None,
+                strict: false,
                 vault: Some(vault_file.path().to_str().unwrap().to_string()),
+                file_mode: dio::FILE_MODE,
             };
             let vault_view = view::handle(view);
             assert!(vault_view.is_ok());
@@ -148,8 +853,10 @@ mod tests {
             assert_eq!(input, output);
 
             let edit = Action::Edit {
+                force: false,
                 key: Some(test.private_key.to_string()),
                 passphrase: None,
+                timeout: None,
                 vault: vault_file.path().to_str().unwrap().to_string(),
             };
 
@@ -159,16 +866,44 @@ mod tests {
                 assert!(vault_edit.is_ok());
             });
 
+            // nothing changed, the vault is left alone
+            let vault_contents_after_edit = std::fs::read_to_string(&vault_file).unwrap();
+            assert_eq!(vault_contents, vault_contents_after_edit);
+
+            let edit = Action::Edit {
+                force: true,
+                key: Some(test.private_key.to_string()),
+                passphrase: None,
+                timeout: None,
+                vault: vault_file.path().to_str().unwrap().to_string(),
+            };
+
+            temp_env::with_vars([("EDITOR", Some("cat"))], || {
+                let vault_edit = edit::handle(edit);
+                assert!(vault_edit.is_ok());
+            });
+
             let vault_contents_after_edit = std::fs::read_to_string(&vault_file).unwrap();
             assert_ne!(vault_contents, vault_contents_after_edit);
 
             // check if we can still view the vault
             let output = NamedTempFile::new().unwrap();
             let view = Action::View {
+                exec: None,
+                format: None,
+                on: None,
                 key: Some(test.private_key.to_string()),
                 output: Some(output.path().to_str().unwrap().to_string()),
                 passphrase: None,
+                quiet: false,
+                raw: false,
+                redact: false,
+                restore_owner: false,
+                revision: None,
+                share: None,
+                strict: false,
                 vault: Some(vault_file.path().to_str().unwrap().to_string()),
+                file_mode: dio::FILE_MODE,
             };
             let vault_view = view::handle(view);
             assert!(vault_view.is_ok());
@@ -178,12 +913,20 @@ mod tests {
 
             // try to create again with the same vault (should fail)
             let create = Action::Create {
+                dual_control: false,
+                expires: None,
                 fingerprint: None,
                 key: Some(test.public_key.to_string()),
+                label: None,
+                recipients: Vec::new(),
+                strict: false,
                 user: None,
                 vault: Some(vault_file.path().to_str().unwrap().to_string()),
                 json: false,
                 input: Some(temp_file.path().to_str().unwrap().to_string()),
+                preserve: Vec::new(),
+                quiet: false,
+                file_mode: dio::FILE_MODE,
             };
             let vault = create::handle(create);
             assert!(vault.is_err());
@@ -197,13 +940,13 @@ mod tests {
                 input: "Three may keep a secret, if two of them are dead",
                 public_key: "test_data/ed25519.pub",
                 private_key: "test_data/ed25519",
-                header: "SSH-VAULT;CHACHA20-POLY1305",
+                header: "-> X25519",
             },
             Test {
                 input: "Hello World!",
                 public_key: "test_data/ed25519.pub",
                 private_key: "test_data/ed25519",
-                header: "SSH-VAULT;CHACHA20-POLY1305",
+                header: "-> X25519",
             },
         ];
 
@@ -214,12 +957,20 @@ mod tests {
             let vault_json = NamedTempFile::new().unwrap();
 
             let create = Action::Create {
+                dual_control: false,
+                expires: None,
                 fingerprint: None,
                 key: Some(test.public_key.to_string()),
+                label: None,
+                recipients: Vec::new(),
+                strict: false,
                 user: None,
                 vault: Some(vault_json.path().to_str().unwrap().to_string()),
                 json: true,
                 input: Some(temp_file.path().to_str().unwrap().to_string()),
+                preserve: Vec::new(),
+                quiet: false,
+                file_mode: dio::FILE_MODE,
             };
             let vault = create::handle(create);
             assert!(vault.is_ok());
@@ -233,10 +984,22 @@ mod tests {
             let output = NamedTempFile::new().unwrap();
 
             let view = Action::View {
+                exec: None,
+                format: None,
+
+                on: None,
                 key: Some(test.private_key.to_string()),
                 output: Some(output.path().to_str().unwrap().to_string()),
                 passphrase: None,
+                quiet: false,
+                raw: false,
+                redact: false,
+                restore_owner: false,
+                revision: None,
+                share: None,
+                strict: false,
                 vault: Some(vault_file.path().to_str().unwrap().to_string()),
+                file_mode: dio::FILE_MODE,
             };
             let vault_view = view::handle(view);
             assert!(vault_view.is_ok());
@@ -246,6 +1009,194 @@ mod tests {
         }
     }
 
+    #[test]
+    fn test_create_with_recipients() {
+        let mut temp_file = NamedTempFile::new().unwrap();
+        temp_file.write_all(b"Machs na").unwrap();
+        let vault_file = NamedTempFile::new().unwrap();
+        let vault_path = vault_file.path().to_str().unwrap().to_string();
+
+        let create = Action::Create {
+            dual_control: false,
+            expires: None,
+            fingerprint: None,
+            key: Some("test_data/ed25519.pub".to_string()),
+            label: None,
+            recipients: vec!["test_data/ed25519_password.pub".to_string()],
+            strict: false,
+            user: None,
+            vault: Some(vault_path.clone()),
+            json: false,
+            input: Some(temp_file.path().to_str().unwrap().to_string()),
+            preserve: Vec::new(),
+            quiet: false,
+            file_mode: dio::FILE_MODE,
+        };
+        assert!(create::handle(create).is_ok());
+
+        let vault_contents = std::fs::read_to_string(&vault_path).unwrap();
+        assert_eq!(vault_contents.matches("-> X25519").count(), 2);
+
+        let output = NamedTempFile::new().unwrap();
+        let view = Action::View {
+            exec: None,
+            format: None,
+            on: None,
+            key: Some("test_data/ed25519".to_string()),
+            output: Some(output.path().to_str().unwrap().to_string()),
+            passphrase: None,
+            quiet: false,
+            raw: false,
+            redact: false,
+            restore_owner: false,
+            revision: None,
+            share: None,
+            strict: false,
+            vault: Some(vault_path),
+            file_mode: dio::FILE_MODE,
+        };
+        assert!(view::handle(view).is_ok());
+        assert_eq!(std::fs::read_to_string(output).unwrap(), "Machs na");
+    }
+
+    #[test]
+    fn test_edit_legacy_vault() {
+        let public_key = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let v = SshVault::new(
+            &find::key_type(&public_key.algorithm()).unwrap(),
+            Some(public_key),
+            None,
+        )
+        .unwrap();
+        let password = crate::vault::crypto::gen_password().unwrap();
+        let legacy = v.create(password, &mut b"Machs na".to_vec()).unwrap();
+
+        let mut vault_file = NamedTempFile::new().unwrap();
+        vault_file.write_all(legacy.as_bytes()).unwrap();
+        let vault_path = vault_file.path().to_str().unwrap().to_string();
+
+        let edit = Action::Edit {
+            force: true,
+            key: Some("test_data/ed25519".to_string()),
+            passphrase: None,
+            timeout: None,
+            vault: vault_path.clone(),
+        };
+
+        // the vault is upgraded to the streamed format
+        temp_env::with_vars([("EDITOR", Some("cat"))], || {
+            assert!(edit::handle(edit).is_ok());
+        });
+        assert!(std::fs::read_to_string(&vault_path)
+            .unwrap()
+            .starts_with(stream::MAGIC));
+
+        let output = NamedTempFile::new().unwrap();
+        let view = Action::View {
+            exec: None,
+            format: None,
+            on: None,
+            key: Some("test_data/ed25519".to_string()),
+            output: Some(output.path().to_str().unwrap().to_string()),
+            passphrase: None,
+            quiet: false,
+            raw: false,
+            redact: false,
+            restore_owner: false,
+            revision: None,
+            share: None,
+            strict: false,
+            vault: Some(vault_path),
+            file_mode: dio::FILE_MODE,
+        };
+        assert!(view::handle(view).is_ok());
+        assert_eq!(std::fs::read_to_string(output).unwrap(), "Machs na");
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_edit_conflict() {
+        let mut temp_file = NamedTempFile::new().unwrap();
+        temp_file.write_all(b"Machs na").unwrap();
+        let vault_file = NamedTempFile::new().unwrap();
+        let vault_path = vault_file.path().to_str().unwrap().to_string();
+
+        let create = Action::Create {
+            dual_control: false,
+            expires: None,
+            fingerprint: None,
+            key: Some("test_data/ed25519.pub".to_string()),
+            label: None,
+            recipients: Vec::new(),
+            strict: false,
+            user: None,
+            vault: Some(vault_path.clone()),
+            json: false,
+            input: Some(temp_file.path().to_str().unwrap().to_string()),
+            preserve: Vec::new(),
+            quiet: false,
+            file_mode: dio::FILE_MODE,
+        };
+        assert!(create::handle(create).is_ok());
+        let original = std::fs::read_to_string(&vault_path).unwrap();
+
+        let edit = Action::Edit {
+            force: true,
+            key: Some("test_data/ed25519".to_string()),
+            passphrase: None,
+            timeout: None,
+            vault: vault_path.clone(),
+        };
+
+        // the "editor" modifies the vault on disk while it is being edited
+        let editor = format!("sh -c 'echo changed > {vault_path}' sh");
+        temp_env::with_vars([("EDITOR", Some(editor))], || {
+            assert!(edit::handle(edit).is_err());
+        });
+
+        assert_eq!(std::fs::read_to_string(&vault_path).unwrap(), "changed\n");
+        assert_eq!(
+            std::fs::read_to_string(format!("{vault_path}.base")).unwrap(),
+            original
+        );
+        let mine = std::fs::read_to_string(format!("{vault_path}.mine")).unwrap();
+        assert!(mine.starts_with(stream::MAGIC));
+
+        std::fs::remove_file(format!("{vault_path}.base")).unwrap();
+        std::fs::remove_file(format!("{vault_path}.mine")).unwrap();
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_wait_editor_timeout_abort() {
+        let mut child = std::process::Command::new("sleep")
+            .arg("5")
+            .spawn()
+            .unwrap();
+        let timeout = EditorTimeout {
+            duration: Duration::from_millis(100),
+            abort: true,
+        };
+        let start = Instant::now();
+        assert!(wait_editor(&mut child, Some(timeout)).is_err());
+        assert!(start.elapsed() < Duration::from_secs(5));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_wait_editor_timeout_warn() {
+        let mut child = std::process::Command::new("sleep")
+            .arg("1")
+            .spawn()
+            .unwrap();
+        let timeout = EditorTimeout {
+            duration: Duration::from_millis(100),
+            abort: false,
+        };
+        let status = wait_editor(&mut child, Some(timeout)).unwrap();
+        assert!(status.success());
+    }
+
     #[test]
     fn test_fingerprint() {
         let fingerprint = Action::Fingerprint {
@@ -256,4 +1207,31 @@ mod tests {
         let fingerprint = fingerprint::handle(fingerprint);
         assert!(fingerprint.is_ok());
     }
+
+    #[test]
+    fn test_redacted() {
+        assert_eq!(
+            redacted(b"USER=app\nPASSWORD=\"correct horse\" # old\n", None),
+            "USER=\"******** [3]\"\nPASSWORD=\"co****se [13]\" # old\n"
+        );
+        assert_eq!(
+            redacted(
+                br#"{"db": {"password": "correct horse", "port": 5432}}"#,
+                None
+            ),
+            r#"{"db": {"password": "co****se [13]", "port": "******** [4]"}}"#
+        );
+        assert_eq!(
+            redacted(
+                b"db:\n  password: correct horse\n",
+                Some("config.yml.vault")
+            ),
+            "db:\n  password: \"co****se [13]\"\n"
+        );
+        assert_eq!(
+            redacted(b"correct horse battery staple\n", None),
+            "co****le [28]\n"
+        );
+        assert_eq!(redacted(&[0xff, 0x00], None), "[2 bytes of binary data]\n");
+    }
 }
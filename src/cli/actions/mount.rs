@@ -0,0 +1,30 @@
+use crate::cli::actions::{private_vault, Action};
+use crate::vault::{
+    mount::{self, Cache, Tree},
+    ssh,
+};
+use anyhow::Result;
+use std::path::Path;
+
+/// Handle the mount action
+/// # Errors
+/// Will return an error if the private key can't be used or the directory can't be mounted
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Mount {
+            dir,
+            key,
+            mountpoint,
+            ttl,
+        } => {
+            let tree = Tree::scan(Path::new(&dir))?;
+
+            // the passphrase is asked once, before mounting
+            let vault = private_vault(key, &[ssh::ed25519::STANZA, ssh::rsa::STANZA], &[], None)?;
+
+            mount::mount(tree, Cache::new(vault, ttl), Path::new(&mountpoint))?;
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
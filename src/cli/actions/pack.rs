@@ -0,0 +1,67 @@
+use crate::audit;
+use crate::cli::actions::Action;
+use crate::vault::{archive, dio::OutputDestination, find, permissions, revoked, stream, SshVault};
+use anyhow::{anyhow, Result};
+use ssh_key::HashAlg;
+use std::{
+    io::{BufWriter, Write},
+    path::Path,
+};
+use zeroize::Zeroize;
+
+/// Handle the pack action
+/// # Errors
+/// Will return an error if the directory can't be archived or the vault exists
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Pack {
+            compress,
+            dir,
+            file_mode,
+            key,
+            recipients,
+            vault,
+        } => {
+            let mut keys = vec![find::public_key(key)?];
+
+            // the other keys that can open the vault
+            for path in &recipients {
+                keys.extend(find::public_keys(path)?);
+            }
+
+            revoked::check(&keys)?;
+
+            let key_fingerprint = keys[0].fingerprint(HashAlg::Sha256).to_string();
+
+            let vaults = keys
+                .into_iter()
+                .map(|key| SshVault::new(&find::key_type(&key.algorithm())?, Some(key), None))
+                .collect::<Result<Vec<_>>>()?;
+
+            if let Some(path) = vault.as_deref().filter(|path| *path != "-") {
+                permissions::check_vault_dir(Path::new(path));
+            }
+
+            let output = OutputDestination::with_mode(vault.clone(), file_mode)?;
+
+            if !output.is_empty()? {
+                return Err(anyhow!("Vault file already exists"));
+            }
+
+            // the archive is kept in memory to zeroize it
+            let mut data = Vec::new();
+            let rs = archive::pack(Path::new(&dir), compress, &mut data).and_then(|()| {
+                let mut output = BufWriter::new(output);
+                stream::encrypt(&vaults, data.as_slice(), &mut output)?;
+                Ok(output.flush()?)
+            });
+            data.zeroize();
+
+            rs?;
+
+            audit::log("create", vault.as_deref(), &key_fingerprint);
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
@@ -0,0 +1,158 @@
+// Commands ssh-vault doesn't know run the plugin ssh-vault-<command> found in
+// the PATH with the rest of the arguments, like git and kubectl do:
+//
+//   ssh-vault rotate --all secrets/   runs   ssh-vault-rotate --all secrets/
+//
+// stdin, stdout and stderr are the ones of ssh-vault, and the plugin gets its
+// context in the environment:
+//
+//   SSH_VAULT_BIN       the ssh-vault executable, to call it back
+//   SSH_VAULT_PROFILE   with --profile, SSH_VAULT_LOG_LEVEL with --log-level
+//   SSH_VAULT_CONTEXT   everything as JSON: version, bin, config, profile,
+//                       log_level, log_json, socks5 and agent_socket
+//
+// so `$SSH_VAULT_BIN view ...` uses the same settings as the plugin was given
+
+use crate::cli::actions::Action;
+use crate::{config, exit::Failure, vault::agent};
+use anyhow::{Context, Result};
+use serde_json::json;
+use std::{
+    env,
+    ffi::OsString,
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+/// Prefix of the plugin executables
+pub const PREFIX: &str = "ssh-vault-";
+
+/// Handle the plugin action, returns the exit code of the plugin
+/// # Errors
+/// Will return an error if there is no plugin with the name or it can't be run
+pub fn handle(action: Action) -> Result<i32> {
+    match action {
+        Action::Plugin {
+            args,
+            log_json,
+            log_level,
+            name,
+            profile,
+            socks5,
+        } => {
+            let program = find(&name, env::var_os("PATH")).ok_or_else(|| {
+                Failure::Usage.error(format!(
+                    "Unknown command {name}, no {PREFIX}{name} plugin in the PATH"
+                ))
+            })?;
+
+            let bin = env::current_exe()?;
+
+            let context = json!({
+                "version": env!("CARGO_PKG_VERSION"),
+                "bin": bin,
+                "config": config::path().ok(),
+                "profile": config::profile().ok().flatten(),
+                "log_level": log_level,
+                "log_json": log_json,
+                "socks5": socks5,
+                "agent_socket": agent::socket_path().ok(),
+            });
+
+            let mut command = Command::new(&program);
+            command
+                .args(&args)
+                .env("SSH_VAULT_BIN", &bin)
+                .env("SSH_VAULT_CONTEXT", context.to_string());
+
+            for (name, value) in [
+                ("SSH_VAULT_PROFILE", &profile),
+                ("SSH_VAULT_LOG_LEVEL", &log_level),
+            ] {
+                if let Some(value) = value {
+                    command.env(name, value);
+                }
+            }
+
+            run(command, &program)
+        }
+        _ => unreachable!(),
+    }
+}
+
+// The plugin replaces ssh-vault, signals and the exit code are its own
+#[cfg(unix)]
+fn run(mut command: Command, program: &Path) -> Result<i32> {
+    use std::os::unix::process::CommandExt;
+
+    // only returns if the plugin can't be run
+    Err(command.exec()).with_context(|| format!("Could not run {}", program.display()))
+}
+
+#[cfg(not(unix))]
+fn run(mut command: Command, program: &Path) -> Result<i32> {
+    let status = command
+        .status()
+        .with_context(|| format!("Could not run {}", program.display()))?;
+
+    Ok(status.code().unwrap_or(crate::exit::FAILURE))
+}
+
+// The first ssh-vault-<name> executable in the directories of the PATH
+fn find(name: &str, path: Option<OsString>) -> Option<PathBuf> {
+    // a name, not a path that could run something else
+    if name.is_empty() || name.contains(['/', '\\']) || name.starts_with('.') {
+        return None;
+    }
+
+    let file = format!("{PREFIX}{name}{}", env::consts::EXE_SUFFIX);
+
+    env::split_paths(&path?)
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .map(|dir| dir.join(&file))
+        .find(|candidate| is_executable(candidate))
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+
+    path.metadata().map_or(false, |m| {
+        m.is_file() && m.permissions().mode() & 0o111 != 0
+    })
+}
+
+#[cfg(not(unix))]
+fn is_executable(path: &Path) -> bool {
+    path.is_file()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    #[test]
+    #[cfg(unix)]
+    fn test_find() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let first = tempfile::tempdir().unwrap();
+        let second = tempfile::tempdir().unwrap();
+
+        let plugin = second.path().join("ssh-vault-rotate");
+        fs::write(&plugin, "#!/bin/sh\n").unwrap();
+        fs::set_permissions(&plugin, fs::Permissions::from_mode(0o755)).unwrap();
+
+        // not executable
+        fs::write(first.path().join("ssh-vault-rotate"), "#!/bin/sh\n").unwrap();
+
+        let path = env::join_paths([first.path(), second.path()]).ok();
+
+        assert_eq!(find("rotate", path.clone()), Some(plugin));
+        assert_eq!(find("missing", path.clone()), None);
+        assert_eq!(find("../rotate", path.clone()), None);
+        assert_eq!(find("", path), None);
+        assert_eq!(find("rotate", None), None);
+    }
+}
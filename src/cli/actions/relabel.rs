@@ -0,0 +1,73 @@
+use crate::audit;
+use crate::cli::actions::{private_vault, Action};
+use crate::vault::{history, label::Label, stream::Header};
+use anyhow::{Context, Result};
+use std::{
+    fs::{self, File},
+    io::{self, BufReader, BufWriter, Write},
+    path::Path,
+};
+use tempfile::NamedTempFile;
+
+/// Handle the relabel action
+/// # Errors
+/// Will return an error if the key can't open the vault or the label is not valid
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Relabel {
+            key,
+            label,
+            passphrase,
+            vault,
+        } => {
+            let path = Path::new(&vault);
+
+            let mut reader = BufReader::new(
+                File::open(path).with_context(|| format!("Could not open {vault}"))?,
+            );
+            let mut header = Header::read(&mut reader)?;
+
+            let ssh_vault =
+                private_vault(key, &header.key_types(), &header.fingerprints(), passphrase)?;
+
+            // the current label is replaced, a recipient can fix a modified one
+            // unless the header has a mac, then nothing can have been modified
+            if header.mac.is_none() {
+                header.label = None;
+            }
+            let vault_key = header.unwrap(&ssh_vault)?;
+
+            header.label = label
+                .map(|label| Label::new(&label, &vault_key))
+                .transpose()?;
+
+            // the payload is copied as is, it doesn't depend on the label, only
+            // on whether the header has a mac
+            if header.mac.is_some() {
+                header.authenticate(&vault_key)?;
+            }
+
+            let dir = path
+                .parent()
+                .filter(|dir| !dir.as_os_str().is_empty())
+                .unwrap_or_else(|| Path::new("."));
+            let mut tmp = NamedTempFile::new_in(dir)?;
+
+            {
+                let mut output = BufWriter::new(tmp.as_file_mut());
+                header.write(&mut output)?;
+                io::copy(&mut reader, &mut output)?;
+                output.flush()?;
+            }
+
+            tmp.as_file()
+                .set_permissions(fs::metadata(path)?.permissions())?;
+
+            history::persist(tmp, path)?;
+
+            audit::log("relabel", Some(&vault), &ssh_vault.fingerprint());
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
@@ -0,0 +1,50 @@
+use crate::audit;
+use crate::cli::actions::{private_vault, Action};
+use crate::vault::{dio, stream, stream::Header};
+use anyhow::{anyhow, Context, Result};
+use std::{fs::File, io::BufReader};
+
+/// Handle the repair action
+/// # Errors
+/// Will return an error if the vault can't be opened or chunks were lost
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Repair {
+            key,
+            output,
+            passphrase,
+            vault,
+        } => {
+            let mut input = BufReader::new(
+                File::open(&vault).with_context(|| format!("Could not open {vault}"))?,
+            );
+
+            // only the streamed format has chunks
+            if stream::read_line(&mut input)?.as_deref() != Some(stream::MAGIC) {
+                return Err(anyhow!(
+                    "Only vaults in the streamed format ({}) can be repaired",
+                    stream::MAGIC
+                ));
+            }
+
+            let header = Header::read_stanzas(&mut input)?;
+
+            let ssh_vault =
+                private_vault(key, &header.key_types(), &header.fingerprints(), passphrase)?;
+
+            let output = dio::OutputDestination::new(output)?;
+            output.truncate()?;
+            let recovery = stream::repair(&header, &header.unwrap(&ssh_vault)?, input, output)?;
+
+            audit::log("repair", Some(&vault), &ssh_vault.fingerprint());
+
+            eprintln!("{recovery}");
+
+            if !recovery.is_intact() {
+                return Err(anyhow!("{vault} is damaged, part of the data was lost"));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
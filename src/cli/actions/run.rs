@@ -0,0 +1,267 @@
+use crate::audit;
+use crate::cli::actions::{decrypt, direnv, Action};
+use crate::style::{Color, Style};
+use crate::vault::{dotenv, remote};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    env,
+    fs::File,
+    io::{self, BufReader, Write},
+    process::{Command, ExitStatus, Stdio},
+    thread,
+};
+use zeroize::Zeroize;
+
+/// Handle the run action
+/// # Errors
+/// Will return an error if the vault can't be decrypted, it has invalid lines
+/// or the command fails
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Run {
+            command,
+            diff_env,
+            key,
+            ssh,
+            vault,
+        } => {
+            let input = File::open(&vault).with_context(|| format!("Could not open {vault}"))?;
+
+            if diff_env {
+                let mut data = Vec::new();
+                let rs =
+                    decrypt(BufReader::new(input), &mut data, key, None).and_then(|fingerprint| {
+                        let mut vars = dotenv::parse(std::str::from_utf8(&data)?)?;
+
+                        print!(
+                            "{}",
+                            env_changes(&vars, |name| env::var(name).ok(), Style::stdout())
+                        );
+
+                        for (_, value) in &mut vars {
+                            value.zeroize();
+                        }
+
+                        Ok(fingerprint)
+                    });
+                data.zeroize();
+
+                audit::log("view", Some(&vault), &rs?);
+
+                return Ok(());
+            }
+
+            let mut data = Vec::new();
+            let rs = decrypt(BufReader::new(input), &mut data, key, None).and_then(|fingerprint| {
+                let env = std::str::from_utf8(&data)?;
+
+                let status = match &ssh {
+                    Some(destination) => run_on(destination, &command, env)?,
+                    None => run(&command, env)?,
+                };
+
+                Ok((fingerprint, status))
+            });
+            data.zeroize();
+
+            let (fingerprint, status) = rs?;
+
+            audit::log("view", Some(&vault), &fingerprint);
+
+            if !status.success() {
+                return Err(anyhow!(
+                    "{} exited with {status}",
+                    shell_words::join(&command)
+                ));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// Run the command with the variables added to its environment
+fn run(command: &[String], env: &str) -> Result<ExitStatus> {
+    let (program, args) = command
+        .split_first()
+        .ok_or_else(|| anyhow!("The command to run is empty"))?;
+
+    let mut vars = dotenv::parse(env)?;
+
+    let status = Command::new(program)
+        .args(args)
+        .envs(vars.iter().map(|(key, value)| (key, value)))
+        .status()
+        .with_context(|| format!("Failed to run {program}"));
+
+    for (_, value) in &mut vars {
+        value.zeroize();
+    }
+
+    status
+}
+
+// The variables the command would get that are not in the environment (+) or
+// have another value there (~), only their names so no secret reaches the
+// terminal
+fn env_changes<F>(vars: &[(String, String)], current: F, style: Style) -> String
+where
+    F: Fn(&str) -> Option<String>,
+{
+    let mut out = String::new();
+    let mut same = 0;
+
+    for (name, value) in vars {
+        let (sign, color) = match current(name) {
+            None => ("+", Color::Green),
+            Some(mut existing) => {
+                let changed = existing != *value;
+                existing.zeroize();
+
+                if !changed {
+                    same += 1;
+                    continue;
+                }
+
+                ("~", Color::Yellow)
+            }
+        };
+
+        out.push_str(&format!(
+            "{} {}\n",
+            style.paint(sign, color),
+            style.paint(name, Color::Bold)
+        ));
+    }
+
+    if out.is_empty() {
+        out.push_str("The vault adds no variables and overrides none\n");
+    }
+
+    if same > 0 {
+        out.push_str(&format!("{same} variable(s) already have the same value\n"));
+    }
+
+    out
+}
+
+// Run the command on the host, the export lines are the first bytes of the
+// session and are evaluated by the remote shell before the command, the rest
+// of stdin goes to the command
+fn run_on(destination: &str, command: &[String], env: &str) -> Result<ExitStatus> {
+    let mut exports = direnv::exports(env)?;
+
+    let mut child = remote::ssh_session(destination)?
+        .arg(remote_command(exports.len(), command))
+        .stdin(Stdio::piped())
+        .spawn()
+        .context("Failed to run ssh")?;
+
+    let mut stdin = child
+        .stdin
+        .take()
+        .ok_or_else(|| anyhow!("Failed to run ssh"))?;
+
+    let rs = stdin.write_all(exports.as_bytes());
+    exports.zeroize();
+
+    if let Err(e) = rs {
+        let _ = child.kill();
+        return Err(e).with_context(|| format!("Failed to send the variables to {destination}"));
+    }
+
+    // not joined, it waits for stdin while the command runs
+    thread::spawn(move || io::copy(&mut io::stdin(), &mut stdin));
+
+    Ok(child.wait()?)
+}
+
+// the command line run by the shell of the remote user, dd reads exactly the
+// export lines so the command gets the rest of stdin
+fn remote_command(length: usize, command: &[String]) -> String {
+    let script = format!("eval \"$(dd bs=1 count={length} 2>/dev/null)\" && exec \"$@\"");
+
+    format!(
+        "sh -c {} sh {}",
+        shell_words::quote(&script),
+        shell_words::join(command)
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_remote_command() {
+        let command = vec!["psql".to_string(), "-c".to_string(), "select 1".to_string()];
+
+        assert_eq!(
+            remote_command(42, &command),
+            r#"sh -c 'eval "$(dd bs=1 count=42 2>/dev/null)" && exec "$@"' sh psql -c 'select 1'"#
+        );
+    }
+
+    #[test]
+    fn test_remote_command_env() {
+        let exports = direnv::exports("PASSWORD=\"it's $ecret\"\n").unwrap();
+        let command = vec![
+            "sh".to_string(),
+            "-c".to_string(),
+            "echo \"$PASSWORD\"; cat".to_string(),
+        ];
+
+        let mut child = Command::new("sh")
+            .arg("-c")
+            .arg(remote_command(exports.len(), &command))
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .spawn()
+            .unwrap();
+
+        let mut stdin = child.stdin.take().unwrap();
+        stdin.write_all(exports.as_bytes()).unwrap();
+        stdin.write_all(b"stdin\n").unwrap();
+        drop(stdin);
+
+        let output = child.wait_with_output().unwrap();
+        assert!(output.status.success());
+        assert_eq!(output.stdout, b"it's $ecret\nstdin\n");
+    }
+
+    #[test]
+    fn test_env_changes() {
+        let vars = [
+            ("USER", "app"),
+            ("DB_PASSWORD", "correct horse"),
+            ("HOME", "/root"),
+        ]
+        .map(|(name, value)| (name.to_string(), value.to_string()));
+
+        let current = |name: &str| match name {
+            "USER" => Some("alice".to_string()),
+            "HOME" => Some("/root".to_string()),
+            _ => None,
+        };
+
+        let changes = env_changes(&vars, current, Style::plain());
+        assert_eq!(
+            changes,
+            "~ USER\n+ DB_PASSWORD\n1 variable(s) already have the same value\n"
+        );
+        assert!(!changes.contains("correct") && !changes.contains("[13]"));
+
+        assert_eq!(
+            env_changes(&vars[2..], current, Style::plain()),
+            "The vault adds no variables and overrides none\n\
+             1 variable(s) already have the same value\n"
+        );
+    }
+
+    #[test]
+    fn test_run_invalid() {
+        assert!(run(&[], "USER=app").is_err());
+        assert!(run(&["true".to_string()], "not a variable").is_err());
+        assert!(run_on("-oProxyCommand=sh", &["env".to_string()], "USER=app").is_err());
+    }
+}
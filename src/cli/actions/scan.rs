@@ -0,0 +1,64 @@
+use crate::cli::actions::Action;
+use crate::git;
+use crate::vault::{info, scan::Scanner};
+use anyhow::{anyhow, Result};
+use std::path::{Path, PathBuf};
+
+/// Handle the scan action
+/// # Errors
+/// Will return an error if plaintext files that should be vaults are found
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Scan {
+            paths,
+            patterns,
+            staged,
+        } => {
+            let mut scanner = Scanner::new(&patterns)?;
+            let mut leaks = 0;
+
+            if staged {
+                // the content in the index is what gets committed
+                for file in git::staged_files()? {
+                    if let Some(content) = git::staged_blob(&file) {
+                        if let Some(leak) = scanner.check(Path::new(&file), &content)? {
+                            println!("{file}: {leak}");
+                            leaks += 1;
+                        }
+                    }
+                }
+            } else {
+                let paths = if paths.is_empty() {
+                    vec![String::from(".")]
+                } else {
+                    paths
+                };
+
+                for path in paths {
+                    let path = PathBuf::from(path);
+
+                    let files = if path.is_dir() {
+                        info::walk(&path)?
+                    } else {
+                        vec![path]
+                    };
+
+                    for file in files {
+                        if let Some(leak) = scanner.check_file(&file)? {
+                            println!("{}: {leak}", file.display());
+                            leaks += 1;
+                        }
+                    }
+                }
+            }
+
+            if leaks > 0 {
+                return Err(anyhow!(
+                    "{leaks} plaintext file(s) should be vaults, encrypt them with ssh-vault create"
+                ));
+            }
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
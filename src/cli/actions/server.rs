@@ -0,0 +1,59 @@
+use crate::cli::actions::{recipient_keys, Action};
+use crate::vault::{
+    acl::{Access, Acl},
+    find,
+    metrics::Metrics,
+    server::Server,
+    ssh::prompt,
+    SshVault,
+};
+use anyhow::{anyhow, Result};
+use std::{
+    net::TcpListener,
+    path::{Path, PathBuf},
+};
+
+/// Handle the server action
+/// # Errors
+/// Will return an error if there are no recipients or the address can't be used
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Server {
+            acl,
+            listen,
+            recipients,
+            token_file,
+            vaults,
+        } => {
+            let access = match (acl, token_file) {
+                (Some(acl), _) => Access::file(Path::new(&acl))?,
+                (None, Some(token_file)) => Access::new(
+                    Acl::token(prompt::from_file(&token_file)?)
+                        .map_err(|_| anyhow!("The token in {token_file} is empty"))?,
+                ),
+                (None, None) => return Err(anyhow!("A token file or an ACL is required")),
+            };
+
+            let keys = recipient_keys(&recipients)?;
+
+            let recipients = keys
+                .into_iter()
+                .map(|key| SshVault::new(&find::key_type(&key.algorithm())?, Some(key), None))
+                .collect::<Result<Vec<_>>>()?;
+
+            let listener = TcpListener::bind(&listen)?;
+
+            eprintln!("Listening on http://{}", listener.local_addr()?);
+
+            Server {
+                access,
+                recipients,
+                vaults: vaults.map(PathBuf::from),
+                metrics: Metrics::default(),
+            }
+            .serve(&listener)?;
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
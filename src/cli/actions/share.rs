@@ -0,0 +1,78 @@
+use crate::audit;
+use crate::cli::actions::{private_vault, Action};
+use crate::vault::{dio::OutputDestination, find, info, paste, stream, stream::Header, SshVault};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    fs::{self, File},
+    io::BufReader,
+    path::Path,
+    time::Duration,
+};
+
+/// Handle the share action
+/// # Errors
+/// Will return an error if the key has no share of the vault or the recipient
+/// is not the other key of the pair, or if the upload of the vault fails
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Share {
+            key,
+            output,
+            recipient,
+            ttl,
+            vault,
+        } => {
+            // a one-time link to the vault instead of a share
+            if let Some(ttl) = ttl {
+                return upload(&vault, ttl);
+            }
+
+            let recipient = recipient.ok_or_else(|| anyhow!("Recipient required"))?;
+
+            let header = Header::read(&mut BufReader::new(
+                File::open(&vault).with_context(|| format!("Could not open {vault}"))?,
+            ))?;
+
+            if header.shares.is_empty() {
+                return Err(anyhow!("{vault} is not a dual control vault"));
+            }
+
+            let partner = find::public_key(Some(recipient))?;
+            let partner =
+                SshVault::new(&find::key_type(&partner.algorithm())?, Some(partner), None)?;
+
+            let ssh_vault = private_vault(key, &header.key_types(), &header.fingerprints(), None)?;
+
+            let share = header.share_for(&ssh_vault, &partner)?;
+
+            stream::write_share(&share, &mut OutputDestination::new(output)?)?;
+
+            audit::log("share", Some(&vault), &ssh_vault.fingerprint());
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// Only the ciphertext is uploaded, the link is printed to stdout and how to
+// open it to stderr
+fn upload(vault: &str, ttl: Duration) -> Result<()> {
+    let endpoint = paste::endpoint()?;
+
+    if !info::is_vault(Path::new(vault)) {
+        return Err(anyhow!("{vault} is not a vault"));
+    }
+
+    let data = fs::read(vault).with_context(|| format!("Could not open {vault}"))?;
+
+    let url = paste::upload(&endpoint, &data, ttl)?;
+
+    println!("{url}");
+
+    eprintln!(
+        "The link works once and expires in {}, send it to the recipient, they open the vault with:\n\n    curl -s '{url}' | ssh-vault view",
+        humantime::format_duration(Duration::from_secs(ttl.as_secs()))
+    );
+
+    Ok(())
+}
@@ -0,0 +1,149 @@
+use crate::audit;
+use crate::cli::actions::{open_vault, Action};
+use crate::style::{Color, Style};
+use crate::vault::{diff, dio, history, lock::Lock, ssh::prompt};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    fs::{self, File},
+    io,
+    path::Path,
+};
+use tempfile::Builder;
+use zeroize::Zeroize;
+
+/// Handle the undo action
+/// # Errors
+/// Will return an error if there is no revision to restore or the vault can't be written
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Undo {
+            key,
+            passphrase,
+            vault,
+            yes,
+        } => {
+            // the vault can't be edited while it is being restored
+            let _lock = Lock::acquire(&vault)?;
+
+            let path = Path::new(&vault);
+
+            if history::list(path)?.is_empty() {
+                return Err(anyhow!(
+                    "{vault} has no revisions to undo, set history in the config to keep them"
+                ));
+            }
+
+            let previous = history::revision(path, -1)?;
+
+            // nothing is decrypted with --yes
+            let fingerprint = if yes {
+                String::new()
+            } else {
+                let mut current = Vec::new();
+                let (ssh_vault, _, _) = open_vault(
+                    File::open(path).with_context(|| format!("Could not open {vault}"))?,
+                    &mut current,
+                    key,
+                    passphrase,
+                )?;
+
+                let rs = ssh_vault
+                    .open(&fs::read(&previous.path)?)
+                    .map(|mut restored| {
+                        let changes = changes(&current, &restored, Style::stdout());
+                        restored.zeroize();
+                        changes
+                    });
+                current.zeroize();
+                let mut changes =
+                    rs.with_context(|| format!("Could not open {}", previous.path.display()))?;
+
+                if changes.is_empty() {
+                    println!("The previous revision has the same content");
+                } else {
+                    print!("{changes}");
+                }
+                changes.zeroize();
+
+                if !prompt::confirm(&format!("Revert {vault} to the previous revision?"))
+                    .context("Could not confirm, use --yes to restore without confirming")?
+                {
+                    eprintln!("{vault} unchanged");
+                    return Ok(());
+                }
+
+                ssh_vault.fingerprint()
+            };
+
+            // the current version is kept as a revision, undo again to get it back
+            let dir = path
+                .parent()
+                .filter(|dir| !dir.as_os_str().is_empty())
+                .unwrap_or_else(|| Path::new("."));
+            let mut tmp = Builder::new().prefix(".vault-").tempfile_in(dir)?;
+
+            io::copy(&mut File::open(&previous.path)?, tmp.as_file_mut())?;
+            // a deleted vault gets back the permissions of the revision
+            let metadata = fs::metadata(path).or_else(|_| fs::metadata(&previous.path))?;
+            tmp.as_file().set_permissions(metadata.permissions())?;
+
+            history::persist(tmp, path)?;
+
+            eprintln!("{vault} restored from {}", previous.path.display());
+
+            audit::log("undo", Some(&vault), &fingerprint);
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// What the undo reverts, the lines removed are the ones of the current version
+fn changes(current: &[u8], restored: &[u8], style: Style) -> String {
+    if current == restored {
+        return String::new();
+    }
+
+    if dio::is_binary(current) || dio::is_binary(restored) {
+        return String::from("The binary content differs\n");
+    }
+
+    diff::unified(
+        &String::from_utf8_lossy(current),
+        &String::from_utf8_lossy(restored),
+        3,
+    )
+    .lines()
+    .map(|line| {
+        let color = match line.chars().next() {
+            Some('-') => Some(Color::Red),
+            Some('+') => Some(Color::Green),
+            Some('@') => Some(Color::Cyan),
+            _ => None,
+        };
+
+        color.map_or_else(
+            || format!("{line}\n"),
+            |color| format!("{}\n", style.paint(line, color)),
+        )
+    })
+    .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_changes() {
+        assert_eq!(changes(b"same\n", b"same\n", Style::plain()), "");
+        assert_eq!(
+            changes(b"a\nbotched\n", b"a\nb\n", Style::plain()),
+            "@@ -1,2 +1,2 @@\n a\n-botched\n+b\n"
+        );
+        assert_eq!(
+            changes(b"\0\x01", b"\0\x02", Style::plain()),
+            "The binary content differs\n"
+        );
+    }
+}
@@ -0,0 +1,49 @@
+use crate::audit;
+use crate::cli::actions::{decrypt, encrypt::EXTENSION, Action};
+use crate::vault::archive;
+use anyhow::{anyhow, Context, Result};
+use std::{fs::File, io::BufReader, path::Path};
+use zeroize::Zeroize;
+
+/// Handle the unpack action
+/// # Errors
+/// Will return an error if the vault can't be decrypted, it is not an archive
+/// or the directory is not empty
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Unpack {
+            dir,
+            key,
+            passphrase,
+            vault,
+        } => {
+            // next to the vault without the extension
+            let dir = match dir {
+                Some(dir) => dir,
+                None => vault
+                    .strip_suffix(EXTENSION)
+                    .filter(|dir| !dir.is_empty() && !dir.ends_with('/'))
+                    .map(str::to_string)
+                    .ok_or_else(|| {
+                        anyhow!("{vault} doesn't end with {EXTENSION}, give the directory")
+                    })?,
+            };
+
+            let input = File::open(&vault).with_context(|| format!("Could not open {vault}"))?;
+
+            let mut data = Vec::new();
+            let rs = decrypt(BufReader::new(input), &mut data, key, passphrase).and_then(
+                |fingerprint| Ok((fingerprint, archive::unpack(&data, Path::new(&dir))?)),
+            );
+            data.zeroize();
+
+            let (fingerprint, files) = rs?;
+
+            audit::log("view", Some(&vault), &fingerprint);
+
+            eprintln!("{vault} -> {dir} ({files} files)");
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
@@ -0,0 +1,391 @@
+// Self-update of the single binary installed from the GitHub releases:
+//
+//   1. the release, the latest or --version, from `update_url` in the config,
+//      the GitHub API of ssh-vault/ssh-vault by default
+//   2. its SHA256SUMS and SHA256SUMS.sig, an SSH signature of one of the
+//      release keys: ssh-keygen -Y sign -n ssh-vault-release SHA256SUMS
+//   3. ssh-vault-<version>-<target>.tar.gz, it must match its checksum
+//   4. the binary is written next to the running one and renamed over it
+//
+// The release keys are SSH_VAULT_RELEASE_KEY when building and the
+// `update_keys` of the config, nothing is installed without a valid signature
+
+use crate::cli::actions::Action;
+use crate::{config, vault::remote};
+use ::config::Config;
+use anyhow::{anyhow, Context, Result};
+use flate2::read::GzDecoder;
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+use ssh_key::{PublicKey, SshSig};
+use std::{cmp::Ordering, env, io::Read, path::Path};
+use url::Url;
+
+const RELEASES: &str = "https://api.github.com/repos/ssh-vault/ssh-vault/releases";
+
+// the namespace of the signatures, a signature made for something else is
+// not a valid one
+const NAMESPACE: &str = "ssh-vault-release";
+
+const SUMS: &str = "SHA256SUMS";
+
+#[derive(Debug, Deserialize)]
+struct Release {
+    tag_name: String,
+    #[serde(default)]
+    assets: Vec<Asset>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Asset {
+    name: String,
+    browser_download_url: String,
+}
+
+impl Release {
+    // the tags may start with a v
+    fn version(&self) -> &str {
+        self.tag_name.trim_start_matches('v')
+    }
+
+    fn asset(&self, name: &str) -> Result<Url> {
+        let asset = self
+            .assets
+            .iter()
+            .find(|asset| asset.name == name)
+            .ok_or_else(|| anyhow!("The release {} has no {name}", self.tag_name))?;
+
+        Url::parse(&asset.browser_download_url)
+            .with_context(|| format!("Invalid URL of {name}: {}", asset.browser_download_url))
+    }
+}
+
+/// Handle the update action
+/// # Errors
+/// Will return an error if the release can't be downloaded, its signature or
+/// checksum is not valid or the binary can't be replaced
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Update { check, version } => {
+            // get the config from ~/.config/ssh-vault/config.yml
+            let config = config::get()?;
+
+            let releases = config
+                .get_string("update_url")
+                .unwrap_or_else(|_| RELEASES.to_string());
+
+            let release = release(&releases, version.as_deref())?;
+
+            let current = env!("CARGO_PKG_VERSION");
+            let available = release.version();
+
+            if version.is_none() && compare(available, current) != Ordering::Greater {
+                println!("ssh-vault {current} is up to date");
+                return Ok(());
+            }
+
+            if check {
+                println!("ssh-vault {available} is available, {current} is installed");
+                return Ok(());
+            }
+
+            // the releases for windows are zip files and the running binary
+            // can't be replaced
+            if cfg!(not(unix)) {
+                return Err(anyhow!(
+                    "Self-update is not supported on this platform, download ssh-vault {available} from the releases"
+                ));
+            }
+
+            let keys = release_keys(&config)?;
+
+            let sums = remote::download(&release.asset(SUMS)?)?;
+            let signature = remote::download(&release.asset(&format!("{SUMS}.sig"))?)?;
+            verify(&keys, &sums, &signature)?;
+
+            let name = format!("ssh-vault-{}-{}", release.tag_name, env!("TARGET"));
+            let file = format!("{name}.tar.gz");
+
+            let archive = remote::download(&release.asset(&file)?)?;
+            checksum(&String::from_utf8_lossy(&sums), &file, &archive)?;
+
+            let binary = extract(&archive, &format!("{name}/ssh-vault"))?;
+
+            let exe = env::current_exe()?
+                .canonicalize()
+                .context("Could not find the running binary")?;
+
+            install(&binary, &exe)?;
+
+            println!("ssh-vault updated from {current} to {available}");
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// The latest release or the one with the version
+fn release(releases: &str, version: Option<&str>) -> Result<Release> {
+    let releases = releases.trim_end_matches('/');
+
+    let url = version.map_or_else(
+        || format!("{releases}/latest"),
+        |version| format!("{releases}/tags/{version}"),
+    );
+
+    let body = remote::download(&Url::parse(&url)?)
+        .with_context(|| format!("Could not get the release from {url}"))?;
+
+    serde_json::from_slice(&body).with_context(|| format!("Invalid release from {url}"))
+}
+
+// Compare the numbers of two versions, 1.0.10 is newer than 1.0.9
+fn compare(a: &str, b: &str) -> Ordering {
+    let numbers = |version: &str| -> Vec<u64> {
+        version
+            .split(['.', '-', '+'])
+            .map_while(|part| part.parse().ok())
+            .collect()
+    };
+
+    numbers(a).cmp(&numbers(b))
+}
+
+// The keys the releases are signed with
+fn release_keys(config: &Config) -> Result<Vec<PublicKey>> {
+    let mut keys: Vec<String> = option_env!("SSH_VAULT_RELEASE_KEY")
+        .map(|keys| keys.lines().map(ToString::to_string).collect())
+        .unwrap_or_default();
+
+    if config.get_array("update_keys").is_ok() {
+        keys.extend(
+            config
+                .get::<Vec<String>>("update_keys")
+                .context("Invalid update_keys in the config")?,
+        );
+    }
+
+    let keys = keys
+        .iter()
+        .map(|key| key.trim())
+        .filter(|key| !key.is_empty())
+        .map(|key| {
+            PublicKey::from_openssh(key).with_context(|| format!("Invalid release key {key}"))
+        })
+        .collect::<Result<Vec<_>>>()?;
+
+    if keys.is_empty() {
+        return Err(anyhow!(
+            "No release key to verify the update with, this binary was built without SSH_VAULT_RELEASE_KEY, add the key the releases are signed with to update_keys in the config"
+        ));
+    }
+
+    Ok(keys)
+}
+
+fn verify(keys: &[PublicKey], sums: &[u8], signature: &[u8]) -> Result<()> {
+    let signature = SshSig::from_pem(signature).context("Invalid signature of SHA256SUMS")?;
+
+    if keys
+        .iter()
+        .any(|key| key.verify(NAMESPACE, sums, &signature).is_ok())
+    {
+        Ok(())
+    } else {
+        Err(anyhow!("SHA256SUMS is not signed by a release key"))
+    }
+}
+
+// The file must be in SHA256SUMS, lines of `sha256sum`: <hex>  <file>
+fn checksum(sums: &str, file: &str, data: &[u8]) -> Result<()> {
+    let expected = sums
+        .lines()
+        .filter_map(|line| line.split_once(char::is_whitespace))
+        .find(|(_, name)| name.trim_start().trim_start_matches('*') == file)
+        .map(|(hex, _)| hex)
+        .ok_or_else(|| anyhow!("{file} is not in {SUMS}"))?;
+
+    if expected.eq_ignore_ascii_case(&format!("{:x}", Sha256::digest(data))) {
+        Ok(())
+    } else {
+        Err(anyhow!("The checksum of {file} doesn't match {SUMS}"))
+    }
+}
+
+// The file at the path of the .tar.gz
+fn extract(archive: &[u8], path: &str) -> Result<Vec<u8>> {
+    let mut archive = tar::Archive::new(GzDecoder::new(archive));
+
+    for entry in archive.entries()? {
+        let mut entry = entry?;
+
+        if entry.path()?.as_ref() == Path::new(path) {
+            let mut binary = Vec::new();
+            entry.read_to_end(&mut binary)?;
+            return Ok(binary);
+        }
+    }
+
+    Err(anyhow!("The archive has no {path}"))
+}
+
+// Write the binary next to the running one and rename it over it, the
+// running process keeps the previous one open
+fn install(binary: &[u8], exe: &Path) -> Result<()> {
+    let dir = exe
+        .parent()
+        .ok_or_else(|| anyhow!("Invalid path of the binary {}", exe.display()))?;
+
+    let mut tmp = tempfile::Builder::new()
+        .prefix(".ssh-vault-")
+        .tempfile_in(dir)
+        .with_context(|| {
+            format!(
+                "Could not write to {}, run the update as the owner of {}",
+                dir.display(),
+                exe.display()
+            )
+        })?;
+
+    std::io::Write::write_all(&mut tmp, binary)?;
+
+    // same mode as the running binary
+    tmp.as_file()
+        .set_permissions(std::fs::metadata(exe)?.permissions())?;
+    tmp.as_file().sync_all()?;
+
+    tmp.persist(exe)
+        .with_context(|| format!("Could not replace {}", exe.display()))?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    const SIGNED: &str =
+        "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  ssh-vault-1.0.14-x86_64-unknown-linux-musl.tar.gz\n";
+
+    // ssh-keygen -Y sign -f test_data/ed25519 -n ssh-vault-release SHA256SUMS
+    const SIGNATURE: &str = "-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAg2LF/abaePxMN5rNta56ZRjxkc2
+DvOcDuFU83xMkuvZYAAAARc3NoLXZhdWx0LXJlbGVhc2UAAAAAAAAABnNoYTUxMgAAAFMA
+AAALc3NoLWVkMjU1MTkAAABA6epcm5p7S+WyirtoBm/LJOc1sALR/klYMc/Mtm5JbBNjJP
+lG3VoGjd5HD/EmCSzF3uDZ2NYQPKwAcnGxBpDiBA==
+-----END SSH SIGNATURE-----
+";
+
+    #[test]
+    fn test_compare() {
+        assert_eq!(compare("1.0.10", "1.0.9"), Ordering::Greater);
+        assert_eq!(compare("1.0.13", "1.0.13"), Ordering::Equal);
+        assert_eq!(compare("1.0.13", "1.1.0"), Ordering::Less);
+        assert_eq!(compare("2.0.0-rc1", "1.9.9"), Ordering::Greater);
+    }
+
+    #[test]
+    fn test_release() {
+        let release: Release = serde_json::from_str(
+            r#"{"tag_name": "v1.0.14", "assets": [{"name": "SHA256SUMS", "browser_download_url": "https://example.com/SHA256SUMS"}]}"#,
+        )
+        .unwrap();
+
+        assert_eq!(release.version(), "1.0.14");
+        assert_eq!(
+            release.asset(SUMS).unwrap().as_str(),
+            "https://example.com/SHA256SUMS"
+        );
+        assert!(release.asset("SHA256SUMS.sig").is_err());
+    }
+
+    #[test]
+    fn test_verify() {
+        let key =
+            PublicKey::from_openssh(&fs::read_to_string("test_data/ed25519.pub").unwrap()).unwrap();
+        let other =
+            PublicKey::from_openssh(&fs::read_to_string("test_data/ed25519_password.pub").unwrap())
+                .unwrap();
+
+        assert!(verify(&[key.clone()], SIGNED.as_bytes(), SIGNATURE.as_bytes()).is_ok());
+        assert!(verify(
+            &[other.clone(), key.clone()],
+            SIGNED.as_bytes(),
+            SIGNATURE.as_bytes()
+        )
+        .is_ok());
+
+        // modified sums, another key or no signature at all
+        let forged = SIGNED.replace("e3b0", "0000");
+        assert!(verify(&[key.clone()], forged.as_bytes(), SIGNATURE.as_bytes()).is_err());
+        assert!(verify(&[other], SIGNED.as_bytes(), SIGNATURE.as_bytes()).is_err());
+        assert!(verify(&[key], SIGNED.as_bytes(), b"").is_err());
+    }
+
+    #[test]
+    fn test_release_keys() {
+        let key = fs::read_to_string("test_data/ed25519.pub").unwrap();
+
+        let config = Config::builder()
+            .set_override("update_keys", vec![key.trim()])
+            .unwrap()
+            .build()
+            .unwrap();
+        assert!(!release_keys(&config).unwrap().is_empty());
+
+        let config = Config::builder()
+            .set_override("update_keys", vec!["not a key"])
+            .unwrap()
+            .build()
+            .unwrap();
+        assert!(release_keys(&config).is_err());
+    }
+
+    #[test]
+    fn test_checksum() {
+        let file = "ssh-vault-1.0.14-x86_64-unknown-linux-musl.tar.gz";
+
+        // the SHA-256 of nothing
+        assert!(checksum(SIGNED, file, b"").is_ok());
+        assert!(checksum(&SIGNED.replace("  ", " *"), file, b"").is_ok());
+        assert!(checksum(SIGNED, file, b"tampered").is_err());
+        assert!(checksum(SIGNED, "ssh-vault-1.0.14-x86_64-apple-darwin.tar.gz", b"").is_err());
+    }
+
+    #[test]
+    fn test_extract_install() {
+        let mut builder = tar::Builder::new(flate2::write::GzEncoder::new(
+            Vec::new(),
+            flate2::Compression::default(),
+        ));
+
+        let mut header = tar::Header::new_gnu();
+        header.set_size(7);
+        header.set_mode(0o755);
+        header.set_cksum();
+        builder
+            .append_data(
+                &mut header,
+                "ssh-vault-1.0.14-x/ssh-vault",
+                &b"binary\n"[..],
+            )
+            .unwrap();
+
+        let archive = builder.into_inner().unwrap().finish().unwrap();
+
+        let binary = extract(&archive, "ssh-vault-1.0.14-x/ssh-vault").unwrap();
+        assert_eq!(binary, b"binary\n");
+        assert!(extract(&archive, "ssh-vault").is_err());
+
+        let dir = tempfile::tempdir().unwrap();
+        let exe = dir.path().join("ssh-vault");
+        fs::write(&exe, "old").unwrap();
+
+        install(&binary, &exe).unwrap();
+        assert_eq!(fs::read(&exe).unwrap(), b"binary\n");
+
+        // only the binary is left
+        assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 1);
+    }
+}
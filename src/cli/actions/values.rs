@@ -0,0 +1,121 @@
+use crate::audit;
+use crate::cli::actions::{private_vault, recipient_keys, Action};
+use crate::vault::{find, history, values, values::Format, SshVault};
+use anyhow::{Context, Result};
+use regex::RegexSet;
+use std::{
+    fs,
+    io::{self, Read, Write},
+    path::Path,
+};
+use tempfile::Builder;
+use zeroize::Zeroize;
+
+/// Handle the values action
+/// # Errors
+/// Will return an error if the document can't be read or the values can't be
+/// encrypted or decrypted
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Values {
+            decrypt,
+            file,
+            format,
+            in_place,
+            key,
+            recipients,
+            select,
+        } => {
+            let select = RegexSet::new(&select).context("Invalid --select regex")?;
+            let format = values::format(format.as_deref(), file.as_deref())?;
+
+            let mut doc = match &file {
+                Some(path) => {
+                    fs::read_to_string(path).with_context(|| format!("Could not read {path}"))?
+                }
+                None => {
+                    let mut doc = String::new();
+                    io::stdin().read_to_string(&mut doc)?;
+                    doc
+                }
+            };
+
+            let rs = transform(format.as_ref(), &doc, decrypt, key, &recipients, &select);
+            doc.zeroize();
+
+            let (mut output, operation, fingerprint) = rs?;
+
+            let rs = match (&file, in_place) {
+                (Some(path), true) => write_in_place(path, output.as_bytes()),
+                _ => io::stdout()
+                    .write_all(output.as_bytes())
+                    .map_err(Into::into),
+            };
+            output.zeroize();
+            rs?;
+
+            audit::log(operation, file.as_deref(), &fingerprint);
+        }
+        _ => unreachable!(),
+    }
+    Ok(())
+}
+
+// the document with the values encrypted or decrypted, the operation for the
+// audit log and the fingerprint of the key used
+fn transform(
+    format: &dyn Format,
+    doc: &str,
+    decrypt: bool,
+    key: Option<String>,
+    recipients: &[String],
+    select: &RegexSet,
+) -> Result<(String, &'static str, String)> {
+    if decrypt {
+        let header = values::header(format, doc)?;
+        let private = private_vault(key, &header.key_types(), &header.fingerprints(), None)?;
+
+        Ok((
+            values::decrypt(format, doc, &private)?,
+            "view",
+            private.fingerprint(),
+        ))
+    } else if let Ok(header) = values::header(format, doc) {
+        // new values are encrypted with the key of the document
+        let private = private_vault(key, &header.key_types(), &header.fingerprints(), None)?;
+
+        Ok((
+            values::encrypt(format, doc, &[], Some(&private), select)?,
+            "edit",
+            private.fingerprint(),
+        ))
+    } else {
+        let recipients = recipient_keys(recipients)?
+            .into_iter()
+            .map(|key| SshVault::new(&find::key_type(&key.algorithm())?, Some(key), None))
+            .collect::<Result<Vec<_>>>()?;
+
+        Ok((
+            values::encrypt(format, doc, &recipients, None, select)?,
+            "create",
+            recipients
+                .first()
+                .map(SshVault::fingerprint)
+                .unwrap_or_default(),
+        ))
+    }
+}
+
+// replace the file once the whole document has been written
+fn write_in_place(path: &str, data: &[u8]) -> Result<()> {
+    let dir = Path::new(path)
+        .parent()
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .unwrap_or_else(|| Path::new("."));
+
+    let mut tmp = Builder::new().prefix(".values-").tempfile_in(dir)?;
+    tmp.write_all(data)?;
+    history::persist(tmp, Path::new(path))?;
+
+    Ok(())
+}
@@ -1,48 +1,465 @@
-use crate::cli::actions::Action;
-use crate::vault::{dio, find, parse, ssh::decrypt_private_key, SshVault};
-use anyhow::Result;
-use std::io::{Read, Write};
+use crate::cli::actions::{
+    check_expiry, decrypt_with_metadata, private_vault, redacted, unquote, Action,
+};
+use crate::vault::{
+    dio, dotenv, history, metadata::Metadata, permissions, remote, stream, stream::Header, strict,
+    values,
+};
+use crate::{
+    audit,
+    hooks::{self, Stage},
+    progress::Progress,
+};
+use anyhow::{anyhow, Context, Result};
+use secrecy::Secret;
+use std::{
+    fs::{self, File},
+    io::{self, BufRead, BufReader, Cursor, Read, Write},
+    path::Path,
+    process::{Child, Command, Stdio},
+    thread,
+};
 use zeroize::Zeroize;
 
 pub fn handle(action: Action) -> Result<()> {
     match action {
         Action::View {
+            exec,
+            file_mode,
+            format,
             key,
+            on,
             output,
             vault,
             passphrase,
+            quiet,
+            raw,
+            redact,
+            restore_owner,
+            revision,
+            share,
+            strict,
         } => {
-            let mut data = String::new();
+            hooks::run(Stage::Pre, "view", vault.as_deref())?;
+
+            // an older version of the vault, kept with the history option
+            let input_path = match (revision, &vault) {
+                (Some(revision), Some(vault)) => Some(
+                    history::revision(Path::new(vault), revision)?
+                        .path
+                        .to_string_lossy()
+                        .to_string(),
+                ),
+                _ => vault.clone(),
+            };
+
+            // the EnvironmentFile of a service, e.g. in /run/myapp/
+            let env_file = output
+                .as_deref()
+                .filter(|path| format.is_some() && *path != "-")
+                .map(Path::new);
+
+            if let Some(path) = env_file {
+                runtime_dir(path)?;
+                permissions::check_runtime_file(path);
+            }
 
             // setup Reader(input) and Writer (output)
-            let (mut input, mut output) = dio::setup_io(vault, output)?;
+            let (mut input, writer) =
+                dio::setup_io_with_mode(input_path, output.clone(), file_mode)?;
 
-            input.read_to_string(&mut data)?;
+            // an existing file keeps its mode and content otherwise
+            if let Some(path) = env_file {
+                set_mode(path, file_mode)?;
+                writer.truncate()?;
+            }
+
+            // the private key never leaves the host, the vault is opened there
+            if let Some(destination) = on {
+                let mut data = Vec::new();
+                input.read_to_end(&mut data)?;
 
-            // parse vault
-            let (key_type, fingerprint, password, data) = parse(&data)?;
+                if strict {
+                    strict::check(&data, true)?;
+                }
 
-            // find the private_key using the vault header AES256 or CHACHA20-POLY1305
-            let mut private_key = find::private_key_type(key, key_type)?;
+                view_on(&destination, exec.as_deref(), strict, data, writer)?;
 
-            // decrypt private_key if encrypted
-            if private_key.is_encrypted() {
-                private_key = decrypt_private_key(&private_key, passphrase)?;
+                return hooks::run(Stage::Post, "view", vault.as_deref());
             }
 
-            // RSA or ED25519
-            let key_type = find::key_type(&private_key.algorithm())?;
+            let mut child = exec.as_deref().map(spawn).transpose()?;
+
+            // binary data would corrupt the terminal, a command gets it as is
+            let writer: Box<dyn Write> = match child.as_mut().and_then(|child| child.stdin.take()) {
+                Some(stdin) => Box::new(stdin),
+                None if writer.is_terminal() && !raw => Box::new(dio::TextOnly::new(writer)),
+                None => Box::new(writer),
+            };
+
+            // the whole vault is read to check it before decrypting
+            let input: Box<dyn BufRead> = if strict {
+                let mut data = Vec::new();
+                input.read_to_end(&mut data)?;
+                strict::check(&data, true)?;
+                Box::new(Cursor::new(data))
+            } else {
+                let size = input.size();
+                Box::new(BufReader::new(Progress::new(
+                    input,
+                    "Decrypting",
+                    size,
+                    quiet,
+                )))
+            };
+
+            let decrypt =
+                |output: &mut dyn Write| open(input, output, key, passphrase, share, strict);
+
+            let decrypted = match format.as_deref() {
+                Some(format) => render(format, vault.as_deref(), writer, decrypt),
+                None if redact => render("redacted", vault.as_deref(), writer, decrypt),
+                None => {
+                    let mut writer = writer;
+                    decrypt(&mut writer)
+                }
+            };
+
+            // its stdin is closed, a command that exits early fails the writes
+            if let Some(mut child) = child {
+                let status = child.wait()?;
+
+                if !status.success() {
+                    return Err(anyhow!("{} exited with {status}", exec.unwrap_or_default()));
+                }
+            }
 
-            let vault = SshVault::new(&key_type, None, Some(private_key))?;
+            let (key_fingerprint, metadata) = decrypted?;
 
-            let mut data = vault.view(&password, &data, &fingerprint)?;
+            // the output is closed, restore the mode, owner and mtime of the input file
+            if let Some(output) = output.filter(|path| path != "-" && format.is_none() && !redact) {
+                metadata.restore(Path::new(&output), file_mode, restore_owner)?;
+            }
 
-            output.write_all(data.as_bytes())?;
+            audit::log("view", vault.as_deref(), &key_fingerprint);
 
-            // zeroize the secret
-            data.zeroize();
+            hooks::run(Stage::Post, "view", vault.as_deref())?;
         }
         _ => unreachable!(),
     }
     Ok(())
 }
+
+fn open<R: BufRead, W: Write>(
+    input: R,
+    writer: W,
+    key: Option<String>,
+    passphrase: Option<Secret<String>>,
+    share: Option<String>,
+    strict: bool,
+) -> Result<(String, Metadata)> {
+    match share {
+        // dual control, combine the share of the key with the share of the other recipient
+        Some(share) => decrypt_dual(input, writer, key, passphrase, &share, strict),
+
+        // streamed or legacy vault
+        None => decrypt_with_metadata(input, writer, key, passphrase, strict),
+    }
+}
+
+// Decrypt in memory and write the variables or the values in the format
+fn render<W: Write>(
+    format: &str,
+    path: Option<&str>,
+    mut writer: W,
+    decrypt: impl FnOnce(&mut dyn Write) -> Result<(String, Metadata)>,
+) -> Result<(String, Metadata)> {
+    let mut data = Vec::new();
+
+    let rs = decrypt(&mut data).and_then(|decrypted| {
+        let text = || std::str::from_utf8(&data);
+
+        let mut rendered = match format {
+            "redacted" => redacted(&data, path),
+            "systemd-env" => systemd_env(text()?)?,
+            "csv" => table(text()?, path, ',')?,
+            "tsv" => table(text()?, path, '\t')?,
+            _ => return Err(anyhow!("Unsupported format: {format}")),
+        };
+
+        let rs = writer
+            .write_all(rendered.as_bytes())
+            .and_then(|()| writer.flush());
+        rendered.zeroize();
+        rs?;
+
+        Ok(decrypted)
+    });
+    data.zeroize();
+
+    rs
+}
+
+// EnvironmentFile lines, the values in double quotes where systemd takes the
+// escaped characters as is and keeps the newlines
+fn systemd_env(data: &str) -> Result<String> {
+    let mut out = String::new();
+
+    for (key, mut value) in dotenv::parse(data)? {
+        out.push_str(&key);
+        out.push_str("=\"");
+
+        for c in value.chars() {
+            if matches!(c, '"' | '\\' | '$' | '`') {
+                out.push('\\');
+            }
+            out.push(c);
+        }
+
+        out.push_str("\"\n");
+        value.zeroize();
+    }
+
+    Ok(out)
+}
+
+// A row per value, the documents are read like `values` does, JSON and YAML by
+// the dotted path of the value, the others as KEY=VALUE lines
+fn table(text: &str, path: Option<&str>, separator: char) -> Result<String> {
+    // db.json.vault is a JSON document
+    let format = values::format(None, path.map(|path| path.trim_end_matches(".vault")))
+        .unwrap_or_else(|_| Box::new(values::dotenv::Dotenv));
+
+    let mut rows = Vec::new();
+
+    // the values are left as they are, only the copy of the document is returned
+    format
+        .map_values(text, &mut |key, value| {
+            rows.push((key.to_string(), unquote(value)));
+            Ok(value.to_string())
+        })?
+        .zeroize();
+
+    let mut out = format!("key{separator}value\n");
+
+    for (key, mut value) in rows {
+        out.push_str(&field(&key, separator));
+        out.push(separator);
+        out.push_str(&field(&value, separator));
+        out.push('\n');
+        value.zeroize();
+    }
+
+    Ok(out)
+}
+
+// a field of CSV (RFC 4180) or TSV, where tabs and newlines are escaped
+fn field(value: &str, separator: char) -> String {
+    if separator == '\t' {
+        return value
+            .replace('\\', "\\\\")
+            .replace('\t', "\\t")
+            .replace('\n', "\\n")
+            .replace('\r', "\\r");
+    }
+
+    if value.contains([separator, '"', '\n', '\r']) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+// the directory of the file only for its owner if it has to be created
+fn runtime_dir(path: &Path) -> Result<()> {
+    let Some(dir) = path.parent().filter(|dir| !dir.as_os_str().is_empty()) else {
+        return Ok(());
+    };
+
+    let mut builder = fs::DirBuilder::new();
+    builder.recursive(true);
+
+    #[cfg(unix)]
+    std::os::unix::fs::DirBuilderExt::mode(&mut builder, 0o700);
+
+    builder
+        .create(dir)
+        .with_context(|| format!("Could not create {}", dir.display()))
+}
+
+#[cfg(unix)]
+fn set_mode(path: &Path, mode: u32) -> Result<()> {
+    use std::os::unix::fs::PermissionsExt;
+
+    Ok(fs::set_permissions(path, fs::Permissions::from_mode(mode))?)
+}
+
+#[cfg(not(unix))]
+fn set_mode(_path: &Path, _mode: u32) -> Result<()> {
+    Ok(())
+}
+
+// Run the command with the plaintext on its stdin
+fn spawn(exec: &str) -> Result<Child> {
+    let args = shell_words::split(exec)?;
+
+    let (program, args) = args
+        .split_first()
+        .ok_or_else(|| anyhow!("The command to run is empty"))?;
+
+    Command::new(program)
+        .args(args)
+        .stdin(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Failed to run {program}"))
+}
+
+// Open the vault with ssh-vault on the host, the vault goes over ssh and the
+// plaintext or the output of the command comes back, the host logs the view
+fn view_on<W: Write>(
+    destination: &str,
+    exec: Option<&str>,
+    strict: bool,
+    vault: Vec<u8>,
+    mut output: W,
+) -> Result<()> {
+    let mut child = remote::ssh_session(destination)?
+        .arg(remote_command(exec, strict))
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .spawn()
+        .context("Failed to run ssh")?;
+
+    let (Some(mut stdin), Some(mut stdout)) = (child.stdin.take(), child.stdout.take()) else {
+        return Err(anyhow!("Failed to run ssh"));
+    };
+
+    // written while the output is read, a large vault would fill the pipes
+    let writer = thread::spawn(move || stdin.write_all(&vault));
+
+    io::copy(&mut stdout, &mut output)?;
+    output.flush()?;
+
+    let status = child.wait()?;
+
+    if !status.success() {
+        return Err(anyhow!("ssh-vault view on {destination} failed: {status}"));
+    }
+
+    writer
+        .join()
+        .map_err(|_| anyhow!("Failed to send the vault to {destination}"))??;
+
+    Ok(())
+}
+
+// the command line run by the shell of the remote user, the host enforces
+// the expiry in strict mode once it checked the header
+fn remote_command(exec: Option<&str>, strict: bool) -> String {
+    let mut command = String::from("ssh-vault view");
+
+    if strict {
+        command.push_str(" --strict");
+    }
+
+    if let Some(exec) = exec {
+        command.push_str(&format!(" --exec {}", shell_words::quote(exec)));
+    }
+
+    command
+}
+
+fn decrypt_dual<R: BufRead, W: Write>(
+    mut input: R,
+    output: W,
+    key: Option<String>,
+    passphrase: Option<Secret<String>>,
+    share: &str,
+    strict: bool,
+) -> Result<(String, Metadata)> {
+    let share = stream::read_share(&mut BufReader::new(
+        File::open(share).with_context(|| format!("Could not open {share}"))?,
+    ))?;
+
+    let header = Header::read(&mut input)?;
+
+    let ssh_vault = private_vault(key, &header.key_types(), &header.fingerprints(), passphrase)?;
+
+    let vault_key = header.unwrap_dual(&ssh_vault, &share)?;
+    check_expiry(&header, strict)?;
+
+    stream::decrypt_with_key(&header, &vault_key, input, output)?;
+
+    Ok((ssh_vault.fingerprint(), header.metadata))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_remote_command() {
+        assert_eq!(remote_command(None, false), "ssh-vault view");
+        assert_eq!(
+            remote_command(Some("wc -c"), false),
+            "ssh-vault view --exec 'wc -c'"
+        );
+        assert_eq!(remote_command(None, true), "ssh-vault view --strict");
+    }
+
+    #[test]
+    fn test_systemd_env() {
+        assert_eq!(
+            systemd_env("USER=app\nPASSWORD='a\"b$c\\d`e'\n").unwrap(),
+            "USER=\"app\"\nPASSWORD=\"a\\\"b\\$c\\\\d\\`e\"\n"
+        );
+        assert!(systemd_env("not a variable").is_err());
+    }
+
+    #[test]
+    fn test_table() {
+        assert_eq!(
+            table("USER=app\nPASSWORD=\"a,b\"\n", Some("db.env.vault"), ',').unwrap(),
+            "key,value\nUSER,app\nPASSWORD,\"a,b\"\n"
+        );
+        assert_eq!(
+            table(
+                r#"{"db": {"user": "admin", "password": "say \"hi\"\n", "port": 5432}}"#,
+                Some("config.json.vault"),
+                ','
+            )
+            .unwrap(),
+            "key,value\ndb.user,admin\ndb.password,\"say \"\"hi\"\"\n\"\ndb.port,5432\n"
+        );
+        assert_eq!(
+            table("db:\n  password: 'a\tb'\n", Some("config.yml"), '\t').unwrap(),
+            "key\tvalue\ndb.password\ta\\tb\n"
+        );
+        assert!(table("not a variable", None, ',').is_err());
+    }
+
+    #[test]
+    fn test_runtime_dir() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("myapp/env");
+
+        runtime_dir(&path).unwrap();
+        assert!(dir.path().join("myapp").is_dir());
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+
+            let mode = fs::metadata(dir.path().join("myapp"))
+                .unwrap()
+                .permissions()
+                .mode();
+            assert_eq!(mode & 0o077, 0);
+        }
+    }
+
+    #[test]
+    fn test_view_on_invalid() {
+        assert!(view_on("-oProxyCommand=sh", None, false, Vec::new(), io::sink()).is_err());
+    }
+}
@@ -0,0 +1,256 @@
+use crate::cli::actions::{open_vault, Action};
+use crate::vault::{
+    history, last_edit::LastEdit, lock::Lock, stream, stream::Header, watch::Watcher, SshVault,
+};
+use crate::{audit, interrupt};
+use anyhow::{anyhow, Context, Result};
+use secrecy::Secret;
+use sha2::{Digest, Sha256};
+use std::{
+    fs::{self, File, OpenOptions},
+    io::Write,
+    path::Path,
+    thread,
+    time::Duration,
+};
+use tempfile::Builder;
+use zeroize::Zeroize;
+
+// how often the file is checked for changes
+const POLL: Duration = Duration::from_millis(100);
+
+/// Handle the watch action
+/// # Errors
+/// Will return an error if the vault can't be decrypted or written to, or if
+/// it was changed by someone else while watching
+pub fn handle(action: Action) -> Result<()> {
+    match action {
+        Action::Watch {
+            debounce,
+            file,
+            key,
+            passphrase,
+            vault,
+        } => {
+            let input = File::open(&vault)
+                .with_context(|| format!("Could not open {vault}, create it first"))?;
+
+            // keep the header and the key so the stanzas of the vault stay the same
+            let mut plaintext = Vec::new();
+            let rs = open_vault(input, &mut plaintext, key, passphrase).and_then(|opened| {
+                if !Path::new(&file).exists() {
+                    create(&file, &plaintext)?;
+                    eprintln!("{vault} -> {file}");
+                }
+                Ok(opened)
+            });
+            plaintext.zeroize();
+
+            let (ssh_vault, mut header, vault_key) = rs?;
+            let fingerprint = ssh_vault.fingerprint();
+
+            audit::log("view", Some(&vault), &fingerprint);
+
+            // the digests of what was last encrypted and of the vault written,
+            // saves without changes are skipped
+            let mut saved = digest(Path::new(&file))?;
+            let mut written = digest(Path::new(&vault))?;
+
+            let mut watcher = Watcher::new(Path::new(&file), debounce);
+
+            eprintln!("Watching {file}, press Ctrl-C to stop");
+
+            loop {
+                thread::sleep(POLL);
+
+                if !watcher.poll() {
+                    continue;
+                }
+
+                let mut data = match fs::read(&file) {
+                    Ok(data) => data,
+                    // removed since, encrypted once it is saved again
+                    Err(_) => continue,
+                };
+
+                let current: [u8; 32] = Sha256::digest(&data).into();
+
+                let rs = if current == saved {
+                    Ok(None)
+                } else {
+                    save(&vault, &written, &ssh_vault, &mut header, &vault_key, &data).map(Some)
+                };
+                data.zeroize();
+
+                if let Some(digest) = rs? {
+                    saved = current;
+                    written = digest;
+
+                    audit::log("edit", Some(&vault), &fingerprint);
+
+                    eprintln!("{file} -> {vault}");
+                }
+            }
+        }
+        _ => unreachable!(),
+    }
+}
+
+// Encrypt the data into the vault with the key it already has, returns the
+// digest of the new vault
+fn save(
+    vault: &str,
+    written: &[u8; 32],
+    ssh_vault: &SshVault,
+    header: &mut Header,
+    vault_key: &Secret<[u8; 32]>,
+    data: &[u8],
+) -> Result<[u8; 32]> {
+    // prevent others from editing the vault at the same time
+    let _lock = Lock::acquire(vault)?;
+
+    // don't clobber the changes of others, e.g. a git pull
+    if digest(Path::new(vault))? != *written {
+        return Err(anyhow!(
+            "{vault} was modified by someone else while watching, stopped to not overwrite it"
+        ));
+    }
+
+    // new files are created next to the vault so they can be renamed over it
+    let dir = Path::new(vault)
+        .parent()
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .unwrap_or_else(|| Path::new("."));
+
+    let mut tmp = Builder::new().prefix(".vault-").tempfile_in(dir)?;
+
+    let _remove = {
+        let path = tmp.path().to_path_buf();
+        interrupt::on_interrupt(move || {
+            let _ = fs::remove_file(path);
+        })
+    };
+
+    header.edited = Some(LastEdit::now(ssh_vault, vault_key)?);
+
+    let mut vault_data = Vec::new();
+    stream::encrypt_with_key(header, vault_key, data, &mut vault_data)?;
+
+    tmp.as_file_mut().write_all(&vault_data)?;
+
+    // save the vault, keeping its permissions
+    fs::set_permissions(tmp.path(), fs::metadata(vault)?.permissions())?;
+    history::persist(tmp, Path::new(vault))?;
+
+    Ok(Sha256::digest(&vault_data).into())
+}
+
+// The plaintext of the vault, only readable by the owner
+fn create(file: &str, plaintext: &[u8]) -> Result<()> {
+    let mut options = OpenOptions::new();
+    options.write(true).create_new(true);
+
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+
+    let mut output = options
+        .open(file)
+        .with_context(|| format!("Could not create {file}"))?;
+
+    output.write_all(plaintext)?;
+
+    Ok(output.sync_all()?)
+}
+
+fn digest(path: &Path) -> Result<[u8; 32]> {
+    let data = fs::read(path).with_context(|| format!("Could not read {}", path.display()))?;
+
+    Ok(Sha256::digest(data).into())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::cli::actions::decrypt;
+    use crate::vault::{find, SshKeyType};
+    use std::io::BufReader;
+
+    #[test]
+    fn test_save() {
+        let dir = tempfile::tempdir().unwrap();
+        let vault = dir.path().join("secret.vault");
+        let vault_str = vault.to_str().unwrap();
+
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+
+        let mut data = Vec::new();
+        stream::encrypt(&[recipient], &b"TOKEN=1\n"[..], &mut data).unwrap();
+        fs::write(&vault, &data).unwrap();
+
+        let (ssh_vault, mut header, vault_key) = open_vault(
+            File::open(&vault).unwrap(),
+            &mut Vec::new(),
+            Some("test_data/ed25519".to_string()),
+            None,
+        )
+        .unwrap();
+
+        let written = digest(&vault).unwrap();
+        let written = save(
+            vault_str,
+            &written,
+            &ssh_vault,
+            &mut header,
+            &vault_key,
+            b"TOKEN=2\n",
+        )
+        .unwrap();
+        assert!(header.edited.is_some());
+        assert_eq!(written, digest(&vault).unwrap());
+
+        let mut plaintext = Vec::new();
+        decrypt(
+            BufReader::new(File::open(&vault).unwrap()),
+            &mut plaintext,
+            Some("test_data/ed25519".to_string()),
+            None,
+        )
+        .unwrap();
+        assert_eq!(plaintext, b"TOKEN=2\n");
+
+        // changed by someone else
+        fs::write(&vault, &data).unwrap();
+        assert!(save(
+            vault_str,
+            &written,
+            &ssh_vault,
+            &mut header,
+            &vault_key,
+            b"TOKEN=3\n"
+        )
+        .is_err());
+        assert_eq!(fs::read(&vault).unwrap(), data);
+        assert!(!Path::new(&format!("{vault_str}.lock")).exists());
+    }
+
+    #[test]
+    fn test_create() {
+        let dir = tempfile::tempdir().unwrap();
+        let file = dir.path().join(".env");
+        let file = file.to_str().unwrap();
+
+        create(file, b"TOKEN=1\n").unwrap();
+        assert_eq!(fs::read(file).unwrap(), b"TOKEN=1\n");
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = fs::metadata(file).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o600);
+        }
+
+        // never over an existing file
+        assert!(create(file, b"TOKEN=2\n").is_err());
+    }
+}
@@ -0,0 +1,125 @@
+use clap::{builder::ValueParser, Arg, ArgAction, Command};
+
+pub fn validator_lifetime() -> ValueParser {
+    ValueParser::from(move |s: &str| -> std::result::Result<u64, String> {
+        match s.parse::<u64>() {
+            Ok(minutes) if minutes > 0 => Ok(minutes),
+            _ => Err("Lifetime must be a positive number of minutes".to_owned()),
+        }
+    })
+}
+
+pub fn subcommand_agent() -> Command {
+    Command::new("agent")
+        .about("Cache the passphrases of the private ssh keys and decrypt with unlocked keys")
+        .after_help(
+            r"Examples:
+
+Start the agent in the background, view and edit will use it to cache the passphrases:
+
+    ssh-vault agent &
+
+Keep the passphrases for one hour:
+
+    ssh-vault agent --lifetime 60
+
+Unlock a key once, view and other tools using the socket decrypt without it:
+
+    ssh-vault agent -i ~/.ssh/id_ed25519 --socket /run/user/1000/ssh-vault.sock &
+
+Serve Prometheus metrics on http://127.0.0.1:9101/metrics:
+
+    ssh-vault agent --metrics 127.0.0.1:9101 &
+
+Stop the agent:
+
+    ssh-vault agent --stop
+",
+        )
+        .arg(
+            Arg::new("identity")
+                .short('i')
+                .long("identity")
+                .help("Private key to hold unlocked, asks for its passphrase once")
+                .value_name("KEY")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("lifetime")
+                .short('l')
+                .long("lifetime")
+                .help("Forget the passphrases after N minutes")
+                .value_name("MINUTES")
+                .default_value("15")
+                .value_parser(validator_lifetime()),
+        )
+        .arg(
+            Arg::new("metrics")
+                .long("metrics")
+                .help("Serve Prometheus metrics on http://ADDR/metrics")
+                .value_name("ADDR"),
+        )
+        .arg(
+            Arg::new("socket")
+                .short('s')
+                .long("socket")
+                .env("SSH_VAULT_AGENT_SOCK")
+                .help("Path of the agent socket, defaults to ~/.ssh/vault/agent.sock"),
+        )
+        .arg(
+            Arg::new("stop")
+                .long("stop")
+                .help("Stop the running agent")
+                .number_of_values(0),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_agent() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_agent());
+        let matches = app.try_get_matches_from(vec!["ssh-vault", "agent"]);
+        assert!(matches.is_ok());
+
+        let m = matches
+            .unwrap()
+            .subcommand_matches("agent")
+            .unwrap()
+            .to_owned();
+
+        assert_eq!(m.get_one::<u64>("lifetime").copied(), Some(15));
+        assert_eq!(m.get_flag("stop"), false);
+        assert!(m.get_one::<String>("metrics").is_none());
+    }
+
+    #[test]
+    fn test_subcommand_agent_lifetime() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_agent());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "agent",
+            "--lifetime",
+            "60",
+            "--socket",
+            "/tmp/agent.sock",
+        ]);
+        assert!(matches.is_ok());
+
+        let m = matches
+            .unwrap()
+            .subcommand_matches("agent")
+            .unwrap()
+            .to_owned();
+
+        assert_eq!(m.get_one::<u64>("lifetime").copied(), Some(60));
+        assert_eq!(m.get_one::<String>("socket").unwrap(), "/tmp/agent.sock");
+        assert!(m.get_many::<String>("identity").is_none());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_agent());
+        let matches = app.try_get_matches_from(vec!["ssh-vault", "agent", "--lifetime", "0"]);
+        assert!(matches.is_err());
+    }
+}
@@ -0,0 +1,65 @@
+use crate::cli::commands::check::{arg_exclude, arg_include};
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_audit_recipients() -> Command {
+    Command::new("audit-recipients")
+        .about("Report who can open the vaults of a tree and flag deviations from the policy")
+        .after_help(
+            r"Every vault is compared with the recipients of its .ssh-vault.yml policy:
+
+    x  recipient of the vault
+    +  recipient of the vault not in the policy
+    -  recipient of the policy missing in the vault
+    !  recipient revoked in ~/.ssh/vault/revoked_keys
+
+Exits with an error if a vault deviates from its policy or includes a revoked key.
+
+Examples:
+
+Audit the vaults of the current directory:
+
+    ssh-vault audit-recipients
+
+Export the report for a security review:
+
+    ssh-vault audit-recipients --json ./secrets > recipients.json
+",
+        )
+        .arg(
+            Arg::new("json")
+                .short('j')
+                .long("json")
+                .help("Output in JSON format")
+                .num_args(0),
+        )
+        .arg(arg_include())
+        .arg(arg_exclude())
+        .arg(
+            Arg::new("paths")
+                .help("Vault files or directories to audit, defaults to the current directory")
+                .value_name("PATH")
+                .action(ArgAction::Append),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_audit_recipients() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_audit_recipients());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "audit-recipients", "--json", "secrets"])
+            .unwrap();
+        let m = matches.subcommand_matches("audit-recipients").unwrap();
+        assert!(m.get_flag("json"));
+        assert_eq!(
+            m.get_many::<String>("paths")
+                .unwrap()
+                .cloned()
+                .collect::<Vec<_>>(),
+            vec!["secrets"]
+        );
+    }
+}
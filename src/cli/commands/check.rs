@@ -0,0 +1,116 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn arg_include() -> Arg {
+    Arg::new("include")
+        .long("include")
+        .help("Only the files of the directories matching GLOB, relative to them, can be used multiple times")
+        .value_name("GLOB")
+        .action(ArgAction::Append)
+}
+
+pub fn arg_exclude() -> Arg {
+    Arg::new("exclude")
+        .long("exclude")
+        .help("Skip the files of the directories matching GLOB, e.g. 'archive/**', can be used multiple times")
+        .value_name("GLOB")
+        .action(ArgAction::Append)
+}
+
+pub fn subcommand_check() -> Command {
+    Command::new("check")
+        .about("List the vaults your keys can and cannot open, nothing is decrypted to the output")
+        .after_help(
+            r"Only the key of a vault is decrypted, the default keys are the IdentityFile
+entries of ~/.ssh/config for the host ssh-vault, ~/.ssh/id_ed25519 and
+~/.ssh/id_rsa, the passphrases cached by the agent are used.
+
+Examples:
+
+Check the vaults of a directory after rotating your key:
+
+    ssh-vault check ./secrets
+
+Check with a new key:
+
+    ssh-vault check -k ~/.ssh/id_ed25519_new ./secrets
+
+Check the vaults of a monorepo except the archived ones:
+
+    ssh-vault check --include '*.vault' --exclude 'archive/**' .
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to a private ssh key to check, can be used multiple times")
+                .action(ArgAction::Append),
+        )
+        .arg(arg_include())
+        .arg(arg_exclude())
+        .arg(
+            Arg::new("paths")
+                .help("Vault files or directories to check, defaults to the current directory")
+                .value_name("PATH")
+                .action(ArgAction::Append),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_check() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_check());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "check",
+                "-k",
+                "id_old",
+                "-k",
+                "id_new",
+                "secrets",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("check").unwrap();
+        assert_eq!(
+            m.get_many::<String>("key")
+                .unwrap()
+                .cloned()
+                .collect::<Vec<_>>(),
+            vec!["id_old", "id_new"]
+        );
+        assert_eq!(
+            m.get_many::<String>("paths")
+                .unwrap()
+                .cloned()
+                .collect::<Vec<_>>(),
+            vec!["secrets"]
+        );
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_check());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "check",
+                "--include",
+                "*.vault",
+                "--exclude",
+                "archive/**",
+                "--exclude",
+                "tmp/**",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("check").unwrap();
+        assert_eq!(
+            m.get_many::<String>("exclude")
+                .unwrap()
+                .cloned()
+                .collect::<Vec<_>>(),
+            vec!["archive/**", "tmp/**"]
+        );
+        assert_eq!(m.get_one::<String>("include").unwrap(), "*.vault");
+    }
+}
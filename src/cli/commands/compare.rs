@@ -0,0 +1,86 @@
+use crate::cli::commands::view::arg_identity_fp;
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_compare() -> Command {
+    Command::new("compare")
+        .about("Report the drift of a deployed file from a vault without showing the secrets")
+        .after_help(
+            r"The keys of a dotenv, JSON or YAML file that changed, are missing or were
+added are listed, the lines that differ are counted for other files. With
+--diff the lines that differ are shown with their values masked. The exit
+code is 1 when the file drifted:
+
+    ssh-vault compare app.env.vault /etc/app/app.env
+    ssh-vault compare --diff config.yml.vault /etc/app/config.yml
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("diff")
+                .short('d')
+                .long("diff")
+                .help("Show the lines that differ with their values masked")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(Arg::new("vault").help("Vault to compare").required(true))
+        .arg(
+            Arg::new("file")
+                .help("Deployed file to compare the vault with")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_compare() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_compare());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "compare",
+                "--diff",
+                "app.env.vault",
+                "/etc/app/app.env",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("compare").unwrap();
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "app.env.vault");
+        assert_eq!(m.get_one::<String>("file").unwrap(), "/etc/app/app.env");
+        assert!(m.get_flag("diff"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_compare());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "compare", "app.env.vault"])
+            .is_err());
+    }
+}
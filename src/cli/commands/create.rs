@@ -1,4 +1,5 @@
-use clap::{builder::ValueParser, Arg, Command};
+use crate::vault::metadata;
+use clap::{builder::ValueParser, Arg, ArgAction, Command};
 use regex::Regex;
 
 const REGEX_MD5_FINGERPRINT: &str = r"^([0-9a-f]{2}:){15}([0-9a-f]{2})$";
@@ -17,6 +18,35 @@ pub fn validator_fingerprint() -> ValueParser {
     })
 }
 
+pub fn validator_file_mode() -> ValueParser {
+    ValueParser::from(move |s: &str| -> std::result::Result<u32, String> {
+        match u32::from_str_radix(s, 8) {
+            Ok(mode) if mode <= 0o777 && mode & 0o600 == 0o600 => Ok(mode),
+            _ => {
+                Err("Mode must be octal (e.g. 600, 640) and readable/writable by the owner".into())
+            }
+        }
+    })
+}
+
+pub fn arg_file_mode() -> Arg {
+    Arg::new("file-mode")
+        .long("file-mode")
+        .env("SSH_VAULT_FILE_MODE")
+        .help("Permissions of the created files")
+        .value_name("MODE")
+        .default_value("600")
+        .value_parser(validator_file_mode())
+}
+
+pub fn arg_quiet() -> Arg {
+    Arg::new("quiet")
+        .short('q')
+        .long("quiet")
+        .help("Don't show the progress of large files")
+        .action(ArgAction::SetTrue)
+}
+
 pub fn subcommand_create() -> Command {
     Command::new("create")
         .about("Create a new vault")
@@ -31,9 +61,59 @@ Share a secret with a known user in GitHub:
 
     echo "secret" | ssh-vault create -u alice
 
+Share a secret with a GitHub Enterprise user, or the members of a team
+(github_token in the config is used to list them):
+
+    echo "secret" | ssh-vault create -u ghe.example.com/alice
+    echo "secret" | ssh-vault create -u ghe.example.com/@infra/oncall
+
+Share a secret with a corporate identity, its keys are fetched from
+oidc_keys_url in the config:
+
+    echo "secret" | ssh-vault create -u oidc:alice@example.com
+
+Share a secret with a user publishing its keys in
+https://example.com/.well-known/ssh-keys/alice:
+
+    echo "secret" | ssh-vault create -u alice@example.com
+
 Share a secret with Alice using its second key:
 
     echo "secret" | ssh-vault create -u alice -k 2
+
+Share a secret with your key and the keys of a team, one per line:
+
+    echo "secret" | ssh-vault create -r team.keys
+
+Share a secret with a host using the key it advertises, or a key file in it:
+
+    echo "secret" | ssh-vault create -k ssh://server.example.com
+    echo "secret" | ssh-vault create -k ssh://alice@bastion/~/.ssh/id_ed25519.pub
+
+Share a secret only the host can open, its key exchange gives the host key,
+root opens the vault on the host with the key in /etc/ssh:
+
+    echo "secret" | ssh-vault create -u host:server.example.com db.vault
+    sudo ssh-vault view db.vault
+
+Refuse to create the vault if Alice's key changed since it was first used:
+
+    echo "secret" | ssh-vault create -u alice --strict
+
+Require both Alice and Bob to open the vault, Alice sends a share to Bob:
+
+    echo "secret" | ssh-vault create --dual-control -k alice.pub -r bob.pub break-glass.vault
+    ssh-vault share -k alice -r bob.pub break-glass.vault > alice.share
+
+Encrypt a script, it is executable again when viewed with -o:
+
+    ssh-vault create -k alice.pub -i deploy.sh --preserve mode,mtime deploy.sh.vault
+    ssh-vault view -o deploy.sh deploy.sh.vault
+    ssh-vault view -k bob --share alice.share break-glass.vault
+
+Rotate a token every 90 days, view warns and check reports it once expired:
+
+    echo "token" | ssh-vault create -k alice.pub --expires 90d token.vault
 "#,
         )
         .visible_alias("c")
@@ -49,14 +129,22 @@ Share a secret with Alice using its second key:
             Arg::new("key")
                 .short('k')
                 .long("key")
-                .help("Path to public ssh key or index when using option -u")
+                .help("Path or ssh:// URL of the public ssh key, or index when using option -u")
                 .conflicts_with("fingerprint"),
         )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help("Also create the vault for the public keys in FILE, can be used multiple times")
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
         .arg(
             Arg::new("user")
                 .short('u')
                 .long("user")
-                .help("GitHub username or URL, optional [-k N] where N is the key index"),
+                .help("GitHub [host/]username, [host/]@org/team, oidc:identity, user@domain, host:server[:port] or URL, optional [-k N] where N is the key index"),
         )
         .arg(
             Arg::new("json")
@@ -65,6 +153,28 @@ Share a secret with Alice using its second key:
                 .help("When using option -u and user 'new', output the vault in JSON format")
                 .number_of_values(0),
         )
+        .arg(
+            Arg::new("strict")
+                .long("strict")
+                .help("Fail instead of warning if the key of the user changed since it was first used")
+                .requires("user")
+                .number_of_values(0),
+        )
+        .arg(
+            Arg::new("dual-control")
+                .long("dual-control")
+                .help("Split the vault key between the key and a single recipient, both are required to open the vault")
+                .requires("recipient")
+                .conflicts_with("json")
+                .num_args(0),
+        )
+        .arg(
+            Arg::new("expires")
+                .long("expires")
+                .help("Record that the secret expires after DURATION (e.g. 90d), view warns once it is past")
+                .value_name("DURATION")
+                .value_parser(humantime::parse_duration),
+        )
         .arg(
             Arg::new("input")
                 .short('i')
@@ -72,6 +182,22 @@ Share a secret with Alice using its second key:
                 .help("Create a vault form an existing file")
                 .value_name("FILE"),
         )
+        .arg(
+            Arg::new("label")
+                .long("label")
+                .help("Short description of the vault, shown by info without the key"),
+        )
+        .arg(arg_quiet())
+        .arg(
+            Arg::new("preserve")
+                .long("preserve")
+                .help("Attributes of the input file to restore with view -o, the owner only with --restore-owner")
+                .value_name("ATTRIBUTES")
+                .value_delimiter(',')
+                .value_parser(metadata::ATTRIBUTES)
+                .default_value("mode"),
+        )
+        .arg(arg_file_mode())
         .arg(Arg::new("vault").help("file to store the vault or writes to stdout if not specified"))
 }
 
@@ -214,4 +340,42 @@ mod tests {
         let matches = app.try_get_matches_from(vec!["ssh-vault", "create", "-u", "new", "-k", "0"]);
         assert!(matches.is_ok());
     }
+
+    #[test]
+    fn test_subcommand_create_file_mode() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_create());
+        let m = app
+            .try_get_matches_from(vec!["ssh-vault", "create", "--file-mode", "640"])
+            .unwrap();
+        let m = m.subcommand_matches("create").unwrap();
+        assert_eq!(m.get_one::<u32>("file-mode").copied(), Some(0o640));
+
+        for mode in ["999", "400", "1777"] {
+            let app = Command::new("ssh-vault").subcommand(subcommand_create());
+            let m = app.try_get_matches_from(vec!["ssh-vault", "create", "--file-mode", mode]);
+            assert!(m.is_err(), "{mode}");
+        }
+    }
+
+    #[test]
+    fn test_subcommand_create_dual_control() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_create());
+        let m = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "create",
+                "--dual-control",
+                "-r",
+                "bob.pub",
+            ])
+            .unwrap();
+        let m = m.subcommand_matches("create").unwrap();
+        assert!(m.get_flag("dual-control"));
+
+        // the other key is required
+        let app = Command::new("ssh-vault").subcommand(subcommand_create());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "create", "--dual-control"])
+            .is_err());
+    }
 }
@@ -0,0 +1,105 @@
+use crate::cli::commands::{
+    create::{arg_file_mode, arg_quiet},
+    view::{arg_identity_fp, arg_restore_owner},
+};
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_decrypt() -> Command {
+    Command::new("decrypt")
+        .about("Decrypt <file>.vault into <file>")
+        .after_help(
+            r"The file is written next to the vault without the .vault extension and the
+mode recorded by encrypt or create -i is restored. An existing file is only
+replaced with --force.
+
+Examples:
+
+    ssh-vault decrypt app.conf.vault
+
+With - the vault is read from stdin and the plaintext written to stdout, the
+terminal is never used, an encrypted key needs --passphrase-fd,
+--passphrase-file or the agent:
+
+    aws s3 cp s3://backups/app.sql.vault - | ssh-vault decrypt -k backup --passphrase-fd 3 - 3<pass | psql app
+",
+        )
+        .arg(
+            Arg::new("force")
+                .short('f')
+                .long("force")
+                .help("Replace the file if it exists")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(arg_quiet())
+        .arg(arg_restore_owner())
+        .arg(arg_file_mode())
+        .arg(
+            Arg::new("vault")
+                .help("Vault to decrypt, its name must end with .vault, or - for stdin to stdout")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_decrypt() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_decrypt());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "decrypt",
+                "-k",
+                "id_ed25519",
+                "app.conf.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("decrypt").unwrap();
+        assert_eq!(m.get_one::<String>("key").unwrap(), "id_ed25519");
+        assert!(!m.get_flag("force"));
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "app.conf.vault");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_decrypt());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "decrypt", "--passphrase-fd", "3", "-"])
+            .unwrap();
+        let m = matches.subcommand_matches("decrypt").unwrap();
+        assert_eq!(m.get_one::<i32>("passphrase-fd").copied(), Some(3));
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "-");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_decrypt());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "decrypt"])
+            .is_err());
+    }
+}
@@ -0,0 +1,53 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_direnv() -> Command {
+    Command::new("direnv")
+        .about("Export the variables of a vault for direnv")
+        .after_help(
+            r#"The vault must have KEY=VALUE lines, the values are quoted for the shell.
+
+Example .envrc:
+
+    eval "$(ssh-vault direnv --watch secret.vault)"
+"#,
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("watch")
+                .short('w')
+                .long("watch")
+                .help("Add a watch_file line so direnv reloads when the vault changes")
+                .num_args(0),
+        )
+        .arg(
+            Arg::new("vault")
+                .help("Vault with the variables")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_direnv() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_direnv());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "direnv", "-w", "secret.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("direnv").unwrap();
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "secret.vault");
+        assert!(m.get_flag("watch"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_direnv());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "direnv"])
+            .is_err());
+    }
+}
@@ -1,4 +1,19 @@
-use clap::{Arg, Command};
+use crate::cli::commands::view::arg_identity_fp;
+use clap::{builder::ValueParser, Arg, Command};
+
+// a day, long enough for any edit and far from overflowing as seconds
+pub const MAX_TIMEOUT: u64 = 24 * 60;
+
+pub fn validator_timeout() -> ValueParser {
+    ValueParser::from(move |s: &str| -> std::result::Result<u64, String> {
+        match s.parse::<u64>() {
+            Ok(minutes) if (1..=MAX_TIMEOUT).contains(&minutes) => Ok(minutes),
+            _ => Err(format!(
+                "Timeout must be a number of minutes between 1 and {MAX_TIMEOUT}"
+            )),
+        }
+    })
+}
 
 pub fn subcommand_edit() -> Command {
     Command::new("edit")
@@ -9,6 +24,20 @@ pub fn subcommand_edit() -> Command {
 Edit a secret:
 
     ssh-vault edit /path/to/secret.vault
+
+Encrypt the vault again even if nothing changed:
+
+    ssh-vault edit --force /path/to/secret.vault
+
+Discard the changes if the editor is still open after 10 minutes:
+
+    ssh-vault edit --timeout 10 --abort-on-timeout /path/to/secret.vault
+
+The vault is replaced once the new one is safely on disk, set `backup: true` in
+~/.config/ssh-vault/config.yml to keep the previous version as <vault>.bak
+
+Binary data is opened with the `hex_editor` of the config instead of EDITOR,
+e.g. `hex_editor: hexedit`
 ",
         )
         .visible_alias("e")
@@ -18,6 +47,7 @@ Edit a secret:
                 .long("key")
                 .help("Path to the private ssh key to use for decyrpting"),
         )
+        .arg(arg_identity_fp())
         .arg(
             Arg::new("passphrase")
                 .short('p')
@@ -25,6 +55,43 @@ Edit a secret:
                 .env("SSH_VAULT_PASSPHRASE")
                 .help("Passphrase of the private ssh key"),
         )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("timeout")
+                .short('t')
+                .long("timeout")
+                .env("SSH_VAULT_EDITOR_TIMEOUT")
+                .help("Warn if the editor is still open after N minutes")
+                .value_name("MINUTES")
+                .value_parser(validator_timeout()),
+        )
+        .arg(
+            Arg::new("abort-on-timeout")
+                .long("abort-on-timeout")
+                .help("Close the editor and discard the changes once the timeout is reached")
+                .requires("timeout")
+                .number_of_values(0),
+        )
+        .arg(
+            Arg::new("force")
+                .short('f')
+                .long("force")
+                .help("Encrypt and save the vault even if the secret didn't change")
+                .num_args(0),
+        )
         .arg(
             Arg::new("vault")
                 .required(true)
@@ -83,4 +150,48 @@ mod tests {
         assert_eq!(m.get_one::<String>("passphrase").unwrap(), "passphrase");
         assert_eq!(m.get_one::<String>("vault").unwrap(), "/tmp/vault");
     }
+
+    #[test]
+    fn test_subcommand_edit_with_timeout() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_edit());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "edit",
+            "--timeout",
+            "10",
+            "--abort-on-timeout",
+            "/tmp/vault",
+        ]);
+        assert!(matches.is_ok());
+
+        let m = matches
+            .unwrap()
+            .subcommand_matches("edit")
+            .unwrap()
+            .to_owned();
+        assert_eq!(m.get_one::<u64>("timeout").copied(), Some(10));
+        assert_eq!(m.get_one::<bool>("abort-on-timeout").copied(), Some(true));
+    }
+
+    #[test]
+    fn test_subcommand_edit_with_invalid_timeout() {
+        for timeout in ["0", "-1", "ten", "1441", "307445734561825861"] {
+            let app = Command::new("ssh-vault").subcommand(subcommand_edit());
+            let matches =
+                app.try_get_matches_from(vec!["ssh-vault", "edit", "-t", timeout, "/tmp/vault"]);
+            assert!(matches.is_err());
+        }
+    }
+
+    #[test]
+    fn test_subcommand_edit_abort_requires_timeout() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_edit());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "edit",
+            "--abort-on-timeout",
+            "/tmp/vault",
+        ]);
+        assert!(matches.is_err());
+    }
 }
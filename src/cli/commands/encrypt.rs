@@ -0,0 +1,135 @@
+use crate::cli::commands::{
+    check::{arg_exclude, arg_include},
+    create::{arg_file_mode, arg_quiet},
+};
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_encrypt() -> Command {
+    Command::new("encrypt")
+        .about("Encrypt a file into <file>.vault")
+        .after_help(
+            r"The vault is created next to the file with the .vault extension and the
+mode of the file is recorded, decrypt restores it. The file is kept unless
+--rm is used, then it is overwritten with zeros and removed once the vault
+is written.
+
+With --recursive every file of the directory and its subdirectories is
+encrypted, for the recipients of its .ssh-vault.yml unless -k or -r are used.
+Hidden directories, vaults and files that have a vault already are skipped.
+
+Examples:
+
+    ssh-vault encrypt -k ~/.ssh/id_ed25519.pub --rm app.conf
+    ssh-vault decrypt app.conf.vault
+
+Encrypt a directory with 8 workers:
+
+    ssh-vault encrypt --recursive --jobs 8 --rm ./configs
+
+Encrypt the env files of a directory except the examples:
+
+    ssh-vault encrypt -R --include '*.env' --exclude '*.example.env' ./configs
+
+With - the vault is a filter from stdin to stdout that never uses the terminal,
+for pipelines and cron jobs:
+
+    pg_dump app | ssh-vault encrypt -k backup.pub - | aws s3 cp - s3://backups/app.sql.vault
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path or ssh:// URL of the public ssh key"),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help("Also encrypt for the public keys in FILE, can be used multiple times")
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("recursive")
+                .short('R')
+                .long("recursive")
+                .help("Encrypt the files of a directory and its subdirectories")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(
+            Arg::new("jobs")
+                .short('j')
+                .long("jobs")
+                .help("Files encrypted at the same time with --recursive, defaults to the number of CPUs")
+                .value_name("N")
+                .value_parser(clap::value_parser!(usize))
+                .requires("recursive"),
+        )
+        .arg(arg_include().requires("recursive"))
+        .arg(arg_exclude().requires("recursive"))
+        .arg(arg_quiet())
+        .arg(
+            Arg::new("rm")
+                .long("rm")
+                .help("Remove the file once the vault is written")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(arg_file_mode())
+        .arg(
+            Arg::new("file")
+                .help("File to encrypt, directory with --recursive or - for stdin to stdout")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_encrypt() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_encrypt());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "encrypt",
+                "-k",
+                "id_ed25519.pub",
+                "--rm",
+                "app.conf",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("encrypt").unwrap();
+        assert_eq!(m.get_one::<String>("key").unwrap(), "id_ed25519.pub");
+        assert!(m.get_flag("rm"));
+        assert!(!m.get_flag("recursive"));
+        assert_eq!(m.get_one::<String>("file").unwrap(), "app.conf");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_encrypt());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "encrypt", "-R", "-j", "8", "configs"])
+            .unwrap();
+        let m = matches.subcommand_matches("encrypt").unwrap();
+        assert!(m.get_flag("recursive"));
+        assert_eq!(m.get_one::<usize>("jobs").copied(), Some(8));
+
+        // --jobs only with --recursive
+        let app = Command::new("ssh-vault").subcommand(subcommand_encrypt());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "encrypt", "-j", "8", "app.conf"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_encrypt());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "encrypt", "-k", "backup.pub", "-"])
+            .unwrap();
+        let m = matches.subcommand_matches("encrypt").unwrap();
+        assert_eq!(m.get_one::<String>("file").unwrap(), "-");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_encrypt());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "encrypt"])
+            .is_err());
+    }
+}
@@ -0,0 +1,112 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_export() -> Command {
+    Command::new("export")
+        .about("Export vaults to another password manager")
+        .after_help(
+            r"Every vault of the directory is decrypted and written as an entry of the
+target, keeping the directory layout.
+
+pass, the entries are encrypted with gpg for the keys of the .gpg-id files:
+
+    ssh-vault export pass secrets -o ~/.password-store
+
+sealed-secrets, a SealedSecret manifest per vault encrypted with kubeseal, the
+vaults with KEY=VALUE lines get a key per variable:
+
+    ssh-vault export sealed-secrets secrets -o manifests --namespace prod
+",
+        )
+        .arg(
+            Arg::new("format")
+                .help("Password manager or format to export to")
+                .value_parser(["pass", "sealed-secrets"])
+                .required(true),
+        )
+        .arg(
+            Arg::new("path")
+                .help("Directory with the vaults")
+                .required(true),
+        )
+        .arg(
+            Arg::new("output")
+                .short('o')
+                .long("output")
+                .help("Password store or directory to write the entries to")
+                .value_name("DIR")
+                .required(true),
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("cert")
+                .long("cert")
+                .help("Certificate of the sealed secrets controller, kubeseal gets it from the cluster if not set")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("namespace")
+                .long("namespace")
+                .help("Namespace of the secrets")
+                .value_name("NAME"),
+        )
+        .arg(
+            Arg::new("force")
+                .short('f')
+                .long("force")
+                .help("Overwrite existing entries")
+                .num_args(0),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_export() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_export());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "export",
+                "pass",
+                "secrets",
+                "-o",
+                "store",
+                "-f",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("export").unwrap();
+        assert_eq!(m.get_one::<String>("format").unwrap(), "pass");
+        assert_eq!(m.get_one::<String>("path").unwrap(), "secrets");
+        assert_eq!(m.get_one::<String>("output").unwrap(), "store");
+        assert!(m.get_flag("force"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_export());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "export",
+                "sealed-secrets",
+                "secrets",
+                "-o",
+                "manifests",
+                "--namespace",
+                "prod",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("export").unwrap();
+        assert_eq!(m.get_one::<String>("format").unwrap(), "sealed-secrets");
+        assert_eq!(m.get_one::<String>("namespace").unwrap(), "prod");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_export());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "export", "1password", "secrets"])
+            .is_err());
+    }
+}
@@ -0,0 +1,63 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_git_filter() -> Command {
+    Command::new("git-filter")
+        .about("Encrypt and decrypt files transparently in a git repository")
+        .after_help(
+            r"The files are encrypted for the recipients of the .ssh-vault.yml file found in
+the directory of the file or its parents.
+
+Setup:
+
+    git config filter.sshvault.clean 'ssh-vault git-filter clean %f'
+    git config filter.sshvault.smudge 'ssh-vault git-filter smudge %f'
+    git config filter.sshvault.required true
+
+    echo 'secrets/** filter=sshvault' >> .gitattributes
+
+Example .ssh-vault.yml:
+
+    recipients:
+      - keys/team.keys
+    users:
+      - alice
+",
+        )
+        .arg(
+            Arg::new("mode")
+                .help("clean encrypts the file for the repository, smudge decrypts it for the working tree")
+                .value_parser(["clean", "smudge"])
+                .required(true),
+        )
+        .arg(
+            Arg::new("path")
+                .help("Path of the file in the repository, passed by git with %f"),
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_git_filter() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_git_filter());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "git-filter", "clean", "secrets/db.env"])
+            .unwrap();
+        let m = matches.subcommand_matches("git-filter").unwrap();
+        assert_eq!(m.get_one::<String>("mode").unwrap(), "clean");
+        assert_eq!(m.get_one::<String>("path").unwrap(), "secrets/db.env");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_git_filter());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "git-filter", "encrypt"])
+            .is_err());
+    }
+}
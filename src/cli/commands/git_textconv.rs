@@ -0,0 +1,47 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_git_textconv() -> Command {
+    Command::new("git-textconv")
+        .about("Decrypt a vault for git diff and git log -p")
+        .after_help(
+            r"Vaults that can't be decrypted with the available keys are shown as they are.
+
+Setup:
+
+    git config diff.sshvault.textconv 'ssh-vault git-textconv'
+
+    echo '*.vault diff=sshvault' >> .gitattributes
+",
+        )
+        .arg(
+            Arg::new("path")
+                .help("File with the vault, passed by git")
+                .required(true),
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_git_textconv() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_git_textconv());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "git-textconv", "/tmp/secret.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("git-textconv").unwrap();
+        assert_eq!(m.get_one::<String>("path").unwrap(), "/tmp/secret.vault");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_git_textconv());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "git-textconv"])
+            .is_err());
+    }
+}
@@ -0,0 +1,55 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_grpc() -> Command {
+    Command::new("grpc")
+        .about("Serve the gRPC API on a unix socket for other services on the host")
+        .after_help(
+            r"The service is defined in proto/ssh_vault.proto, it needs ssh-vault built with:
+
+    cargo build --features grpc
+
+Examples:
+
+Encrypt for the recipients of .ssh-vault.yml and decrypt with the key of the host:
+
+    ssh-vault grpc --key /etc/ssh-vault/id_ed25519 --socket /run/ssh-vault/grpc.sock
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting, defaults to ~/.ssh/id_ed25519 or ~/.ssh/id_rsa"),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help("File with public keys to encrypt for, defaults to the keys of .ssh-vault.yml")
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("socket")
+                .short('s')
+                .long("socket")
+                .env("SSH_VAULT_GRPC_SOCK")
+                .help("Path of the socket, defaults to ~/.ssh/vault/grpc.sock"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_grpc() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_grpc());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "grpc", "-s", "/tmp/grpc.sock"])
+            .unwrap();
+        let m = matches.subcommand_matches("grpc").unwrap();
+        assert_eq!(m.get_one::<String>("socket").unwrap(), "/tmp/grpc.sock");
+        assert!(m.get_one::<String>("key").is_none());
+    }
+}
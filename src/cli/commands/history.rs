@@ -0,0 +1,40 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_history() -> Command {
+    Command::new("history")
+        .about("List the previous revisions of a vault kept with the history option")
+        .after_help(
+            r"With history: N in ~/.config/ssh-vault/config.yml every save of a vault by
+edit, watch, relabel or values keeps the previous N versions, still
+encrypted, in .<vault>.d next to it. The newest is listed first:
+
+    ssh-vault history db.vault
+    ssh-vault view --revision -1 db.vault
+",
+        )
+        .arg(
+            Arg::new("vault")
+                .help("Vault to list the revisions of")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_history() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_history());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "history", "db.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("history").unwrap();
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "db.vault");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_history());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "history"])
+            .is_err());
+    }
+}
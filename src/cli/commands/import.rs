@@ -0,0 +1,107 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_import() -> Command {
+    Command::new("import")
+        .about("Import the entries of another password manager as vaults")
+        .after_help(
+            r"Every entry is written to its own vault in the output directory, keeping the
+directory layout or the folders of the source. Like pass, the first line of the
+vault is the password followed by the username, url, totp and the notes.
+
+pass, the entries are decrypted with gpg:
+
+    ssh-vault import pass ~/.password-store -o secrets -r ~/.ssh/id_ed25519.pub
+
+1Password and LastPass CSV exports, Bitwarden CSV or unencrypted JSON exports:
+
+    ssh-vault import bitwarden bitwarden_export.json -o secrets
+    ssh-vault import lastpass lastpass_export.csv --single -o passwords.vault
+",
+        )
+        .arg(
+            Arg::new("format")
+                .help("Password manager to import from")
+                .value_parser(["1password", "bitwarden", "lastpass", "pass"])
+                .required(true),
+        )
+        .arg(
+            Arg::new("path")
+                .help("Password store or export file to import")
+                .required(true),
+        )
+        .arg(
+            Arg::new("output")
+                .short('o')
+                .long("output")
+                .help("Directory for the vaults, the vault with --single")
+                .value_name("DIR")
+                .required(true),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help(
+                    "File with public keys to encrypt for, defaults to the keys of .ssh-vault.yml",
+                )
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("single")
+                .long("single")
+                .help("Write all the entries to a single vault as a JSON array")
+                .num_args(0),
+        )
+        .arg(
+            Arg::new("force")
+                .short('f')
+                .long("force")
+                .help("Overwrite existing vaults")
+                .num_args(0),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_import() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_import());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "import",
+                "pass",
+                "store",
+                "-o",
+                "secrets",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("import").unwrap();
+        assert_eq!(m.get_one::<String>("format").unwrap(), "pass");
+        assert_eq!(m.get_one::<String>("path").unwrap(), "store");
+        assert_eq!(m.get_one::<String>("output").unwrap(), "secrets");
+        assert!(!m.get_flag("force"));
+        assert!(!m.get_flag("single"));
+
+        // the output directory is required
+        let app = Command::new("ssh-vault").subcommand(subcommand_import());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "import", "pass", "store"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_import());
+        assert!(app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "import",
+                "keepass",
+                "export.csv",
+                "-o",
+                "secrets"
+            ])
+            .is_err());
+    }
+}
@@ -0,0 +1,48 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_index() -> Command {
+    Command::new("index")
+        .about(
+            "Write a JSON manifest of the vaults of a tree for dashboards and compliance reports",
+        )
+        .after_help(
+            r"Every vault is listed with its path relative to the directory, label,
+recipients, when it was created and when and by which key it was last edited.
+Nothing is decrypted.
+
+Examples:
+
+Write the manifest of the vaults in ./secrets:
+
+    ssh-vault index ./secrets > MANIFEST.json
+",
+        )
+        .arg(
+            Arg::new("dir")
+                .help("Directory to search for vaults, defaults to the current directory")
+                .value_name("DIR")
+                .default_value("."),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_index() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_index());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "index", "secrets"])
+            .unwrap();
+        let m = matches.subcommand_matches("index").unwrap();
+        assert_eq!(m.get_one::<String>("dir").unwrap(), "secrets");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_index());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "index"])
+            .unwrap();
+        let m = matches.subcommand_matches("index").unwrap();
+        assert_eq!(m.get_one::<String>("dir").unwrap(), ".");
+    }
+}
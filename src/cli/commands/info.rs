@@ -0,0 +1,58 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_info() -> Command {
+    Command::new("info")
+        .about("Show the keys that can open a vault without decrypting it")
+        .after_help(
+            r"Examples:
+
+List the keys of a vault:
+
+    ssh-vault info secret.vault
+
+List all the vaults in a directory and their keys:
+
+    ssh-vault info ./secrets
+",
+        )
+        .visible_alias("i")
+        .arg(
+            Arg::new("json")
+                .short('j')
+                .long("json")
+                .help("Output in JSON format")
+                .num_args(0),
+        )
+        .arg(
+            Arg::new("paths")
+                .help("Vault files or directories to search for vaults")
+                .value_name("PATH")
+                .required(true)
+                .action(ArgAction::Append),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_info() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_info());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "info", "a.vault", "secrets"])
+            .unwrap();
+        let m = matches.subcommand_matches("info").unwrap();
+        assert_eq!(
+            m.get_many::<String>("paths")
+                .unwrap()
+                .cloned()
+                .collect::<Vec<_>>(),
+            vec!["a.vault", "secrets"]
+        );
+        assert!(!m.get_flag("json"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_info());
+        assert!(app.try_get_matches_from(vec!["ssh-vault", "info"]).is_err());
+    }
+}
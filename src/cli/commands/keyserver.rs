@@ -0,0 +1,113 @@
+use clap::{Arg, ArgGroup, Command};
+
+pub fn subcommand_keyserver() -> Command {
+    Command::new("keyserver")
+        .about("Serve the public keys of a team as <user>.keys over HTTP")
+        .after_help(
+            r#"Only public keys and certificates are served, with ETag, Last-Modified and
+Cache-Control headers. Use a TLS proxy in front of it when listening on other
+interfaces.
+
+Examples:
+
+Serve ./keys/alice.keys as http://127.0.0.1:8080/alice.keys:
+
+    ssh-vault keyserver --from ./keys/
+
+    echo "secret" | ssh-vault create -u http://127.0.0.1:8080/alice.keys
+
+Serve the sshPublicKey attribute of the LDAP users, with ldapsearch:
+
+    ssh-vault keyserver --ldap ldap://ldap.example.com --ldap-base ou=people,dc=example,dc=com
+"#,
+        )
+        .arg(
+            Arg::new("listen")
+                .short('l')
+                .long("listen")
+                .help("Address to listen on")
+                .value_name("ADDR")
+                .default_value("127.0.0.1:8080"),
+        )
+        .arg(
+            Arg::new("from")
+                .long("from")
+                .help("Directory with the <user>.keys files")
+                .value_name("DIR"),
+        )
+        .arg(
+            Arg::new("ldap")
+                .long("ldap")
+                .help("URL of the LDAP server with the keys")
+                .value_name("URL")
+                .requires("ldap-base"),
+        )
+        .arg(
+            Arg::new("ldap-base")
+                .long("ldap-base")
+                .help("Search base of the users")
+                .value_name("DN")
+                .requires("ldap"),
+        )
+        .arg(
+            Arg::new("ldap-filter")
+                .long("ldap-filter")
+                .help("Filter of the user, {user} is replaced by the requested user")
+                .value_name("FILTER")
+                .default_value("(uid={user})"),
+        )
+        .arg(
+            Arg::new("max-age")
+                .long("max-age")
+                .help("Seconds the clients may cache the keys")
+                .value_name("SECONDS")
+                .default_value("300")
+                .value_parser(clap::value_parser!(u64)),
+        )
+        .group(
+            ArgGroup::new("source")
+                .args(["from", "ldap"])
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_keyserver() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_keyserver());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "keyserver", "--from", "keys"])
+            .unwrap();
+        let m = matches.subcommand_matches("keyserver").unwrap();
+        assert_eq!(m.get_one::<String>("listen").unwrap(), "127.0.0.1:8080");
+        assert_eq!(m.get_one::<String>("from").unwrap(), "keys");
+        assert_eq!(m.get_one::<u64>("max-age").copied(), Some(300));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_keyserver());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "keyserver"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_keyserver());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "keyserver", "--ldap", "ldap://ldap"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_keyserver());
+        assert!(app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "keyserver",
+                "--from",
+                "keys",
+                "--ldap",
+                "ldap://ldap",
+                "--ldap-base",
+                "dc=example,dc=com"
+            ])
+            .is_err());
+    }
+}
@@ -0,0 +1,82 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_merge() -> Command {
+    Command::new("merge")
+        .about("Three-way merge of vaults, usable as a git merge driver")
+        .after_help(
+            r"The vaults are decrypted, merged with git merge-file and the result is encrypted
+for the recipients of ours. Conflicts are kept with markers in the encrypted
+result, resolve them with: ssh-vault edit
+
+Register the merge driver in the current repository:
+
+    ssh-vault merge --install
+
+    echo '*.vault merge=sshvault' >> .gitattributes
+
+Merge manually:
+
+    ssh-vault merge base.vault ours.vault theirs.vault merged.vault
+",
+        )
+        .arg(
+            Arg::new("install")
+                .long("install")
+                .help(
+                    "Register ssh-vault as the sshvault merge driver of the current git repository",
+                )
+                .num_args(0)
+                .conflicts_with_all(["base", "ours", "theirs", "output"]),
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("base")
+                .help("Vault of the common ancestor, git %O")
+                .required_unless_present("install"),
+        )
+        .arg(
+            Arg::new("ours")
+                .help("Vault of the current branch, git %A")
+                .required_unless_present("install"),
+        )
+        .arg(
+            Arg::new("theirs")
+                .help("Vault of the other branch, git %B")
+                .required_unless_present("install"),
+        )
+        .arg(
+            Arg::new("output")
+                .help("Where to write the merged vault, defaults to ours like git expects"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_merge() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_merge());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "merge", "base", "ours", "theirs"])
+            .unwrap();
+        let m = matches.subcommand_matches("merge").unwrap();
+        assert_eq!(m.get_one::<String>("ours").unwrap(), "ours");
+        assert!(m.get_one::<String>("output").is_none());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_merge());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "merge", "--install"])
+            .is_ok());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_merge());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "merge", "base", "ours"])
+            .is_err());
+    }
+}
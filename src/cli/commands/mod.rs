@@ -1,13 +1,44 @@
+pub mod agent;
+pub mod audit_recipients;
+pub mod check;
+pub mod compare;
 pub mod create;
+pub mod decrypt;
+pub mod direnv;
 pub mod edit;
+pub mod encrypt;
+pub mod export;
 pub mod fingerprint;
+pub mod git_filter;
+pub mod git_textconv;
+pub mod grpc;
+pub mod history;
+pub mod import;
+pub mod index;
+pub mod info;
+pub mod keyserver;
+pub mod merge;
+pub mod mount;
+pub mod pack;
+pub mod relabel;
+pub mod repair;
+pub mod run;
+pub mod scan;
+pub mod server;
+pub mod share;
+pub mod undo;
+pub mod unpack;
+pub mod update;
+pub mod values;
 pub mod view;
+pub mod watch;
 
 use clap::{
     builder::styling::{AnsiColor, Effects, Styles},
-    ColorChoice, Command,
+    Arg, ColorChoice, Command,
 };
 
+use crate::logging;
 use std::env;
 
 pub fn new() -> Command {
@@ -20,13 +51,81 @@ pub fn new() -> Command {
     Command::new("ssh-vault")
         .about("encrypt/decrypt using ssh keys")
         .arg_required_else_help(true)
+        .allow_external_subcommands(true)
+        .after_help(
+            r"The options of a command may also come before it, as in ssh-vault 0.x:
+
+    ssh-vault -k ~/.ssh/id_ed25519 view secret.vault
+
+Other commands run the plugin ssh-vault-<command> found in the PATH",
+        )
         .version(env!("CARGO_PKG_VERSION"))
         .color(ColorChoice::Auto)
         .styles(styles)
+        .arg(
+            Arg::new("profile")
+                .long("profile")
+                .help("Use the settings of the profile in the config, SSH_VAULT_PROFILE is used if not set")
+                .value_name("NAME")
+                .global(true),
+        )
+        .arg(
+            Arg::new("socks5")
+                .long("socks5")
+                .help("Fetch the keys through a SOCKS5 proxy, e.g. 127.0.0.1:9050 for Tor, ALL_PROXY is used if not set")
+                .value_name("HOST:PORT")
+                .global(true),
+        )
+        .arg(
+            Arg::new("log-level")
+                .long("log-level")
+                .help("Log the key fetches, backend calls and decisions to stderr, secrets are redacted")
+                .value_name("LEVEL")
+                .env("SSH_VAULT_LOG_LEVEL")
+                .value_parser(logging::LEVELS)
+                .global(true),
+        )
+        .arg(
+            Arg::new("log-json")
+                .long("log-json")
+                .help("Log JSON lines, at the info level unless --log-level is set")
+                .num_args(0)
+                .global(true),
+        )
+        .subcommand(agent::subcommand_agent())
+        .subcommand(audit_recipients::subcommand_audit_recipients())
+        .subcommand(check::subcommand_check())
+        .subcommand(compare::subcommand_compare())
         .subcommand(create::subcommand_create())
+        .subcommand(decrypt::subcommand_decrypt())
+        .subcommand(direnv::subcommand_direnv())
         .subcommand(edit::subcommand_edit())
+        .subcommand(encrypt::subcommand_encrypt())
+        .subcommand(export::subcommand_export())
         .subcommand(fingerprint::subcommand_fingerprint())
+        .subcommand(git_filter::subcommand_git_filter())
+        .subcommand(git_textconv::subcommand_git_textconv())
+        .subcommand(grpc::subcommand_grpc())
+        .subcommand(history::subcommand_history())
+        .subcommand(import::subcommand_import())
+        .subcommand(index::subcommand_index())
+        .subcommand(info::subcommand_info())
+        .subcommand(keyserver::subcommand_keyserver())
+        .subcommand(merge::subcommand_merge())
+        .subcommand(mount::subcommand_mount())
+        .subcommand(pack::subcommand_pack())
+        .subcommand(relabel::subcommand_relabel())
+        .subcommand(repair::subcommand_repair())
+        .subcommand(run::subcommand_run())
+        .subcommand(scan::subcommand_scan())
+        .subcommand(server::subcommand_server())
+        .subcommand(share::subcommand_share())
+        .subcommand(undo::subcommand_undo())
+        .subcommand(unpack::subcommand_unpack())
+        .subcommand(update::subcommand_update())
+        .subcommand(values::subcommand_values())
         .subcommand(view::subcommand_view())
+        .subcommand(watch::subcommand_watch())
 }
 
 #[cfg(test)]
@@ -47,4 +146,46 @@ mod tests {
             env!("CARGO_PKG_VERSION")
         );
     }
+
+    #[test]
+    fn test_profile() {
+        let matches = new().get_matches_from(vec!["ssh-vault", "create", "--profile", "work"]);
+
+        assert_eq!(
+            matches.get_one::<String>("profile").map(String::as_str),
+            Some("work")
+        );
+    }
+
+    #[test]
+    fn test_log() {
+        let matches = new().get_matches_from(vec![
+            "ssh-vault",
+            "view",
+            "--log-level",
+            "debug",
+            "--log-json",
+        ]);
+
+        assert_eq!(
+            matches.get_one::<String>("log-level").map(String::as_str),
+            Some("debug")
+        );
+        assert!(matches.get_flag("log-json"));
+
+        assert!(new()
+            .try_get_matches_from(vec!["ssh-vault", "view", "--log-level", "verbose"])
+            .is_err());
+    }
+
+    #[test]
+    fn test_socks5() {
+        let matches =
+            new().get_matches_from(vec!["ssh-vault", "view", "--socks5", "127.0.0.1:9050"]);
+
+        assert_eq!(
+            matches.get_one::<String>("socks5").map(String::as_str),
+            Some("127.0.0.1:9050")
+        );
+    }
 }
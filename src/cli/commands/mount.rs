@@ -0,0 +1,67 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_mount() -> Command {
+    Command::new("mount")
+        .about("Mount the vaults of a directory decrypted and read-only")
+        .after_help(
+            r"The vaults are decrypted when first opened and kept in memory for --ttl seconds,
+listing them decrypts nothing so their size shows as 0 until then. It needs ssh-vault built with:
+
+    cargo build --features fuse
+
+Examples:
+
+    ssh-vault mount ./secrets /mnt/secrets
+
+Unmount:
+
+    fusermount -u /mnt/secrets
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("ttl")
+                .long("ttl")
+                .help("Seconds to keep a decrypted vault in memory")
+                .value_name("SECONDS")
+                .default_value("60")
+                .value_parser(clap::value_parser!(u64)),
+        )
+        .arg(
+            Arg::new("dir")
+                .help("Directory with the vaults")
+                .required(true),
+        )
+        .arg(
+            Arg::new("mountpoint")
+                .help("Empty directory where the vaults are shown decrypted")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_mount() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_mount());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "mount", "./secrets", "/mnt/secrets"])
+            .unwrap();
+        let m = matches.subcommand_matches("mount").unwrap();
+        assert_eq!(m.get_one::<String>("dir").unwrap(), "./secrets");
+        assert_eq!(m.get_one::<String>("mountpoint").unwrap(), "/mnt/secrets");
+        assert_eq!(m.get_one::<u64>("ttl").copied(), Some(60));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_mount());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "mount", "./secrets"])
+            .is_err());
+    }
+}
@@ -0,0 +1,71 @@
+use crate::cli::commands::create::arg_file_mode;
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_pack() -> Command {
+    Command::new("pack")
+        .about("Encrypt a directory into a single vault")
+        .after_help(
+            r"The directory is archived with tar, the paths are relative to it and the
+modes are kept, for secrets made of several files like a certificate, its key
+and the config using them. unpack extracts it again.
+
+Examples:
+
+    ssh-vault pack -k alice.pub -r bob.pub ./tls tls.vault
+    ssh-vault unpack -k ~/.ssh/bob tls.vault ./tls
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path or ssh:// URL of the public ssh key"),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help("Also encrypt for the public keys in FILE, can be used multiple times")
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("compress")
+                .short('z')
+                .long("compress")
+                .help("Compress the archive with gzip")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(arg_file_mode())
+        .arg(Arg::new("dir").help("Directory to encrypt").required(true))
+        .arg(Arg::new("vault").help("File to store the vault or writes to stdout if not specified"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_pack() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_pack());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "pack",
+                "-k",
+                "alice.pub",
+                "-z",
+                "./tls",
+                "tls.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("pack").unwrap();
+        assert_eq!(m.get_one::<String>("key").unwrap(), "alice.pub");
+        assert!(m.get_flag("compress"));
+        assert_eq!(m.get_one::<String>("dir").unwrap(), "./tls");
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "tls.vault");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_pack());
+        assert!(app.try_get_matches_from(vec!["ssh-vault", "pack"]).is_err());
+    }
+}
@@ -0,0 +1,85 @@
+use crate::cli::commands::view::arg_identity_fp;
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_relabel() -> Command {
+    Command::new("relabel")
+        .about("Change the label of a vault")
+        .after_help(
+            r#"The label is readable by anyone with ssh-vault info, but only a recipient of
+the vault can change it, the payload is not decrypted or modified.
+
+Examples:
+
+    ssh-vault relabel db.vault "prod DB creds"
+    ssh-vault relabel --remove db.vault
+"#,
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("remove")
+                .long("remove")
+                .help("Remove the label")
+                .action(ArgAction::SetTrue)
+                .conflicts_with("label"),
+        )
+        .arg(Arg::new("vault").help("Vault to relabel").required(true))
+        .arg(
+            Arg::new("label")
+                .help("New label of the vault")
+                .required_unless_present("remove"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_relabel() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_relabel());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "relabel", "db.vault", "prod DB creds"])
+            .unwrap();
+        let m = matches.subcommand_matches("relabel").unwrap();
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "db.vault");
+        assert_eq!(m.get_one::<String>("label").unwrap(), "prod DB creds");
+        assert!(!m.get_flag("remove"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_relabel());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "relabel", "db.vault"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_relabel());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "relabel", "--remove", "db.vault", "x"])
+            .is_err());
+    }
+}
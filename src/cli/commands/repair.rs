@@ -0,0 +1,81 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_repair() -> Command {
+    Command::new("repair")
+        .about("Recover what can be read of a damaged vault")
+        .after_help(
+            r"Every chunk of 64 KiB of a vault in the streamed format is authenticated on
+its own, the chunks that fail are skipped and the rest is decrypted, the lost
+chunks and the damaged lines are reported. Vaults created before the streamed
+format can't be repaired.
+
+Examples:
+
+    ssh-vault repair -o secret.recovered /path/to/damaged.vault
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("output")
+                .short('o')
+                .long("output")
+                .help("Write the recovered data to file instead of stdout"),
+        )
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(Arg::new("vault").help("Damaged vault").required(true))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_repair() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_repair());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "repair",
+                "-k",
+                "id_ed25519",
+                "-o",
+                "secret.txt",
+                "secret.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("repair").unwrap();
+        assert_eq!(m.get_one::<String>("key").unwrap(), "id_ed25519");
+        assert_eq!(m.get_one::<String>("output").unwrap(), "secret.txt");
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "secret.vault");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_repair());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "repair"])
+            .is_err());
+    }
+}
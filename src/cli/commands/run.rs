@@ -0,0 +1,119 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_run() -> Command {
+    Command::new("run")
+        .about("Run a command with the variables of a vault in its environment")
+        .visible_alias("exec")
+        .after_help(
+            r#"The vault must have KEY=VALUE lines, it is decrypted locally and the
+variables are only added to the environment of the command.
+
+Examples:
+
+Run a migration with the database credentials:
+
+    ssh-vault run db.env.vault -- ./migrate.sh
+
+Run it on a server, the variables go over the ssh session and are never
+written to its disk, stdin is forwarded to the command:
+
+    ssh-vault run --ssh admin@db.example.com db.env.vault -- psql < fix.sql
+
+Check which variables the vault adds to the environment or overrides, only
+their names are shown and nothing is run:
+
+    ssh-vault run --diff-env db.env.vault
+"#,
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("ssh")
+                .long("ssh")
+                .help("Run the command on [user@]host over ssh")
+                .value_name("DESTINATION"),
+        )
+        .arg(
+            Arg::new("diff-env")
+                .long("diff-env")
+                .help("Show the names of the variables that would be added or overridden instead of running the command")
+                .action(ArgAction::SetTrue)
+                .conflicts_with("ssh"),
+        )
+        .arg(
+            Arg::new("vault")
+                .help("Vault with the variables")
+                .required(true),
+        )
+        .arg(
+            Arg::new("command")
+                .help("Command to run and its arguments")
+                .value_name("COMMAND")
+                .num_args(1..)
+                .trailing_var_arg(true)
+                .allow_hyphen_values(true)
+                .required_unless_present("diff-env"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_run() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_run());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "run",
+                "--ssh",
+                "admin@db",
+                "db.env.vault",
+                "--",
+                "psql",
+                "-c",
+                "select 1",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("run").unwrap();
+        assert_eq!(m.get_one::<String>("ssh").unwrap(), "admin@db");
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "db.env.vault");
+        assert_eq!(
+            m.get_many::<String>("command")
+                .unwrap()
+                .map(String::as_str)
+                .collect::<Vec<_>>(),
+            vec!["psql", "-c", "select 1"]
+        );
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_run());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "run", "db.env.vault"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_run());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "exec", "--diff-env", "db.env.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("run").unwrap();
+        assert!(m.get_flag("diff-env"));
+        assert!(m.get_many::<String>("command").is_none());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_run());
+        assert!(app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "run",
+                "--diff-env",
+                "--ssh",
+                "admin@db",
+                "db.env.vault"
+            ])
+            .is_err());
+    }
+}
@@ -0,0 +1,71 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_scan() -> Command {
+    Command::new("scan")
+        .about("Find plaintext files that should be vaults")
+        .after_help(
+            r#"Files are flagged if they match the patterns of the .ssh-vault.yml policy or
+--pattern and are not vaults, or if they contain a private key.
+
+Examples:
+
+Scan the current directory:
+
+    ssh-vault scan
+
+Block commits with plaintext secrets, in .git/hooks/pre-commit:
+
+    #!/bin/sh
+    exec ssh-vault scan --staged --pattern '*.env'
+"#,
+        )
+        .arg(
+            Arg::new("pattern")
+                .short('p')
+                .long("pattern")
+                .help("Glob of the files that must be vaults, can be used multiple times")
+                .value_name("GLOB")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("staged")
+                .short('s')
+                .long("staged")
+                .help("Scan the files staged in git instead of the working tree")
+                .num_args(0)
+                .conflicts_with("paths"),
+        )
+        .arg(
+            Arg::new("paths")
+                .help("Files or directories to scan, defaults to the current directory")
+                .value_name("PATH")
+                .action(ArgAction::Append),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_scan() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_scan());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "scan", "-p", "*.env", "app", "config"])
+            .unwrap();
+        let m = matches.subcommand_matches("scan").unwrap();
+        assert_eq!(
+            m.get_many::<String>("paths")
+                .unwrap()
+                .cloned()
+                .collect::<Vec<_>>(),
+            vec!["app", "config"]
+        );
+        assert!(!m.get_flag("staged"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_scan());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "scan", "--staged", "app"])
+            .is_err());
+    }
+}
@@ -0,0 +1,140 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_server() -> Command {
+    Command::new("server")
+        .about("Serve an HTTP API to create vaults and list their keys")
+        .after_help(
+            r#"Every request needs the header "Authorization: Bearer <token>". The server never
+decrypts, use a TLS proxy in front of it when listening on other interfaces.
+
+Endpoints:
+
+    POST /v1/encrypt        encrypt the body for the recipients, returns the vault
+    GET  /v1/vaults         keys of the vaults in --vaults, as in: ssh-vault info --json
+    GET  /v1/vaults/<path>  keys of a vault
+    PUT  /v1/vaults/<path>  encrypt the body into the vault, replacing it
+    GET  /v1/health
+    GET  /metrics           requests, failures and encrypt latency for Prometheus
+
+With --acl each client has its own token and vault paths, globs relative to
+--vaults where `*` doesn't cross directories. The file is loaded again when it
+or a token file changes, without a restart:
+
+    clients:
+      - name: ci
+        token_file: tokens/ci
+        encrypt:
+          - apps/ci/**
+        read:
+          - apps/**
+
+Examples:
+
+Encrypt for the recipients of .ssh-vault.yml:
+
+    ssh-vault server --token-file /etc/ssh-vault/token --vaults ./secrets
+
+    curl -H "Authorization: Bearer $TOKEN" --data-binary @secret.txt http://127.0.0.1:8080/v1/encrypt
+
+Give each client access to its own vaults:
+
+    ssh-vault server --acl /etc/ssh-vault/acl.yml --vaults ./secrets
+
+    curl -X PUT -H "Authorization: Bearer $CI_TOKEN" --data-binary @db.env http://127.0.0.1:8080/v1/vaults/apps/ci/db.env.vault
+"#,
+        )
+        .arg(
+            Arg::new("listen")
+                .short('l')
+                .long("listen")
+                .help("Address to listen on")
+                .value_name("ADDR")
+                .default_value("127.0.0.1:8080"),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help("File with public keys to encrypt for, defaults to the keys of .ssh-vault.yml")
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("token-file")
+                .short('t')
+                .long("token-file")
+                .env("SSH_VAULT_SERVER_TOKEN_FILE")
+                .help("File with the bearer token required by the API")
+                .value_name("FILE")
+                .required_unless_present("acl"),
+        )
+        .arg(
+            Arg::new("acl")
+                .long("acl")
+                .env("SSH_VAULT_SERVER_ACL")
+                .help("File with the clients, their tokens and the vault paths they may use")
+                .value_name("FILE")
+                .conflicts_with("token-file"),
+        )
+        .arg(
+            Arg::new("vaults")
+                .long("vaults")
+                .help("Directory with the vaults to list")
+                .value_name("DIR"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_server() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_server());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "server",
+                "-t",
+                "token",
+                "-r",
+                "team.keys",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("server").unwrap();
+        assert_eq!(m.get_one::<String>("listen").unwrap(), "127.0.0.1:8080");
+        assert_eq!(m.get_one::<String>("token-file").unwrap(), "token");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_server());
+        temp_env::with_var_unset("SSH_VAULT_SERVER_TOKEN_FILE", || {
+            assert!(app
+                .try_get_matches_from(vec!["ssh-vault", "server"])
+                .is_err());
+        });
+
+        temp_env::with_vars_unset(
+            ["SSH_VAULT_SERVER_TOKEN_FILE", "SSH_VAULT_SERVER_ACL"],
+            || {
+                let app = Command::new("ssh-vault").subcommand(subcommand_server());
+                let matches = app
+                    .try_get_matches_from(vec!["ssh-vault", "server", "--acl", "acl.yml"])
+                    .unwrap();
+                let m = matches.subcommand_matches("server").unwrap();
+                assert_eq!(m.get_one::<String>("acl").unwrap(), "acl.yml");
+                assert!(m.get_one::<String>("token-file").is_none());
+
+                let app = Command::new("ssh-vault").subcommand(subcommand_server());
+                assert!(app
+                    .try_get_matches_from(vec![
+                        "ssh-vault",
+                        "server",
+                        "--acl",
+                        "acl.yml",
+                        "-t",
+                        "token"
+                    ])
+                    .is_err());
+            },
+        );
+    }
+}
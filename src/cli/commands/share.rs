@@ -0,0 +1,99 @@
+use clap::{Arg, Command};
+
+pub fn subcommand_share() -> Command {
+    Command::new("share")
+        .about("Send your share of a dual control vault to the other recipient, or a vault as a one-time link")
+        .after_help(
+            r"The share is decrypted with your key and encrypted for the other recipient of
+the vault, it is useless without their key and their own share.
+
+    ssh-vault share -k ~/.ssh/id_ed25519 -r bob.pub break-glass.vault > alice.share
+    ssh-vault view -k ~/.ssh/bob --share alice.share break-glass.vault
+
+With --ttl the vault is uploaded to the share_url of the config and a link that
+downloads it once is printed, the service deletes it when the TTL is over:
+
+    ssh-vault share --ttl 1h secret.vault
+    curl -s https://paste.example.com/p/4f2a | ssh-vault view
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help("Public key of the other recipient of the vault")
+                .value_name("FILE")
+                .required_unless_present("ttl"),
+        )
+        .arg(
+            Arg::new("output")
+                .short('o')
+                .long("output")
+                .help("Write the share to file instead of stdout"),
+        )
+        .arg(
+            Arg::new("ttl")
+                .long("ttl")
+                .help("Upload the vault and print a one-time link to it, valid for DURATION (e.g. 1h)")
+                .value_name("DURATION")
+                .value_parser(humantime::parse_duration)
+                .conflicts_with_all(["key", "recipient", "output"]),
+        )
+        .arg(Arg::new("vault").help("Dual control vault, or any vault with --ttl").required(true))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_subcommand_share() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_share());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "share", "-r", "bob.pub", "secret.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("share").unwrap();
+        assert_eq!(m.get_one::<String>("recipient").unwrap(), "bob.pub");
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "secret.vault");
+        assert_eq!(m.get_one::<String>("output"), None);
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_share());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "share", "secret.vault"])
+            .is_err());
+    }
+
+    #[test]
+    fn test_subcommand_share_ttl() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_share());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "share", "secret.vault", "--ttl", "1h"])
+            .unwrap();
+        let m = matches.subcommand_matches("share").unwrap();
+        assert_eq!(
+            m.get_one::<Duration>("ttl"),
+            Some(&Duration::from_secs(3600))
+        );
+        assert_eq!(m.get_one::<String>("recipient"), None);
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_share());
+        assert!(app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "share",
+                "-r",
+                "bob.pub",
+                "--ttl",
+                "1h",
+                "secret.vault"
+            ])
+            .is_err());
+    }
+}
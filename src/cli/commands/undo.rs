@@ -0,0 +1,72 @@
+use crate::cli::commands::view::arg_identity_fp;
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_undo() -> Command {
+    Command::new("undo")
+        .about("Restore the previous revision of a vault kept with the history option")
+        .after_help(
+            r"The changes that will be reverted are shown as a diff of the plaintexts and
+the vault is only restored once confirmed. The version replaced is kept as a
+revision too, undo again to get it back.
+
+    ssh-vault undo db.vault
+    ssh-vault undo --yes db.vault
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("yes")
+                .short('y')
+                .long("yes")
+                .help("Restore without showing the diff or asking, nothing is decrypted")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(Arg::new("vault").help("Vault to restore").required(true))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_undo() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_undo());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "undo", "-k", "id", "db.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("undo").unwrap();
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "db.vault");
+        assert_eq!(m.get_one::<String>("key").unwrap(), "id");
+        assert!(!m.get_flag("yes"));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_undo());
+        assert!(app.try_get_matches_from(vec!["ssh-vault", "undo"]).is_err());
+    }
+}
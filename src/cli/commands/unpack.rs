@@ -0,0 +1,80 @@
+use crate::cli::commands::view::arg_identity_fp;
+use clap::{Arg, Command};
+
+pub fn subcommand_unpack() -> Command {
+    Command::new("unpack")
+        .about("Extract a directory encrypted with pack")
+        .after_help(
+            r"The directory must be new or empty, the files get the modes they had when
+packed and nothing is written outside of it. Without a directory the vault
+is extracted next to it, without the .vault extension.
+
+Examples:
+
+    ssh-vault unpack tls.vault ./tls
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("vault")
+                .help("Vault created with pack")
+                .required(true),
+        )
+        .arg(Arg::new("dir").help("Directory to extract the files to"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_unpack() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_unpack());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "unpack",
+                "-k",
+                "bob",
+                "tls.vault",
+                "./tls",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("unpack").unwrap();
+        assert_eq!(m.get_one::<String>("key").unwrap(), "bob");
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "tls.vault");
+        assert_eq!(m.get_one::<String>("dir").unwrap(), "./tls");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_unpack());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "unpack"])
+            .is_err());
+    }
+}
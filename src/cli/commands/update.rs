@@ -0,0 +1,71 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_update() -> Command {
+    Command::new("update")
+        .about("Update ssh-vault to the latest release, verifying its signed checksum")
+        .after_help(
+            r"The SHA256SUMS of the release must be signed with ssh-keygen -Y sign by one of
+the release keys, the ones built in and the update_keys of the config, and the
+archive must match its checksum. The running binary is replaced atomically,
+packages managed by brew, apt or cargo should be updated with them instead.
+
+The release binaries have the key built in. A binary built from source has
+none unless SSH_VAULT_RELEASE_KEY was set when building, add the release key
+to ~/.config/ssh-vault/config.yml to use it:
+
+    update_keys:
+      - ssh-ed25519 AAAA... ssh-vault-release
+
+    ssh-vault update --check
+    ssh-vault update
+    ssh-vault update --version 1.0.13
+",
+        )
+        .arg(
+            Arg::new("check")
+                .long("check")
+                .help("Only tell if a newer release is available")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(
+            Arg::new("version")
+                .long("version")
+                .help("Install this release instead of the latest, e.g. to go back")
+                .value_name("VERSION")
+                .conflicts_with("check"),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_update() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_update());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "update", "--check"])
+            .unwrap();
+        let m = matches.subcommand_matches("update").unwrap();
+        assert!(m.get_flag("check"));
+        assert!(m.get_one::<String>("version").is_none());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_update());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "update", "--version", "1.0.13"])
+            .unwrap();
+        let m = matches.subcommand_matches("update").unwrap();
+        assert_eq!(m.get_one::<String>("version").unwrap(), "1.0.13");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_update());
+        assert!(app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "update",
+                "--check",
+                "--version",
+                "1.0.13"
+            ])
+            .is_err());
+    }
+}
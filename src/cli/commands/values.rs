@@ -0,0 +1,112 @@
+use clap::{Arg, ArgAction, Command};
+
+pub fn subcommand_values() -> Command {
+    Command::new("values")
+        .about("Encrypt only the values of a document, keys and comments stay readable")
+        .after_help(
+            r"The values are replaced with ENC[SSH-VAULT,...] and the encrypted key of the
+document is stored in the ssh_vault key, new values are encrypted with the same
+key so only the changed lines show up in a diff.
+
+Example:
+
+    ssh-vault values encrypt -r ~/.ssh/id_ed25519.pub -i config.yml
+    ssh-vault values encrypt -s 'password|token' -i config.json
+    ssh-vault values decrypt .env.production
+    ssh-vault values decrypt config.yml
+",
+        )
+        .arg(
+            Arg::new("mode")
+                .help("encrypt the values that are not encrypted yet or decrypt all the values")
+                .value_parser(["encrypt", "decrypt"])
+                .required(true),
+        )
+        .arg(Arg::new("file").help("Document to read, stdin if not set"))
+        .arg(
+            Arg::new("format")
+                .short('f')
+                .long("format")
+                .help("Format of the document, detected from the file extension if not set")
+                .value_parser(["dotenv", "json", "yaml"]),
+        )
+        .arg(
+            Arg::new("in-place")
+                .short('i')
+                .long("in-place")
+                .help("Write the result to the file instead of stdout")
+                .requires("file")
+                .num_args(0),
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(
+            Arg::new("select")
+                .short('s')
+                .long("select")
+                .help("Only encrypt the values whose path matches the regex, e.g. db.password, can be repeated")
+                .value_name("REGEX")
+                .action(ArgAction::Append),
+        )
+        .arg(
+            Arg::new("recipient")
+                .short('r')
+                .long("recipient")
+                .help(
+                    "File with public keys to encrypt for, defaults to the keys of .ssh-vault.yml",
+                )
+                .value_name("FILE")
+                .action(ArgAction::Append),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subcommand_values() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_values());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "values",
+                "encrypt",
+                "-r",
+                "a.pub",
+                "-r",
+                "b.pub",
+                "-s",
+                "password",
+                "-i",
+                "config.yml",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("values").unwrap();
+        assert_eq!(m.get_one::<String>("mode").unwrap(), "encrypt");
+        assert_eq!(m.get_one::<String>("file").unwrap(), "config.yml");
+        assert_eq!(
+            m.get_many::<String>("recipient")
+                .unwrap()
+                .collect::<Vec<_>>(),
+            vec!["a.pub", "b.pub"]
+        );
+        assert!(m.get_flag("in-place"));
+        assert_eq!(m.get_one::<String>("select").unwrap(), "password");
+
+        // in place requires a file
+        let app = Command::new("ssh-vault").subcommand(subcommand_values());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "values", "decrypt", "-i"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_values());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "values", "encrypt", "-f", "toml"])
+            .is_err());
+    }
+}
@@ -1,4 +1,21 @@
-use clap::{Arg, Command};
+use crate::cli::commands::create::{arg_file_mode, arg_quiet, validator_fingerprint};
+use clap::{Arg, ArgAction, Command};
+
+pub fn arg_identity_fp() -> Arg {
+    Arg::new("identity-fp")
+        .long("identity-fp")
+        .help("Use the key in ~/.ssh with this fingerprint instead of asking which one")
+        .value_name("FINGERPRINT")
+        .value_parser(validator_fingerprint())
+        .conflicts_with("key")
+}
+
+pub fn arg_restore_owner() -> Arg {
+    Arg::new("restore-owner")
+        .long("restore-owner")
+        .help("Also restore the owner recorded by create --preserve owner, usually as root")
+        .action(ArgAction::SetTrue)
+}
 
 pub fn subcommand_view() -> Command {
     Command::new("view")
@@ -9,6 +26,45 @@ pub fn subcommand_view() -> Command {
 View a secret:
 
     ssh-vault view < /path/to/secret.vault
+
+Read the passphrase of the private key from a file:
+
+    ssh-vault view --passphrase-file /path/to/passphrase /path/to/secret.vault
+
+Open a dual control vault with the share of the other recipient:
+
+    ssh-vault view --share alice.share /path/to/secret.vault
+
+Check that the vault is well formed before opening it:
+
+    ssh-vault view --strict /path/to/secret.vault
+
+Open a vault with one of the keys in ~/.ssh without being asked which one:
+
+    ssh-vault view --identity-fp SHA256:hgIL5fEHz5zuOWY1CDlUuotdaUl4MvYG7vAgE4q4TzM /path/to/secret.vault
+
+Open a vault with a key that never leaves a server, ssh-vault runs there with
+the key or the agent of the user:
+
+    ssh-vault view --on deploy@server.example.com secret.vault
+
+Give the secret to a command on the server, only its output comes back:
+
+    ssh-vault view --on deploy@server.example.com --exec 'psql -f -' migration.sql.vault
+
+Write the KEY=VALUE lines of a vault as an EnvironmentFile of a systemd unit,
+the file is only readable by its owner:
+
+    ssh-vault view --format systemd-env -o /run/myapp/env myapp.env.vault
+
+List the values of a dotenv, JSON or YAML vault as CSV, a row per key:
+
+    ssh-vault view --format csv config.json.vault
+
+Check that it is the right vault on a shared screen, the keys are shown and
+the values masked:
+
+    ssh-vault view --redact config.json.vault
 ",
         )
         .visible_alias("v")
@@ -18,11 +74,33 @@ View a secret:
                 .long("key")
                 .help("Path to the private ssh key to use for decyrpting"),
         )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("on")
+                .long("on")
+                .help("Send the vault over ssh and open it with ssh-vault on [user@]host")
+                .value_name("DESTINATION")
+                .conflicts_with_all(["key", "identity-fp", "share"]),
+        )
+        .arg(
+            Arg::new("exec")
+                .long("exec")
+                .help("Write the secret to the stdin of the command instead, on the host with --on")
+                .value_name("COMMAND")
+                .conflicts_with("output"),
+        )
+        .arg(
+            Arg::new("format")
+                .long("format")
+                .help("Write the variables of the secret as a systemd EnvironmentFile or its values as CSV or TSV")
+                .value_parser(["csv", "systemd-env", "tsv"])
+                .conflicts_with("on"),
+        )
         .arg(
             Arg::new("output")
                 .short('o')
                 .long("output")
-                .help("Write output to file instead of stdout"),
+                .help("Write output to file instead of stdout, restores the mode recorded by create"),
         )
         .arg(
             Arg::new("passphrase")
@@ -31,6 +109,57 @@ View a secret:
                 .env("SSH_VAULT_PASSPHRASE")
                 .help("Passphrase of the private ssh key"),
         )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("share")
+                .long("share")
+                .help("Share sent by the other recipient of a dual control vault")
+                .value_name("FILE"),
+        )
+        .arg(arg_quiet())
+        .arg(
+            Arg::new("raw")
+                .long("raw")
+                .help("Write binary data even if the output is a terminal")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(
+            Arg::new("redact")
+                .long("redact")
+                .help("Show the keys and the length of the values, masked but their first and last 2 characters")
+                .action(ArgAction::SetTrue)
+                .conflicts_with_all(["format", "on"]),
+        )
+        .arg(arg_restore_owner().requires("output"))
+        .arg(
+            Arg::new("revision")
+                .long("revision")
+                .help("Open a previous revision kept with the history option, -1 is the last one")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i64))
+                .allow_negative_numbers(true)
+                .requires("vault"),
+        )
+        .arg(
+            Arg::new("strict")
+                .long("strict")
+                .help("Reject any malformed armor or header, even if it could be read, and expired vaults")
+                .action(ArgAction::SetTrue),
+        )
+        .arg(arg_file_mode())
         .arg(
             Arg::new("vault")
                 .help("file to read the vault from or reads from stdin if not specified"),
@@ -85,6 +214,9 @@ mod tests {
         assert_eq!(m.get_one::<String>("vault"), None);
         assert_eq!(m.get_one::<String>("passphrase"), None);
         assert_eq!(m.get_one::<String>("output"), None);
+        assert_eq!(m.get_one::<String>("share"), None);
+        assert!(!m.get_flag("raw"));
+        assert!(!m.get_flag("strict"));
     }
 
     #[test]
@@ -160,4 +292,148 @@ mod tests {
         assert_eq!(m.get_one::<String>("passphrase").unwrap(), "secret");
         assert_eq!(m.get_one::<String>("output").unwrap(), "/path/to/output");
     }
+
+    #[test]
+    fn test_subcommand_view_passphrase_fd_file() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "view",
+            "--passphrase-fd",
+            "3",
+            "/path/to/vault",
+        ]);
+        assert!(matches.is_ok());
+        let m = matches
+            .unwrap()
+            .subcommand_matches("view")
+            .unwrap()
+            .to_owned();
+        assert_eq!(m.get_one::<i32>("passphrase-fd").copied(), Some(3));
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "view",
+            "--passphrase-fd",
+            "3",
+            "--passphrase-file",
+            "/path/to/passphrase",
+        ]);
+        assert!(matches.is_err());
+    }
+
+    #[test]
+    fn test_subcommand_view_identity_fp() {
+        let fingerprint = "SHA256:hgIL5fEHz5zuOWY1CDlUuotdaUl4MvYG7vAgE4q4TzM";
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "view",
+            "--identity-fp",
+            fingerprint,
+            "/path/to/vault",
+        ]);
+        assert!(matches.is_ok());
+        let m = matches
+            .unwrap()
+            .subcommand_matches("view")
+            .unwrap()
+            .to_owned();
+        assert_eq!(m.get_one::<String>("identity-fp").unwrap(), fingerprint);
+
+        // with -k there is nothing to choose
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app.try_get_matches_from(vec![
+            "ssh-vault",
+            "view",
+            "-k",
+            "/path/to/id_rsa",
+            "--identity-fp",
+            fingerprint,
+        ]);
+        assert!(matches.is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches =
+            app.try_get_matches_from(vec!["ssh-vault", "view", "--identity-fp", "invalid"]);
+        assert!(matches.is_err());
+    }
+
+    #[test]
+    fn test_subcommand_view_on() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "view",
+                "--on",
+                "deploy@server",
+                "--exec",
+                "wc -c",
+                "secret.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("view").unwrap();
+        assert_eq!(m.get_one::<String>("on").unwrap(), "deploy@server");
+        assert_eq!(m.get_one::<String>("exec").unwrap(), "wc -c");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        assert!(app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "view",
+                "--on",
+                "server",
+                "-k",
+                "id_ed25519"
+            ])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "view", "--exec", "cat", "-o", "out"])
+            .is_err());
+    }
+
+    #[test]
+    fn test_subcommand_view_format() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "view",
+                "--format",
+                "systemd-env",
+                "-o",
+                "/run/myapp/env",
+                "myapp.env.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("view").unwrap();
+        assert_eq!(m.get_one::<String>("format").unwrap(), "systemd-env");
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "view", "--format", "yaml"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "view", "--format", "csv", "--redact"])
+            .is_err());
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        let matches = app
+            .try_get_matches_from(vec!["ssh-vault", "view", "--revision", "-1", "db.vault"])
+            .unwrap();
+        let m = matches.subcommand_matches("view").unwrap();
+        assert_eq!(m.get_one::<i64>("revision").copied(), Some(-1));
+
+        // the revisions are the ones of a file
+        let app = Command::new("ssh-vault").subcommand(subcommand_view());
+        assert!(app
+            .try_get_matches_from(vec!["ssh-vault", "view", "--revision", "-1"])
+            .is_err());
+    }
 }
@@ -0,0 +1,130 @@
+use crate::cli::commands::view::arg_identity_fp;
+use clap::{Arg, Command};
+
+pub fn subcommand_watch() -> Command {
+    Command::new("watch")
+        .about("Encrypt a plaintext file into an existing vault every time it is saved")
+        .after_help(
+            r"The vault keeps its recipients, it is opened once with your key and the file
+is encrypted again with the same key on every save, until Ctrl-C. A missing
+file is created from the vault with mode 0600.
+
+Examples:
+
+    ssh-vault watch -k ~/.ssh/id_ed25519 .env secrets.env.vault
+
+Wait for the file to stay the same for 2 seconds before encrypting it:
+
+    ssh-vault watch --debounce 2s .env secrets.env.vault
+
+The plaintext file stays on disk, keep it out of git and remove it when done
+",
+        )
+        .arg(
+            Arg::new("key")
+                .short('k')
+                .long("key")
+                .help("Path to the private ssh key to use for decrypting"),
+        )
+        .arg(arg_identity_fp())
+        .arg(
+            Arg::new("passphrase")
+                .short('p')
+                .long("passphrase")
+                .env("SSH_VAULT_PASSPHRASE")
+                .help("Passphrase of the private ssh key"),
+        )
+        .arg(
+            Arg::new("passphrase-fd")
+                .long("passphrase-fd")
+                .help("Read the passphrase of the private ssh key from file descriptor N")
+                .value_name("N")
+                .value_parser(clap::value_parser!(i32))
+                .conflicts_with("passphrase-file"),
+        )
+        .arg(
+            Arg::new("passphrase-file")
+                .long("passphrase-file")
+                .help("Read the passphrase of the private ssh key from the first line of a file")
+                .value_name("FILE"),
+        )
+        .arg(
+            Arg::new("debounce")
+                .long("debounce")
+                .help("Encrypt once the file didn't change for DURATION")
+                .value_name("DURATION")
+                .default_value("500ms")
+                .value_parser(humantime::parse_duration),
+        )
+        .arg(
+            Arg::new("file")
+                .help("Plaintext file to watch")
+                .required(true),
+        )
+        .arg(
+            Arg::new("vault")
+                .help("Vault to encrypt the file into")
+                .required(true),
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_subcommand_watch() {
+        let app = Command::new("ssh-vault").subcommand(subcommand_watch());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "watch",
+                "-k",
+                "bob",
+                ".env",
+                "secrets.env.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("watch").unwrap();
+        assert_eq!(m.get_one::<String>("key").unwrap(), "bob");
+        assert_eq!(m.get_one::<String>("file").unwrap(), ".env");
+        assert_eq!(m.get_one::<String>("vault").unwrap(), "secrets.env.vault");
+        assert_eq!(
+            m.get_one::<Duration>("debounce").copied(),
+            Some(Duration::from_millis(500))
+        );
+
+        let app = Command::new("ssh-vault").subcommand(subcommand_watch());
+        let matches = app
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "watch",
+                "--debounce",
+                "2s",
+                ".env",
+                "secrets.env.vault",
+            ])
+            .unwrap();
+        let m = matches.subcommand_matches("watch").unwrap();
+        assert_eq!(
+            m.get_one::<Duration>("debounce").copied(),
+            Some(Duration::from_secs(2))
+        );
+
+        for args in [
+            vec!["ssh-vault", "watch", ".env"],
+            vec![
+                "ssh-vault",
+                "watch",
+                "--debounce",
+                "soon",
+                ".env",
+                "s.vault",
+            ],
+        ] {
+            let app = Command::new("ssh-vault").subcommand(subcommand_watch());
+            assert!(app.try_get_matches_from(args).is_err());
+        }
+    }
+}
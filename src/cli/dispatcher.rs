@@ -1,7 +1,11 @@
-use crate::cli::actions::Action;
+use crate::{
+    cli::actions::{Action, EditorTimeout, FilterMode},
+    vault::{dio, find, ssh::prompt},
+};
 
 use anyhow::{Context, Result};
 use secrecy::Secret;
+use std::{ffi::OsString, time::Duration};
 
 pub fn dispatch(matches: &clap::ArgMatches) -> Result<Action> {
     // Closure to return subcommand matches
@@ -22,10 +26,24 @@ pub fn dispatch(matches: &clap::ArgMatches) -> Result<Action> {
         Some("create") => {
             let sub_m = sub_m("create")?;
             Ok(Action::Create {
+                dual_control: sub_m.get_flag("dual-control"),
+                expires: sub_m.get_one::<Duration>("expires").copied(),
+                file_mode: file_mode(sub_m),
                 fingerprint: sub_m.get_one("fingerprint").map(|s: &String| s.to_string()),
                 input: sub_m.get_one("input").map(|s: &String| s.to_string()),
                 json: sub_m.get_one("json").copied().unwrap_or(false),
                 key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                label: sub_m.get_one("label").map(|s: &String| s.to_string()),
+                preserve: sub_m
+                    .get_many::<String>("preserve")
+                    .map(|attributes| attributes.cloned().collect())
+                    .unwrap_or_default(),
+                quiet: sub_m.get_flag("quiet"),
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                strict: sub_m.get_flag("strict"),
                 user: sub_m.get_one("user").map(|s: &String| s.to_string()),
                 vault: sub_m.get_one("vault").map(|s: &String| s.to_string()),
             })
@@ -33,37 +51,533 @@ pub fn dispatch(matches: &clap::ArgMatches) -> Result<Action> {
         Some("view") => {
             let sub_m = sub_m("view")?;
             Ok(Action::View {
-                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                exec: sub_m.get_one("exec").map(|s: &String| s.to_string()),
+                file_mode: file_mode(sub_m),
+                format: sub_m.get_one("format").map(|s: &String| s.to_string()),
+                key: key(sub_m)?,
+                on: sub_m.get_one("on").map(|s: &String| s.to_string()),
                 vault: sub_m.get_one("vault").map(|s: &String| s.to_string()),
                 output: sub_m.get_one("output").map(|s: &String| s.to_string()),
-                passphrase: sub_m
-                    .get_one("passphrase")
-                    .map(|s: &String| Secret::new(s.to_string())),
+                passphrase: passphrase(sub_m)?,
+                quiet: sub_m.get_flag("quiet"),
+                raw: sub_m.get_flag("raw"),
+                redact: sub_m.get_flag("redact"),
+                restore_owner: sub_m.get_flag("restore-owner"),
+                revision: sub_m.get_one::<i64>("revision").copied(),
+                share: sub_m.get_one("share").map(|s: &String| s.to_string()),
+                strict: sub_m.get_flag("strict"),
+            })
+        }
+        Some("direnv") => {
+            let sub_m = sub_m("direnv")?;
+            Ok(Action::Direnv {
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+                watch: sub_m.get_flag("watch"),
             })
         }
         Some("edit") => {
             let sub_m = sub_m("edit")?;
             Ok(Action::Edit {
+                force: sub_m.get_flag("force"),
+                key: key(sub_m)?,
+                passphrase: passphrase(sub_m)?,
+                timeout: sub_m
+                    .get_one::<u64>("timeout")
+                    .map(|minutes| EditorTimeout {
+                        duration: Duration::from_secs(minutes * 60),
+                        abort: sub_m.get_flag("abort-on-timeout"),
+                    }),
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("export") => {
+            let sub_m = sub_m("export")?;
+            Ok(Action::Export {
+                cert: sub_m.get_one("cert").map(|s: &String| s.to_string()),
+                force: sub_m.get_flag("force"),
+                format: sub_m
+                    .get_one("format")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Format required"))?,
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                namespace: sub_m.get_one("namespace").map(|s: &String| s.to_string()),
+                output: sub_m
+                    .get_one("output")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Output required"))?,
+                path: sub_m
+                    .get_one("path")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Path required"))?,
+            })
+        }
+        Some("git-filter") => {
+            let sub_m = sub_m("git-filter")?;
+            Ok(Action::GitFilter {
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                mode: match sub_m.get_one::<String>("mode").map(String::as_str) {
+                    Some("smudge") => FilterMode::Smudge,
+                    _ => FilterMode::Clean,
+                },
+                path: sub_m.get_one("path").map(|s: &String| s.to_string()),
+            })
+        }
+        Some("git-textconv") => {
+            let sub_m = sub_m("git-textconv")?;
+            Ok(Action::GitTextconv {
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                path: sub_m
+                    .get_one("path")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Path required"))?,
+            })
+        }
+        Some("grpc") => {
+            let sub_m = sub_m("grpc")?;
+            Ok(Action::Grpc {
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                socket: sub_m.get_one("socket").map(|s: &String| s.to_string()),
+            })
+        }
+        Some("import") => {
+            let sub_m = sub_m("import")?;
+            Ok(Action::Import {
+                force: sub_m.get_flag("force"),
+                format: sub_m
+                    .get_one("format")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Format required"))?,
+                output: sub_m
+                    .get_one("output")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Output required"))?,
+                path: sub_m
+                    .get_one("path")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Path required"))?,
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                single: sub_m.get_flag("single"),
+            })
+        }
+        Some("info") => {
+            let sub_m = sub_m("info")?;
+            Ok(Action::Info {
+                json: sub_m.get_flag("json"),
+                paths: sub_m
+                    .get_many::<String>("paths")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+            })
+        }
+        Some("merge") => {
+            let sub_m = sub_m("merge")?;
+            Ok(Action::Merge {
+                base: sub_m.get_one("base").map(|s: &String| s.to_string()),
+                install: sub_m.get_flag("install"),
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                ours: sub_m.get_one("ours").map(|s: &String| s.to_string()),
+                output: sub_m.get_one("output").map(|s: &String| s.to_string()),
+                theirs: sub_m.get_one("theirs").map(|s: &String| s.to_string()),
+            })
+        }
+        Some("mount") => {
+            let sub_m = sub_m("mount")?;
+            Ok(Action::Mount {
+                dir: sub_m
+                    .get_one("dir")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Directory required"))?,
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                mountpoint: sub_m
+                    .get_one("mountpoint")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Mountpoint required"))?,
+                ttl: Duration::from_secs(sub_m.get_one::<u64>("ttl").copied().unwrap_or(60)),
+            })
+        }
+        Some("scan") => {
+            let sub_m = sub_m("scan")?;
+            Ok(Action::Scan {
+                paths: sub_m
+                    .get_many::<String>("paths")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                patterns: sub_m
+                    .get_many::<String>("pattern")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                staged: sub_m.get_flag("staged"),
+            })
+        }
+        Some("server") => {
+            let sub_m = sub_m("server")?;
+            Ok(Action::Server {
+                acl: sub_m.get_one("acl").map(|s: &String| s.to_string()),
+                listen: sub_m.get_one("listen").map_or_else(
+                    || String::from("127.0.0.1:8080"),
+                    |s: &String| s.to_string(),
+                ),
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                token_file: sub_m.get_one("token-file").map(|s: &String| s.to_string()),
+                vaults: sub_m.get_one("vaults").map(|s: &String| s.to_string()),
+            })
+        }
+        Some("share") => {
+            let sub_m = sub_m("share")?;
+            Ok(Action::Share {
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                output: sub_m.get_one("output").map(|s: &String| s.to_string()),
+                recipient: sub_m.get_one("recipient").map(|s: &String| s.to_string()),
+                ttl: sub_m.get_one::<Duration>("ttl").copied(),
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("values") => {
+            let sub_m = sub_m("values")?;
+            Ok(Action::Values {
+                decrypt: sub_m.get_one::<String>("mode").map(String::as_str) == Some("decrypt"),
+                file: sub_m.get_one("file").map(|s: &String| s.to_string()),
+                format: sub_m.get_one("format").map(|s: &String| s.to_string()),
+                in_place: sub_m.get_flag("in-place"),
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                select: sub_m
+                    .get_many::<String>("select")
+                    .map(|select| select.cloned().collect())
+                    .unwrap_or_default(),
+            })
+        }
+        Some("agent") => {
+            let sub_m = sub_m("agent")?;
+            Ok(Action::Agent {
+                identities: sub_m
+                    .get_many::<String>("identity")
+                    .map(|identities| identities.cloned().collect())
+                    .unwrap_or_default(),
+                lifetime: Duration::from_secs(
+                    sub_m.get_one::<u64>("lifetime").copied().unwrap_or(15) * 60,
+                ),
+                metrics: sub_m.get_one("metrics").map(|s: &String| s.to_string()),
+                socket: sub_m.get_one("socket").map(|s: &String| s.to_string()),
+                stop: sub_m.get_flag("stop"),
+            })
+        }
+        Some("audit-recipients") => {
+            let sub_m = sub_m("audit-recipients")?;
+            Ok(Action::AuditRecipients {
+                exclude: sub_m
+                    .get_many::<String>("exclude")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                include: sub_m
+                    .get_many::<String>("include")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                json: sub_m.get_flag("json"),
+                paths: sub_m
+                    .get_many::<String>("paths")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+            })
+        }
+        Some("check") => {
+            let sub_m = sub_m("check")?;
+            Ok(Action::Check {
+                exclude: sub_m
+                    .get_many::<String>("exclude")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                include: sub_m
+                    .get_many::<String>("include")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                keys: sub_m
+                    .get_many::<String>("key")
+                    .map(|keys| keys.cloned().collect())
+                    .unwrap_or_default(),
+                paths: sub_m
+                    .get_many::<String>("paths")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+            })
+        }
+        Some("repair") => {
+            let sub_m = sub_m("repair")?;
+            Ok(Action::Repair {
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                output: sub_m.get_one("output").map(|s: &String| s.to_string()),
+                passphrase: passphrase(sub_m)?,
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("encrypt") => {
+            let sub_m = sub_m("encrypt")?;
+            Ok(Action::Encrypt {
+                exclude: sub_m
+                    .get_many::<String>("exclude")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                file: sub_m
+                    .get_one("file")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("File path required"))?,
+                file_mode: file_mode(sub_m),
+                include: sub_m
+                    .get_many::<String>("include")
+                    .map(|patterns| patterns.cloned().collect())
+                    .unwrap_or_default(),
+                jobs: sub_m.get_one::<usize>("jobs").copied(),
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                quiet: sub_m.get_flag("quiet"),
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                recursive: sub_m.get_flag("recursive"),
+                remove: sub_m.get_flag("rm"),
+            })
+        }
+        Some("decrypt") => {
+            let sub_m = sub_m("decrypt")?;
+            Ok(Action::Decrypt {
+                file_mode: file_mode(sub_m),
+                force: sub_m.get_flag("force"),
+                key: key(sub_m)?,
+                passphrase: passphrase(sub_m)?,
+                quiet: sub_m.get_flag("quiet"),
+                restore_owner: sub_m.get_flag("restore-owner"),
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("relabel") => {
+            let sub_m = sub_m("relabel")?;
+            Ok(Action::Relabel {
+                key: key(sub_m)?,
+                label: sub_m.get_one("label").map(|s: &String| s.to_string()),
+                passphrase: passphrase(sub_m)?,
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("keyserver") => {
+            let sub_m = sub_m("keyserver")?;
+            Ok(Action::Keyserver {
+                from: sub_m.get_one("from").map(|s: &String| s.to_string()),
+                ldap: sub_m.get_one("ldap").map(|s: &String| s.to_string()),
+                ldap_base: sub_m.get_one("ldap-base").map(|s: &String| s.to_string()),
+                ldap_filter: sub_m
+                    .get_one("ldap-filter")
+                    .map_or_else(|| String::from("(uid={user})"), |s: &String| s.to_string()),
+                listen: sub_m.get_one("listen").map_or_else(
+                    || String::from("127.0.0.1:8080"),
+                    |s: &String| s.to_string(),
+                ),
+                max_age: sub_m.get_one::<u64>("max-age").copied().unwrap_or(300),
+            })
+        }
+        Some("index") => {
+            let sub_m = sub_m("index")?;
+            Ok(Action::Index {
+                dir: sub_m
+                    .get_one("dir")
+                    .map_or_else(|| String::from("."), |s: &String| s.to_string()),
+            })
+        }
+        Some("run") => {
+            let sub_m = sub_m("run")?;
+            Ok(Action::Run {
+                command: sub_m
+                    .get_many::<String>("command")
+                    .map(|command| command.cloned().collect())
+                    .unwrap_or_default(),
+                diff_env: sub_m.get_flag("diff-env"),
+                key: sub_m.get_one("key").map(|s: &String| s.to_string()),
+                ssh: sub_m.get_one("ssh").map(|s: &String| s.to_string()),
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("pack") => {
+            let sub_m = sub_m("pack")?;
+            Ok(Action::Pack {
+                compress: sub_m.get_flag("compress"),
+                dir: sub_m
+                    .get_one("dir")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Directory required"))?,
+                file_mode: file_mode(sub_m),
                 key: sub_m.get_one("key").map(|s: &String| s.to_string()),
-                passphrase: sub_m
-                    .get_one("passphrase")
-                    .map(|s: &String| Secret::new(s.to_string())),
+                recipients: sub_m
+                    .get_many::<String>("recipient")
+                    .map(|recipients| recipients.cloned().collect())
+                    .unwrap_or_default(),
+                vault: sub_m.get_one("vault").map(|s: &String| s.to_string()),
+            })
+        }
+        Some("unpack") => {
+            let sub_m = sub_m("unpack")?;
+            Ok(Action::Unpack {
+                dir: sub_m.get_one("dir").map(|s: &String| s.to_string()),
+                key: key(sub_m)?,
+                passphrase: passphrase(sub_m)?,
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("history") => {
+            let sub_m = sub_m("history")?;
+            Ok(Action::History {
                 vault: sub_m
                     .get_one("vault")
                     .map(|s: &String| s.to_string())
                     .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
             })
         }
+        Some("undo") => {
+            let sub_m = sub_m("undo")?;
+            Ok(Action::Undo {
+                key: key(sub_m)?,
+                passphrase: passphrase(sub_m)?,
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+                yes: sub_m.get_flag("yes"),
+            })
+        }
+        Some("compare") => {
+            let sub_m = sub_m("compare")?;
+            Ok(Action::Compare {
+                diff: sub_m.get_flag("diff"),
+                file: sub_m
+                    .get_one("file")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("File path required"))?,
+                key: key(sub_m)?,
+                passphrase: passphrase(sub_m)?,
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        Some("update") => {
+            let sub_m = sub_m("update")?;
+            Ok(Action::Update {
+                check: sub_m.get_flag("check"),
+                version: sub_m.get_one("version").map(|s: &String| s.to_string()),
+            })
+        }
+        Some("watch") => {
+            let sub_m = sub_m("watch")?;
+            Ok(Action::Watch {
+                debounce: sub_m
+                    .get_one::<Duration>("debounce")
+                    .copied()
+                    .unwrap_or_default(),
+                file: sub_m
+                    .get_one("file")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("File path required"))?,
+                key: key(sub_m)?,
+                passphrase: passphrase(sub_m)?,
+                vault: sub_m
+                    .get_one("vault")
+                    .map(|s: &String| s.to_string())
+                    .ok_or_else(|| anyhow::anyhow!("Vault path required"))?,
+            })
+        }
+        // any other command is a plugin, ssh-vault-<name> in the PATH
+        Some(name) => Ok(Action::Plugin {
+            args: matches
+                .subcommand()
+                .and_then(|(_, sub_m)| sub_m.get_many::<OsString>(""))
+                .map(|args| args.cloned().collect())
+                .unwrap_or_default(),
+            log_json: matches.get_flag("log-json"),
+            log_level: matches.get_one("log-level").map(|s: &String| s.to_string()),
+            name: name.to_string(),
+            profile: matches.get_one("profile").map(|s: &String| s.to_string()),
+            socks5: matches.get_one("socks5").map(|s: &String| s.to_string()),
+        }),
         _ => Ok(Action::Help),
     }
 }
 
+fn file_mode(sub_m: &clap::ArgMatches) -> u32 {
+    sub_m
+        .get_one::<u32>("file-mode")
+        .copied()
+        .unwrap_or(dio::FILE_MODE)
+}
+
+// the private key of -k or the key in ~/.ssh with the fingerprint of --identity-fp
+fn key(sub_m: &clap::ArgMatches) -> Result<Option<String>> {
+    match sub_m.get_one::<String>("identity-fp") {
+        Some(fingerprint) => Ok(Some(find::identity_with_fingerprint(fingerprint)?)),
+        None => Ok(sub_m.get_one("key").map(|s: &String| s.to_string())),
+    }
+}
+
+// Get the passphrase from --passphrase, --passphrase-fd or --passphrase-file
+fn passphrase(sub_m: &clap::ArgMatches) -> Result<Option<Secret<String>>> {
+    if let Some(passphrase) = sub_m.get_one::<String>("passphrase") {
+        Ok(Some(Secret::new(passphrase.to_string())))
+    } else if let Some(fd) = sub_m.get_one::<i32>("passphrase-fd") {
+        Ok(Some(prompt::from_fd(*fd)?))
+    } else if let Some(path) = sub_m.get_one::<String>("passphrase-file") {
+        Ok(Some(prompt::from_file(path)?))
+    } else {
+        Ok(None)
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
     use crate::cli::{
         actions::Action,
-        commands::{create, edit, fingerprint, view},
+        commands::{
+            self, agent, audit_recipients, check, compare, create, decrypt, direnv, edit, encrypt,
+            export, fingerprint, git_filter, git_textconv, grpc, history, import, index, info,
+            keyserver, merge, mount, pack, relabel, repair, run, scan, server, share, undo, unpack,
+            update, values, view, watch,
+        },
     };
     use clap::Command;
     use secrecy::ExposeSecret;
@@ -149,17 +663,33 @@ mod tests {
         let action = dispatch(&matches).unwrap();
         match action {
             Action::Create {
+                dual_control,
+                expires,
+                file_mode,
                 fingerprint,
                 input,
                 json,
                 key,
+                label,
+                preserve,
+                quiet,
+                recipients,
+                strict,
                 user,
                 vault,
             } => {
+                assert!(!dual_control);
+                assert_eq!(expires, None);
+                assert_eq!(file_mode, 0o600);
+                assert!(recipients.is_empty());
                 assert_eq!(fingerprint, None);
                 assert_eq!(input, None);
                 assert_eq!(json, false);
                 assert_eq!(key, None);
+                assert_eq!(label, None);
+                assert_eq!(preserve, vec!["mode"]);
+                assert!(!quiet);
+                assert!(!strict);
                 assert_eq!(user, None);
                 assert_eq!(vault, None);
             }
@@ -167,6 +697,399 @@ mod tests {
         }
     }
 
+    #[test]
+    fn test_dispatch_info() {
+        let cmd = Command::new("test").subcommand(info::subcommand_info());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "info", "--json", "a.vault", "secrets"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Info { json, paths } => {
+                assert!(json);
+                assert_eq!(paths, vec!["a.vault", "secrets"]);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_audit_recipients() {
+        let cmd = Command::new("test").subcommand(audit_recipients::subcommand_audit_recipients());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "audit-recipients"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::AuditRecipients {
+                exclude,
+                include,
+                json,
+                paths,
+            } => {
+                assert!(exclude.is_empty());
+                assert!(include.is_empty());
+                assert!(!json);
+                assert!(paths.is_empty());
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_check() {
+        let cmd = Command::new("test").subcommand(check::subcommand_check());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "check",
+                "-k",
+                "id_ed25519",
+                "--exclude",
+                "archive/**",
+                "secrets",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Check {
+                exclude,
+                include,
+                keys,
+                paths,
+            } => {
+                assert_eq!(exclude, vec!["archive/**"]);
+                assert!(include.is_empty());
+                assert_eq!(keys, vec!["id_ed25519"]);
+                assert_eq!(paths, vec!["secrets"]);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_git_filter() {
+        let cmd = Command::new("test").subcommand(git_filter::subcommand_git_filter());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "git-filter", "smudge", "db.env"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::GitFilter { key, mode, path } => {
+                assert_eq!(key, None);
+                assert_eq!(mode, FilterMode::Smudge);
+                assert_eq!(path, Some("db.env".to_string()));
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_git_textconv() {
+        let cmd = Command::new("test").subcommand(git_textconv::subcommand_git_textconv());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "git-textconv", "-k", "id", "a.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::GitTextconv { key, path } => {
+                assert_eq!(key, Some("id".to_string()));
+                assert_eq!(path, "a.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_scan() {
+        let cmd = Command::new("test").subcommand(scan::subcommand_scan());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "scan", "--staged", "-p", "*.env"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Scan {
+                paths,
+                patterns,
+                staged,
+            } => {
+                assert!(paths.is_empty());
+                assert_eq!(patterns, vec!["*.env"]);
+                assert!(staged);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_direnv() {
+        let cmd = Command::new("test").subcommand(direnv::subcommand_direnv());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "direnv", "secret.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Direnv { key, vault, watch } => {
+                assert_eq!(key, None);
+                assert_eq!(vault, "secret.vault");
+                assert!(!watch);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_server() {
+        let cmd = Command::new("test").subcommand(server::subcommand_server());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "server", "-t", "token", "--vaults", "secrets"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Server {
+                acl,
+                listen,
+                recipients,
+                token_file,
+                vaults,
+            } => {
+                assert_eq!(acl, None);
+                assert_eq!(listen, "127.0.0.1:8080");
+                assert!(recipients.is_empty());
+                assert_eq!(token_file, Some("token".to_string()));
+                assert_eq!(vaults, Some("secrets".to_string()));
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_relabel() {
+        let cmd = Command::new("test").subcommand(relabel::subcommand_relabel());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "relabel", "--remove", "db.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Relabel {
+                key,
+                label,
+                passphrase,
+                vault,
+            } => {
+                assert_eq!(key, None);
+                assert_eq!(label, None);
+                assert!(passphrase.is_none());
+                assert_eq!(vault, "db.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_share() {
+        let cmd = Command::new("test").subcommand(share::subcommand_share());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "share", "-r", "bob.pub", "secret.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Share {
+                key,
+                output,
+                recipient,
+                ttl,
+                vault,
+            } => {
+                assert_eq!(key, None);
+                assert_eq!(output, None);
+                assert_eq!(recipient.as_deref(), Some("bob.pub"));
+                assert_eq!(ttl, None);
+                assert_eq!(vault, "secret.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_repair() {
+        let cmd = Command::new("test").subcommand(repair::subcommand_repair());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "repair", "-p", "secret", "damaged.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Repair {
+                key,
+                output,
+                passphrase,
+                vault,
+            } => {
+                assert_eq!(key, None);
+                assert_eq!(output, None);
+                assert_eq!("secret", passphrase.unwrap().expose_secret());
+                assert_eq!(vault, "damaged.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_values() {
+        let cmd = Command::new("test").subcommand(values::subcommand_values());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "values", "decrypt", "config.yml"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Values {
+                decrypt,
+                file,
+                format,
+                in_place,
+                key,
+                recipients,
+                select,
+            } => {
+                assert!(decrypt);
+                assert_eq!(file, Some("config.yml".to_string()));
+                assert_eq!(format, None);
+                assert!(!in_place);
+                assert_eq!(key, None);
+                assert!(recipients.is_empty());
+                assert!(select.is_empty());
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_import() {
+        let cmd = Command::new("test").subcommand(import::subcommand_import());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "import", "pass", "store", "-o", "secrets"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Import {
+                force,
+                format,
+                output,
+                path,
+                recipients,
+                single,
+            } => {
+                assert!(!force);
+                assert!(!single);
+                assert_eq!(format, "pass");
+                assert_eq!(output, "secrets");
+                assert_eq!(path, "store");
+                assert!(recipients.is_empty());
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_export() {
+        let cmd = Command::new("test").subcommand(export::subcommand_export());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "export", "pass", "secrets", "-o", "store"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Export {
+                cert,
+                force,
+                format,
+                key,
+                namespace,
+                output,
+                path,
+            } => {
+                assert_eq!(cert, None);
+                assert!(!force);
+                assert_eq!(format, "pass");
+                assert_eq!(key, None);
+                assert_eq!(namespace, None);
+                assert_eq!(output, "store");
+                assert_eq!(path, "secrets");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_grpc() {
+        let cmd = Command::new("test").subcommand(grpc::subcommand_grpc());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "grpc", "-k", "id", "-r", "team.keys"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Grpc {
+                key, recipients, ..
+            } => {
+                assert_eq!(key, Some("id".to_string()));
+                assert_eq!(recipients, vec!["team.keys"]);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_mount() {
+        let cmd = Command::new("test").subcommand(mount::subcommand_mount());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "mount",
+                "--ttl",
+                "5",
+                "secrets",
+                "/mnt/secrets",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Mount {
+                dir,
+                key,
+                mountpoint,
+                ttl,
+            } => {
+                assert_eq!(dir, "secrets");
+                assert_eq!(key, None);
+                assert_eq!(mountpoint, "/mnt/secrets");
+                assert_eq!(ttl, Duration::from_secs(5));
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_merge() {
+        let cmd = Command::new("test").subcommand(merge::subcommand_merge());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "merge", "base", "ours", "theirs", "out"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Merge {
+                base,
+                install,
+                ours,
+                output,
+                theirs,
+                ..
+            } => {
+                assert_eq!(base, Some("base".to_string()));
+                assert!(!install);
+                assert_eq!(ours, Some("ours".to_string()));
+                assert_eq!(output, Some("out".to_string()));
+                assert_eq!(theirs, Some("theirs".to_string()));
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_create_with_recipients() {
+        let cmd = Command::new("test").subcommand(create::subcommand_create());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "create", "-r", "team.keys", "-r", "ops.keys"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Create { recipients, .. } => {
+                assert_eq!(recipients, vec!["team.keys", "ops.keys"]);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
     #[test]
     fn test_dispatch_create_with_json() {
         let cmd = Command::new("test").subcommand(create::subcommand_create());
@@ -176,17 +1099,33 @@ mod tests {
         let action = dispatch(&matches).unwrap();
         match action {
             Action::Create {
+                dual_control,
+                expires,
+                file_mode,
                 fingerprint,
                 input,
                 json,
                 key,
+                label,
+                preserve,
+                quiet,
+                recipients,
+                strict,
                 user,
                 vault,
             } => {
+                assert!(!dual_control);
+                assert_eq!(expires, None);
+                assert_eq!(file_mode, 0o600);
+                assert!(recipients.is_empty());
                 assert_eq!(fingerprint, None);
                 assert_eq!(input, None);
                 assert_eq!(json, true);
                 assert_eq!(key, None);
+                assert_eq!(label, None);
+                assert_eq!(preserve, vec!["mode"]);
+                assert!(!quiet);
+                assert!(!strict);
                 assert_eq!(user, None);
                 assert_eq!(vault, None);
             }
@@ -204,18 +1143,50 @@ mod tests {
         let action = dispatch(&matches).unwrap();
         match action {
             Action::Edit {
+                force,
                 key,
                 passphrase,
+                timeout,
                 vault,
             } => {
+                assert!(!force);
                 assert_eq!(key, None);
                 assert_eq!("secret", passphrase.unwrap().expose_secret());
+                assert_eq!(timeout, None);
                 assert_eq!(vault, String::from("test_data/id_rsa"));
             }
             _ => panic!("Wrong action"),
         }
     }
 
+    #[test]
+    fn test_dispatch_edit_with_timeout() {
+        let cmd = Command::new("test").subcommand(edit::subcommand_edit());
+        let matches = cmd.try_get_matches_from(vec![
+            "test",
+            "edit",
+            "--timeout",
+            "5",
+            "--abort-on-timeout",
+            "test_data/id_rsa",
+        ]);
+        assert!(matches.is_ok());
+        let matches = matches.unwrap();
+        let action = dispatch(&matches).unwrap();
+        match action {
+            Action::Edit { timeout, .. } => {
+                assert_eq!(
+                    timeout,
+                    Some(EditorTimeout {
+                        duration: Duration::from_secs(300),
+                        abort: true,
+                    })
+                );
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
     #[test]
     fn test_dispatch_edit_no_vault() {
         let cmd = Command::new("test").subcommand(edit::subcommand_edit());
@@ -232,15 +1203,429 @@ mod tests {
         let action = dispatch(&matches).unwrap();
         match action {
             Action::View {
+                exec,
+                file_mode,
+                format,
                 key,
+                on,
                 vault,
                 output,
                 passphrase,
+                quiet,
+                raw,
+                redact,
+                restore_owner,
+                revision,
+                share,
+                strict,
             } => {
+                assert_eq!(exec, None);
+                assert_eq!(file_mode, 0o600);
+                assert_eq!(format, None);
                 assert_eq!(key, None);
+                assert_eq!(on, None);
                 assert_eq!(vault, None);
                 assert_eq!(output, None);
                 assert_eq!("secret", passphrase.unwrap().expose_secret());
+                assert!(!quiet);
+                assert!(!raw);
+                assert!(!redact);
+                assert!(!restore_owner);
+                assert_eq!(revision, None);
+                assert_eq!(share, None);
+                assert!(!strict);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_view_passphrase_file() {
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        std::io::Write::write_all(&mut file, b"secret\n").unwrap();
+
+        let cmd = Command::new("test").subcommand(view::subcommand_view());
+        let matches = cmd.try_get_matches_from(vec![
+            "test",
+            "view",
+            "--passphrase-file",
+            file.path().to_str().unwrap(),
+        ]);
+        assert!(matches.is_ok());
+        let matches = matches.unwrap();
+        let action = dispatch(&matches).unwrap();
+        match action {
+            Action::View { passphrase, .. } => {
+                assert_eq!("secret", passphrase.unwrap().expose_secret());
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_agent() {
+        let cmd = Command::new("test").subcommand(agent::subcommand_agent());
+        let matches = cmd.try_get_matches_from(vec![
+            "test",
+            "agent",
+            "--lifetime",
+            "5",
+            "--stop",
+            "-i",
+            "id_ed25519",
+            "--metrics",
+            "127.0.0.1:9101",
+        ]);
+        assert!(matches.is_ok());
+        let matches = matches.unwrap();
+        let action = dispatch(&matches).unwrap();
+        match action {
+            Action::Agent {
+                identities,
+                lifetime,
+                metrics,
+                stop,
+                ..
+            } => {
+                assert_eq!(identities, vec!["id_ed25519".to_string()]);
+                assert_eq!(lifetime, Duration::from_secs(300));
+                assert_eq!(metrics, Some("127.0.0.1:9101".to_string()));
+                assert!(stop);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_encrypt() {
+        let cmd = Command::new("test").subcommand(encrypt::subcommand_encrypt());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "encrypt",
+                "-r",
+                "team.keys",
+                "--rm",
+                "app.conf",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Encrypt {
+                exclude,
+                file,
+                file_mode,
+                include,
+                jobs,
+                key,
+                quiet,
+                recipients,
+                recursive,
+                remove,
+            } => {
+                assert!(exclude.is_empty());
+                assert_eq!(file, "app.conf");
+                assert_eq!(file_mode, 0o600);
+                assert!(include.is_empty());
+                assert_eq!(key, None);
+                assert!(!quiet);
+                assert_eq!(jobs, None);
+                assert_eq!(recipients, vec!["team.keys"]);
+                assert!(!recursive);
+                assert!(remove);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_decrypt() {
+        let cmd = Command::new("test").subcommand(decrypt::subcommand_decrypt());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "decrypt",
+                "-f",
+                "-k",
+                "id_ed25519",
+                "app.conf.vault",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Decrypt {
+                force,
+                key,
+                passphrase,
+                vault,
+                ..
+            } => {
+                assert!(force);
+                assert_eq!(key, Some("id_ed25519".to_string()));
+                assert!(passphrase.is_none());
+                assert_eq!(vault, "app.conf.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_keyserver() {
+        let cmd = Command::new("test").subcommand(keyserver::subcommand_keyserver());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "keyserver",
+                "--ldap",
+                "ldap://ldap.example.com",
+                "--ldap-base",
+                "dc=example,dc=com",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Keyserver {
+                from,
+                ldap,
+                ldap_base,
+                ldap_filter,
+                listen,
+                max_age,
+            } => {
+                assert!(from.is_none());
+                assert_eq!(ldap, Some("ldap://ldap.example.com".to_string()));
+                assert_eq!(ldap_base, Some("dc=example,dc=com".to_string()));
+                assert_eq!(ldap_filter, "(uid={user})");
+                assert_eq!(listen, "127.0.0.1:8080");
+                assert_eq!(max_age, 300);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_index() {
+        let cmd = Command::new("test").subcommand(index::subcommand_index());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "index", "secrets"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Index { dir } => assert_eq!(dir, "secrets"),
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_run() {
+        let cmd = Command::new("test").subcommand(run::subcommand_run());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "run", "db.env.vault", "env"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Run {
+                command,
+                diff_env,
+                key,
+                ssh,
+                vault,
+            } => {
+                assert_eq!(command, vec!["env"]);
+                assert!(!diff_env);
+                assert_eq!(key, None);
+                assert_eq!(ssh, None);
+                assert_eq!(vault, "db.env.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_pack() {
+        let cmd = Command::new("test").subcommand(pack::subcommand_pack());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "pack", "-r", "bob.pub", "./tls"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Pack {
+                compress,
+                dir,
+                file_mode,
+                key,
+                recipients,
+                vault,
+            } => {
+                assert!(!compress);
+                assert_eq!(dir, "./tls");
+                assert_eq!(file_mode, 0o600);
+                assert_eq!(key, None);
+                assert_eq!(recipients, vec!["bob.pub"]);
+                assert_eq!(vault, None);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_unpack() {
+        let cmd = Command::new("test").subcommand(unpack::subcommand_unpack());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "unpack", "-p", "secret", "tls.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Unpack {
+                dir,
+                key,
+                passphrase,
+                vault,
+            } => {
+                assert_eq!(dir, None);
+                assert_eq!(key, None);
+                assert_eq!(passphrase.unwrap().expose_secret(), "secret");
+                assert_eq!(vault, "tls.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_history() {
+        let cmd = Command::new("test").subcommand(history::subcommand_history());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "history", "db.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::History { vault } => assert_eq!(vault, "db.vault"),
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_undo() {
+        let cmd = Command::new("test").subcommand(undo::subcommand_undo());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "undo", "--yes", "db.vault"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Undo {
+                key,
+                passphrase,
+                vault,
+                yes,
+            } => {
+                assert_eq!(key, None);
+                assert!(passphrase.is_none());
+                assert_eq!(vault, "db.vault");
+                assert!(yes);
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_compare() {
+        let cmd = Command::new("test").subcommand(compare::subcommand_compare());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "compare",
+                "-k",
+                "id",
+                "app.env.vault",
+                "app.env",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Compare {
+                diff,
+                file,
+                key,
+                vault,
+                ..
+            } => {
+                assert!(!diff);
+                assert_eq!(file, "app.env");
+                assert_eq!(key, Some("id".to_string()));
+                assert_eq!(vault, "app.env.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_update() {
+        let cmd = Command::new("test").subcommand(update::subcommand_update());
+        let matches = cmd
+            .try_get_matches_from(vec!["test", "update", "--version", "1.0.13"])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Update { check, version } => {
+                assert!(!check);
+                assert_eq!(version, Some("1.0.13".to_string()));
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_watch() {
+        let cmd = Command::new("test").subcommand(watch::subcommand_watch());
+        let matches = cmd
+            .try_get_matches_from(vec![
+                "test",
+                "watch",
+                "-k",
+                "bob",
+                "--debounce",
+                "1s",
+                ".env",
+                "secrets.env.vault",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Watch {
+                debounce,
+                file,
+                key,
+                passphrase,
+                vault,
+            } => {
+                assert_eq!(debounce, Duration::from_secs(1));
+                assert_eq!(file, ".env");
+                assert_eq!(key, Some("bob".to_string()));
+                assert!(passphrase.is_none());
+                assert_eq!(vault, "secrets.env.vault");
+            }
+            _ => panic!("Wrong action"),
+        }
+    }
+
+    #[test]
+    fn test_dispatch_plugin() {
+        let matches = commands::new()
+            .try_get_matches_from(vec![
+                "ssh-vault",
+                "--profile",
+                "work",
+                "rotate",
+                "--all",
+                "db.vault",
+            ])
+            .unwrap();
+        match dispatch(&matches).unwrap() {
+            Action::Plugin {
+                args,
+                log_json,
+                log_level,
+                name,
+                profile,
+                socks5,
+            } => {
+                assert_eq!(
+                    args,
+                    vec![OsString::from("--all"), OsString::from("db.vault")]
+                );
+                assert!(!log_json);
+                assert_eq!(log_level, None);
+                assert_eq!(name, "rotate");
+                assert_eq!(profile, Some("work".to_string()));
+                assert_eq!(socks5, None);
             }
             _ => panic!("Wrong action"),
         }
@@ -0,0 +1,191 @@
+// The syntax of ssh-vault 0.x put the options before the command:
+//
+//   ssh-vault -k ~/.ssh/id_ed25519 -u alice create secret.vault
+//
+// the options of the command are moved after it, the global ones (--profile,
+// --log-level, ...) stay where they are, and clap reports anything it doesn't
+// know as usual:
+//
+//   ssh-vault create -k ~/.ssh/id_ed25519 -u alice secret.vault
+
+use clap::{Arg, Command};
+use std::ffi::OsString;
+
+/// The arguments with the options given before the command moved after it
+#[must_use]
+pub fn rewrite(cmd: &Command, args: Vec<OsString>) -> Vec<OsString> {
+    let mut cmd = cmd.clone();
+    cmd.build();
+
+    // the first command that everything before it is an option of
+    for (i, name) in args.iter().enumerate().skip(1) {
+        if name == "--" {
+            break;
+        }
+
+        let Some(subcommand) = cmd.find_subcommand(name) else {
+            continue;
+        };
+
+        let Some((global, moved)) = split(&cmd, subcommand, &args[1..i]) else {
+            continue;
+        };
+
+        if moved.is_empty() {
+            break;
+        }
+
+        let mut rewritten = vec![args[0].clone()];
+        rewritten.extend(global);
+        rewritten.push(name.clone());
+        rewritten.extend(moved);
+        rewritten.extend_from_slice(&args[i + 1..]);
+        return rewritten;
+    }
+
+    args
+}
+
+// The global options and the ones of the command, None if something else
+fn split(
+    cmd: &Command,
+    subcommand: &Command,
+    options: &[OsString],
+) -> Option<(Vec<OsString>, Vec<OsString>)> {
+    let mut global = Vec::new();
+    let mut moved = Vec::new();
+
+    let mut options = options.iter();
+
+    while let Some(option) = options.next() {
+        let text = option
+            .to_str()
+            .filter(|o| o.starts_with('-') && *o != "-" && *o != "--")?;
+
+        let (to, arg) = match find(cmd, text) {
+            Some(arg) => (&mut global, arg),
+            None => (&mut moved, find(subcommand, text)?),
+        };
+
+        to.push(option.clone());
+
+        if needs_value(arg, text) {
+            to.push(options.next()?.clone());
+        }
+    }
+
+    Some((global, moved))
+}
+
+// The argument of the option, -k, -kKEY, --key or --key=KEY
+fn find<'a>(cmd: &'a Command, option: &str) -> Option<&'a Arg> {
+    if let Some(long) = option.strip_prefix("--") {
+        let long = long.split_once('=').map_or(long, |(long, _)| long);
+        return cmd.get_arguments().find(|arg| {
+            arg.get_long() == Some(long)
+                || arg
+                    .get_all_aliases()
+                    .is_some_and(|aliases| aliases.contains(&long))
+        });
+    }
+
+    let short = option.chars().nth(1)?;
+    cmd.get_arguments()
+        .find(|arg| arg.get_short() == Some(short))
+}
+
+// The value is the next argument, not in the option
+fn needs_value(arg: &Arg, option: &str) -> bool {
+    let inline = if option.starts_with("--") {
+        option.contains('=')
+    } else {
+        option.len() > 2
+    };
+
+    arg.get_action().takes_values() && !inline
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::cli::commands;
+
+    fn rewritten(args: &[&str]) -> Vec<String> {
+        rewrite(&commands::new(), args.iter().map(OsString::from).collect())
+            .iter()
+            .map(|arg| arg.to_string_lossy().to_string())
+            .collect()
+    }
+
+    #[test]
+    fn test_rewrite() {
+        assert_eq!(
+            rewritten(&[
+                "ssh-vault",
+                "-k",
+                "id_ed25519",
+                "-u",
+                "alice",
+                "create",
+                "s.vault"
+            ]),
+            [
+                "ssh-vault",
+                "create",
+                "-k",
+                "id_ed25519",
+                "-u",
+                "alice",
+                "s.vault"
+            ]
+        );
+
+        // the global options stay before the command
+        assert_eq!(
+            rewritten(&[
+                "ssh-vault",
+                "--profile",
+                "work",
+                "--key=id",
+                "view",
+                "s.vault"
+            ]),
+            [
+                "ssh-vault",
+                "--profile",
+                "work",
+                "view",
+                "--key=id",
+                "s.vault"
+            ]
+        );
+
+        // aliases, flags and values in the option
+        assert_eq!(
+            rewritten(&["ssh-vault", "--json", "i", "s.vault"]),
+            ["ssh-vault", "i", "--json", "s.vault"]
+        );
+        assert_eq!(
+            rewritten(&["ssh-vault", "-kid", "v", "s.vault"]),
+            ["ssh-vault", "v", "-kid", "s.vault"]
+        );
+
+        // a value named like a command
+        assert_eq!(
+            rewritten(&["ssh-vault", "-k", "view", "view", "s.vault"]),
+            ["ssh-vault", "view", "-k", "view", "s.vault"]
+        );
+
+        // nothing to move
+        for args in [
+            vec!["ssh-vault", "view", "-k", "id", "s.vault"],
+            vec!["ssh-vault", "--log-level", "debug", "view", "s.vault"],
+            vec!["ssh-vault", "-V"],
+            vec!["ssh-vault", "-k", "id"],
+            vec!["ssh-vault", "--nope", "view", "s.vault"],
+            vec!["ssh-vault", "-k", "id", "rotate", "--all"],
+        ] {
+            assert_eq!(rewritten(&args), args);
+        }
+    }
+}
@@ -5,3 +5,4 @@ pub use self::start::start;
 
 mod commands;
 mod dispatcher;
+mod legacy;
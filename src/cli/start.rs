@@ -1,10 +1,39 @@
-use crate::cli::{actions::Action, commands, dispatcher};
+use crate::cli::{actions::Action, commands, dispatcher, legacy};
+use crate::{config, logging, vault::remote};
 use anyhow::Result;
+use slog::debug;
+use std::env;
 
 /// Start the CLI
 pub fn start() -> Result<Action> {
     let cmd = commands::new();
-    let matches = cmd.get_matches();
+
+    // the options may come before the command, like in ssh-vault 0.x
+    let args = legacy::rewrite(&cmd, env::args_os().collect());
+    let matches = cmd.get_matches_from(args);
+
+    // --log-json alone logs at the info level
+    let json = matches.get_flag("log-json");
+    let level = matches
+        .get_one::<String>("log-level")
+        .map(String::as_str)
+        .or_else(|| json.then_some("info"));
+
+    if let Some(level) = level {
+        logging::init(level, json)?;
+    }
+
+    // the settings of the profile apply to everything after
+    if let Some(profile) = matches.get_one::<String>("profile") {
+        config::set_profile(profile)?;
+        debug!(logging::logger(), "using the profile"; "profile" => profile);
+    }
+
+    // every key is fetched through the proxy
+    if let Some(proxy) = matches.get_one::<String>("socks5") {
+        remote::set_socks5(proxy)?;
+    }
+
     let action = dispatcher::dispatch(&matches)?;
     Ok(action)
 }
@@ -1,10 +1,106 @@
+// Settings of ~/.config/ssh-vault/config.yml and the SSH_VAULT_* variables,
+// named profiles override them:
+//
+//   profile: work
+//   profiles:
+//     work:
+//       key: ~/.ssh/id_work
+//       github_host: github.example.com
+//       recipients: [~/team.keys]
+//     personal:
+//       key: ~/.ssh/id_ed25519
+//
+// the profile is selected with --profile, SSH_VAULT_PROFILE or `profile`, and
+// has its own cache of fetched keys
+
 use crate::tools;
-use anyhow::Result;
+use anyhow::{anyhow, Result};
 use config::Config;
+use std::{path::PathBuf, sync::OnceLock};
+
+// profile selected by the application, e.g. with --profile
+static PROFILE: OnceLock<String> = OnceLock::new();
 
+/// Use the settings of the named profile
+/// # Errors
+/// Will return an error if the profile was already set
+pub fn set_profile(name: &str) -> Result<()> {
+    PROFILE
+        .set(name.to_string())
+        .map_err(|_| anyhow!("The profile was already set"))
+}
+
+/// The settings of the selected profile over the ones of the config
+/// # Errors
+/// Will return an error if the home directory can't be found or the selected
+/// profile is not in the config
 pub fn get() -> Result<Config> {
-    let home = tools::get_home()?;
-    let config_file = home.join(".config").join("ssh-vault").join("config.yml");
+    let config = base()?;
+    let name = selected(&config)?;
+
+    with_profile(config, name.as_deref())
+}
+
+// the settings of the profile override the ones of the config
+fn with_profile(config: Config, name: Option<&str>) -> Result<Config> {
+    let Some(name) = name else {
+        return Ok(config);
+    };
+
+    let settings = config
+        .get_table(&format!("profiles.{name}"))
+        .map_err(|_| anyhow!("Profile {name} not found in the config"))?;
+
+    let mut builder = Config::builder().add_source(config);
+
+    for (key, value) in settings {
+        builder = builder.set_override(key, value)?;
+    }
+
+    Ok(builder.build()?)
+}
+
+/// The name of the selected profile, if any
+/// # Errors
+/// Will return an error if the home directory can't be found or the name is
+/// not valid
+pub fn profile() -> Result<Option<String>> {
+    selected(&base()?)
+}
+
+// the name is also a directory of the cache, nothing that escapes it
+fn selected(config: &Config) -> Result<Option<String>> {
+    let name = PROFILE.get().cloned().or_else(|| {
+        config
+            .get_string("profile")
+            .ok()
+            .filter(|name| !name.is_empty())
+    });
+
+    match name {
+        Some(name)
+            if !name
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_')) =>
+        {
+            Err(anyhow!("Invalid profile name: {name}"))
+        }
+        name => Ok(name),
+    }
+}
+
+/// The path of the config file, ~/.config/ssh-vault/config.yml
+/// # Errors
+/// Will return an error if the home directory can't be found
+pub fn path() -> Result<PathBuf> {
+    Ok(tools::get_home()?
+        .join(".config")
+        .join("ssh-vault")
+        .join("config.yml"))
+}
+
+fn base() -> Result<Config> {
+    let config_file = path()?;
 
     let builder = Config::builder()
         .add_source(config::Environment::with_prefix("SSH_VAULT"))
@@ -29,4 +125,49 @@ mod tests {
             assert_eq!(config.get_string("sshkeys_online").unwrap(), "localhost");
         });
     }
+
+    fn config() -> Config {
+        Config::builder()
+            .set_override("github_host", "github.com")
+            .unwrap()
+            .set_override("profiles.work.github_host", "github.example.com")
+            .unwrap()
+            .set_override("profiles.work.key", "~/.ssh/id_work")
+            .unwrap()
+            .build()
+            .unwrap()
+    }
+
+    #[test]
+    fn test_with_profile() {
+        let work = with_profile(config(), Some("work")).unwrap();
+        assert_eq!(
+            work.get_string("github_host").unwrap(),
+            "github.example.com"
+        );
+        assert_eq!(work.get_string("key").unwrap(), "~/.ssh/id_work");
+
+        let default = with_profile(config(), None).unwrap();
+        assert_eq!(default.get_string("github_host").unwrap(), "github.com");
+        assert!(default.get_string("key").is_err());
+
+        assert!(with_profile(config(), Some("prod")).is_err());
+    }
+
+    #[test]
+    fn test_selected() {
+        assert_eq!(selected(&config()).unwrap(), None);
+
+        let config = |name: &str| {
+            Config::builder()
+                .set_override("profile", name)
+                .unwrap()
+                .build()
+                .unwrap()
+        };
+
+        assert_eq!(selected(&config("work")).unwrap().as_deref(), Some("work"));
+        assert_eq!(selected(&config("")).unwrap(), None);
+        assert!(selected(&config("../work")).is_err());
+    }
 }
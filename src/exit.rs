@@ -0,0 +1,107 @@
+// Exit codes by kind of failure, so scripts can react differently to each:
+//
+//  1 any other failure
+//  2 usage error, also used by clap for invalid options
+//  3 vault or key file not found
+//  4 wrong key or passphrase
+//  5 corrupt vault
+//  6 network failure
+//  7 editor aborted
+
+use std::{fmt, io};
+
+/// Any failure without a more specific code
+pub const FAILURE: i32 = 1;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Failure {
+    Usage,
+    NotFound,
+    WrongKey,
+    Corrupt,
+    Network,
+    EditorAborted,
+}
+
+impl Failure {
+    #[must_use]
+    pub const fn code(self) -> i32 {
+        match self {
+            Self::Usage => 2,
+            Self::NotFound => 3,
+            Self::WrongKey => 4,
+            Self::Corrupt => 5,
+            Self::Network => 6,
+            Self::EditorAborted => 7,
+        }
+    }
+
+    /// Error with the message, `code` finds its kind again
+    pub fn error(self, message: impl fmt::Display) -> anyhow::Error {
+        anyhow::Error::new(Error {
+            failure: self,
+            message: message.to_string(),
+        })
+    }
+}
+
+#[derive(Debug)]
+struct Error {
+    failure: Failure,
+    message: String,
+}
+
+impl fmt::Display for Error {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl std::error::Error for Error {}
+
+/// Exit code of the error, the first cause with a known kind decides it
+#[must_use]
+pub fn code(error: &anyhow::Error) -> i32 {
+    for cause in error.chain() {
+        if let Some(e) = cause.downcast_ref::<Error>() {
+            return e.failure.code();
+        }
+
+        if let Some(e) = cause.downcast_ref::<io::Error>() {
+            if e.kind() == io::ErrorKind::NotFound {
+                return Failure::NotFound.code();
+            }
+        }
+
+        if cause.downcast_ref::<reqwest::Error>().is_some() {
+            return Failure::Network.code();
+        }
+
+        if cause.downcast_ref::<clap::Error>().is_some() {
+            return Failure::Usage.code();
+        }
+    }
+
+    FAILURE
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_code() {
+        assert_eq!(code(&Failure::WrongKey.error("wrong key")), 4);
+        assert_eq!(code(&Failure::Corrupt.error("corrupt")), 5);
+        assert_eq!(code(&Failure::EditorAborted.error("aborted")), 7);
+        assert_eq!(Failure::Corrupt.error("corrupt").to_string(), "corrupt");
+
+        let not_found = io::Error::new(io::ErrorKind::NotFound, "secret.vault");
+        assert_eq!(code(&anyhow::Error::new(not_found)), 3);
+
+        let denied = io::Error::new(io::ErrorKind::PermissionDenied, "secret.vault");
+        assert_eq!(code(&anyhow::Error::new(denied)), FAILURE);
+
+        assert_eq!(code(&anyhow::anyhow!("other")), FAILURE);
+    }
+}
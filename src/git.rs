@@ -0,0 +1,128 @@
+use anyhow::{anyhow, Result};
+use std::{
+    path::Path,
+    process::{Command, Stdio},
+};
+
+/// Get the content of a file as staged in the git index, `None` if the file is
+/// not staged or this is not a git repository
+pub fn staged_blob(path: &str) -> Option<Vec<u8>> {
+    let output = Command::new("git")
+        .args(["cat-file", "blob", &format!(":{path}")])
+        .stdin(Stdio::null())
+        .stderr(Stdio::null())
+        .output()
+        .ok()?;
+
+    output.status.success().then_some(output.stdout)
+}
+
+/// List the files added, copied, modified or renamed in the git index
+/// # Errors
+/// Will return an error if git fails, e.g. this is not a git repository
+pub fn staged_files() -> Result<Vec<String>> {
+    let output = Command::new("git")
+        .args([
+            "diff",
+            "--cached",
+            "--name-only",
+            "--diff-filter=ACMR",
+            "-z",
+        ])
+        .stdin(Stdio::null())
+        .output()?;
+
+    if !output.status.success() {
+        return Err(anyhow!(
+            "git diff failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+
+    Ok(output
+        .stdout
+        .split(|&byte| byte == 0)
+        .filter(|name| !name.is_empty())
+        .map(|name| String::from_utf8_lossy(name).to_string())
+        .collect())
+}
+
+/// Three-way merge of text files with `git merge-file`, returns the merged
+/// content, with conflict markers, and the number of conflicts
+/// # Errors
+/// Will return an error if git fails
+pub fn merge_file(ours: &Path, base: &Path, theirs: &Path) -> Result<(Vec<u8>, u8)> {
+    let output = Command::new("git")
+        .args([
+            "merge-file",
+            "-p",
+            "-L",
+            "ours",
+            "-L",
+            "base",
+            "-L",
+            "theirs",
+        ])
+        .args([ours, base, theirs])
+        .stdin(Stdio::null())
+        .output()?;
+
+    // the status is the number of conflicts, negative on errors
+    match output.status.code() {
+        Some(conflicts @ 0..=127) => Ok((output.stdout, u8::try_from(conflicts)?)),
+        _ => Err(anyhow!(
+            "git merge-file failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        )),
+    }
+}
+
+/// Set a git config value in the current repository
+/// # Errors
+/// Will return an error if git fails, e.g. this is not a git repository
+pub fn config(name: &str, value: &str) -> Result<()> {
+    let status = Command::new("git")
+        .args(["config", name, value])
+        .stdin(Stdio::null())
+        .status()?;
+
+    if status.success() {
+        Ok(())
+    } else {
+        Err(anyhow!("git config {name} failed"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_merge_file() {
+        let dir = tempfile::tempdir().unwrap();
+        let (ours, base, theirs) = (
+            dir.path().join("ours"),
+            dir.path().join("base"),
+            dir.path().join("theirs"),
+        );
+
+        std::fs::write(&base, "a\nb\nc\n").unwrap();
+        std::fs::write(&ours, "A\nb\nc\n").unwrap();
+        std::fs::write(&theirs, "a\nb\nC\n").unwrap();
+
+        let (merged, conflicts) = merge_file(&ours, &base, &theirs).unwrap();
+        assert_eq!(merged, b"A\nb\nC\n");
+        assert_eq!(conflicts, 0);
+
+        std::fs::write(&theirs, "a2\nb\nc\n").unwrap();
+
+        let (merged, conflicts) = merge_file(&ours, &base, &theirs).unwrap();
+        assert!(String::from_utf8(merged).unwrap().contains("<<<<<<< ours"));
+        assert_eq!(conflicts, 1);
+    }
+
+    #[test]
+    fn test_staged_blob_missing() {
+        assert!(staged_blob("test_data/does-not-exist.vault").is_none());
+    }
+}
@@ -0,0 +1,93 @@
+// Best-effort protections to keep secrets out of core dumps, debuggers and swap
+
+/// Disable core dumps and prevent other processes from attaching to this one.
+/// Failures are ignored since not every platform or sandbox allows them
+pub fn process() {
+    #[cfg(unix)]
+    disable_core_dumps();
+
+    #[cfg(target_os = "linux")]
+    // SAFETY: prctl with PR_SET_DUMPABLE only changes a flag of the current process
+    unsafe {
+        libc::prctl(libc::PR_SET_DUMPABLE, 0, 0, 0, 0);
+    }
+
+    #[cfg(target_os = "macos")]
+    // SAFETY: PT_DENY_ATTACH ignores the pid, addr and data arguments
+    unsafe {
+        libc::ptrace(libc::PT_DENY_ATTACH, 0, std::ptr::null_mut(), 0);
+    }
+}
+
+#[cfg(unix)]
+fn disable_core_dumps() -> bool {
+    let limit = libc::rlimit {
+        rlim_cur: 0,
+        rlim_max: 0,
+    };
+
+    // SAFETY: the pointer is valid for the duration of the call
+    unsafe { libc::setrlimit(libc::RLIMIT_CORE, &limit) == 0 }
+}
+
+/// Keep the memory of a secret from being swapped to disk, returns false if it
+/// couldn't be locked (e.g. `RLIMIT_MEMLOCK` reached)
+#[must_use]
+pub fn mlock(data: &[u8]) -> bool {
+    if data.is_empty() {
+        return false;
+    }
+
+    #[cfg(unix)]
+    // SAFETY: the range belongs to a live allocation
+    unsafe {
+        libc::mlock(data.as_ptr().cast(), data.len()) == 0
+    }
+
+    #[cfg(not(unix))]
+    false
+}
+
+/// Unlock the memory of a secret once it was zeroized, before it is freed
+pub fn munlock(data: &[u8]) {
+    if data.is_empty() {
+        return;
+    }
+
+    #[cfg(unix)]
+    // SAFETY: the range belongs to a live allocation
+    unsafe {
+        libc::munlock(data.as_ptr().cast(), data.len());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[cfg(unix)]
+    #[test]
+    fn test_disable_core_dumps() {
+        assert!(disable_core_dumps());
+
+        let mut limit = libc::rlimit {
+            rlim_cur: 1,
+            rlim_max: 1,
+        };
+        // SAFETY: the pointer is valid for the duration of the call
+        let rs = unsafe { libc::getrlimit(libc::RLIMIT_CORE, &mut limit) };
+        assert_eq!(rs, 0);
+        assert_eq!(limit.rlim_cur, 0);
+    }
+
+    #[test]
+    fn test_mlock() {
+        assert!(!mlock(&[]));
+        munlock(&[]);
+
+        let data = vec![0; 64];
+        if mlock(&data) {
+            munlock(&data);
+        }
+    }
+}
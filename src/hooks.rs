@@ -0,0 +1,183 @@
+// Commands run before and after create, edit and view, `hooks` in the config
+// lists them by stage and operation:
+//
+//   hooks:
+//     pre_create:
+//       - ./scripts/policy-check
+//     post_edit:
+//       - sh -c 'git add "$SSH_VAULT_PATH"'
+//
+// a command or a list of them, split like a shell would but not run by one.
+// They get SSH_VAULT_OPERATION, SSH_VAULT_HOOK and SSH_VAULT_PATH, the vault,
+// unset for stdin and stdout. Their stdout goes to stderr so it never mixes
+// with a vault or a plaintext, and they don't read stdin.
+//
+// A hook that fails aborts the operation, a pre hook before it starts and a
+// post hook with an error once it's done. post_edit only runs when the vault
+// changed, and ssh-vault run by a hook doesn't run the hooks again
+
+use crate::{config, logging};
+use ::config::Config;
+use anyhow::{anyhow, Context, Result};
+use slog::debug;
+use std::{
+    env, io,
+    process::{Command, Stdio},
+};
+
+// set for the commands run by a hook
+const HOOK_VAR: &str = "SSH_VAULT_HOOK";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Stage {
+    Pre,
+    Post,
+}
+
+impl Stage {
+    const fn name(self) -> &'static str {
+        match self {
+            Self::Pre => "pre",
+            Self::Post => "post",
+        }
+    }
+}
+
+/// Run the hooks of the stage of the operation, e.g. pre_create
+/// # Errors
+/// Will return an error if the hooks are not valid or one fails
+pub fn run(stage: Stage, operation: &str, vault: Option<&str>) -> Result<()> {
+    if env::var_os(HOOK_VAR).is_some() {
+        return Ok(());
+    }
+
+    let hook = format!("{}_{operation}", stage.name());
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let commands = commands(&config::get()?, &hook)?;
+
+    execute(
+        &commands,
+        &hook,
+        operation,
+        vault.filter(|path| *path != "-"),
+    )
+}
+
+// Run the commands in order, stopping at the first one that fails
+fn execute(commands: &[String], hook: &str, operation: &str, vault: Option<&str>) -> Result<()> {
+    for command in commands {
+        debug!(logging::logger(), "running the hook"; "hook" => hook, "command" => command);
+
+        let args = shell_words::split(command)
+            .with_context(|| format!("Invalid {hook} hook: {command}"))?;
+
+        let (program, args) = args
+            .split_first()
+            .ok_or_else(|| anyhow!("The {hook} hook is empty"))?;
+
+        let mut child = Command::new(program);
+        child
+            .args(args)
+            .env("SSH_VAULT_OPERATION", operation)
+            .env(HOOK_VAR, hook)
+            .stdin(Stdio::null())
+            .stdout(Stdio::from(io::stderr()));
+
+        match vault {
+            Some(vault) => child.env("SSH_VAULT_PATH", vault),
+            None => child.env_remove("SSH_VAULT_PATH"),
+        };
+
+        let status = child
+            .status()
+            .with_context(|| format!("Failed to run the {hook} hook: {program}"))?;
+
+        if !status.success() {
+            return Err(anyhow!("The {hook} hook {command} exited with {status}"));
+        }
+    }
+
+    Ok(())
+}
+
+// The commands of the hook, one or a list
+fn commands(config: &Config, hook: &str) -> Result<Vec<String>> {
+    let key = format!("hooks.{hook}");
+
+    if let Ok(command) = config.get_string(&key) {
+        return Ok(vec![command]);
+    }
+
+    if config.get_array(&key).is_err() {
+        return Ok(Vec::new());
+    }
+
+    config
+        .get(&key)
+        .with_context(|| format!("Invalid {hook} hooks in the config"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    #[test]
+    fn test_commands() {
+        let config = Config::builder()
+            .set_override("hooks.pre_create", "ssh-vault check .")
+            .unwrap()
+            .set_override("hooks.post_edit", vec!["git add x", "git commit"])
+            .unwrap()
+            .build()
+            .unwrap();
+
+        assert_eq!(
+            commands(&config, "pre_create").unwrap(),
+            vec!["ssh-vault check .".to_string()]
+        );
+        assert_eq!(
+            commands(&config, "post_edit").unwrap(),
+            vec!["git add x".to_string(), "git commit".to_string()]
+        );
+        assert!(commands(&config, "pre_view").unwrap().is_empty());
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_execute() {
+        let dir = tempfile::tempdir().unwrap();
+        let out = dir.path().join("out");
+
+        let commands = vec![
+            format!(
+                "sh -c 'echo \"$SSH_VAULT_HOOK $SSH_VAULT_OPERATION $SSH_VAULT_PATH\" > {}'",
+                out.display()
+            ),
+            String::from("true"),
+        ];
+
+        execute(&commands, "post_edit", "edit", Some("db.vault")).unwrap();
+        assert_eq!(
+            fs::read_to_string(&out).unwrap(),
+            "post_edit edit db.vault\n"
+        );
+
+        // the first failure stops the rest
+        fs::remove_file(&out).unwrap();
+        let failing = [String::from("false"), commands[0].clone()];
+        assert!(execute(&failing, "pre_create", "create", None).is_err());
+        assert!(!out.exists());
+
+        assert!(execute(&[String::from("'unterminated")], "pre_view", "view", None).is_err());
+        assert!(execute(&[String::new()], "pre_view", "view", None).is_err());
+        assert!(execute(
+            &[String::from("/nonexistent/hook")],
+            "pre_view",
+            "view",
+            None
+        )
+        .is_err());
+    }
+}
@@ -0,0 +1,208 @@
+// Leave the terminal as it was when the process dies: a passphrase prompt
+// disables the echo, if the process panics or gets SIGINT or SIGTERM while
+// prompting the terminal settings of the start are restored, so the shell
+// doesn't stay blind.
+//
+// The signals are handled in a thread, which first runs the cleanups
+// registered with `on_interrupt` (e.g. shred the decrypted vault being edited
+// and release its lock) and then exits with the default action of the signal
+// so the status still tells the process was interrupted
+
+#[cfg(unix)]
+use std::{fs::File, os::unix::io::AsRawFd, sync::OnceLock, thread};
+use std::{
+    panic,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Mutex, PoisonError,
+    },
+};
+
+type Cleanup = Box<dyn FnOnce() + Send>;
+
+// cleanups to run if interrupted, by the id of their guard
+static CLEANUPS: Mutex<Vec<(usize, Cleanup)>> = Mutex::new(Vec::new());
+
+static NEXT_ID: AtomicUsize = AtomicUsize::new(0);
+
+// the terminal and its settings when the process started
+#[cfg(unix)]
+static TERMINAL: OnceLock<(File, libc::termios)> = OnceLock::new();
+
+/// Restore the terminal on panic, SIGINT, SIGTERM and SIGHUP and run the
+/// cleanups on the signals, failures are ignored since there may be no
+/// terminal
+pub fn install() {
+    #[cfg(unix)]
+    save_terminal();
+
+    let default_hook = panic::take_hook();
+    panic::set_hook(Box::new(move |info| {
+        restore_terminal();
+        default_hook(info);
+    }));
+
+    #[cfg(unix)]
+    {
+        use signal_hook::{
+            consts::{SIGHUP, SIGINT, SIGTERM},
+            iterator::Signals,
+            low_level,
+        };
+
+        if let Ok(mut signals) = Signals::new([SIGINT, SIGTERM, SIGHUP]) {
+            let _ = thread::Builder::new()
+                .name("signals".to_string())
+                .spawn(move || {
+                    if let Some(signal) = signals.forever().next() {
+                        run_cleanups();
+                        restore_terminal();
+                        let _ = low_level::emulate_default_handler(signal);
+                    }
+                });
+        }
+    }
+}
+
+/// Removes the cleanup when dropped, once the work it undoes is finished
+#[derive(Debug)]
+#[must_use = "the cleanup is removed when the guard is dropped"]
+pub struct Guard {
+    id: usize,
+}
+
+impl Drop for Guard {
+    fn drop(&mut self) {
+        CLEANUPS
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .retain(|(id, _)| *id != self.id);
+    }
+}
+
+/// Run the cleanup if the process is interrupted before the guard is dropped
+pub fn on_interrupt(cleanup: impl FnOnce() + Send + 'static) -> Guard {
+    let id = NEXT_ID.fetch_add(1, Ordering::Relaxed);
+
+    CLEANUPS
+        .lock()
+        .unwrap_or_else(PoisonError::into_inner)
+        .push((id, Box::new(cleanup)));
+
+    Guard { id }
+}
+
+fn run_cleanups() {
+    run(std::mem::take(
+        &mut *CLEANUPS.lock().unwrap_or_else(PoisonError::into_inner),
+    ));
+}
+
+// the latest registered first, like the guards would be dropped
+fn run(cleanups: Vec<(usize, Cleanup)>) {
+    for (_, cleanup) in cleanups.into_iter().rev() {
+        cleanup();
+    }
+}
+
+#[cfg(unix)]
+fn save_terminal() {
+    let Ok(tty) = File::options().read(true).write(true).open("/dev/tty") else {
+        return;
+    };
+
+    // SAFETY: termios is plain data, tcgetattr fills it on success
+    let mut termios: libc::termios = unsafe { std::mem::zeroed() };
+
+    // SAFETY: the descriptor is open and the pointer valid for the call
+    if unsafe { libc::tcgetattr(tty.as_raw_fd(), &mut termios) } == 0 {
+        let _ = TERMINAL.set((tty, termios));
+    }
+}
+
+/// Restore the settings of the terminal saved at the start, when the echo was
+/// turned off by a prompt the line is ended and the cursor shown
+pub fn restore_terminal() {
+    #[cfg(unix)]
+    {
+        use std::io::Write;
+
+        let Some((tty, saved)) = TERMINAL.get() else {
+            return;
+        };
+
+        // SAFETY: termios is plain data, tcgetattr fills it on success
+        let mut current: libc::termios = unsafe { std::mem::zeroed() };
+
+        // SAFETY: the descriptor is open and the pointers valid for the calls
+        unsafe {
+            if libc::tcgetattr(tty.as_raw_fd(), &mut current) != 0 {
+                return;
+            }
+
+            libc::tcsetattr(tty.as_raw_fd(), libc::TCSANOW, saved);
+        }
+
+        if prompting(saved.c_lflag, current.c_lflag) {
+            let mut tty = tty;
+            let _ = tty.write_all(b"\n\x1b[?25h");
+        }
+    }
+}
+
+// the echo was on at the start and is off now, a prompt was interrupted
+#[cfg(unix)]
+const fn prompting(saved: libc::tcflag_t, current: libc::tcflag_t) -> bool {
+    saved & libc::ECHO != 0 && current & libc::ECHO == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[cfg(unix)]
+    #[test]
+    fn test_prompting() {
+        let echo = libc::ECHO | libc::ICANON;
+
+        assert!(prompting(echo, libc::ICANON));
+        assert!(!prompting(echo, echo));
+        assert!(!prompting(libc::ICANON, libc::ICANON));
+    }
+
+    #[test]
+    fn test_on_interrupt() {
+        let registered = |id| {
+            CLEANUPS
+                .lock()
+                .unwrap()
+                .iter()
+                .any(|(registered, _)| *registered == id)
+        };
+
+        let guard = on_interrupt(|| {});
+        let id = guard.id;
+        assert!(registered(id));
+
+        drop(guard);
+        assert!(!registered(id));
+    }
+
+    #[test]
+    fn test_run() {
+        let (tx, rx) = std::sync::mpsc::channel();
+        let cleanup = |name| {
+            let tx = tx.clone();
+            Box::new(move || tx.send(name).unwrap()) as Cleanup
+        };
+
+        run(vec![(0, cleanup("first")), (1, cleanup("second"))]);
+        assert_eq!(rx.try_iter().collect::<Vec<_>>(), vec!["second", "first"]);
+    }
+
+    #[test]
+    fn test_restore_terminal() {
+        // nothing saved or no terminal, nothing to do
+        restore_terminal();
+    }
+}
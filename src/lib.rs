@@ -1,5 +1,15 @@
+pub mod audit;
 pub mod cache;
 pub mod cli;
 pub mod config;
+pub mod exit;
+pub mod git;
+pub mod harden;
+pub mod hooks;
+pub mod interrupt;
+pub mod logging;
+pub mod progress;
+pub mod style;
 pub mod tools;
 pub mod vault;
+pub mod webhook;
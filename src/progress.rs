@@ -0,0 +1,146 @@
+// Progress of long operations on stderr, only shown on a terminal and once the
+// operation takes longer than a second, so small vaults print nothing
+
+use std::{
+    io::{self, IsTerminal, Read, Write},
+    time::{Duration, Instant},
+};
+
+const DELAY: Duration = Duration::from_secs(1);
+const INTERVAL: Duration = Duration::from_millis(200);
+
+/// Reader that reports how much of the input was read
+pub struct Progress<R: Read> {
+    inner: R,
+    label: &'static str,
+    total: Option<u64>,
+    read: u64,
+    enabled: bool,
+    start: Instant,
+    last: Option<Instant>,
+    finished: bool,
+}
+
+impl<R: Read> Progress<R> {
+    /// Report the progress of reading the input, the percentage is shown if the
+    /// total size is known
+    pub fn new(inner: R, label: &'static str, total: Option<u64>, quiet: bool) -> Self {
+        Self {
+            inner,
+            label,
+            total,
+            read: 0,
+            enabled: !quiet && io::stderr().is_terminal(),
+            start: Instant::now(),
+            last: None,
+            finished: false,
+        }
+    }
+
+    fn report(&mut self) {
+        if !self.enabled || self.start.elapsed() < DELAY {
+            return;
+        }
+
+        if !self.finished && self.last.is_some_and(|last| last.elapsed() < INTERVAL) {
+            return;
+        }
+
+        self.last = Some(Instant::now());
+
+        let mut stderr = io::stderr();
+        let _ = write!(stderr, "\r{}", line(self.label, self.read, self.total));
+
+        if self.finished {
+            let _ = writeln!(stderr);
+        }
+
+        let _ = stderr.flush();
+    }
+}
+
+impl<R: Read> Read for Progress<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = self.inner.read(buf)?;
+
+        if !self.finished {
+            self.read += n as u64;
+            self.finished = n == 0 && !buf.is_empty();
+            self.report();
+        }
+
+        Ok(n)
+    }
+}
+
+impl<R: Read> Drop for Progress<R> {
+    fn drop(&mut self) {
+        // end the line if the operation failed before the end of the input
+        if self.last.is_some() && !self.finished {
+            eprintln!();
+        }
+    }
+}
+
+fn line(label: &str, read: u64, total: Option<u64>) -> String {
+    total.filter(|total| *total > 0).map_or_else(
+        || format!("{label} {}", size(read)),
+        |total| {
+            format!(
+                "{label} {:>3}% {} / {}",
+                (read.min(total) * 100) / total,
+                size(read),
+                size(total)
+            )
+        },
+    )
+}
+
+#[allow(clippy::cast_precision_loss)]
+fn size(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KiB", "MiB", "GiB", "TiB"];
+
+    if bytes < 1024 {
+        return format!("{bytes} B");
+    }
+
+    let mut size = bytes as f64 / 1024.0;
+    let mut unit = 0;
+
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+
+    format!("{size:.1} {}", UNITS[unit])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_line() {
+        assert_eq!(line("Decrypting", 512, None), "Decrypting 512 B");
+        assert_eq!(
+            line("Encrypting", 512 * 1024, Some(2048 * 1024)),
+            "Encrypting  25% 512.0 KiB / 2.0 MiB"
+        );
+        assert_eq!(
+            line("Encrypting", 3 << 30, Some(3 << 30)),
+            "Encrypting 100% 3.0 GiB / 3.0 GiB"
+        );
+        assert_eq!(line("Decrypting", 10, Some(0)), "Decrypting 10 B");
+    }
+
+    #[test]
+    fn test_read() {
+        let mut progress = Progress::new(&b"secret"[..], "Decrypting", Some(6), true);
+        let mut data = Vec::new();
+        progress.read_to_end(&mut data).unwrap();
+
+        assert_eq!(data, b"secret");
+        assert_eq!(progress.read, 6);
+        assert!(progress.finished);
+    }
+}
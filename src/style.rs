@@ -0,0 +1,115 @@
+// Colors and aligned columns for people reading the output on a terminal,
+// scripts reading it from a pipe get the plain format. Colors are also off
+// with NO_COLOR set (https://no-color.org) or TERM=dumb
+
+use std::{
+    env,
+    io::{self, IsTerminal},
+};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Color {
+    Red,
+    Green,
+    Yellow,
+    Cyan,
+    Bold,
+    Dim,
+}
+
+impl Color {
+    const fn code(self) -> &'static str {
+        match self {
+            Self::Red => "31",
+            Self::Green => "32",
+            Self::Yellow => "33",
+            Self::Cyan => "36",
+            Self::Bold => "1",
+            Self::Dim => "2",
+        }
+    }
+}
+
+/// How the output is shown
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Style {
+    terminal: bool,
+    color: bool,
+}
+
+impl Style {
+    /// The style of stdout
+    #[must_use]
+    pub fn stdout() -> Self {
+        let terminal = io::stdout().is_terminal();
+        let no_color = env::var_os("NO_COLOR").map_or(false, |value| !value.is_empty());
+        let dumb = env::var("TERM").map_or(false, |term| term == "dumb");
+
+        Self {
+            terminal,
+            color: terminal && !no_color && !dumb,
+        }
+    }
+
+    /// The format for pipes and files
+    #[must_use]
+    pub const fn plain() -> Self {
+        Self {
+            terminal: false,
+            color: false,
+        }
+    }
+
+    /// Aligned columns, without colors
+    #[must_use]
+    pub const fn aligned() -> Self {
+        Self {
+            terminal: true,
+            color: false,
+        }
+    }
+
+    /// Read by a person, columns are aligned
+    #[must_use]
+    pub const fn is_terminal(self) -> bool {
+        self.terminal
+    }
+
+    /// The text in the color, unchanged without colors
+    #[must_use]
+    pub fn paint(self, text: &str, color: Color) -> String {
+        if self.color && !text.is_empty() {
+            format!("\x1b[{}m{text}\x1b[0m", color.code())
+        } else {
+            text.to_string()
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_paint() {
+        let colored = Style {
+            terminal: true,
+            color: true,
+        };
+
+        assert_eq!(colored.paint("ok", Color::Green), "\x1b[32mok\x1b[0m");
+        assert_eq!(colored.paint("", Color::Green), "");
+        assert_eq!(Style::plain().paint("ok", Color::Green), "ok");
+        assert_eq!(Style::aligned().paint("ok", Color::Red), "ok");
+        assert!(Style::aligned().is_terminal());
+        assert!(!Style::plain().is_terminal());
+    }
+
+    #[test]
+    fn test_stdout() {
+        // the tests don't write to a terminal, or NO_COLOR turns the colors off
+        temp_env::with_var("NO_COLOR", Some("1"), || {
+            assert!(!Style::stdout().color);
+        });
+    }
+}
@@ -5,6 +5,14 @@ pub fn get_home() -> Result<PathBuf> {
     home::home_dir().map_or_else(|| Err(anyhow!("Could not find home directory")), Ok)
 }
 
+// ~/ of the paths in the config is the home directory
+pub fn expand_home(path: &str) -> String {
+    match (path.strip_prefix("~/"), get_home()) {
+        (Some(path), Ok(home)) => home.join(path).display().to_string(),
+        _ => path.to_string(),
+    }
+}
+
 pub fn filter_fetched_keys(response: &str) -> Result<String> {
     let mut filtered_keys = String::new();
 
@@ -26,6 +34,20 @@ pub fn filter_fetched_keys(response: &str) -> Result<String> {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_expand_home() {
+        let home = get_home().unwrap();
+        assert_eq!(
+            expand_home("~/.ssh/id_ed25519"),
+            home.join(".ssh/id_ed25519").display().to_string()
+        );
+        assert_eq!(expand_home("/etc/keys"), "/etc/keys");
+        assert_eq!(
+            expand_home("https://github.com/alice.keys"),
+            "https://github.com/alice.keys"
+        );
+    }
+
     #[test]
     fn test_get_home() {
         let home = get_home().unwrap();
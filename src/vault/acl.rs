@@ -0,0 +1,341 @@
+// Access control lists of the HTTP server, the vault paths each client may
+// encrypt to and read the keys of, globs relative to the --vaults directory:
+//
+//   clients:
+//     - name: ci
+//       token_file: tokens/ci
+//       encrypt:
+//         - apps/ci/**
+//       read:
+//         - apps/**
+//
+// `*` doesn't cross directories, `**` does. The token files are relative to
+// the ACL file, which is loaded again when it or a token file changes
+
+use crate::logging;
+use crate::vault::{crypto, ssh::prompt};
+use anyhow::{anyhow, Context, Result};
+use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
+use secrecy::{ExposeSecret, Secret};
+use serde::Deserialize;
+use slog::{info, warn};
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex, PoisonError},
+    time::SystemTime,
+};
+
+#[derive(Deserialize)]
+struct AclFile {
+    clients: Vec<Entry>,
+}
+
+#[derive(Deserialize)]
+struct Entry {
+    name: String,
+    token_file: String,
+    #[serde(default)]
+    encrypt: Vec<String>,
+    #[serde(default)]
+    read: Vec<String>,
+}
+
+/// A client of the server and the vault paths it may use
+pub struct Client {
+    pub name: String,
+    token: Secret<String>,
+    encrypt: GlobSet,
+    read: GlobSet,
+}
+
+impl Client {
+    /// May encrypt the vault at the path
+    #[must_use]
+    pub fn can_encrypt(&self, path: &str) -> bool {
+        self.encrypt.is_match(path)
+    }
+
+    /// May read the keys of the vault at the path
+    #[must_use]
+    pub fn can_read(&self, path: &str) -> bool {
+        self.read.is_match(path)
+    }
+
+    /// May encrypt to some path, needed by /v1/encrypt which stores nothing
+    #[must_use]
+    pub fn can_encrypt_any(&self) -> bool {
+        !self.encrypt.is_empty()
+    }
+}
+
+pub struct Acl {
+    clients: Vec<Client>,
+    // the ACL file and the token files
+    files: Vec<PathBuf>,
+}
+
+impl Acl {
+    /// A single client with the token, allowed everything
+    /// # Errors
+    /// Will return an error if the token is empty
+    pub fn token(token: Secret<String>) -> Result<Self> {
+        if token.expose_secret().is_empty() {
+            return Err(anyhow!("The token is empty"));
+        }
+
+        let all = globs(&[String::from("**")])?;
+
+        Ok(Self {
+            clients: vec![Client {
+                name: String::from("default"),
+                token,
+                encrypt: all.clone(),
+                read: all,
+            }],
+            files: Vec::new(),
+        })
+    }
+
+    /// Load an ACL file and the tokens of its clients
+    /// # Errors
+    /// Will return an error if a file can't be read, a glob is not valid or
+    /// two clients share a name or a token
+    pub fn load(path: &Path) -> Result<Self> {
+        let file: AclFile = config::Config::builder()
+            .add_source(config::File::from(path))
+            .build()
+            .and_then(config::Config::try_deserialize)
+            .with_context(|| format!("Could not read {}", path.display()))?;
+
+        let dir = path.parent().unwrap_or_else(|| Path::new("."));
+
+        let mut clients: Vec<Client> = Vec::new();
+        let mut files = vec![path.to_path_buf()];
+
+        for entry in file.clients {
+            let token_file = dir.join(&entry.token_file);
+            let token = prompt::from_file(&token_file.to_string_lossy())?;
+
+            if token.expose_secret().is_empty() {
+                return Err(anyhow!("The token in {} is empty", token_file.display()));
+            }
+
+            if let Some(other) = clients.iter().find(|client| {
+                client.name == entry.name
+                    || crypto::ct_eq(
+                        client.token.expose_secret().as_bytes(),
+                        token.expose_secret().as_bytes(),
+                    )
+            }) {
+                return Err(anyhow!(
+                    "The clients {} and {} of {} share a name or a token",
+                    other.name,
+                    entry.name,
+                    path.display()
+                ));
+            }
+
+            files.push(token_file);
+
+            clients.push(Client {
+                encrypt: globs(&entry.encrypt)
+                    .with_context(|| format!("Invalid encrypt glob of {}", entry.name))?,
+                read: globs(&entry.read)
+                    .with_context(|| format!("Invalid read glob of {}", entry.name))?,
+                name: entry.name,
+                token,
+            });
+        }
+
+        Ok(Self { clients, files })
+    }
+
+    /// The client with the token
+    #[must_use]
+    pub fn client(&self, token: &str) -> Option<&Client> {
+        // every token is compared, the time doesn't tell which client matched
+        self.clients.iter().fold(None, |found, client| {
+            let matches = crypto::ct_eq(token.as_bytes(), client.token.expose_secret().as_bytes());
+            found.or_else(|| matches.then_some(client))
+        })
+    }
+}
+
+/// The clients of the server, from the token or an ACL file loaded again
+/// when it changes
+pub struct Access {
+    path: Option<PathBuf>,
+    state: Mutex<State>,
+}
+
+struct State {
+    acl: Arc<Acl>,
+    // modification times of the files of the ACL
+    modified: Vec<Option<SystemTime>>,
+}
+
+impl Access {
+    /// A fixed ACL
+    #[must_use]
+    pub fn new(acl: Acl) -> Self {
+        Self {
+            path: None,
+            state: Mutex::new(State {
+                acl: Arc::new(acl),
+                modified: Vec::new(),
+            }),
+        }
+    }
+
+    /// The ACL of the file
+    /// # Errors
+    /// Will return an error if the file is not valid
+    pub fn file(path: &Path) -> Result<Self> {
+        let acl = Acl::load(path)?;
+
+        Ok(Self {
+            path: Some(path.to_path_buf()),
+            state: Mutex::new(State {
+                modified: modified(&acl.files),
+                acl: Arc::new(acl),
+            }),
+        })
+    }
+
+    /// The current ACL, the file is loaded again if it or a token file
+    /// changed, the previous ACL is kept if it's not valid
+    pub fn acl(&self) -> Arc<Acl> {
+        let mut state = self.state.lock().unwrap_or_else(PoisonError::into_inner);
+
+        if let Some(path) = &self.path {
+            let current = modified(&state.acl.files);
+
+            if current != state.modified {
+                // a broken file is not loaded again until it changes
+                state.modified = current;
+
+                match Acl::load(path) {
+                    Ok(acl) => {
+                        info!(logging::logger(), "ACL reloaded";
+                            "path" => %path.display(), "clients" => acl.clients.len());
+                        state.modified = modified(&acl.files);
+                        state.acl = Arc::new(acl);
+                    }
+                    Err(e) => {
+                        warn!(logging::logger(), "ACL not reloaded, keeping the previous one";
+                            "path" => %path.display(), "error" => %e);
+                    }
+                }
+            }
+        }
+
+        Arc::clone(&state.acl)
+    }
+}
+
+fn modified(files: &[PathBuf]) -> Vec<Option<SystemTime>> {
+    files
+        .iter()
+        .map(|path| fs::metadata(path).and_then(|m| m.modified()).ok())
+        .collect()
+}
+
+// Globs matching whole paths, `*` stops at the directories
+fn globs(patterns: &[String]) -> Result<GlobSet> {
+    let mut builder = GlobSetBuilder::new();
+
+    for pattern in patterns {
+        builder.add(
+            GlobBuilder::new(pattern)
+                .literal_separator(true)
+                .build()
+                .with_context(|| format!("Invalid pattern {pattern}"))?,
+        );
+    }
+
+    Ok(builder.build()?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const ACL: &str = "clients:
+  - name: ci
+    token_file: tokens/ci
+    encrypt:
+      - apps/ci/*
+    read:
+      - apps/**
+";
+
+    #[test]
+    fn test_acl() {
+        let acl = Acl::token(Secret::new(String::from("t0ken"))).unwrap();
+        let client = acl.client("t0ken").unwrap();
+        assert!(client.can_encrypt("a/b/c.vault"));
+        assert!(client.can_read("c.vault"));
+        assert!(acl.client("t0ke").is_none());
+        assert!(acl.client("").is_none());
+
+        assert!(Acl::token(Secret::new(String::new())).is_err());
+    }
+
+    #[test]
+    fn test_reload() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("acl.yml");
+        fs::create_dir(dir.path().join("tokens")).unwrap();
+        fs::write(dir.path().join("tokens/ci"), "t0ken\n").unwrap();
+        fs::write(&path, ACL).unwrap();
+
+        let access = Access::file(&path).unwrap();
+        let acl = access.acl();
+        let client = acl.client("t0ken").unwrap();
+        assert_eq!(client.name, "ci");
+        assert!(client.can_encrypt("apps/ci/db.vault"));
+        assert!(!client.can_encrypt("apps/ci/old/db.vault"));
+        assert!(client.can_read("apps/web/old/db.vault"));
+        assert!(!client.can_read("infra/db.vault"));
+
+        // a new token is used once its file changes
+        fs::write(dir.path().join("tokens/ci"), "rotated\n").unwrap();
+        bump(&dir.path().join("tokens/ci"));
+        assert!(access.acl().client("t0ken").is_none());
+        assert!(access.acl().client("rotated").is_some());
+
+        // an invalid file keeps the previous ACL
+        fs::write(&path, "clients:\n  - name: ci\n    token_file: missing\n").unwrap();
+        bump(&path);
+        assert!(access.acl().client("rotated").is_some());
+
+        fs::write(&path, ACL.replace("apps/ci/*", "apps/**")).unwrap();
+        bump(&path);
+        assert!(access
+            .acl()
+            .client("rotated")
+            .unwrap()
+            .can_encrypt("apps/ci/old/db.vault"));
+
+        // two clients with the same token
+        fs::write(
+            &path,
+            format!("{ACL}  - name: web\n    token_file: tokens/ci\n"),
+        )
+        .unwrap();
+        assert!(Acl::load(&path).is_err());
+    }
+
+    // a modification time the file didn't have, the writes of a test can
+    // happen within the resolution of the clock
+    fn bump(path: &Path) {
+        let modified = fs::metadata(path).unwrap().modified().unwrap();
+        fs::File::options()
+            .write(true)
+            .open(path)
+            .unwrap()
+            .set_modified(modified + std::time::Duration::from_secs(1))
+            .unwrap();
+    }
+}
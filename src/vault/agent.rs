@@ -0,0 +1,550 @@
+// The agent keeps the passphrases of the private keys for a while and holds
+// the identities it was started with unlocked, answering on a unix socket a
+// request per connection, one line each way:
+//
+//   GET <fingerprint>         OK <passphrase>
+//   PUT <fingerprint> <passphrase base64>
+//   IDENTITIES                OK <fingerprint>...
+//   UNWRAP <header base64>    OK <fingerprint> <vault key base64>
+//   DECRYPT <vault base64>    OK <plaintext base64>
+//   CLEAR, STOP
+//
+// errors are answered with ERR <message>. With --metrics the counters of the
+// requests, the failures and the cache are served for Prometheus over HTTP
+
+use crate::tools;
+use crate::vault::{stream::Header, SshVault};
+use anyhow::{anyhow, Result};
+use base64ct::{Base64, Encoding};
+use secrecy::{ExposeSecret, Secret};
+use std::{
+    env,
+    net::TcpListener,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+#[cfg(unix)]
+use std::{
+    collections::HashMap,
+    fs,
+    io::{BufRead, BufReader, ErrorKind, Read, Write},
+    os::unix::{
+        fs::PermissionsExt,
+        net::{UnixListener, UnixStream},
+    },
+    sync::Arc,
+    thread,
+    time::Instant,
+};
+
+#[cfg(unix)]
+use crate::vault::{
+    http::{self, Request, Response},
+    metrics::Metrics,
+};
+
+#[cfg(unix)]
+use zeroize::Zeroize;
+
+// largest request, e.g. the vault of DECRYPT in base64
+#[cfg(unix)]
+const MAX_REQUEST: u64 = 64 * 1024 * 1024;
+
+/// Get the path of the agent socket, `SSH_VAULT_AGENT_SOCK` or ~/.ssh/vault/agent.sock
+/// # Errors
+/// Will return an error if the home directory can't be found
+pub fn socket_path() -> Result<PathBuf> {
+    match env::var("SSH_VAULT_AGENT_SOCK") {
+        Ok(path) if !path.is_empty() => Ok(PathBuf::from(path)),
+        _ => Ok(tools::get_home()?
+            .join(".ssh")
+            .join("vault")
+            .join("agent.sock")),
+    }
+}
+
+/// Get the passphrase stored for the key, None if the agent is not running
+#[must_use]
+pub fn get(key: &str) -> Option<Secret<String>> {
+    let path = socket_path().ok()?;
+    let response = request(&path, &format!("GET {key}")).ok()?;
+    let encoded = response.strip_prefix("OK ")?;
+    let decoded = Base64::decode_vec(encoded).ok()?;
+
+    String::from_utf8(decoded).ok().map(Secret::new)
+}
+
+/// Store the passphrase of the key in the agent if it is running
+/// # Errors
+/// Will return an error if the agent refuses the passphrase
+pub fn put(key: &str, passphrase: &Secret<String>) -> Result<()> {
+    let path = socket_path()?;
+
+    if !path.exists() {
+        return Ok(());
+    }
+
+    let encoded = Base64::encode_string(passphrase.expose_secret().as_bytes());
+    let response = request(&path, &format!("PUT {key} {encoded}"))?;
+
+    if response == "OK" {
+        Ok(())
+    } else {
+        Err(anyhow!("agent: {response}"))
+    }
+}
+
+/// Decrypt the vault key with an identity held by the agent, None if the
+/// agent is not running or holds no key of the vault
+#[must_use]
+pub fn unwrap(header: &Header) -> Option<(String, Secret<[u8; 32]>)> {
+    let path = socket_path().ok()?;
+
+    if !path.exists() {
+        return None;
+    }
+
+    let mut encoded = Vec::new();
+    header.write(&mut encoded).ok()?;
+
+    let response = request(
+        &path,
+        &format!("UNWRAP {}", Base64::encode_string(&encoded)),
+    )
+    .ok()?;
+
+    let (fingerprint, key) = response.strip_prefix("OK ")?.split_once(' ')?;
+
+    let key: [u8; 32] = Base64::decode_vec(key).ok()?.try_into().ok()?;
+
+    Some((fingerprint.to_string(), Secret::new(key)))
+}
+
+/// Decrypt a whole vault with an identity held by the agent
+/// # Errors
+/// Will return an error if the agent is not running or holds no key of the
+/// vault
+pub fn decrypt(vault: &[u8]) -> Result<Vec<u8>> {
+    let response = request(
+        &socket_path()?,
+        &format!("DECRYPT {}", Base64::encode_string(vault)),
+    )?;
+
+    let plaintext = response
+        .strip_prefix("OK ")
+        .ok_or_else(|| anyhow!("agent: {response}"))?;
+
+    Base64::decode_vec(plaintext).map_err(|_| anyhow!("agent: invalid response"))
+}
+
+/// Stop the agent listening on the socket
+/// # Errors
+/// Will return an error if the agent is not running
+pub fn stop(path: &Path) -> Result<()> {
+    request(path, "STOP").map(|_| ())
+}
+
+#[cfg(unix)]
+fn request(path: &Path, command: &str) -> Result<String> {
+    let mut stream = UnixStream::connect(path)?;
+    stream.set_read_timeout(Some(Duration::from_secs(5)))?;
+
+    writeln!(stream, "{command}")?;
+
+    let mut response = String::new();
+    BufReader::new(stream).read_line(&mut response)?;
+
+    Ok(response.trim_end().to_string())
+}
+
+#[cfg(not(unix))]
+fn request(_path: &Path, _command: &str) -> Result<String> {
+    Err(anyhow!("ssh-vault agent is only supported on unix"))
+}
+
+/// Run the agent, keeping the passphrases for the given lifetime and
+/// decrypting with the unlocked identities, the metrics are served on
+/// GET /metrics of the listener if any
+/// # Errors
+/// Will return an error if the socket can't be created or an agent is already running
+#[cfg(unix)]
+pub fn serve(
+    path: &Path,
+    lifetime: Duration,
+    identities: &[SshVault],
+    metrics_listener: Option<TcpListener>,
+) -> Result<()> {
+    if path.exists() {
+        if UnixStream::connect(path).is_ok() {
+            return Err(anyhow!("agent already running on {}", path.display()));
+        }
+
+        // stale socket
+        fs::remove_file(path)?;
+    }
+
+    if let Some(parent) = path.parent().filter(|dir| !dir.as_os_str().is_empty()) {
+        socket_dir(parent)?;
+    }
+
+    // the socket is created only accessible by the owner, nobody can connect
+    // to it before the mode is set
+    // SAFETY: umask only changes the file mode creation mask of the process
+    let umask = unsafe { libc::umask(0o177) };
+    let listener = UnixListener::bind(path);
+    // SAFETY: as above, the previous mask is restored
+    unsafe { libc::umask(umask) };
+    let listener = listener?;
+    fs::set_permissions(path, fs::Permissions::from_mode(0o600))?;
+
+    listener.set_nonblocking(true)?;
+
+    let metrics = Arc::new(Metrics::default());
+
+    // answers until the agent exits
+    if let Some(listener) = metrics_listener {
+        let metrics = Arc::clone(&metrics);
+        thread::spawn(move || http::serve(&listener, |request| route(request, &metrics)));
+    }
+
+    let mut store: HashMap<String, (Secret<String>, Instant)> = HashMap::new();
+
+    loop {
+        // forget the expired passphrases
+        store.retain(|_, (_, expires)| *expires > Instant::now());
+
+        match listener.accept() {
+            Ok((stream, _)) => {
+                if !handle(stream, &mut store, lifetime, identities, &metrics) {
+                    break;
+                }
+            }
+            Err(e) if e.kind() == ErrorKind::WouldBlock => {
+                thread::sleep(Duration::from_millis(200));
+            }
+            Err(_) => continue,
+        }
+    }
+
+    fs::remove_file(path)?;
+
+    Ok(())
+}
+
+// The metrics are the only thing served over HTTP, they hold no secrets
+#[cfg(unix)]
+fn route(request: &Request, metrics: &Metrics) -> Response {
+    match (request.method.as_str(), request.path.as_str()) {
+        ("GET", "/metrics") => metrics.response(),
+        (_, "/metrics") => Response::error(405, "Method not allowed"),
+        _ => Response::error(404, "Not found"),
+    }
+}
+
+// Reply to a single request, returns false when the agent should stop
+#[cfg(unix)]
+fn handle(
+    mut stream: UnixStream,
+    store: &mut HashMap<String, (Secret<String>, Instant)>,
+    lifetime: Duration,
+    identities: &[SshVault],
+    metrics: &Metrics,
+) -> bool {
+    let mut line = String::new();
+    if stream.set_nonblocking(false).is_err()
+        || stream
+            .set_read_timeout(Some(Duration::from_secs(5)))
+            .is_err()
+        || BufReader::new(&stream)
+            .take(MAX_REQUEST)
+            .read_line(&mut line)
+            .is_err()
+    {
+        return true;
+    }
+
+    let mut parts = line.split_whitespace();
+    let start = Instant::now();
+
+    let response = match (parts.next(), parts.next(), parts.next()) {
+        (Some("GET"), Some(key), None) => {
+            metrics.request("GET");
+            let cached = store.get(key);
+            metrics.cache(cached.is_some());
+
+            cached.map_or_else(
+                || String::from("ERR not found"),
+                |(passphrase, _)| format!("OK {}", passphrase.expose_secret()),
+            )
+        }
+        (Some("PUT"), Some(key), Some(passphrase)) => {
+            metrics.request("PUT");
+            store.insert(
+                key.to_string(),
+                (
+                    Secret::new(passphrase.to_string()),
+                    Instant::now() + lifetime,
+                ),
+            );
+            String::from("OK")
+        }
+        (Some("IDENTITIES"), None, None) => {
+            metrics.request("IDENTITIES");
+            identities
+                .iter()
+                .fold(String::from("OK"), |response, identity| {
+                    format!("{response} {}", identity.fingerprint())
+                })
+        }
+        (Some("UNWRAP"), Some(header), None) => {
+            metrics.request("UNWRAP");
+            let response = unwrap_header(header, identities);
+            metrics.observe("unwrap", start.elapsed());
+            answer(response, metrics)
+        }
+        (Some("DECRYPT"), Some(vault), None) => {
+            metrics.request("DECRYPT");
+            let response = decrypt_vault(vault, identities);
+            metrics.observe("decrypt", start.elapsed());
+            answer(response, metrics)
+        }
+        (Some("CLEAR"), None, None) => {
+            metrics.request("CLEAR");
+            store.clear();
+            String::from("OK")
+        }
+        (Some("STOP"), None, None) => {
+            metrics.request("STOP");
+            let _ = writeln!(stream, "OK");
+            return false;
+        }
+        _ => {
+            metrics.request("unknown");
+            metrics.failure("unknown_command");
+            String::from("ERR unknown command")
+        }
+    };
+
+    let _ = writeln!(stream, "{response}");
+
+    true
+}
+
+// A failure and its cause in the metrics
+#[cfg(unix)]
+type Failure = (&'static str, anyhow::Error);
+
+// The response line, counting the failure
+#[cfg(unix)]
+fn answer(response: Result<String, Failure>, metrics: &Metrics) -> String {
+    response.unwrap_or_else(|(cause, e)| {
+        metrics.failure(cause);
+        format!("ERR {e}")
+    })
+}
+
+// The vault key of the header with the first identity that has a stanza
+#[cfg(unix)]
+fn unwrap_header(encoded: &str, identities: &[SshVault]) -> Result<String, Failure> {
+    let header =
+        Base64::decode_vec(encoded).map_err(|_| ("invalid_request", anyhow!("invalid header")))?;
+    let header = Header::read(&mut header.as_slice()).map_err(|e| ("invalid_request", e))?;
+
+    let fingerprints = header.fingerprints();
+
+    let identity = identities
+        .iter()
+        .find(|identity| fingerprints.contains(&identity.fingerprint().as_str()))
+        .ok_or_else(|| ("no_identity", anyhow!("no identity for the vault")))?;
+
+    let key = header.unwrap(identity).map_err(|e| ("decrypt", e))?;
+
+    Ok(format!(
+        "OK {} {}",
+        identity.fingerprint(),
+        Base64::encode_string(key.expose_secret())
+    ))
+}
+
+// The plaintext of the vault with the first identity that opens it
+#[cfg(unix)]
+fn decrypt_vault(encoded: &str, identities: &[SshVault]) -> Result<String, Failure> {
+    let mut vault =
+        Base64::decode_vec(encoded).map_err(|_| ("invalid_request", anyhow!("invalid vault")))?;
+
+    let plaintext = identities
+        .iter()
+        .find_map(|identity| identity.open(&vault).ok());
+
+    vault.zeroize();
+
+    let mut plaintext =
+        plaintext.ok_or_else(|| ("no_identity", anyhow!("no identity for the vault")))?;
+
+    let response = format!("OK {}", Base64::encode_string(&plaintext));
+
+    plaintext.zeroize();
+
+    Ok(response)
+}
+
+/// Create the directory of a socket only accessible by the owner, an existing
+/// one writable by others would let them replace the socket
+/// # Errors
+/// Will return an error if the directory can't be created or is writable by others
+#[cfg(unix)]
+pub fn socket_dir(dir: &Path) -> Result<()> {
+    use std::os::unix::fs::DirBuilderExt;
+
+    fs::DirBuilder::new()
+        .recursive(true)
+        .mode(0o700)
+        .create(dir)?;
+
+    if fs::metadata(dir)?.permissions().mode() & 0o022 != 0 {
+        return Err(anyhow!(
+            "{} is writable by others, use a private directory for the socket",
+            dir.display()
+        ));
+    }
+
+    Ok(())
+}
+
+#[cfg(not(unix))]
+pub fn serve(
+    _path: &Path,
+    _lifetime: Duration,
+    _identities: &[SshVault],
+    _metrics_listener: Option<TcpListener>,
+) -> Result<()> {
+    Err(anyhow!("ssh-vault agent is only supported on unix"))
+}
+
+#[cfg(test)]
+#[cfg(unix)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, stream, SshKeyType};
+    use ssh_key::PublicKey;
+
+    #[test]
+    fn test_socket_dir() {
+        let dir = tempfile::tempdir().unwrap();
+
+        let path = dir.path().join("vault");
+        socket_dir(&path).unwrap();
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o700
+        );
+
+        let shared = dir.path().join("shared");
+        fs::create_dir(&shared).unwrap();
+        fs::set_permissions(&shared, fs::Permissions::from_mode(0o777)).unwrap();
+        assert!(socket_dir(&shared).is_err());
+        assert!(serve(
+            &shared.join("agent.sock"),
+            Duration::from_secs(1),
+            &[],
+            None
+        )
+        .is_err());
+    }
+
+    #[test]
+    fn test_agent() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("agent.sock");
+
+        let server = {
+            let path = path.clone();
+            thread::spawn(move || serve(&path, Duration::from_secs(60), &[], None))
+        };
+
+        // wait for the socket
+        for _ in 0..50 {
+            if UnixStream::connect(&path).is_ok() {
+                break;
+            }
+            thread::sleep(Duration::from_millis(20));
+        }
+
+        temp_env::with_var("SSH_VAULT_AGENT_SOCK", Some(&path), || {
+            assert!(get("SHA256:key").is_none());
+
+            put("SHA256:key", &Secret::new(String::from("pass phrase"))).unwrap();
+            assert_eq!(get("SHA256:key").unwrap().expose_secret(), "pass phrase");
+
+            // a second agent can't use the same socket
+            assert!(serve(&path, Duration::from_secs(60), &[], None).is_err());
+
+            stop(&path).unwrap();
+        });
+
+        assert!(server.join().unwrap().is_ok());
+        assert!(!path.exists());
+    }
+
+    #[test]
+    fn test_agent_identities() {
+        let public_key = PublicKey::read_openssh_file(Path::new("test_data/ed25519.pub")).unwrap();
+        let private_key =
+            find::private_key(Some("test_data/ed25519".to_string()), &SshKeyType::Ed25519).unwrap();
+
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public_key), None).unwrap();
+        let identity = SshVault::new(&SshKeyType::Ed25519, None, Some(private_key)).unwrap();
+        let fingerprint = identity.fingerprint();
+
+        let mut vault = Vec::new();
+        stream::encrypt(&[recipient], &b"secret"[..], &mut vault).unwrap();
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("agent.sock");
+
+        let server = {
+            let path = path.clone();
+            thread::spawn(move || serve(&path, Duration::from_secs(60), &[identity], None))
+        };
+
+        for _ in 0..50 {
+            if UnixStream::connect(&path).is_ok() {
+                break;
+            }
+            thread::sleep(Duration::from_millis(20));
+        }
+
+        temp_env::with_var("SSH_VAULT_AGENT_SOCK", Some(&path), || {
+            assert_eq!(
+                request(&path, "IDENTITIES").unwrap(),
+                format!("OK {fingerprint}")
+            );
+
+            assert_eq!(decrypt(&vault).unwrap(), b"secret");
+            assert!(decrypt(b"not a vault").is_err());
+
+            let mut input = vault.as_slice();
+            let header = Header::read(&mut input).unwrap();
+            let (unwrapped, key) = unwrap(&header).unwrap();
+            assert_eq!(unwrapped, fingerprint);
+
+            let mut plaintext = Vec::new();
+            stream::decrypt_with_key(&header, &key, input, &mut plaintext).unwrap();
+            assert_eq!(plaintext, b"secret");
+
+            stop(&path).unwrap();
+        });
+
+        assert!(server.join().unwrap().is_ok());
+    }
+
+    #[test]
+    fn test_agent_not_running() {
+        temp_env::with_var("SSH_VAULT_AGENT_SOCK", Some("/path/does/not/exist"), || {
+            assert!(get("SHA256:key").is_none());
+            assert!(decrypt(b"vault").is_err());
+            assert!(put("SHA256:key", &Secret::new(String::from("secret"))).is_ok());
+        });
+    }
+}
@@ -0,0 +1,295 @@
+// Credentials of the key URLs behind authentication, `http_credentials` in
+// the config lists the URLs and where their secret is:
+//
+//   http_credentials:
+//     - url: https://keys.example.com/
+//       env: KEYS_TOKEN
+//     - url: https://files.example.com/ssh/
+//       username: alice
+//       keyring: true
+//
+// the secret is the value of the `env` variable, the output of `command` or
+// the password stored in the OS keyring for the service ssh-vault and the
+// host of the URL:
+//
+//   secret-tool store --label ssh-vault service ssh-vault host files.example.com
+//   security add-generic-password -s ssh-vault -a files.example.com -w
+//
+// it is sent as a bearer token, or with `username` as basic auth, only to the
+// URLs starting with `url`, the longest match wins
+
+use crate::{config, logging};
+use ::config::Config;
+use anyhow::{anyhow, Context, Result};
+use reqwest::blocking::RequestBuilder;
+use secrecy::{ExposeSecret, Secret};
+use serde::Deserialize;
+use slog::debug;
+use std::{
+    env,
+    process::{Command, Stdio},
+};
+use url::Url;
+
+// service of the secrets in the keyring
+const SERVICE: &str = "ssh-vault";
+
+#[derive(Debug, Default, Deserialize)]
+struct Credential {
+    url: String,
+    username: Option<String>,
+    env: Option<String>,
+    command: Option<String>,
+    #[serde(default)]
+    keyring: bool,
+}
+
+/// How a request is authenticated
+pub enum Auth {
+    Bearer(Secret<String>),
+    Basic(String, Secret<String>),
+}
+
+impl Auth {
+    /// Add the Authorization header to the request, marked as sensitive
+    pub fn apply(&self, req: RequestBuilder) -> RequestBuilder {
+        match self {
+            Self::Bearer(token) => req.bearer_auth(token.expose_secret()),
+            Self::Basic(username, password) => {
+                req.basic_auth(username, Some(password.expose_secret()))
+            }
+        }
+    }
+}
+
+/// The credentials of the URL in the config, if any
+/// # Errors
+/// Will return an error if `http_credentials` is not valid or the secret
+/// can't be read
+pub fn find(url: &Url) -> Result<Option<Auth>> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    let credentials = credentials(&config)?;
+
+    let Some(credential) = matching(&credentials, url)? else {
+        return Ok(None);
+    };
+
+    let from = if credential.env.is_some() {
+        "env"
+    } else if credential.command.is_some() {
+        "command"
+    } else {
+        "keyring"
+    };
+
+    debug!(logging::logger(), "http_credentials"; "prefix" => &credential.url, "from" => from);
+
+    let secret = secret(credential, url)?;
+
+    Ok(Some(match &credential.username {
+        Some(username) => Auth::Basic(username.to_string(), secret),
+        None => Auth::Bearer(secret),
+    }))
+}
+
+fn credentials(config: &Config) -> Result<Vec<Credential>> {
+    if config.get_array("http_credentials").is_err() {
+        return Ok(Vec::new());
+    }
+
+    config
+        .get("http_credentials")
+        .context("Invalid http_credentials in the config")
+}
+
+// The credential with the longest url the URL starts with
+fn matching<'a>(credentials: &'a [Credential], url: &Url) -> Result<Option<&'a Credential>> {
+    let mut found: Option<(usize, &Credential)> = None;
+
+    for credential in credentials {
+        let prefix = Url::parse(&credential.url)
+            .with_context(|| format!("Invalid url in http_credentials: {}", credential.url))?;
+
+        let prefix = prefix.as_str();
+
+        if url.as_str().starts_with(prefix) && found.map_or(true, |(len, _)| prefix.len() > len) {
+            found = Some((prefix.len(), credential));
+        }
+    }
+
+    Ok(found.map(|(_, credential)| credential))
+}
+
+fn secret(credential: &Credential, url: &Url) -> Result<Secret<String>> {
+    if let Some(name) = &credential.env {
+        return env::var(name)
+            .ok()
+            .filter(|secret| !secret.is_empty())
+            .map(Secret::new)
+            .ok_or_else(|| anyhow!("{name} is not set, needed to authenticate to {url}"));
+    }
+
+    if let Some(command) = &credential.command {
+        let args = shell_words::split(command)?;
+
+        let (program, args) = args
+            .split_first()
+            .ok_or_else(|| anyhow!("The command of {} is empty", credential.url))?;
+
+        let mut command = Command::new(program);
+        command.args(args);
+
+        return output(command, program);
+    }
+
+    if credential.keyring {
+        let host = url
+            .host_str()
+            .ok_or_else(|| anyhow!("Missing host in {url}"))?;
+
+        return output(keyring(host), "the keyring");
+    }
+
+    Err(anyhow!(
+        "Set env, command or keyring in http_credentials for {}",
+        credential.url
+    ))
+}
+
+// Look up the password of the host in the keychain or the secret service
+fn keyring(host: &str) -> Command {
+    if cfg!(target_os = "macos") {
+        let mut command = Command::new("security");
+        command.args(["find-generic-password", "-s", SERVICE, "-a", host, "-w"]);
+        command
+    } else {
+        let mut command = Command::new("secret-tool");
+        command.args(["lookup", "service", SERVICE, "host", host]);
+        command
+    }
+}
+
+// Run the command and read the secret from its stdout
+fn output(mut command: Command, name: &str) -> Result<Secret<String>> {
+    let output = command
+        .stdin(Stdio::null())
+        .stderr(Stdio::inherit())
+        .output()
+        .with_context(|| format!("Failed to run {name}"))?;
+
+    if !output.status.success() {
+        return Err(anyhow!(
+            "Failed to get the secret from {name}: {}",
+            output.status
+        ));
+    }
+
+    let secret = String::from_utf8(output.stdout)?.trim_end().to_string();
+
+    if secret.is_empty() {
+        return Err(anyhow!("No secret found in {name}"));
+    }
+
+    Ok(Secret::new(secret))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use ::config::{Map, Value};
+
+    fn entry(url: &str) -> Credential {
+        Credential {
+            url: url.to_string(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_matching() {
+        let credentials = vec![
+            entry("https://keys.example.com"),
+            entry("https://keys.example.com/team/"),
+        ];
+
+        let url = |url| Url::parse(url).unwrap();
+
+        let found = |u| {
+            matching(&credentials, &url(u))
+                .unwrap()
+                .map(|credential| credential.url.as_str())
+        };
+
+        assert_eq!(
+            found("https://keys.example.com/team/alice.keys"),
+            Some("https://keys.example.com/team/")
+        );
+        assert_eq!(
+            found("https://keys.example.com/alice.keys"),
+            Some("https://keys.example.com")
+        );
+        assert_eq!(found("https://keys.example.com.evil/alice.keys"), None);
+        assert_eq!(found("http://keys.example.com/alice.keys"), None);
+
+        assert!(matching(&[entry("not a url")], &url("https://example.com")).is_err());
+    }
+
+    #[test]
+    fn test_secret() {
+        let url = Url::parse("https://keys.example.com/alice.keys").unwrap();
+
+        temp_env::with_var("SSH_VAULT_TEST_TOKEN", Some("s3cr3t"), || {
+            let credential = Credential {
+                env: Some("SSH_VAULT_TEST_TOKEN".to_string()),
+                ..entry("https://keys.example.com")
+            };
+            assert_eq!(secret(&credential, &url).unwrap().expose_secret(), "s3cr3t");
+        });
+
+        temp_env::with_var("SSH_VAULT_TEST_TOKEN", None::<&str>, || {
+            let credential = Credential {
+                env: Some("SSH_VAULT_TEST_TOKEN".to_string()),
+                ..entry("https://keys.example.com")
+            };
+            assert!(secret(&credential, &url).is_err());
+        });
+
+        let credential = Credential {
+            command: Some("echo token".to_string()),
+            ..entry("https://keys.example.com")
+        };
+        assert_eq!(secret(&credential, &url).unwrap().expose_secret(), "token");
+
+        let credential = Credential {
+            command: Some("false".to_string()),
+            ..entry("https://keys.example.com")
+        };
+        assert!(secret(&credential, &url).is_err());
+
+        // no source
+        assert!(secret(&entry("https://keys.example.com"), &url).is_err());
+    }
+
+    #[test]
+    fn test_credentials() {
+        let mut map = Map::new();
+        map.insert("url".to_string(), Value::from("https://keys.example.com"));
+        map.insert("username".to_string(), Value::from("alice"));
+        map.insert("keyring".to_string(), Value::from(true));
+
+        let config = Config::builder()
+            .set_override("http_credentials", vec![Value::from(map)])
+            .unwrap()
+            .build()
+            .unwrap();
+
+        let parsed = credentials(&config).unwrap();
+        assert_eq!(parsed.len(), 1);
+        assert_eq!(parsed[0].username.as_deref(), Some("alice"));
+        assert!(parsed[0].keyring);
+
+        assert!(credentials(&Config::default()).unwrap().is_empty());
+    }
+}
@@ -0,0 +1,203 @@
+// Payload ciphers of streamed vaults, ChaCha20-Poly1305 by default and
+// AES-256-GCM for FIPS mode, both with 96 bit nonces and 128 bit tags
+
+use crate::exit::Failure;
+use aes_gcm::Aes256Gcm;
+use anyhow::{anyhow, Result};
+use chacha20poly1305::{
+    aead::{self, AeadInPlace, KeyInit},
+    ChaCha20Poly1305,
+};
+use secrecy::{ExposeSecret, Secret};
+use std::{fmt, str::FromStr};
+
+/// Size of the plaintext chunks of a streamed vault
+pub const CHUNK_SIZE: usize = 64 * 1024;
+
+/// Size of the authentication tag appended to every encrypted chunk
+pub const TAG_SIZE: usize = 16;
+
+/// The AEAD encrypting the payload
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Cipher {
+    #[default]
+    ChaCha20Poly1305,
+    Aes256Gcm,
+}
+
+impl Cipher {
+    /// Name used in the `+> cipher` line of the header
+    #[must_use]
+    pub const fn name(self) -> &'static str {
+        match self {
+            Self::ChaCha20Poly1305 => "CHACHA20-POLY1305",
+            Self::Aes256Gcm => "AES-256-GCM",
+        }
+    }
+
+    /// Approved by FIPS 140-3
+    #[must_use]
+    pub const fn is_fips_approved(self) -> bool {
+        matches!(self, Self::Aes256Gcm)
+    }
+}
+
+impl fmt::Display for Cipher {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.name())
+    }
+}
+
+impl FromStr for Cipher {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "CHACHA20-POLY1305" => Ok(Self::ChaCha20Poly1305),
+            "AES-256-GCM" => Ok(Self::Aes256Gcm),
+            _ => Err(anyhow!("Unsupported cipher: {s}")),
+        }
+    }
+}
+
+enum Aead {
+    ChaCha20Poly1305(ChaCha20Poly1305),
+    // the expanded AES key is much larger than the ChaCha20 one
+    Aes256Gcm(Box<Aes256Gcm>),
+}
+
+impl Aead {
+    fn seal(&self, nonce: &[u8; 12], chunk: &mut Vec<u8>) -> Result<(), aead::Error> {
+        match self {
+            Self::ChaCha20Poly1305(aead) => aead.encrypt_in_place(nonce.into(), b"", chunk),
+            Self::Aes256Gcm(aead) => aead.encrypt_in_place(nonce.into(), b"", chunk),
+        }
+    }
+
+    fn open(&self, nonce: &[u8; 12], chunk: &mut Vec<u8>) -> Result<(), aead::Error> {
+        match self {
+            Self::ChaCha20Poly1305(aead) => aead.decrypt_in_place(nonce.into(), b"", chunk),
+            Self::Aes256Gcm(aead) => aead.decrypt_in_place(nonce.into(), b"", chunk),
+        }
+    }
+}
+
+/// Encrypts a stream of chunks with the same key (STREAM construction).
+///
+/// The nonce of every chunk is its position plus a flag marking the last one,
+/// so chunks can't be reordered, dropped or the stream truncated unnoticed
+pub struct ChunkCipher {
+    aead: Aead,
+    counter: u64,
+}
+
+impl ChunkCipher {
+    #[must_use]
+    pub fn new(cipher: Cipher, key: &Secret<[u8; 32]>) -> Self {
+        let key = key.expose_secret().into();
+
+        let aead = match cipher {
+            Cipher::ChaCha20Poly1305 => Aead::ChaCha20Poly1305(ChaCha20Poly1305::new(key)),
+            Cipher::Aes256Gcm => Aead::Aes256Gcm(Box::new(Aes256Gcm::new(key))),
+        };
+
+        Self { aead, counter: 0 }
+    }
+
+    /// Encrypt the next chunk in place, appending the tag
+    /// # Errors
+    /// Will return an error if the encryption fails or there are too many chunks
+    pub fn seal(&mut self, chunk: &mut Vec<u8>, last: bool) -> Result<()> {
+        let nonce = self.next_nonce(last)?;
+        self.aead
+            .seal(&nonce, chunk)
+            .map_err(|_| anyhow!("Failed to encrypt data"))
+    }
+
+    /// Decrypt and authenticate the next chunk in place, removing the tag
+    /// # Errors
+    /// Will return an error if the chunk was tampered with or is not in place
+    pub fn open(&mut self, chunk: &mut Vec<u8>, last: bool) -> Result<()> {
+        let nonce = self.next_nonce(last)?;
+        self.aead.open(&nonce, chunk).map_err(|_| {
+            Failure::Corrupt.error("Failed to decrypt data, the vault is corrupted or truncated")
+        })
+    }
+
+    /// Decrypt and authenticate the chunk at a position in place, used to
+    /// recover the chunks that follow a damaged one
+    /// # Errors
+    /// Will return an error if the chunk was tampered with or is not in place
+    pub fn open_at(&self, index: u64, chunk: &mut Vec<u8>, last: bool) -> Result<()> {
+        self.aead
+            .open(&nonce(index, last), chunk)
+            .map_err(|_| Failure::Corrupt.error(format!("Failed to decrypt chunk {index}")))
+    }
+
+    fn next_nonce(&mut self, last: bool) -> Result<[u8; 12]> {
+        let nonce = nonce(self.counter, last);
+
+        self.counter = self
+            .counter
+            .checked_add(1)
+            .ok_or_else(|| anyhow!("Too many chunks"))?;
+
+        Ok(nonce)
+    }
+}
+
+// 8 bytes big endian counter followed by the last chunk flag
+fn nonce(counter: u64, last: bool) -> [u8; 12] {
+    let mut nonce = [0; 12];
+    nonce[3..11].copy_from_slice(&counter.to_be_bytes());
+    nonce[11] = u8::from(last);
+    nonce
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_chunk_cipher() {
+        let key = Secret::new([7_u8; 32]);
+
+        for cipher in [Cipher::ChaCha20Poly1305, Cipher::Aes256Gcm] {
+            let mut seal = ChunkCipher::new(cipher, &key);
+            let mut first = b"first".to_vec();
+            seal.seal(&mut first, false).unwrap();
+            let mut last = b"last".to_vec();
+            seal.seal(&mut last, true).unwrap();
+            assert_eq!(first.len(), 5 + TAG_SIZE);
+
+            let mut open = ChunkCipher::new(cipher, &key);
+            let mut chunk = first.clone();
+            open.open(&mut chunk, false).unwrap();
+            assert_eq!(chunk, b"first");
+            let mut chunk = last.clone();
+            open.open(&mut chunk, true).unwrap();
+            assert_eq!(chunk, b"last");
+
+            // out of order
+            let mut open = ChunkCipher::new(cipher, &key);
+            assert!(open.open(&mut last.clone(), true).is_err());
+
+            // truncated after the first chunk
+            let mut open = ChunkCipher::new(cipher, &key);
+            assert!(open.open(&mut first.clone(), true).is_err());
+        }
+    }
+
+    #[test]
+    fn test_cipher() {
+        assert_eq!(Cipher::default(), Cipher::ChaCha20Poly1305);
+
+        for cipher in [Cipher::ChaCha20Poly1305, Cipher::Aes256Gcm] {
+            assert_eq!(cipher.to_string().parse::<Cipher>().unwrap(), cipher);
+        }
+
+        assert!("AES-128-GCM".parse::<Cipher>().is_err());
+        assert!(Cipher::Aes256Gcm.is_fips_approved());
+        assert!(!Cipher::ChaCha20Poly1305.is_fips_approved());
+    }
+}
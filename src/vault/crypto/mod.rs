@@ -1,12 +1,15 @@
 pub mod aes256;
 pub mod chacha20poly1305;
+pub mod chunk;
 
 use anyhow::{anyhow, Result};
+use base64ct::{Base64, Encoding};
 use hkdf::Hkdf;
 use rand::{rngs::OsRng, RngCore};
 use rsa::sha2;
-use secrecy::Secret;
+use secrecy::{ExposeSecret, Secret};
 use sha2::Sha256;
+use subtle::ConstantTimeEq;
 
 // Define a trait for cryptographic algorithms
 pub trait Crypto {
@@ -34,11 +37,28 @@ pub fn hkdf(salt: &[u8], info: &[u8], ikm: &[u8]) -> Result<[u8; 32], anyhow::Er
     Ok(output_key_material)
 }
 
+// Tag of the readable lines of a header, an HMAC-SHA256 of the data with a key
+// derived from the vault key for the context, e.g. "label"
+pub fn header_tag(key: &Secret<[u8; 32]>, context: &str, data: &[u8]) -> Result<String> {
+    let tag_key = hkdf(&[], context.as_bytes(), key.expose_secret())?;
+
+    Ok(Base64::encode_string(&hkdf(
+        &tag_key,
+        format!("{context} tag").as_bytes(),
+        data,
+    )?))
+}
+
+// Compare in constant time, fingerprints and tags must not leak through timing
+#[must_use]
+pub fn ct_eq(a: &[u8], b: &[u8]) -> bool {
+    a.ct_eq(b).into()
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
     use hex_literal::hex;
-    use secrecy::ExposeSecret;
 
     #[test]
     fn test_gen_password() {
@@ -46,6 +66,14 @@ mod tests {
         assert_eq!(password.expose_secret().len(), 32);
     }
 
+    #[test]
+    fn test_ct_eq() {
+        assert!(ct_eq(b"SHA256:abc", b"SHA256:abc"));
+        assert!(!ct_eq(b"SHA256:abc", b"SHA256:abd"));
+        assert!(!ct_eq(b"SHA256:abc", b"SHA256:ab"));
+        assert!(ct_eq(b"", b""));
+    }
+
     #[test]
     fn test_hkdf() {
         let ikm = hex!("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b");
@@ -0,0 +1,180 @@
+// Line diffs of plaintexts in the unified format, computed in memory so the
+// plaintexts never reach the disk like they would with diff or git diff
+
+use std::fmt::Write;
+
+// above this many pairs of lines the diff is not minimal, everything old is
+// removed and everything new added
+const MAX_PAIRS: usize = 4_000_000;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Line<'a> {
+    Same(&'a str),
+    Removed(&'a str),
+    Added(&'a str),
+}
+
+/// The lines of old and new, the ones that changed as few as possible
+#[must_use]
+pub fn lines<'a>(old: &[&'a str], new: &[&'a str]) -> Vec<Line<'a>> {
+    let mut diff = Vec::with_capacity(old.len() + new.len());
+
+    // lengths of the longest common subsequences of the rest of the lines
+    let lcs = if old.len().saturating_mul(new.len()) <= MAX_PAIRS {
+        let mut lcs = vec![vec![0_usize; new.len() + 1]; old.len() + 1];
+
+        for i in (0..old.len()).rev() {
+            for j in (0..new.len()).rev() {
+                lcs[i][j] = if old[i] == new[j] {
+                    lcs[i + 1][j + 1] + 1
+                } else {
+                    lcs[i + 1][j].max(lcs[i][j + 1])
+                };
+            }
+        }
+
+        Some(lcs)
+    } else {
+        None
+    };
+
+    let (mut i, mut j) = (0, 0);
+
+    if let Some(lcs) = lcs {
+        while i < old.len() && j < new.len() {
+            if old[i] == new[j] {
+                diff.push(Line::Same(old[i]));
+                i += 1;
+                j += 1;
+            } else if lcs[i + 1][j] >= lcs[i][j + 1] {
+                diff.push(Line::Removed(old[i]));
+                i += 1;
+            } else {
+                diff.push(Line::Added(new[j]));
+                j += 1;
+            }
+        }
+    }
+
+    diff.extend(old[i..].iter().map(|line| Line::Removed(line)));
+    diff.extend(new[j..].iter().map(|line| Line::Added(line)));
+
+    diff
+}
+
+/// The unified diff of old and new with the lines of context around the
+/// changes, empty if they are the same
+#[must_use]
+pub fn unified(old: &str, new: &str, context: usize) -> String {
+    let old: Vec<&str> = old.lines().collect();
+    let new: Vec<&str> = new.lines().collect();
+    let diff = lines(&old, &new);
+
+    // the line numbers before each line of the diff
+    let mut positions = Vec::with_capacity(diff.len() + 1);
+    let (mut old_line, mut new_line) = (0, 0);
+    for line in &diff {
+        positions.push((old_line, new_line));
+        match line {
+            Line::Same(_) => {
+                old_line += 1;
+                new_line += 1;
+            }
+            Line::Removed(_) => old_line += 1,
+            Line::Added(_) => new_line += 1,
+        }
+    }
+    positions.push((old_line, new_line));
+
+    let mut out = String::new();
+    let mut changes = diff
+        .iter()
+        .enumerate()
+        .filter(|(_, line)| !matches!(line, Line::Same(_)))
+        .map(|(i, _)| i)
+        .peekable();
+
+    while let Some(first) = changes.next() {
+        let start = first.saturating_sub(context);
+        let mut end = (first + context + 1).min(diff.len());
+
+        // changes close enough share the hunk
+        while let Some(&next) = changes.peek() {
+            if next.saturating_sub(context) > end {
+                break;
+            }
+            end = (next + context + 1).min(diff.len());
+            changes.next();
+        }
+
+        let (old_start, new_start) = positions[start];
+        let (old_end, new_end) = positions[end];
+
+        let _ = writeln!(
+            out,
+            "@@ -{} +{} @@",
+            range(old_start, old_end - old_start),
+            range(new_start, new_end - new_start)
+        );
+
+        for line in &diff[start..end] {
+            let _ = match line {
+                Line::Same(line) => writeln!(out, " {line}"),
+                Line::Removed(line) => writeln!(out, "-{line}"),
+                Line::Added(line) => writeln!(out, "+{line}"),
+            };
+        }
+    }
+
+    out
+}
+
+// start,count with the start line counted from 1, the line before for none
+fn range(start: usize, count: usize) -> String {
+    if count == 0 {
+        format!("{start},0")
+    } else {
+        format!("{},{count}", start + 1)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_lines() {
+        assert_eq!(
+            lines(&["a", "b", "c"], &["a", "x", "c"]),
+            vec![
+                Line::Same("a"),
+                Line::Removed("b"),
+                Line::Added("x"),
+                Line::Same("c")
+            ]
+        );
+        assert_eq!(lines(&[], &["a"]), vec![Line::Added("a")]);
+        assert!(lines(&[], &[]).is_empty());
+    }
+
+    #[test]
+    fn test_unified() {
+        assert_eq!(unified("a\nb\n", "a\nb\n", 3), "");
+
+        let old = "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n";
+        let new = "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n";
+
+        assert_eq!(
+            unified(old, new, 1),
+            "@@ -2,3 +2,3 @@\n 2\n-3\n+three\n 4\n@@ -10,1 +10,2 @@\n 10\n+11\n"
+        );
+
+        // close changes share the hunk
+        assert_eq!(
+            unified("a\nb\nc\n", "x\nb\ny\n", 1),
+            "@@ -1,3 +1,3 @@\n-a\n+x\n b\n-c\n+y\n"
+        );
+
+        assert_eq!(unified("", "new\n", 3), "@@ -0,0 +1,1 @@\n+new\n");
+    }
+}
@@ -1,5 +1,24 @@
-use std::fs::{File, OpenOptions};
+use crate::config;
+use anyhow::Result;
+use std::fs::{self, File, OpenOptions};
 use std::io::{self, IsTerminal, Read, Write};
+use std::path::{Path, PathBuf};
+use tempfile::NamedTempFile;
+
+/// Mode of the files created by ssh-vault, only readable by the owner
+pub const FILE_MODE: u32 = 0o600;
+
+/// Bytes checked to tell binary data from text, like git does
+pub const BINARY_SAMPLE: usize = 8000;
+
+/// Check if the start of the data is binary, contains a NUL byte or is not
+/// valid UTF-8, a character cut at the end of the sample is ignored
+#[must_use]
+pub fn is_binary(data: &[u8]) -> bool {
+    let sample = &data[..data.len().min(BINARY_SAMPLE)];
+
+    sample.contains(&0) || std::str::from_utf8(sample).is_err_and(|e| e.error_len().is_some())
+}
 
 pub enum InputSource {
     Stdin,
@@ -21,6 +40,14 @@ impl InputSource {
     pub fn is_terminal(&self) -> bool {
         matches!(self, Self::Stdin) && io::stdin().is_terminal()
     }
+
+    // Size of the file, unknown for stdin
+    pub fn size(&self) -> Option<u64> {
+        match self {
+            Self::File(file) => file.metadata().ok().map(|m| m.len()),
+            Self::Stdin => None,
+        }
+    }
 }
 
 impl Read for InputSource {
@@ -39,20 +66,47 @@ pub enum OutputDestination {
 }
 
 impl OutputDestination {
-    #[allow(clippy::suspicious_open_options)]
     pub fn new(output: Option<String>) -> io::Result<Self> {
+        Self::with_mode(output, FILE_MODE)
+    }
+
+    // Files get exactly the given mode (unix only) whatever the umask, existing
+    // regular files are changed to it too
+    #[allow(clippy::suspicious_open_options)]
+    pub fn with_mode(output: Option<String>, mode: u32) -> io::Result<Self> {
         if let Some(filename) = output {
             // Use a file if the filename is not "-" (stdout)
             if filename != "-" {
-                return Ok(Self::File(
-                    OpenOptions::new().write(true).create(true).open(filename)?,
-                ));
+                let mut options = OpenOptions::new();
+                options.write(true).create(true);
+
+                #[cfg(unix)]
+                std::os::unix::fs::OpenOptionsExt::mode(&mut options, mode);
+                #[cfg(not(unix))]
+                let _ = mode;
+
+                let file = options.open(filename)?;
+
+                // the umask narrows the mode of new files and existing ones keep
+                // theirs, devices like /dev/null are left alone
+                #[cfg(unix)]
+                if file.metadata()?.is_file() {
+                    use std::os::unix::fs::PermissionsExt;
+
+                    file.set_permissions(fs::Permissions::from_mode(mode))?;
+                }
+
+                return Ok(Self::File(file));
             }
         }
 
         Ok(Self::Stdout)
     }
 
+    pub fn is_terminal(&self) -> bool {
+        matches!(self, Self::Stdout) && io::stdout().is_terminal()
+    }
+
     pub fn truncate(&self) -> io::Result<()> {
         match self {
             Self::File(file) => file.set_len(0),
@@ -85,20 +139,183 @@ impl Write for OutputDestination {
     }
 }
 
+/// Writer that refuses binary data, the first write is checked so nothing is
+/// written to a terminal that binary data would corrupt
+pub struct TextOnly<W: Write> {
+    inner: W,
+    checked: bool,
+}
+
+impl<W: Write> TextOnly<W> {
+    pub const fn new(inner: W) -> Self {
+        Self {
+            inner,
+            checked: false,
+        }
+    }
+}
+
+impl<W: Write> Write for TextOnly<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if !self.checked && !buf.is_empty() {
+            if is_binary(buf) {
+                return Err(io::Error::new(
+                    io::ErrorKind::InvalidData,
+                    "The vault contains binary data, use -o FILE or --raw to write it anyway",
+                ));
+            }
+
+            self.checked = true;
+        }
+
+        self.inner.write(buf)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.inner.flush()
+    }
+}
+
 pub fn setup_io(
     input: Option<String>,
     output: Option<String>,
+) -> io::Result<(InputSource, OutputDestination)> {
+    setup_io_with_mode(input, output, FILE_MODE)
+}
+
+pub fn setup_io_with_mode(
+    input: Option<String>,
+    output: Option<String>,
+    mode: u32,
 ) -> io::Result<(InputSource, OutputDestination)> {
     let input = InputSource::new(input)?;
-    let output = OutputDestination::new(output)?;
+    let output = OutputDestination::with_mode(output, mode)?;
 
     Ok((input, output))
 }
 
+/// Replace the file with a temporary file written in the same directory
+///
+/// The data is synced to disk before the rename so a crash or a full disk never
+/// leaves a partial file, the previous version is kept as `<file>.bak` if the
+/// `backup` option is set
+/// # Errors
+/// Will return an error if the file can't be synced or renamed
+pub fn persist(tmp: NamedTempFile, path: &Path) -> Result<()> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let backup = config::get()?.get_bool("backup").unwrap_or(false);
+
+    persist_with_backup(tmp, path, backup)
+}
+
+fn persist_with_backup(tmp: NamedTempFile, path: &Path, backup: bool) -> Result<()> {
+    tmp.as_file().sync_all()?;
+
+    if backup && path.exists() {
+        let bak = backup_path(path);
+
+        match fs::remove_file(&bak) {
+            Err(e) if e.kind() != io::ErrorKind::NotFound => return Err(e.into()),
+            _ => {}
+        }
+
+        // a link keeps the previous version without copying it
+        if fs::hard_link(path, &bak).is_err() {
+            fs::copy(path, &bak)?;
+        }
+    }
+
+    tmp.persist(path)?;
+
+    // the rename is only durable once the directory is synced
+    #[cfg(unix)]
+    File::open(
+        path.parent()
+            .filter(|dir| !dir.as_os_str().is_empty())
+            .unwrap_or_else(|| Path::new(".")),
+    )?
+    .sync_all()?;
+
+    Ok(())
+}
+
+/// The path of the previous version of a file, `<file>.bak`
+#[must_use]
+pub fn backup_path(path: &Path) -> PathBuf {
+    let mut bak = path.as_os_str().to_owned();
+    bak.push(".bak");
+    PathBuf::from(bak)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
-    use tempfile::NamedTempFile;
+
+    #[test]
+    fn test_is_binary() {
+        assert!(!is_binary(b""));
+        assert!(!is_binary(b"secret\n"));
+        assert!(!is_binary("contraseña".as_bytes()));
+        assert!(is_binary(b"secret\0"));
+        assert!(is_binary(b"\x89PNG\r\n\x1a\n"));
+
+        // a character cut at the end of the sample is still text
+        let mut text = vec![b'a'; BINARY_SAMPLE - 1];
+        text.extend_from_slice("ñ".as_bytes());
+        assert!(!is_binary(&text));
+
+        // only the sample is checked
+        let mut text = vec![b'a'; BINARY_SAMPLE];
+        text.push(0);
+        assert!(!is_binary(&text));
+    }
+
+    #[test]
+    fn test_text_only() {
+        let mut output = TextOnly::new(Vec::new());
+        output.write_all(b"secret\n").unwrap();
+        output.write_all(b"\0").unwrap();
+        assert_eq!(output.inner, b"secret\n\0");
+
+        let mut output = TextOnly::new(Vec::new());
+        let err = output.write_all(b"\0\x01\x02").unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+        assert!(output.inner.is_empty());
+    }
+
+    #[test]
+    fn test_persist_with_backup() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("secret.vault");
+
+        let write = |data: &str| {
+            let mut tmp = NamedTempFile::new_in(dir.path()).unwrap();
+            tmp.write_all(data.as_bytes()).unwrap();
+            tmp
+        };
+
+        // nothing to back up
+        persist_with_backup(write("one"), &path, true).unwrap();
+        assert_eq!(fs::read_to_string(&path).unwrap(), "one");
+        assert!(!backup_path(&path).exists());
+
+        persist_with_backup(write("two"), &path, true).unwrap();
+        assert_eq!(fs::read_to_string(&path).unwrap(), "two");
+        assert_eq!(fs::read_to_string(backup_path(&path)).unwrap(), "one");
+
+        // the backup is replaced
+        persist_with_backup(write("three"), &path, true).unwrap();
+        assert_eq!(fs::read_to_string(backup_path(&path)).unwrap(), "two");
+
+        persist_with_backup(write("four"), &path, false).unwrap();
+        assert_eq!(fs::read_to_string(&path).unwrap(), "four");
+        assert_eq!(fs::read_to_string(backup_path(&path)).unwrap(), "two");
+
+        assert_eq!(
+            backup_path(Path::new("a/secret.vault")),
+            PathBuf::from("a/secret.vault.bak")
+        );
+    }
 
     #[test]
     fn test_setup_io() {
@@ -171,6 +388,32 @@ mod tests {
         assert_eq!(n, 4);
     }
 
+    #[cfg(unix)]
+    #[test]
+    fn test_output_destination_mode() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let dir = tempfile::tempdir().unwrap();
+
+        let path = dir.path().join("default");
+        OutputDestination::new(Some(path.to_str().unwrap().to_string())).unwrap();
+        let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o600);
+
+        let path = dir.path().join("relaxed");
+        OutputDestination::with_mode(Some(path.to_str().unwrap().to_string()), 0o640).unwrap();
+        let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o640);
+
+        // an existing file readable by everyone is tightened
+        let path = dir.path().join("existing");
+        std::fs::write(&path, "").unwrap();
+        std::fs::set_permissions(&path, std::fs::Permissions::from_mode(0o644)).unwrap();
+        OutputDestination::new(Some(path.to_str().unwrap().to_string())).unwrap();
+        let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o600);
+    }
+
     #[test]
     fn test_output_destination_truncate() {
         let mut output_file = NamedTempFile::new().unwrap();
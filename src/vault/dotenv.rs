@@ -0,0 +1,156 @@
+use anyhow::{anyhow, Result};
+
+/// Parse `KEY=VALUE` lines, blank lines and `#` comments are skipped, the
+/// `export` prefix, the quotes around the values and the inline comments are
+/// removed
+/// # Errors
+/// Will return an error if a line is not a valid assignment
+pub fn parse(data: &str) -> Result<Vec<(String, String)>> {
+    let mut vars = Vec::new();
+
+    for (n, line) in data.lines().enumerate() {
+        let line = line.trim();
+
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+
+        let line = line.strip_prefix("export ").unwrap_or(line);
+
+        let (key, value) = line
+            .split_once('=')
+            .ok_or_else(|| anyhow!("Line {}: expected KEY=VALUE", n + 1))?;
+
+        let key = key.trim();
+
+        if !is_valid_key(key) {
+            return Err(anyhow!("Line {}: invalid variable name {key:?}", n + 1));
+        }
+
+        let (value, _) = split_comment(value.trim_start());
+
+        vars.push((key.to_string(), unquote(value).to_string()));
+    }
+
+    Ok(vars)
+}
+
+/// Check if the name is allowed by the shell
+#[must_use]
+pub fn is_valid_key(key: &str) -> bool {
+    let mut chars = key.chars();
+
+    chars
+        .next()
+        .map_or(false, |c| c.is_ascii_alphabetic() || c == '_')
+        && chars.all(|c| c.is_ascii_alphanumeric() || c == '_')
+}
+
+/// Split a value and what follows it, the spaces and the inline comment, a
+/// comment starts with ` #` after an unquoted value or after the closing quote
+#[must_use]
+pub fn split_comment(value: &str) -> (&str, &str) {
+    let quoted = value
+        .chars()
+        .next()
+        .filter(|quote| *quote == '"' || *quote == '\'')
+        .and_then(|quote| closing_quote(value, quote))
+        .filter(|end| {
+            let rest = value[end + 1..].trim_start();
+            rest.is_empty() || rest.starts_with('#')
+        });
+
+    // KEY= # comment
+    if value.starts_with('#') {
+        return ("", value);
+    }
+
+    let end = quoted.map_or_else(
+        || {
+            value
+                .find(" #")
+                .or_else(|| value.find("\t#"))
+                .map_or(value, |start| &value[..start])
+                .trim_end()
+                .len()
+        },
+        |end| end + 1,
+    );
+
+    value.split_at(end)
+}
+
+// index of the closing quote, `\"` doesn't close a double quoted value
+fn closing_quote(value: &str, quote: char) -> Option<usize> {
+    let mut escaped = false;
+
+    for (i, c) in value.char_indices().skip(1) {
+        match c {
+            '\\' if quote == '"' && !escaped => escaped = true,
+            c if c == quote && !escaped => return Some(i),
+            _ => escaped = false,
+        }
+    }
+
+    None
+}
+
+/// Remove the quotes around a value
+#[must_use]
+pub fn unquote(value: &str) -> &str {
+    for quote in ['"', '\''] {
+        if value.len() >= 2 && value.starts_with(quote) && value.ends_with(quote) {
+            return &value[1..value.len() - 1];
+        }
+    }
+
+    value
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse() {
+        let vars = parse(
+            "# database\nDB_USER=app\nexport DB_PASSWORD=\"s3cr3t value\"\n\nTOKEN='a=b'\nEMPTY=\n",
+        )
+        .unwrap();
+
+        assert_eq!(
+            vars,
+            vec![
+                ("DB_USER".to_string(), "app".to_string()),
+                ("DB_PASSWORD".to_string(), "s3cr3t value".to_string()),
+                ("TOKEN".to_string(), "a=b".to_string()),
+                ("EMPTY".to_string(), String::new()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_split_comment() {
+        assert_eq!(split_comment("app # the user"), ("app", " # the user"));
+        assert_eq!(split_comment("app  "), ("app", "  "));
+        assert_eq!(split_comment("http://host/#top"), ("http://host/#top", ""));
+        assert_eq!(
+            split_comment("\"a # b\"  # comment"),
+            ("\"a # b\"", "  # comment")
+        );
+        assert_eq!(split_comment(r#""a \" b" # c"#), (r#""a \" b""#, " # c"));
+        assert_eq!(split_comment("'a' b"), ("'a' b", ""));
+        assert_eq!(split_comment("# empty"), ("", "# empty"));
+
+        let vars = parse("TOKEN='a=b' # rotated\nURL=http://host/#top\n").unwrap();
+        assert_eq!(vars[0].1, "a=b");
+        assert_eq!(vars[1].1, "http://host/#top");
+    }
+
+    #[test]
+    fn test_parse_invalid() {
+        assert!(parse("not a variable").is_err());
+        assert!(parse("1KEY=value").is_err());
+        assert!(parse("KEY;rm -rf /=value").is_err());
+    }
+}
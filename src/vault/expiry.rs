@@ -0,0 +1,134 @@
+// Expiry of a vault, recorded by `ssh-vault create --expires 90d` so the
+// secret is rotated in time, `view` warns once it is past and fails with
+// `--strict`, `check` reports the expired vaults:
+//
+//  +> expires <tag> 1700000000
+//
+// the line is authenticated with the vault key like the label
+
+use crate::exit::Failure;
+use crate::vault::crypto;
+use anyhow::{anyhow, Result};
+use secrecy::Secret;
+use std::{
+    fmt,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+/// Start of the expiry line of the header
+pub const PREFIX: &str = "+> expires";
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Expiry {
+    // seconds since the epoch
+    pub time: u64,
+    tag: String,
+}
+
+impl Expiry {
+    /// Expire the vault once the duration from now is past
+    /// # Errors
+    /// Will return an error if the clock is before the epoch
+    pub fn after(duration: Duration, key: &Secret<[u8; 32]>) -> Result<Self> {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs();
+
+        Self::new(now.saturating_add(duration.as_secs()), key)
+    }
+
+    /// Expire the vault at the time, in seconds since the epoch
+    /// # Errors
+    /// Will return an error if the tag can't be computed
+    pub fn new(time: u64, key: &Secret<[u8; 32]>) -> Result<Self> {
+        Ok(Self {
+            time,
+            tag: crypto::header_tag(key, "expires", time.to_string().as_bytes())?,
+        })
+    }
+
+    /// Parse a `+> expires <tag> <time>` line
+    /// # Errors
+    /// Will return an error if the line is not valid
+    pub fn parse(line: &str) -> Result<Self> {
+        let (tag, time) = line
+            .strip_prefix(PREFIX)
+            .and_then(|rest| rest.strip_prefix(' '))
+            .and_then(|rest| rest.split_once(' '))
+            .ok_or_else(|| anyhow!("Not an expiry line"))?;
+
+        Ok(Self {
+            time: time.parse().map_err(|_| anyhow!("Invalid expiry time"))?,
+            tag: tag.to_string(),
+        })
+    }
+
+    /// Check the expiry was set by a recipient of the vault
+    /// # Errors
+    /// Will return an error if the line was modified
+    pub fn verify(&self, key: &Secret<[u8; 32]>) -> Result<()> {
+        let tag = crypto::header_tag(key, "expires", self.time.to_string().as_bytes())?;
+
+        if crypto::ct_eq(self.tag.as_bytes(), tag.as_bytes()) {
+            Ok(())
+        } else {
+            Err(Failure::Corrupt
+                .error("The expiry of the vault was modified, it was not set by a recipient"))
+        }
+    }
+
+    #[must_use]
+    pub fn is_expired(&self) -> bool {
+        is_expired(self.time)
+    }
+}
+
+impl fmt::Display for Expiry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{PREFIX} {} {}", self.tag, self.time)
+    }
+}
+
+/// Check if the time, in seconds since the epoch, is past
+#[must_use]
+pub fn is_expired(time: u64) -> bool {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(false, |now| now.as_secs() >= time)
+}
+
+/// The time as an RFC 3339 date, e.g. 2023-11-14T22:13:20Z
+#[must_use]
+pub fn date(time: u64) -> String {
+    humantime::format_rfc3339_seconds(UNIX_EPOCH + Duration::from_secs(time)).to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_expiry() {
+        let key = crypto::gen_password().unwrap();
+        let expiry = Expiry::new(1_700_000_000, &key).unwrap();
+        assert!(expiry.is_expired());
+
+        let line = expiry.to_string();
+        assert!(line.starts_with("+> expires "));
+        assert!(line.ends_with(" 1700000000"));
+
+        let parsed = Expiry::parse(&line).unwrap();
+        assert_eq!(parsed, expiry);
+        assert!(parsed.verify(&key).is_ok());
+        assert!(parsed.verify(&crypto::gen_password().unwrap()).is_err());
+
+        // postponed without the key
+        let forged = Expiry::parse(&line.replace("1700000000", "4000000000")).unwrap();
+        assert!(forged.verify(&key).is_err());
+
+        let expiry = Expiry::after(Duration::from_secs(90 * 86_400), &key).unwrap();
+        assert!(!expiry.is_expired());
+
+        assert!(Expiry::parse("+> expires tag").is_err());
+        assert!(Expiry::parse("+> expires tag soon").is_err());
+        assert_eq!(date(1_700_000_000), "2023-11-14T22:13:20Z");
+    }
+}
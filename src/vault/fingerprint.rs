@@ -163,6 +163,19 @@ pub fn get_remote_fingerprints(keys: &str, key: Option<u32>) -> Result<Vec<Finge
     Ok(fingerprints)
 }
 
+/// SHA256 fingerprint of the key and the MD5 of RSA keys used by the legacy format
+/// # Errors
+/// Will return an error if the RSA key is not valid
+pub fn key_fingerprints(key: &PublicKey) -> Result<Vec<String>> {
+    let mut fingerprints = vec![key.fingerprint(HashAlg::Sha256).to_string()];
+
+    if let Some(key_data) = key.key_data().rsa() {
+        fingerprints.push(md5_fingerprint(&RsaPublicKey::try_from(key_data)?)?);
+    }
+
+    Ok(fingerprints)
+}
+
 // Calculate the MD5 fingerprint of a RSA public key
 // and format it as a colon separated string
 pub fn md5_fingerprint(public_key: &RsaPublicKey) -> Result<String> {
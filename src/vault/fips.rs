@@ -0,0 +1,117 @@
+// FIPS mode, vaults are only created and opened with primitives approved by
+// FIPS 140-3: RSA-OAEP with SHA-256 and keys of at least 2048 bits to encrypt
+// the vault key, AES-256-GCM for the payload and HKDF-SHA256 to derive keys.
+//
+// Enabled building with `--features fips` or in the config:
+//
+//   fips: true
+//
+// (SSH_VAULT_FIPS=true), ed25519 keys (X25519), smaller RSA keys,
+// ChaCha20-Poly1305 payloads, the legacy CHACHA20-POLY1305 vaults and
+// encrypted values are refused.
+//
+// This is a policy over the RustCrypto implementations, which are not a FIPS
+// validated module, the feature doesn't link BoringCrypto, OpenSSL or
+// aws-lc-rs. It keeps the vaults readable by a build that uses a validated
+// module but doesn't make this build one
+
+use crate::config;
+use crate::vault::{crypto::chunk::Cipher, SshKeyType};
+use anyhow::{anyhow, Result};
+
+/// Smallest RSA key allowed in FIPS mode, SP 800-131A
+pub const MIN_RSA_BITS: usize = 2048;
+
+/// FIPS mode is enabled by the build or the config
+/// # Errors
+/// Will return an error if the config can't be read
+pub fn enabled() -> Result<bool> {
+    if cfg!(feature = "fips") {
+        return Ok(true);
+    }
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    Ok(config::get()?.get_bool("fips").unwrap_or(false))
+}
+
+/// The cipher of the payload of new vaults
+/// # Errors
+/// Will return an error if the config can't be read
+pub fn cipher() -> Result<Cipher> {
+    if enabled()? {
+        Ok(Cipher::Aes256Gcm)
+    } else {
+        Ok(Cipher::default())
+    }
+}
+
+/// Check the ssh key can be used
+/// # Errors
+/// Will return an error in FIPS mode if the key is not RSA
+pub fn check_key(key_type: &SshKeyType) -> Result<()> {
+    if *key_type == SshKeyType::Ed25519 && enabled()? {
+        return Err(anyhow!(
+            "ed25519 keys use X25519, which is not FIPS approved, use an RSA key"
+        ));
+    }
+
+    Ok(())
+}
+
+/// Check the size of an RSA key
+/// # Errors
+/// Will return an error in FIPS mode if the key is smaller than `MIN_RSA_BITS`
+pub fn check_rsa_bits(bits: usize) -> Result<()> {
+    if bits < MIN_RSA_BITS && enabled()? {
+        return Err(anyhow!(
+            "RSA keys of {bits} bits are not FIPS approved, use at least {MIN_RSA_BITS} bits"
+        ));
+    }
+
+    Ok(())
+}
+
+/// Check the payload cipher can be used
+/// # Errors
+/// Will return an error in FIPS mode if the cipher is not approved
+pub fn check_cipher(cipher: Cipher) -> Result<()> {
+    check(cipher.is_fips_approved(), cipher.name())
+}
+
+// Refuse a primitive that is not approved in FIPS mode
+fn check(approved: bool, name: &str) -> Result<()> {
+    if !approved && enabled()? {
+        return Err(anyhow!("{name} is not FIPS approved, FIPS mode is enabled"));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_fips() {
+        temp_env::with_vars([("SSH_VAULT_FIPS", Some("true"))], || {
+            assert!(enabled().unwrap());
+            assert_eq!(cipher().unwrap(), Cipher::Aes256Gcm);
+            assert!(check_key(&SshKeyType::Rsa).is_ok());
+            assert!(check_key(&SshKeyType::Ed25519).is_err());
+            assert!(check_rsa_bits(1024).is_err());
+            assert!(check_rsa_bits(2048).is_ok());
+            assert!(check_cipher(Cipher::Aes256Gcm).is_ok());
+            assert!(check_cipher(Cipher::ChaCha20Poly1305).is_err());
+            assert!(check(false, "CHACHA20-POLY1305").is_err());
+        });
+
+        if !cfg!(feature = "fips") {
+            temp_env::with_vars([("SSH_VAULT_FIPS", None::<&str>)], || {
+                assert_eq!(cipher().unwrap(), Cipher::ChaCha20Poly1305);
+                assert!(check_key(&SshKeyType::Ed25519).is_ok());
+                assert!(check_rsa_bits(1024).is_ok());
+                assert!(check_cipher(Cipher::ChaCha20Poly1305).is_ok());
+            });
+        }
+    }
+}
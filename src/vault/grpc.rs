@@ -0,0 +1,241 @@
+use crate::tools;
+use crate::vault::{
+    find, info, info::Recipient, info::VaultInfo, ssh, stream, SshKeyType, SshVault,
+};
+use anyhow::{anyhow, Result};
+use ssh_key::{HashAlg, PublicKey};
+use std::path::{Path, PathBuf};
+
+#[cfg(feature = "grpc")]
+pub mod pb {
+    tonic::include_proto!("sshvault.v1");
+}
+
+/// Get the default path of the gRPC socket ~/.ssh/vault/grpc.sock
+/// # Errors
+/// Will return an error if the home directory can't be found
+pub fn socket_path() -> Result<PathBuf> {
+    Ok(tools::get_home()?
+        .join(".ssh")
+        .join("vault")
+        .join("grpc.sock"))
+}
+
+/// Operations of the gRPC service, see proto/ssh_vault.proto
+pub struct Service {
+    recipients: Vec<SshVault>,
+    keys: Vec<Recipient>,
+    // decrypts the vaults, None to only encrypt
+    private: Option<SshVault>,
+}
+
+impl Service {
+    /// Create the service for the recipients and the private key of the host
+    /// # Errors
+    /// Will return an error if a key type is not supported
+    pub fn new(recipients: Vec<PublicKey>, private: Option<SshVault>) -> Result<Self> {
+        let mut keys = Vec::new();
+        let mut vaults = Vec::new();
+
+        for key in recipients {
+            let key_type = find::key_type(&key.algorithm())?;
+
+            keys.push(Recipient {
+                key_type: match key_type {
+                    SshKeyType::Ed25519 => ssh::ed25519::STANZA,
+                    SshKeyType::Rsa => ssh::rsa::STANZA,
+                }
+                .to_string(),
+                fingerprint: key.fingerprint(HashAlg::Sha256).to_string(),
+            });
+
+            vaults.push(SshVault::new(&key_type, Some(key), None)?);
+        }
+
+        Ok(Self {
+            recipients: vaults,
+            keys,
+            private,
+        })
+    }
+
+    /// Encrypt for the recipients
+    /// # Errors
+    /// Will return an error if there are no recipients
+    pub fn seal(&self, plaintext: &[u8]) -> Result<Vec<u8>> {
+        let mut vault = Vec::new();
+        stream::encrypt(&self.recipients, plaintext, &mut vault)?;
+        Ok(vault)
+    }
+
+    /// Decrypt a vault in the streamed or the legacy format
+    /// # Errors
+    /// Will return an error if there is no private key or it can't open the vault
+    pub fn open(&self, vault: &[u8]) -> Result<Vec<u8>> {
+        let private = self
+            .private
+            .as_ref()
+            .ok_or_else(|| anyhow!("The server has no private key to decrypt"))?;
+
+        private.open(vault)
+    }
+
+    /// Keys that can open a vault
+    /// # Errors
+    /// Will return an error if it's not a vault
+    pub fn read_info(vault: &[u8]) -> Result<VaultInfo> {
+        info::read(&mut &vault[..])
+    }
+
+    /// Keys the service encrypts for
+    #[must_use]
+    pub fn keys(&self) -> &[Recipient] {
+        &self.keys
+    }
+}
+
+#[cfg(feature = "grpc")]
+mod server {
+    use super::{pb, Service};
+    use tonic::{Request, Response, Status};
+    use zeroize::Zeroize;
+
+    #[allow(clippy::needless_pass_by_value)]
+    fn status(e: anyhow::Error) -> Status {
+        Status::invalid_argument(e.to_string())
+    }
+
+    fn recipients(recipients: &[crate::vault::info::Recipient]) -> Vec<pb::Recipient> {
+        recipients
+            .iter()
+            .map(|recipient| pb::Recipient {
+                key_type: recipient.key_type.clone(),
+                fingerprint: recipient.fingerprint.clone(),
+            })
+            .collect()
+    }
+
+    #[tonic::async_trait]
+    impl pb::vault_server::Vault for Service {
+        async fn encrypt(
+            &self,
+            request: Request<pb::EncryptRequest>,
+        ) -> Result<Response<pb::EncryptResponse>, Status> {
+            let mut request = request.into_inner();
+            let vault = self.seal(&request.plaintext);
+            request.plaintext.zeroize();
+
+            Ok(Response::new(pb::EncryptResponse {
+                vault: vault.map_err(status)?,
+            }))
+        }
+
+        async fn decrypt(
+            &self,
+            request: Request<pb::DecryptRequest>,
+        ) -> Result<Response<pb::DecryptResponse>, Status> {
+            let plaintext = self.open(&request.into_inner().vault).map_err(status)?;
+
+            Ok(Response::new(pb::DecryptResponse { plaintext }))
+        }
+
+        async fn info(
+            &self,
+            request: Request<pb::InfoRequest>,
+        ) -> Result<Response<pb::InfoResponse>, Status> {
+            let info = Self::read_info(&request.into_inner().vault).map_err(status)?;
+
+            Ok(Response::new(pb::InfoResponse {
+                format: info.format,
+                recipients: recipients(&info.recipients),
+            }))
+        }
+
+        async fn recipients(
+            &self,
+            _request: Request<pb::RecipientsRequest>,
+        ) -> Result<Response<pb::RecipientsResponse>, Status> {
+            Ok(Response::new(pb::RecipientsResponse {
+                recipients: recipients(self.keys()),
+            }))
+        }
+    }
+}
+
+/// Serve the gRPC service on a unix socket only the user can use
+/// # Errors
+/// Will return an error if the socket can't be created or a server is already running
+#[cfg(all(feature = "grpc", unix))]
+pub fn serve(path: &Path, service: Service) -> Result<()> {
+    use std::{fs, os::unix::fs::PermissionsExt, os::unix::net::UnixStream};
+
+    if path.exists() {
+        if UnixStream::connect(path).is_ok() {
+            return Err(anyhow!("gRPC server already running on {}", path.display()));
+        }
+
+        // stale socket
+        fs::remove_file(path)?;
+    }
+
+    if let Some(parent) = path.parent().filter(|dir| !dir.as_os_str().is_empty()) {
+        super::agent::socket_dir(parent)?;
+    }
+
+    tokio::runtime::Runtime::new()?.block_on(async {
+        // like the agent, nobody can connect before the mode is set
+        // SAFETY: umask only changes the file mode creation mask of the process
+        let umask = unsafe { libc::umask(0o177) };
+        let listener = tokio::net::UnixListener::bind(path);
+        // SAFETY: as above, the previous mask is restored
+        unsafe { libc::umask(umask) };
+        let listener = listener?;
+        fs::set_permissions(path, fs::Permissions::from_mode(0o600))?;
+
+        tonic::transport::Server::builder()
+            .add_service(pb::vault_server::VaultServer::new(service))
+            .serve_with_incoming(tokio_stream::wrappers::UnixListenerStream::new(listener))
+            .await?;
+
+        Ok(())
+    })
+}
+
+#[cfg(not(all(feature = "grpc", unix)))]
+pub fn serve(_path: &Path, _service: Service) -> Result<()> {
+    Err(anyhow!(
+        "ssh-vault was built without gRPC support, build it with: cargo build --features grpc"
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use ssh_key::PrivateKey;
+
+    #[test]
+    fn test_service() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+
+        let service = Service::new(
+            vec![public.clone()],
+            Some(SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap()),
+        )
+        .unwrap();
+
+        assert_eq!(service.keys().len(), 1);
+        assert_eq!(service.keys()[0].key_type, ssh::ed25519::STANZA);
+
+        let vault = service.seal(b"secret").unwrap();
+        assert_eq!(service.open(&vault).unwrap(), b"secret");
+
+        let info = Service::read_info(&vault).unwrap();
+        assert_eq!(info.recipients, service.keys());
+
+        // without a private key it can only encrypt
+        let service = Service::new(vec![public], None).unwrap();
+        assert!(service.open(&vault).is_err());
+        assert!(Service::read_info(b"not a vault").is_err());
+    }
+}
@@ -0,0 +1,230 @@
+// Encrypted revisions of the vaults, with `history: N` in the config every
+// save of a vault keeps the previous N versions next to it:
+//
+//   secret.vault
+//   .secret.vault.d/
+//     1.vault
+//     2.vault
+//
+// the revisions are the vault as it was, encrypted, numbered in the order they
+// were replaced and dated by their modification time. The directory is hidden
+// so check, index and mount skip the old revisions, `ssh-vault history` lists
+// them and `view --revision -1` opens the previous one
+
+use crate::{config, vault::dio};
+use anyhow::{anyhow, Context, Result};
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    time::SystemTime,
+};
+use tempfile::NamedTempFile;
+
+const EXTENSION: &str = "vault";
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Revision {
+    pub number: u64,
+    pub path: PathBuf,
+    // when the vault was saved with this content
+    pub modified: Option<SystemTime>,
+    pub size: u64,
+}
+
+/// The directory of the revisions of the vault, `.<vault>.d` next to it
+#[must_use]
+pub fn dir(vault: &Path) -> PathBuf {
+    let mut name = std::ffi::OsString::from(".");
+    name.push(vault.file_name().unwrap_or(vault.as_os_str()));
+    name.push(".d");
+
+    vault.with_file_name(name)
+}
+
+/// Replace the vault like `dio::persist`, keeping the previous version if the
+/// `history` option is set
+/// # Errors
+/// Will return an error if the revision can't be kept or the vault replaced
+pub fn persist(tmp: NamedTempFile, vault: &Path) -> Result<()> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let keep = config::get()?
+        .get_int("history")
+        .ok()
+        .and_then(|n| usize::try_from(n).ok())
+        .unwrap_or(0);
+
+    if keep > 0 && vault.exists() {
+        save(vault, keep)?;
+    }
+
+    dio::persist(tmp, vault)
+}
+
+// Keep the current version of the vault and drop the oldest ones
+fn save(vault: &Path, keep: usize) -> Result<()> {
+    let dir = dir(vault);
+
+    create_dir(&dir).with_context(|| format!("Could not create {}", dir.display()))?;
+
+    let number = list(vault)?.last().map_or(1, |last| last.number + 1);
+    let revision = dir.join(format!("{number}.{EXTENSION}"));
+
+    // the file is renamed over, a link keeps it without copying it
+    if fs::hard_link(vault, &revision).is_err() {
+        fs::copy(vault, &revision)?;
+    }
+
+    let revisions = list(vault)?;
+    for old in &revisions[..revisions.len().saturating_sub(keep)] {
+        fs::remove_file(&old.path)?;
+    }
+
+    Ok(())
+}
+
+#[cfg(unix)]
+fn create_dir(dir: &Path) -> std::io::Result<()> {
+    use std::os::unix::fs::DirBuilderExt;
+
+    fs::DirBuilder::new()
+        .recursive(true)
+        .mode(0o700)
+        .create(dir)
+}
+
+#[cfg(not(unix))]
+fn create_dir(dir: &Path) -> std::io::Result<()> {
+    fs::create_dir_all(dir)
+}
+
+/// The revisions of the vault, the oldest first
+/// # Errors
+/// Will return an error if the directory of the revisions can't be read
+pub fn list(vault: &Path) -> Result<Vec<Revision>> {
+    let dir = dir(vault);
+
+    if !dir.is_dir() {
+        return Ok(Vec::new());
+    }
+
+    let mut revisions = Vec::new();
+
+    for entry in fs::read_dir(&dir)? {
+        let path = entry?.path();
+
+        let number = path
+            .extension()
+            .filter(|ext| *ext == EXTENSION)
+            .and_then(|_| path.file_stem()?.to_str()?.parse::<u64>().ok());
+
+        if let Some(number) = number {
+            let metadata = fs::metadata(&path)?;
+
+            revisions.push(Revision {
+                number,
+                modified: metadata.modified().ok(),
+                size: metadata.len(),
+                path,
+            });
+        }
+    }
+
+    revisions.sort_by_key(|revision| revision.number);
+
+    Ok(revisions)
+}
+
+/// The revision of the vault, -1 is the previous version, -2 the one before
+/// and a positive number the revision with the number
+/// # Errors
+/// Will return an error if there is no such revision
+pub fn revision(vault: &Path, revision: i64) -> Result<Revision> {
+    let revisions = list(vault)?;
+
+    let found = match revision {
+        0 => None,
+        n if n < 0 => usize::try_from(n.unsigned_abs())
+            .ok()
+            .and_then(|back| revisions.len().checked_sub(back))
+            .and_then(|i| revisions.get(i)),
+        n => revisions
+            .iter()
+            .find(|r| i64::try_from(r.number).is_ok_and(|number| number == n)),
+    };
+
+    found.cloned().ok_or_else(|| {
+        anyhow!(
+            "{} has no revision {revision}, {} kept",
+            vault.display(),
+            revisions.len()
+        )
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+
+    fn write(vault: &Path, content: &str) {
+        let mut tmp = NamedTempFile::new_in(vault.parent().unwrap()).unwrap();
+        tmp.write_all(content.as_bytes()).unwrap();
+        if vault.exists() {
+            save(vault, 2).unwrap();
+        }
+        dio::persist(tmp, vault).unwrap();
+    }
+
+    #[test]
+    fn test_dir() {
+        assert_eq!(
+            dir(Path::new("secrets/db.vault")),
+            PathBuf::from("secrets/.db.vault.d")
+        );
+        assert_eq!(dir(Path::new("db.vault")), PathBuf::from(".db.vault.d"));
+    }
+
+    #[test]
+    fn test_history() {
+        let tmp = tempfile::tempdir().unwrap();
+        let vault = tmp.path().join("db.vault");
+
+        assert!(list(&vault).unwrap().is_empty());
+        assert!(revision(&vault, -1).is_err());
+
+        for content in ["one", "two", "three", "four"] {
+            write(&vault, content);
+        }
+
+        // the oldest revision was dropped
+        let revisions = list(&vault).unwrap();
+        assert_eq!(
+            revisions.iter().map(|r| r.number).collect::<Vec<_>>(),
+            vec![2, 3]
+        );
+
+        let previous = revision(&vault, -1).unwrap();
+        assert_eq!(fs::read_to_string(&previous.path).unwrap(), "three");
+        assert_eq!(previous.size, 5);
+        assert_eq!(
+            fs::read_to_string(revision(&vault, -2).unwrap().path).unwrap(),
+            "two"
+        );
+        assert_eq!(
+            fs::read_to_string(revision(&vault, 2).unwrap().path).unwrap(),
+            "two"
+        );
+        assert_eq!(fs::read_to_string(&vault).unwrap(), "four");
+
+        assert!(revision(&vault, -3).is_err());
+        assert!(revision(&vault, 1).is_err());
+        assert!(revision(&vault, 0).is_err());
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = fs::metadata(dir(&vault)).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o700);
+        }
+    }
+}
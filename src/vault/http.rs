@@ -0,0 +1,331 @@
+// Minimal HTTP/1.1 used by the servers, a thread and a request per connection,
+// up to MAX_CONNECTIONS at once
+
+use anyhow::{anyhow, Result};
+use serde::Serialize;
+use std::{
+    io::{BufRead, BufReader, Read, Write},
+    net::{TcpListener, TcpStream},
+    sync::atomic::{AtomicUsize, Ordering},
+    thread,
+    time::Duration,
+};
+use zeroize::Zeroize;
+
+// largest body accepted, e.g. by the encrypt endpoint
+const MAX_BODY_SIZE: usize = 10 * 1024 * 1024;
+
+// largest request line or header
+const MAX_LINE_SIZE: u64 = 8 * 1024;
+
+// connections handled at once, the following ones are refused until one closes
+const MAX_CONNECTIONS: usize = 64;
+
+#[derive(Debug, Default)]
+pub struct Request {
+    pub method: String,
+    pub path: String,
+    pub authorization: Option<String>,
+    pub if_none_match: Option<String>,
+    pub if_modified_since: Option<String>,
+    pub body: Vec<u8>,
+}
+
+pub struct Response {
+    pub status: u16,
+    pub content_type: &'static str,
+    pub headers: Vec<(&'static str, String)>,
+    pub body: Vec<u8>,
+}
+
+impl Response {
+    #[must_use]
+    pub const fn new(status: u16, content_type: &'static str, body: Vec<u8>) -> Self {
+        Self {
+            status,
+            content_type,
+            headers: Vec::new(),
+            body,
+        }
+    }
+
+    pub fn json<T: Serialize>(status: u16, value: &T) -> Self {
+        Self::new(
+            status,
+            "application/json",
+            serde_json::to_vec(value).unwrap_or_default(),
+        )
+    }
+
+    #[must_use]
+    pub fn error(status: u16, message: &str) -> Self {
+        Self::json(status, &serde_json::json!({ "error": message }))
+    }
+}
+
+/// Accept connections until the listener fails, the body of the requests is
+/// zeroized once answered
+/// # Errors
+/// Will return an error if the listener fails
+pub fn serve<F>(listener: &TcpListener, route: F) -> Result<()>
+where
+    F: Fn(&Request) -> Response + Sync,
+{
+    serve_authorized(listener, |_| true, route)
+}
+
+/// Like `serve`, requests that are not authorized get a 401 before their body
+/// is read
+/// # Errors
+/// Will return an error if the listener fails
+pub fn serve_authorized<A, F>(listener: &TcpListener, authorize: A, route: F) -> Result<()>
+where
+    A: Fn(&Request) -> bool + Sync,
+    F: Fn(&Request) -> Response + Sync,
+{
+    let authorize = &authorize;
+    let route = &route;
+    let active = &AtomicUsize::new(0);
+
+    thread::scope(|scope| {
+        for stream in listener.incoming() {
+            let mut stream = stream?;
+
+            if active.fetch_add(1, Ordering::SeqCst) >= MAX_CONNECTIONS {
+                active.fetch_sub(1, Ordering::SeqCst);
+
+                stream.set_write_timeout(Some(Duration::from_secs(1)))?;
+                let _ = write_response(&mut stream, &Response::error(503, "Too many connections"));
+
+                continue;
+            }
+
+            scope.spawn(move || {
+                let _ = handle(stream, authorize, route);
+                active.fetch_sub(1, Ordering::SeqCst);
+            });
+        }
+
+        Ok(())
+    })
+}
+
+fn handle<A, F>(mut stream: TcpStream, authorize: A, route: F) -> Result<()>
+where
+    A: Fn(&Request) -> bool,
+    F: Fn(&Request) -> Response,
+{
+    stream.set_read_timeout(Some(Duration::from_secs(30)))?;
+
+    let mut reader = BufReader::new(&stream);
+
+    let response = match read_head(&mut reader) {
+        Ok((request, _)) if !authorize(&request) => Response::error(401, "Unauthorized"),
+        Ok((mut request, length)) => match read_body(&mut reader, length) {
+            Ok(body) => {
+                request.body = body;
+                let response = route(&request);
+                request.body.zeroize();
+                response
+            }
+            Err(e) => Response::error(400, &e.to_string()),
+        },
+        Err(e) => Response::error(400, &e.to_string()),
+    };
+
+    write_response(&mut stream, &response)
+}
+
+fn read_line<R: BufRead>(reader: &mut R) -> Result<String> {
+    let mut line = String::new();
+    reader.take(MAX_LINE_SIZE).read_line(&mut line)?;
+
+    if !line.ends_with('\n') {
+        return Err(anyhow!("Invalid request"));
+    }
+
+    Ok(line.trim_end().to_string())
+}
+
+/// Read the request line, the headers and the body
+/// # Errors
+/// Will return an error if the request is not valid or too large
+pub fn read_request<R: BufRead>(reader: &mut R) -> Result<Request> {
+    let (mut request, length) = read_head(reader)?;
+    request.body = read_body(reader, length)?;
+
+    Ok(request)
+}
+
+// The request line and the headers, with the length of the body that follows
+fn read_head<R: BufRead>(reader: &mut R) -> Result<(Request, usize)> {
+    let line = read_line(reader)?;
+    let mut parts = line.split_whitespace();
+
+    let (Some(method), Some(path), Some(_version)) = (parts.next(), parts.next(), parts.next())
+    else {
+        return Err(anyhow!("Invalid request"));
+    };
+
+    let mut request = Request {
+        method: method.to_string(),
+        path: path.to_string(),
+        ..Request::default()
+    };
+
+    let mut length = 0;
+
+    loop {
+        let line = read_line(reader)?;
+
+        if line.is_empty() {
+            break;
+        }
+
+        let Some((name, value)) = line.split_once(':') else {
+            return Err(anyhow!("Invalid header"));
+        };
+
+        let value = value.trim();
+
+        if name.eq_ignore_ascii_case("authorization") {
+            request.authorization = Some(value.to_string());
+        } else if name.eq_ignore_ascii_case("if-none-match") {
+            request.if_none_match = Some(value.to_string());
+        } else if name.eq_ignore_ascii_case("if-modified-since") {
+            request.if_modified_since = Some(value.to_string());
+        } else if name.eq_ignore_ascii_case("content-length") {
+            length = value
+                .parse::<usize>()
+                .map_err(|_| anyhow!("Invalid Content-Length"))?;
+        }
+    }
+
+    if length > MAX_BODY_SIZE {
+        return Err(anyhow!("Payload too large"));
+    }
+
+    Ok((request, length))
+}
+
+// the body grows with what is received, not with what the client announced
+fn read_body<R: Read>(reader: &mut R, length: usize) -> Result<Vec<u8>> {
+    let mut body = Vec::new();
+    reader.take(length as u64).read_to_end(&mut body)?;
+
+    if body.len() < length {
+        body.zeroize();
+        return Err(anyhow!("Truncated body"));
+    }
+
+    Ok(body)
+}
+
+/// Write the response and close the connection
+/// # Errors
+/// Will return an error if writing fails
+pub fn write_response<W: Write>(writer: &mut W, response: &Response) -> Result<()> {
+    let reason = match response.status {
+        200 => "OK",
+        304 => "Not Modified",
+        401 => "Unauthorized",
+        403 => "Forbidden",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        500 => "Internal Server Error",
+        503 => "Service Unavailable",
+        _ => "Bad Request",
+    };
+
+    write!(
+        writer,
+        "HTTP/1.1 {} {reason}\r\nContent-Type: {}\r\nContent-Length: {}\r\n",
+        response.status,
+        response.content_type,
+        response.body.len()
+    )?;
+
+    for (name, value) in &response.headers {
+        write!(writer, "{name}: {value}\r\n")?;
+    }
+
+    writer.write_all(b"Connection: close\r\n\r\n")?;
+    writer.write_all(&response.body)?;
+
+    Ok(writer.flush()?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_read_request() {
+        let raw = b"POST /v1/encrypt HTTP/1.1\r\nHost: localhost\r\nauthorization: Bearer t0ken\r\nIf-None-Match: \"abc\"\r\nContent-Length: 6\r\n\r\nsecret";
+        let request = read_request(&mut &raw[..]).unwrap();
+
+        assert_eq!(request.method, "POST");
+        assert_eq!(request.path, "/v1/encrypt");
+        assert_eq!(request.authorization.as_deref(), Some("Bearer t0ken"));
+        assert_eq!(request.if_none_match.as_deref(), Some("\"abc\""));
+        assert_eq!(request.body, b"secret");
+
+        assert!(read_request(&mut &b"GET\r\n\r\n"[..]).is_err());
+        assert!(
+            read_request(&mut &b"POST / HTTP/1.1\r\nContent-Length: 99999999999\r\n\r\n"[..])
+                .is_err()
+        );
+
+        // the body is read as it arrives, a short one fails
+        assert!(
+            read_request(&mut &b"POST / HTTP/1.1\r\nContent-Length: 1000\r\n\r\nshort"[..])
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_serve_authorized() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        thread::spawn(move || {
+            serve_authorized(
+                &listener,
+                |request| request.authorization.as_deref() == Some("Bearer t0ken"),
+                |request| Response::new(200, "text/plain", request.body.clone()),
+            )
+        });
+
+        let send = |raw: &[u8]| {
+            let mut stream = TcpStream::connect(addr).unwrap();
+            stream.write_all(raw).unwrap();
+            let mut response = String::new();
+            stream.read_to_string(&mut response).unwrap();
+            response
+        };
+
+        // refused without waiting for the announced body
+        let response = send(b"POST / HTTP/1.1\r\nContent-Length: 1000000\r\n\r\n");
+        assert!(response.starts_with("HTTP/1.1 401 Unauthorized\r\n"));
+
+        let response = send(
+            b"POST / HTTP/1.1\r\nAuthorization: Bearer t0ken\r\nContent-Length: 6\r\n\r\nsecret",
+        );
+        assert!(response.starts_with("HTTP/1.1 200 OK\r\n"));
+        assert!(response.ends_with("\r\n\r\nsecret"));
+    }
+
+    #[test]
+    fn test_write_response() {
+        let mut response = Response::new(200, "text/plain", b"keys".to_vec());
+        response.headers.push(("ETag", "\"abc\"".to_string()));
+
+        let mut out = Vec::new();
+        write_response(&mut out, &response).unwrap();
+
+        assert_eq!(
+            String::from_utf8(out).unwrap(),
+            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 4\r\nETag: \"abc\"\r\nConnection: close\r\n\r\nkeys"
+        );
+    }
+}
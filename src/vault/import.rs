@@ -0,0 +1,407 @@
+// Exports of other password managers, the CSV exports of 1Password, Bitwarden
+// and LastPass only differ in the names of the columns
+
+use anyhow::{anyhow, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::{collections::HashSet, fmt::Write, path::PathBuf};
+use zeroize::Zeroize;
+
+/// Entry of a password manager
+#[derive(Debug, Default, PartialEq, Eq, Serialize)]
+pub struct Entry {
+    pub name: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub folder: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub username: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub password: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub url: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub totp: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub notes: Option<String>,
+}
+
+impl Drop for Entry {
+    fn drop(&mut self) {
+        for field in [
+            &mut self.username,
+            &mut self.password,
+            &mut self.totp,
+            &mut self.notes,
+        ]
+        .into_iter()
+        .flatten()
+        {
+            field.zeroize();
+        }
+    }
+}
+
+impl Entry {
+    /// Content of the vault, like pass the password is in the first line
+    /// followed by the other fields and the notes
+    #[must_use]
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+
+        out.push_str(self.password.as_deref().unwrap_or_default());
+        out.push('\n');
+
+        for (name, value) in [
+            ("username", &self.username),
+            ("url", &self.url),
+            ("totp", &self.totp),
+        ] {
+            if let Some(value) = value {
+                let _ = writeln!(out, "{name}: {value}");
+            }
+        }
+
+        if let Some(notes) = &self.notes {
+            out.push('\n');
+            out.push_str(notes);
+            if !notes.ends_with('\n') {
+                out.push('\n');
+            }
+        }
+
+        out
+    }
+}
+
+// columns of the CSV exports, the first name found is used
+const NAME: &[&str] = &["title", "name"];
+const FOLDER: &[&str] = &["folder", "grouping"];
+const USERNAME: &[&str] = &["username", "login_username"];
+const PASSWORD: &[&str] = &["password", "login_password"];
+const URL: &[&str] = &["url", "website", "login_uri"];
+const TOTP: &[&str] = &["otpauth", "totp", "login_totp"];
+const NOTES: &[&str] = &["notes", "extra", "notesplain"];
+
+// url of the secure notes of LastPass
+const LASTPASS_NOTE: &str = "http://sn";
+
+/// Parse the CSV export of 1Password, Bitwarden or LastPass
+/// # Errors
+/// Will return an error if the CSV is not valid or it has no name column
+pub fn parse_csv(data: &str) -> Result<Vec<Entry>> {
+    let mut rows = csv(data)?.into_iter();
+
+    let header: Vec<String> = rows
+        .next()
+        .ok_or_else(|| anyhow!("The export is empty"))?
+        .into_iter()
+        .map(|column| column.trim().to_lowercase())
+        .collect();
+
+    let column = |names: &[&str]| {
+        names
+            .iter()
+            .find_map(|name| header.iter().position(|column| column == name))
+    };
+
+    let name = column(NAME).ok_or_else(|| anyhow!("The export has no name or title column"))?;
+    let (folder, username, password, url, totp, notes) = (
+        column(FOLDER),
+        column(USERNAME),
+        column(PASSWORD),
+        column(URL),
+        column(TOTP),
+        column(NOTES),
+    );
+
+    let mut entries = Vec::new();
+
+    for mut row in rows {
+        if row.iter().all(String::is_empty) {
+            continue;
+        }
+
+        let mut field = |index: Option<usize>| {
+            index
+                .and_then(|index| row.get_mut(index))
+                .map(std::mem::take)
+                .filter(|value| !value.is_empty())
+        };
+
+        entries.push(Entry {
+            name: field(Some(name)).unwrap_or_default(),
+            folder: field(folder).map(|folder| folder.replace('\\', "/")),
+            username: field(username),
+            password: field(password),
+            url: field(url).filter(|url| url != LASTPASS_NOTE),
+            totp: field(totp),
+            notes: field(notes),
+        });
+
+        row.zeroize();
+    }
+
+    Ok(entries)
+}
+
+#[derive(Deserialize)]
+struct BitwardenExport {
+    #[serde(default)]
+    encrypted: bool,
+    #[serde(default)]
+    folders: Vec<BitwardenFolder>,
+    items: Vec<BitwardenItem>,
+}
+
+#[derive(Deserialize)]
+struct BitwardenFolder {
+    id: String,
+    name: String,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct BitwardenItem {
+    name: String,
+    folder_id: Option<String>,
+    notes: Option<String>,
+    login: Option<BitwardenLogin>,
+}
+
+#[derive(Deserialize)]
+struct BitwardenLogin {
+    username: Option<String>,
+    password: Option<String>,
+    totp: Option<String>,
+    #[serde(default)]
+    uris: Vec<BitwardenUri>,
+}
+
+#[derive(Deserialize)]
+struct BitwardenUri {
+    uri: Option<String>,
+}
+
+/// Parse the unencrypted JSON export of Bitwarden
+/// # Errors
+/// Will return an error if the JSON is not valid or the export is encrypted
+pub fn parse_bitwarden(data: &str) -> Result<Vec<Entry>> {
+    let export: BitwardenExport =
+        serde_json::from_str(data).context("Invalid Bitwarden JSON export")?;
+
+    if export.encrypted {
+        return Err(anyhow!(
+            "The Bitwarden export is encrypted, export it again as unencrypted JSON"
+        ));
+    }
+
+    Ok(export
+        .items
+        .into_iter()
+        .map(|item| {
+            let login = item.login;
+
+            Entry {
+                name: item.name,
+                folder: item.folder_id.and_then(|id| {
+                    export
+                        .folders
+                        .iter()
+                        .find(|folder| folder.id == id)
+                        .map(|folder| folder.name.clone())
+                }),
+                username: login.as_ref().and_then(|login| login.username.clone()),
+                password: login.as_ref().and_then(|login| login.password.clone()),
+                url: login
+                    .as_ref()
+                    .and_then(|login| login.uris.first())
+                    .and_then(|uri| uri.uri.clone()),
+                totp: login.as_ref().and_then(|login| login.totp.clone()),
+                notes: item.notes,
+            }
+        })
+        .collect())
+}
+
+/// Paths of the entries relative to the output directory, the names are
+/// sanitized and duplicates get a number
+#[must_use]
+pub fn paths(entries: &[Entry]) -> Vec<PathBuf> {
+    let mut seen = HashSet::new();
+
+    entries
+        .iter()
+        .map(|entry| {
+            let mut base = PathBuf::new();
+
+            if let Some(folder) = &entry.folder {
+                for component in folder.split('/').filter(|c| !c.trim().is_empty()) {
+                    base.push(sanitize(component));
+                }
+            }
+
+            let name = sanitize(&entry.name);
+            let mut path = base.join(&name);
+            let mut n = 1;
+
+            while !seen.insert(path.clone()) {
+                n += 1;
+                path = base.join(format!("{name} ({n})"));
+            }
+
+            path
+        })
+        .collect()
+}
+
+// a single path component
+fn sanitize(name: &str) -> String {
+    let name: String = name
+        .trim()
+        .chars()
+        .map(|c| {
+            if matches!(c, '/' | '\\' | ':' | '\0') || c.is_control() {
+                '_'
+            } else {
+                c
+            }
+        })
+        .collect();
+
+    match name.as_str() {
+        "" => String::from("untitled"),
+        _ if name.starts_with('.') => format!("_{}", &name[1..]),
+        _ => name,
+    }
+}
+
+// RFC 4180, quoted fields may have commas, quotes and new lines
+fn csv(data: &str) -> Result<Vec<Vec<String>>> {
+    let data = data.strip_prefix('\u{feff}').unwrap_or(data);
+
+    let mut rows = Vec::new();
+    let mut row = Vec::new();
+    let mut field = String::new();
+    let mut quoted = false;
+    let mut chars = data.chars().peekable();
+
+    while let Some(c) = chars.next() {
+        match (quoted, c) {
+            (true, '"') if chars.peek() == Some(&'"') => {
+                chars.next();
+                field.push('"');
+            }
+            (true, '"') => quoted = false,
+            (true, c) => field.push(c),
+            (false, '"') if field.is_empty() => quoted = true,
+            (false, ',') => row.push(std::mem::take(&mut field)),
+            (false, '\r') if chars.peek() == Some(&'\n') => {}
+            (false, '\n') => {
+                row.push(std::mem::take(&mut field));
+                rows.push(std::mem::take(&mut row));
+            }
+            (false, c) => field.push(c),
+        }
+    }
+
+    if quoted {
+        return Err(anyhow!("Invalid CSV, unterminated quoted field"));
+    }
+
+    if !field.is_empty() || !row.is_empty() {
+        row.push(field);
+        rows.push(row);
+    }
+
+    Ok(rows)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_csv() {
+        assert_eq!(
+            csv("a,\"b,c\",\"d \"\"e\"\"\"\r\n\"multi\nline\",,x").unwrap(),
+            vec![vec!["a", "b,c", "d \"e\""], vec!["multi\nline", "", "x"],]
+        );
+        assert!(csv("\"open").is_err());
+    }
+
+    #[test]
+    fn test_parse_csv() {
+        // LastPass
+        let entries = parse_csv(
+            "url,username,password,totp,extra,name,grouping,fav\nhttps://github.com,alice,s3cr3t,,,GitHub,Work\\Dev,0\nhttp://sn,,,,\"secret note\",Note,,0\n",
+        )
+        .unwrap();
+
+        assert_eq!(entries.len(), 2);
+        assert_eq!(entries[0].name, "GitHub");
+        assert_eq!(entries[0].folder.as_deref(), Some("Work/Dev"));
+        assert_eq!(entries[0].password.as_deref(), Some("s3cr3t"));
+        assert_eq!(entries[1].url, None);
+        assert_eq!(entries[1].render(), "\n\nsecret note\n");
+
+        // 1Password
+        let entries = parse_csv(
+            "\u{feff}\"Title\",\"Url\",\"Username\",\"Password\",\"OTPAuth\",\"Favorite\",\"Archived\",\"Tags\",\"Notes\"\n\"Mail\",\"https://mail.com\",\"bob\",\"pw\",\"\",\"false\",\"false\",\"\",\"\"\n",
+        )
+        .unwrap();
+
+        assert_eq!(
+            entries[0].render(),
+            "pw\nusername: bob\nurl: https://mail.com\n"
+        );
+
+        assert!(parse_csv("url,password\nx,y\n").is_err());
+    }
+
+    #[test]
+    fn test_parse_bitwarden() {
+        let entries = parse_bitwarden(
+            r#"{
+  "encrypted": false,
+  "folders": [{"id": "f1", "name": "Work"}],
+  "items": [
+    {"type": 1, "name": "GitHub", "folderId": "f1", "notes": null,
+     "login": {"username": "alice", "password": "s3cr3t", "totp": null, "uris": [{"match": null, "uri": "https://github.com"}]}},
+    {"type": 2, "name": "Note", "folderId": null, "notes": "secret note"}
+  ]
+}"#,
+        )
+        .unwrap();
+
+        assert_eq!(entries.len(), 2);
+        assert_eq!(entries[0].folder.as_deref(), Some("Work"));
+        assert_eq!(entries[0].url.as_deref(), Some("https://github.com"));
+        assert_eq!(entries[1].notes.as_deref(), Some("secret note"));
+
+        assert!(parse_bitwarden(r#"{"encrypted": true, "items": []}"#).is_err());
+    }
+
+    #[test]
+    fn test_paths() {
+        let entry = |name: &str, folder: Option<&str>| {
+            let mut entry = Entry::default();
+            entry.name = name.to_string();
+            entry.folder = folder.map(String::from);
+            entry
+        };
+
+        assert_eq!(
+            paths(&[
+                entry("GitHub", Some("Work/Dev")),
+                entry("GitHub", Some("Work/Dev")),
+                entry("../etc/passwd", None),
+                entry("", Some(".hidden")),
+            ]),
+            vec![
+                PathBuf::from("Work/Dev/GitHub"),
+                PathBuf::from("Work/Dev/GitHub (2)"),
+                PathBuf::from("_._etc_passwd"),
+                PathBuf::from("_hidden/untitled"),
+            ]
+        );
+    }
+}
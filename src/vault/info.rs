@@ -0,0 +1,313 @@
+use crate::vault::{
+    policy,
+    stream::{self, Header},
+};
+use anyhow::{anyhow, Result};
+use globset::GlobSet;
+use serde::Serialize;
+use std::{
+    fs::{self, File},
+    io::{BufRead, BufReader, Read},
+    path::{Path, PathBuf},
+};
+
+/// First bytes of every vault
+pub const PREFIX: &[u8] = b"SSH-VAULT;";
+
+// lines of a vault created before the streamed format needed to get its
+// fingerprint, wrapped at 64 characters
+const LEGACY_HEADER_LINES: usize = 3;
+
+/// A key that can open a vault
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Recipient {
+    pub key_type: String,
+    pub fingerprint: String,
+}
+
+/// What can be known about a vault without decrypting it
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct VaultInfo {
+    pub format: String,
+    // not checked, only the recipients can check it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub label: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub edited: Option<Edit>,
+    // seconds since the epoch
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub expires: Option<u64>,
+    pub recipients: Vec<Recipient>,
+}
+
+/// The key that edited the vault last
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Edit {
+    pub fingerprint: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub comment: String,
+    // seconds since the epoch
+    pub time: u64,
+}
+
+impl From<&Header> for VaultInfo {
+    fn from(header: &Header) -> Self {
+        Self {
+            format: "V2".to_string(),
+            label: header.label.as_ref().map(|label| label.text.clone()),
+            edited: header.edited.as_ref().map(|edited| Edit {
+                fingerprint: edited.fingerprint.clone(),
+                comment: edited.comment.clone(),
+                time: edited.time,
+            }),
+            expires: header.expires.as_ref().map(|expires| expires.time),
+            recipients: header
+                .stanzas
+                .iter()
+                // both keys of a dual control vault are needed to open it
+                .chain(header.shares.iter().flatten())
+                .map(|stanza| Recipient {
+                    key_type: stanza.tag.clone(),
+                    fingerprint: stanza.fingerprint.clone(),
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Read the header of a vault, the payload is never read
+/// # Errors
+/// Will return an error if it's not a valid vault
+pub fn read<R: BufRead>(reader: &mut R) -> Result<VaultInfo> {
+    let first_line = stream::read_line(reader)?.unwrap_or_default();
+
+    if first_line == stream::MAGIC {
+        return Ok(VaultInfo::from(&Header::read_stanzas(reader)?));
+    }
+
+    // SSH-VAULT;AES256;<fingerprint>\n<payload>
+    if let Some(fingerprint) = first_line.strip_prefix("SSH-VAULT;AES256;") {
+        return Ok(legacy("AES256", fingerprint));
+    }
+
+    // SSH-VAULT;CHACHA20-POLY1305;<fingerprint>;<payload> wrapped at 64 characters
+    let mut header = first_line;
+    for _ in 1..LEGACY_HEADER_LINES {
+        if header.matches(';').count() >= 3 {
+            break;
+        }
+        header.push_str(&stream::read_line(reader)?.unwrap_or_default());
+    }
+
+    match header.split(';').collect::<Vec<_>>().as_slice() {
+        ["SSH-VAULT", "CHACHA20-POLY1305", fingerprint, _, ..] => {
+            Ok(legacy("CHACHA20-POLY1305", fingerprint))
+        }
+        _ => Err(anyhow!("Not a valid SSH-VAULT file")),
+    }
+}
+
+fn legacy(format: &str, fingerprint: &str) -> VaultInfo {
+    VaultInfo {
+        format: format.to_string(),
+        label: None,
+        edited: None,
+        expires: None,
+        recipients: vec![Recipient {
+            key_type: format.to_string(),
+            fingerprint: fingerprint.trim().to_string(),
+        }],
+    }
+}
+
+/// Read the header of a vault file
+/// # Errors
+/// Will return an error if the file can't be read or it's not a valid vault
+pub fn read_file(path: &Path) -> Result<VaultInfo> {
+    read(&mut BufReader::new(File::open(path)?)).map_err(|e| anyhow!("{}: {e}", path.display()))
+}
+
+/// Check if a file is a vault reading only its first bytes
+#[must_use]
+pub fn is_vault(path: &Path) -> bool {
+    let mut prefix = [0; PREFIX.len()];
+
+    File::open(path)
+        .and_then(|mut file| file.read_exact(&mut prefix))
+        .map_or(false, |()| prefix == PREFIX)
+}
+
+/// Find the vaults in a directory and its subdirectories, hidden directories
+/// like .git are skipped
+/// # Errors
+/// Will return an error if a directory can't be read
+pub fn scan(dir: &Path) -> Result<Vec<PathBuf>> {
+    Ok(walk(dir)?
+        .into_iter()
+        .filter(|path| is_vault(path))
+        .collect())
+}
+
+/// List the files in a directory and its subdirectories, hidden directories
+/// like .git are skipped
+/// # Errors
+/// Will return an error if a directory can't be read
+pub fn walk(dir: &Path) -> Result<Vec<PathBuf>> {
+    let mut files = Vec::new();
+    let mut dirs = vec![dir.to_path_buf()];
+
+    while let Some(dir) = dirs.pop() {
+        for entry in fs::read_dir(&dir)? {
+            let entry = entry?;
+            let path = entry.path();
+            let file_type = entry.file_type()?;
+
+            if file_type.is_dir() {
+                if !entry.file_name().to_string_lossy().starts_with('.') {
+                    dirs.push(path);
+                }
+            } else if file_type.is_file() {
+                files.push(path);
+            }
+        }
+    }
+
+    files.sort();
+
+    Ok(files)
+}
+
+/// Include and exclude globs scoping the files of a directory, matched
+/// against their paths relative to it, e.g. `archive/**`
+pub struct Filter {
+    // every file if empty
+    include: Option<GlobSet>,
+    exclude: GlobSet,
+}
+
+impl Filter {
+    /// Compile the patterns
+    /// # Errors
+    /// Will return an error if a pattern is not a valid glob
+    pub fn new(include: &[String], exclude: &[String]) -> Result<Self> {
+        Ok(Self {
+            include: if include.is_empty() {
+                None
+            } else {
+                Some(policy::globs(include)?)
+            },
+            exclude: policy::globs(exclude)?,
+        })
+    }
+
+    /// The files of the directory matching an include glob and no exclude one
+    #[must_use]
+    pub fn apply(&self, dir: &Path, files: Vec<PathBuf>) -> Vec<PathBuf> {
+        files
+            .into_iter()
+            .filter(|file| {
+                let path = file.strip_prefix(dir).unwrap_or(file);
+
+                self.include
+                    .as_ref()
+                    .map_or(true, |include| include.is_match(path))
+                    && !self.exclude.is_match(path)
+            })
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const LEGACY_AES256: &str = "SSH-VAULT;AES256;55:cd:f2:7e:4c:0b:e5:a7:6e:6c:fc:6b:8e:58:9d:13
+bm90IHJlYWQ=;bm90IHJlYWQ=";
+
+    const LEGACY_CHACHA20: &str =
+        "SSH-VAULT;CHACHA20-POLY1305;SHA256:O09r+CSX4Ub8S3klaRp86ahCLbBkxhb
+aXW7v8y/ANCI;bm90IHJlYWQ=;bm90IHJlYWQ=;bm90IHJlYWQ=";
+
+    #[test]
+    fn test_read_legacy() {
+        let info = read(&mut LEGACY_AES256.as_bytes()).unwrap();
+        assert_eq!(info.format, "AES256");
+        assert_eq!(
+            info.recipients[0].fingerprint,
+            "55:cd:f2:7e:4c:0b:e5:a7:6e:6c:fc:6b:8e:58:9d:13"
+        );
+
+        let info = read(&mut LEGACY_CHACHA20.as_bytes()).unwrap();
+        assert_eq!(info.format, "CHACHA20-POLY1305");
+        assert_eq!(
+            info.recipients[0].fingerprint,
+            "SHA256:O09r+CSX4Ub8S3klaRp86ahCLbBkxhbaXW7v8y/ANCI"
+        );
+
+        assert!(read(&mut "not a vault".as_bytes()).is_err());
+    }
+
+    #[test]
+    fn test_read_header_only() {
+        // the payload is not valid, only the header is read
+        let vault =
+            "SSH-VAULT;V2\n-> X25519 SHA256:abc AQID\n-> RSA-OAEP SHA256:def BA==\n---\n!!!!";
+        let info = read(&mut vault.as_bytes()).unwrap();
+        assert_eq!(info.format, "V2");
+        assert_eq!(
+            info.recipients,
+            vec![
+                Recipient {
+                    key_type: "X25519".to_string(),
+                    fingerprint: "SHA256:abc".to_string(),
+                },
+                Recipient {
+                    key_type: "RSA-OAEP".to_string(),
+                    fingerprint: "SHA256:def".to_string(),
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_scan() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::create_dir_all(dir.path().join("a/b")).unwrap();
+        fs::create_dir_all(dir.path().join(".git")).unwrap();
+        fs::write(dir.path().join("a/b/one.vault"), LEGACY_AES256).unwrap();
+        fs::write(dir.path().join("two"), LEGACY_CHACHA20).unwrap();
+        fs::write(dir.path().join(".git/three.vault"), LEGACY_AES256).unwrap();
+        fs::write(dir.path().join("README"), "SSH").unwrap();
+
+        let vaults = scan(dir.path()).unwrap();
+        assert_eq!(
+            vaults,
+            vec![dir.path().join("a/b/one.vault"), dir.path().join("two")]
+        );
+    }
+
+    #[test]
+    fn test_filter() {
+        let dir = Path::new("secrets");
+        let files = vec![
+            dir.join("db.env.vault"),
+            dir.join("prod/api.vault"),
+            dir.join("archive/2023/db.env.vault"),
+            dir.join("README"),
+        ];
+
+        let filter = Filter::new(&["*.vault".to_string()], &["archive/**".to_string()]).unwrap();
+        assert_eq!(
+            filter.apply(dir, files.clone()),
+            vec![dir.join("db.env.vault"), dir.join("prod/api.vault")]
+        );
+
+        let filter = Filter::new(&[], &[]).unwrap();
+        assert_eq!(filter.apply(dir, files.clone()), files);
+
+        let filter = Filter::new(&[], &["**/db.env.vault".to_string()]).unwrap();
+        assert_eq!(filter.apply(dir, files).len(), 2);
+
+        assert!(Filter::new(&["[".to_string()], &[]).is_err());
+    }
+}
@@ -0,0 +1,585 @@
+// In-process ssh-keyscan for `-u host:<host>[:port]`, the start of the SSH
+// transport (RFC 4253) with the curve25519-sha256 key exchange (RFC 8731):
+//
+//   -> SSH-2.0-ssh-vault_<version>     <- SSH-2.0-OpenSSH_9.6
+//   -> KEXINIT                         <- KEXINIT
+//   -> KEX_ECDH_INIT Q_C               <- KEX_ECDH_REPLY K_S Q_S signature
+//
+// the host key K_S is accepted once its signature of the exchange hash is
+// verified, the connection is closed before NEWKEYS. Like ssh-keyscan nothing
+// proves it is the key of the host, --strict pins it on first use
+//
+// A vault for the host key is opened on the host by root, with the key in
+// /etc/ssh or the agent holding it
+
+use crate::vault::remote;
+use anyhow::{anyhow, Context, Result};
+use rand::{rngs::OsRng, RngCore};
+use rsa::{pkcs1v15, signature::Verifier, RsaPublicKey};
+use sha2::{Digest, Sha256, Sha512};
+use ssh_key::PublicKey;
+use std::{
+    io::{BufRead, BufReader, Read, Write},
+    net::{TcpStream, ToSocketAddrs},
+    time::Duration,
+};
+use url::Url;
+use x25519_dalek::{EphemeralSecret, PublicKey as X25519PublicKey};
+
+pub const PREFIX: &str = "host:";
+
+const VERSION: &str = concat!("SSH-2.0-ssh-vault_", env!("CARGO_PKG_VERSION"));
+
+const KEX_ALGORITHMS: [&str; 2] = ["curve25519-sha256", "curve25519-sha256@libssh.org"];
+
+// the keys ssh-vault can encrypt for, ed25519 first
+const HOST_KEY_ALGORITHMS: [&str; 3] = ["ssh-ed25519", "rsa-sha2-512", "rsa-sha2-256"];
+
+// never used, the server only needs one in common to answer
+const CIPHERS: &str = "chacha20-poly1305@openssh.com,aes128-ctr,aes192-ctr,aes256-ctr,aes128-gcm@openssh.com,aes256-gcm@openssh.com";
+const MACS: &str = "hmac-sha2-256-etm@openssh.com,hmac-sha2-512-etm@openssh.com,hmac-sha2-256,hmac-sha2-512,hmac-sha1";
+const COMPRESSION: &str = "none,zlib@openssh.com";
+
+const TIMEOUT: Duration = Duration::from_secs(10);
+
+// RFC 4253 requires at least 35000 bytes
+const MAX_PACKET: usize = 256 * 1024;
+
+// lines the server may send before its version
+const MAX_BANNER_LINES: usize = 64;
+
+const MSG_DISCONNECT: u8 = 1;
+const MSG_IGNORE: u8 = 2;
+const MSG_UNIMPLEMENTED: u8 = 3;
+const MSG_DEBUG: u8 = 4;
+const MSG_KEXINIT: u8 = 20;
+const MSG_KEX_ECDH_INIT: u8 = 30;
+const MSG_KEX_ECDH_REPLY: u8 = 31;
+
+/// The host key of `host[:port]` as a line of public keys
+/// # Errors
+/// Will return an error if the host can't be reached or its key exchange
+/// fails
+pub fn host_keys(host: &str) -> Result<String> {
+    let url =
+        Url::parse(&format!("ssh://{host}")).with_context(|| format!("Invalid host {host}"))?;
+
+    let name = url
+        .host_str()
+        .filter(|_| url.path().is_empty() && url.username().is_empty())
+        .ok_or_else(|| anyhow!("Invalid host {host}, expected host[:port]"))?;
+
+    let key = host_key(name.trim_matches(['[', ']']), url.port().unwrap_or(22))?;
+
+    Ok(format!("{}\n", key.to_openssh()?))
+}
+
+/// Scan the host key, through the SOCKS proxy if set
+/// # Errors
+/// Will return an error if the host can't be reached or its key exchange
+/// fails
+pub fn host_key(host: &str, port: u16) -> Result<PublicKey> {
+    let stream = match remote::ssh_proxy()? {
+        Some(proxy) => socks5(&proxy, host, port)?,
+        None => connect((host, port)).with_context(|| format!("Could not connect to {host}"))?,
+    };
+
+    let mut key = exchange(&mut BufReader::new(&stream), &mut &stream)
+        .with_context(|| format!("Could not get the host key of {host}"))?;
+
+    key.set_comment(host);
+
+    Ok(key)
+}
+
+fn connect<A: ToSocketAddrs>(addr: A) -> Result<TcpStream> {
+    let mut error = None;
+
+    for addr in addr.to_socket_addrs()? {
+        match TcpStream::connect_timeout(&addr, TIMEOUT) {
+            Ok(stream) => {
+                stream.set_read_timeout(Some(TIMEOUT))?;
+                stream.set_write_timeout(Some(TIMEOUT))?;
+                return Ok(stream);
+            }
+            Err(e) => error = Some(e),
+        }
+    }
+
+    Err(error.map_or_else(|| anyhow!("No address found"), Into::into))
+}
+
+// CONNECT without authentication (RFC 1928), the proxy resolves the host
+fn socks5(proxy: &str, host: &str, port: u16) -> Result<TcpStream> {
+    let mut stream =
+        connect(proxy).with_context(|| format!("Could not connect to the proxy {proxy}"))?;
+
+    stream.write_all(&[5, 1, 0])?;
+
+    let mut reply = [0; 2];
+    stream.read_exact(&mut reply)?;
+
+    if reply != [5, 0] {
+        return Err(anyhow!("The SOCKS5 proxy {proxy} requires authentication"));
+    }
+
+    let mut request = vec![5, 1, 0, 3, u8::try_from(host.len())?];
+    request.extend_from_slice(host.as_bytes());
+    request.extend_from_slice(&port.to_be_bytes());
+    stream.write_all(&request)?;
+
+    let mut reply = [0; 4];
+    stream.read_exact(&mut reply)?;
+
+    if reply[1] != 0 {
+        return Err(anyhow!(
+            "The SOCKS5 proxy {proxy} could not connect to {host}:{port}, error {}",
+            reply[1]
+        ));
+    }
+
+    // the address the proxy bound, IPv4, domain or IPv6, and its port
+    let length = match reply[3] {
+        1 => 4,
+        4 => 16,
+        3 => {
+            let mut length = [0];
+            stream.read_exact(&mut length)?;
+            usize::from(length[0])
+        }
+        _ => return Err(anyhow!("Invalid reply of the SOCKS5 proxy {proxy}")),
+    };
+
+    stream.read_exact(&mut vec![0; length + 2])?;
+
+    Ok(stream)
+}
+
+// The key exchange up to the reply of the server, returns its verified key
+fn exchange<R: BufRead, W: Write>(reader: &mut R, writer: &mut W) -> Result<PublicKey> {
+    writer.write_all(format!("{VERSION}\r\n").as_bytes())?;
+
+    let server_version = read_version(reader)?;
+
+    let client_kexinit = kexinit(&KEX_ALGORITHMS, &HOST_KEY_ALGORITHMS);
+    write_packet(writer, &client_kexinit)?;
+
+    let server_kexinit = read_message(reader, MSG_KEXINIT)?;
+
+    // the message type and the cookie precede the name-lists
+    let mut lists = Decoder(server_kexinit.get(17..).unwrap_or_default());
+
+    negotiate(&KEX_ALGORITHMS, &lists.name_list()?)
+        .ok_or_else(|| anyhow!("The server doesn't support curve25519-sha256"))?;
+
+    let algorithm = negotiate(&HOST_KEY_ALGORITHMS, &lists.name_list()?)
+        .ok_or_else(|| anyhow!("The server has no ed25519 or rsa host key"))?;
+
+    let secret = EphemeralSecret::random();
+    let client_public = X25519PublicKey::from(&secret);
+
+    let mut init = vec![MSG_KEX_ECDH_INIT];
+    put_string(&mut init, client_public.as_bytes());
+    write_packet(writer, &init)?;
+
+    let reply = read_message(reader, MSG_KEX_ECDH_REPLY)?;
+    let mut decoder = Decoder(&reply[1..]);
+
+    let host_key = decoder.string()?;
+    let server_public: [u8; 32] = decoder
+        .string()?
+        .try_into()
+        .map_err(|_| anyhow!("Invalid key exchange reply"))?;
+    let signature = decoder.string()?;
+
+    let shared = secret.diffie_hellman(&X25519PublicKey::from(server_public));
+
+    if shared.as_bytes().iter().all(|byte| *byte == 0) {
+        return Err(anyhow!("Invalid key exchange reply"));
+    }
+
+    let hash = exchange_hash(
+        &[
+            VERSION.as_bytes(),
+            server_version.as_bytes(),
+            &client_kexinit,
+            &server_kexinit,
+            host_key,
+            client_public.as_bytes(),
+            &server_public,
+        ],
+        shared.as_bytes(),
+    );
+
+    let key = PublicKey::from_bytes(host_key).context("Invalid host key")?;
+
+    verify(&key, algorithm, &hash, signature)?;
+
+    Ok(key)
+}
+
+fn read_version<R: BufRead>(reader: &mut R) -> Result<String> {
+    for _ in 0..MAX_BANNER_LINES {
+        let mut line = String::new();
+        reader.take(256).read_line(&mut line)?;
+
+        if !line.ends_with('\n') {
+            return Err(anyhow!("Not an SSH server"));
+        }
+
+        let line = line.trim_end();
+
+        if line.starts_with("SSH-2.0-") || line.starts_with("SSH-1.99-") {
+            return Ok(line.to_string());
+        }
+
+        if line.starts_with("SSH-") {
+            return Err(anyhow!("Unsupported protocol version {line}"));
+        }
+    }
+
+    Err(anyhow!("Not an SSH server"))
+}
+
+fn kexinit(kex_algorithms: &[&str], host_key_algorithms: &[&str]) -> Vec<u8> {
+    let mut payload = vec![MSG_KEXINIT];
+
+    let mut cookie = [0; 16];
+    OsRng.fill_bytes(&mut cookie);
+    payload.extend_from_slice(&cookie);
+
+    for list in [
+        kex_algorithms.join(",").as_str(),
+        host_key_algorithms.join(",").as_str(),
+        CIPHERS,
+        CIPHERS,
+        MACS,
+        MACS,
+        COMPRESSION,
+        COMPRESSION,
+        "",
+        "",
+    ] {
+        put_string(&mut payload, list.as_bytes());
+    }
+
+    // first_kex_packet_follows and reserved
+    payload.extend_from_slice(&[0; 5]);
+
+    payload
+}
+
+// The first algorithm of the client the server supports
+fn negotiate(client: &[&'static str], server: &[&str]) -> Option<&'static str> {
+    client
+        .iter()
+        .find(|algorithm| server.contains(algorithm))
+        .copied()
+}
+
+fn exchange_hash(strings: &[&[u8]], shared: &[u8]) -> Vec<u8> {
+    let mut data = Vec::new();
+
+    for string in strings {
+        put_string(&mut data, string);
+    }
+
+    put_mpint(&mut data, shared);
+
+    Sha256::digest(&data).to_vec()
+}
+
+fn verify(key: &PublicKey, algorithm: &str, hash: &[u8], signature: &[u8]) -> Result<()> {
+    let mut decoder = Decoder(signature);
+
+    let name = decoder.string()?;
+    let signature = decoder.string()?;
+
+    if name != algorithm.as_bytes() {
+        return Err(anyhow!("The host key signature is not {algorithm}"));
+    }
+
+    let invalid = || anyhow!("Invalid signature of the host key");
+
+    match algorithm {
+        "ssh-ed25519" => {
+            let key = key.key_data().ed25519().ok_or_else(invalid)?;
+
+            ed25519_dalek::VerifyingKey::try_from(key)?
+                .verify_strict(
+                    hash,
+                    &ed25519_dalek::Signature::from_slice(signature).map_err(|_| invalid())?,
+                )
+                .map_err(|_| invalid())
+        }
+        "rsa-sha2-512" | "rsa-sha2-256" => {
+            let key = RsaPublicKey::try_from(key.key_data().rsa().ok_or_else(invalid)?)?;
+            let signature = pkcs1v15::Signature::try_from(signature).map_err(|_| invalid())?;
+
+            if algorithm == "rsa-sha2-512" {
+                pkcs1v15::VerifyingKey::<Sha512>::new(key).verify(hash, &signature)
+            } else {
+                pkcs1v15::VerifyingKey::<Sha256>::new(key).verify(hash, &signature)
+            }
+            .map_err(|_| invalid())
+        }
+        _ => Err(invalid()),
+    }
+}
+
+// The next message of the expected type, skipping the ones a server may send
+// at any time
+fn read_message<R: Read>(reader: &mut R, expected: u8) -> Result<Vec<u8>> {
+    loop {
+        let payload = read_packet(reader)?;
+
+        match payload[0] {
+            MSG_IGNORE | MSG_DEBUG | MSG_UNIMPLEMENTED => continue,
+            MSG_DISCONNECT => {
+                let mut decoder = Decoder(&payload[1..]);
+                decoder.u32()?;
+
+                return Err(anyhow!(
+                    "Disconnected: {}",
+                    String::from_utf8_lossy(decoder.string()?)
+                ));
+            }
+            message if message == expected => return Ok(payload),
+            message => return Err(anyhow!("Unexpected message {message}")),
+        }
+    }
+}
+
+// uint32 length, byte padding length, payload and padding, unencrypted
+fn read_packet<R: Read>(reader: &mut R) -> Result<Vec<u8>> {
+    let mut length = [0; 4];
+    reader.read_exact(&mut length)?;
+
+    let length = usize::try_from(u32::from_be_bytes(length))?;
+
+    if !(2..=MAX_PACKET).contains(&length) {
+        return Err(anyhow!("Invalid packet"));
+    }
+
+    let mut packet = vec![0; length];
+    reader.read_exact(&mut packet)?;
+
+    let padding = usize::from(packet[0]);
+
+    packet
+        .get(1..length.saturating_sub(padding))
+        .filter(|payload| !payload.is_empty())
+        .map(<[u8]>::to_vec)
+        .ok_or_else(|| anyhow!("Invalid packet"))
+}
+
+fn write_packet<W: Write>(writer: &mut W, payload: &[u8]) -> Result<()> {
+    // at least 4 bytes of padding, the packet is a multiple of 8
+    let mut padding = 8 - (5 + payload.len()) % 8;
+    if padding < 4 {
+        padding += 8;
+    }
+
+    let mut packet = Vec::with_capacity(5 + payload.len() + padding);
+    packet.extend_from_slice(&u32::try_from(1 + payload.len() + padding)?.to_be_bytes());
+    packet.push(u8::try_from(padding)?);
+    packet.extend_from_slice(payload);
+    packet.resize(packet.len() + padding, 0);
+
+    writer.write_all(&packet)?;
+
+    Ok(writer.flush()?)
+}
+
+fn put_string(buf: &mut Vec<u8>, string: &[u8]) {
+    buf.extend_from_slice(
+        &u32::try_from(string.len())
+            .unwrap_or(u32::MAX)
+            .to_be_bytes(),
+    );
+    buf.extend_from_slice(string);
+}
+
+// unsigned big-endian integer without leading zeros, a zero byte keeps it
+// positive
+fn put_mpint(buf: &mut Vec<u8>, bytes: &[u8]) {
+    let start = bytes
+        .iter()
+        .position(|byte| *byte != 0)
+        .unwrap_or(bytes.len());
+    let bytes = &bytes[start..];
+
+    if bytes.first().is_some_and(|byte| byte & 0x80 != 0) {
+        put_string(buf, &[&[0], bytes].concat());
+    } else {
+        put_string(buf, bytes);
+    }
+}
+
+struct Decoder<'a>(&'a [u8]);
+
+impl<'a> Decoder<'a> {
+    fn u32(&mut self) -> Result<u32> {
+        let (bytes, rest) = self
+            .0
+            .split_first_chunk::<4>()
+            .ok_or_else(|| anyhow!("Invalid message"))?;
+
+        self.0 = rest;
+
+        Ok(u32::from_be_bytes(*bytes))
+    }
+
+    fn string(&mut self) -> Result<&'a [u8]> {
+        let length = usize::try_from(self.u32()?)?;
+
+        if length > self.0.len() {
+            return Err(anyhow!("Invalid message"));
+        }
+
+        let (string, rest) = self.0.split_at(length);
+        self.0 = rest;
+
+        Ok(string)
+    }
+
+    fn name_list(&mut self) -> Result<Vec<&'a str>> {
+        Ok(std::str::from_utf8(self.string()?)?.split(',').collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, SshKeyType};
+    use ed25519_dalek::{Signer, SigningKey};
+    use ssh_key::private::KeypairData;
+    use std::{net::TcpListener, path::Path, thread};
+
+    // The server side of the exchange with test_data/ed25519, a wrong
+    // signature if tampered
+    fn server(listener: &TcpListener, tampered: bool) -> Result<()> {
+        let private_key =
+            find::private_key(Some("test_data/ed25519".to_string()), &SshKeyType::Ed25519)?;
+
+        let KeypairData::Ed25519(keypair) = private_key.key_data() else {
+            return Err(anyhow!("not an ed25519 key"));
+        };
+
+        let signing_key = SigningKey::from_bytes(&keypair.private.to_bytes());
+        let host_key = private_key.public_key().to_bytes()?;
+
+        let (stream, _) = listener.accept()?;
+        let mut reader = BufReader::new(&stream);
+        let mut writer = &stream;
+
+        writer.write_all(b"Welcome\r\nSSH-2.0-Test_1.0\r\n")?;
+
+        let client_version = read_version(&mut reader)?;
+
+        let server_kexinit = kexinit(&["curve25519-sha256"], &["rsa-sha2-512", "ssh-ed25519"]);
+        write_packet(&mut writer, &[MSG_IGNORE])?;
+        write_packet(&mut writer, &server_kexinit)?;
+
+        let client_kexinit = read_message(&mut reader, MSG_KEXINIT)?;
+        let init = read_message(&mut reader, MSG_KEX_ECDH_INIT)?;
+        let client_public: [u8; 32] = Decoder(&init[1..]).string()?.try_into().unwrap();
+
+        let secret = EphemeralSecret::random();
+        let server_public = X25519PublicKey::from(&secret);
+        let shared = secret.diffie_hellman(&X25519PublicKey::from(client_public));
+
+        let mut hash = exchange_hash(
+            &[
+                client_version.as_bytes(),
+                b"SSH-2.0-Test_1.0",
+                &client_kexinit,
+                &server_kexinit,
+                &host_key,
+                &client_public,
+                server_public.as_bytes(),
+            ],
+            shared.as_bytes(),
+        );
+
+        if tampered {
+            hash[0] ^= 1;
+        }
+
+        let mut signature = Vec::new();
+        put_string(&mut signature, b"ssh-ed25519");
+        put_string(&mut signature, &signing_key.sign(&hash).to_bytes());
+
+        let mut reply = vec![MSG_KEX_ECDH_REPLY];
+        put_string(&mut reply, &host_key);
+        put_string(&mut reply, server_public.as_bytes());
+        put_string(&mut reply, &signature);
+        write_packet(&mut writer, &reply)?;
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_host_key() {
+        let expected = PublicKey::read_openssh_file(Path::new("test_data/ed25519.pub")).unwrap();
+
+        for tampered in [false, true] {
+            let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+            let port = listener.local_addr().unwrap().port();
+
+            let server = thread::spawn(move || server(&listener, tampered));
+
+            let key = host_key("127.0.0.1", port);
+
+            server.join().unwrap().unwrap();
+
+            if tampered {
+                assert!(key.is_err());
+            } else {
+                let key = key.unwrap();
+                assert_eq!(key.key_data(), expected.key_data());
+                assert_eq!(key.comment(), "127.0.0.1");
+            }
+        }
+    }
+
+    #[test]
+    fn test_packet() {
+        let mut packet = Vec::new();
+        write_packet(&mut packet, b"payload").unwrap();
+        assert_eq!(packet.len() % 8, 0);
+        assert_eq!(read_packet(&mut packet.as_slice()).unwrap(), b"payload");
+
+        assert!(read_packet(&mut &[0, 0, 0, 1, 0][..]).is_err());
+        assert!(read_packet(&mut &[0xff, 0, 0, 0][..]).is_err());
+    }
+
+    #[test]
+    fn test_put_mpint() {
+        let mut buf = Vec::new();
+        put_mpint(&mut buf, &[0, 0, 0x80, 1]);
+        assert_eq!(buf, [0, 0, 0, 3, 0, 0x80, 1]);
+
+        let mut buf = Vec::new();
+        put_mpint(&mut buf, &[0, 0x7f]);
+        assert_eq!(buf, [0, 0, 0, 1, 0x7f]);
+    }
+
+    #[test]
+    fn test_negotiate() {
+        assert_eq!(
+            negotiate(&HOST_KEY_ALGORITHMS, &["rsa-sha2-256", "ssh-ed25519"]),
+            Some("ssh-ed25519")
+        );
+        assert_eq!(
+            negotiate(&KEX_ALGORITHMS, &["diffie-hellman-group14-sha256"]),
+            None
+        );
+    }
+
+    #[test]
+    fn test_host_keys_invalid() {
+        assert!(host_keys("alice@server").is_err());
+        assert!(host_keys("server/path").is_err());
+    }
+}
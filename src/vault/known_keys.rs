@@ -0,0 +1,118 @@
+use crate::cache;
+use anyhow::{anyhow, Result};
+use ssh_key::{HashAlg, PublicKey};
+use std::{
+    fs::{self, OpenOptions},
+    io::Write,
+    path::{Path, PathBuf},
+};
+
+/// Trust on first use: pin the fingerprints of the keys fetched for a user the
+/// first time, warn (or fail if strict) if a later fetch returns another key
+/// # Errors
+/// Will return an error if the key changed and strict is set or the pins can't be saved
+pub fn check(user: &str, keys: &str, key: &PublicKey, strict: bool) -> Result<()> {
+    check_file(&get_known_keys_path()?, user, keys, key, strict)
+}
+
+fn check_file(path: &Path, user: &str, keys: &str, key: &PublicKey, strict: bool) -> Result<()> {
+    let fingerprint = key.fingerprint(HashAlg::Sha256).to_string();
+    let pinned = pinned(path, user)?;
+
+    if pinned.is_empty() {
+        return pin(path, user, keys);
+    }
+
+    if pinned.contains(&fingerprint) {
+        return Ok(());
+    }
+
+    let message = format!(
+        "The key {fingerprint} for {user} does not match the keys seen the first time. \
+        If the change is expected, remove the {user} entries from {}",
+        path.display()
+    );
+
+    if strict {
+        Err(anyhow!(message))
+    } else {
+        eprintln!("WARNING: REMOTE KEY CHANGED! {message}");
+        Ok(())
+    }
+}
+
+// fingerprints pinned for the user
+fn pinned(path: &Path, user: &str) -> Result<Vec<String>> {
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+
+    Ok(fs::read_to_string(path)?
+        .lines()
+        .filter_map(|line| line.split_once(' '))
+        .filter(|(u, _)| *u == user)
+        .map(|(_, fingerprint)| fingerprint.trim().to_string())
+        .collect())
+}
+
+// pin all the fetched keys of the user
+fn pin(path: &Path, user: &str, keys: &str) -> Result<()> {
+    if let Some(parent_dir) = path.parent() {
+        fs::create_dir_all(parent_dir)?;
+    }
+
+    let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+
+    for line in keys.lines() {
+        if let Ok(key) = PublicKey::from_openssh(line) {
+            writeln!(file, "{user} {}", key.fingerprint(HashAlg::Sha256))?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Get the path to the pinned keys ~/.ssh/vault/known_keys
+/// # Errors
+/// Return an error if we can't get the path to the ssh-vault directory
+fn get_known_keys_path() -> Result<PathBuf> {
+    Ok(cache::get_ssh_vault_path()?.join("known_keys"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const KEY_1: &str =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINixf2m2nj8TDeazbWuemUY8ZHNg7znA7hVPN8TJLr2W";
+    const KEY_2: &str =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKdb5/i8sIEZ84k+LpJCAxRwxUZsP2MHFWApeB2TSUux ssh-vault";
+
+    #[test]
+    fn test_check_file() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("known_keys");
+
+        let key_1 = PublicKey::from_openssh(KEY_1).unwrap();
+        let key_2 = PublicKey::from_openssh(KEY_2).unwrap();
+
+        // first use pins the key
+        assert!(check_file(&path, "alice", KEY_1, &key_1, true).is_ok());
+        assert_eq!(
+            pinned(&path, "alice").unwrap(),
+            vec![key_1.fingerprint(HashAlg::Sha256).to_string()]
+        );
+
+        // same key
+        assert!(check_file(&path, "alice", KEY_1, &key_1, true).is_ok());
+
+        // key changed
+        assert!(check_file(&path, "alice", KEY_2, &key_2, true).is_err());
+        assert!(check_file(&path, "alice", KEY_2, &key_2, false).is_ok());
+
+        // other users are pinned independently
+        assert!(check_file(&path, "bob", KEY_2, &key_2, true).is_ok());
+        assert_eq!(pinned(&path, "alice").unwrap().len(), 1);
+        assert_eq!(pinned(&path, "bob").unwrap().len(), 1);
+    }
+}
@@ -0,0 +1,184 @@
+// Bitnami Sealed Secrets, a Kubernetes Secret encrypted by kubeseal for the
+// public certificate of the controller of the cluster, safe to commit and
+// decrypted by the controller into the Secret:
+//
+//   ssh-vault export sealed-secrets secrets -o manifests --namespace prod
+//
+// The vaults with KEY=VALUE lines get a key per variable, the others a key
+// named after the file
+
+use crate::vault::dotenv;
+use anyhow::{anyhow, Context, Result};
+use base64ct::{Base64, Encoding};
+use serde_json::{json, Map, Value};
+use std::{
+    io::Write,
+    path::Path,
+    process::{Command, Stdio},
+};
+
+/// Extension of the manifests
+pub const EXTENSION: &str = "yaml";
+
+/// Name of the Secret, the path of the vault without the extension and with
+/// `-` instead of `/`, e.g. prod/db.env.vault is prod-db.env
+/// # Errors
+/// Will return an error if the name is not valid in Kubernetes
+pub fn name(vault: &Path) -> Result<String> {
+    let path = if vault.extension().map_or(false, |ext| ext == "vault") {
+        vault.with_extension("")
+    } else {
+        vault.to_path_buf()
+    };
+
+    let name = path
+        .iter()
+        .map(|part| part.to_string_lossy().to_lowercase().replace('_', "-"))
+        .collect::<Vec<_>>()
+        .join("-");
+
+    // a DNS subdomain, RFC 1123 labels separated by dots
+    let valid = name.len() <= 253
+        && name.split('.').all(|label| {
+            label.starts_with(|c: char| c.is_ascii_alphanumeric())
+                && label.ends_with(|c: char| c.is_ascii_alphanumeric())
+                && label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+        });
+
+    if !valid {
+        return Err(anyhow!(
+            "{} is not a valid Kubernetes name",
+            vault.display()
+        ));
+    }
+
+    Ok(name)
+}
+
+/// Secret manifest with the plaintext of the vault
+/// # Errors
+/// Will return an error if a key is not valid in Kubernetes
+pub fn secret(name: &str, namespace: Option<&str>, key: &str, plaintext: &[u8]) -> Result<String> {
+    let mut data = Map::new();
+
+    // KEY=VALUE lines or a single key with the whole plaintext
+    let vars = std::str::from_utf8(plaintext)
+        .ok()
+        .and_then(|text| dotenv::parse(text).ok())
+        .filter(|vars| !vars.is_empty());
+
+    match vars {
+        Some(vars) => {
+            for (key, value) in vars {
+                data.insert(key, Value::String(Base64::encode_string(value.as_bytes())));
+            }
+        }
+        None => {
+            if !valid_key(key) {
+                return Err(anyhow!("{key} is not a valid key of a Secret"));
+            }
+
+            data.insert(
+                key.to_string(),
+                Value::String(Base64::encode_string(plaintext)),
+            );
+        }
+    }
+
+    let mut metadata = Map::new();
+    metadata.insert("name".to_string(), Value::String(name.to_string()));
+
+    if let Some(namespace) = namespace {
+        metadata.insert(
+            "namespace".to_string(),
+            Value::String(namespace.to_string()),
+        );
+    }
+
+    Ok(json!({
+        "apiVersion": "v1",
+        "kind": "Secret",
+        "metadata": metadata,
+        "type": "Opaque",
+        "data": data,
+    })
+    .to_string())
+}
+
+/// Encrypt the Secret with kubeseal into the `SealedSecret` manifest, for the
+/// certificate or the one of the controller of the current cluster
+/// # Errors
+/// Will return an error if kubeseal fails
+pub fn seal(secret: &str, cert: Option<&str>) -> Result<Vec<u8>> {
+    let mut command = Command::new("kubeseal");
+    command.args(["--format", "yaml"]);
+
+    if let Some(cert) = cert {
+        command.args(["--cert", cert]);
+    }
+
+    let mut child = command
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .context("Could not run kubeseal")?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(secret.as_bytes())?;
+    }
+
+    let output = child.wait_with_output()?;
+
+    if !output.status.success() {
+        return Err(anyhow!(
+            "kubeseal failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+
+    Ok(output.stdout)
+}
+
+// keys of the data of a Secret
+fn valid_key(key: &str) -> bool {
+    !key.is_empty()
+        && key
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_name() {
+        assert_eq!(name(Path::new("prod/db.env.vault")).unwrap(), "prod-db.env");
+        assert_eq!(name(Path::new("API_Token.vault")).unwrap(), "api-token");
+        assert!(name(Path::new("prod/.env.vault")).is_err());
+        assert!(name(Path::new("tls key.vault")).is_err());
+    }
+
+    #[test]
+    fn test_secret() {
+        let manifest: Value = serde_json::from_str(
+            &secret("db", Some("prod"), "db.env", b"USER=app\nPASSWORD=s3cr3t\n").unwrap(),
+        )
+        .unwrap();
+
+        assert_eq!(manifest["kind"], "Secret");
+        assert_eq!(manifest["metadata"]["name"], "db");
+        assert_eq!(manifest["metadata"]["namespace"], "prod");
+        assert_eq!(manifest["data"]["USER"], "YXBw");
+        assert_eq!(manifest["data"]["PASSWORD"], "czNjcjN0");
+
+        let manifest: Value =
+            serde_json::from_str(&secret("tls", None, "tls.key", b"-----BEGIN").unwrap()).unwrap();
+
+        assert!(manifest["metadata"].get("namespace").is_none());
+        assert_eq!(manifest["data"]["tls.key"], "LS0tLS1CRUdJTg==");
+
+        assert!(secret("tls", None, "tls key", b"-----BEGIN").is_err());
+    }
+}
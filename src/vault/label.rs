@@ -0,0 +1,132 @@
+// Label of a vault, a short description readable without the key so that a
+// directory of vaults can be browsed with `ssh-vault info`:
+//
+//  +> label <tag> prod DB creds
+//
+// the tag is an HMAC of the label with a key derived from the vault key, the
+// label is checked when the vault is opened and only the recipients can change
+// it with `ssh-vault relabel`
+
+use crate::exit::Failure;
+use crate::vault::crypto;
+use anyhow::{anyhow, Result};
+use secrecy::Secret;
+use std::fmt;
+
+/// Start of the label line of the header
+pub const PREFIX: &str = "+> label";
+
+/// Maximum length of a label in characters
+pub const MAX_LEN: usize = 200;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Label {
+    pub text: String,
+    tag: String,
+}
+
+impl Label {
+    /// Label the vault with the text, authenticated with the vault key
+    /// # Errors
+    /// Will return an error if the text is empty, too long or has control
+    /// characters
+    pub fn new(text: &str, key: &Secret<[u8; 32]>) -> Result<Self> {
+        validate(text)?;
+
+        Ok(Self {
+            text: text.to_string(),
+            tag: crypto::header_tag(key, "label", text.as_bytes())?,
+        })
+    }
+
+    /// Parse a `+> label <tag> <text>` line
+    /// # Errors
+    /// Will return an error if the line is not a valid label
+    pub fn parse(line: &str) -> Result<Self> {
+        let (tag, text) = line
+            .strip_prefix(PREFIX)
+            .and_then(|rest| rest.strip_prefix(' '))
+            .and_then(|rest| rest.split_once(' '))
+            .ok_or_else(|| anyhow!("Not a label line"))?;
+
+        validate(text)?;
+
+        Ok(Self {
+            text: text.to_string(),
+            tag: tag.to_string(),
+        })
+    }
+
+    /// Check the label was set by a recipient of the vault
+    /// # Errors
+    /// Will return an error if the label was modified
+    pub fn verify(&self, key: &Secret<[u8; 32]>) -> Result<()> {
+        let tag = crypto::header_tag(key, "label", self.text.as_bytes())?;
+
+        if crypto::ct_eq(self.tag.as_bytes(), tag.as_bytes()) {
+            Ok(())
+        } else {
+            Err(Failure::Corrupt
+                .error("The label of the vault was modified, it was not set by a recipient"))
+        }
+    }
+}
+
+impl fmt::Display for Label {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{PREFIX} {} {}", self.tag, self.text)
+    }
+}
+
+fn validate(text: &str) -> Result<()> {
+    if text.trim().is_empty() {
+        return Err(anyhow!("The label is empty"));
+    }
+
+    if text.chars().count() > MAX_LEN {
+        return Err(anyhow!("The label is longer than {MAX_LEN} characters"));
+    }
+
+    if text.chars().any(char::is_control) {
+        return Err(anyhow!("The label can't have control characters"));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_label() {
+        let key = crypto::gen_password().unwrap();
+        let label = Label::new("prod DB creds", &key).unwrap();
+
+        let line = label.to_string();
+        assert!(line.starts_with("+> label "));
+        assert!(line.ends_with(" prod DB creds"));
+
+        let parsed = Label::parse(&line).unwrap();
+        assert_eq!(parsed, label);
+        assert!(parsed.verify(&key).is_ok());
+
+        // another key or text fails the check
+        assert!(parsed.verify(&crypto::gen_password().unwrap()).is_err());
+
+        let forged = Label::parse(&line.replace("prod", "test")).unwrap();
+        assert!(forged.verify(&key).is_err());
+    }
+
+    #[test]
+    fn test_validate() {
+        let key = crypto::gen_password().unwrap();
+
+        assert!(Label::new("", &key).is_err());
+        assert!(Label::new("line\nbreak", &key).is_err());
+        assert!(Label::new(&"x".repeat(MAX_LEN + 1), &key).is_err());
+        assert!(Label::new(&"x".repeat(MAX_LEN), &key).is_ok());
+        assert!(Label::parse("+> label").is_err());
+        assert!(Label::parse("+> labels tag text").is_err());
+    }
+}
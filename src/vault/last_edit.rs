@@ -0,0 +1,162 @@
+// Who edited the vault last and when, recorded by `ssh-vault edit` so that
+// `ssh-vault info` shows some provenance without the key:
+//
+//  +> edited <tag> SHA256:<fingerprint> 1700000000 alice@laptop
+//
+// the comment of the ssh key is optional, the line is authenticated with the
+// vault key like the label
+
+use crate::exit::Failure;
+use crate::vault::{crypto, SshVault};
+use anyhow::{anyhow, Result};
+use secrecy::Secret;
+use std::{
+    fmt,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+/// Start of the last edit line of the header
+pub const PREFIX: &str = "+> edited";
+
+// longest comment kept, the comment is only informative
+const MAX_COMMENT: usize = 100;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LastEdit {
+    pub fingerprint: String,
+    // seconds since the epoch
+    pub time: u64,
+    pub comment: String,
+    tag: String,
+}
+
+impl LastEdit {
+    /// Record an edit made now with the key of the vault
+    /// # Errors
+    /// Will return an error if the clock is before the epoch
+    pub fn now(vault: &SshVault, key: &Secret<[u8; 32]>) -> Result<Self> {
+        let time = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs();
+
+        Self::new(&vault.fingerprint(), time, vault.comment(), key)
+    }
+
+    /// Record an edit, control characters are removed from the comment
+    /// # Errors
+    /// Will return an error if the fingerprint is not valid
+    pub fn new(
+        fingerprint: &str,
+        time: u64,
+        comment: &str,
+        key: &Secret<[u8; 32]>,
+    ) -> Result<Self> {
+        if fingerprint.is_empty() || fingerprint.contains(char::is_whitespace) {
+            return Err(anyhow!("Invalid fingerprint: {fingerprint}"));
+        }
+
+        let comment: String = comment
+            .chars()
+            .filter(|c| !c.is_control())
+            .take(MAX_COMMENT)
+            .collect();
+
+        let mut edit = Self {
+            fingerprint: fingerprint.to_string(),
+            time,
+            comment: comment.trim().to_string(),
+            tag: String::new(),
+        };
+
+        edit.tag = crypto::header_tag(key, "edited", edit.data().as_bytes())?;
+
+        Ok(edit)
+    }
+
+    /// Parse a `+> edited <tag> <fingerprint> <time> [comment]` line
+    /// # Errors
+    /// Will return an error if the line is not valid
+    pub fn parse(line: &str) -> Result<Self> {
+        let rest = line
+            .strip_prefix(PREFIX)
+            .and_then(|rest| rest.strip_prefix(' '))
+            .ok_or_else(|| anyhow!("Not a last edit line"))?;
+
+        let mut fields = rest.splitn(4, ' ');
+
+        let (Some(tag), Some(fingerprint), Some(time)) =
+            (fields.next(), fields.next(), fields.next())
+        else {
+            return Err(anyhow!("Invalid last edit line"));
+        };
+
+        Ok(Self {
+            fingerprint: fingerprint.to_string(),
+            time: time
+                .parse()
+                .map_err(|_| anyhow!("Invalid last edit time"))?,
+            comment: fields.next().unwrap_or_default().to_string(),
+            tag: tag.to_string(),
+        })
+    }
+
+    /// Check the edit was recorded by a recipient of the vault
+    /// # Errors
+    /// Will return an error if the line was modified
+    pub fn verify(&self, key: &Secret<[u8; 32]>) -> Result<()> {
+        let tag = crypto::header_tag(key, "edited", self.data().as_bytes())?;
+
+        if crypto::ct_eq(self.tag.as_bytes(), tag.as_bytes()) {
+            Ok(())
+        } else {
+            Err(Failure::Corrupt.error(
+                "The last edit of the vault was modified, it was not recorded by a recipient",
+            ))
+        }
+    }
+
+    // the authenticated fields, as written after the tag
+    fn data(&self) -> String {
+        if self.comment.is_empty() {
+            format!("{} {}", self.fingerprint, self.time)
+        } else {
+            format!("{} {} {}", self.fingerprint, self.time, self.comment)
+        }
+    }
+}
+
+impl fmt::Display for LastEdit {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{PREFIX} {} {}", self.tag, self.data())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_last_edit() {
+        let key = crypto::gen_password().unwrap();
+        let edit = LastEdit::new("SHA256:abc", 1_700_000_000, "alice@laptop\n", &key).unwrap();
+        assert_eq!(edit.comment, "alice@laptop");
+
+        let line = edit.to_string();
+        assert!(line.starts_with("+> edited "));
+        assert!(line.ends_with(" SHA256:abc 1700000000 alice@laptop"));
+
+        let parsed = LastEdit::parse(&line).unwrap();
+        assert_eq!(parsed, edit);
+        assert!(parsed.verify(&key).is_ok());
+        assert!(parsed.verify(&crypto::gen_password().unwrap()).is_err());
+
+        let forged = LastEdit::parse(&line.replace("alice", "mallory")).unwrap();
+        assert!(forged.verify(&key).is_err());
+
+        // the comment is optional
+        let edit = LastEdit::new("SHA256:abc", 1, "", &key).unwrap();
+        assert_eq!(LastEdit::parse(&edit.to_string()).unwrap(), edit);
+
+        assert!(LastEdit::parse("+> edited tag SHA256:abc").is_err());
+        assert!(LastEdit::parse("+> edited tag SHA256:abc now").is_err());
+        assert!(LastEdit::new("", 1, "", &key).is_err());
+    }
+}
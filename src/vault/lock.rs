@@ -0,0 +1,133 @@
+use crate::interrupt;
+use anyhow::{anyhow, Result};
+use std::{
+    env,
+    fs::{self, OpenOptions},
+    io::{ErrorKind, Write},
+    path::{Path, PathBuf},
+    process,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+/// Advisory lock on a vault, held while it is being edited.
+/// The lock file `<vault>.lock` is removed when the lock is dropped.
+#[derive(Debug)]
+pub struct Lock {
+    path: PathBuf,
+    // removes the lock file if the process is interrupted
+    _interrupted: interrupt::Guard,
+}
+
+impl Lock {
+    /// Take the lock for the given vault
+    /// # Errors
+    /// Will return an error if the vault is already locked, showing who holds the lock
+    pub fn acquire(vault: &str) -> Result<Self> {
+        let path = PathBuf::from(format!("{vault}.lock"));
+
+        match OpenOptions::new().write(true).create_new(true).open(&path) {
+            Ok(mut file) => {
+                let interrupted = {
+                    let path = path.clone();
+                    interrupt::on_interrupt(move || {
+                        let _ = fs::remove_file(path);
+                    })
+                };
+
+                let lock = Self {
+                    path,
+                    _interrupted: interrupted,
+                };
+                file.write_all(holder().as_bytes())?;
+                Ok(lock)
+            }
+            Err(e) if e.kind() == ErrorKind::AlreadyExists => Err(anyhow!(
+                "{vault} is being edited by {}, if that is not the case remove {}",
+                describe(&path),
+                path.display()
+            )),
+            Err(e) => Err(anyhow!("Could not lock {vault}: {e}")),
+        }
+    }
+
+    #[must_use]
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+impl Drop for Lock {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.path);
+    }
+}
+
+// user@host pid timestamp
+fn holder() -> String {
+    let user = env::var("USER")
+        .or_else(|_| env::var("USERNAME"))
+        .unwrap_or_else(|_| String::from("unknown"));
+
+    let host = env::var("HOSTNAME")
+        .or_else(|_| env::var("COMPUTERNAME"))
+        .or_else(|_| fs::read_to_string("/etc/hostname").map(|h| h.trim().to_string()))
+        .unwrap_or_else(|_| String::from("localhost"));
+
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs();
+
+    format!("{user}@{host} {} {now}\n", process::id())
+}
+
+// Human readable owner of an existing lock file
+fn describe(path: &Path) -> String {
+    let content = fs::read_to_string(path).unwrap_or_default();
+    let mut fields = content.split_whitespace();
+
+    match (fields.next(), fields.next(), fields.next()) {
+        (Some(owner), Some(pid), Some(since)) => {
+            let since = since
+                .parse::<u64>()
+                .ok()
+                .map(|secs| UNIX_EPOCH + Duration::from_secs(secs))
+                .and_then(|t| SystemTime::now().duration_since(t).ok())
+                .map_or_else(String::new, |d| {
+                    format!(" since {} minutes ago", d.as_secs() / 60)
+                });
+            format!("{owner} (pid {pid}){since}")
+        }
+        _ => String::from("another process"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::NamedTempFile;
+
+    #[test]
+    fn test_lock() {
+        let vault = NamedTempFile::new().unwrap();
+        let vault = vault.path().to_str().unwrap();
+
+        let lock = Lock::acquire(vault).unwrap();
+        assert!(lock.path().exists());
+
+        let content = fs::read_to_string(lock.path()).unwrap();
+        assert!(content.contains(&format!(" {} ", process::id())));
+
+        let err = Lock::acquire(vault).unwrap_err().to_string();
+        assert!(err.contains("is being edited by"));
+        assert!(err.contains(&format!("(pid {})", process::id())));
+
+        let path = lock.path().to_path_buf();
+        drop(lock);
+        assert!(!path.exists());
+
+        // lock can be taken again once released
+        let lock = Lock::acquire(vault);
+        assert!(lock.is_ok());
+    }
+}
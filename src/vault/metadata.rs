@@ -0,0 +1,336 @@
+// Metadata of the file a vault was created from, kept in the header of the
+// vault to restore the file with its mode, owner and modification time:
+//
+//  +> file <tag> mode=755 uid=1000 gid=1000 mtime=1700000000
+//
+// the tag is an HMAC of the attributes with a key derived from the vault key
+// like the label, the attributes are only restored once checked
+
+use crate::exit::Failure;
+use crate::vault::crypto;
+use anyhow::{anyhow, Result};
+use base64ct::{Base64, Encoding};
+use secrecy::Secret;
+use std::{
+    fmt, fs,
+    path::Path,
+    time::{Duration, UNIX_EPOCH},
+};
+
+/// Start of the metadata line of the header
+pub const PREFIX: &str = "+> file";
+
+/// Attributes that can be recorded, `mode` is recorded by default
+pub const ATTRIBUTES: [&str; 4] = ["mode", "owner", "mtime", "none"];
+
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Metadata {
+    pub mode: Option<u32>,
+    // uid and gid
+    pub owner: Option<(u32, u32)>,
+    // seconds since the epoch
+    pub mtime: Option<u64>,
+    // empty until tagged with the vault key
+    tag: String,
+}
+
+impl Metadata {
+    /// Record the attributes of a file
+    /// # Errors
+    /// Will return an error if the metadata of the file can't be read
+    pub fn from_file(path: &Path, attributes: &[String]) -> Result<Self> {
+        let metadata = fs::metadata(path)?;
+        let has = |attribute: &str| attributes.iter().any(|a| a == attribute);
+
+        let mut recorded = Self::default();
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::MetadataExt;
+
+            if has("mode") {
+                recorded.mode = Some(metadata.mode() & 0o777);
+            }
+
+            if has("owner") {
+                recorded.owner = Some((metadata.uid(), metadata.gid()));
+            }
+        }
+
+        if has("mtime") {
+            recorded.mtime = Some(metadata.modified()?.duration_since(UNIX_EPOCH)?.as_secs());
+        }
+
+        Ok(recorded)
+    }
+
+    #[must_use]
+    pub const fn is_empty(&self) -> bool {
+        self.mode.is_none() && self.owner.is_none() && self.mtime.is_none()
+    }
+
+    /// Authenticate the attributes with the vault key
+    /// # Errors
+    /// Will return an error if the tag can't be derived
+    pub fn tagged(mut self, key: &Secret<[u8; 32]>) -> Result<Self> {
+        self.tag = crypto::header_tag(key, "file", self.fields().as_bytes())?;
+        Ok(self)
+    }
+
+    /// Check the attributes were recorded by a recipient of the vault
+    /// # Errors
+    /// Will return an error if the attributes were modified or have no tag
+    pub fn verify(&self, key: &Secret<[u8; 32]>) -> Result<()> {
+        if self.is_empty() {
+            return Ok(());
+        }
+
+        let tag = crypto::header_tag(key, "file", self.fields().as_bytes())?;
+
+        if crypto::ct_eq(self.tag.as_bytes(), tag.as_bytes()) {
+            Ok(())
+        } else {
+            Err(Failure::Corrupt.error(
+                "The file metadata of the vault was modified, it was not recorded by a recipient",
+            ))
+        }
+    }
+
+    /// Parse a `+> file <tag> key=value...` line, unknown keys are ignored
+    /// # Errors
+    /// Will return an error if the line or a value is not valid
+    pub fn parse(line: &str) -> Result<Self> {
+        let rest = line
+            .strip_prefix(PREFIX)
+            .filter(|rest| rest.is_empty() || rest.starts_with(' '))
+            .ok_or_else(|| anyhow!("Not a file metadata line"))?;
+
+        let mut metadata = Self::default();
+        let mut uid = None;
+        let mut gid = None;
+
+        let mut fields = rest.split_whitespace().peekable();
+
+        // the tag comes first, 32 bytes in base64
+        if let Some(tag) =
+            fields.next_if(|field| Base64::decode_vec(field).is_ok_and(|tag| tag.len() == 32))
+        {
+            metadata.tag = tag.to_string();
+        }
+
+        for field in fields {
+            let (key, value) = field
+                .split_once('=')
+                .ok_or_else(|| anyhow!("Invalid file metadata: {field}"))?;
+
+            let invalid = |_| anyhow!("Invalid file metadata: {field}");
+
+            match key {
+                "mode" => metadata.mode = Some(u32::from_str_radix(value, 8).map_err(invalid)?),
+                "uid" => uid = Some(value.parse().map_err(invalid)?),
+                "gid" => gid = Some(value.parse().map_err(invalid)?),
+                "mtime" => metadata.mtime = Some(value.parse().map_err(invalid)?),
+                _ => {}
+            }
+        }
+
+        if metadata.mode.is_some_and(|mode| mode > 0o777) {
+            return Err(anyhow!("Invalid file metadata: mode out of range"));
+        }
+
+        metadata.owner = uid.zip(gid);
+
+        Ok(metadata)
+    }
+
+    /// Restore the recorded attributes, the permissions of the group and others
+    /// are limited to the file mode so a secret is not readable by others
+    /// unless the file mode allows it. The owner is only restored when asked,
+    /// it can usually only be restored by root, failing only prints a warning.
+    /// The attributes must have been checked with `verify`
+    /// # Errors
+    /// Will return an error if the mode or the modification time can't be set
+    pub fn restore(&self, path: &Path, file_mode: u32, owner: bool) -> Result<()> {
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+
+            if let Some((uid, gid)) = self.owner.filter(|_| owner) {
+                if let Err(e) = std::os::unix::fs::chown(path, Some(uid), Some(gid)) {
+                    eprintln!(
+                        "WARNING: could not restore the owner of {}: {e}",
+                        path.display()
+                    );
+                }
+            }
+
+            if let Some(mode) = self.mode {
+                fs::set_permissions(
+                    path,
+                    fs::Permissions::from_mode(mode & (0o700 | file_mode) & 0o777),
+                )?;
+            }
+        }
+
+        #[cfg(not(unix))]
+        let _ = (file_mode, owner);
+
+        if let Some(mtime) = self.mtime {
+            fs::File::options()
+                .write(true)
+                .open(path)?
+                .set_modified(UNIX_EPOCH + Duration::from_secs(mtime))?;
+        }
+
+        Ok(())
+    }
+
+    // the attributes as written in the header, the data of the tag
+    fn fields(&self) -> String {
+        let mut fields = Vec::new();
+
+        if let Some(mode) = self.mode {
+            fields.push(format!("mode={mode:o}"));
+        }
+
+        if let Some((uid, gid)) = self.owner {
+            fields.push(format!("uid={uid} gid={gid}"));
+        }
+
+        if let Some(mtime) = self.mtime {
+            fields.push(format!("mtime={mtime}"));
+        }
+
+        fields.join(" ")
+    }
+}
+
+impl fmt::Display for Metadata {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{PREFIX}")?;
+
+        if !self.tag.is_empty() {
+            write!(f, " {}", self.tag)?;
+        }
+
+        let fields = self.fields();
+        if !fields.is_empty() {
+            write!(f, " {fields}")?;
+        }
+
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse() {
+        let metadata = Metadata {
+            mode: Some(0o755),
+            owner: Some((1000, 100)),
+            mtime: Some(1_700_000_000),
+            ..Metadata::default()
+        };
+
+        let line = metadata.to_string();
+        assert_eq!(line, "+> file mode=755 uid=1000 gid=100 mtime=1700000000");
+        assert_eq!(Metadata::parse(&line).unwrap(), metadata);
+
+        let key = crypto::gen_password().unwrap();
+        let metadata = metadata.tagged(&key).unwrap();
+        let line = metadata.to_string();
+        assert!(line.starts_with("+> file "));
+        assert!(line.ends_with(" mode=755 uid=1000 gid=100 mtime=1700000000"));
+        assert_eq!(Metadata::parse(&line).unwrap(), metadata);
+
+        // unknown keys are ignored
+        let metadata = Metadata::parse("+> file mode=644 xattr=abc").unwrap();
+        assert_eq!(metadata.mode, Some(0o644));
+        assert!(metadata.owner.is_none());
+
+        assert!(Metadata::parse("+> file").unwrap().is_empty());
+        assert!(Metadata::parse("+> files mode=644").is_err());
+        assert!(Metadata::parse("+> file mode=999").is_err());
+        assert!(Metadata::parse("+> file mode=7777").is_err());
+        assert!(Metadata::parse("+> file mtime").is_err());
+        assert!(Metadata::parse("-> X25519 SHA256:abc").is_err());
+    }
+
+    #[test]
+    fn test_verify() {
+        let key = crypto::gen_password().unwrap();
+        let metadata = Metadata {
+            mode: Some(0o755),
+            owner: Some((1000, 100)),
+            ..Metadata::default()
+        }
+        .tagged(&key)
+        .unwrap();
+
+        let line = metadata.to_string();
+        assert!(Metadata::parse(&line).unwrap().verify(&key).is_ok());
+
+        // another key, a modified owner or no tag fails the check
+        assert!(metadata.verify(&crypto::gen_password().unwrap()).is_err());
+        assert!(Metadata::parse(&line.replace("uid=1000", "uid=0"))
+            .unwrap()
+            .verify(&key)
+            .is_err());
+        assert!(Metadata::parse("+> file mode=755 uid=0 gid=0")
+            .unwrap()
+            .verify(&key)
+            .is_err());
+
+        // nothing to restore, nothing to check
+        assert!(Metadata::parse("+> file").unwrap().verify(&key).is_ok());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_from_file_restore() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let dir = tempfile::tempdir().unwrap();
+        let script = dir.path().join("script.sh");
+        fs::write(&script, "#!/bin/sh").unwrap();
+        fs::set_permissions(&script, fs::Permissions::from_mode(0o755)).unwrap();
+
+        let attributes = vec!["mode".to_string(), "mtime".to_string()];
+        let metadata = Metadata::from_file(&script, &attributes).unwrap();
+        assert_eq!(metadata.mode, Some(0o755));
+        assert!(metadata.owner.is_none());
+        assert!(metadata.mtime.is_some());
+
+        assert!(Metadata::from_file(&script, &["none".to_string()])
+            .unwrap()
+            .is_empty());
+
+        let restored = dir.path().join("restored.sh");
+        fs::write(&restored, "#!/bin/sh").unwrap();
+
+        let metadata = Metadata {
+            mode: Some(0o755),
+            owner: None,
+            mtime: Some(1_700_000_000),
+            ..Metadata::default()
+        };
+
+        // group and others limited to the file mode
+        metadata.restore(&restored, 0o600, false).unwrap();
+        let restored_metadata = fs::metadata(&restored).unwrap();
+        assert_eq!(restored_metadata.permissions().mode() & 0o777, 0o700);
+        assert_eq!(
+            restored_metadata.modified().unwrap(),
+            UNIX_EPOCH + Duration::from_secs(1_700_000_000)
+        );
+
+        metadata.restore(&restored, 0o644, false).unwrap();
+        assert_eq!(
+            fs::metadata(&restored).unwrap().permissions().mode() & 0o777,
+            0o744
+        );
+    }
+}
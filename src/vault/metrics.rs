@@ -0,0 +1,212 @@
+// Prometheus metrics of the long running modes, `server` answers them on
+// GET /metrics and `agent --metrics ADDR` on a listener of its own:
+//
+//   ssh_vault_requests_total{request="UNWRAP"} 12
+//   ssh_vault_failures_total{cause="no_identity"} 1
+//   ssh_vault_duration_seconds_bucket{operation="decrypt",le="0.01"} 11
+//   ssh_vault_cache_requests_total{result="hit"} 5
+//
+// the hit rate of the passphrase cache is hits / (hits + misses). The labels
+// are names fixed in the code, never paths, fingerprints or anything else
+// coming from the requests
+
+use crate::vault::http::Response;
+use std::{
+    collections::BTreeMap,
+    fmt::Write,
+    sync::{Mutex, PoisonError},
+    time::Duration,
+};
+
+// upper bounds of the histogram buckets in seconds
+const BUCKETS: [f64; 8] = [0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1.0, 5.0];
+
+// the text exposition format
+const CONTENT_TYPE: &str = "text/plain; version=0.0.4";
+
+#[derive(Debug, Default)]
+pub struct Metrics {
+    inner: Mutex<Inner>,
+}
+
+#[derive(Debug, Default)]
+struct Inner {
+    requests: BTreeMap<&'static str, u64>,
+    failures: BTreeMap<&'static str, u64>,
+    durations: BTreeMap<&'static str, Histogram>,
+    cache_hits: u64,
+    cache_misses: u64,
+}
+
+#[derive(Debug, Default)]
+struct Histogram {
+    // cumulative, the count of the observations up to each bound
+    buckets: [u64; BUCKETS.len()],
+    sum: f64,
+    count: u64,
+}
+
+impl Metrics {
+    fn update(&self, f: impl FnOnce(&mut Inner)) {
+        f(&mut self.inner.lock().unwrap_or_else(PoisonError::into_inner));
+    }
+
+    /// Count a request
+    pub fn request(&self, request: &'static str) {
+        self.update(|inner| *inner.requests.entry(request).or_default() += 1);
+    }
+
+    /// Count a failed request
+    pub fn failure(&self, cause: &'static str) {
+        self.update(|inner| *inner.failures.entry(cause).or_default() += 1);
+    }
+
+    /// Record how long the operation took
+    pub fn observe(&self, operation: &'static str, duration: Duration) {
+        let seconds = duration.as_secs_f64();
+
+        self.update(|inner| {
+            let histogram = inner.durations.entry(operation).or_default();
+
+            for (bucket, bound) in histogram.buckets.iter_mut().zip(BUCKETS) {
+                if seconds <= bound {
+                    *bucket += 1;
+                }
+            }
+
+            histogram.sum += seconds;
+            histogram.count += 1;
+        });
+    }
+
+    /// Count a lookup of the cache
+    pub fn cache(&self, hit: bool) {
+        self.update(|inner| {
+            if hit {
+                inner.cache_hits += 1;
+            } else {
+                inner.cache_misses += 1;
+            }
+        });
+    }
+
+    /// The metrics in the Prometheus text format
+    #[must_use]
+    pub fn render(&self) -> String {
+        let inner = self.inner.lock().unwrap_or_else(PoisonError::into_inner);
+        let mut out = String::new();
+
+        counters(
+            &mut out,
+            "ssh_vault_requests_total",
+            "Requests answered, by request",
+            "request",
+            &inner.requests,
+        );
+
+        counters(
+            &mut out,
+            "ssh_vault_failures_total",
+            "Requests that failed, by cause",
+            "cause",
+            &inner.failures,
+        );
+
+        let name = "ssh_vault_duration_seconds";
+        let _ = writeln!(
+            out,
+            "# HELP {name} Time to encrypt or decrypt, by operation\n# TYPE {name} histogram"
+        );
+
+        for (operation, histogram) in &inner.durations {
+            for (bucket, bound) in histogram.buckets.iter().zip(BUCKETS) {
+                let _ = writeln!(
+                    out,
+                    "{name}_bucket{{operation=\"{operation}\",le=\"{bound}\"}} {bucket}"
+                );
+            }
+
+            let _ = writeln!(
+                out,
+                "{name}_bucket{{operation=\"{operation}\",le=\"+Inf\"}} {count}\n\
+                 {name}_sum{{operation=\"{operation}\"}} {sum}\n\
+                 {name}_count{{operation=\"{operation}\"}} {count}",
+                count = histogram.count,
+                sum = histogram.sum
+            );
+        }
+
+        counters(
+            &mut out,
+            "ssh_vault_cache_requests_total",
+            "Lookups of the passphrase cache, by result",
+            "result",
+            &BTreeMap::from([("hit", inner.cache_hits), ("miss", inner.cache_misses)]),
+        );
+
+        out
+    }
+
+    /// The answer to GET /metrics
+    #[must_use]
+    pub fn response(&self) -> Response {
+        Response::new(200, CONTENT_TYPE, self.render().into_bytes())
+    }
+}
+
+fn counters(
+    out: &mut String,
+    name: &str,
+    help: &str,
+    label: &str,
+    values: &BTreeMap<&'static str, u64>,
+) {
+    let _ = writeln!(out, "# HELP {name} {help}\n# TYPE {name} counter");
+
+    for (value, count) in values {
+        let _ = writeln!(out, "{name}{{{label}=\"{value}\"}} {count}");
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render() {
+        let metrics = Metrics::default();
+        metrics.request("UNWRAP");
+        metrics.request("UNWRAP");
+        metrics.request("GET");
+        metrics.failure("no_identity");
+        metrics.observe("decrypt", Duration::from_millis(3));
+        metrics.observe("decrypt", Duration::from_secs(2));
+        metrics.cache(true);
+        metrics.cache(false);
+        metrics.cache(true);
+
+        let text = metrics.render();
+
+        for line in [
+            "# TYPE ssh_vault_requests_total counter",
+            "ssh_vault_requests_total{request=\"GET\"} 1",
+            "ssh_vault_requests_total{request=\"UNWRAP\"} 2",
+            "ssh_vault_failures_total{cause=\"no_identity\"} 1",
+            "# TYPE ssh_vault_duration_seconds histogram",
+            "ssh_vault_duration_seconds_bucket{operation=\"decrypt\",le=\"0.001\"} 0",
+            "ssh_vault_duration_seconds_bucket{operation=\"decrypt\",le=\"0.005\"} 1",
+            "ssh_vault_duration_seconds_bucket{operation=\"decrypt\",le=\"1\"} 1",
+            "ssh_vault_duration_seconds_bucket{operation=\"decrypt\",le=\"5\"} 2",
+            "ssh_vault_duration_seconds_bucket{operation=\"decrypt\",le=\"+Inf\"} 2",
+            "ssh_vault_duration_seconds_count{operation=\"decrypt\"} 2",
+            "ssh_vault_cache_requests_total{result=\"hit\"} 2",
+            "ssh_vault_cache_requests_total{result=\"miss\"} 1",
+        ] {
+            assert!(text.lines().any(|l| l == line), "missing {line}");
+        }
+
+        let response = metrics.response();
+        assert_eq!(response.status, 200);
+        assert_eq!(response.content_type, CONTENT_TYPE);
+    }
+}
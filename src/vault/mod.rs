@@ -1,10 +1,46 @@
+pub mod acl;
+pub mod agent;
+pub mod archive;
+pub mod credentials;
 pub mod crypto;
+pub mod diff;
 pub mod dio;
+pub mod dotenv;
+pub mod expiry;
 pub mod find;
 pub mod fingerprint;
+pub mod fips;
+pub mod grpc;
+pub mod history;
+pub mod http;
+pub mod import;
+pub mod info;
+pub mod keyscan;
+pub mod keyserver;
+pub mod known_keys;
+pub mod kubeseal;
+pub mod label;
+pub mod last_edit;
+pub mod lock;
+pub mod metadata;
+pub mod metrics;
+pub mod mount;
+pub mod oidc;
 pub mod online;
+pub mod pass;
+pub mod paste;
+pub mod permissions;
+pub mod policy;
 pub mod remote;
+pub mod revoked;
+pub mod scan;
+pub mod server;
 pub mod ssh;
+pub mod ssh_config;
+pub mod stream;
+pub mod strict;
+pub mod values;
+pub mod watch;
 
 pub mod parse;
 pub use self::parse::parse;
@@ -12,6 +48,7 @@ pub use self::parse::parse;
 use anyhow::Result;
 use secrecy::Secret;
 use ssh_key::{PrivateKey, PublicKey};
+use stream::Stanza;
 
 #[derive(Debug, PartialEq, Eq)]
 pub enum SshKeyType {
@@ -20,7 +57,9 @@ pub enum SshKeyType {
 }
 
 pub struct SshVault {
-    vault: Box<dyn Vault>,
+    vault: Box<dyn Vault + Send + Sync>,
+    // of the ssh key, e.g. alice@laptop
+    comment: String,
 }
 
 impl SshVault {
@@ -29,15 +68,22 @@ impl SshVault {
         public: Option<PublicKey>,
         private: Option<PrivateKey>,
     ) -> Result<Self> {
+        fips::check_key(key_type)?;
+
+        let comment = private.as_ref().map_or_else(
+            || public.as_ref().map(PublicKey::comment).unwrap_or_default(),
+            PrivateKey::comment,
+        );
+        let comment = comment.to_string();
+
         let vault = match key_type {
-            SshKeyType::Ed25519 => {
-                Box::new(ssh::ed25519::Ed25519Vault::new(public, private)?) as Box<dyn Vault>
-            }
+            SshKeyType::Ed25519 => Box::new(ssh::ed25519::Ed25519Vault::new(public, private)?)
+                as Box<dyn Vault + Send + Sync>,
             SshKeyType::Rsa => {
-                Box::new(ssh::rsa::RsaVault::new(public, private)?) as Box<dyn Vault>
+                Box::new(ssh::rsa::RsaVault::new(public, private)?) as Box<dyn Vault + Send + Sync>
             }
         };
-        Ok(Self { vault })
+        Ok(Self { vault, comment })
     }
 
     pub fn create(&self, password: Secret<[u8; 32]>, data: &mut [u8]) -> Result<String> {
@@ -47,6 +93,50 @@ impl SshVault {
     pub fn view(&self, password: &[u8], data: &[u8], fingerprint: &str) -> Result<String> {
         self.vault.view(password, data, fingerprint)
     }
+
+    /// Decrypt a whole vault in the streamed or the legacy format, requires the
+    /// private key
+    /// # Errors
+    /// Will return an error if the vault was not created for this key
+    pub fn open(&self, vault: &[u8]) -> Result<Vec<u8>> {
+        let mut input = vault;
+
+        if vault.starts_with(stream::MAGIC.as_bytes()) {
+            let header = stream::Header::read(&mut input)?;
+            let mut plaintext = Vec::new();
+            stream::decrypt(&header, self, input, &mut plaintext)?;
+            return Ok(plaintext);
+        }
+
+        let (_key_type, fingerprint, password, data) = parse(std::str::from_utf8(vault)?)?;
+
+        Ok(self.view(&password, &data, &fingerprint)?.into_bytes())
+    }
+
+    /// SHA256 fingerprint of the key
+    pub fn fingerprint(&self) -> String {
+        self.vault.fingerprint()
+    }
+
+    /// Comment of the key, empty if it has none
+    #[must_use]
+    pub fn comment(&self) -> &str {
+        &self.comment
+    }
+
+    /// Encrypt the key of a streamed vault for this ssh key
+    /// # Errors
+    /// Will return an error if the key can't be encrypted
+    pub fn wrap(&self, key: &Secret<[u8; 32]>) -> Result<Stanza> {
+        self.vault.wrap(key)
+    }
+
+    /// Decrypt the key of a streamed vault, requires the private key
+    /// # Errors
+    /// Will return an error if the stanza was not created for this key
+    pub fn unwrap(&self, stanza: &Stanza) -> Result<Secret<[u8; 32]>> {
+        self.vault.unwrap(stanza)
+    }
 }
 
 pub trait Vault {
@@ -55,6 +145,9 @@ pub trait Vault {
         Self: Sized;
     fn create(&self, password: Secret<[u8; 32]>, data: &mut [u8]) -> Result<String>;
     fn view(&self, password: &[u8], data: &[u8], fingerprint: &str) -> Result<String>;
+    fn fingerprint(&self) -> String;
+    fn wrap(&self, key: &Secret<[u8; 32]>) -> Result<Stanza>;
+    fn unwrap(&self, stanza: &Stanza) -> Result<Secret<[u8; 32]>>;
 }
 
 #[cfg(test)]
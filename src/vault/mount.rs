@@ -0,0 +1,510 @@
+use crate::vault::{info, SshVault};
+use anyhow::{anyhow, Result};
+use std::{
+    collections::HashMap,
+    ffi::{OsStr, OsString},
+    fs,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+    thread,
+    time::{Duration, Instant},
+};
+use zeroize::Zeroize;
+
+/// Inode of the root directory
+pub const ROOT: u64 = 1;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Kind {
+    Dir,
+    File,
+}
+
+#[derive(Debug)]
+struct Node {
+    name: OsString,
+    parent: u64,
+    kind: Kind,
+    // path of the vault, relative to the root
+    path: PathBuf,
+}
+
+/// Directories and vaults under the mounted directory, the inode of a node is
+/// its index plus one
+#[derive(Debug)]
+pub struct Tree {
+    root: PathBuf,
+    nodes: Vec<Node>,
+}
+
+impl Tree {
+    /// Find the vaults in a directory, hidden directories are skipped
+    /// # Errors
+    /// Will return an error if a directory can't be read
+    pub fn scan(root: &Path) -> Result<Self> {
+        let mut tree = Self {
+            root: root.to_path_buf(),
+            nodes: vec![Node {
+                name: OsString::from("."),
+                parent: ROOT,
+                kind: Kind::Dir,
+                path: PathBuf::new(),
+            }],
+        };
+
+        tree.scan_dir(ROOT, &PathBuf::new())?;
+
+        Ok(tree)
+    }
+
+    fn scan_dir(&mut self, ino: u64, rel: &Path) -> Result<()> {
+        let mut entries = fs::read_dir(self.root.join(rel))?.collect::<Result<Vec<_>, _>>()?;
+        entries.sort_by_key(fs::DirEntry::file_name);
+
+        for entry in entries {
+            let name = entry.file_name();
+            let path = rel.join(&name);
+            let file_type = entry.file_type()?;
+
+            if file_type.is_dir() && !name.to_string_lossy().starts_with('.') {
+                self.nodes.push(Node {
+                    name,
+                    parent: ino,
+                    kind: Kind::Dir,
+                    path: path.clone(),
+                });
+                self.scan_dir(self.nodes.len() as u64, &path)?;
+            } else if file_type.is_file() && info::is_vault(&entry.path()) {
+                self.nodes.push(Node {
+                    name,
+                    parent: ino,
+                    kind: Kind::File,
+                    path,
+                });
+            }
+        }
+
+        Ok(())
+    }
+
+    fn node(&self, ino: u64) -> Option<&Node> {
+        usize::try_from(ino)
+            .ok()
+            .and_then(|ino| ino.checked_sub(1))
+            .and_then(|index| self.nodes.get(index))
+    }
+
+    /// Kind of the node
+    #[must_use]
+    pub fn kind(&self, ino: u64) -> Option<Kind> {
+        self.node(ino).map(|node| node.kind)
+    }
+
+    /// Path of the vault on disk
+    #[must_use]
+    pub fn path(&self, ino: u64) -> Option<PathBuf> {
+        self.node(ino).map(|node| self.root.join(&node.path))
+    }
+
+    /// Find an entry of a directory by name
+    #[must_use]
+    pub fn lookup(&self, parent: u64, name: &OsStr) -> Option<u64> {
+        self.children(parent)
+            .into_iter()
+            .find(|(_, _, child)| *child == name)
+            .map(|(ino, _, _)| ino)
+    }
+
+    /// Entries of a directory, without . and ..
+    #[must_use]
+    pub fn children(&self, parent: u64) -> Vec<(u64, Kind, &OsStr)> {
+        self.nodes
+            .iter()
+            .enumerate()
+            .skip(1)
+            .filter(|(_, node)| node.parent == parent)
+            .map(|(index, node)| (index as u64 + 1, node.kind, node.name.as_os_str()))
+            .collect()
+    }
+
+    /// Parent of a node, the root is its own parent
+    #[must_use]
+    pub fn parent(&self, ino: u64) -> u64 {
+        self.node(ino).map_or(ROOT, |node| node.parent)
+    }
+}
+
+/// Decrypted vaults, kept in memory for a while to avoid decrypting them on
+/// every read
+pub struct Cache {
+    vault: SshVault,
+    ttl: Duration,
+    entries: HashMap<u64, (Instant, Vec<u8>)>,
+}
+
+impl Cache {
+    #[must_use]
+    pub fn new(vault: SshVault, ttl: Duration) -> Self {
+        Self {
+            vault,
+            ttl,
+            entries: HashMap::new(),
+        }
+    }
+
+    /// Get the plaintext of a vault, decrypting it if not cached or expired
+    /// # Errors
+    /// Will return an error if the vault can't be read or decrypted
+    pub fn get(&mut self, ino: u64, path: &Path) -> Result<&[u8]> {
+        self.expire();
+
+        if !self.entries.contains_key(&ino) {
+            let plaintext = self.vault.open(&fs::read(path)?)?;
+            self.entries.insert(ino, (Instant::now(), plaintext));
+        }
+
+        self.entries
+            .get(&ino)
+            .map(|(_, plaintext)| plaintext.as_slice())
+            .ok_or_else(|| anyhow!("Vault not cached"))
+    }
+
+    /// Size of the plaintext of a vault if it is cached, nothing is decrypted
+    #[must_use]
+    pub fn size(&mut self, ino: u64) -> Option<u64> {
+        self.expire();
+
+        self.entries
+            .get(&ino)
+            .map(|(_, plaintext)| plaintext.len() as u64)
+    }
+
+    /// Forget the expired plaintexts, zeroizing them
+    pub fn expire(&mut self) {
+        let ttl = self.ttl;
+
+        self.entries.retain(|_, (decrypted, plaintext)| {
+            let keep = decrypted.elapsed() < ttl;
+
+            if !keep {
+                plaintext.zeroize();
+            }
+
+            keep
+        });
+    }
+}
+
+/// Forget the expired plaintexts every period even if nothing reads the mount,
+/// until the cache is dropped
+pub fn expire_every(cache: &Arc<Mutex<Cache>>, period: Duration) -> thread::JoinHandle<()> {
+    let cache = Arc::downgrade(cache);
+
+    thread::spawn(move || loop {
+        thread::sleep(period);
+
+        let Some(shared) = cache.upgrade() else {
+            break;
+        };
+
+        let Ok(mut entries) = shared.lock() else {
+            break;
+        };
+
+        entries.expire();
+    })
+}
+
+impl Drop for Cache {
+    fn drop(&mut self) {
+        for (_, plaintext) in self.entries.values_mut() {
+            plaintext.zeroize();
+        }
+    }
+}
+
+#[cfg(all(feature = "fuse", unix))]
+mod fs_impl {
+    use super::{Cache, Kind, Tree};
+    use fuser::{
+        consts::FOPEN_DIRECT_IO, FileAttr, FileType, Filesystem, ReplyAttr, ReplyData,
+        ReplyDirectory, ReplyEntry, ReplyOpen, Request,
+    };
+    use std::{
+        ffi::OsStr,
+        sync::{Arc, Mutex},
+        time::{Duration, SystemTime},
+    };
+
+    // how long the kernel may cache the attributes
+    const ATTR_TTL: Duration = Duration::from_secs(1);
+
+    pub struct VaultFs {
+        pub tree: Tree,
+        pub cache: Arc<Mutex<Cache>>,
+        pub uid: u32,
+        pub gid: u32,
+    }
+
+    impl VaultFs {
+        fn attr(&mut self, ino: u64) -> Option<FileAttr> {
+            let kind = self.tree.kind(ino)?;
+            let path = self.tree.path(ino)?;
+            let modified = std::fs::metadata(&path)
+                .and_then(|metadata| metadata.modified())
+                .unwrap_or(SystemTime::UNIX_EPOCH);
+
+            // listing the mount decrypts nothing, the size is only known once
+            // the vault was opened, the files are read with direct I/O until
+            // the end whatever their size
+            let (kind, perm, size) = match kind {
+                Kind::Dir => (FileType::Directory, 0o500, 0),
+                Kind::File => (
+                    FileType::RegularFile,
+                    0o400,
+                    self.cache
+                        .lock()
+                        .ok()
+                        .and_then(|mut cache| cache.size(ino))
+                        .unwrap_or(0),
+                ),
+            };
+
+            Some(FileAttr {
+                ino,
+                size,
+                blocks: size.div_ceil(512),
+                atime: modified,
+                mtime: modified,
+                ctime: modified,
+                crtime: modified,
+                kind,
+                perm,
+                nlink: 1,
+                uid: self.uid,
+                gid: self.gid,
+                rdev: 0,
+                blksize: 4096,
+                flags: 0,
+            })
+        }
+    }
+
+    impl Filesystem for VaultFs {
+        fn lookup(&mut self, _req: &Request, parent: u64, name: &OsStr, reply: ReplyEntry) {
+            match self
+                .tree
+                .lookup(parent, name)
+                .and_then(|ino| self.attr(ino))
+            {
+                Some(attr) => reply.entry(&ATTR_TTL, &attr, 0),
+                None => reply.error(libc::ENOENT),
+            }
+        }
+
+        fn getattr(&mut self, _req: &Request, ino: u64, _fh: Option<u64>, reply: ReplyAttr) {
+            match self.attr(ino) {
+                Some(attr) => reply.attr(&ATTR_TTL, &attr),
+                None => reply.error(libc::ENOENT),
+            }
+        }
+
+        fn open(&mut self, _req: &Request, ino: u64, _flags: i32, reply: ReplyOpen) {
+            let (Some(Kind::File), Some(path)) = (self.tree.kind(ino), self.tree.path(ino)) else {
+                return reply.error(libc::ENOENT);
+            };
+
+            // a vault the keys can't open is there but not readable
+            match self.cache.lock() {
+                Ok(mut cache) => match cache.get(ino, &path) {
+                    Ok(_) => reply.opened(0, FOPEN_DIRECT_IO),
+                    Err(_) => reply.error(libc::EACCES),
+                },
+                Err(_) => reply.error(libc::EIO),
+            }
+        }
+
+        fn read(
+            &mut self,
+            _req: &Request,
+            ino: u64,
+            _fh: u64,
+            offset: i64,
+            size: u32,
+            _flags: i32,
+            _lock_owner: Option<u64>,
+            reply: ReplyData,
+        ) {
+            let Some(path) = self.tree.path(ino) else {
+                return reply.error(libc::ENOENT);
+            };
+
+            let Ok(mut cache) = self.cache.lock() else {
+                return reply.error(libc::EIO);
+            };
+
+            match cache.get(ino, &path) {
+                Ok(plaintext) => {
+                    let start = usize::try_from(offset).unwrap_or(0).min(plaintext.len());
+                    let end = start.saturating_add(size as usize).min(plaintext.len());
+                    reply.data(&plaintext[start..end]);
+                }
+                Err(_) => reply.error(libc::EACCES),
+            }
+        }
+
+        fn readdir(
+            &mut self,
+            _req: &Request,
+            ino: u64,
+            _fh: u64,
+            offset: i64,
+            mut reply: ReplyDirectory,
+        ) {
+            if self.tree.kind(ino) != Some(Kind::Dir) {
+                return reply.error(libc::ENOTDIR);
+            }
+
+            let mut entries = vec![
+                (ino, FileType::Directory, OsStr::new(".")),
+                (self.tree.parent(ino), FileType::Directory, OsStr::new("..")),
+            ];
+
+            entries.extend(
+                self.tree
+                    .children(ino)
+                    .into_iter()
+                    .map(|(ino, kind, name)| {
+                        let kind = match kind {
+                            Kind::Dir => FileType::Directory,
+                            Kind::File => FileType::RegularFile,
+                        };
+                        (ino, kind, name)
+                    }),
+            );
+
+            for (i, (ino, kind, name)) in entries
+                .into_iter()
+                .enumerate()
+                .skip(usize::try_from(offset).unwrap_or(0))
+            {
+                // the offset of the next entry
+                if reply.add(ino, (i + 1) as i64, kind, name) {
+                    break;
+                }
+            }
+
+            reply.ok();
+        }
+    }
+}
+
+/// Mount the vaults of a directory read-only, blocks until it's unmounted
+/// # Errors
+/// Will return an error if the directory can't be mounted
+#[cfg(all(feature = "fuse", unix))]
+pub fn mount(tree: Tree, cache: Cache, mountpoint: &Path) -> Result<()> {
+    use fuser::MountOption;
+
+    let cache = Arc::new(Mutex::new(cache));
+
+    // the plaintexts are forgotten after the ttl even if nothing reads them
+    expire_every(&cache, Duration::from_secs(1));
+
+    let fs = fs_impl::VaultFs {
+        tree,
+        cache,
+        // SAFETY: getuid and getgid never fail
+        uid: unsafe { libc::getuid() },
+        gid: unsafe { libc::getgid() },
+    };
+
+    fuser::mount2(
+        fs,
+        mountpoint,
+        &[
+            MountOption::RO,
+            MountOption::NoExec,
+            MountOption::NoSuid,
+            MountOption::NoDev,
+            MountOption::FSName(String::from("ssh-vault")),
+        ],
+    )?;
+
+    Ok(())
+}
+
+#[cfg(not(all(feature = "fuse", unix)))]
+pub fn mount(_tree: Tree, _cache: Cache, _mountpoint: &Path) -> Result<()> {
+    Err(anyhow!(
+        "ssh-vault was built without FUSE support, build it with: cargo build --features fuse"
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, stream, SshKeyType};
+    use ssh_key::PrivateKey;
+
+    #[test]
+    fn test_tree_and_cache() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::create_dir_all(dir.path().join("db")).unwrap();
+        fs::create_dir_all(dir.path().join(".git")).unwrap();
+
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+
+        let mut vault = Vec::new();
+        stream::encrypt(&[recipient], &b"password"[..], &mut vault).unwrap();
+        fs::write(dir.path().join("db/password.vault"), &vault).unwrap();
+        fs::write(dir.path().join(".git/config.vault"), &vault).unwrap();
+        fs::write(dir.path().join("README.md"), "not a vault").unwrap();
+
+        let tree = Tree::scan(dir.path()).unwrap();
+
+        let children = tree.children(ROOT);
+        assert_eq!(children.len(), 1);
+        assert_eq!(children[0].2, "db");
+
+        let db = tree.lookup(ROOT, OsStr::new("db")).unwrap();
+        assert_eq!(tree.kind(db), Some(Kind::Dir));
+        assert_eq!(tree.parent(db), ROOT);
+
+        let file = tree.lookup(db, OsStr::new("password.vault")).unwrap();
+        assert_eq!(tree.kind(file), Some(Kind::File));
+        assert!(tree.lookup(ROOT, OsStr::new("README.md")).is_none());
+        assert!(tree.kind(99).is_none());
+
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let private = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let mut cache = Cache::new(private, Duration::from_secs(60));
+        let path = tree.path(file).unwrap();
+
+        // only known once decrypted
+        assert_eq!(cache.size(file), None);
+        assert_eq!(cache.get(file, &path).unwrap(), b"password");
+        assert_eq!(cache.entries.len(), 1);
+        assert_eq!(cache.size(file), Some(8));
+
+        // expired
+        cache.ttl = Duration::ZERO;
+        cache.expire();
+        assert!(cache.entries.is_empty());
+
+        // in the background, without any read
+        cache.ttl = Duration::from_millis(50);
+        cache.get(file, &path).unwrap();
+        let cache = Arc::new(Mutex::new(cache));
+        let expiry = expire_every(&cache, Duration::from_millis(10));
+
+        thread::sleep(Duration::from_millis(200));
+        assert!(cache.lock().unwrap().entries.is_empty());
+
+        // stops with the cache
+        drop(cache);
+        expiry.join().unwrap();
+    }
+}
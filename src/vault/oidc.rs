@@ -0,0 +1,172 @@
+// Keys of a corporate identity, `-u oidc:alice@example.com` asks the endpoint
+// `oidc_keys_url` of the config for the keys registered by the identity,
+// authenticated with an OIDC ID token:
+//
+//   oidc_keys_url: https://keys.example.com/v1/users/{identity}/keys
+//   oidc_token_command: gcloud auth print-identity-token
+//
+// the token is `oidc_token` (SSH_VAULT_OIDC_TOKEN) or the output of
+// `oidc_token_command`, and only sent to the host of the endpoint
+
+use crate::config;
+use anyhow::{anyhow, Context, Result};
+use secrecy::{ExposeSecret, Secret};
+use std::process::{Command, Stdio};
+use url::{form_urlencoded, Url};
+
+/// Prefix of the recipients resolved by the OIDC endpoint
+pub const PREFIX: &str = "oidc:";
+
+const PLACEHOLDER: &str = "{identity}";
+
+/// URL of the keys of the identity
+/// # Errors
+/// Will return an error if `oidc_keys_url` is not set or is not a valid URL
+pub fn keys_url(identity: &str) -> Result<Url> {
+    if identity.is_empty() {
+        return Err(anyhow!("Missing identity, expected {PREFIX}<identity>"));
+    }
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    let endpoint = config
+        .get_string("oidc_keys_url")
+        .map_err(|_| anyhow!("Set oidc_keys_url in the config to resolve {PREFIX} recipients"))?;
+
+    expand(&endpoint, identity)
+}
+
+// Replace {identity} in the endpoint with the encoded identity
+fn expand(endpoint: &str, identity: &str) -> Result<Url> {
+    if !endpoint.contains(PLACEHOLDER) {
+        return Err(anyhow!("oidc_keys_url must contain {PLACEHOLDER}"));
+    }
+
+    let identity: String = form_urlencoded::byte_serialize(identity.as_bytes()).collect();
+
+    Url::parse(&endpoint.replace(PLACEHOLDER, &identity))
+        .with_context(|| format!("Invalid oidc_keys_url: {endpoint}"))
+}
+
+/// The ID token for the request, only if it goes to the OIDC endpoint
+/// # Errors
+/// Will return an error if the token command fails
+pub fn token(url: &Url) -> Result<Option<Secret<String>>> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    let Ok(endpoint) = config.get_string("oidc_keys_url") else {
+        return Ok(None);
+    };
+
+    if !same_origin(url, &endpoint) {
+        return Ok(None);
+    }
+
+    if let Ok(token) = config.get_string("oidc_token") {
+        if !token.is_empty() {
+            return Ok(Some(Secret::new(token)));
+        }
+    }
+
+    match config.get_string("oidc_token_command") {
+        Ok(command) if !command.is_empty() => token_command(&command).map(Some),
+        _ => Err(anyhow!(
+            "Set oidc_token or oidc_token_command in the config to authenticate to {}",
+            url.origin().ascii_serialization()
+        )),
+    }
+}
+
+// The scheme, host and port of the URL are the ones of the endpoint
+fn same_origin(url: &Url, endpoint: &str) -> bool {
+    Url::parse(&endpoint.replace(PLACEHOLDER, "_"))
+        .is_ok_and(|endpoint| endpoint.origin() == url.origin())
+}
+
+// Run the command and read the token from its stdout
+fn token_command(command: &str) -> Result<Secret<String>> {
+    let args = shell_words::split(command)?;
+
+    let (program, args) = args
+        .split_first()
+        .ok_or_else(|| anyhow!("oidc_token_command is empty"))?;
+
+    let output = Command::new(program)
+        .args(args)
+        .stdin(Stdio::null())
+        .stderr(Stdio::inherit())
+        .output()
+        .with_context(|| format!("Failed to run oidc_token_command: {program}"))?;
+
+    if !output.status.success() {
+        return Err(anyhow!("oidc_token_command failed: {}", output.status));
+    }
+
+    let token = String::from_utf8(output.stdout)?.trim().to_string();
+
+    if token.is_empty() {
+        return Err(anyhow!("oidc_token_command printed no token"));
+    }
+
+    Ok(Secret::new(token))
+}
+
+/// The Authorization header of the token
+#[must_use]
+pub fn bearer(token: &Secret<String>) -> String {
+    format!("Bearer {}", token.expose_secret())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_expand() {
+        let endpoint = "https://keys.example.com/v1/users/{identity}/keys";
+
+        assert_eq!(
+            expand(endpoint, "alice@example.com").unwrap().as_str(),
+            "https://keys.example.com/v1/users/alice%40example.com/keys"
+        );
+        assert_eq!(
+            expand("https://keys.example.com/keys?sub={identity}", "a/b c")
+                .unwrap()
+                .as_str(),
+            "https://keys.example.com/keys?sub=a%2Fb+c"
+        );
+        assert!(expand("https://keys.example.com/keys", "alice").is_err());
+    }
+
+    #[test]
+    fn test_token() {
+        let endpoint = "https://keys.example.com/v1/users/{identity}/keys";
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_OIDC_KEYS_URL", Some(endpoint)),
+                ("SSH_VAULT_OIDC_TOKEN", Some("eyJhbGciOi")),
+            ],
+            || {
+                let url = expand(endpoint, "alice@example.com").unwrap();
+                let id_token = token(&url).unwrap().unwrap();
+                assert_eq!(bearer(&id_token), "Bearer eyJhbGciOi");
+
+                // never sent to other hosts
+                let other = Url::parse("https://github.com/alice.keys").unwrap();
+                assert!(token(&other).unwrap().is_none());
+            },
+        );
+    }
+
+    #[test]
+    fn test_token_command() {
+        let token = token_command("echo eyJhbGciOi").unwrap();
+        assert_eq!(token.expose_secret(), "eyJhbGciOi");
+
+        assert!(token_command("false").is_err());
+        assert!(token_command("").is_err());
+    }
+}
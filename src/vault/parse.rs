@@ -1,24 +1,31 @@
-use anyhow::{anyhow, Result};
+use crate::{exit::Failure, vault::strict};
+use anyhow::Result;
 use base64ct::{Base64, Encoding};
 
 // check if it's a valid SSH-VAULT file and return the data
 pub fn parse(data: &str) -> Result<(&str, String, Vec<u8>, Vec<u8>)> {
+    // tell what is wrong and where
+    strict::check(data.as_bytes(), false)?;
+
     let tokens: Vec<_> = data.split(';').collect();
 
-    if tokens[0] != "SSH-VAULT" || (tokens[1] != "AES256" && tokens[1] != "CHACHA20-POLY1305") {
-        return Err(anyhow!("Not a valid SSH-VAULT file"));
+    if tokens.len() < 2
+        || tokens[0] != "SSH-VAULT"
+        || (tokens[1] != "AES256" && tokens[1] != "CHACHA20-POLY1305")
+    {
+        return Err(Failure::Corrupt.error("Not a valid SSH-VAULT file"));
     }
 
     if tokens[1] == "AES256" {
         if tokens.len() != 4 {
-            return Err(anyhow!("Not a valid SSH-VAULT file"));
+            return Err(Failure::Corrupt.error("Not a valid SSH-VAULT file"));
         }
 
         let mut lines = tokens[2].lines();
 
         let fingerprint = lines
             .next()
-            .ok_or_else(|| anyhow!("Not a valid SSH-VAULT file"))?;
+            .ok_or_else(|| Failure::Corrupt.error("Not a valid SSH-VAULT file"))?;
 
         let password = lines.collect::<Vec<&str>>().join("");
         let password = Base64::decode_vec(&password)?;
@@ -31,7 +38,7 @@ pub fn parse(data: &str) -> Result<(&str, String, Vec<u8>, Vec<u8>)> {
         return Ok((tokens[1], fingerprint.to_string(), password, data));
     } else if tokens[1] == "CHACHA20-POLY1305" {
         if tokens.len() != 6 {
-            return Err(anyhow!("Not a valid SSH-VAULT file"));
+            return Err(Failure::Corrupt.error("Not a valid SSH-VAULT file"));
         }
 
         let fingerprint = tokens[2].lines().collect::<Vec<&str>>().join("");
@@ -52,7 +59,7 @@ pub fn parse(data: &str) -> Result<(&str, String, Vec<u8>, Vec<u8>)> {
         return Ok((tokens[1], fingerprint, epk_and_password, data));
     }
 
-    Err(anyhow!("Not a valid SSH-VAULT file"))
+    Err(Failure::Corrupt.error("Not a valid SSH-VAULT file"))
 }
 
 #[cfg(test)]
@@ -0,0 +1,167 @@
+// pass, the standard unix password manager, stores every entry in a gpg
+// encrypted file, the gpg keys of a directory are listed in its .gpg-id file
+
+use crate::vault::info;
+use anyhow::{anyhow, Context, Result};
+use std::{
+    fs,
+    io::Write,
+    path::{Path, PathBuf},
+    process::{Command, Stdio},
+};
+
+/// Extension of the entries
+pub const EXTENSION: &str = "gpg";
+
+/// File with the gpg keys of a directory and its subdirectories
+pub const GPG_ID: &str = ".gpg-id";
+
+/// Find the entries of a password store, the .git directory is skipped
+/// # Errors
+/// Will return an error if a directory can't be read
+pub fn entries(store: &Path) -> Result<Vec<PathBuf>> {
+    Ok(info::walk(store)?
+        .into_iter()
+        .filter(|path| path.extension().map_or(false, |ext| ext == EXTENSION))
+        .collect())
+}
+
+/// Name of an entry, its path in the store without the extension
+#[must_use]
+pub fn name(store: &Path, entry: &Path) -> PathBuf {
+    entry
+        .strip_prefix(store)
+        .unwrap_or(entry)
+        .with_extension("")
+}
+
+/// Decrypt an entry with gpg, the gpg agent prompts for the passphrase
+/// # Errors
+/// Will return an error if gpg fails
+pub fn decrypt(entry: &Path) -> Result<Vec<u8>> {
+    let output = Command::new("gpg")
+        .args(["--quiet", "--batch", "--decrypt"])
+        .arg(entry)
+        .stdin(Stdio::null())
+        .output()
+        .context("Could not run gpg")?;
+
+    if !output.status.success() {
+        return Err(anyhow!(
+            "gpg could not decrypt {}: {}",
+            entry.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+
+    Ok(output.stdout)
+}
+
+/// Get the gpg keys of the .gpg-id file closest to the entry
+/// # Errors
+/// Will return an error if no .gpg-id file is found in the store
+pub fn gpg_ids(store: &Path, entry: &Path) -> Result<Vec<String>> {
+    for dir in entry.ancestors().skip(1) {
+        let path = dir.join(GPG_ID);
+
+        if path.is_file() {
+            let ids: Vec<String> = fs::read_to_string(&path)?
+                .lines()
+                .map(str::trim)
+                .filter(|line| !line.is_empty() && !line.starts_with('#'))
+                .map(String::from)
+                .collect();
+
+            if ids.is_empty() {
+                return Err(anyhow!("No gpg keys found in {}", path.display()));
+            }
+
+            return Ok(ids);
+        }
+
+        if dir == store {
+            break;
+        }
+    }
+
+    Err(anyhow!(
+        "No {GPG_ID} found in {}, initialize it with: pass init <gpg-id>",
+        store.display()
+    ))
+}
+
+/// Encrypt an entry with gpg for the keys
+/// # Errors
+/// Will return an error if gpg fails
+pub fn encrypt(ids: &[String], data: &[u8], entry: &Path) -> Result<()> {
+    let mut command = Command::new("gpg");
+    command.args(["--quiet", "--batch", "--yes", "--encrypt"]);
+
+    for id in ids {
+        command.args(["--recipient", id]);
+    }
+
+    let mut child = command
+        .arg("--output")
+        .arg(entry)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .spawn()
+        .context("Could not run gpg")?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(data)?;
+    }
+
+    let output = child.wait_with_output()?;
+
+    if !output.status.success() {
+        return Err(anyhow!(
+            "gpg could not encrypt {}: {}",
+            entry.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_entries() {
+        let store = tempfile::tempdir().unwrap();
+        let dir = store.path().join("web");
+        fs::create_dir_all(&dir).unwrap();
+        fs::create_dir_all(store.path().join(".git")).unwrap();
+
+        fs::write(store.path().join(GPG_ID), "alice@example.com\n").unwrap();
+        fs::write(
+            dir.join(GPG_ID),
+            "# team\nalice@example.com\nbob@example.com\n",
+        )
+        .unwrap();
+        fs::write(store.path().join("email.gpg"), "").unwrap();
+        fs::write(dir.join("github.gpg"), "").unwrap();
+        fs::write(store.path().join(".git").join("x.gpg"), "").unwrap();
+
+        let entries = entries(store.path()).unwrap();
+        assert_eq!(entries.len(), 2);
+        assert_eq!(name(store.path(), &entries[1]), Path::new("web/github"));
+
+        assert_eq!(
+            gpg_ids(store.path(), &entries[0]).unwrap(),
+            vec!["alice@example.com"]
+        );
+        assert_eq!(
+            gpg_ids(store.path(), &entries[1]).unwrap(),
+            vec!["alice@example.com", "bob@example.com"]
+        );
+
+        fs::remove_file(store.path().join(GPG_ID)).unwrap();
+        assert!(gpg_ids(store.path(), &entries[0]).is_err());
+    }
+}
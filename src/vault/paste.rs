@@ -0,0 +1,124 @@
+// One-time links to send a vault to a coworker instead of a chat attachment,
+// the vault is uploaded to the `share_url` of the config, a service that
+// deletes it once it was downloaded or when the TTL is over:
+//
+//   share_url: https://paste.example.com/api/upload
+//
+// The vault is sent with POST <share_url>?ttl=<seconds>&burn=1 and the service
+// answers with the URL to download it, only the ciphertext leaves the machine
+
+use crate::config;
+use crate::vault::remote;
+use anyhow::{anyhow, Context, Result};
+use std::time::Duration;
+use url::{Host, Url};
+
+/// The `share_url` of the config, over HTTPS unless the service is local
+/// # Errors
+/// Will return an error if `share_url` is not set or not valid
+pub fn endpoint() -> Result<Url> {
+    let share_url = config::get()?
+        .get_string("share_url")
+        .ok()
+        .filter(|url| !url.is_empty())
+        .ok_or_else(|| anyhow!("Set share_url in the config to upload vaults"))?;
+
+    parse_endpoint(&share_url)
+}
+
+fn parse_endpoint(share_url: &str) -> Result<Url> {
+    let url = Url::parse(share_url).with_context(|| format!("Invalid share_url: {share_url}"))?;
+
+    // the link opens the vault once, nobody else must see it
+    let local = match url.host() {
+        Some(Host::Domain(domain)) => domain == "localhost",
+        Some(Host::Ipv4(ip)) => ip.is_loopback(),
+        Some(Host::Ipv6(ip)) => ip.is_loopback(),
+        None => false,
+    };
+
+    if url.scheme() != "https" && !(url.scheme() == "http" && local) {
+        return Err(anyhow!("share_url must use https: {share_url}"));
+    }
+
+    Ok(url)
+}
+
+/// Upload the vault, returns the URL that downloads it once before the TTL
+/// is over
+/// # Errors
+/// Will return an error if the TTL is shorter than a second, the upload fails
+/// or the service doesn't answer with a URL
+pub fn upload(endpoint: &Url, vault: &[u8], ttl: Duration) -> Result<Url> {
+    if ttl.as_secs() == 0 {
+        return Err(anyhow!("The TTL must be at least a second"));
+    }
+
+    let body = remote::post(&upload_url(endpoint, ttl), vault.to_vec())?;
+
+    link(&body)
+}
+
+fn upload_url(endpoint: &Url, ttl: Duration) -> Url {
+    let mut url = endpoint.clone();
+
+    url.query_pairs_mut()
+        .append_pair("ttl", &ttl.as_secs().to_string())
+        .append_pair("burn", "1");
+
+    url
+}
+
+// the first line of the response
+fn link(body: &str) -> Result<Url> {
+    let line = body.lines().next().unwrap_or_default().trim();
+
+    Url::parse(line)
+        .ok()
+        .filter(|url| matches!(url.scheme(), "https" | "http"))
+        .ok_or_else(|| anyhow!("The share service did not answer with a URL"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_endpoint() {
+        assert!(parse_endpoint("https://paste.example.com/api").is_ok());
+        assert!(parse_endpoint("http://localhost:8080/").is_ok());
+        assert!(parse_endpoint("http://127.0.0.1:8080/").is_ok());
+        assert!(parse_endpoint("http://paste.example.com/api").is_err());
+        assert!(parse_endpoint("ftp://paste.example.com/").is_err());
+        assert!(parse_endpoint("paste.example.com").is_err());
+    }
+
+    #[test]
+    fn test_upload_url() {
+        let endpoint = Url::parse("https://paste.example.com/api?team=infra").unwrap();
+
+        assert_eq!(
+            upload_url(&endpoint, Duration::from_secs(3600)).as_str(),
+            "https://paste.example.com/api?team=infra&ttl=3600&burn=1"
+        );
+    }
+
+    #[test]
+    fn test_link() {
+        assert_eq!(
+            link("https://paste.example.com/p/4f2a#x\n")
+                .unwrap()
+                .as_str(),
+            "https://paste.example.com/p/4f2a#x"
+        );
+        assert!(link("").is_err());
+        assert!(link("<html>").is_err());
+        assert!(link("file:///etc/passwd").is_err());
+    }
+
+    #[test]
+    fn test_upload_ttl() {
+        let endpoint = Url::parse("https://paste.example.com/api").unwrap();
+        assert!(upload(&endpoint, b"SSH-VAULT;V2", Duration::from_millis(10)).is_err());
+    }
+}
@@ -0,0 +1,181 @@
+use crate::config;
+use anyhow::{anyhow, Result};
+use std::path::Path;
+
+#[cfg(unix)]
+use std::{fs, os::unix::fs::MetadataExt};
+
+/// Check that the private key is only accessible by its owner, like `OpenSSH` does.
+/// Refuses the key when `strict_permissions` is set in the config, otherwise warns
+/// # Errors
+/// Will return an error if the permissions are too open and `strict_permissions` is set
+pub fn check_private_key(path: &Path) -> Result<()> {
+    let Some(problem) = private_key_problem(path) else {
+        return Ok(());
+    };
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let strict = config::get()?
+        .get_bool("strict_permissions")
+        .unwrap_or(false);
+
+    if strict {
+        Err(anyhow!("{problem}, refusing to use it"))
+    } else {
+        eprintln!("WARNING: {problem}");
+        Ok(())
+    }
+}
+
+/// Warn when the vault is created in a directory others can read or write
+pub fn check_vault_dir(path: &Path) {
+    if let Some(problem) = vault_dir_problem(path) {
+        eprintln!("WARNING: {problem}");
+    }
+}
+
+/// Warn when a file with secrets for a service is not in memory, e.g. /run is
+/// a tmpfs and is gone on reboot
+pub fn check_runtime_file(path: &Path) {
+    if let Some(problem) = runtime_file_problem(path) {
+        eprintln!("WARNING: {problem}");
+    }
+}
+
+#[cfg(unix)]
+fn private_key_problem(path: &Path) -> Option<String> {
+    let metadata = fs::metadata(path).ok()?;
+    let mode = metadata.mode() & 0o777;
+
+    if mode & 0o077 != 0 {
+        return Some(format!(
+            "Permissions {mode:04o} for '{}' are too open, the private key must not be accessible by others",
+            path.display()
+        ));
+    }
+
+    // SAFETY: geteuid has no preconditions and never fails
+    let uid = unsafe { libc::geteuid() };
+    if metadata.uid() != uid && metadata.uid() != 0 {
+        return Some(format!(
+            "'{}' is not owned by the current user",
+            path.display()
+        ));
+    }
+
+    None
+}
+
+#[cfg(not(unix))]
+fn private_key_problem(_path: &Path) -> Option<String> {
+    None
+}
+
+#[cfg(unix)]
+fn vault_dir_problem(path: &Path) -> Option<String> {
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+
+    let mode = fs::metadata(dir).ok()?.mode() & 0o777;
+
+    if mode & 0o006 != 0 {
+        Some(format!(
+            "Creating the vault in '{}' which is readable by others (permissions {mode:04o})",
+            dir.display()
+        ))
+    } else {
+        None
+    }
+}
+
+#[cfg(not(unix))]
+fn vault_dir_problem(_path: &Path) -> Option<String> {
+    None
+}
+
+#[cfg(target_os = "linux")]
+fn runtime_file_problem(path: &Path) -> Option<String> {
+    use std::{ffi::CString, os::unix::ffi::OsStrExt};
+
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+
+    let c_dir = CString::new(dir.as_os_str().as_bytes()).ok()?;
+
+    // SAFETY: statfs is a plain C struct, zeroed is a valid value
+    let mut stat: libc::statfs = unsafe { std::mem::zeroed() };
+
+    // SAFETY: the path is a valid C string and stat outlives the call
+    if unsafe { libc::statfs(c_dir.as_ptr(), &mut stat) } != 0 {
+        return None;
+    }
+
+    if stat.f_type == libc::TMPFS_MAGIC {
+        None
+    } else {
+        Some(format!(
+            "Writing the secrets to '{}' which is not a tmpfs, they stay on the disk",
+            dir.display()
+        ))
+    }
+}
+
+#[cfg(not(target_os = "linux"))]
+fn runtime_file_problem(_path: &Path) -> Option<String> {
+    None
+}
+
+#[cfg(test)]
+#[cfg(unix)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+
+    #[test]
+    fn test_private_key_problem() {
+        let file = tempfile::NamedTempFile::new().unwrap();
+
+        fs::set_permissions(file.path(), fs::Permissions::from_mode(0o600)).unwrap();
+        assert!(private_key_problem(file.path()).is_none());
+
+        fs::set_permissions(file.path(), fs::Permissions::from_mode(0o644)).unwrap();
+        let problem = private_key_problem(file.path()).unwrap();
+        assert!(problem.contains("Permissions 0644"));
+    }
+
+    #[test]
+    fn test_check_private_key_strict() {
+        let file = tempfile::NamedTempFile::new().unwrap();
+        fs::set_permissions(file.path(), fs::Permissions::from_mode(0o640)).unwrap();
+
+        temp_env::with_var("SSH_VAULT_STRICT_PERMISSIONS", Some("true"), || {
+            assert!(check_private_key(file.path()).is_err());
+        });
+
+        temp_env::with_var("SSH_VAULT_STRICT_PERMISSIONS", None::<&str>, || {
+            assert!(check_private_key(file.path()).is_ok());
+        });
+    }
+
+    #[test]
+    fn test_vault_dir_problem() {
+        let dir = tempfile::tempdir().unwrap();
+        let vault = dir.path().join("secret.vault");
+
+        fs::set_permissions(dir.path(), fs::Permissions::from_mode(0o700)).unwrap();
+        assert!(vault_dir_problem(&vault).is_none());
+
+        fs::set_permissions(dir.path(), fs::Permissions::from_mode(0o755)).unwrap();
+        assert!(vault_dir_problem(&vault).is_some());
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn test_runtime_file_problem() {
+        assert!(runtime_file_problem(Path::new("/proc/env")).is_some());
+    }
+}
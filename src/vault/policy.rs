@@ -0,0 +1,256 @@
+use crate::vault::{find, known_keys, remote};
+use anyhow::{anyhow, Context, Result};
+use globset::{Glob, GlobSet, GlobSetBuilder};
+use serde::Deserialize;
+use ssh_key::{HashAlg, PublicKey};
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+};
+
+/// Name of the file with the recipients of the vaults in a directory and its
+/// subdirectories, e.g.:
+///
+/// ```yaml
+/// recipients:
+///   - keys/team.keys
+///   - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINixf2m2nj8TDeazbWuemUY8ZHNg7znA7hVPN8TJLr2W
+/// users:
+///   - alice
+/// pins:
+///   alice:
+///     - SHA256:hgIL5fEHz5zuOWY1CDlUuotdaUl4MvYG7vAgE4q4TzM
+/// patterns:
+///   - "*.env"
+///   - secrets/**
+/// ```
+pub const POLICY_FILE: &str = ".ssh-vault.yml";
+
+#[derive(Debug, Default, Deserialize)]
+pub struct Policy {
+    // public keys or files with keys relative to the policy file
+    #[serde(default)]
+    pub recipients: Vec<String>,
+
+    // GitHub users or URLs to fetch the keys from
+    #[serde(default)]
+    pub users: Vec<String>,
+
+    // fingerprints of the only keys accepted for a user
+    #[serde(default)]
+    pub pins: HashMap<String, Vec<String>>,
+
+    // files that must be vaults, globs relative to the policy file
+    #[serde(default)]
+    pub patterns: Vec<String>,
+
+    #[serde(skip)]
+    pub path: PathBuf,
+}
+
+impl Policy {
+    /// Load a policy file
+    /// # Errors
+    /// Will return an error if the file can't be read or parsed
+    pub fn load(path: &Path) -> Result<Self> {
+        let mut policy: Self = config::Config::builder()
+            .add_source(config::File::from(path))
+            .build()
+            .and_then(config::Config::try_deserialize)
+            .with_context(|| format!("Could not read {}", path.display()))?;
+
+        policy.path = path.to_path_buf();
+
+        Ok(policy)
+    }
+
+    /// Find the policy of a directory, looking in its parents until found
+    /// # Errors
+    /// Will return an error if a policy file is found but it's not valid
+    pub fn find(dir: &Path) -> Result<Option<Self>> {
+        for dir in dir.ancestors() {
+            let path = dir.join(POLICY_FILE);
+
+            if path.is_file() {
+                return Self::load(&path).map(Some);
+            }
+        }
+
+        Ok(None)
+    }
+
+    /// Find the policy of a directory or fail
+    /// # Errors
+    /// Will return an error if there is no policy or it's not valid
+    pub fn require(dir: &Path) -> Result<Self> {
+        Self::find(dir)?.ok_or_else(|| {
+            anyhow!(
+                "No {POLICY_FILE} found in {} or its parents, create one with the recipients of the vaults",
+                dir.display()
+            )
+        })
+    }
+
+    /// Directory of the policy file, paths in the policy are relative to it
+    #[must_use]
+    pub fn dir(&self) -> &Path {
+        self.path.parent().unwrap_or_else(|| Path::new("."))
+    }
+
+    /// Compile the patterns of the files that must be vaults
+    /// # Errors
+    /// Will return an error if a pattern is not a valid glob
+    pub fn globs(&self) -> Result<GlobSet> {
+        globs(&self.patterns)
+    }
+
+    /// Get the public keys of all the recipients, the keys of the users are
+    /// pinned on first use
+    /// # Errors
+    /// Will return an error if a key can't be read or fetched
+    pub fn public_keys(&self) -> Result<Vec<PublicKey>> {
+        let mut keys = Vec::new();
+
+        for recipient in &self.recipients {
+            if recipient.starts_with("ssh-") {
+                keys.push(
+                    PublicKey::from_openssh(recipient)
+                        .with_context(|| format!("Invalid key in {}", self.path.display()))?,
+                );
+            } else {
+                let path = self.dir().join(recipient);
+                keys.extend(find::public_keys(&path.to_string_lossy())?);
+            }
+        }
+
+        for user in &self.users {
+            let fetched = remote::get_keys(user)?;
+
+            for line in fetched.lines() {
+                if let Ok(key) = PublicKey::from_openssh(line) {
+                    self.check_pin(user, &key)?;
+                    known_keys::check(user, &fetched, &key, false)?;
+                    keys.push(key);
+                }
+            }
+        }
+
+        if keys.is_empty() {
+            return Err(anyhow!("No recipients in {}", self.path.display()));
+        }
+
+        Ok(keys)
+    }
+
+    /// Check the key fetched for a user is one of the fingerprints pinned for
+    /// it, users without pins accept any key
+    /// # Errors
+    /// Will return an error if the key is not pinned
+    pub fn check_pin(&self, user: &str, key: &PublicKey) -> Result<()> {
+        let Some(pins) = self.pins.get(user) else {
+            return Ok(());
+        };
+
+        let fingerprint = key.fingerprint(HashAlg::Sha256).to_string();
+
+        if pins.contains(&fingerprint) {
+            return Ok(());
+        }
+
+        Err(anyhow!(
+            "The key {fingerprint} fetched for {user} does not match the fingerprints pinned in {}: {}",
+            self.path.display(),
+            pins.join(", ")
+        ))
+    }
+}
+
+/// Compile a list of glob patterns
+/// # Errors
+/// Will return an error if a pattern is not a valid glob
+pub fn globs(patterns: &[String]) -> Result<GlobSet> {
+    let mut builder = GlobSetBuilder::new();
+
+    for pattern in patterns {
+        builder.add(Glob::new(pattern).with_context(|| format!("Invalid pattern {pattern}"))?);
+    }
+
+    Ok(builder.build()?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    #[test]
+    fn test_find() {
+        let dir = tempfile::tempdir().unwrap();
+        let sub = dir.path().join("a/b");
+        fs::create_dir_all(&sub).unwrap();
+
+        fs::copy("test_data/ed25519.pub", dir.path().join("ed25519.pub")).unwrap();
+        fs::write(
+            dir.path().join(POLICY_FILE),
+            format!(
+                "recipients:\n  - ed25519.pub\n  - {}\n",
+                fs::read_to_string("test_data/ed25519_password.pub")
+                    .unwrap()
+                    .trim()
+            ),
+        )
+        .unwrap();
+
+        let policy = Policy::find(&sub).unwrap().unwrap();
+        assert_eq!(policy.path, dir.path().join(POLICY_FILE));
+        assert_eq!(policy.recipients.len(), 2);
+        assert!(policy.users.is_empty());
+        assert!(policy.patterns.is_empty());
+        assert_eq!(policy.public_keys().unwrap().len(), 2);
+    }
+
+    #[test]
+    fn test_find_none() {
+        let dir = tempfile::tempdir().unwrap();
+        assert!(Policy::find(dir.path()).unwrap().is_none());
+        assert!(Policy::require(dir.path()).is_err());
+    }
+
+    #[test]
+    fn test_globs() {
+        let globs = globs(&["*.env".to_string(), "secrets/**".to_string()]).unwrap();
+        assert!(globs.is_match("db.env"));
+        assert!(globs.is_match("app/db.env"));
+        assert!(globs.is_match("secrets/api/token"));
+        assert!(!globs.is_match("README.md"));
+
+        assert!(super::globs(&["a[".to_string()]).is_err());
+    }
+
+    #[test]
+    fn test_check_pin() {
+        let key = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let other = find::public_key(Some("test_data/id_rsa.pub".to_string())).unwrap();
+
+        let policy = Policy {
+            pins: HashMap::from([(
+                "alice".to_string(),
+                vec![key.fingerprint(HashAlg::Sha256).to_string()],
+            )]),
+            ..Policy::default()
+        };
+
+        assert!(policy.check_pin("alice", &key).is_ok());
+        assert!(policy.check_pin("alice", &other).is_err());
+        assert!(policy.check_pin("bob", &other).is_ok());
+    }
+
+    #[test]
+    fn test_no_recipients() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::write(dir.path().join(POLICY_FILE), "users: []\n").unwrap();
+
+        let policy = Policy::require(dir.path()).unwrap();
+        assert!(policy.public_keys().is_err());
+    }
+}
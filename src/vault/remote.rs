@@ -1,18 +1,224 @@
-use crate::{cache, config, tools, vault::fingerprint};
-use anyhow::{anyhow, Result};
-use reqwest::header::HeaderMap;
+use crate::{
+    cache, config, logging, tools,
+    vault::{credentials, find, fingerprint, keyscan, oidc},
+};
+use ::config::Config;
+use anyhow::{anyhow, Context, Result};
+use reqwest::{
+    blocking::{Client, ClientBuilder, RequestBuilder, Response},
+    header::{
+        HeaderMap, HeaderName, HeaderValue, AUTHORIZATION, CONTENT_TYPE, ETAG, IF_MODIFIED_SINCE,
+        IF_NONE_MATCH, LAST_MODIFIED, RETRY_AFTER, USER_AGENT,
+    },
+    Identity, NoProxy, Proxy, StatusCode,
+};
 use rsa::RsaPublicKey;
-use ssh_key::{HashAlg, PublicKey};
-use std::collections::HashMap;
+use serde::Deserialize;
+use slog::{debug, info, warn};
+use ssh_key::{Certificate, Fingerprint, HashAlg, PublicKey};
+use std::{
+    env, fs,
+    process::{Command, Stdio},
+    sync::OnceLock,
+    thread,
+    time::{Duration, SystemTime},
+};
 use url::Url;
 
-const GITHUB_BASE_URL: &str = "https://github.com";
+const GITHUB_HOST: &str = "github.com";
 const SSHKEYS_ONLINE: &str = "https://ssh-keys.online/new";
 
-// Fetch the ssh keys from GitHub
+// algorithm of the certificates, e.g. ssh-ed25519-cert-v01@openssh.com
+const CERT_SUFFIX: &str = "-cert-v01@openssh.com";
+
+// defaults of http_connect_timeout and http_timeout in seconds, and http_retries
+const CONNECT_TIMEOUT: u64 = 10;
+const TIMEOUT: u64 = 30;
+const RETRIES: u32 = 3;
+
+// wait before the first retry, doubled for every other one, and the longest
+// wait, a longer Retry-After fails the request
+const BACKOFF: Duration = Duration::from_millis(500);
+const MAX_WAIT: Duration = Duration::from_secs(60);
+
+// client set by the application, used for every request
+static CLIENT: OnceLock<Client> = OnceLock::new();
+
+// proxy set with --socks5, also used by ssh
+static SOCKS5: OnceLock<String> = OnceLock::new();
+
+/// Use this client to fetch the keys instead of the one built by ssh-vault,
+/// e.g. with a proxy, custom TLS roots or tracing. The `http_headers` of the
+/// config are still added to every request
+/// # Errors
+/// Will return an error if a client was already set
+pub fn set_client(client: Client) -> Result<()> {
+    CLIENT
+        .set(client)
+        .map_err(|_| anyhow!("The HTTP client was already set"))
+}
+
+// The client set by the application or the default one
+fn client() -> Result<Client> {
+    CLIENT
+        .get()
+        .map_or_else(default_client, |client| Ok(client.clone()))
+}
+
+/// The client used unless the application sets its own, connecting within
+/// `http_connect_timeout` seconds and giving up on a request after
+/// `http_timeout` seconds of the config
+///
+/// Requests go through the `socks5` proxy of the config or `ALL_PROXY` if set
+/// and present the `tls_client_cert` to servers requiring mutual TLS
+/// # Errors
+/// Will return an error if the proxy or the client certificate are not valid
+/// or the TLS backend can't be initialized
+pub fn default_client() -> Result<Client> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    let mut builder = builder(&config)?;
+
+    if let Some(proxy) = proxy(&config) {
+        builder = builder.proxy(all_proxy(&proxy)?);
+    }
+
+    Ok(builder.build()?)
+}
+
+/// Fetch every key through a SOCKS5 proxy, `host:port` or a `socks5://` or
+/// `socks5h://` URL, over HTTP and ssh
+/// # Errors
+/// Will return an error if the proxy or the client certificate are not valid,
+/// the TLS backend can't be initialized or the client was already set
+pub fn set_socks5(proxy: &str) -> Result<()> {
+    let url = socks5_url(proxy);
+
+    set_client(builder(&config::get()?)?.proxy(all_proxy(&url)?).build()?)?;
+
+    SOCKS5
+        .set(url)
+        .map_err(|_| anyhow!("The SOCKS5 proxy was already set"))
+}
+
+fn builder(config: &Config) -> Result<ClientBuilder> {
+    let builder = Client::builder()
+        .user_agent("ssh-vault")
+        .connect_timeout(seconds(config, "http_connect_timeout", CONNECT_TIMEOUT))
+        .timeout(seconds(config, "http_timeout", TIMEOUT));
+
+    Ok(match identity(config)? {
+        Some(identity) => builder.identity(identity),
+        None => builder,
+    })
+}
+
+// The client certificate for mutual TLS, `tls_client_cert` is the PEM
+// certificate chain and `tls_client_key` its PKCS#8 PEM key
+fn identity(config: &Config) -> Result<Option<Identity>> {
+    let cert = config.get_string("tls_client_cert").ok();
+    let key = config.get_string("tls_client_key").ok();
+
+    let (cert, key) = match (cert, key) {
+        (None, None) => return Ok(None),
+        (Some(cert), Some(key)) => (cert, key),
+        _ => {
+            return Err(anyhow!(
+                "tls_client_cert and tls_client_key must be set together"
+            ))
+        }
+    };
+
+    let read = |path: &str| fs::read(path).with_context(|| format!("Could not read {path}"));
+
+    Identity::from_pkcs8_pem(&read(&cert)?, &read(&key)?)
+        .map(Some)
+        .with_context(|| format!("Invalid client certificate {cert} or key {key}"))
+}
+
+// The proxy for every request, the hosts of NO_PROXY are reached directly
+fn all_proxy(url: &str) -> Result<Proxy> {
+    Ok(Proxy::all(url)
+        .with_context(|| format!("Invalid proxy: {url}"))?
+        .no_proxy(NoProxy::from_env()))
+}
+
+// The socks5 proxy of the config, otherwise ALL_PROXY, reqwest only uses
+// HTTP_PROXY and HTTPS_PROXY by itself
+fn proxy(config: &Config) -> Option<String> {
+    if let Ok(proxy) = config.get_string("socks5") {
+        if !proxy.is_empty() {
+            return Some(socks5_url(&proxy));
+        }
+    }
+
+    ["ALL_PROXY", "all_proxy"]
+        .iter()
+        .find_map(|name| env::var(name).ok().filter(|proxy| !proxy.is_empty()))
+}
+
+/// host:port of the SOCKS proxy ssh and the keyscan connect through, HTTP
+/// proxies are ignored
+/// # Errors
+/// Will return an error if the proxy is not valid
+pub fn ssh_proxy() -> Result<Option<String>> {
+    let proxy = match SOCKS5.get() {
+        Some(proxy) => Some(proxy.clone()),
+        None => proxy(&config::get()?),
+    };
+
+    let Some(proxy) = proxy else {
+        return Ok(None);
+    };
+
+    let url = Url::parse(&proxy).with_context(|| format!("Invalid proxy: {proxy}"))?;
+
+    if !url.scheme().starts_with("socks") {
+        return Ok(None);
+    }
+
+    let host = url
+        .host_str()
+        .ok_or_else(|| anyhow!("Missing host in the proxy {proxy}"))?;
+
+    Ok(Some(format!("{host}:{}", url.port().unwrap_or(1080))))
+}
+
+// host:port as a proxy URL, socks5h so the proxy resolves the host names and
+// they don't leak to the local DNS, as Tor requires
+fn socks5_url(proxy: &str) -> String {
+    if proxy.contains("://") {
+        proxy.to_string()
+    } else {
+        format!("socks5h://{proxy}")
+    }
+}
+
+// A positive number of seconds from the config or the default
+fn seconds(config: &Config, name: &str, default: u64) -> Duration {
+    Duration::from_secs(
+        config
+            .get_int(name)
+            .ok()
+            .and_then(|n| u64::try_from(n).ok())
+            .filter(|n| *n > 0)
+            .unwrap_or(default),
+    )
+}
+
+// Fetch the ssh keys from GitHub, `user`, `host/user` for GitHub Enterprise or
+// `[host/]@org/team` for the keys of the members of a team, `oidc:identity`
+// from the OIDC endpoint of the config, `user@domain` from the domain or
+// `host:server` the host key of the server
 pub fn get_keys(user: &str) -> Result<String> {
     let mut cache = true;
 
+    // scanned every time, --strict notices a new host key
+    if let Some(host) = user.strip_prefix(keyscan::PREFIX) {
+        return keyscan::host_keys(host);
+    }
+
     let url = if user.starts_with("http://") || user.starts_with("https://") {
         Url::parse(user)?
     } else if user == "new" {
@@ -26,11 +232,283 @@ pub fn get_keys(user: &str) -> Result<String> {
                 .get_string("sshkeys_online")
                 .unwrap_or_else(|_| String::from(SSHKEYS_ONLINE)),
         )?
+    } else if let Some(identity) = user.strip_prefix(oidc::PREFIX) {
+        oidc::keys_url(identity)?
+    } else if let Some(url) = well_known_url(user)? {
+        url
     } else {
-        Url::parse(&format!("{GITHUB_BASE_URL}/{user}.keys"))?
+        match github_source(user, &github_host()?)? {
+            GitHub::User(url) => url,
+            GitHub::Team { host, org, team } => {
+                let keys = team_keys(&host, &org, &team)?;
+
+                return match TrustedCa::from_config()? {
+                    Some(ca) => ca.keys(&keys),
+                    None => Ok(keys),
+                };
+            }
+        }
     };
 
-    request(url.as_str(), cache)
+    let keys = request(url.as_str(), cache)?;
+
+    // only the certificates signed by the trusted CA are accepted
+    match TrustedCa::from_config()? {
+        Some(ca) if cache => ca.keys(&keys),
+        _ => Ok(keys),
+    }
+}
+
+// `user@domain` publishes its keys in https://domain/.well-known/ssh-keys/user,
+// GitHub names can't have an @, teams start with it
+fn well_known_url(user: &str) -> Result<Option<Url>> {
+    let Some((local, domain)) = user.split_once('@') else {
+        return Ok(None);
+    };
+
+    if local.is_empty() || local.contains('/') {
+        return Ok(None);
+    }
+
+    if domain.is_empty() || domain.contains(['/', '@']) {
+        return Err(anyhow!("Invalid recipient {user}, expected user@domain"));
+    }
+
+    let mut url = Url::parse(&format!("https://{domain}/.well-known/ssh-keys/"))
+        .with_context(|| format!("Invalid domain in {user}"))?;
+
+    url.path_segments_mut()
+        .map_err(|()| anyhow!("Invalid domain in {user}"))?
+        .pop_if_empty()
+        .push(local);
+
+    Ok(Some(url))
+}
+
+#[derive(Debug, PartialEq, Eq)]
+enum GitHub {
+    // the keys of a user
+    User(Url),
+    // the members of a team, their keys are fetched one by one
+    Team {
+        host: String,
+        org: String,
+        team: String,
+    },
+}
+
+// The GitHub host, `github_host` in the config for GitHub Enterprise
+fn github_host() -> Result<String> {
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    Ok(config
+        .get_string("github_host")
+        .ok()
+        .filter(|host| !host.is_empty())
+        .unwrap_or_else(|| String::from(GITHUB_HOST)))
+}
+
+// Where to fetch the keys of `user`, `host/user` or `[host/]@org/team`, a
+// host has a dot or a port, GitHub names can't have either
+fn github_source(user: &str, default_host: &str) -> Result<GitHub> {
+    let (host, name) = match user.split_once('/') {
+        Some((host, name)) if host.contains(['.', ':']) => (host, name),
+        _ => (default_host, user),
+    };
+
+    if let Some(team) = name.strip_prefix('@') {
+        let (org, team) = team
+            .split_once('/')
+            .filter(|(org, team)| !org.is_empty() && !team.is_empty() && !team.contains('/'))
+            .ok_or_else(|| anyhow!("Invalid team {user}, expected [host/]@org/team"))?;
+
+        return Ok(GitHub::Team {
+            host: host.to_string(),
+            org: org.to_string(),
+            team: team.to_string(),
+        });
+    }
+
+    if name.is_empty() || name.contains('/') {
+        return Err(anyhow!("Invalid user {user}, expected [host/]user"));
+    }
+
+    Ok(GitHub::User(Url::parse(&format!(
+        "https://{host}/{name}.keys"
+    ))?))
+}
+
+// The REST API of github.com or of a GitHub Enterprise host
+fn github_api(host: &str) -> String {
+    if host == GITHUB_HOST {
+        String::from("https://api.github.com")
+    } else {
+        format!("https://{host}/api/v3")
+    }
+}
+
+// Keys of the members of a team, listing the members requires `github_token`
+fn team_keys(host: &str, org: &str, team: &str) -> Result<String> {
+    #[derive(Deserialize)]
+    struct Member {
+        login: String,
+    }
+
+    const PER_PAGE: usize = 100;
+
+    let mut keys = String::new();
+
+    for page in 1.. {
+        let url = format!(
+            "{}/orgs/{org}/teams/{team}/members?per_page={PER_PAGE}&page={page}",
+            github_api(host)
+        );
+
+        let members: Vec<Member> = serde_json::from_str(&request(&url, false)?)
+            .with_context(|| format!("Unexpected response listing the members of @{org}/{team}"))?;
+
+        for member in &members {
+            let fetched = request(&format!("https://{host}/{}.keys", member.login), true)?;
+            keys.push_str(fetched.trim_end());
+            keys.push('\n');
+        }
+
+        if members.len() < PER_PAGE {
+            break;
+        }
+    }
+
+    if keys.trim().is_empty() {
+        return Err(anyhow!("No keys found for the members of @{org}/{team}"));
+    }
+
+    Ok(keys)
+}
+
+// The `github_token` is only sent to the GitHub host and its API
+fn github_token(url: &Url, github_host: &str) -> Result<Option<String>> {
+    let api = github_api(github_host);
+    let api_host = Url::parse(&api)?.host_str().map(str::to_string);
+
+    let host = url.host_str();
+
+    if host != Some(github_host) && host != api_host.as_deref() {
+        return Ok(None);
+    }
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    Ok(config
+        .get_string("github_token")
+        .ok()
+        .filter(|token| !token.is_empty()))
+}
+
+/// Certificate authority that must sign the certificates returned by a key
+/// source, `trusted_ca` and `trusted_principals` in the config
+pub struct TrustedCa {
+    fingerprints: Vec<Fingerprint>,
+    principals: Vec<String>,
+}
+
+impl TrustedCa {
+    /// Load the trusted CA from the config, None if not configured
+    /// # Errors
+    /// Will return an error if the CA public keys can't be read
+    pub fn from_config() -> Result<Option<Self>> {
+        let config = config::get()?;
+
+        let Ok(path) = config.get_string("trusted_ca") else {
+            return Ok(None);
+        };
+
+        // a list in the config file or comma separated in the environment
+        let principals = config.get_array("trusted_principals").map_or_else(
+            |_| {
+                config
+                    .get_string("trusted_principals")
+                    .unwrap_or_default()
+                    .split(',')
+                    .map(str::trim)
+                    .filter(|principal| !principal.is_empty())
+                    .map(str::to_string)
+                    .collect()
+            },
+            |principals| {
+                principals
+                    .into_iter()
+                    .filter_map(|principal| principal.into_string().ok())
+                    .collect()
+            },
+        );
+
+        Ok(Some(Self::new(&find::public_keys(&path)?, principals)))
+    }
+
+    #[must_use]
+    pub fn new(keys: &[PublicKey], principals: Vec<String>) -> Self {
+        Self {
+            fingerprints: keys
+                .iter()
+                .map(|key| key.fingerprint(HashAlg::Sha256))
+                .collect(),
+            principals,
+        }
+    }
+
+    /// Validate the certificates and return their public keys, keys without a
+    /// certificate are ignored
+    /// # Errors
+    /// Will return an error if a certificate is not signed by the CA, expired,
+    /// not for the principals or there are no certificates
+    pub fn keys(&self, keys: &str) -> Result<String> {
+        let mut accepted = String::new();
+
+        for line in keys.lines().map(str::trim) {
+            if !line
+                .split(' ')
+                .next()
+                .unwrap_or_default()
+                .ends_with(CERT_SUFFIX)
+            {
+                continue;
+            }
+
+            let certificate = Certificate::from_openssh(line).context("Invalid certificate")?;
+
+            certificate.validate(&self.fingerprints).map_err(|e| {
+                anyhow!(
+                    "The certificate {} is not valid for the trusted CA: {e}",
+                    certificate.key_id()
+                )
+            })?;
+
+            if !self.principals.is_empty()
+                && !certificate
+                    .valid_principals()
+                    .iter()
+                    .any(|principal| self.principals.contains(principal))
+            {
+                return Err(anyhow!(
+                    "The certificate {} is not valid for the principals {}",
+                    certificate.key_id(),
+                    self.principals.join(", ")
+                ));
+            }
+
+            let key = PublicKey::new(certificate.public_key().clone(), certificate.key_id());
+            accepted.push_str(&key.to_openssh()?);
+            accepted.push('\n');
+        }
+
+        if accepted.is_empty() {
+            return Err(anyhow!("No certificates signed by the trusted CA found"));
+        }
+
+        Ok(accepted)
+    }
 }
 
 pub fn request(url: &str, cache: bool) -> Result<String> {
@@ -40,26 +518,67 @@ pub fn request(url: &str, cache: bool) -> Result<String> {
 
     // load from cache
     if let Ok(key) = cache::get(&cache_key) {
+        debug!(logging::logger(), "keys from the cache"; "url" => %url);
         Ok(key)
     } else {
         // get the headers
         let headers: HeaderMap = get_headers()?;
 
-        // Create a client
-        let client = reqwest::blocking::Client::builder()
-            .user_agent("ssh-vault")
-            .default_headers(headers)
-            .build()?;
+        let mut req = client()?.get(url.clone()).headers(headers);
+
+        if let Some(auth) = credentials::find(&url)? {
+            req = auth.apply(req);
+        } else if let Some(token) = github_token(&url, &github_host()?)? {
+            req = req.header(AUTHORIZATION, format!("token {token}"));
+        } else if let Some(token) = oidc::token(&url)? {
+            req = req.header(AUTHORIZATION, oidc::bearer(&token));
+        }
+
+        // revalidate an expired response, only downloaded again if it changed
+        let stale = if cache {
+            cache::get_stale(&cache_key)
+        } else {
+            None
+        };
+
+        if stale.is_some() {
+            if let Some(validators) = cache::get_validators(&cache_key) {
+                if let Some(etag) = validators.etag {
+                    req = req.header(IF_NONE_MATCH, etag);
+                }
+
+                if let Some(last_modified) = validators.last_modified {
+                    req = req.header(IF_MODIFIED_SINCE, last_modified);
+                }
+            }
+        }
 
         // Make a GET request
-        let res = client.get(url).send()?;
+        debug!(logging::logger(), "fetching keys"; "url" => %url, "revalidate" => stale.is_some());
+        let res = send(&req)?;
+
+        info!(logging::logger(), "fetched keys"; "url" => %url, "status" => res.status().as_u16());
+
+        if res.status() == StatusCode::NOT_MODIFIED {
+            if let Some(body) = stale {
+                // the keys didn't change, renew the cache
+                cache::put(&cache_key, &body)?;
+                return Ok(body);
+            }
+        }
 
         if res.status().is_success() {
+            let validators = cache::Validators {
+                etag: header(res.headers(), &ETAG),
+                last_modified: header(res.headers(), &LAST_MODIFIED),
+            };
+
             // Read the response body
             let body = res.text()?;
 
             if cache {
                 cache::put(&cache_key, &body)?;
+                cache::put_validators(&cache_key, &validators)?;
             }
             Ok(body)
         } else {
@@ -68,21 +587,304 @@ pub fn request(url: &str, cache: bool) -> Result<String> {
     }
 }
 
+/// GET a file as is, never cached, with the headers and the credentials of the
+/// config like the keys
+/// # Errors
+/// Will return an error if the request fails or the status is not a success
+pub fn download(url: &Url) -> Result<Vec<u8>> {
+    let mut req = client()?.get(url.clone()).headers(get_headers()?);
+
+    if let Some(auth) = credentials::find(url)? {
+        req = auth.apply(req);
+    } else if let Some(token) = github_token(url, &github_host()?)? {
+        req = req.header(AUTHORIZATION, format!("token {token}"));
+    }
+
+    debug!(logging::logger(), "downloading"; "url" => %url);
+    let res = send(&req)?;
+
+    info!(logging::logger(), "downloaded"; "url" => %url, "status" => res.status().as_u16());
+
+    if res.status().is_success() {
+        Ok(res.bytes()?.to_vec())
+    } else {
+        Err(anyhow!("Request failed with status: {}", res.status()))
+    }
+}
+
+/// POST the body with the headers and the credentials of the config, returns
+/// the response, not retried as the request may not be idempotent
+/// # Errors
+/// Will return an error if the request fails or the status is not a success
+pub fn post(url: &Url, body: Vec<u8>) -> Result<String> {
+    post_as(url, "text/plain", body)
+}
+
+/// POST a JSON document like `post`
+/// # Errors
+/// Will return an error if the request fails or the status is not a success
+pub fn post_json(url: &Url, value: &serde_json::Value) -> Result<String> {
+    post_as(url, "application/json", serde_json::to_vec(value)?)
+}
+
+fn post_as(url: &Url, content_type: &'static str, body: Vec<u8>) -> Result<String> {
+    let mut req = client()?
+        .post(url.clone())
+        .headers(get_headers()?)
+        .header(CONTENT_TYPE, content_type)
+        .body(body);
+
+    if let Some(auth) = credentials::find(url)? {
+        req = auth.apply(req);
+    }
+
+    let res = req.send()?;
+
+    info!(logging::logger(), "uploaded"; "url" => %url, "status" => res.status().as_u16());
+
+    if res.status().is_success() {
+        Ok(res.text()?)
+    } else {
+        Err(anyhow!("Request failed with status: {}", res.status()))
+    }
+}
+
+// Send the request retrying transient failures, timeouts, connection errors,
+// 429 and 5xx errors, up to `http_retries` times (3) with exponential backoff
+// or waiting what the server asks with Retry-After
+fn send(req: &RequestBuilder) -> Result<Response> {
+    let retries = config::get()?
+        .get_int("http_retries")
+        .ok()
+        .and_then(|n| u32::try_from(n).ok())
+        .unwrap_or(RETRIES);
+
+    let mut attempt = 0;
+
+    loop {
+        let rs = req
+            .try_clone()
+            .ok_or_else(|| anyhow!("The request can't be retried"))?
+            .send();
+
+        let (reason, wait) = match &rs {
+            Ok(res) if transient(res.status()) => (
+                res.status().to_string(),
+                retry_after(res.headers(), SystemTime::now()),
+            ),
+            Err(e) if e.is_timeout() || e.is_connect() => (e.to_string(), None),
+            _ => return Ok(rs?),
+        };
+
+        let wait = wait.unwrap_or_else(|| backoff(attempt));
+
+        if attempt >= retries || wait > MAX_WAIT {
+            return Ok(rs?);
+        }
+
+        warn!(logging::logger(), "retrying";
+            "reason" => %reason, "attempt" => attempt + 1, "wait" => wait.as_secs_f32());
+        eprintln!("{reason}, retrying in {}s", wait.as_secs_f32());
+        thread::sleep(wait);
+
+        attempt += 1;
+    }
+}
+
+// Errors worth trying again, the server may be overloaded or restarting
+const fn transient(status: StatusCode) -> bool {
+    matches!(
+        status,
+        StatusCode::REQUEST_TIMEOUT
+            | StatusCode::TOO_MANY_REQUESTS
+            | StatusCode::INTERNAL_SERVER_ERROR
+            | StatusCode::BAD_GATEWAY
+            | StatusCode::SERVICE_UNAVAILABLE
+            | StatusCode::GATEWAY_TIMEOUT
+    )
+}
+
+// 0.5s, 1s, 2s, ... up to the longest wait
+fn backoff(attempt: u32) -> Duration {
+    BACKOFF
+        .checked_mul(2_u32.saturating_pow(attempt))
+        .map_or(MAX_WAIT, |wait| wait.min(MAX_WAIT))
+}
+
+// Retry-After in seconds or as an HTTP date, e.g. Wed, 21 Oct 2015 07:28:00 GMT
+fn retry_after(headers: &HeaderMap, now: SystemTime) -> Option<Duration> {
+    let value = headers.get(RETRY_AFTER)?.to_str().ok()?.trim();
+
+    if let Ok(seconds) = value.parse::<u64>() {
+        return Some(Duration::from_secs(seconds));
+    }
+
+    let [_, day, month, year, time, "GMT"] = value.split_whitespace().collect::<Vec<_>>()[..]
+    else {
+        return None;
+    };
+
+    let month = [
+        "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+    ]
+    .iter()
+    .position(|name| *name == month)?
+        + 1;
+
+    let date = humantime::parse_rfc3339(&format!("{year}-{month:02}-{day}T{time}Z")).ok()?;
+
+    // a date in the past means now
+    Some(date.duration_since(now).unwrap_or_default())
+}
+
+fn header(headers: &HeaderMap, name: &HeaderName) -> Option<String> {
+    headers
+        .get(name)
+        .and_then(|value| value.to_str().ok())
+        .map(str::to_string)
+}
+
+/// Get keys over ssh
+///
+/// `ssh://[user@]host[:port]` returns the keys advertised by the host and
+/// `ssh://[user@]host[:port]/path` the content of a file in the host, `/~/path`
+/// is relative to the home directory
+///
+/// Through a SOCKS proxy ssh connects with `nc -X 5`, ssh-keyscan can't use a
+/// proxy so the host keys must be read as files
+/// # Errors
+/// Will return an error if the URL is not valid or ssh fails
+pub fn ssh_request(url: &str) -> Result<String> {
+    let url = Url::parse(url)?;
+    let host = url
+        .host_str()
+        .ok_or_else(|| anyhow!("Missing host in {url}"))?;
+
+    let keyscan = url.path().is_empty() || url.path() == "/";
+
+    if keyscan && ssh_proxy()?.is_some() {
+        return Err(anyhow!(
+            "ssh-keyscan can't use a proxy, use ssh://{host}/etc/ssh/ssh_host_ed25519_key.pub"
+        ));
+    }
+
+    let mut command = if keyscan {
+        let mut command = Command::new("ssh-keyscan");
+        command.args(["-t", "ed25519,rsa"]);
+        command
+    } else {
+        ssh_command()?
+    };
+
+    if let Some(port) = url.port() {
+        command.args(["-p", &port.to_string()]);
+    }
+
+    if keyscan {
+        command.arg(host);
+    } else {
+        let destination = if url.username().is_empty() {
+            host.to_string()
+        } else {
+            format!("{}@{host}", url.username())
+        };
+
+        command.args([destination, format!("cat {}", remote_path(url.path()))]);
+    }
+
+    debug!(logging::logger(), "fetching keys over ssh"; "url" => %url, "keyscan" => keyscan);
+
+    let output = command.stdin(Stdio::null()).output()?;
+
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+
+        return Err(match stderr.trim() {
+            "" => anyhow!("Could not get {url}"),
+            stderr => anyhow!("Could not get {url}: {stderr}"),
+        });
+    }
+
+    let body = String::from_utf8(output.stdout)?;
+
+    Ok(if keyscan { host_keys(&body) } else { body })
+}
+
+/// ssh, through the SOCKS proxy with `nc -X 5` if set
+/// # Errors
+/// Will return an error if the proxy is not valid
+pub fn ssh_command() -> Result<Command> {
+    let mut command = Command::new("ssh");
+
+    if let Some(proxy) = ssh_proxy()? {
+        command.args(["-o", &format!("ProxyCommand=nc -X 5 -x {proxy} %h %p")]);
+    }
+
+    Ok(command)
+}
+
+/// ssh without a tty to the destination, ready for the remote command
+/// # Errors
+/// Will return an error if the destination or the proxy is not valid
+pub fn ssh_session(destination: &str) -> Result<Command> {
+    // an option would be taken by ssh, e.g. -oProxyCommand=
+    if destination.is_empty() || destination.starts_with('-') {
+        return Err(anyhow!("Invalid destination {destination}"));
+    }
+
+    let mut command = ssh_command()?;
+    command.arg("-T").arg(destination);
+
+    Ok(command)
+}
+
+// quote the path for the remote shell, keeping ~ to expand the home directory
+fn remote_path(path: &str) -> String {
+    let (home, path) = path
+        .strip_prefix("/~/")
+        .map_or(("", path), |path| ("~/", path));
+
+    format!("{home}'{}'", path.replace('\'', r"'\''"))
+}
+
+// ssh-keyscan prints "host type key", as public keys "type key host"
+fn host_keys(output: &str) -> String {
+    output
+        .lines()
+        .filter(|line| !line.starts_with('#'))
+        .filter_map(|line| line.split_once(' '))
+        .map(|(host, key)| format!("{key} {host}\n"))
+        .collect()
+}
+
 // Get the HTTP headers from the config
+// Headers of the requests, `user_agent` overrides the User-Agent and
+// `http_headers` adds headers, e.g. the auth header of an internal keyserver
 fn get_headers() -> Result<HeaderMap> {
-    let mut config_headers: HashMap<String, String> = HashMap::new();
+    let mut headers = HeaderMap::new();
 
     // get the config from ~/.config/ssh-vault/config.yml
     let config = config::get()?;
 
+    if let Ok(user_agent) = config.get_string("user_agent") {
+        headers.insert(
+            USER_AGENT,
+            HeaderValue::from_str(&user_agent).context("Invalid user_agent in the config")?,
+        );
+    }
+
     if let Ok(http_headers) = config.get_table("http_headers") {
-        for (key, value) in &http_headers {
-            config_headers.insert(key.to_string(), value.to_string());
+        for (name, value) in http_headers {
+            headers.insert(
+                HeaderName::from_bytes(name.as_bytes())
+                    .with_context(|| format!("Invalid header name in http_headers: {name}"))?,
+                HeaderValue::from_str(&value.to_string()).with_context(|| {
+                    format!("Invalid value of the header {name} in http_headers")
+                })?,
+            );
         }
     }
 
-    let headers: HeaderMap = (&config_headers).try_into().unwrap_or_default();
-
     Ok(headers)
 }
 
@@ -189,6 +991,62 @@ Fin
         ]
     }
 
+    #[test]
+    fn test_remote_path() {
+        assert_eq!(remote_path("/etc/ssh/keys"), "'/etc/ssh/keys'");
+        assert_eq!(
+            remote_path("/~/.ssh/id_ed25519.pub"),
+            "~/'.ssh/id_ed25519.pub'"
+        );
+        assert_eq!(remote_path("/it's"), r"'/it'\''s'");
+    }
+
+    #[test]
+    fn test_host_keys() {
+        let output = "# github.com:22 SSH-2.0-babeld\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n";
+        let keys = host_keys(output);
+        assert_eq!(
+            keys,
+            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl github.com\n"
+        );
+        assert!(PublicKey::from_openssh(keys.trim()).is_ok());
+    }
+
+    #[test]
+    fn test_trusted_ca() {
+        let ca = TrustedCa::new(&find::public_keys("test_data/ca.pub").unwrap(), Vec::new());
+        let certificate = std::fs::read_to_string("test_data/ed25519-cert.pub").unwrap();
+
+        // keys without a certificate are not trusted
+        assert!(ca.keys(KEYS).is_err());
+
+        let keys = ca.keys(&format!("{KEYS}\n{certificate}")).unwrap();
+        let key = PublicKey::from_openssh(keys.trim()).unwrap();
+        assert_eq!(
+            key.fingerprint(HashAlg::Sha256).to_string(),
+            "SHA256:hgIL5fEHz5zuOWY1CDlUuotdaUl4MvYG7vAgE4q4TzM"
+        );
+
+        let ca = TrustedCa::new(
+            &find::public_keys("test_data/ca.pub").unwrap(),
+            vec!["ops".to_string()],
+        );
+        assert!(ca.keys(&certificate).is_ok());
+
+        let ca = TrustedCa::new(
+            &find::public_keys("test_data/ca.pub").unwrap(),
+            vec!["root".to_string()],
+        );
+        assert!(ca.keys(&certificate).is_err());
+
+        // signed by another CA
+        let ca = TrustedCa::new(
+            &find::public_keys("test_data/ed25519.pub").unwrap(),
+            Vec::new(),
+        );
+        assert!(ca.keys(&certificate).is_err());
+    }
+
     #[test]
     fn test_get_remote_fingerprints() {
         let f = get_remote_fingerprints(KEYS, None).unwrap();
@@ -325,5 +1183,275 @@ Fin
     fn test_get_headers() {
         let headers = get_headers().unwrap();
         assert!(headers.is_empty());
+
+        temp_env::with_vars([("SSH_VAULT_USER_AGENT", Some("keys-audit/1.0"))], || {
+            let headers = get_headers().unwrap();
+            assert_eq!(headers.get(USER_AGENT).unwrap(), "keys-audit/1.0");
+        });
+
+        temp_env::with_vars([("SSH_VAULT_USER_AGENT", Some("bad\nagent"))], || {
+            assert!(get_headers().is_err());
+        });
+    }
+
+    #[test]
+    fn test_well_known_url() {
+        assert_eq!(
+            well_known_url("alice@example.com")
+                .unwrap()
+                .unwrap()
+                .as_str(),
+            "https://example.com/.well-known/ssh-keys/alice"
+        );
+        assert_eq!(
+            well_known_url("a b@example.com:8443")
+                .unwrap()
+                .unwrap()
+                .as_str(),
+            "https://example.com:8443/.well-known/ssh-keys/a%20b"
+        );
+        assert_eq!(well_known_url("alice").unwrap(), None);
+        assert_eq!(well_known_url("@infra/oncall").unwrap(), None);
+        assert_eq!(
+            well_known_url("ghe.example.com/@infra/oncall").unwrap(),
+            None
+        );
+        assert!(well_known_url("alice@").is_err());
+        assert!(well_known_url("alice@example.com/keys").is_err());
+    }
+
+    #[test]
+    fn test_github_source() {
+        assert_eq!(
+            github_source("alice", GITHUB_HOST).unwrap(),
+            GitHub::User(Url::parse("https://github.com/alice.keys").unwrap())
+        );
+        assert_eq!(
+            github_source("ghe.mycorp.com/alice", GITHUB_HOST).unwrap(),
+            GitHub::User(Url::parse("https://ghe.mycorp.com/alice.keys").unwrap())
+        );
+        assert_eq!(
+            github_source("alice", "ghe.mycorp.com").unwrap(),
+            GitHub::User(Url::parse("https://ghe.mycorp.com/alice.keys").unwrap())
+        );
+        assert_eq!(
+            github_source("ghe.mycorp.com:8443/@infra/oncall", GITHUB_HOST).unwrap(),
+            GitHub::Team {
+                host: "ghe.mycorp.com:8443".to_string(),
+                org: "infra".to_string(),
+                team: "oncall".to_string(),
+            }
+        );
+        assert!(github_source("@infra", GITHUB_HOST).is_err());
+        assert!(github_source("@infra/oncall/extra", GITHUB_HOST).is_err());
+        assert!(github_source("alice/bob", GITHUB_HOST).is_err());
+        assert!(github_source("ghe.mycorp.com/", GITHUB_HOST).is_err());
+    }
+
+    #[test]
+    fn test_github_token() {
+        temp_env::with_vars([("SSH_VAULT_GITHUB_TOKEN", Some("ghp_secret"))], || {
+            let token = |url: &str, host: &str| github_token(&Url::parse(url).unwrap(), host);
+
+            assert_eq!(
+                token("https://github.com/alice.keys", GITHUB_HOST).unwrap(),
+                Some("ghp_secret".to_string())
+            );
+            assert_eq!(
+                token("https://api.github.com/orgs/infra", GITHUB_HOST).unwrap(),
+                Some("ghp_secret".to_string())
+            );
+            assert_eq!(
+                token("https://ghe.mycorp.com/api/v3/orgs", "ghe.mycorp.com").unwrap(),
+                Some("ghp_secret".to_string())
+            );
+
+            // never sent to other hosts
+            assert_eq!(
+                token("https://keys.example.com/alice", GITHUB_HOST).unwrap(),
+                None
+            );
+            assert_eq!(
+                token("https://github.com/alice.keys", "ghe.mycorp.com").unwrap(),
+                None
+            );
+        });
+    }
+
+    #[test]
+    fn test_retry_after() {
+        let now = humantime::parse_rfc3339("2015-10-21T07:27:00Z").unwrap();
+        let retry_after = |value: &str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(RETRY_AFTER, HeaderValue::from_str(value).unwrap());
+            super::retry_after(&headers, now)
+        };
+
+        assert_eq!(retry_after("120"), Some(Duration::from_secs(120)));
+        assert_eq!(
+            retry_after("Wed, 21 Oct 2015 07:28:00 GMT"),
+            Some(Duration::from_secs(60))
+        );
+        assert_eq!(
+            retry_after("Wed, 21 Oct 2015 07:00:00 GMT"),
+            Some(Duration::ZERO)
+        );
+        assert_eq!(retry_after("soon"), None);
+        assert_eq!(retry_after("Wed, 21 Foo 2015 07:28:00 GMT"), None);
+        assert_eq!(super::retry_after(&HeaderMap::new(), now), None);
+    }
+
+    #[test]
+    fn test_backoff() {
+        assert_eq!(backoff(0), Duration::from_millis(500));
+        assert_eq!(backoff(1), Duration::from_secs(1));
+        assert_eq!(backoff(3), Duration::from_secs(4));
+        assert_eq!(backoff(10), MAX_WAIT);
+        assert_eq!(backoff(u32::MAX), MAX_WAIT);
+
+        assert!(transient(StatusCode::TOO_MANY_REQUESTS));
+        assert!(transient(StatusCode::SERVICE_UNAVAILABLE));
+        assert!(!transient(StatusCode::NOT_FOUND));
+        assert!(!transient(StatusCode::UNAUTHORIZED));
+    }
+
+    #[test]
+    fn test_seconds() {
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_HTTP_TIMEOUT", Some("5")),
+                ("SSH_VAULT_HTTP_CONNECT_TIMEOUT", Some("-1")),
+            ],
+            || {
+                let config = config::get().unwrap();
+                assert_eq!(
+                    seconds(&config, "http_timeout", TIMEOUT),
+                    Duration::from_secs(5)
+                );
+                assert_eq!(
+                    seconds(&config, "http_connect_timeout", CONNECT_TIMEOUT),
+                    Duration::from_secs(CONNECT_TIMEOUT)
+                );
+            },
+        );
+    }
+
+    #[test]
+    fn test_proxy() {
+        assert_eq!(socks5_url("127.0.0.1:9050"), "socks5h://127.0.0.1:9050");
+        assert_eq!(socks5_url("socks5://proxy:1080"), "socks5://proxy:1080");
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_SOCKS5", Some("127.0.0.1:9050")),
+                ("ALL_PROXY", Some("socks5://proxy:1080")),
+            ],
+            || {
+                assert_eq!(
+                    proxy(&config::get().unwrap()).unwrap(),
+                    "socks5h://127.0.0.1:9050"
+                )
+            },
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_SOCKS5", None),
+                ("ALL_PROXY", None),
+                ("all_proxy", Some("socks5://proxy:1080")),
+            ],
+            || {
+                assert_eq!(
+                    proxy(&config::get().unwrap()).unwrap(),
+                    "socks5://proxy:1080"
+                )
+            },
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_SOCKS5", None::<&str>),
+                ("ALL_PROXY", None),
+                ("all_proxy", None),
+            ],
+            || assert!(proxy(&config::get().unwrap()).is_none()),
+        );
+    }
+
+    #[test]
+    fn test_identity() {
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_TLS_CLIENT_CERT", Some("test_data/client.crt")),
+                ("SSH_VAULT_TLS_CLIENT_KEY", Some("test_data/client.key")),
+            ],
+            || {
+                assert!(identity(&config::get().unwrap()).unwrap().is_some());
+                assert!(default_client().is_ok());
+            },
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_TLS_CLIENT_CERT", Some("test_data/client.crt")),
+                ("SSH_VAULT_TLS_CLIENT_KEY", Some("test_data/ed25519")),
+            ],
+            || assert!(identity(&config::get().unwrap()).is_err()),
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_TLS_CLIENT_CERT", Some("test_data/client.crt")),
+                ("SSH_VAULT_TLS_CLIENT_KEY", None),
+            ],
+            || assert!(identity(&config::get().unwrap()).is_err()),
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_TLS_CLIENT_CERT", None::<&str>),
+                ("SSH_VAULT_TLS_CLIENT_KEY", None),
+            ],
+            || assert!(identity(&config::get().unwrap()).unwrap().is_none()),
+        );
+    }
+
+    #[test]
+    fn test_ssh_proxy() {
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_SOCKS5", Some("127.0.0.1:9050")),
+                ("ALL_PROXY", None),
+            ],
+            || {
+                assert_eq!(ssh_proxy().unwrap().unwrap(), "127.0.0.1:9050");
+                assert!(ssh_request("ssh://example.com").is_err());
+            },
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_SOCKS5", None),
+                ("ALL_PROXY", Some("socks5://proxy")),
+            ],
+            || assert_eq!(ssh_proxy().unwrap().unwrap(), "proxy:1080"),
+        );
+
+        temp_env::with_vars(
+            [
+                ("SSH_VAULT_SOCKS5", None),
+                ("ALL_PROXY", Some("http://proxy:3128")),
+            ],
+            || assert!(ssh_proxy().unwrap().is_none()),
+        );
+    }
+
+    #[test]
+    fn test_set_client() {
+        set_client(default_client().unwrap()).unwrap();
+        assert!(client().is_ok());
+
+        // only set once
+        assert!(set_client(default_client().unwrap()).is_err());
     }
 }
@@ -0,0 +1,99 @@
+use crate::{cache, config, vault::fingerprint::key_fingerprints};
+use anyhow::{anyhow, Result};
+use ssh_key::PublicKey;
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+/// Fingerprints of the keys that must not be used to create vaults, one per
+/// line followed by an optional note, e.g.:
+///
+/// ```text
+/// # left the team 2024-03-01
+/// SHA256:hgIL5fEHz5zuOWY1CDlUuotdaUl4MvYG7vAgE4q4TzM alice@laptop
+/// ```
+/// # Errors
+/// Will return an error if the revocation file can't be read
+pub fn load() -> Result<Vec<String>> {
+    load_file(&get_revoked_keys_path()?)
+}
+
+fn load_file(path: &Path) -> Result<Vec<String>> {
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+
+    Ok(fs::read_to_string(path)?
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .filter_map(|line| line.split_whitespace().next())
+        .map(|fingerprint| fingerprint.trim_start_matches("MD5:").to_string())
+        .collect())
+}
+
+/// Refuse the keys in the revocation file
+/// # Errors
+/// Will return an error if a key is revoked
+pub fn check(keys: &[PublicKey]) -> Result<()> {
+    check_keys(&load()?, keys)
+}
+
+fn check_keys(revoked: &[String], keys: &[PublicKey]) -> Result<()> {
+    for key in keys {
+        if let Some(fingerprint) = key_fingerprints(key)?
+            .into_iter()
+            .find(|fingerprint| revoked.contains(fingerprint))
+        {
+            return Err(anyhow!(
+                "The key {fingerprint} {} is revoked, remove it from the recipients",
+                key.comment()
+            ));
+        }
+    }
+
+    Ok(())
+}
+
+/// Get the path to the revocation file, `revoked_keys` in the config or
+/// ~/.ssh/vault/revoked_keys
+/// # Errors
+/// Return an error if we can't get the path to the ssh-vault directory
+fn get_revoked_keys_path() -> Result<PathBuf> {
+    match config::get()?.get_string("revoked_keys") {
+        Ok(path) => Ok(PathBuf::from(path)),
+        Err(_) => Ok(cache::get_ssh_vault_path()?.join("revoked_keys")),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use ssh_key::HashAlg;
+
+    #[test]
+    fn test_check_keys() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("revoked_keys");
+        let key = PublicKey::read_openssh_file(Path::new("test_data/ed25519.pub")).unwrap();
+
+        assert!(load_file(&path).unwrap().is_empty());
+
+        fs::write(
+            &path,
+            format!(
+                "# left the team\n\n{} alice@laptop\nMD5:00:11\n",
+                key.fingerprint(HashAlg::Sha256)
+            ),
+        )
+        .unwrap();
+
+        let revoked = load_file(&path).unwrap();
+        assert_eq!(revoked.len(), 2);
+        assert_eq!(revoked[1], "00:11");
+
+        assert!(check_keys(&revoked, &[key.clone()]).is_err());
+        assert!(check_keys(&revoked[1..], &[key]).is_ok());
+    }
+}
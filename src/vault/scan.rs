@@ -0,0 +1,177 @@
+use crate::vault::{info, policy, policy::Policy};
+use anyhow::Result;
+use globset::GlobSet;
+use std::{
+    collections::HashMap,
+    fmt,
+    fs::File,
+    io::Read,
+    path::{Component, Path, PathBuf},
+};
+
+// only the start of large files is checked
+const MAX_SCAN_SIZE: u64 = 1024 * 1024;
+
+/// Why a plaintext file should be a vault
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Leak {
+    // the path matches a pattern of the policy or the command line
+    Pattern,
+    // the content has a private key
+    PrivateKey,
+}
+
+impl fmt::Display for Leak {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Pattern => write!(f, "matches a pattern of files that must be vaults"),
+            Self::PrivateKey => write!(f, "contains a private key"),
+        }
+    }
+}
+
+/// Finds plaintext files that should be vaults
+pub struct Scanner {
+    patterns: GlobSet,
+    // patterns of the policy for each directory, the paths are matched
+    // relative to the directory of the policy
+    policies: HashMap<PathBuf, Option<(PathBuf, GlobSet)>>,
+}
+
+impl Scanner {
+    /// Create a scanner with extra patterns to the ones of the policies
+    /// # Errors
+    /// Will return an error if a pattern is not a valid glob
+    pub fn new(patterns: &[String]) -> Result<Self> {
+        Ok(Self {
+            patterns: policy::globs(patterns)?,
+            policies: HashMap::new(),
+        })
+    }
+
+    /// Check the content of a file, vaults and empty files are never leaks
+    /// # Errors
+    /// Will return an error if the policy of the file is not valid
+    pub fn check(&mut self, path: &Path, content: &[u8]) -> Result<Option<Leak>> {
+        if content.is_empty() || content.starts_with(info::PREFIX) {
+            return Ok(None);
+        }
+
+        let path = normalize(path);
+
+        if self.patterns.is_match(&path) || self.policy_match(&path)? {
+            return Ok(Some(Leak::Pattern));
+        }
+
+        if has_private_key(content) {
+            return Ok(Some(Leak::PrivateKey));
+        }
+
+        Ok(None)
+    }
+
+    /// Check a file in the working tree
+    /// # Errors
+    /// Will return an error if the file can't be read
+    pub fn check_file(&mut self, path: &Path) -> Result<Option<Leak>> {
+        let mut content = Vec::new();
+        File::open(path)?
+            .take(MAX_SCAN_SIZE)
+            .read_to_end(&mut content)?;
+
+        self.check(path, &content)
+    }
+
+    fn policy_match(&mut self, path: &Path) -> Result<bool> {
+        let dir = path.parent().unwrap_or_else(|| Path::new("")).to_path_buf();
+
+        if !self.policies.contains_key(&dir) {
+            let globs = match Policy::find(&dir)? {
+                Some(policy) => Some((policy.dir().to_path_buf(), policy.globs()?)),
+                None => None,
+            };
+            self.policies.insert(dir.clone(), globs);
+        }
+
+        Ok(match &self.policies[&dir] {
+            Some((policy_dir, globs)) => path
+                .strip_prefix(policy_dir)
+                .map_or(false, |path| globs.is_match(path)),
+            None => false,
+        })
+    }
+}
+
+// remove the ./ so the patterns match the paths given as ./secrets/...
+fn normalize(path: &Path) -> PathBuf {
+    path.components()
+        .filter(|component| *component != Component::CurDir)
+        .collect()
+}
+
+fn has_private_key(content: &[u8]) -> bool {
+    let begin = b"-----BEGIN ";
+    let end = b"PRIVATE KEY-----";
+
+    content
+        .windows(begin.len())
+        .position(|window| window == begin)
+        .map_or(false, |start| {
+            content[start..]
+                .windows(end.len())
+                .any(|window| window == end)
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::policy::POLICY_FILE;
+    use std::fs;
+
+    #[test]
+    fn test_check() {
+        let mut scanner = Scanner::new(&["*.env".to_string()]).unwrap();
+        let path = Path::new("./app/db.env");
+
+        assert_eq!(
+            scanner.check(path, b"DB_PASSWORD=secret").unwrap(),
+            Some(Leak::Pattern)
+        );
+        assert_eq!(scanner.check(path, b"SSH-VAULT;V2\n").unwrap(), None);
+        assert_eq!(scanner.check(path, b"").unwrap(), None);
+
+        let key = fs::read("test_data/ed25519").unwrap();
+        assert_eq!(
+            scanner.check(Path::new("id"), &key).unwrap(),
+            Some(Leak::PrivateKey)
+        );
+        assert_eq!(
+            scanner
+                .check(Path::new("README.md"), b"# ssh-vault")
+                .unwrap(),
+            None
+        );
+    }
+
+    #[test]
+    fn test_check_policy() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::create_dir(dir.path().join("secrets")).unwrap();
+        fs::write(
+            dir.path().join(POLICY_FILE),
+            "recipients: []\npatterns:\n  - secrets/**\n",
+        )
+        .unwrap();
+
+        let secret = dir.path().join("secrets/token");
+        fs::write(&secret, "token").unwrap();
+
+        let public = dir.path().join("README.md");
+        fs::write(&public, "token").unwrap();
+
+        let mut scanner = Scanner::new(&[]).unwrap();
+        assert_eq!(scanner.check_file(&secret).unwrap(), Some(Leak::Pattern));
+        assert_eq!(scanner.check_file(&public).unwrap(), None);
+    }
+}
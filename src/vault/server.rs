@@ -0,0 +1,505 @@
+use crate::logging;
+use crate::vault::{
+    acl::{Access, Acl, Client},
+    history,
+    http::{self, Request, Response},
+    info,
+    metrics::Metrics,
+    stream, SshVault,
+};
+use anyhow::Result;
+use serde::Serialize;
+use slog::warn;
+use std::{
+    fs,
+    io::Write,
+    net::TcpListener,
+    path::{Component, Path, PathBuf},
+    time::Instant,
+};
+
+/// HTTP API to encrypt payloads for the configured recipients and to list the
+/// vaults of a directory, it never decrypts and never sees private keys
+pub struct Server {
+    // clients and the vault paths they may use, a bearer token each
+    pub access: Access,
+    pub recipients: Vec<SshVault>,
+    // directory with the vaults of /v1/vaults
+    pub vaults: Option<PathBuf>,
+    // served by /metrics
+    pub metrics: Metrics,
+}
+
+#[derive(Serialize)]
+struct VaultEntry {
+    path: String,
+    #[serde(flatten)]
+    info: info::VaultInfo,
+}
+
+impl Server {
+    /// Accept connections until the listener fails, a thread per request
+    /// # Errors
+    /// Will return an error if the listener fails
+    pub fn serve(&self, listener: &TcpListener) -> Result<()> {
+        http::serve_authorized(
+            listener,
+            |request| {
+                // refused before the body is read
+                let authorized = client(&self.access.acl(), request).is_some();
+
+                if !authorized {
+                    self.metrics.request(endpoint(&request.path));
+                    self.metrics.failure("unauthorized");
+                }
+
+                authorized
+            },
+            |request| {
+                let response = self.route(request);
+
+                self.metrics.request(endpoint(&request.path));
+
+                if let Some(cause) = cause(response.status) {
+                    self.metrics.failure(cause);
+                }
+
+                response
+            },
+        )
+    }
+
+    fn route(&self, request: &Request) -> Response {
+        let acl = self.access.acl();
+
+        let Some(client) = client(&acl, request) else {
+            return Response::error(401, "Unauthorized");
+        };
+
+        if let Some(path) = request.path.strip_prefix("/v1/vaults/") {
+            return match request.method.as_str() {
+                "GET" => self.read(client, path),
+                "PUT" => self.store(client, path, &request.body),
+                _ => Response::error(405, "Method not allowed"),
+            };
+        }
+
+        match (request.method.as_str(), request.path.as_str()) {
+            ("GET", "/v1/health") => Response::json(200, &serde_json::json!({ "status": "ok" })),
+            ("POST", "/v1/encrypt") => self.encrypt(client, &request.body),
+            ("GET", "/v1/vaults") => self.list(client),
+            ("GET", "/metrics") => self.metrics.response(),
+            (_, "/v1/health" | "/v1/encrypt" | "/v1/vaults" | "/metrics") => {
+                Response::error(405, "Method not allowed")
+            }
+            _ => Response::error(404, "Not found"),
+        }
+    }
+
+    fn seal(&self, body: &[u8]) -> Result<Vec<u8>> {
+        let mut vault = Vec::new();
+
+        let start = Instant::now();
+        let encrypted = stream::encrypt(&self.recipients, body, &mut vault);
+        self.metrics.observe("encrypt", start.elapsed());
+
+        encrypted.map(|()| vault)
+    }
+
+    fn encrypt(&self, client: &Client, body: &[u8]) -> Response {
+        if !client.can_encrypt_any() {
+            warn!(logging::logger(), "access denied";
+                "client" => &client.name, "path" => "/v1/encrypt");
+            return Response::error(403, "Forbidden");
+        }
+
+        match self.seal(body) {
+            Ok(vault) => Response::new(200, "text/plain", vault),
+            Err(e) => Response::error(500, &e.to_string()),
+        }
+    }
+
+    fn list(&self, client: &Client) -> Response {
+        let Some(dir) = &self.vaults else {
+            return Response::error(404, "No vaults directory configured");
+        };
+
+        let entries = info::scan(dir).and_then(|paths| {
+            paths
+                .iter()
+                .map(|path| (path, relative(dir, path)))
+                .filter(|(_, relative)| client.can_read(relative))
+                .map(|(path, relative)| {
+                    Ok(VaultEntry {
+                        path: relative,
+                        info: info::read_file(path)?,
+                    })
+                })
+                .collect::<Result<Vec<_>>>()
+        });
+
+        match entries {
+            Ok(entries) => Response::json(200, &entries),
+            Err(e) => Response::error(500, &e.to_string()),
+        }
+    }
+
+    // The keys of a vault
+    fn read(&self, client: &Client, path: &str) -> Response {
+        let file = match self.vault_path(client, path, Client::can_read) {
+            Ok(file) => file,
+            Err(response) => return response,
+        };
+
+        if !file.is_file() {
+            return Response::error(404, "Not found");
+        }
+
+        match info::read_file(&file) {
+            Ok(info) => Response::json(
+                200,
+                &VaultEntry {
+                    path: path.to_string(),
+                    info,
+                },
+            ),
+            Err(e) => Response::error(500, &e.to_string()),
+        }
+    }
+
+    // Encrypt the body into the vault at the path, replacing it
+    fn store(&self, client: &Client, path: &str, body: &[u8]) -> Response {
+        let file = match self.vault_path(client, path, Client::can_encrypt) {
+            Ok(file) => file,
+            Err(response) => return response,
+        };
+
+        let stored = self.seal(body).and_then(|vault| {
+            let dir = file.parent().unwrap_or_else(|| Path::new("."));
+            fs::create_dir_all(dir)?;
+
+            let mut tmp = tempfile::NamedTempFile::new_in(dir)?;
+            tmp.write_all(&vault)?;
+
+            history::persist(tmp, &file)
+        });
+
+        match stored {
+            Ok(()) => Response::json(200, &serde_json::json!({ "path": path })),
+            Err(e) => Response::error(500, &e.to_string()),
+        }
+    }
+
+    // The file of a vault path the client is allowed to use
+    fn vault_path(
+        &self,
+        client: &Client,
+        path: &str,
+        allowed: fn(&Client, &str) -> bool,
+    ) -> Result<PathBuf, Response> {
+        let Some(dir) = &self.vaults else {
+            return Err(Response::error(404, "No vaults directory configured"));
+        };
+
+        // only plain relative paths, nothing outside of the directory
+        if path.is_empty()
+            || !Path::new(path)
+                .components()
+                .all(|component| matches!(component, Component::Normal(_)))
+        {
+            return Err(Response::error(400, "Invalid vault path"));
+        }
+
+        let file = dir.join(path);
+
+        if !allowed(client, path) || !contained(dir, &file) {
+            warn!(logging::logger(), "access denied";
+                "client" => &client.name, "path" => path);
+            return Err(Response::error(403, "Forbidden"));
+        }
+
+        Ok(file)
+    }
+}
+
+// The file is in the directory once the symlinks are resolved, a new vault is
+// checked by the last of its directories that exists
+fn contained(dir: &Path, file: &Path) -> bool {
+    // nothing can lead out of a directory that doesn't exist yet
+    let Ok(dir) = dir.canonicalize() else {
+        return !dir.exists();
+    };
+
+    file.ancestors()
+        .find_map(|path| path.canonicalize().ok())
+        .is_some_and(|path| path.starts_with(&dir))
+}
+
+// The client of the bearer token of the request
+fn client<'a>(acl: &'a Acl, request: &Request) -> Option<&'a Client> {
+    request
+        .authorization
+        .as_deref()
+        .and_then(|value| value.strip_prefix("Bearer "))
+        .and_then(|token| acl.client(token))
+}
+
+// The path of the vault in the directory, with forward slashes
+fn relative(dir: &Path, path: &Path) -> String {
+    path.strip_prefix(dir)
+        .unwrap_or(path)
+        .components()
+        .map(|component| component.as_os_str().to_string_lossy())
+        .collect::<Vec<_>>()
+        .join("/")
+}
+
+// The label of the path in the metrics, unknown paths are counted together
+fn endpoint(path: &str) -> &'static str {
+    match path {
+        "/v1/health" => "/v1/health",
+        "/v1/encrypt" => "/v1/encrypt",
+        "/v1/vaults" => "/v1/vaults",
+        "/metrics" => "/metrics",
+        _ if path.starts_with("/v1/vaults/") => "/v1/vaults/<path>",
+        _ => "other",
+    }
+}
+
+const fn cause(status: u16) -> Option<&'static str> {
+    match status {
+        200..=399 => None,
+        401 => Some("unauthorized"),
+        403 => Some("forbidden"),
+        404 => Some("not_found"),
+        405 => Some("method_not_allowed"),
+        500..=599 => Some("internal"),
+        _ => Some("bad_request"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{acl::Acl, find, SshKeyType};
+    use secrecy::Secret;
+
+    fn server(vaults: Option<PathBuf>) -> Server {
+        let key = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+
+        Server {
+            access: Access::new(Acl::token(Secret::new(String::from("t0ken"))).unwrap()),
+            recipients: vec![SshVault::new(&SshKeyType::Ed25519, Some(key), None).unwrap()],
+            vaults,
+            metrics: Metrics::default(),
+        }
+    }
+
+    fn request(method: &str, path: &str, token: Option<&str>, body: &[u8]) -> Request {
+        Request {
+            method: method.to_string(),
+            path: path.to_string(),
+            authorization: token.map(|token| format!("Bearer {token}")),
+            body: body.to_vec(),
+            ..Request::default()
+        }
+    }
+
+    #[test]
+    fn test_route() {
+        let server = server(None);
+
+        assert_eq!(
+            server
+                .route(&request("GET", "/v1/health", None, b""))
+                .status,
+            401
+        );
+        assert_eq!(
+            server
+                .route(&request("GET", "/v1/health", Some("wrong"), b""))
+                .status,
+            401
+        );
+        assert_eq!(
+            server
+                .route(&request("GET", "/v1/health", Some("t0ken"), b""))
+                .status,
+            200
+        );
+        assert_eq!(
+            server
+                .route(&request("GET", "/v1/encrypt", Some("t0ken"), b""))
+                .status,
+            405
+        );
+        assert_eq!(
+            server
+                .route(&request("GET", "/v1/keys", Some("t0ken"), b""))
+                .status,
+            404
+        );
+        assert_eq!(
+            server
+                .route(&request("GET", "/v1/vaults", Some("t0ken"), b""))
+                .status,
+            404
+        );
+
+        let response = server.route(&request("POST", "/v1/encrypt", Some("t0ken"), b"secret"));
+        assert_eq!(response.status, 200);
+        assert!(response.body.starts_with(stream::MAGIC.as_bytes()));
+    }
+
+    #[test]
+    fn test_metrics() {
+        let server = server(None);
+        server.route(&request("POST", "/v1/encrypt", Some("t0ken"), b"secret"));
+
+        assert_eq!(
+            server.route(&request("GET", "/metrics", None, b"")).status,
+            401
+        );
+
+        let response = server.route(&request("GET", "/metrics", Some("t0ken"), b""));
+        assert_eq!(response.status, 200);
+
+        let text = String::from_utf8(response.body).unwrap();
+        assert!(text.contains("ssh_vault_duration_seconds_count{operation=\"encrypt\"} 1"));
+
+        assert_eq!(endpoint("/v1/encrypt"), "/v1/encrypt");
+        assert_eq!(endpoint("/v1/vaults/apps/db.vault"), "/v1/vaults/<path>");
+        assert_eq!(endpoint("/v1/keys/alice"), "other");
+        assert_eq!(cause(200), None);
+        assert_eq!(cause(401), Some("unauthorized"));
+        assert_eq!(cause(500), Some("internal"));
+    }
+
+    #[test]
+    fn test_list() {
+        let dir = tempfile::tempdir().unwrap();
+        let server = server(Some(dir.path().to_path_buf()));
+
+        let vault = server.route(&request("POST", "/v1/encrypt", Some("t0ken"), b"secret"));
+        fs::write(dir.path().join("secret.vault"), vault.body).unwrap();
+        fs::write(dir.path().join("README.md"), "not a vault").unwrap();
+
+        let response = server.route(&request("GET", "/v1/vaults", Some("t0ken"), b""));
+        assert_eq!(response.status, 200);
+
+        let entries: serde_json::Value = serde_json::from_slice(&response.body).unwrap();
+        assert_eq!(entries.as_array().unwrap().len(), 1);
+        assert_eq!(entries[0]["path"], "secret.vault");
+        assert_eq!(entries[0]["recipients"][0]["key_type"], "X25519");
+    }
+
+    #[test]
+    fn test_acl() {
+        let dir = tempfile::tempdir().unwrap();
+        let vaults = dir.path().join("vaults");
+        fs::write(dir.path().join("ci.token"), "ci-t0ken\n").unwrap();
+        fs::write(dir.path().join("ops.token"), "ops-t0ken\n").unwrap();
+        fs::write(
+            dir.path().join("acl.yml"),
+            "clients:\n  - name: ci\n    token_file: ci.token\n    encrypt:\n      - apps/ci/*\n    read:\n      - apps/**\n  - name: ops\n    token_file: ops.token\n    read:\n      - apps/ci/*\n",
+        )
+        .unwrap();
+
+        let mut server = server(Some(vaults.clone()));
+        server.access = Access::file(&dir.path().join("acl.yml")).unwrap();
+
+        let put = |token, path| {
+            server
+                .route(&request("PUT", path, Some(token), b"secret"))
+                .status
+        };
+
+        assert_eq!(put("t0ken", "/v1/vaults/apps/ci/db.vault"), 401);
+        assert_eq!(put("ci-t0ken", "/v1/vaults/apps/ci/db.vault"), 200);
+        assert_eq!(put("ci-t0ken", "/v1/vaults/apps/ci/sub/db.vault"), 403);
+        assert_eq!(put("ci-t0ken", "/v1/vaults/apps/web/db.vault"), 403);
+        assert_eq!(put("ci-t0ken", "/v1/vaults/apps/ci/../../x.vault"), 400);
+        assert_eq!(put("ops-t0ken", "/v1/vaults/apps/ci/db.vault"), 403);
+        assert!(vaults.join("apps/ci/db.vault").is_file());
+
+        let get = |token, path| server.route(&request("GET", path, Some(token), b""));
+
+        let response = get("ops-t0ken", "/v1/vaults/apps/ci/db.vault");
+        assert_eq!(response.status, 200);
+        let entry: serde_json::Value = serde_json::from_slice(&response.body).unwrap();
+        assert_eq!(entry["path"], "apps/ci/db.vault");
+        assert_eq!(
+            get("ops-t0ken", "/v1/vaults/apps/ci/other.vault").status,
+            404
+        );
+
+        let store = |path| {
+            let vault = server.seal(b"secret").unwrap();
+            fs::create_dir_all(vaults.join(path).parent().unwrap()).unwrap();
+            fs::write(vaults.join(path), vault).unwrap();
+        };
+        store("apps/web/web.vault");
+        store("infra/root.vault");
+
+        let listed = |token| {
+            let response = get(token, "/v1/vaults");
+            let entries: serde_json::Value = serde_json::from_slice(&response.body).unwrap();
+            let mut paths: Vec<String> = entries
+                .as_array()
+                .unwrap()
+                .iter()
+                .map(|entry| entry["path"].as_str().unwrap().to_string())
+                .collect();
+            paths.sort();
+            paths
+        };
+
+        assert_eq!(
+            listed("ci-t0ken"),
+            ["apps/ci/db.vault", "apps/web/web.vault"]
+        );
+        assert_eq!(listed("ops-t0ken"), ["apps/ci/db.vault"]);
+
+        // only clients that may encrypt somewhere use /v1/encrypt
+        let encrypt = |token| {
+            server
+                .route(&request("POST", "/v1/encrypt", Some(token), b"secret"))
+                .status
+        };
+        assert_eq!(encrypt("ci-t0ken"), 200);
+        assert_eq!(encrypt("ops-t0ken"), 403);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_symlink() {
+        let dir = tempfile::tempdir().unwrap();
+        let vaults = dir.path().join("vaults");
+        let outside = dir.path().join("outside");
+        fs::create_dir_all(&vaults).unwrap();
+        fs::create_dir_all(&outside).unwrap();
+        std::os::unix::fs::symlink(&outside, vaults.join("link")).unwrap();
+
+        let server = server(Some(vaults.clone()));
+        let vault = server.seal(b"secret").unwrap();
+        fs::write(outside.join("db.vault"), &vault).unwrap();
+        std::os::unix::fs::symlink(outside.join("db.vault"), vaults.join("db.vault")).unwrap();
+
+        let status = |method, path| {
+            server
+                .route(&request(method, path, Some("t0ken"), b"secret"))
+                .status
+        };
+
+        assert_eq!(status("PUT", "/v1/vaults/link/new.vault"), 403);
+        assert_eq!(status("PUT", "/v1/vaults/link/sub/new.vault"), 403);
+        assert_eq!(status("GET", "/v1/vaults/link/db.vault"), 403);
+        assert_eq!(status("GET", "/v1/vaults/db.vault"), 403);
+        assert!(!outside.join("new.vault").exists());
+        assert!(!outside.join("sub").exists());
+
+        // a new directory in the vaults is fine
+        assert_eq!(status("PUT", "/v1/vaults/apps/new.vault"), 200);
+        assert_eq!(status("GET", "/v1/vaults/apps/new.vault"), 200);
+    }
+}
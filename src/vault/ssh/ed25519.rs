@@ -1,7 +1,8 @@
+use crate::exit::Failure;
 use crate::vault::{
-    crypto, crypto::chacha20poly1305::ChaCha20Poly1305Crypto, crypto::Crypto, Vault,
+    crypto, crypto::chacha20poly1305::ChaCha20Poly1305Crypto, crypto::Crypto, stream::Stanza, Vault,
 };
-use anyhow::{Context, Result};
+use anyhow::{anyhow, Context, Result};
 use base64ct::{Base64, Encoding};
 use secrecy::{ExposeSecret, Secret};
 use sha2::{Digest, Sha512};
@@ -13,6 +14,9 @@ use ssh_key::{
 use x25519_dalek::{EphemeralSecret, PublicKey as X25519PublicKey, StaticSecret};
 use zeroize::Zeroize;
 
+/// Tag of the stanzas wrapping the vault key for an Ed25519 key
+pub const STANZA: &str = "X25519";
+
 pub struct Ed25519Vault {
     montgomery_key: X25519PublicKey,
     private_key: Option<Ed25519PrivateKey>,
@@ -71,25 +75,8 @@ impl Vault for Ed25519Vault {
         // zeroize data
         data.zeroize();
 
-        // generate an ephemeral key pair
-        let e_secret = EphemeralSecret::random();
-        let e_public: X25519PublicKey = (&e_secret).into();
-
-        let shared_secret: StaticSecret =
-            (*e_secret.diffie_hellman(&self.montgomery_key).as_bytes()).into();
-
-        // the salt is the concatenation of the
-        // ephemeral public key and the receiver's public key
-        let mut salt = [0; 64];
-        salt[..32].copy_from_slice(e_public.as_bytes());
-        salt[32..].copy_from_slice(self.montgomery_key.as_bytes());
-
-        let enc_key = crypto::hkdf(&salt, fingerprint.as_bytes(), shared_secret.as_bytes())?;
-
-        // encrypt the password with the derived key
-        let crypto = ChaCha20Poly1305Crypto::new(Secret::new(enc_key));
-        let encrypted_password =
-            crypto.encrypt(password.expose_secret(), fingerprint.as_bytes())?;
+        // encrypt the password with a key derived from an ephemeral key pair
+        let (e_public, encrypted_password) = self.wrap_key(&password)?;
 
         // create vault payload
         Ok(format!(
@@ -110,54 +97,117 @@ impl Vault for Ed25519Vault {
     fn view(&self, password: &[u8], data: &[u8], fingerprint: &str) -> Result<String> {
         let get_fingerprint = self.public_key.fingerprint(HashAlg::Sha256);
 
-        if get_fingerprint.to_string() != fingerprint {
-            return Err(anyhow::anyhow!("Fingerprint mismatch, use correct key"));
+        if !crypto::ct_eq(
+            get_fingerprint.to_string().as_bytes(),
+            fingerprint.as_bytes(),
+        ) {
+            return Err(Failure::WrongKey.error("Fingerprint mismatch, use correct key"));
         }
 
-        match &self.private_key {
-            Some(private_key) => {
-                // extract the ephemeral public key
-                let mut epk: [u8; 32] = [0; 32];
-                epk.copy_from_slice(&password[0..32]);
+        if password.len() < 32 {
+            return Err(anyhow!("Invalid password"));
+        }
 
-                // extract the encrypted password
-                let encrypted_password = &password[32..];
+        // the password is the ephemeral public key followed by the encrypted password
+        let p = self.unwrap_key(&password[0..32], &password[32..])?;
 
-                // decode the ephemeral public key
-                let epk = X25519PublicKey::from(epk);
+        // decrypt the data with the derived key
+        let crypto = ChaCha20Poly1305Crypto::new(p);
 
-                // generate the static secret and public key
-                let sk: StaticSecret = {
-                    let mut sk = [0u8; 32];
-                    sk.copy_from_slice(&Sha512::digest(private_key.as_ref())[0..32]);
-                    sk.into()
-                };
-                let pk = X25519PublicKey::from(&sk);
+        let out = crypto.decrypt(data, get_fingerprint.as_bytes())?;
+        Ok(String::from_utf8(out)?)
+    }
 
-                // generate the shared secret
-                let shared_secret: StaticSecret = (*sk.diffie_hellman(&epk).as_bytes()).into();
+    fn fingerprint(&self) -> String {
+        self.public_key.fingerprint(HashAlg::Sha256).to_string()
+    }
 
-                let mut salt = [0; 64];
-                salt[..32].copy_from_slice(epk.as_bytes());
-                salt[32..].copy_from_slice(pk.as_bytes());
+    fn wrap(&self, key: &Secret<[u8; 32]>) -> Result<Stanza> {
+        let (e_public, encrypted_key) = self.wrap_key(key)?;
 
-                let enc_key =
-                    crypto::hkdf(&salt, get_fingerprint.as_bytes(), shared_secret.as_bytes())?;
+        Ok(Stanza {
+            tag: STANZA.to_string(),
+            fingerprint: self.fingerprint(),
+            args: vec![e_public.as_bytes().to_vec(), encrypted_key],
+        })
+    }
 
-                // use the enc_key to decrypt the password
-                let crypto = ChaCha20Poly1305Crypto::new(Secret::new(enc_key));
+    fn unwrap(&self, stanza: &Stanza) -> Result<Secret<[u8; 32]>> {
+        match stanza.args.as_slice() {
+            [epk, encrypted_key] if stanza.tag == STANZA && epk.len() == 32 => {
+                self.unwrap_key(epk, encrypted_key)
+            }
+            _ => Err(anyhow!("Invalid {STANZA} stanza")),
+        }
+    }
+}
 
-                let mut p: [u8; 32] = [0; 32];
-                let password = crypto.decrypt(encrypted_password, get_fingerprint.as_bytes())?;
-                p.copy_from_slice(&password[0..32]);
+impl Ed25519Vault {
+    // Encrypt the key with a key derived from an ephemeral key pair and the
+    // receiver's public key, returns the ephemeral public key and encrypted key
+    fn wrap_key(&self, key: &Secret<[u8; 32]>) -> Result<(X25519PublicKey, Vec<u8>)> {
+        let fingerprint = self.public_key.fingerprint(HashAlg::Sha256);
 
-                // decrypt the data with the derived key
-                let crypto = ChaCha20Poly1305Crypto::new(Secret::new(p));
+        // generate an ephemeral key pair
+        let e_secret = EphemeralSecret::random();
+        let e_public: X25519PublicKey = (&e_secret).into();
 
-                let out = crypto.decrypt(data, get_fingerprint.as_bytes())?;
-                Ok(String::from_utf8(out)?)
-            }
-            None => Err(anyhow::anyhow!("Private key is required to view vault")),
-        }
+        let shared_secret: StaticSecret =
+            (*e_secret.diffie_hellman(&self.montgomery_key).as_bytes()).into();
+
+        // the salt is the concatenation of the
+        // ephemeral public key and the receiver's public key
+        let mut salt = [0; 64];
+        salt[..32].copy_from_slice(e_public.as_bytes());
+        salt[32..].copy_from_slice(self.montgomery_key.as_bytes());
+
+        let enc_key = crypto::hkdf(&salt, fingerprint.as_bytes(), shared_secret.as_bytes())?;
+
+        // encrypt the key with the derived key
+        let crypto = ChaCha20Poly1305Crypto::new(Secret::new(enc_key));
+        let encrypted_key = crypto.encrypt(key.expose_secret(), fingerprint.as_bytes())?;
+
+        Ok((e_public, encrypted_key))
+    }
+
+    // Decrypt a key encrypted by wrap_key
+    fn unwrap_key(&self, epk: &[u8], encrypted_key: &[u8]) -> Result<Secret<[u8; 32]>> {
+        let Some(private_key) = &self.private_key else {
+            return Err(anyhow!("Private key is required to view vault"));
+        };
+
+        let fingerprint = self.public_key.fingerprint(HashAlg::Sha256);
+
+        // decode the ephemeral public key
+        let epk: [u8; 32] = epk
+            .try_into()
+            .map_err(|_| anyhow!("Invalid ephemeral public key"))?;
+        let epk = X25519PublicKey::from(epk);
+
+        // generate the static secret and public key
+        let sk: StaticSecret = {
+            let mut sk = [0u8; 32];
+            sk.copy_from_slice(&Sha512::digest(private_key.as_ref())[0..32]);
+            sk.into()
+        };
+        let pk = X25519PublicKey::from(&sk);
+
+        // generate the shared secret
+        let shared_secret: StaticSecret = (*sk.diffie_hellman(&epk).as_bytes()).into();
+
+        let mut salt = [0; 64];
+        salt[..32].copy_from_slice(epk.as_bytes());
+        salt[32..].copy_from_slice(pk.as_bytes());
+
+        let enc_key = crypto::hkdf(&salt, fingerprint.as_bytes(), shared_secret.as_bytes())?;
+
+        // use the enc_key to decrypt the key
+        let crypto = ChaCha20Poly1305Crypto::new(Secret::new(enc_key));
+
+        let mut key = crypto.decrypt(encrypted_key, fingerprint.as_bytes())?;
+        let rs = <[u8; 32]>::try_from(key.as_slice()).map_err(|_| anyhow!("Invalid password"));
+        key.zeroize();
+
+        Ok(Secret::new(rs?))
     }
 }
@@ -1,21 +1,179 @@
 pub mod ed25519;
+pub mod prompt;
 pub mod rsa;
 
-use anyhow::{Context, Result};
+use crate::{config, exit::Failure, vault::agent};
+use anyhow::{anyhow, Result};
 use secrecy::{ExposeSecret, Secret};
-use ssh_key::PrivateKey;
+use ssh_key::{HashAlg, PrivateKey};
+
+const PASSPHRASE_ATTEMPTS: u32 = 3;
 
 // Decrypts a private key with a password
 pub fn decrypt_private_key(
     key: &PrivateKey,
     password: Option<Secret<String>>,
 ) -> Result<PrivateKey> {
-    let password = match password {
-        Some(password) => password,
-        None => Secret::new(rpassword::prompt_password("Enter ssh key passphrase: ")?),
-    };
-
     // Decrypt the private key
-    key.decrypt(password.expose_secret())
-        .context("Failed to decrypt private key, wrong password?")
+    if let Some(password) = password {
+        return key
+            .decrypt(password.expose_secret())
+            .map_err(|e| decrypt_error(&e));
+    }
+
+    // use the passphrase cached by the agent
+    let fingerprint = key.fingerprint(HashAlg::Sha256).to_string();
+    if let Some(password) = agent::get(&fingerprint) {
+        if let Ok(key) = key.decrypt(password.expose_secret()) {
+            return Ok(key);
+        }
+    }
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    // hosts provisioned with a secret file decrypt unattended, never prompt
+    if let Some(path) = passphrase_file(&config) {
+        let password = prompt::from_file(&path)?;
+
+        return key
+            .decrypt(password.expose_secret())
+            .map_err(|e| decrypt_error(&e));
+    }
+
+    let attempts = config
+        .get_int("passphrase_attempts")
+        .ok()
+        .and_then(|n| u32::try_from(n).ok())
+        .filter(|n| *n > 0)
+        .unwrap_or(PASSPHRASE_ATTEMPTS);
+
+    let (key, password) = with_retries(
+        attempts,
+        || prompt::passphrase("Enter ssh key passphrase: "),
+        |password| {
+            key.decrypt(password)
+                .map(|key| (key, Secret::new(password.to_string())))
+        },
+    )?;
+
+    // cache the passphrase if the agent is running
+    if let Err(e) = agent::put(&fingerprint, &password) {
+        eprintln!("Could not store the passphrase in the agent: {e}");
+    }
+
+    Ok(key)
+}
+
+// The passphrase_file of the config or SSH_VAULT_PASSPHRASE_FILE, used by every
+// command when the passphrase is not given with the options
+fn passphrase_file(config: &::config::Config) -> Option<String> {
+    config
+        .get_string("passphrase_file")
+        .ok()
+        .filter(|path| !path.is_empty())
+}
+
+// Ask again for the passphrase while it is wrong, any other error is returned right away
+fn with_retries<T>(
+    attempts: u32,
+    mut ask: impl FnMut() -> Result<Secret<String>>,
+    decrypt: impl Fn(&str) -> ssh_key::Result<T>,
+) -> Result<T> {
+    for attempt in 1..=attempts {
+        let password = ask()?;
+
+        match decrypt(password.expose_secret()) {
+            Ok(key) => return Ok(key),
+            Err(ssh_key::Error::Crypto) if attempt < attempts => {
+                eprintln!("Wrong passphrase, try again.");
+            }
+            Err(e) => return Err(decrypt_error(&e)),
+        }
+    }
+
+    Err(Failure::WrongKey.error("Failed to decrypt private key"))
+}
+
+fn decrypt_error(e: &ssh_key::Error) -> anyhow::Error {
+    match e {
+        ssh_key::Error::Crypto => {
+            Failure::WrongKey.error("Failed to decrypt private key, wrong passphrase")
+        }
+        e => anyhow!("Failed to decrypt private key: {e}"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_passphrase_file() {
+        temp_env::with_vars(
+            [("SSH_VAULT_PASSPHRASE_FILE", Some("/run/secrets/ssh-vault"))],
+            || {
+                let config = config::get().unwrap();
+                assert_eq!(
+                    passphrase_file(&config).as_deref(),
+                    Some("/run/secrets/ssh-vault")
+                );
+            },
+        );
+
+        temp_env::with_vars([("SSH_VAULT_PASSPHRASE_FILE", Some(""))], || {
+            assert_eq!(passphrase_file(&config::get().unwrap()), None);
+        });
+    }
+
+    #[test]
+    fn test_with_retries() {
+        let mut asked = 0;
+        let key = with_retries(
+            3,
+            || {
+                asked += 1;
+                Ok(Secret::new(format!("attempt {asked}")))
+            },
+            |password| {
+                if password == "attempt 2" {
+                    Ok(password.to_string())
+                } else {
+                    Err(ssh_key::Error::Crypto)
+                }
+            },
+        );
+        assert_eq!(key.unwrap(), "attempt 2");
+        assert_eq!(asked, 2);
+    }
+
+    #[test]
+    fn test_with_retries_exhausted() {
+        let mut asked = 0;
+        let key: Result<()> = with_retries(
+            3,
+            || {
+                asked += 1;
+                Ok(Secret::new(String::new()))
+            },
+            |_| Err(ssh_key::Error::Crypto),
+        );
+        assert!(key.unwrap_err().to_string().contains("wrong passphrase"));
+        assert_eq!(asked, 3);
+    }
+
+    #[test]
+    fn test_with_retries_other_error() {
+        let mut asked = 0;
+        let key: Result<()> = with_retries(
+            3,
+            || {
+                asked += 1;
+                Ok(Secret::new(String::new()))
+            },
+            |_| Err(ssh_key::Error::Decrypted),
+        );
+        assert!(key.is_err());
+        assert_eq!(asked, 1);
+    }
 }
@@ -0,0 +1,415 @@
+use crate::{config, exit::Failure};
+use anyhow::{anyhow, Context, Result};
+use secrecy::Secret;
+use std::{
+    env, fs,
+    io::{BufRead, BufReader, Write},
+    process::{Command, Stdio},
+    sync::atomic::{AtomicBool, Ordering},
+};
+
+const DESCRIPTION: &str = "ssh-vault needs the passphrase of your private ssh key";
+const SSH_ASKPASS: &str = "ssh-askpass";
+const CHOICE_ATTEMPTS: u32 = 3;
+
+// set in the pipe mode, e.g. in cron jobs, nothing is asked
+static DISABLED: AtomicBool = AtomicBool::new(false);
+
+/// Never ask, the passphrase must come from the options, a file or the agent
+/// and the first key is used when several can open the vault
+pub fn disable() {
+    DISABLED.store(true, Ordering::Relaxed);
+}
+
+/// Ask for the passphrase of the private key, using the `pinentry` program
+/// from the config (`SSH_VAULT_PINENTRY`) if any, then `SSH_ASKPASS` following
+/// the `OpenSSH` rules, otherwise the terminal
+/// # Errors
+/// Will return an error if the passphrase can't be read
+pub fn passphrase(prompt: &str) -> Result<Secret<String>> {
+    if DISABLED.load(Ordering::Relaxed) {
+        return Err(Failure::Usage.error(
+            "The private key is encrypted, use --passphrase-fd, --passphrase-file or the agent",
+        ));
+    }
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let config = config::get()?;
+
+    if let Ok(program) = config.get_string("pinentry") {
+        if !program.is_empty() {
+            return pinentry(&program, prompt);
+        }
+    }
+
+    let require = env::var("SSH_ASKPASS_REQUIRE").ok();
+    let askpass = env::var("SSH_ASKPASS").ok().filter(|p| !p.is_empty());
+    let display = env::var_os("DISPLAY").is_some() || env::var_os("WAYLAND_DISPLAY").is_some();
+
+    if use_askpass(require.as_deref(), askpass.is_some(), display, has_tty()) {
+        return ssh_askpass(askpass.as_deref().unwrap_or(SSH_ASKPASS), prompt);
+    }
+
+    Ok(Secret::new(rpassword::prompt_password(prompt)?))
+}
+
+/// Read the passphrase from the first line of a file
+/// # Errors
+/// Will return an error if the file can't be read
+pub fn from_file(path: &str) -> Result<Secret<String>> {
+    let content = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read passphrase file: {path}"))?;
+
+    Ok(Secret::new(first_line(&content)))
+}
+
+/// Read the passphrase from the first line of an open file descriptor
+/// # Errors
+/// Will return an error if the file descriptor can't be read
+pub fn from_fd(fd: i32) -> Result<Secret<String>> {
+    if cfg!(unix) {
+        let mut reader = BufReader::new(
+            fs::File::open(format!("/dev/fd/{fd}"))
+                .with_context(|| format!("Failed to open file descriptor {fd}"))?,
+        );
+
+        let mut line = String::new();
+        reader.read_line(&mut line)?;
+
+        Ok(Secret::new(first_line(&line)))
+    } else {
+        Err(anyhow!("--passphrase-fd is not supported on this platform"))
+    }
+}
+
+fn first_line(s: &str) -> String {
+    s.lines().next().unwrap_or_default().to_string()
+}
+
+/// Get the passphrase using an askpass program, the prompt is passed as the
+/// first argument and the passphrase is read from its stdout
+/// # Errors
+/// Will return an error if the program can't be started or exits with an error
+pub fn ssh_askpass(program: &str, prompt: &str) -> Result<Secret<String>> {
+    let output = Command::new(program)
+        .arg(prompt)
+        .stdin(Stdio::null())
+        .stderr(Stdio::inherit())
+        .output()
+        .with_context(|| format!("Failed to run askpass program: {program}"))?;
+
+    if !output.status.success() {
+        return Err(anyhow!(
+            "askpass program {program} failed: {}",
+            output.status
+        ));
+    }
+
+    let passphrase = String::from_utf8(output.stdout)?;
+
+    Ok(Secret::new(
+        passphrase.trim_end_matches(['\r', '\n']).to_string(),
+    ))
+}
+
+// SSH_ASKPASS_REQUIRE: never, prefer or force, if not set askpass is only
+// used when there is no terminal and a display is available
+fn use_askpass(require: Option<&str>, askpass: bool, display: bool, tty: bool) -> bool {
+    match require {
+        Some("never") => false,
+        Some("force") => true,
+        Some("prefer") => askpass,
+        _ => askpass && display && !tty,
+    }
+}
+
+/// Ask to choose one of the options in the terminal, returns its index
+/// # Errors
+/// Will return an error if there is no terminal or no valid choice is made
+pub fn choose(prompt: &str, options: &[String]) -> Result<usize> {
+    if DISABLED.load(Ordering::Relaxed) || !has_tty() {
+        return Err(anyhow!("No terminal to choose from"));
+    }
+
+    eprintln!("{prompt}");
+    for (i, option) in options.iter().enumerate() {
+        eprintln!("  {}) {option}", i + 1);
+    }
+
+    for _ in 0..CHOICE_ATTEMPTS {
+        eprint!("Choose [1-{}]: ", options.len());
+
+        let mut line = String::new();
+        read_tty_line(&mut line)?;
+
+        if let Some(index) = choice(&line, options.len()) {
+            return Ok(index);
+        }
+    }
+
+    Err(anyhow!("No valid choice"))
+}
+
+/// Ask a yes or no question in the terminal, anything but yes is a no
+/// # Errors
+/// Will return an error if there is no terminal
+pub fn confirm(prompt: &str) -> Result<bool> {
+    if DISABLED.load(Ordering::Relaxed) || !has_tty() {
+        return Err(anyhow!("No terminal to confirm on"));
+    }
+
+    eprint!("{prompt} [y/N]: ");
+
+    let mut line = String::new();
+    read_tty_line(&mut line)?;
+
+    Ok(matches!(line.trim().to_lowercase().as_str(), "y" | "yes"))
+}
+
+fn choice(line: &str, options: usize) -> Option<usize> {
+    line.trim()
+        .parse::<usize>()
+        .ok()
+        .filter(|n| (1..=options).contains(n))
+        .map(|n| n - 1)
+}
+
+fn read_tty_line(line: &mut String) -> Result<()> {
+    #[cfg(unix)]
+    BufReader::new(fs::File::open("/dev/tty")?).read_line(line)?;
+
+    #[cfg(not(unix))]
+    std::io::stdin().read_line(line)?;
+
+    Ok(())
+}
+
+// Check if there is a controlling terminal to prompt on
+fn has_tty() -> bool {
+    #[cfg(unix)]
+    {
+        std::fs::File::open("/dev/tty").is_ok()
+    }
+    #[cfg(not(unix))]
+    {
+        use std::io::IsTerminal;
+        std::io::stdin().is_terminal()
+    }
+}
+
+/// Get the passphrase using a pinentry program (Assuan protocol)
+/// # Errors
+/// Will return an error if the program can't be started or the user cancels
+pub fn pinentry(program: &str, prompt: &str) -> Result<Secret<String>> {
+    let mut child = Command::new(program)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .with_context(|| format!("Failed to run pinentry program: {program}"))?;
+
+    let mut stdin = child
+        .stdin
+        .take()
+        .ok_or_else(|| anyhow!("Failed to open pinentry stdin"))?;
+    let mut stdout = BufReader::new(
+        child
+            .stdout
+            .take()
+            .ok_or_else(|| anyhow!("Failed to open pinentry stdout"))?,
+    );
+
+    let result = (|| -> Result<Secret<String>> {
+        // greeting
+        assuan_read(&mut stdout)?;
+
+        let mut commands = vec![
+            format!("SETDESC {}", assuan_encode(DESCRIPTION)),
+            format!("SETPROMPT {}", assuan_encode(prompt.trim_end())),
+        ];
+
+        if let Ok(tty) = env::var("GPG_TTY") {
+            commands.push(format!("OPTION ttyname={tty}"));
+        }
+
+        for command in commands {
+            writeln!(stdin, "{command}")?;
+            assuan_read(&mut stdout)?;
+        }
+
+        writeln!(stdin, "GETPIN")?;
+        let pin = assuan_read(&mut stdout)?;
+
+        Ok(Secret::new(pin))
+    })();
+
+    let _ = writeln!(stdin, "BYE");
+    drop(stdin);
+    let _ = child.wait();
+
+    result
+}
+
+// Read lines until OK or ERR, returns the data lines
+fn assuan_read(reader: &mut impl BufRead) -> Result<String> {
+    let mut data = String::new();
+
+    loop {
+        let mut line = String::new();
+        if reader.read_line(&mut line)? == 0 {
+            return Err(anyhow!("pinentry closed the connection"));
+        }
+
+        let line = line.trim_end_matches(['\r', '\n']);
+
+        if line == "OK" || line.starts_with("OK ") {
+            return Ok(data);
+        } else if let Some(error) = line.strip_prefix("ERR ") {
+            return Err(anyhow!("pinentry error: {error}"));
+        } else if let Some(d) = line.strip_prefix("D ") {
+            data.push_str(&assuan_decode(d));
+        }
+    }
+}
+
+// Percent-escape the characters not allowed in Assuan lines
+fn assuan_encode(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    for c in s.chars() {
+        match c {
+            '%' => out.push_str("%25"),
+            '\n' => out.push_str("%0A"),
+            '\r' => out.push_str("%0D"),
+            _ => out.push(c),
+        }
+    }
+    out
+}
+
+fn assuan_decode(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+
+    while i < bytes.len() {
+        if bytes[i] == b'%' && i + 2 < bytes.len() {
+            if let Some(b) = std::str::from_utf8(&bytes[i + 1..i + 3])
+                .ok()
+                .and_then(|hex| u8::from_str_radix(hex, 16).ok())
+            {
+                out.push(b);
+                i += 3;
+                continue;
+            }
+        }
+        out.push(bytes[i]);
+        i += 1;
+    }
+
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use secrecy::ExposeSecret;
+
+    #[test]
+    fn test_choice() {
+        assert_eq!(choice("1\n", 2), Some(0));
+        assert_eq!(choice(" 2 ", 2), Some(1));
+        assert_eq!(choice("0", 2), None);
+        assert_eq!(choice("3", 2), None);
+        assert_eq!(choice("a", 2), None);
+    }
+
+    #[test]
+    fn test_assuan_encode_decode() {
+        assert_eq!(assuan_encode("100%\nsure"), "100%25%0Asure");
+        assert_eq!(assuan_decode("100%25%0Asure"), "100%\nsure");
+        assert_eq!(assuan_decode("no escapes"), "no escapes");
+        assert_eq!(assuan_decode("trailing%2"), "trailing%2");
+    }
+
+    #[test]
+    fn test_assuan_read() {
+        let mut reader = "D pass%25word\nOK\n".as_bytes();
+        assert_eq!(assuan_read(&mut reader).unwrap(), "pass%word");
+
+        let mut reader = "ERR 83886179 Operation cancelled\n".as_bytes();
+        assert!(assuan_read(&mut reader).is_err());
+    }
+
+    #[test]
+    fn test_from_file() {
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(file, "secret\nignored").unwrap();
+
+        let passphrase = from_file(file.path().to_str().unwrap()).unwrap();
+        assert_eq!(passphrase.expose_secret(), "secret");
+
+        assert!(from_file("/path/does/not/exist").is_err());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_from_fd() {
+        use std::os::unix::io::AsRawFd;
+
+        let mut file = tempfile::tempfile().unwrap();
+        writeln!(file, "secret").unwrap();
+        std::io::Seek::rewind(&mut file).unwrap();
+
+        let passphrase = from_fd(file.as_raw_fd()).unwrap();
+        assert_eq!(passphrase.expose_secret(), "secret");
+    }
+
+    #[test]
+    fn test_use_askpass() {
+        // default, only without a terminal and with a display
+        assert!(use_askpass(None, true, true, false));
+        assert!(!use_askpass(None, true, true, true));
+        assert!(!use_askpass(None, true, false, false));
+        assert!(!use_askpass(None, false, true, false));
+
+        assert!(!use_askpass(Some("never"), true, true, false));
+        assert!(use_askpass(Some("prefer"), true, false, true));
+        assert!(!use_askpass(Some("prefer"), false, true, false));
+        assert!(use_askpass(Some("force"), false, false, true));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_ssh_askpass() {
+        use std::{fs, os::unix::fs::PermissionsExt};
+
+        let dir = tempfile::tempdir().unwrap();
+        let program = dir.path().join("askpass");
+        fs::write(&program, "#!/bin/sh\necho \"secret for $1\"\n").unwrap();
+        fs::set_permissions(&program, fs::Permissions::from_mode(0o755)).unwrap();
+
+        let pin = ssh_askpass(program.to_str().unwrap(), "key:").unwrap();
+        assert_eq!(pin.expose_secret(), "secret for key:");
+
+        fs::write(&program, "#!/bin/sh\nexit 1\n").unwrap();
+        assert!(ssh_askpass(program.to_str().unwrap(), "key:").is_err());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_pinentry() {
+        use std::{fs, os::unix::fs::PermissionsExt};
+
+        let dir = tempfile::tempdir().unwrap();
+        let program = dir.path().join("pinentry");
+        fs::write(
+            &program,
+            "#!/bin/sh\necho OK ready\nwhile read cmd; do\n  case $cmd in\n    GETPIN) echo 'D secret'; echo OK ;;\n    BYE) echo OK; exit 0 ;;\n    *) echo OK ;;\n  esac\ndone\n",
+        )
+        .unwrap();
+        fs::set_permissions(&program, fs::Permissions::from_mode(0o755)).unwrap();
+
+        let pin = pinentry(program.to_str().unwrap(), "Enter ssh key passphrase: ").unwrap();
+        assert_eq!(pin.expose_secret(), "secret");
+    }
+}
@@ -1,16 +1,23 @@
+use crate::exit::Failure;
 use crate::vault::{
-    crypto::aes256::Aes256Crypto, crypto::Crypto, fingerprint::md5_fingerprint, Vault,
+    crypto, crypto::aes256::Aes256Crypto, crypto::Crypto, fingerprint::md5_fingerprint, fips,
+    stream::Stanza, Vault,
 };
-use anyhow::{Context, Result};
+use anyhow::{anyhow, Context, Result};
 use base64ct::{Base64, Encoding};
 use rand::rngs::OsRng;
-use rsa::{Oaep, RsaPrivateKey, RsaPublicKey};
+use rsa::{traits::PublicKeyParts, Oaep, RsaPrivateKey, RsaPublicKey};
 use secrecy::{ExposeSecret, Secret};
 use sha2::Sha256;
-use ssh_key::{private::KeypairData, public::KeyData, PrivateKey, PublicKey};
+use ssh_key::{private::KeypairData, public::KeyData, HashAlg, PrivateKey, PublicKey};
 use zeroize::Zeroize;
 
+/// Tag of the stanzas wrapping the vault key for an RSA key
+pub const STANZA: &str = "RSA-OAEP";
+
 pub struct RsaVault {
+    // SHA256 fingerprint of the ssh key
+    fingerprint: String,
     public_key: RsaPublicKey,
     private_key: Option<RsaPrivateKey>,
 }
@@ -22,7 +29,9 @@ impl Vault for RsaVault {
                 KeyData::Rsa(key_data) => {
                     let public_key =
                         RsaPublicKey::try_from(key_data).context("Could not load key")?;
+                    fips::check_rsa_bits(public_key.size() * 8)?;
                     Ok(Self {
+                        fingerprint: public.fingerprint(HashAlg::Sha256).to_string(),
                         public_key,
                         private_key: None,
                     })
@@ -37,7 +46,9 @@ impl Vault for RsaVault {
                     }
                     let private_key = RsaPrivateKey::try_from(key_data)?;
                     let public_key = private_key.to_public_key();
+                    fips::check_rsa_bits(public_key.size() * 8)?;
                     Ok(Self {
+                        fingerprint: private.fingerprint(HashAlg::Sha256).to_string(),
                         public_key,
                         private_key: Some(private_key),
                     })
@@ -61,9 +72,7 @@ impl Vault for RsaVault {
         // zeroize data
         data.zeroize();
 
-        let encrypted_password =
-            self.public_key
-                .encrypt(&mut OsRng, Oaep::new::<Sha256>(), password.expose_secret())?;
+        let encrypted_password = self.wrap_key(&password)?;
 
         // create vault payload
         let payload = format!(
@@ -84,25 +93,56 @@ impl Vault for RsaVault {
     fn view(&self, password: &[u8], data: &[u8], fingerprint: &str) -> Result<String> {
         let get_fingerprint = md5_fingerprint(&self.public_key)?;
 
-        if get_fingerprint != fingerprint {
-            return Err(anyhow::anyhow!("Fingerprint mismatch, use correct key"));
+        if !crypto::ct_eq(get_fingerprint.as_bytes(), fingerprint.as_bytes()) {
+            return Err(Failure::WrongKey.error("Fingerprint mismatch, use correct key"));
+        }
+
+        let password = self.unwrap_key(password)?;
+
+        let crypto = Aes256Crypto::new(password);
+
+        let out = crypto.decrypt(data, fingerprint.as_bytes())?;
+        Ok(String::from_utf8(out)?)
+    }
+
+    fn fingerprint(&self) -> String {
+        self.fingerprint.clone()
+    }
+
+    fn wrap(&self, key: &Secret<[u8; 32]>) -> Result<Stanza> {
+        Ok(Stanza {
+            tag: STANZA.to_string(),
+            fingerprint: self.fingerprint(),
+            args: vec![self.wrap_key(key)?],
+        })
+    }
+
+    fn unwrap(&self, stanza: &Stanza) -> Result<Secret<[u8; 32]>> {
+        match stanza.args.as_slice() {
+            [encrypted_key] if stanza.tag == STANZA => self.unwrap_key(encrypted_key),
+            _ => Err(anyhow!("Invalid {STANZA} stanza")),
         }
+    }
+}
+
+impl RsaVault {
+    // Encrypt the key with the public key using OAEP
+    fn wrap_key(&self, key: &Secret<[u8; 32]>) -> Result<Vec<u8>> {
+        Ok(self
+            .public_key
+            .encrypt(&mut OsRng, Oaep::new::<Sha256>(), key.expose_secret())?)
+    }
 
+    // Decrypt a key encrypted by wrap_key
+    fn unwrap_key(&self, encrypted_key: &[u8]) -> Result<Secret<[u8; 32]>> {
         match &self.private_key {
-            Some(private_key) => {
-                let password: Secret<[u8; 32]> = Secret::new(
-                    private_key
-                        .decrypt(Oaep::new::<Sha256>(), password)?
-                        .try_into()
-                        .map_err(|_| anyhow::Error::msg("Invalid password"))?,
-                );
-
-                let crypto = Aes256Crypto::new(password);
-
-                let out = crypto.decrypt(data, fingerprint.as_bytes())?;
-                Ok(String::from_utf8(out)?)
-            }
-            None => Err(anyhow::anyhow!("Private key is required to view vault")),
+            Some(private_key) => Ok(Secret::new(
+                private_key
+                    .decrypt(Oaep::new::<Sha256>(), encrypted_key)?
+                    .try_into()
+                    .map_err(|_| anyhow::Error::msg("Invalid password"))?,
+            )),
+            None => Err(anyhow!("Private key is required to view vault")),
         }
     }
 }
@@ -0,0 +1,120 @@
+use globset::Glob;
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+// host of the blocks that apply to ssh-vault, e.g.:
+//
+// Host ssh-vault
+//     IdentityFile ~/.ssh/work_ed25519
+const HOST: &str = "ssh-vault";
+
+/// Get the `IdentityFile` entries of an ssh config that apply to ssh-vault,
+/// the global ones and the ones of the `Host` blocks matching `ssh-vault`
+#[must_use]
+pub fn identity_files(path: &Path, home: &Path) -> Vec<PathBuf> {
+    fs::read_to_string(path)
+        .map(|config| parse(&config, home))
+        .unwrap_or_default()
+}
+
+fn parse(config: &str, home: &Path) -> Vec<PathBuf> {
+    let mut identities = Vec::new();
+
+    // the lines before the first Host or Match apply to every host
+    let mut applies = true;
+
+    for line in config.lines().map(str::trim) {
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+
+        // Keyword value or Keyword=value
+        let (keyword, value) = line
+            .split_once(|c: char| c.is_whitespace() || c == '=')
+            .map_or((line, ""), |(keyword, value)| {
+                (
+                    keyword,
+                    value.trim_start_matches(|c: char| c.is_whitespace() || c == '='),
+                )
+            });
+
+        match keyword.to_lowercase().as_str() {
+            "host" => applies = matches(value),
+            // the criteria of Match are not supported
+            "match" => applies = false,
+            "identityfile" if applies => {
+                identities.push(expand(value.trim().trim_matches('"'), home));
+            }
+            _ => {}
+        }
+    }
+
+    identities
+}
+
+// any pattern matches and no negated pattern does
+fn matches(patterns: &str) -> bool {
+    let mut matched = false;
+
+    for pattern in patterns.split_whitespace() {
+        let (negated, pattern) = pattern
+            .strip_prefix('!')
+            .map_or((false, pattern), |pattern| (true, pattern));
+
+        if Glob::new(pattern).map_or(false, |glob| glob.compile_matcher().is_match(HOST)) {
+            if negated {
+                return false;
+            }
+            matched = true;
+        }
+    }
+
+    matched
+}
+
+fn expand(path: &str, home: &Path) -> PathBuf {
+    let home = home.display().to_string();
+
+    let path = path.replace("%d", &home);
+
+    path.strip_prefix("~/")
+        .map_or_else(|| PathBuf::from(&path), |path| Path::new(&home).join(path))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse() {
+        let config = r#"
+IdentityFile ~/.ssh/global
+
+Host github.com
+    IdentityFile ~/.ssh/github
+
+Host ssh-vault
+    IdentityFile=%d/.ssh/vault_ed25519
+
+Host * !ssh-vault
+    IdentityFile ~/.ssh/not_vault
+
+Host ssh-*
+    IdentityFile "/keys/shared key"
+
+Match host ssh-vault
+    IdentityFile ~/.ssh/match
+"#;
+
+        assert_eq!(
+            parse(config, Path::new("/home/alice")),
+            vec![
+                PathBuf::from("/home/alice/.ssh/global"),
+                PathBuf::from("/home/alice/.ssh/vault_ed25519"),
+                PathBuf::from("/keys/shared key"),
+            ]
+        );
+    }
+}
@@ -0,0 +1,1540 @@
+// Vault format that can be encrypted and decrypted without holding the data in
+// memory:
+//
+//  SSH-VAULT;V2
+//  -> X25519 SHA256:<fingerprint> <ephemeral public key> <encrypted key>
+//  +> cipher AES-256-GCM
+//  +> file <tag> mode=755
+//  +> label <tag> prod DB creds
+//  +> edited <tag> SHA256:<fingerprint> 1700000000 alice@laptop
+//  +> expires <tag> 1707776000
+//  +> mac <tag>
+//  ---
+//  <payload in base64, 64 columns>
+//
+// The payload is a random salt followed by the data split in chunks, encrypted
+// with a key derived from the salt and the vault key, using ChaCha20-Poly1305
+// or AES-256-GCM when the header has a `+> cipher` line (FIPS mode)
+//
+// Dual control vaults split the vault key in two shares, key = share1 ^ share2,
+// each one encrypted for a different ssh key in a pair of `=>` lines, opening
+// the vault requires both keys
+//
+// The optional `+> file` line keeps the mode, owner and modification time of
+// the file the vault was created from, `+> label` describes the vault,
+// `+> edited` records the key that edited it last and `+> expires` when the
+// secret should be rotated
+//
+// The `+> mac` line authenticates the whole header with the vault key, so a
+// line can't be removed or added either. The payload key of a vault with the
+// line is derived differently, removing it makes the payload fail to decrypt
+
+use crate::exit::Failure;
+use crate::harden;
+use crate::vault::{
+    crypto,
+    crypto::chunk::{ChunkCipher, Cipher, CHUNK_SIZE, TAG_SIZE},
+    expiry::{self, Expiry},
+    fips,
+    label::{self, Label},
+    last_edit::{self, LastEdit},
+    metadata::{self, Metadata},
+    SshVault,
+};
+use anyhow::{anyhow, Result};
+use base64ct::{Base64, Encoding};
+use rand::{rngs::OsRng, RngCore};
+use secrecy::{ExposeSecret, Secret};
+use std::{
+    collections::HashSet,
+    fmt,
+    io::{self, BufRead, Read, Write},
+    num::NonZeroUsize,
+    sync::atomic::{AtomicUsize, Ordering},
+    thread,
+};
+use zeroize::Zeroize;
+
+/// First line of a streamed vault
+pub const MAGIC: &str = "SSH-VAULT;V2";
+
+/// Last line of the header
+pub const END: &str = "---";
+
+/// Start of the line naming the payload cipher, ChaCha20-Poly1305 if missing
+pub const CIPHER: &str = "+> cipher";
+
+/// Start of the line authenticating the whole header, missing in older vaults
+pub const MAC: &str = "+> mac";
+
+/// Start of the stanzas of a dual control share
+pub const SHARE_ARROW: &str = "=>";
+
+/// First line of a share of a dual control vault
+pub const SHARE_MAGIC: &str = "SSH-VAULT;SHARE";
+
+pub const SALT_SIZE: usize = 16;
+
+/// Bytes per line of the payload, 64 base64 characters
+pub const LINE_SIZE: usize = 48;
+
+/// The vault key encrypted for one ssh key
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Stanza {
+    pub tag: String,
+    pub fingerprint: String,
+    pub args: Vec<Vec<u8>>,
+}
+
+impl Stanza {
+    /// Parse a `-> <tag> <fingerprint> <base64 args...>` line
+    /// # Errors
+    /// Will return an error if the line is not a valid stanza
+    pub fn parse(line: &str) -> Result<Self> {
+        let mut tokens = line.split_whitespace();
+
+        if tokens.next() != Some("->") {
+            return Err(invalid());
+        }
+
+        let tag = tokens.next().ok_or_else(invalid)?.to_string();
+        let fingerprint = tokens.next().ok_or_else(invalid)?.to_string();
+        let args = tokens
+            .map(|arg| Base64::decode_vec(arg).map_err(|_| invalid()))
+            .collect::<Result<Vec<_>>>()?;
+
+        Ok(Self {
+            tag,
+            fingerprint,
+            args,
+        })
+    }
+}
+
+impl fmt::Display for Stanza {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "-> {} {}", self.tag, self.fingerprint)?;
+
+        for arg in &self.args {
+            write!(f, " {}", Base64::encode_string(arg))?;
+        }
+
+        Ok(())
+    }
+}
+
+/// The header of a streamed vault
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Header {
+    pub stanzas: Vec<Stanza>,
+    // dual control, both stanzas of a pair are required to get the key
+    pub shares: Vec<[Stanza; 2]>,
+    // of the payload
+    pub cipher: Cipher,
+    // of the file the vault was created from
+    pub metadata: Metadata,
+    // authenticated with the vault key but readable without it
+    pub label: Option<Label>,
+    pub edited: Option<LastEdit>,
+    pub expires: Option<Expiry>,
+    // of the other lines, set when the vault is encrypted
+    pub mac: Option<String>,
+}
+
+impl Header {
+    /// Read the header, leaving the reader at the start of the payload
+    /// # Errors
+    /// Will return an error if it's not a valid streamed vault
+    pub fn read<R: BufRead>(reader: &mut R) -> Result<Self> {
+        if read_line(reader)?.as_deref() != Some(MAGIC) {
+            return Err(invalid());
+        }
+
+        Self::read_stanzas(reader)
+    }
+
+    /// Read the header once the first line has been consumed
+    /// # Errors
+    /// Will return an error if a stanza is not valid or the header has no end
+    pub fn read_stanzas<R: BufRead>(reader: &mut R) -> Result<Self> {
+        let mut stanzas = Vec::new();
+        let mut shares = Vec::new();
+        let mut share: Option<Stanza> = None;
+        let mut cipher = Cipher::default();
+        let mut metadata = Metadata::default();
+        let mut label = None;
+        let mut edited = None;
+        let mut expires = None;
+        let mut mac = None;
+
+        // the first line is the magic
+        let mut number = 1;
+
+        loop {
+            number += 1;
+
+            match read_line(reader)?.as_deref() {
+                Some(END) => break,
+                Some(line) if line.starts_with(CIPHER) => {
+                    cipher = line
+                        .strip_prefix(CIPHER)
+                        .and_then(|name| name.strip_prefix(' '))
+                        .and_then(|name| name.parse().ok())
+                        .ok_or_else(|| invalid_at(number, "unsupported cipher"))?;
+                }
+                Some(line) if line.starts_with(MAC) => {
+                    mac = Some(
+                        line.strip_prefix(MAC)
+                            .and_then(|tag| tag.strip_prefix(' '))
+                            .filter(|tag| !tag.is_empty() && !tag.contains(' '))
+                            .ok_or_else(|| invalid_at(number, "invalid mac"))?
+                            .to_string(),
+                    );
+                }
+                Some(line) if line.starts_with(metadata::PREFIX) => {
+                    metadata = Metadata::parse(line)
+                        .map_err(|_| invalid_at(number, "invalid file metadata"))?;
+                }
+                Some(line) if line.starts_with(label::PREFIX) => {
+                    label =
+                        Some(Label::parse(line).map_err(|_| invalid_at(number, "invalid label"))?);
+                }
+                Some(line) if line.starts_with(last_edit::PREFIX) => {
+                    edited = Some(
+                        LastEdit::parse(line)
+                            .map_err(|_| invalid_at(number, "invalid last edit"))?,
+                    );
+                }
+                Some(line) if line.starts_with(expiry::PREFIX) => {
+                    expires = Some(
+                        Expiry::parse(line).map_err(|_| invalid_at(number, "invalid expiry"))?,
+                    );
+                }
+                Some(line) => match line.strip_prefix(SHARE_ARROW) {
+                    Some(rest) => {
+                        let stanza = Stanza::parse(&format!("->{rest}"))
+                            .map_err(|_| invalid_at(number, "invalid share stanza"))?;
+
+                        match share.take() {
+                            Some(first) => shares.push([first, stanza]),
+                            None => share = Some(stanza),
+                        }
+                    }
+                    None => stanzas.push(
+                        Stanza::parse(line).map_err(|_| invalid_at(number, "invalid stanza"))?,
+                    ),
+                },
+                None => return Err(invalid_at(number, "the header has no end (---)")),
+            }
+        }
+
+        // shares come in pairs
+        if share.is_some() {
+            return Err(invalid_at(
+                number,
+                "a share of the dual control has no pair",
+            ));
+        }
+
+        if stanzas.is_empty() && shares.is_empty() {
+            return Err(invalid_at(number, "the header has no stanzas"));
+        }
+
+        Ok(Self {
+            stanzas,
+            shares,
+            cipher,
+            metadata,
+            label,
+            edited,
+            expires,
+            mac,
+        })
+    }
+
+    /// Write the header
+    /// # Errors
+    /// Will return an error if the writer fails
+    pub fn write<W: Write>(&self, writer: &mut W) -> Result<()> {
+        writeln!(writer, "{MAGIC}")?;
+
+        for stanza in &self.stanzas {
+            writeln!(writer, "{stanza}")?;
+        }
+
+        for stanza in self.shares.iter().flatten() {
+            writeln!(writer, "{SHARE_ARROW}{}", &stanza.to_string()[2..])?;
+        }
+
+        // vaults without the line use ChaCha20-Poly1305
+        if self.cipher != Cipher::default() {
+            writeln!(writer, "{CIPHER} {}", self.cipher)?;
+        }
+
+        if !self.metadata.is_empty() {
+            writeln!(writer, "{}", self.metadata)?;
+        }
+
+        if let Some(label) = &self.label {
+            writeln!(writer, "{label}")?;
+        }
+
+        if let Some(edited) = &self.edited {
+            writeln!(writer, "{edited}")?;
+        }
+
+        if let Some(expires) = &self.expires {
+            writeln!(writer, "{expires}")?;
+        }
+
+        if let Some(mac) = &self.mac {
+            writeln!(writer, "{MAC} {mac}")?;
+        }
+
+        writeln!(writer, "{END}")?;
+
+        Ok(())
+    }
+
+    /// Authenticate the whole header with the vault key, the payload must be
+    /// encrypted again unless the header already had a mac
+    /// # Errors
+    /// Will return an error if the tag can't be derived
+    pub fn authenticate(&mut self, key: &Secret<[u8; 32]>) -> Result<()> {
+        self.mac = Some(self.tag(key)?);
+        Ok(())
+    }
+
+    // the tag of the header without the mac line
+    fn tag(&self, key: &Secret<[u8; 32]>) -> Result<String> {
+        let mut header = Vec::new();
+
+        Self {
+            mac: None,
+            ..self.clone()
+        }
+        .write(&mut header)?;
+
+        crypto::header_tag(key, "header", &header)
+    }
+
+    /// Tags of the stanzas, used to find the private key
+    #[must_use]
+    pub fn key_types(&self) -> Vec<&str> {
+        self.stanzas
+            .iter()
+            .chain(self.shares.iter().flatten())
+            .map(|stanza| stanza.tag.as_str())
+            .collect()
+    }
+
+    /// Fingerprints of the keys that have a stanza or a share
+    #[must_use]
+    pub fn fingerprints(&self) -> Vec<&str> {
+        self.stanzas
+            .iter()
+            .chain(self.shares.iter().flatten())
+            .map(|stanza| stanza.fingerprint.as_str())
+            .collect()
+    }
+
+    /// Decrypt the vault key using the stanza of the ssh key, the header is
+    /// checked with the key
+    /// # Errors
+    /// Will return an error if there is no stanza for the key, it can't be
+    /// decrypted or the header was modified
+    pub fn unwrap(&self, vault: &SshVault) -> Result<Secret<[u8; 32]>> {
+        let fingerprint = vault.fingerprint();
+
+        let stanza = self
+            .stanzas
+            .iter()
+            .find(|stanza| crypto::ct_eq(stanza.fingerprint.as_bytes(), fingerprint.as_bytes()));
+
+        match stanza {
+            Some(stanza) => self.verify(vault.unwrap(stanza)?),
+            None if self.share_pair(&fingerprint).is_some() => Err(Failure::WrongKey.error(
+                "Dual control vault, the key only opens one share, the other recipient must send theirs with: ssh-vault share"
+            )),
+            None => Err(Failure::WrongKey.error("Fingerprint mismatch, use correct key")),
+        }
+    }
+
+    // the pair of shares of the key and the index of its share
+    fn share_pair(&self, fingerprint: &str) -> Option<(&[Stanza; 2], usize)> {
+        self.shares.iter().find_map(|pair| {
+            pair.iter()
+                .position(|stanza| {
+                    crypto::ct_eq(stanza.fingerprint.as_bytes(), fingerprint.as_bytes())
+                })
+                .map(|index| (pair, index))
+        })
+    }
+
+    /// Decrypt the share of the key and encrypt it for the other key of the
+    /// pair, so only the other recipient can combine the shares
+    /// # Errors
+    /// Will return an error if the key has no share or the partner is not the
+    /// other key of the pair
+    pub fn share_for(&self, vault: &SshVault, partner: &SshVault) -> Result<Stanza> {
+        let (pair, index) = self
+            .share_pair(&vault.fingerprint())
+            .ok_or_else(|| Failure::WrongKey.error("The key has no share of this vault"))?;
+
+        if !crypto::ct_eq(
+            pair[1 - index].fingerprint.as_bytes(),
+            partner.fingerprint().as_bytes(),
+        ) {
+            return Err(anyhow!(
+                "The share can only be sent to {}",
+                pair[1 - index].fingerprint
+            ));
+        }
+
+        partner.wrap(&vault.unwrap(&pair[index])?)
+    }
+
+    /// Decrypt the vault key combining the share of the key and the share
+    /// sent by the other recipient
+    /// # Errors
+    /// Will return an error if the key has no share or the share is not for it
+    pub fn unwrap_dual(&self, vault: &SshVault, share: &Stanza) -> Result<Secret<[u8; 32]>> {
+        let (pair, index) = self
+            .share_pair(&vault.fingerprint())
+            .ok_or_else(|| Failure::WrongKey.error("The key has no share of this vault"))?;
+
+        let own = vault.unwrap(&pair[index])?;
+        let other = vault.unwrap(share)?;
+
+        self.verify(Secret::new(xor(own.expose_secret(), other.expose_secret())))
+    }
+
+    // the vault key if the header was written by a recipient, without the mac
+    // line only the file metadata, the label, the last edit and the expiry can
+    // be checked
+    fn verify(&self, key: Secret<[u8; 32]>) -> Result<Secret<[u8; 32]>> {
+        if let Some(mac) = &self.mac {
+            if !crypto::ct_eq(mac.as_bytes(), self.tag(&key)?.as_bytes()) {
+                return Err(Failure::Corrupt.error(
+                    "The header of the vault was modified, it was not written by a recipient",
+                ));
+            }
+        }
+
+        self.metadata.verify(&key)?;
+
+        if let Some(label) = &self.label {
+            label.verify(&key)?;
+        }
+
+        if let Some(edited) = &self.edited {
+            edited.verify(&key)?;
+        }
+
+        if let Some(expires) = &self.expires {
+            expires.verify(&key)?;
+        }
+
+        Ok(key)
+    }
+}
+
+/// Split the vault key in two shares, one for each key, both are required to
+/// open the vault
+/// # Errors
+/// Will return an error if the keys are the same or a share can't be encrypted
+pub fn wrap_dual(
+    first: &SshVault,
+    second: &SshVault,
+    key: &Secret<[u8; 32]>,
+) -> Result<[Stanza; 2]> {
+    if first.fingerprint() == second.fingerprint() {
+        return Err(anyhow!("Dual control requires two different keys"));
+    }
+
+    let share = crypto::gen_password()?;
+    let other = Secret::new(xor(key.expose_secret(), share.expose_secret()));
+
+    Ok([first.wrap(&share)?, second.wrap(&other)?])
+}
+
+/// Write a share sent to the other recipient of a dual control vault
+/// # Errors
+/// Will return an error if the writer fails
+pub fn write_share<W: Write>(stanza: &Stanza, writer: &mut W) -> Result<()> {
+    writeln!(writer, "{SHARE_MAGIC}")?;
+    writeln!(writer, "{stanza}")?;
+    Ok(())
+}
+
+/// Read a share written by `write_share`
+/// # Errors
+/// Will return an error if it's not a valid share
+pub fn read_share<R: BufRead>(reader: &mut R) -> Result<Stanza> {
+    if read_line(reader)?.as_deref() != Some(SHARE_MAGIC) {
+        return Err(anyhow!("Not a valid share"));
+    }
+
+    Stanza::parse(&read_line(reader)?.unwrap_or_default())
+}
+
+fn xor(a: &[u8; 32], b: &[u8; 32]) -> [u8; 32] {
+    let mut out = [0; 32];
+
+    for (out, (a, b)) in out.iter_mut().zip(a.iter().zip(b)) {
+        *out = a ^ b;
+    }
+
+    out
+}
+
+/// Read a line without the line ending, `None` at the end of the input
+/// # Errors
+/// Will return an error if the line can't be read or is not valid UTF-8
+pub fn read_line<R: BufRead>(reader: &mut R) -> Result<Option<String>> {
+    let mut line = String::new();
+
+    if reader.read_line(&mut line)? == 0 {
+        return Ok(None);
+    }
+
+    Ok(Some(line.trim_end().to_string()))
+}
+
+/// Encrypt the input for the recipients, only one chunk of the data is kept in memory
+/// # Errors
+/// Will return an error if the input can't be read or the output written
+pub fn encrypt<R: Read, W: Write>(recipients: &[SshVault], input: R, output: W) -> Result<()> {
+    let key = crypto::gen_password()?;
+
+    let header = Header {
+        stanzas: wrap(recipients, &key)?,
+        shares: Vec::new(),
+        cipher: fips::cipher()?,
+        metadata: Metadata::default(),
+        label: None,
+        edited: None,
+        expires: None,
+        mac: None,
+    };
+
+    encrypt_with_key(&header, &key, input, output)
+}
+
+/// Encrypt the vault key for every recipient.
+///
+/// Keys used more than once get a single stanza, with many recipients the work
+/// is split between threads, one per available core
+/// # Errors
+/// Will return an error if there are no recipients or the key can't be encrypted
+pub fn wrap(recipients: &[SshVault], key: &Secret<[u8; 32]>) -> Result<Vec<Stanza>> {
+    let mut seen = HashSet::new();
+    let recipients: Vec<&SshVault> = recipients
+        .iter()
+        .filter(|recipient| seen.insert(recipient.fingerprint()))
+        .collect();
+
+    if recipients.is_empty() {
+        return Err(anyhow!("At least one recipient is required"));
+    }
+
+    let workers = thread::available_parallelism()
+        .map_or(1, NonZeroUsize::get)
+        .min(recipients.len());
+
+    if workers == 1 {
+        return recipients
+            .iter()
+            .map(|recipient| recipient.wrap(key))
+            .collect();
+    }
+
+    // workers take the next recipient until there are none left
+    let next = AtomicUsize::new(0);
+    let mut stanzas: Vec<Option<Stanza>> = vec![None; recipients.len()];
+
+    thread::scope(|scope| -> Result<()> {
+        let handles: Vec<_> = (0..workers)
+            .map(|_| {
+                scope.spawn(|| {
+                    let mut wrapped = Vec::new();
+
+                    loop {
+                        let index = next.fetch_add(1, Ordering::Relaxed);
+
+                        let Some(recipient) = recipients.get(index) else {
+                            return wrapped;
+                        };
+
+                        wrapped.push((index, recipient.wrap(key)));
+                    }
+                })
+            })
+            .collect();
+
+        for handle in handles {
+            let wrapped = handle
+                .join()
+                .map_err(|_| anyhow!("Failed to encrypt the key for the recipients"))?;
+
+            for (index, stanza) in wrapped {
+                stanzas[index] = Some(stanza?);
+            }
+        }
+
+        Ok(())
+    })?;
+
+    // keep the order of the recipients
+    Ok(stanzas.into_iter().flatten().collect())
+}
+
+/// Encrypt the input with the key of an existing header, the header gets a
+/// new mac
+/// # Errors
+/// Will return an error if the input can't be read or the output written
+pub fn encrypt_with_key<R: Read, W: Write>(
+    header: &Header,
+    key: &Secret<[u8; 32]>,
+    mut input: R,
+    mut output: W,
+) -> Result<()> {
+    fips::check_cipher(header.cipher)?;
+
+    let mut header = header.clone();
+    header.authenticate(key)?;
+    header.write(&mut output)?;
+
+    write_payload(&header, key, &mut input, output)
+}
+
+// the salt and the chunks following the header
+fn write_payload<R: Read, W: Write>(
+    header: &Header,
+    key: &Secret<[u8; 32]>,
+    input: &mut R,
+    output: W,
+) -> Result<()> {
+    let mut armor = ArmorWriter::new(output);
+
+    let mut salt = [0; SALT_SIZE];
+    OsRng.fill_bytes(&mut salt);
+    armor.write_all(&salt)?;
+
+    let mut cipher = ChunkCipher::new(header.cipher, &payload_key(header, key, &salt)?);
+
+    // the buffer is reused for every chunk, the tag is appended in place
+    let (mut buf, locked) = chunk_buffer();
+    let rs = seal_chunks(input, &mut cipher, &mut armor, &mut buf);
+    release(buf, locked);
+    rs?;
+
+    armor.finish()?.flush()?;
+
+    Ok(())
+}
+
+fn seal_chunks<R: Read, W: Write>(
+    input: &mut R,
+    cipher: &mut ChunkCipher,
+    output: &mut W,
+    buf: &mut Vec<u8>,
+) -> Result<()> {
+    let mut peek = None;
+
+    loop {
+        let last = next_chunk(input, buf, CHUNK_SIZE, &mut peek)?;
+
+        cipher.seal(buf, last)?;
+        output.write_all(buf)?;
+
+        if last {
+            return Ok(());
+        }
+    }
+}
+
+/// Decrypt the payload following the header, every chunk is written once it is
+/// authenticated, a truncated vault is detected when reaching the end
+/// # Errors
+/// Will return an error if the key can't be decrypted or the payload is not valid
+pub fn decrypt<R: BufRead, W: Write>(
+    header: &Header,
+    vault: &SshVault,
+    input: R,
+    output: W,
+) -> Result<()> {
+    decrypt_with_key(header, &header.unwrap(vault)?, input, output)
+}
+
+/// Decrypt the payload following the header with the vault key
+/// # Errors
+/// Will return an error if the payload is not valid
+pub fn decrypt_with_key<R: BufRead, W: Write>(
+    header: &Header,
+    key: &Secret<[u8; 32]>,
+    input: R,
+    mut output: W,
+) -> Result<()> {
+    fips::check_cipher(header.cipher)?;
+
+    let mut armor = ArmorReader::new(input);
+
+    let mut salt = [0; SALT_SIZE];
+    armor.read_exact(&mut salt).map_err(|e| match e.kind() {
+        io::ErrorKind::UnexpectedEof => {
+            Failure::Corrupt.error("Not a valid SSH-VAULT file, the payload is truncated")
+        }
+        _ => e.into(),
+    })?;
+
+    let mut cipher = ChunkCipher::new(header.cipher, &payload_key(header, key, &salt)?);
+
+    let size = CHUNK_SIZE + TAG_SIZE;
+    let (mut buf, locked) = chunk_buffer();
+    let mut peek = None;
+
+    let rs = loop {
+        let last = next_chunk(&mut armor, &mut buf, size, &mut peek)?;
+
+        if let Err(e) = cipher.open(&mut buf, last) {
+            break Err(e);
+        }
+
+        if let Err(e) = output.write_all(&buf) {
+            break Err(e.into());
+        }
+
+        if last {
+            break Ok(());
+        }
+    };
+
+    release(buf, locked);
+    rs?;
+
+    output.flush()?;
+
+    Ok(())
+}
+
+/// What was recovered from a damaged vault
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct Recovery {
+    pub chunks: usize,
+    // positions of the chunks that failed the authentication
+    pub lost: Vec<usize>,
+    // lines of the payload that were not valid base64, counting from 1
+    pub damaged_lines: Vec<usize>,
+    // the last chunk is not marked as the last one
+    pub truncated: bool,
+    // plaintext bytes written
+    pub size: usize,
+}
+
+impl Recovery {
+    #[must_use]
+    pub const fn is_intact(&self) -> bool {
+        self.lost.is_empty() && !self.truncated
+    }
+}
+
+impl fmt::Display for Recovery {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if !self.damaged_lines.is_empty() {
+            let lines: Vec<String> = self.damaged_lines.iter().map(ToString::to_string).collect();
+            writeln!(f, "Damaged lines of the payload: {}", lines.join(", "))?;
+        }
+
+        for chunk in &self.lost {
+            let start = chunk * CHUNK_SIZE;
+            writeln!(
+                f,
+                "Lost chunk {} of {}, bytes {start} to {} of the data",
+                chunk + 1,
+                self.chunks,
+                start + CHUNK_SIZE - 1
+            )?;
+        }
+
+        if self.truncated {
+            writeln!(
+                f,
+                "The vault is truncated, the data after chunk {} is lost",
+                self.chunks
+            )?;
+        }
+
+        write!(
+            f,
+            "Recovered {} of {} chunks, {} bytes",
+            self.chunks - self.lost.len(),
+            self.chunks,
+            self.size
+        )
+    }
+}
+
+/// Decrypt what can be recovered of a damaged payload, the chunks that fail
+/// the authentication are skipped and the following ones still decrypted since
+/// their position in the payload is known.
+///
+/// The payload is read in memory, lines that are not valid base64 are replaced
+/// with zeros to keep the position of the chunks
+/// # Errors
+/// Will return an error if there is no payload or the output can't be written
+pub fn repair<R: BufRead, W: Write>(
+    header: &Header,
+    key: &Secret<[u8; 32]>,
+    mut input: R,
+    mut output: W,
+) -> Result<Recovery> {
+    fips::check_cipher(header.cipher)?;
+
+    let mut recovery = Recovery::default();
+    let mut lines = Vec::new();
+
+    while let Some(line) = read_line(&mut input)? {
+        let line = line.trim();
+
+        if !line.is_empty() {
+            lines.push(Base64::decode_vec(line).ok());
+        }
+    }
+
+    let mut payload = Vec::with_capacity(lines.len() * LINE_SIZE);
+
+    for (i, line) in lines.iter().enumerate() {
+        match line {
+            Some(bytes) if bytes.len() == LINE_SIZE => payload.extend(bytes),
+            // only the last line can be shorter
+            Some(bytes) if i + 1 == lines.len() && bytes.len() < LINE_SIZE => {
+                payload.extend(bytes);
+            }
+            _ => {
+                payload.extend([0; LINE_SIZE]);
+                recovery.damaged_lines.push(i + 1);
+            }
+        }
+    }
+
+    if payload.len() < SALT_SIZE + TAG_SIZE {
+        return Err(anyhow!("Nothing to recover, the payload is empty"));
+    }
+
+    let (salt, chunks) = payload.split_at(SALT_SIZE);
+    let cipher = ChunkCipher::new(header.cipher, &payload_key(header, key, salt)?);
+    let chunks: Vec<&[u8]> = chunks.chunks(CHUNK_SIZE + TAG_SIZE).collect();
+
+    recovery.chunks = chunks.len();
+
+    let (mut buf, locked) = chunk_buffer();
+
+    for (i, chunk) in chunks.iter().enumerate() {
+        let last = i + 1 == chunks.len();
+        let index = i as u64;
+
+        buf.clear();
+        buf.extend_from_slice(chunk);
+
+        let mut opened = cipher.open_at(index, &mut buf, last).is_ok();
+
+        // a middle chunk at the end, the following ones are missing
+        if !opened && last {
+            buf.clear();
+            buf.extend_from_slice(chunk);
+
+            opened = cipher.open_at(index, &mut buf, false).is_ok();
+            recovery.truncated = opened;
+        }
+
+        if opened {
+            let rs = output.write_all(&buf);
+            buf.zeroize();
+
+            if let Err(e) = rs {
+                release(buf, locked);
+                return Err(e.into());
+            }
+
+            recovery.size += chunk.len() - TAG_SIZE;
+        } else {
+            recovery.lost.push(i);
+        }
+    }
+
+    release(buf, locked);
+
+    output.flush()?;
+
+    Ok(recovery)
+}
+
+// The buffer of the chunks, locked to keep the plaintext out of swap. It never
+// grows past its capacity so the chunks stay in the locked allocation
+fn chunk_buffer() -> (Vec<u8>, bool) {
+    let mut buf = vec![0; CHUNK_SIZE + TAG_SIZE];
+    let locked = harden::mlock(&buf);
+    buf.clear();
+
+    (buf, locked)
+}
+
+// zeroize the plaintext, then unlock the allocation before it is freed
+fn release(mut buf: Vec<u8>, locked: bool) {
+    buf.zeroize();
+
+    if locked {
+        buf.resize(CHUNK_SIZE + TAG_SIZE, 0);
+        harden::munlock(&buf);
+    }
+}
+
+// Read the next chunk into the buffer, a byte is read ahead to know if it's the
+// last one, returns true if it is
+fn next_chunk<R: Read>(
+    reader: &mut R,
+    buf: &mut Vec<u8>,
+    size: usize,
+    peek: &mut Option<u8>,
+) -> io::Result<bool> {
+    buf.clear();
+    buf.extend(peek.take());
+
+    let start = buf.len();
+    buf.resize(size, 0);
+    let len = read_full(reader, &mut buf[start..])?;
+    buf.truncate(start + len);
+
+    let mut byte = [0; 1];
+    if read_full(reader, &mut byte)? == 1 {
+        *peek = Some(byte[0]);
+    }
+
+    Ok(peek.is_none())
+}
+
+// the data is encrypted with a key derived from the vault key and a salt so
+// that every version of an edited vault uses a different key, AES-256-GCM gets
+// keys of its own so the cipher line can't be swapped, and so do headers with
+// a mac so the line can't be removed
+fn payload_key(header: &Header, key: &Secret<[u8; 32]>, salt: &[u8]) -> Result<Secret<[u8; 32]>> {
+    let mut info = match header.cipher {
+        Cipher::ChaCha20Poly1305 => b"payload".to_vec(),
+        Cipher::Aes256Gcm => format!("payload {}", header.cipher).into_bytes(),
+    };
+
+    if header.mac.is_some() {
+        info.extend_from_slice(b" mac");
+    }
+
+    Ok(Secret::new(crypto::hkdf(salt, &info, key.expose_secret())?))
+}
+
+// read until the buffer is full or the end of the input
+fn read_full<R: Read>(reader: &mut R, buf: &mut [u8]) -> io::Result<usize> {
+    let mut len = 0;
+
+    while len < buf.len() {
+        match reader.read(&mut buf[len..]) {
+            Ok(0) => break,
+            Ok(n) => len += n,
+            Err(e) if e.kind() == io::ErrorKind::Interrupted => {}
+            Err(e) => return Err(e),
+        }
+    }
+
+    Ok(len)
+}
+
+fn invalid() -> anyhow::Error {
+    Failure::Corrupt.error("Not a valid SSH-VAULT file")
+}
+
+fn invalid_at(line: usize, message: &str) -> anyhow::Error {
+    Failure::Corrupt.error(format!(
+        "Not a valid SSH-VAULT file, line {line}: {message}"
+    ))
+}
+
+/// Encodes the written bytes in base64 lines
+pub struct ArmorWriter<W: Write> {
+    inner: W,
+    line: [u8; LINE_SIZE],
+    len: usize,
+    // base64 of a line followed by the new line
+    encoded: [u8; LINE_SIZE / 3 * 4 + 1],
+}
+
+impl<W: Write> ArmorWriter<W> {
+    pub const fn new(inner: W) -> Self {
+        Self {
+            inner,
+            line: [0; LINE_SIZE],
+            len: 0,
+            encoded: [0; LINE_SIZE / 3 * 4 + 1],
+        }
+    }
+
+    /// Write the last line and return the inner writer
+    /// # Errors
+    /// Will return an error if the inner writer fails
+    pub fn finish(mut self) -> io::Result<W> {
+        if self.len > 0 {
+            self.write_line()?;
+        }
+
+        Ok(self.inner)
+    }
+
+    fn write_line(&mut self) -> io::Result<()> {
+        let n = Base64::encode(&self.line[..self.len], &mut self.encoded)
+            .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "Invalid line"))?
+            .len();
+        self.encoded[n] = b'\n';
+        self.inner.write_all(&self.encoded[..=n])?;
+        self.len = 0;
+        Ok(())
+    }
+}
+
+impl<W: Write> Write for ArmorWriter<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let n = buf.len().min(LINE_SIZE - self.len);
+        self.line[self.len..self.len + n].copy_from_slice(&buf[..n]);
+        self.len += n;
+
+        if self.len == LINE_SIZE {
+            self.write_line()?;
+        }
+
+        Ok(n)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.inner.flush()
+    }
+}
+
+/// Decodes the base64 lines written by `ArmorWriter`, the buffers are reused
+/// for every line
+pub struct ArmorReader<R: BufRead> {
+    inner: R,
+    line: String,
+    buf: Vec<u8>,
+    len: usize,
+    pos: usize,
+    // lines read, to tell which one is not valid
+    lines: usize,
+}
+
+impl<R: BufRead> ArmorReader<R> {
+    pub const fn new(inner: R) -> Self {
+        Self {
+            inner,
+            line: String::new(),
+            buf: Vec::new(),
+            len: 0,
+            pos: 0,
+            lines: 0,
+        }
+    }
+}
+
+impl<R: BufRead> Read for ArmorReader<R> {
+    fn read(&mut self, out: &mut [u8]) -> io::Result<usize> {
+        while self.pos == self.len {
+            self.line.clear();
+
+            if self.inner.read_line(&mut self.line)? == 0 {
+                return Ok(0);
+            }
+
+            self.lines += 1;
+
+            let line = self.line.trim();
+
+            if line.is_empty() {
+                continue;
+            }
+
+            // the decoded line is always shorter than the encoded one
+            if self.buf.len() < line.len() {
+                self.buf.resize(line.len(), 0);
+            }
+
+            self.len = Base64::decode(line, &mut self.buf)
+                .map_err(|_| {
+                    io::Error::new(
+                        io::ErrorKind::InvalidData,
+                        format!("Invalid payload, line {} of the payload", self.lines),
+                    )
+                })?
+                .len();
+            self.pos = 0;
+        }
+
+        let n = out.len().min(self.len - self.pos);
+        out[..n].copy_from_slice(&self.buf[self.pos..self.pos + n]);
+        self.pos += n;
+
+        Ok(n)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, SshKeyType};
+    use ssh_key::PublicKey;
+    use std::path::Path;
+
+    fn vaults() -> (SshVault, SshVault) {
+        let public_key = PublicKey::read_openssh_file(Path::new("test_data/ed25519.pub")).unwrap();
+        let private_key =
+            find::private_key(Some("test_data/ed25519".to_string()), &SshKeyType::Ed25519).unwrap();
+
+        (
+            SshVault::new(&SshKeyType::Ed25519, Some(public_key), None).unwrap(),
+            SshVault::new(&SshKeyType::Ed25519, None, Some(private_key)).unwrap(),
+        )
+    }
+
+    #[test]
+    fn test_stanza() {
+        let stanza = Stanza {
+            tag: "X25519".to_string(),
+            fingerprint: "SHA256:abc".to_string(),
+            args: vec![vec![1, 2, 3], vec![4]],
+        };
+
+        let line = stanza.to_string();
+        assert_eq!(line, "-> X25519 SHA256:abc AQID BA==");
+        assert_eq!(Stanza::parse(&line).unwrap(), stanza);
+
+        assert!(Stanza::parse("X25519 SHA256:abc AQID").is_err());
+        assert!(Stanza::parse("-> X25519").is_err());
+        assert!(Stanza::parse("-> X25519 SHA256:abc !!").is_err());
+    }
+
+    #[test]
+    fn test_header() {
+        assert!(Header::read(&mut "SSH-VAULT;V2\n---\n".as_bytes()).is_err());
+        assert!(Header::read(&mut "SSH-VAULT;V2\n-> X25519 SHA256:abc\n".as_bytes()).is_err());
+        assert!(Header::read(&mut "SSH-VAULT;V3\n-> X25519 SHA256:abc\n---\n".as_bytes()).is_err());
+
+        let header =
+            Header::read(&mut "SSH-VAULT;V2\n-> X25519 SHA256:abc AQID\n---\n".as_bytes()).unwrap();
+        assert_eq!(header.key_types(), vec!["X25519"]);
+
+        let mut out = Vec::new();
+        header.write(&mut out).unwrap();
+        assert_eq!(out, b"SSH-VAULT;V2\n-> X25519 SHA256:abc AQID\n---\n");
+    }
+
+    #[test]
+    fn test_dual_control() {
+        let (public, private) = vaults();
+        let rsa = PublicKey::read_openssh_file(Path::new("test_data/id_rsa.pub")).unwrap();
+        let rsa = SshVault::new(&SshKeyType::Rsa, Some(rsa), None).unwrap();
+        let rsa_private =
+            find::private_key(Some("test_data/id_rsa".to_string()), &SshKeyType::Rsa).unwrap();
+        let rsa_private = SshVault::new(&SshKeyType::Rsa, None, Some(rsa_private)).unwrap();
+
+        assert!(wrap_dual(&public, &public, &crypto::gen_password().unwrap()).is_err());
+
+        let key = crypto::gen_password().unwrap();
+        let header = Header {
+            stanzas: Vec::new(),
+            shares: vec![wrap_dual(&public, &rsa, &key).unwrap()],
+            cipher: Cipher::default(),
+            metadata: Metadata::default(),
+            label: None,
+            edited: None,
+            expires: None,
+            mac: None,
+        };
+
+        let mut vault = Vec::new();
+        encrypt_with_key(&header, &key, b"break glass".as_slice(), &mut vault).unwrap();
+
+        let mut reader = vault.as_slice();
+        let header = Header::read(&mut reader).unwrap();
+        assert_eq!(header.key_types(), vec!["X25519", "RSA-OAEP"]);
+        assert!(String::from_utf8_lossy(&vault).contains("\n=> X25519 "));
+
+        // a single key is not enough
+        assert!(header
+            .unwrap(&private)
+            .unwrap_err()
+            .to_string()
+            .contains("Dual control"));
+
+        // the share is only sent to the other key of the pair
+        assert!(header.share_for(&private, &public).is_err());
+        let share = header.share_for(&private, &rsa).unwrap();
+
+        let mut file = Vec::new();
+        write_share(&share, &mut file).unwrap();
+        let share = read_share(&mut file.as_slice()).unwrap();
+        assert!(read_share(&mut "SSH-VAULT;V2\n".as_bytes()).is_err());
+
+        let key = header.unwrap_dual(&rsa_private, &share).unwrap();
+        let mut out = Vec::new();
+        decrypt_with_key(&header, &key, reader, &mut out).unwrap();
+        assert_eq!(out, b"break glass");
+
+        // an unpaired share
+        assert!(
+            Header::read(&mut "SSH-VAULT;V2\n=> X25519 SHA256:abc AQID\n---\n".as_bytes()).is_err()
+        );
+    }
+
+    #[test]
+    fn test_armor() {
+        let data: Vec<u8> = (0..=255).cycle().take(1000).collect();
+
+        // write in pieces of different sizes
+        let mut armor = ArmorWriter::new(Vec::new());
+        for piece in data.chunks(7) {
+            armor.write_all(piece).unwrap();
+        }
+        let text = armor.finish().unwrap();
+
+        let lines: Vec<&[u8]> = text.split(|&b| b == b'\n').collect();
+        assert!(lines[..lines.len() - 2].iter().all(|line| line.len() == 64));
+
+        let mut out = Vec::new();
+        ArmorReader::new(text.as_slice())
+            .read_to_end(&mut out)
+            .unwrap();
+        assert_eq!(out, data);
+
+        let mut out = Vec::new();
+        assert!(ArmorReader::new("AQID\n!!!!\n".as_bytes())
+            .read_to_end(&mut out)
+            .is_err());
+    }
+
+    #[test]
+    fn test_encrypt_decrypt() {
+        let (public, private) = vaults();
+
+        for size in [0, 1, 47, 48, CHUNK_SIZE, CHUNK_SIZE + 1, 2 * CHUNK_SIZE + 7] {
+            let data: Vec<u8> = (0..size).map(|i| (i % 251) as u8).collect();
+
+            let mut vault = Vec::new();
+            encrypt(std::slice::from_ref(&public), data.as_slice(), &mut vault).unwrap();
+
+            let mut reader = vault.as_slice();
+            let header = Header::read(&mut reader).unwrap();
+
+            let mut out = Vec::new();
+            decrypt(&header, &private, reader, &mut out).unwrap();
+            assert_eq!(out, data, "size {size}");
+
+            // the payload is wrapped at 64 columns
+            let text = String::from_utf8(vault).unwrap();
+            assert!(text.lines().skip(3).all(|line| line.len() <= 64));
+        }
+    }
+
+    #[test]
+    fn test_cipher() {
+        let (public, private) = vaults();
+        let key = crypto::gen_password().unwrap();
+
+        let header = Header {
+            stanzas: wrap(std::slice::from_ref(&public), &key).unwrap(),
+            shares: Vec::new(),
+            cipher: Cipher::Aes256Gcm,
+            metadata: Metadata::default(),
+            label: None,
+            edited: None,
+            expires: None,
+            mac: None,
+        };
+
+        let mut vault = Vec::new();
+        encrypt_with_key(&header, &key, b"secret".as_slice(), &mut vault).unwrap();
+        let text = String::from_utf8(vault).unwrap();
+        assert!(text.contains("\n+> cipher AES-256-GCM\n+> mac "));
+
+        let mut reader = text.as_bytes();
+        let read = Header::read(&mut reader).unwrap();
+        assert_eq!(
+            Header {
+                mac: None,
+                ..read.clone()
+            },
+            header
+        );
+
+        let mut out = Vec::new();
+        decrypt(&read, &private, reader, &mut out).unwrap();
+        assert_eq!(out, b"secret");
+
+        // the payload key depends on the cipher
+        let swapped = text.replace("AES-256-GCM", "CHACHA20-POLY1305");
+        let mut reader = swapped.as_bytes();
+        let read = Header::read(&mut reader).unwrap();
+        assert_eq!(read.cipher, Cipher::ChaCha20Poly1305);
+        assert!(decrypt(&read, &private, reader, &mut Vec::new()).is_err());
+
+        assert!(Header::read(&mut text.replace("AES-256-GCM", "DES").as_bytes()).is_err());
+    }
+
+    #[test]
+    fn test_label() {
+        let (public, private) = vaults();
+        let key = crypto::gen_password().unwrap();
+
+        let header = Header {
+            stanzas: wrap(std::slice::from_ref(&public), &key).unwrap(),
+            shares: Vec::new(),
+            cipher: Cipher::default(),
+            metadata: Metadata::default(),
+            label: Some(Label::new("prod DB creds", &key).unwrap()),
+            edited: None,
+            expires: None,
+            mac: None,
+        };
+
+        let mut vault = Vec::new();
+        encrypt_with_key(&header, &key, b"secret".as_slice(), &mut vault).unwrap();
+
+        let mut reader = vault.as_slice();
+        let read = Header::read(&mut reader).unwrap();
+        assert_eq!(read.label, header.label);
+
+        let mut out = Vec::new();
+        decrypt(&read, &private, reader, &mut out).unwrap();
+        assert_eq!(out, b"secret");
+
+        // the label can be read but not changed without the key
+        let text = String::from_utf8(vault).unwrap().replace("prod", "test");
+        let forged = Header::read(&mut text.as_bytes()).unwrap();
+        assert_eq!(forged.label.unwrap().text, "test DB creds");
+
+        let forged = Header::read(&mut text.as_bytes()).unwrap();
+        assert!(forged.unwrap(&private).is_err());
+    }
+
+    #[test]
+    fn test_mac() {
+        let (public, private) = vaults();
+        let key = crypto::gen_password().unwrap();
+
+        let header = Header {
+            stanzas: wrap(std::slice::from_ref(&public), &key).unwrap(),
+            shares: Vec::new(),
+            cipher: Cipher::default(),
+            metadata: Metadata::default(),
+            label: Some(Label::new("prod DB creds", &key).unwrap()),
+            edited: None,
+            expires: Some(Expiry::new(1_700_000_000, &key).unwrap()),
+            mac: None,
+        };
+
+        let mut vault = Vec::new();
+        encrypt_with_key(&header, &key, b"secret".as_slice(), &mut vault).unwrap();
+        let text = String::from_utf8(vault).unwrap();
+
+        let read = Header::read(&mut text.as_bytes()).unwrap();
+        assert!(read.mac.is_some());
+        assert!(read.unwrap(&private).is_ok());
+
+        // a line removed fails the check
+        let expires = read.expires.as_ref().unwrap().to_string();
+        let removed = text.replace(&format!("{expires}\n"), "");
+        let forged = Header::read(&mut removed.as_bytes()).unwrap();
+        assert!(forged.expires.is_none());
+        assert!(forged.unwrap(&private).is_err());
+
+        // without the mac line the payload key is not the same
+        let mac = format!("{MAC} {}\n", read.mac.as_ref().unwrap());
+        let stripped = removed.replace(&mac, "");
+        let mut reader = stripped.as_bytes();
+        let forged = Header::read(&mut reader).unwrap();
+        assert!(forged.mac.is_none());
+        assert!(decrypt(&forged, &private, reader, &mut Vec::new()).is_err());
+
+        // a recipient can change a line and authenticate the header again
+        let mut reader = text.as_bytes();
+        let mut relabeled = Header::read(&mut reader).unwrap();
+        relabeled.label = None;
+        relabeled.authenticate(&key).unwrap();
+
+        let mut out = Vec::new();
+        decrypt(&relabeled, &private, reader, &mut out).unwrap();
+        assert_eq!(out, b"secret");
+
+        // vaults written before the mac line still open
+        let mut legacy = Vec::new();
+        header.write(&mut legacy).unwrap();
+        write_payload(&header, &key, &mut b"secret".as_slice(), &mut legacy).unwrap();
+
+        let mut reader = legacy.as_slice();
+        let read = Header::read(&mut reader).unwrap();
+        assert!(read.mac.is_none());
+
+        let mut out = Vec::new();
+        decrypt(&read, &private, reader, &mut out).unwrap();
+        assert_eq!(out, b"secret");
+    }
+
+    #[test]
+    fn test_wrap_recipients() {
+        let (public, private) = vaults();
+        let other =
+            PublicKey::read_openssh_file(Path::new("test_data/ed25519_password.pub")).unwrap();
+        let other = SshVault::new(&SshKeyType::Ed25519, Some(other), None).unwrap();
+        let fingerprints = [public.fingerprint(), other.fingerprint()];
+
+        let recipients = [public, other];
+        let key = crypto::gen_password().unwrap();
+        let stanzas = wrap(&recipients, &key).unwrap();
+        assert_eq!(
+            stanzas
+                .iter()
+                .map(|stanza| stanza.fingerprint.clone())
+                .collect::<Vec<_>>(),
+            fingerprints
+        );
+
+        // every recipient can open the vault
+        let mut vault = Vec::new();
+        encrypt(&recipients, "secret".as_bytes(), &mut vault).unwrap();
+        let mut reader = vault.as_slice();
+        let header = Header::read(&mut reader).unwrap();
+        assert_eq!(header.stanzas.len(), 2);
+        let mut out = Vec::new();
+        decrypt(&header, &private, reader, &mut out).unwrap();
+        assert_eq!(out, b"secret");
+
+        assert!(wrap(&[], &key).is_err());
+    }
+
+    #[test]
+    fn test_wrap_duplicated_recipients() {
+        let (public, _) = vaults();
+        let public_key = PublicKey::read_openssh_file(Path::new("test_data/ed25519.pub")).unwrap();
+        let same = SshVault::new(&SshKeyType::Ed25519, Some(public_key), None).unwrap();
+
+        let key = crypto::gen_password().unwrap();
+        assert_eq!(wrap(&[public, same], &key).unwrap().len(), 1);
+    }
+
+    #[test]
+    fn test_decrypt_truncated() {
+        let (public, private) = vaults();
+        let data = vec![1u8; 2 * CHUNK_SIZE];
+
+        let mut vault = Vec::new();
+        encrypt(std::slice::from_ref(&public), data.as_slice(), &mut vault).unwrap();
+
+        // remove the last chunk, everything up to the end of the first one
+        let text = String::from_utf8(vault).unwrap();
+        let lines: Vec<&str> = text.lines().collect();
+        let header_lines = 3;
+        let first_chunk_lines = (SALT_SIZE + CHUNK_SIZE + TAG_SIZE) / LINE_SIZE;
+        let truncated = lines[..header_lines + first_chunk_lines].join("\n");
+
+        let mut reader = truncated.as_bytes();
+        let header = Header::read(&mut reader).unwrap();
+        let mut out = Vec::new();
+        assert!(decrypt(&header, &private, reader, &mut out).is_err());
+    }
+
+    #[test]
+    fn test_repair() {
+        let (public, private) = vaults();
+        let data: Vec<u8> = (0..3 * CHUNK_SIZE + 100).map(|i| (i % 251) as u8).collect();
+
+        let mut vault = Vec::new();
+        encrypt(std::slice::from_ref(&public), data.as_slice(), &mut vault).unwrap();
+
+        let mut reader = vault.as_slice();
+        let header = Header::read(&mut reader).unwrap();
+        let key = header.unwrap(&private).unwrap();
+        let payload = String::from_utf8(reader.to_vec()).unwrap();
+
+        // intact
+        let mut out = Vec::new();
+        let recovery = repair(&header, &key, payload.as_bytes(), &mut out).unwrap();
+        assert!(recovery.is_intact());
+        assert_eq!(recovery.chunks, 4);
+        assert_eq!(out, data);
+
+        // a line in the second chunk that is not valid base64
+        let line = (SALT_SIZE + CHUNK_SIZE + TAG_SIZE) / LINE_SIZE + 10;
+        let mut lines: Vec<String> = payload.lines().map(String::from).collect();
+        lines[line].replace_range(..1, "!");
+
+        let mut out = Vec::new();
+        let recovery = repair(&header, &key, lines.join("\n").as_bytes(), &mut out).unwrap();
+        assert!(!recovery.is_intact());
+        assert_eq!(recovery.lost, vec![1]);
+        assert_eq!(recovery.damaged_lines, vec![line + 1]);
+        assert_eq!(out.len(), 2 * CHUNK_SIZE + 100);
+        assert_eq!(out[..CHUNK_SIZE], data[..CHUNK_SIZE]);
+        assert_eq!(out[CHUNK_SIZE..], data[2 * CHUNK_SIZE..]);
+        assert!(recovery.to_string().contains("Lost chunk 2 of 4"));
+
+        // a flipped bit, only the tag of the chunk fails
+        let mut bytes = Vec::new();
+        ArmorReader::new(payload.as_bytes())
+            .read_to_end(&mut bytes)
+            .unwrap();
+        bytes[SALT_SIZE + 2 * (CHUNK_SIZE + TAG_SIZE) + 5] ^= 1;
+
+        let mut armor = ArmorWriter::new(Vec::new());
+        armor.write_all(&bytes).unwrap();
+        let flipped = armor.finish().unwrap();
+
+        let recovery = repair(&header, &key, flipped.as_slice(), &mut Vec::new()).unwrap();
+        assert_eq!(recovery.lost, vec![2]);
+        assert!(recovery.damaged_lines.is_empty());
+
+        // without the last chunk
+        bytes.truncate(SALT_SIZE + 3 * (CHUNK_SIZE + TAG_SIZE));
+        bytes[SALT_SIZE + 2 * (CHUNK_SIZE + TAG_SIZE) + 5] ^= 1;
+
+        let mut armor = ArmorWriter::new(Vec::new());
+        armor.write_all(&bytes).unwrap();
+        let truncated = armor.finish().unwrap();
+
+        let mut out = Vec::new();
+        let recovery = repair(&header, &key, truncated.as_slice(), &mut out).unwrap();
+        assert!(recovery.truncated);
+        assert!(recovery.lost.is_empty());
+        assert_eq!(out, data[..3 * CHUNK_SIZE]);
+
+        assert!(repair(&header, &key, "".as_bytes(), &mut Vec::new()).is_err());
+    }
+
+    #[test]
+    fn test_decrypt_wrong_key() {
+        let (public, private) = vaults();
+
+        let mut vault = Vec::new();
+        encrypt(
+            std::slice::from_ref(&public),
+            "secret".as_bytes(),
+            &mut vault,
+        )
+        .unwrap();
+
+        let mut reader = vault.as_slice();
+        let mut header = Header::read(&mut reader).unwrap();
+        header.stanzas[0].fingerprint = "SHA256:other".to_string();
+
+        let mut out = Vec::new();
+        let rs = decrypt(&header, &private, reader, &mut out);
+        assert_eq!(
+            rs.unwrap_err().to_string(),
+            "Fingerprint mismatch, use correct key"
+        );
+        assert!(out.is_empty());
+    }
+}
@@ -0,0 +1,718 @@
+// Diagnostics of malformed vaults, instead of a generic error they tell what is
+// wrong and at which line and byte.
+//
+// In strict mode anything the parsers tolerate is rejected too: CRLF line
+// endings, trailing spaces, blank lines, lines of another width, unknown key
+// types or stanzas without the expected arguments
+
+use crate::exit::Failure;
+use crate::vault::{
+    crypto::chunk::{Cipher, TAG_SIZE},
+    expiry::{self, Expiry},
+    label::{self, Label},
+    last_edit::{self, LastEdit},
+    metadata::{self, Metadata},
+    ssh,
+    stream::{CIPHER, END, LINE_SIZE, MAC, MAGIC, SALT_SIZE, SHARE_ARROW},
+};
+use anyhow::Result;
+use base64ct::{Base64, Encoding};
+
+// width of the base64 lines
+const COLUMNS: usize = LINE_SIZE / 3 * 4;
+
+const LEGACY_MAGIC: &str = "SSH-VAULT";
+
+// a line without the line ending and its position in the vault
+struct Line<'a> {
+    start: usize,
+    text: &'a str,
+}
+
+/// Check the armor and the header of a vault in the streamed or the legacy
+/// format, the payload is only decoded, not decrypted
+/// # Errors
+/// Will return an error telling what is wrong and where
+pub fn check(vault: &[u8], strict: bool) -> Result<()> {
+    let text =
+        std::str::from_utf8(vault).map_err(|e| error(vault, e.valid_up_to(), "invalid UTF-8"))?;
+
+    if text.starts_with(MAGIC) {
+        check_stream(text, strict)
+    } else {
+        check_legacy(text, strict)
+    }
+}
+
+fn check_stream(vault: &str, strict: bool) -> Result<()> {
+    let mut lines = lines(vault).into_iter();
+
+    // starts with the magic
+    let first = lines
+        .next()
+        .ok_or_else(|| error(vault.as_bytes(), 0, "empty"))?;
+    if line_text(vault, &first, strict)? != MAGIC {
+        return Err(error(
+            vault.as_bytes(),
+            first.start + MAGIC.len(),
+            "unexpected characters after SSH-VAULT;V2",
+        ));
+    }
+
+    // stanzas until the end of the header
+    let mut stanzas = 0;
+    let mut shares = 0;
+    let mut end = first.start + first.text.len();
+
+    loop {
+        let line = lines
+            .next()
+            .ok_or_else(|| error(vault.as_bytes(), end, "the header has no end (---)"))?;
+        let text = line_text(vault, &line, strict)?;
+        end = line.start + line.text.len();
+
+        if text == END {
+            break;
+        }
+
+        if text.starts_with(metadata::PREFIX) {
+            Metadata::parse(text)
+                .map_err(|e| error(vault.as_bytes(), line.start, &e.to_string()))?;
+        } else if let Some(name) = text.strip_prefix(CIPHER) {
+            name.trim_start()
+                .parse::<Cipher>()
+                .map_err(|e| error(vault.as_bytes(), line.start, &e.to_string()))?;
+        } else if text.starts_with(label::PREFIX) {
+            Label::parse(text).map_err(|e| error(vault.as_bytes(), line.start, &e.to_string()))?;
+        } else if text.starts_with(last_edit::PREFIX) {
+            LastEdit::parse(text)
+                .map_err(|e| error(vault.as_bytes(), line.start, &e.to_string()))?;
+        } else if text.starts_with(expiry::PREFIX) {
+            // the expiry is only enforced once checked with the vault key
+            Expiry::parse(text).map_err(|e| error(vault.as_bytes(), line.start, &e.to_string()))?;
+        } else if let Some(tag) = text.strip_prefix(MAC) {
+            let tag = tag.strip_prefix(' ').ok_or_else(|| {
+                error(vault.as_bytes(), line.start + MAC.len(), "expected a space")
+            })?;
+
+            if base64(vault, line.start + MAC.len() + 1, tag)?.len() != 32 {
+                return Err(error(
+                    vault.as_bytes(),
+                    line.start + MAC.len() + 1,
+                    "the mac must be 32 bytes",
+                ));
+            }
+        } else if let Some(rest) = text.strip_prefix(SHARE_ARROW) {
+            check_stanza(vault, line.start + SHARE_ARROW.len(), rest, strict)?;
+            shares += 1;
+        } else if let Some(rest) = text.strip_prefix("->") {
+            check_stanza(vault, line.start + 2, rest, strict)?;
+            stanzas += 1;
+        } else {
+            return Err(error(
+                vault.as_bytes(),
+                line.start,
+                "expected a stanza (->), a share (=>), a header line (+>) or the end of the header (---)",
+            ));
+        }
+    }
+
+    if shares % 2 == 1 {
+        return Err(error(
+            vault.as_bytes(),
+            end,
+            "a share of the dual control has no pair",
+        ));
+    }
+
+    if stanzas + shares == 0 {
+        return Err(error(vault.as_bytes(), end, "the header has no stanzas"));
+    }
+
+    // base64 lines of the payload
+    let payload: Vec<Line> = lines.collect();
+    let mut size = 0;
+
+    for (i, line) in payload.iter().enumerate() {
+        let text = line_text(vault, line, strict)?;
+        let indent = text.len() - text.trim_start().len();
+
+        if strict && indent > 0 {
+            return Err(error(vault.as_bytes(), line.start, "leading whitespace"));
+        }
+
+        let text = text.trim_start();
+
+        if text.is_empty() {
+            continue;
+        }
+
+        size += base64(vault, line.start + indent, text)?.len();
+
+        let last = i + 1 == payload.len();
+        if strict && (text.len() > COLUMNS || (!last && text.len() != COLUMNS)) {
+            return Err(error(
+                vault.as_bytes(),
+                line.start + text.len().min(COLUMNS),
+                &format!("the lines of the payload must be {COLUMNS} columns wide"),
+            ));
+        }
+    }
+
+    if size < SALT_SIZE + TAG_SIZE {
+        return Err(error(
+            vault.as_bytes(),
+            vault.len(),
+            "the payload is truncated",
+        ));
+    }
+
+    if strict && !vault.ends_with('\n') {
+        return Err(error(
+            vault.as_bytes(),
+            vault.len(),
+            "no new line at the end",
+        ));
+    }
+
+    Ok(())
+}
+
+// the arguments of a stanza after the arrow
+fn check_stanza(vault: &str, start: usize, stanza: &str, strict: bool) -> Result<()> {
+    let at = |offset: usize, message: &str| error(vault.as_bytes(), start + offset, message);
+
+    if !stanza.starts_with(char::is_whitespace) {
+        return Err(at(0, "expected a space after the arrow"));
+    }
+
+    let tokens = tokens(stanza);
+
+    if strict {
+        // tokens separated by a single space
+        let mut expected = 1;
+        for (offset, token) in &tokens {
+            if *offset != expected || !stanza[..*offset].ends_with(' ') {
+                return Err(at(offset - 1, "expected a single space"));
+            }
+            expected = offset + token.len() + 1;
+        }
+    }
+
+    let mut tokens = tokens.into_iter();
+
+    let (offset, tag) = tokens
+        .next()
+        .ok_or_else(|| at(stanza.len(), "the stanza has no key type"))?;
+    let (fingerprint_offset, fingerprint) = tokens
+        .next()
+        .ok_or_else(|| at(stanza.len(), "the stanza has no fingerprint"))?;
+
+    let args = tokens
+        .map(|(offset, arg)| base64(vault, start + offset, arg))
+        .collect::<Result<Vec<_>>>()?;
+
+    if !strict {
+        return Ok(());
+    }
+
+    let sha256 = fingerprint
+        .strip_prefix("SHA256:")
+        .filter(|hash| {
+            !hash.is_empty()
+                && hash
+                    .chars()
+                    .all(|c| c.is_ascii_alphanumeric() || c == '+' || c == '/')
+        })
+        .is_some();
+
+    if !sha256 {
+        return Err(at(fingerprint_offset, "expected a SHA256 fingerprint"));
+    }
+
+    let valid = match tag {
+        ssh::ed25519::STANZA => args.len() == 2 && args[0].len() == 32 && !args[1].is_empty(),
+        ssh::rsa::STANZA => args.len() == 1 && !args[0].is_empty(),
+        _ => return Err(at(offset, &format!("unknown key type {tag}"))),
+    };
+
+    if !valid {
+        return Err(at(offset, &format!("invalid arguments for {tag}")));
+    }
+
+    Ok(())
+}
+
+// SSH-VAULT;AES256;<fingerprint>\n<password>;<data>
+// SSH-VAULT;CHACHA20-POLY1305;<fingerprint>;<epk>;<password>;<data>
+fn check_legacy(vault: &str, strict: bool) -> Result<()> {
+    let lines = lines(vault);
+
+    if strict {
+        for line in &lines {
+            if line_text(vault, line, strict)?.is_empty() {
+                return Err(error(vault.as_bytes(), line.start, "blank line"));
+            }
+        }
+    }
+
+    // fields and their position
+    let mut fields = Vec::new();
+    let mut start = 0;
+    for field in vault.split(';') {
+        fields.push((start, field));
+        start += field.len() + 1;
+    }
+
+    if fields[0].1 != LEGACY_MAGIC {
+        return Err(error(
+            vault.as_bytes(),
+            0,
+            "expected SSH-VAULT;V2, SSH-VAULT;AES256 or SSH-VAULT;CHACHA20-POLY1305",
+        ));
+    }
+
+    let (algorithm_start, algorithm) = fields.get(1).copied().unwrap_or((vault.len(), ""));
+
+    let expected = match algorithm {
+        "AES256" => 4,
+        "CHACHA20-POLY1305" => 6,
+        _ => {
+            return Err(error(
+                vault.as_bytes(),
+                algorithm_start,
+                "expected the algorithm AES256 or CHACHA20-POLY1305",
+            ))
+        }
+    };
+
+    if fields.len() < expected {
+        return Err(error(
+            vault.as_bytes(),
+            vault.len(),
+            &format!(
+                "expected {expected} fields separated by ';', found {}",
+                fields.len()
+            ),
+        ));
+    }
+
+    if fields.len() > expected {
+        return Err(error(
+            vault.as_bytes(),
+            fields[expected].0 - 1,
+            &format!(
+                "expected {expected} fields separated by ';', found {}",
+                fields.len()
+            ),
+        ));
+    }
+
+    if algorithm == "AES256" {
+        let (start, field) = fields[2];
+        let fingerprint = field.lines().next().unwrap_or_default();
+
+        if fingerprint.trim().is_empty() || fingerprint.len() == field.len() {
+            return Err(error(
+                vault.as_bytes(),
+                start,
+                "expected the fingerprint followed by a new line",
+            ));
+        }
+
+        let password_start = start + fingerprint.len();
+        let password = base64(vault, password_start, &field[fingerprint.len()..])?;
+        let data = base64(vault, fields[3].0, fields[3].1)?;
+
+        if strict {
+            check_columns(vault, &lines[1..])?;
+
+            if password.is_empty() || data.is_empty() {
+                return Err(error(vault.as_bytes(), password_start, "empty payload"));
+            }
+        }
+    } else {
+        let (start, fingerprint) = fields[2];
+        let epk = base64(vault, fields[3].0, fields[3].1)?;
+        let password = base64(vault, fields[4].0, fields[4].1)?;
+        let data = base64(vault, fields[5].0, fields[5].1)?;
+
+        if strict {
+            check_columns(vault, &lines)?;
+
+            if !fingerprint.replace('\n', "").starts_with("SHA256:") {
+                return Err(error(
+                    vault.as_bytes(),
+                    start,
+                    "expected a SHA256 fingerprint",
+                ));
+            }
+
+            if epk.len() != 32 {
+                return Err(error(
+                    vault.as_bytes(),
+                    fields[3].0,
+                    "the ephemeral public key must be 32 bytes",
+                ));
+            }
+
+            if password.is_empty() || data.is_empty() {
+                return Err(error(vault.as_bytes(), fields[4].0, "empty payload"));
+            }
+        }
+    }
+
+    Ok(())
+}
+
+// all the lines but the last one are as wide as the columns
+fn check_columns(vault: &str, lines: &[Line]) -> Result<()> {
+    for (i, line) in lines.iter().enumerate() {
+        let last = i + 1 == lines.len();
+
+        if line.text.len() > COLUMNS || (!last && line.text.len() != COLUMNS) {
+            return Err(error(
+                vault.as_bytes(),
+                line.start + line.text.len().min(COLUMNS),
+                &format!("the lines must be {COLUMNS} columns wide"),
+            ));
+        }
+    }
+
+    Ok(())
+}
+
+// decode a base64 field that can span several lines, tells where the first
+// character out of the alphabet is
+fn base64(vault: &str, start: usize, field: &str) -> Result<Vec<u8>> {
+    let mut encoded = String::with_capacity(field.len());
+
+    for (offset, c) in field.char_indices() {
+        match c {
+            'A'..='Z' | 'a'..='z' | '0'..='9' | '+' | '/' | '=' => encoded.push(c),
+            '\n' => {}
+            '\r' if field[offset + 1..].starts_with('\n') => {}
+            _ => {
+                return Err(error(
+                    vault.as_bytes(),
+                    start + offset,
+                    &format!("invalid base64 character {c:?}"),
+                ))
+            }
+        }
+    }
+
+    Base64::decode_vec(&encoded)
+        .map_err(|_| error(vault.as_bytes(), start, "invalid base64 length or padding"))
+}
+
+// the text of the line, in strict mode CRLF and trailing spaces are rejected,
+// otherwise they are trimmed like the parsers do
+fn line_text<'a>(vault: &str, line: &Line<'a>, strict: bool) -> Result<&'a str> {
+    let text = line.text.trim_end();
+
+    if strict && text.len() != line.text.len() {
+        let message = if line.text.ends_with('\r') {
+            "CRLF line ending"
+        } else {
+            "trailing whitespace"
+        };
+
+        return Err(error(vault.as_bytes(), line.start + text.len(), message));
+    }
+
+    Ok(text)
+}
+
+fn lines(vault: &str) -> Vec<Line<'_>> {
+    let mut lines = Vec::new();
+    let mut start = 0;
+
+    for text in vault.split_inclusive('\n') {
+        lines.push(Line {
+            start,
+            text: text.strip_suffix('\n').unwrap_or(text),
+        });
+        start += text.len();
+    }
+
+    lines
+}
+
+// tokens separated by whitespace and their offset
+fn tokens(text: &str) -> Vec<(usize, &str)> {
+    let mut tokens = Vec::new();
+    let mut start = None;
+
+    for (offset, c) in text.char_indices() {
+        match (c.is_whitespace(), start) {
+            (true, Some(s)) => {
+                tokens.push((s, &text[s..offset]));
+                start = None;
+            }
+            (false, None) => start = Some(offset),
+            _ => {}
+        }
+    }
+
+    if let Some(s) = start {
+        tokens.push((s, &text[s..]));
+    }
+
+    tokens
+}
+
+// the position of the byte as line and column, counting from 1
+fn error(vault: &[u8], offset: usize, message: &str) -> anyhow::Error {
+    let offset = offset.min(vault.len());
+    let before = &vault[..offset];
+    let line = before.iter().filter(|&&b| b == b'\n').count() + 1;
+    let column = offset
+        - before
+            .iter()
+            .rposition(|&b| b == b'\n')
+            .map_or(0, |i| i + 1)
+        + 1;
+
+    Failure::Corrupt.error(format!(
+        "Not a valid SSH-VAULT file, line {line} column {column} (byte {}): {message}",
+        offset + 1
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{
+        crypto, parse, ssh::ed25519::Ed25519Vault, stream, stream::ArmorReader, stream::Header,
+        SshKeyType, SshVault, Vault,
+    };
+    use ssh_key::PublicKey;
+    use std::{io::Read, path::Path};
+
+    fn public_key() -> PublicKey {
+        PublicKey::read_openssh_file(Path::new("test_data/ed25519.pub")).unwrap()
+    }
+
+    fn stream_vault() -> String {
+        let vault = SshVault::new(&SshKeyType::Ed25519, Some(public_key()), None).unwrap();
+        let mut out = Vec::new();
+        stream::encrypt(&[vault], vec![7; 100].as_slice(), &mut out).unwrap();
+        String::from_utf8(out).unwrap()
+    }
+
+    fn legacy_vault() -> String {
+        let vault = Ed25519Vault::new(Some(public_key()), None).unwrap();
+        let mut secret = b"secret".to_vec();
+        vault
+            .create(crypto::gen_password().unwrap(), &mut secret)
+            .unwrap()
+    }
+
+    // what the parsers read, the payload is only decoded
+    fn read(vault: &[u8]) -> Result<()> {
+        if vault.starts_with(MAGIC.as_bytes()) {
+            let mut reader = vault;
+            Header::read(&mut reader)?;
+            ArmorReader::new(reader).read_to_end(&mut Vec::new())?;
+        } else {
+            parse(std::str::from_utf8(vault)?)?;
+        }
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_check() {
+        for vault in [stream_vault(), legacy_vault()] {
+            assert!(check(vault.as_bytes(), false).is_ok());
+            assert!(check(vault.as_bytes(), true).is_ok());
+
+            // the parsers accept CRLF line endings
+            let crlf = vault.replace('\n', "\r\n");
+            assert!(check(crlf.as_bytes(), false).is_ok());
+            assert!(read(crlf.as_bytes()).is_ok());
+
+            let e = check(crlf.as_bytes(), true).unwrap_err().to_string();
+            assert!(e.contains("line 1 column"), "{e}");
+            assert!(e.ends_with("CRLF line ending"), "{e}");
+        }
+    }
+
+    #[test]
+    fn test_check_stream() {
+        let vault = stream_vault();
+        let lines: Vec<&str> = vault.lines().collect();
+
+        // invalid base64 in the stanza
+        let bad = vault.replacen(' ', " *", 3);
+        let e = check(bad.as_bytes(), false).unwrap_err().to_string();
+        assert!(
+            e.starts_with("Not a valid SSH-VAULT file, line 2 column"),
+            "{e}"
+        );
+        assert!(e.ends_with("invalid base64 character '*'"), "{e}");
+
+        // no end of the header
+        let e = check(lines[..2].join("\n").as_bytes(), false)
+            .unwrap_err()
+            .to_string();
+        assert!(e.ends_with("the header has no end (---)"), "{e}");
+
+        // a single share
+        let share = vault.replacen("->", "=>", 1);
+        let e = check(share.as_bytes(), false).unwrap_err().to_string();
+        assert!(
+            e.ends_with("a share of the dual control has no pair"),
+            "{e}"
+        );
+
+        // no payload
+        let e = check(lines[..4].join("\n").as_bytes(), false)
+            .unwrap_err()
+            .to_string();
+        assert!(e.ends_with("the payload is truncated"), "{e}");
+
+        // the payload cipher
+        let aes = vault.replacen("\n---", "\n+> cipher AES-256-GCM\n---", 1);
+        assert!(check(aes.as_bytes(), true).is_ok());
+        let e = check(aes.replacen("AES-256-GCM", "DES", 1).as_bytes(), false)
+            .unwrap_err()
+            .to_string();
+        assert!(e.ends_with("Unsupported cipher: DES"), "{e}");
+
+        // the expiry is not checked without the vault key, expired or not
+        let expired = vault.replacen("\n---", "\n+> expires dGFn 1700000000\n---", 1);
+        assert!(check(expired.as_bytes(), true).is_ok());
+        assert!(check(expired.replacen(" 1700000000", "", 1).as_bytes(), false).is_err());
+
+        // the mac of the header
+        let mac = lines[2].strip_prefix("+> mac ").unwrap();
+        let e = check(vault.replacen(mac, "dGFn", 1).as_bytes(), false)
+            .unwrap_err()
+            .to_string();
+        assert!(e.contains("line 3 column 8"), "{e}");
+        assert!(e.ends_with("the mac must be 32 bytes"), "{e}");
+
+        // invalid character in the payload, line 6 column 10
+        let mut bad = lines.clone();
+        let line = format!("{}!{}", &lines[5][..9], &lines[5][10..]);
+        bad[5] = &line;
+        let e = check(bad.join("\n").as_bytes(), false)
+            .unwrap_err()
+            .to_string();
+        assert!(e.contains("line 6 column 10"), "{e}");
+
+        // tolerated unless strict
+        for (tolerated, message) in [
+            (vault.replacen("-> ", "->  ", 1), "expected a single space"),
+            (
+                vault.replacen("X25519", "ED448", 1),
+                "unknown key type ED448",
+            ),
+            (format!("{vault}\n"), "columns wide"),
+            (vault.trim_end().to_string(), "no new line at the end"),
+        ] {
+            assert!(check(tolerated.as_bytes(), false).is_ok(), "{message}");
+            assert!(read(tolerated.as_bytes()).is_ok(), "{message}");
+
+            let e = check(tolerated.as_bytes(), true).unwrap_err().to_string();
+            assert!(e.ends_with(message), "{e}");
+        }
+    }
+
+    #[test]
+    fn test_check_legacy() {
+        let vault = legacy_vault();
+
+        for (bad, message) in [
+            ("", "line 1 column 1 (byte 1): expected SSH-VAULT;V2"),
+            (
+                "SSH-VAULT",
+                "line 1 column 10 (byte 10): expected the algorithm",
+            ),
+            (
+                "SSH-VAULT;AES128;x",
+                "column 11 (byte 11): expected the algorithm",
+            ),
+            (
+                "SSH-VAULT;AES256;fingerprint",
+                "expected 4 fields separated by ';', found 3",
+            ),
+            (
+                "SSH-VAULT;AES256;;0",
+                "expected the fingerprint followed by a new line",
+            ),
+            (
+                "SSH-VAULT;AES256;fp\nAAAA;AA-A",
+                "line 2 column 8 (byte 28): invalid base64",
+            ),
+            (
+                "SSH-VAULT;AES256;fp\nAAAA;AAA",
+                "line 2 column 6 (byte 26): invalid base64 length",
+            ),
+            (
+                "SSH-VAULT;AES256;fp\nAAAA;AAAA;",
+                "line 2 column 10 (byte 30): expected 4 fields",
+            ),
+        ] {
+            let e = check(bad.as_bytes(), false).unwrap_err().to_string();
+            assert!(e.contains(message), "{bad}: {e}");
+            assert!(parse(bad).is_err());
+        }
+
+        let e = check(&[b'S', 0xff], false).unwrap_err().to_string();
+        assert!(e.ends_with("column 2 (byte 2): invalid UTF-8"), "{e}");
+
+        // the lines of the legacy format are 64 columns wide
+        let wide = vault.replacen('\n', "", 1);
+        assert!(check(wide.as_bytes(), false).is_ok());
+        let e = check(wide.as_bytes(), true).unwrap_err().to_string();
+        assert!(e.ends_with("the lines must be 64 columns wide"), "{e}");
+    }
+
+    // random mutations of valid vaults never make the checks or the parsers
+    // panic, and what the strict mode accepts the parsers can read
+    #[test]
+    fn test_fuzz() {
+        let mut seed: u64 = 0x2545_f491_4f6c_dd1d;
+        let mut next = |n: usize| {
+            // xorshift
+            seed ^= seed << 13;
+            seed ^= seed >> 7;
+            seed ^= seed << 17;
+            usize::try_from(seed % n.max(1) as u64).unwrap()
+        };
+
+        for vault in [stream_vault(), legacy_vault()] {
+            for _ in 0..2000 {
+                let mut data = vault.clone().into_bytes();
+
+                for _ in 0..=next(3) {
+                    let i = next(data.len());
+                    match next(4) {
+                        0 => data[i] = u8::try_from(next(256)).unwrap(),
+                        1 => data.truncate(i),
+                        2 => data.insert(i, b"\n\r ;=->"[next(7)]),
+                        _ => {
+                            data.remove(i);
+                        }
+                    }
+
+                    if data.is_empty() {
+                        break;
+                    }
+                }
+
+                let strict = check(&data, true);
+                let lenient = check(&data, false);
+                let read = read(&data);
+
+                if strict.is_ok() {
+                    assert!(lenient.is_ok());
+                    assert!(read.is_ok(), "{}", String::from_utf8_lossy(&data));
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,187 @@
+// Values of a dotenv file, the names, the comments, the blank lines and the
+// line endings stay as they are and the header is kept in comments so the file
+// can still be loaded:
+//
+//  DB_USER=ENC[SSH-VAULT,<nonce and ciphertext in base64>]
+//  # ssh-vault: -> X25519 SHA256:<fingerprint> <ephemeral public key> <encrypted key>
+//
+// The value is encrypted with its quotes, the inline comment after it is kept
+// readable, empty values are not encrypted
+
+use super::{eol, lines, Format};
+use crate::vault::{
+    crypto::chunk::Cipher,
+    dotenv,
+    metadata::Metadata,
+    stream::{Header, Stanza},
+};
+use anyhow::{anyhow, Result};
+
+/// Start of the comments with the header of the file
+pub const HEADER_PREFIX: &str = "# ssh-vault: ";
+
+pub struct Dotenv;
+
+impl Format for Dotenv {
+    fn map_values(
+        &self,
+        doc: &str,
+        f: &mut dyn FnMut(&str, &str) -> Result<String>,
+    ) -> Result<String> {
+        let mut output = String::with_capacity(doc.len());
+
+        for (n, (line, end)) in lines(doc).enumerate() {
+            let trimmed = line.trim();
+
+            if trimmed.is_empty() || trimmed.starts_with('#') {
+                output.push_str(line);
+                output.push_str(end);
+                continue;
+            }
+
+            let (name, value) = line
+                .split_once('=')
+                .ok_or_else(|| anyhow!("Line {}: expected KEY=VALUE", n + 1))?;
+
+            let key = name.trim();
+            let key = key.strip_prefix("export ").unwrap_or(key).trim();
+
+            if !dotenv::is_valid_key(key) {
+                return Err(anyhow!("Line {}: invalid variable name {key:?}", n + 1));
+            }
+
+            let spaces = &value[..value.len() - value.trim_start().len()];
+            let (raw, rest) = dotenv::split_comment(value.trim_start());
+
+            output.push_str(name);
+            output.push('=');
+            output.push_str(spaces);
+
+            if !raw.is_empty() {
+                output.push_str(&f(key, raw)?);
+            }
+
+            output.push_str(rest);
+            output.push_str(end);
+        }
+
+        Ok(output)
+    }
+
+    fn split_header(&self, doc: &str) -> Result<(String, Option<Header>)> {
+        let mut body = String::with_capacity(doc.len());
+        let mut stanzas = Vec::new();
+
+        for (line, end) in lines(doc) {
+            match line.strip_prefix(HEADER_PREFIX) {
+                Some(stanza) => stanzas.push(Stanza::parse(stanza)?),
+                None => {
+                    body.push_str(line);
+                    body.push_str(end);
+                }
+            }
+        }
+
+        if stanzas.is_empty() {
+            return Ok((body, None));
+        }
+
+        Ok((
+            body,
+            Some(Header {
+                stanzas,
+                shares: Vec::new(),
+                cipher: Cipher::default(),
+                metadata: Metadata::default(),
+                label: None,
+                edited: None,
+                expires: None,
+                mac: None,
+            }),
+        ))
+    }
+
+    fn join_header(&self, body: &str, header: &Header) -> String {
+        let eol = eol(body);
+        let mut doc = String::from(body);
+
+        if !doc.is_empty() && !doc.ends_with('\n') {
+            doc.push_str(eol);
+        }
+
+        for stanza in &header.stanzas {
+            doc.push_str(&format!("{HEADER_PREFIX}{stanza}{eol}"));
+        }
+
+        doc
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, values, SshKeyType, SshVault};
+    use regex::RegexSet;
+    use ssh_key::PrivateKey;
+    use std::path::Path;
+
+    const DOC: &str =
+        "# database\nDB_USER=app\nexport DB_PASSWORD=\"s3cr3t value\"\n\nTOKEN='a=b'\nEMPTY=\n";
+
+    #[test]
+    fn test_encrypt_decrypt() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+        let key = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let encrypted =
+            values::encrypt(&Dotenv, DOC, &[recipient], None, &RegexSet::empty()).unwrap();
+
+        assert!(encrypted.starts_with("# database\nDB_USER=ENC[SSH-VAULT,"));
+        assert!(encrypted.contains("\nexport DB_PASSWORD=ENC[SSH-VAULT,"));
+        assert!(encrypted.contains("\nEMPTY=\n# ssh-vault: -> X25519 SHA256:"));
+        assert!(!encrypted.contains("s3cr3t"));
+
+        // the file can still be parsed
+        let vars = dotenv::parse(&encrypted).unwrap();
+        assert_eq!(vars.len(), 4);
+
+        assert_eq!(values::decrypt(&Dotenv, &encrypted, &key).unwrap(), DOC);
+
+        // values can't be moved to other names
+        let moved = encrypted.replacen("DB_USER=", "DB_LOGIN=", 1);
+        assert!(values::decrypt(&Dotenv, &moved, &key).is_err());
+
+        assert!(Dotenv
+            .map_values("1KEY=value\n", &mut |_, v| Ok(v.to_string()))
+            .is_err());
+    }
+
+    #[test]
+    fn test_round_trip() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+        let key = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let doc =
+            "# app\r\nDB_USER=app   # rotated monthly\r\n\r\nEMPTY= # unset\r\nTOKEN='a=b'  \r\n";
+
+        let encrypted =
+            values::encrypt(&Dotenv, doc, &[recipient], None, &RegexSet::empty()).unwrap();
+
+        assert!(encrypted.contains("]   # rotated monthly\r\n\r\nEMPTY= # unset\r\n"));
+        assert!(encrypted.ends_with("\r\n"));
+        assert!(!encrypted.replace("\r\n", "").contains('\n'));
+
+        assert_eq!(values::decrypt(&Dotenv, &encrypted, &key).unwrap(), doc);
+
+        // the header stays where it is when adding values
+        let (body, _) = Dotenv.split_header(&encrypted).unwrap();
+        let moved = format!("{}{body}NEW=value\r\n", &encrypted[body.len()..]);
+        let added = values::encrypt(&Dotenv, &moved, &[], Some(&key), &RegexSet::empty()).unwrap();
+        assert!(added.starts_with(HEADER_PREFIX));
+        assert!(!added.contains("NEW=value"));
+    }
+}
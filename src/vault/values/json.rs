@@ -0,0 +1,507 @@
+// Values of a JSON document, only the scalars are replaced so the keys, the
+// order and the layout of the document stay as they are:
+//
+//  {
+//    "db": {
+//      "user": "admin",
+//      "password": "ENC[SSH-VAULT,<nonce and ciphertext in base64>]"
+//    },
+//    "ssh_vault": [
+//      "-> X25519 SHA256:<fingerprint> <ephemeral public key> <encrypted key>"
+//    ]
+//  }
+//
+// The encrypted value is the JSON text of the scalar, so strings, numbers,
+// booleans and null keep their type once decrypted
+
+use super::{is_encrypted, Format};
+use crate::vault::{
+    crypto::chunk::Cipher,
+    metadata::Metadata,
+    stream::{Header, Stanza},
+};
+use anyhow::{anyhow, Result};
+use std::ops::Range;
+
+/// Top level key with the header of the document
+pub const HEADER_KEY: &str = "ssh_vault";
+
+// nested objects and arrays
+const MAX_DEPTH: usize = 128;
+
+pub struct Json;
+
+// called with the path and the span of every scalar
+type Visit<'v> = dyn FnMut(&[String], Range<usize>) -> Result<()> + 'v;
+
+// member of the top level object
+struct Member {
+    key: String,
+    // from the key to the end of the value
+    span: Range<usize>,
+    value: usize,
+    // end of the previous member, to remove the comma between them
+    previous: Option<usize>,
+    // start of the next member
+    next: Option<usize>,
+}
+
+struct Scanner<'a> {
+    doc: &'a str,
+    pos: usize,
+    members: Vec<Member>,
+}
+
+impl<'a> Scanner<'a> {
+    const fn new(doc: &'a str) -> Self {
+        Self {
+            doc,
+            pos: 0,
+            members: Vec::new(),
+        }
+    }
+
+    fn peek(&self) -> Option<u8> {
+        self.doc.as_bytes().get(self.pos).copied()
+    }
+
+    fn ws(&mut self) {
+        while matches!(self.peek(), Some(b' ' | b'\t' | b'\n' | b'\r')) {
+            self.pos += 1;
+        }
+    }
+
+    fn expect(&mut self, byte: u8) -> Result<()> {
+        self.ws();
+
+        if self.peek() != Some(byte) {
+            return Err(self.invalid());
+        }
+
+        self.pos += 1;
+        Ok(())
+    }
+
+    fn invalid(&self) -> anyhow::Error {
+        anyhow!("Invalid JSON at byte {}", self.pos)
+    }
+
+    fn string(&mut self) -> Result<Range<usize>> {
+        let start = self.pos;
+        self.expect(b'"')?;
+
+        loop {
+            match self.peek() {
+                Some(b'"') => {
+                    self.pos += 1;
+                    return Ok(start..self.pos);
+                }
+                Some(b'\\') => self.pos += 2,
+                Some(_) => self.pos += 1,
+                None => return Err(self.invalid()),
+            }
+        }
+    }
+
+    // numbers, true, false and null
+    fn literal(&mut self) -> Result<Range<usize>> {
+        let start = self.pos;
+
+        while matches!(
+            self.peek(),
+            Some(b'0'..=b'9' | b'a'..=b'z' | b'E' | b'+' | b'-' | b'.')
+        ) {
+            self.pos += 1;
+        }
+
+        let literal = &self.doc[start..self.pos];
+
+        if literal.is_empty()
+            || (!matches!(literal, "true" | "false" | "null")
+                && serde_json::from_str::<serde_json::Number>(literal).is_err())
+        {
+            return Err(self.invalid());
+        }
+
+        Ok(start..self.pos)
+    }
+
+    fn value(&mut self, path: &mut Vec<String>, visit: &mut Visit<'_>) -> Result<()> {
+        if path.len() > MAX_DEPTH {
+            return Err(anyhow!("JSON nested too deep"));
+        }
+
+        self.ws();
+
+        match self.peek() {
+            Some(b'{') => self.object(path, visit),
+            Some(b'[') => self.array(path, visit),
+            Some(b'"') => {
+                let span = self.string()?;
+                visit(path, span)
+            }
+            _ => {
+                let span = self.literal()?;
+                visit(path, span)
+            }
+        }
+    }
+
+    fn object(&mut self, path: &mut Vec<String>, visit: &mut Visit<'_>) -> Result<()> {
+        let top = path.is_empty();
+        self.expect(b'{')?;
+        self.ws();
+
+        if self.peek() == Some(b'}') {
+            self.pos += 1;
+            return Ok(());
+        }
+
+        let mut previous = None;
+
+        loop {
+            self.ws();
+            let key_span = self.string()?;
+            let key: String = serde_json::from_str(&self.doc[key_span.clone()])?;
+            self.expect(b':')?;
+            let value = self.pos;
+
+            path.push(key.clone());
+            self.value(path, visit)?;
+            path.pop();
+
+            if top {
+                if let Some(member) = self.members.last_mut() {
+                    member.next = Some(key_span.start);
+                }
+
+                self.members.push(Member {
+                    key,
+                    span: key_span.start..self.pos,
+                    value,
+                    previous,
+                    next: None,
+                });
+            }
+            previous = Some(self.pos);
+
+            self.ws();
+            match self.peek() {
+                Some(b',') => self.pos += 1,
+                Some(b'}') => {
+                    self.pos += 1;
+                    return Ok(());
+                }
+                _ => return Err(self.invalid()),
+            }
+        }
+    }
+
+    fn array(&mut self, path: &mut Vec<String>, visit: &mut Visit<'_>) -> Result<()> {
+        self.expect(b'[')?;
+        self.ws();
+
+        if self.peek() == Some(b']') {
+            self.pos += 1;
+            return Ok(());
+        }
+
+        loop {
+            path.push(String::from("[]"));
+            self.value(path, visit)?;
+            path.pop();
+
+            self.ws();
+            match self.peek() {
+                Some(b',') => self.pos += 1,
+                Some(b']') => {
+                    self.pos += 1;
+                    return Ok(());
+                }
+                _ => return Err(self.invalid()),
+            }
+        }
+    }
+
+    // the whole document must be a single object
+    fn document(&mut self, visit: &mut Visit<'_>) -> Result<()> {
+        self.ws();
+
+        if self.peek() != Some(b'{') {
+            return Err(anyhow!("The JSON document must be an object"));
+        }
+
+        self.value(&mut Vec::new(), visit)?;
+        self.ws();
+
+        if self.pos != self.doc.len() {
+            return Err(self.invalid());
+        }
+
+        Ok(())
+    }
+}
+
+impl Format for Json {
+    fn map_values(
+        &self,
+        doc: &str,
+        f: &mut dyn FnMut(&str, &str) -> Result<String>,
+    ) -> Result<String> {
+        let mut output = String::with_capacity(doc.len());
+        let mut last = 0;
+
+        Scanner::new(doc).document(&mut |path, span| {
+            let raw = &doc[span.clone()];
+
+            // encrypted values are stored as strings
+            let value = match raw.strip_prefix('"').and_then(|raw| raw.strip_suffix('"')) {
+                Some(inner) if is_encrypted(inner) => inner,
+                _ => raw,
+            };
+
+            let value = f(&path.join("."), value)?;
+
+            output.push_str(&doc[last..span.start]);
+            if is_encrypted(&value) {
+                output.push('"');
+                output.push_str(&value);
+                output.push('"');
+            } else {
+                output.push_str(&value);
+            }
+            last = span.end;
+
+            Ok(())
+        })?;
+
+        output.push_str(&doc[last..]);
+
+        Ok(output)
+    }
+
+    fn split_header(&self, doc: &str) -> Result<(String, Option<Header>)> {
+        let mut scanner = Scanner::new(doc);
+        scanner.document(&mut |_, _| Ok(()))?;
+
+        let Some(member) = scanner
+            .members
+            .iter()
+            .find(|member| member.key == HEADER_KEY)
+        else {
+            return Ok((doc.to_string(), None));
+        };
+
+        let value: serde_json::Value = serde_json::from_str(&doc[member.value..member.span.end])?;
+
+        let stanzas = value
+            .as_array()
+            .filter(|stanzas| !stanzas.is_empty())
+            .ok_or_else(|| anyhow!("Invalid {HEADER_KEY} header, no recipients found"))?
+            .iter()
+            .map(|stanza| {
+                stanza
+                    .as_str()
+                    .ok_or_else(|| anyhow!("Invalid {HEADER_KEY} header"))
+                    .and_then(Stanza::parse)
+            })
+            .collect::<Result<Vec<_>>>()?;
+
+        // remove the member and the comma that separates it from the others
+        let range = match (member.previous, member.next) {
+            (Some(previous), _) => previous..member.span.end,
+            (None, Some(next)) => member.span.start..next,
+            (None, None) => member.span.clone(),
+        };
+
+        let mut body = String::with_capacity(doc.len());
+        body.push_str(&doc[..range.start]);
+        body.push_str(&doc[range.end..]);
+
+        Ok((
+            body,
+            Some(Header {
+                stanzas,
+                shares: Vec::new(),
+                cipher: Cipher::default(),
+                metadata: Metadata::default(),
+                label: None,
+                edited: None,
+                expires: None,
+                mac: None,
+            }),
+        ))
+    }
+
+    fn join_header(&self, body: &str, header: &Header) -> String {
+        let end = body.rfind('}').unwrap_or(body.len());
+        let content = body[..end].trim_end();
+        let empty = content.ends_with('{');
+
+        // same indentation as the first member
+        let indent = body
+            .lines()
+            .nth(1)
+            .map(|line| &line[..line.len() - line.trim_start().len()])
+            .filter(|indent| !indent.is_empty())
+            .unwrap_or("  ");
+
+        let mut doc = String::from(content);
+        if !empty {
+            doc.push(',');
+        }
+
+        doc.push_str(&format!("\n{indent}\"{HEADER_KEY}\": ["));
+        for (i, stanza) in header.stanzas.iter().enumerate() {
+            if i > 0 {
+                doc.push(',');
+            }
+            doc.push_str(&format!("\n{indent}{indent}\"{stanza}\""));
+        }
+        doc.push_str(&format!("\n{indent}]"));
+
+        if empty {
+            doc.push('\n');
+        }
+
+        doc.push_str(&body[content.len()..]);
+
+        doc
+    }
+
+    fn is_header(&self, path: &str) -> bool {
+        path.strip_prefix(HEADER_KEY)
+            .is_some_and(|rest| rest.is_empty() || rest.starts_with('.'))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, values, SshKeyType, SshVault};
+    use regex::RegexSet;
+    use ssh_key::PrivateKey;
+    use std::path::Path;
+
+    const DOC: &str = r#"{
+  "db": {
+    "user": "admin",
+    "password": "s3cr3t \"quoted\"",
+    "port": 5432,
+    "tls": true
+  },
+  "hosts": ["10.0.0.1", null],
+  "api_token": "t0ken"
+}
+"#;
+
+    #[test]
+    fn test_map_values() {
+        let mut paths = Vec::new();
+        let doc = Json
+            .map_values(DOC, &mut |path, value| {
+                paths.push(format!("{path}={value}"));
+                Ok(value.to_string())
+            })
+            .unwrap();
+
+        assert_eq!(doc, DOC);
+        assert_eq!(
+            paths,
+            vec![
+                "db.user=\"admin\"",
+                "db.password=\"s3cr3t \\\"quoted\\\"\"",
+                "db.port=5432",
+                "db.tls=true",
+                "hosts.[]=\"10.0.0.1\"",
+                "hosts.[]=null",
+                "api_token=\"t0ken\"",
+            ]
+        );
+
+        assert!(Json
+            .map_values("[1, 2]", &mut |_, v| Ok(v.to_string()))
+            .is_err());
+        assert!(Json
+            .map_values("{\"a\": 1", &mut |_, v| Ok(v.to_string()))
+            .is_err());
+        assert!(Json
+            .map_values("{\"a\": tru}", &mut |_, v| Ok(v.to_string()))
+            .is_err());
+    }
+
+    #[test]
+    fn test_encrypt_decrypt() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+        let key = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let select = RegexSet::new(["password", "token"]).unwrap();
+        let encrypted = values::encrypt(&Json, DOC, &[recipient], None, &select).unwrap();
+
+        // still valid JSON, only the selected fields are encrypted
+        let value: serde_json::Value = serde_json::from_str(&encrypted).unwrap();
+        assert_eq!(value["db"]["user"], "admin");
+        assert_eq!(value["db"]["port"], 5432);
+        assert!(value["db"]["password"]
+            .as_str()
+            .unwrap()
+            .starts_with(values::PREFIX));
+        assert!(value["api_token"]
+            .as_str()
+            .unwrap()
+            .starts_with(values::PREFIX));
+        assert_eq!(value[HEADER_KEY].as_array().unwrap().len(), 1);
+        assert!(!encrypted.contains("s3cr3t"));
+
+        assert_eq!(values::decrypt(&Json, &encrypted, &key).unwrap(), DOC);
+
+        // without a selection all the values are encrypted
+        let all = values::encrypt(&Json, &encrypted, &[], Some(&key), &RegexSet::empty()).unwrap();
+        let value: serde_json::Value = serde_json::from_str(&all).unwrap();
+        assert!(value["db"]["port"]
+            .as_str()
+            .unwrap()
+            .starts_with(values::PREFIX));
+        assert_eq!(values::decrypt(&Json, &all, &key).unwrap(), DOC);
+    }
+
+    #[test]
+    fn test_header() {
+        let header = Header {
+            stanzas: vec![Stanza {
+                tag: String::from("X25519"),
+                fingerprint: String::from("SHA256:abc"),
+                args: vec![vec![1, 2, 3]],
+            }],
+            shares: Vec::new(),
+            cipher: Cipher::default(),
+            metadata: Metadata::default(),
+            label: None,
+            edited: None,
+            expires: None,
+            mac: None,
+        };
+
+        for doc in ["{}", "{\n    \"a\": 1\n}\n", "{\"a\": 1}"] {
+            let joined = Json.join_header(doc, &header);
+            serde_json::from_str::<serde_json::Value>(&joined).unwrap();
+
+            let (body, split) = Json.split_header(&joined).unwrap();
+            assert_eq!(split, Some(header.clone()));
+            assert_eq!(Json.split_header(&body).unwrap().1, None);
+        }
+
+        assert_eq!(
+            Json.join_header("{\n    \"a\": 1\n}\n", &header),
+            "{\n    \"a\": 1,\n    \"ssh_vault\": [\n        \"-> X25519 SHA256:abc AQID\"\n    ]\n}\n"
+        );
+
+        // the header is not the last member
+        let (body, _) = Json
+            .split_header("{\"ssh_vault\": [\"-> X25519 SHA256:abc AQID\"], \"a\": 1}")
+            .unwrap();
+        assert_eq!(body, "{\"a\": 1}");
+    }
+}
@@ -0,0 +1,299 @@
+pub mod dotenv;
+pub mod json;
+pub mod yaml;
+
+use crate::vault::{
+    crypto::{self, chacha20poly1305::ChaCha20Poly1305Crypto, chunk::Cipher, Crypto},
+    fips,
+    metadata::Metadata,
+    stream::{self, Header},
+    SshVault,
+};
+use anyhow::{anyhow, Result};
+use base64ct::{Base64, Encoding};
+use regex::RegexSet;
+use secrecy::{ExposeSecret, Secret};
+use std::path::Path;
+
+/// Start of an encrypted value, the value ends with `]`
+pub const PREFIX: &str = "ENC[SSH-VAULT,";
+
+// nonce of the encrypted values
+const NONCE_SIZE: usize = 12;
+
+/// Documents where only the values are encrypted, the keys, the structure and
+/// the comments stay readable
+pub trait Format {
+    /// Replace every value with the result of `f(path, value)`, the path of a
+    /// value is the dotted list of its keys
+    /// # Errors
+    /// Will return an error if the document is not valid or `f` fails
+    fn map_values(
+        &self,
+        doc: &str,
+        f: &mut dyn FnMut(&str, &str) -> Result<String>,
+    ) -> Result<String>;
+
+    /// Remove the header with the keys of the document
+    /// # Errors
+    /// Will return an error if the header is not valid
+    fn split_header(&self, doc: &str) -> Result<(String, Option<Header>)>;
+
+    /// Add the header with the keys of the document
+    fn join_header(&self, body: &str, header: &Header) -> String;
+
+    /// Check if the value at the path is part of the header, the values of the
+    /// header are left alone when adding values to the document
+    fn is_header(&self, _path: &str) -> bool {
+        false
+    }
+}
+
+/// Encrypts the values of a document, the path of the value is authenticated
+/// so values can't be moved to other keys
+pub struct ValueCipher {
+    cipher: ChaCha20Poly1305Crypto,
+}
+
+impl ValueCipher {
+    /// Create the cipher from the key of the document
+    /// # Errors
+    /// Will return an error if the key can't be derived or FIPS mode is enabled
+    pub fn new(key: &Secret<[u8; 32]>) -> Result<Self> {
+        // values are only encrypted with ChaCha20-Poly1305
+        fips::check_cipher(Cipher::ChaCha20Poly1305)?;
+
+        let key = crypto::hkdf(b"", b"values", key.expose_secret())?;
+
+        Ok(Self {
+            cipher: ChaCha20Poly1305Crypto::new(Secret::new(key)),
+        })
+    }
+
+    /// Encrypt a value
+    /// # Errors
+    /// Will return an error if the encryption fails
+    pub fn encrypt(&self, path: &str, value: &str) -> Result<String> {
+        let encrypted = self.cipher.encrypt(value.as_bytes(), path.as_bytes())?;
+
+        Ok(format!("{PREFIX}{}]", Base64::encode_string(&encrypted)))
+    }
+
+    /// Decrypt a value
+    /// # Errors
+    /// Will return an error if the value is not valid or was moved to another path
+    pub fn decrypt(&self, path: &str, value: &str) -> Result<String> {
+        let encrypted = value
+            .strip_prefix(PREFIX)
+            .and_then(|value| value.strip_suffix(']'))
+            .and_then(|value| Base64::decode_vec(value).ok())
+            .filter(|encrypted| encrypted.len() > NONCE_SIZE)
+            .ok_or_else(|| anyhow!("{path}: invalid encrypted value"))?;
+
+        let value = self
+            .cipher
+            .decrypt(&encrypted, path.as_bytes())
+            .map_err(|_| anyhow!("{path}: the value can't be decrypted"))?;
+
+        Ok(String::from_utf8(value)?)
+    }
+}
+
+/// Format by name, or by the extension of the path when there is no name
+/// # Errors
+/// Will return an error if the format is not supported
+pub fn format(name: Option<&str>, path: Option<&str>) -> Result<Box<dyn Format>> {
+    let name = match name {
+        Some(name) => name,
+        None => {
+            let path = path.map(Path::new);
+
+            // .env and .env.production
+            if path
+                .and_then(Path::file_name)
+                .and_then(|name| name.to_str())
+                .map_or(false, |name| name == ".env" || name.starts_with(".env."))
+            {
+                "dotenv"
+            } else {
+                path.and_then(Path::extension)
+                    .and_then(|extension| extension.to_str())
+                    .ok_or_else(|| anyhow!("Unknown format, use --format"))?
+            }
+        }
+    };
+
+    match name.to_lowercase().as_str() {
+        "dotenv" | "env" => Ok(Box::new(dotenv::Dotenv)),
+        "json" => Ok(Box::new(json::Json)),
+        "yaml" | "yml" => Ok(Box::new(yaml::Yaml)),
+        _ => Err(anyhow!("Unsupported format: {name}")),
+    }
+}
+
+/// Check if a value is encrypted
+#[must_use]
+pub fn is_encrypted(value: &str) -> bool {
+    value.starts_with(PREFIX) && value.ends_with(']')
+}
+
+/// Encrypt the values of a document that are not encrypted yet and whose path
+/// matches `select`, all of them if `select` is empty, `key` is required to add
+/// values to a document that already has a header
+/// # Errors
+/// Will return an error if the document is not valid or the key can't open it
+pub fn encrypt(
+    format: &dyn Format,
+    doc: &str,
+    recipients: &[SshVault],
+    key: Option<&SshVault>,
+    select: &RegexSet,
+) -> Result<String> {
+    let (body, header) = format.split_header(doc)?;
+
+    // values added to an encrypted document, the header stays where it is
+    if let Some(header) = header {
+        let key = key.ok_or_else(|| anyhow!("The document is already encrypted"))?;
+        let cipher = ValueCipher::new(&header.unwrap(key)?)?;
+
+        return format.map_values(doc, &mut |path, value| {
+            if format.is_header(path) {
+                Ok(value.to_string())
+            } else {
+                encrypt_value(&cipher, select, path, value)
+            }
+        });
+    }
+
+    let data_key = crypto::gen_password()?;
+    let header = Header {
+        stanzas: stream::wrap(recipients, &data_key)?,
+        shares: Vec::new(),
+        cipher: Cipher::default(),
+        metadata: Metadata::default(),
+        label: None,
+        edited: None,
+        expires: None,
+        mac: None,
+    };
+
+    let cipher = ValueCipher::new(&data_key)?;
+
+    let body = format.map_values(&body, &mut |path, value| {
+        encrypt_value(&cipher, select, path, value)
+    })?;
+
+    Ok(format.join_header(&body, &header))
+}
+
+fn encrypt_value(
+    cipher: &ValueCipher,
+    select: &RegexSet,
+    path: &str,
+    value: &str,
+) -> Result<String> {
+    if is_encrypted(value) || !(select.is_empty() || select.is_match(path)) {
+        Ok(value.to_string())
+    } else {
+        cipher.encrypt(path, value)
+    }
+}
+
+/// Decrypt the values of a document
+/// # Errors
+/// Will return an error if the document has no header or the key can't open it
+pub fn decrypt(format: &dyn Format, doc: &str, key: &SshVault) -> Result<String> {
+    let (body, header) = format.split_header(doc)?;
+
+    let header = header.ok_or_else(|| anyhow!("The document has no encrypted values"))?;
+
+    let cipher = ValueCipher::new(&header.unwrap(key)?)?;
+
+    format.map_values(&body, &mut |path, value| {
+        if is_encrypted(value) {
+            cipher.decrypt(path, value)
+        } else {
+            Ok(value.to_string())
+        }
+    })
+}
+
+// The lines of a document and their line ending, `\n`, `\r\n` or nothing for
+// the last line, so the document is written back with its own line endings
+fn lines(doc: &str) -> impl Iterator<Item = (&str, &str)> {
+    doc.split_inclusive('\n').map(|line| {
+        let content = line
+            .strip_suffix('\n')
+            .map_or(line, |line| line.strip_suffix('\r').unwrap_or(line));
+
+        line.split_at(content.len())
+    })
+}
+
+// line ending of the lines added to the document
+fn eol(doc: &str) -> &'static str {
+    if doc.contains("\r\n") {
+        "\r\n"
+    } else {
+        "\n"
+    }
+}
+
+/// Read only the header of a document, to find the key that can open it
+/// # Errors
+/// Will return an error if the document has no header
+pub fn header(format: &dyn Format, doc: &str) -> Result<Header> {
+    format
+        .split_header(doc)?
+        .1
+        .ok_or_else(|| anyhow!("The document has no encrypted values"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_value_cipher() {
+        let key = crypto::gen_password().unwrap();
+        let cipher = ValueCipher::new(&key).unwrap();
+
+        let encrypted = cipher.encrypt("db.password", "s3cr3t").unwrap();
+        assert!(is_encrypted(&encrypted));
+        assert!(!encrypted.contains("s3cr3t"));
+
+        assert_eq!(cipher.decrypt("db.password", &encrypted).unwrap(), "s3cr3t");
+
+        // the value was moved to another key
+        assert!(cipher.decrypt("db.user", &encrypted).is_err());
+        assert!(cipher
+            .decrypt("db.password", "ENC[SSH-VAULT,AAAA]")
+            .is_err());
+        assert!(!is_encrypted("s3cr3t"));
+    }
+
+    #[test]
+    fn test_lines() {
+        assert_eq!(
+            lines("a: 1\r\n\nb: 2").collect::<Vec<_>>(),
+            vec![("a: 1", "\r\n"), ("", "\n"), ("b: 2", "")]
+        );
+        assert_eq!(lines("").count(), 0);
+        assert_eq!(eol("a: 1\r\n"), "\r\n");
+        assert_eq!(eol("a: 1\n"), "\n");
+    }
+
+    #[test]
+    fn test_format() {
+        assert!(format(None, Some("config.yml")).is_ok());
+        assert!(format(None, Some("config.YAML")).is_ok());
+        assert!(format(Some("yaml"), Some("config")).is_ok());
+        assert!(format(None, Some("config")).is_err());
+        assert!(format(None, None).is_err());
+        assert!(format(None, Some("config.json")).is_ok());
+        assert!(format(None, Some("app/.env")).is_ok());
+        assert!(format(None, Some(".env.production")).is_ok());
+        assert!(format(None, Some("prod.env")).is_ok());
+        assert!(format(None, Some("config.toml")).is_err());
+    }
+}
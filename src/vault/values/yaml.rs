@@ -0,0 +1,431 @@
+// Values of a YAML document, the document is transformed line by line so the
+// keys, the comments, the blank lines and the line endings stay as they are:
+//
+//  db:
+//    user: admin # comment
+//    password: ENC[SSH-VAULT,<nonce and ciphertext in base64>]
+//  ssh_vault:
+//    - '-> X25519 SHA256:<fingerprint> <ephemeral public key> <encrypted key>'
+//
+// Block scalars are encrypted as a single value, multi-line plain scalars and
+// flow collections spanning lines are not supported
+
+use super::{eol, lines, Format};
+use crate::vault::{
+    crypto::chunk::Cipher,
+    metadata::Metadata,
+    stream::{Header, Stanza},
+};
+use anyhow::{anyhow, Result};
+
+/// Top level key with the header of the document
+pub const HEADER_KEY: &str = "ssh_vault";
+
+pub struct Yaml;
+
+impl Format for Yaml {
+    fn map_values(
+        &self,
+        doc: &str,
+        f: &mut dyn FnMut(&str, &str) -> Result<String>,
+    ) -> Result<String> {
+        let lines: Vec<(&str, &str)> = lines(doc).collect();
+        let mut output = String::with_capacity(doc.len());
+        // keys of the parent mappings and their indentation
+        let mut stack: Vec<(usize, String)> = Vec::new();
+        let mut i = 0;
+
+        while i < lines.len() {
+            let (line, end) = lines[i];
+            i += 1;
+
+            let trimmed = line.trim_start();
+            if trimmed.is_empty() || trimmed.starts_with('#') {
+                output.push_str(line);
+                output.push_str(end);
+                continue;
+            }
+
+            if line == "---" || line == "..." {
+                stack.clear();
+                output.push_str(line);
+                output.push_str(end);
+                continue;
+            }
+
+            let mut indent = line.len() - trimmed.len();
+            stack.retain(|(level, _)| *level < indent);
+
+            // list items, their content is indented after the dash
+            let mut content = trimmed;
+            while content == "-" || content.starts_with("- ") {
+                stack.push((indent, String::from("[]")));
+                let rest = content[1..].trim_start();
+                indent += content.len() - rest.len();
+                content = rest;
+            }
+
+            let (key, value_start) = match split_key(content) {
+                Some((key, value_start)) => (Some(key), value_start),
+                None => (None, 0),
+            };
+
+            let value = content[value_start..].trim_start();
+            let prefix = &line[..line.len() - value.len()];
+
+            if let Some(key) = &key {
+                if value.is_empty() || value.starts_with('#') {
+                    // nested mapping or list
+                    stack.push((indent, key.clone()));
+                    output.push_str(line);
+                    output.push_str(end);
+                    continue;
+                }
+            } else if value.is_empty() {
+                output.push_str(line);
+                output.push_str(end);
+                continue;
+            }
+
+            let path = path(&stack, key.as_deref());
+
+            if value.starts_with('|') || value.starts_with('>') {
+                // the block scalar and its indented lines are a single value
+                let mut next = i;
+                let mut last = i;
+                while next < lines.len() {
+                    let (line, _) = lines[next];
+                    let next_trimmed = line.trim_start();
+                    if !next_trimmed.is_empty() {
+                        if line.len() - next_trimmed.len() <= indent {
+                            break;
+                        }
+                        last = next + 1;
+                    }
+                    next += 1;
+                }
+
+                // the lines of the block keep their line endings
+                let mut raw = String::from(value);
+                let mut end = end;
+                for (line, line_end) in &lines[i..last] {
+                    raw.push_str(end);
+                    raw.push_str(line);
+                    end = line_end;
+                }
+                i = last;
+
+                output.push_str(prefix);
+                output.push_str(&f(&path, &raw)?);
+                output.push_str(end);
+                continue;
+            }
+
+            // the spaces and the comment after the value are kept as they are
+            let (value, rest) = split_comment(value);
+
+            output.push_str(prefix);
+            output.push_str(&f(&path, value)?);
+            output.push_str(rest);
+            output.push_str(end);
+        }
+
+        Ok(output)
+    }
+
+    fn split_header(&self, doc: &str) -> Result<(String, Option<Header>)> {
+        let mut body = String::with_capacity(doc.len());
+        let mut stanzas = Vec::new();
+        let mut in_header = false;
+        let mut found = false;
+
+        for (line, end) in lines(doc) {
+            let trimmed = line.trim_start();
+
+            if in_header && line.len() == trimmed.len() && !trimmed.is_empty() {
+                in_header = false;
+            }
+
+            if line.len() == trimmed.len()
+                && split_key(line).map(|(key, _)| key).as_deref() == Some(HEADER_KEY)
+            {
+                in_header = true;
+                found = true;
+                continue;
+            }
+
+            if in_header {
+                if let Some(stanza) = trimmed.strip_prefix("- ") {
+                    stanzas.push(Stanza::parse(&unquote(stanza.trim()))?);
+                }
+                continue;
+            }
+
+            body.push_str(line);
+            body.push_str(end);
+        }
+
+        if !found {
+            return Ok((body, None));
+        }
+
+        if stanzas.is_empty() {
+            return Err(anyhow!("Invalid {HEADER_KEY} header, no recipients found"));
+        }
+
+        // drop the blank line added before the header
+        for blank in ["\r\n\r\n", "\n\n"] {
+            if body.ends_with(blank) {
+                body.truncate(body.len() - blank.len() / 2);
+                break;
+            }
+        }
+
+        Ok((
+            body,
+            Some(Header {
+                stanzas,
+                shares: Vec::new(),
+                cipher: Cipher::default(),
+                metadata: Metadata::default(),
+                label: None,
+                edited: None,
+                expires: None,
+                mac: None,
+            }),
+        ))
+    }
+
+    fn join_header(&self, body: &str, header: &Header) -> String {
+        let eol = eol(body);
+        let mut doc = String::from(body);
+
+        if !doc.is_empty() && !doc.ends_with('\n') {
+            doc.push_str(eol);
+        }
+
+        doc.push_str(eol);
+        doc.push_str(HEADER_KEY);
+        doc.push(':');
+        doc.push_str(eol);
+
+        for stanza in &header.stanzas {
+            doc.push_str(&format!("  - '{stanza}'{eol}"));
+        }
+
+        doc
+    }
+
+    fn is_header(&self, path: &str) -> bool {
+        path.strip_prefix(HEADER_KEY)
+            .is_some_and(|rest| rest.is_empty() || rest.starts_with('.'))
+    }
+}
+
+// the key of a `key: value` line and where its value starts
+fn split_key(content: &str) -> Option<(String, usize)> {
+    let (key, rest) = if content.starts_with('"') || content.starts_with('\'') {
+        let end = quoted_end(content)?;
+        (unquote(&content[..=end]), end + 1)
+    } else {
+        let end = content
+            .find(": ")
+            .or_else(|| content.strip_suffix(':').map(str::len))?;
+        let key = &content[..end];
+
+        if key.contains(" #") || key.starts_with('#') {
+            return None;
+        }
+
+        (key.trim_end().to_string(), end)
+    };
+
+    let after = &content[rest..];
+    if after == ":" || after.starts_with(": ") {
+        Some((key, rest + 1))
+    } else {
+        None
+    }
+}
+
+// index of the closing quote of a quoted scalar
+fn quoted_end(value: &str) -> Option<usize> {
+    let quote = value.chars().next()?;
+    let bytes = value.as_bytes();
+    let mut i = 1;
+
+    while i < bytes.len() {
+        match bytes[i] {
+            b'\\' if quote == '"' => i += 1,
+            b'\'' if quote == '\'' && bytes.get(i + 1) == Some(&b'\'') => i += 1,
+            byte if byte == quote as u8 => return Some(i),
+            _ => {}
+        }
+        i += 1;
+    }
+
+    None
+}
+
+fn unquote(value: &str) -> String {
+    if value.len() >= 2 && value.starts_with('\'') && value.ends_with('\'') {
+        value[1..value.len() - 1].replace("''", "'")
+    } else if value.len() >= 2 && value.starts_with('"') && value.ends_with('"') {
+        value[1..value.len() - 1].to_string()
+    } else {
+        value.to_string()
+    }
+}
+
+// split the value and what follows it, the spaces and the inline comment
+fn split_comment(value: &str) -> (&str, &str) {
+    let end = if value.starts_with('"') || value.starts_with('\'') {
+        quoted_end(value)
+            .filter(|end| {
+                let rest = value[end + 1..].trim_start();
+                rest.is_empty() || rest.starts_with('#')
+            })
+            .map_or_else(|| value.trim_end().len(), |end| end + 1)
+    } else {
+        value
+            .find(" #")
+            .map_or(value, |start| &value[..start])
+            .trim_end()
+            .len()
+    };
+
+    value.split_at(end)
+}
+
+fn path(stack: &[(usize, String)], key: Option<&str>) -> String {
+    stack
+        .iter()
+        .map(|(_, key)| key.as_str())
+        .chain(key)
+        .collect::<Vec<_>>()
+        .join(".")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::{find, values, SshKeyType, SshVault};
+    use regex::RegexSet;
+    use ssh_key::PrivateKey;
+    use std::path::Path;
+
+    const DOC: &str = r#"# database
+db:
+  user: admin # the user
+  password: "s3cr3t # not a comment"
+  hosts:
+    - 10.0.0.1
+    - name: replica
+      port: 5432
+certificate: |
+  -----BEGIN CERTIFICATE-----
+  MIIB
+
+  -----END CERTIFICATE-----
+
+empty:
+"#;
+
+    fn paths(doc: &str) -> Vec<(String, String)> {
+        let mut paths = Vec::new();
+        Yaml.map_values(doc, &mut |path, value| {
+            paths.push((path.to_string(), value.to_string()));
+            Ok(value.to_string())
+        })
+        .unwrap();
+        paths
+    }
+
+    #[test]
+    fn test_map_values() {
+        assert_eq!(
+            paths(DOC),
+            vec![
+                ("db.user".to_string(), "admin".to_string()),
+                (
+                    "db.password".to_string(),
+                    "\"s3cr3t # not a comment\"".to_string()
+                ),
+                ("db.hosts.[]".to_string(), "10.0.0.1".to_string()),
+                ("db.hosts.[].name".to_string(), "replica".to_string()),
+                ("db.hosts.[].port".to_string(), "5432".to_string()),
+                (
+                    "certificate".to_string(),
+                    "|\n  -----BEGIN CERTIFICATE-----\n  MIIB\n\n  -----END CERTIFICATE-----"
+                        .to_string()
+                ),
+            ]
+        );
+
+        // the identity keeps the document
+        assert_eq!(
+            Yaml.map_values(DOC, &mut |_, value| Ok(value.to_string()))
+                .unwrap(),
+            DOC
+        );
+    }
+
+    #[test]
+    fn test_round_trip() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+        let key = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let doc = "# app\r\ndb:\r\n  user: admin    # the user\r\n  password: s3cr3t  \r\n\r\nkey: |\r\n  line 1\r\n  line 2\r\n";
+
+        let encrypted =
+            values::encrypt(&Yaml, doc, &[recipient], None, &RegexSet::empty()).unwrap();
+
+        assert!(encrypted.contains("]    # the user\r\n"));
+        assert!(encrypted.contains("\r\nssh_vault:\r\n  - '-> X25519 "));
+        assert!(!encrypted.replace("\r\n", "").contains('\n'));
+
+        assert_eq!(values::decrypt(&Yaml, &encrypted, &key).unwrap(), doc);
+
+        // the header stays where it is when adding values
+        let header = &encrypted[encrypted.find("ssh_vault:").unwrap()..];
+        let moved = format!("{header}token: abc\r\n");
+        let added = values::encrypt(&Yaml, &moved, &[], Some(&key), &RegexSet::empty()).unwrap();
+        assert!(added.starts_with(header));
+        assert!(added.contains("\r\ntoken: ENC[SSH-VAULT,"));
+    }
+
+    #[test]
+    fn test_encrypt_decrypt() {
+        let public = find::public_key(Some("test_data/ed25519.pub".to_string())).unwrap();
+        let private = PrivateKey::read_openssh_file(Path::new("test_data/ed25519")).unwrap();
+        let recipient = SshVault::new(&SshKeyType::Ed25519, Some(public), None).unwrap();
+        let key = SshVault::new(&SshKeyType::Ed25519, None, Some(private)).unwrap();
+
+        let encrypted =
+            values::encrypt(&Yaml, DOC, &[recipient], None, &RegexSet::empty()).unwrap();
+
+        assert!(encrypted.contains("# database\ndb:\n  user: ENC[SSH-VAULT,"));
+        assert!(encrypted.contains("] # the user\n"));
+        assert!(encrypted.contains("\nssh_vault:\n  - '-> X25519 SHA256:"));
+        assert!(!encrypted.contains("s3cr3t"));
+        assert!(!encrypted.contains("MIIB"));
+
+        assert_eq!(values::decrypt(&Yaml, &encrypted, &key).unwrap(), DOC);
+
+        // new values are encrypted with the key of the document
+        let added = format!("token: abc\n{encrypted}");
+        assert!(values::encrypt(&Yaml, &added, &[], None, &RegexSet::empty()).is_err());
+        let added = values::encrypt(&Yaml, &added, &[], Some(&key), &RegexSet::empty()).unwrap();
+        assert!(added.ends_with(&encrypted[encrypted.find("db:").unwrap()..]));
+        assert_eq!(
+            values::decrypt(&Yaml, &added, &key).unwrap(),
+            format!("token: abc\n{DOC}")
+        );
+
+        // values can't be moved to other keys
+        let moved = encrypted.replacen("  user:", "  login:", 1);
+        assert!(values::decrypt(&Yaml, &moved, &key).is_err());
+    }
+}
@@ -0,0 +1,96 @@
+// Changes of the plaintext working file of `ssh-vault watch`, the file is
+// polled so it works the same on every platform and with editors that save
+// by replacing the file. A change is only reported once the file stayed the
+// same for the debounce, editors often write a file in several steps
+
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    time::{Duration, Instant, SystemTime},
+};
+
+// what tells a file changed without reading it
+type Stamp = (SystemTime, u64);
+
+#[derive(Debug)]
+pub struct Watcher {
+    path: PathBuf,
+    debounce: Duration,
+    seen: Option<Stamp>,
+    // when the last change was seen, until it is reported
+    changed: Option<Instant>,
+}
+
+impl Watcher {
+    /// Watch the file, the current version is not a change
+    #[must_use]
+    pub fn new(path: &Path, debounce: Duration) -> Self {
+        Self {
+            path: path.to_path_buf(),
+            debounce,
+            seen: stamp(path),
+            changed: None,
+        }
+    }
+
+    /// Check the file, returns true once a change settled, a removed file is
+    /// only reported when it comes back
+    pub fn poll(&mut self) -> bool {
+        let now = stamp(&self.path);
+
+        if now != self.seen {
+            self.seen = now;
+            self.changed = Some(Instant::now());
+            return false;
+        }
+
+        match self.changed {
+            Some(changed) if self.seen.is_some() && changed.elapsed() >= self.debounce => {
+                self.changed = None;
+                true
+            }
+            _ => false,
+        }
+    }
+}
+
+fn stamp(path: &Path) -> Option<Stamp> {
+    let metadata = fs::metadata(path).ok()?;
+
+    Some((metadata.modified().ok()?, metadata.len()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_watcher() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("secret.env");
+        fs::write(&path, "TOKEN=1\n").unwrap();
+
+        let mut watcher = Watcher::new(&path, Duration::ZERO);
+        assert!(!watcher.poll());
+
+        // reported once it stays the same
+        fs::write(&path, "TOKEN=12\n").unwrap();
+        assert!(!watcher.poll());
+        assert!(watcher.poll());
+        assert!(!watcher.poll());
+
+        // replaced by the editor
+        fs::remove_file(&path).unwrap();
+        assert!(!watcher.poll());
+        assert!(!watcher.poll());
+        fs::write(&path, "TOKEN=123\n").unwrap();
+        assert!(!watcher.poll());
+        assert!(watcher.poll());
+
+        // still changing
+        let mut watcher = Watcher::new(&path, Duration::from_secs(60));
+        fs::write(&path, "TOKEN=1234\n").unwrap();
+        assert!(!watcher.poll());
+        assert!(!watcher.poll());
+    }
+}
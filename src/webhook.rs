@@ -0,0 +1,227 @@
+// Webhooks told when designated vaults are opened or changed, `webhooks` in
+// the config lists the URLs and the vaults they watch:
+//
+//   webhooks:
+//     - url: https://hooks.example.com/ssh-vault
+//       vaults:
+//         - /srv/secrets/prod/**
+//         - "**/*.prod.vault"
+//       operations:
+//         - view
+//         - edit
+//
+// the vaults are globs of their absolute paths, `**` for all of them, and the
+// operations are the ones of the audit log, every one but create by default.
+// Each webhook gets a JSON POST with the operation, the vault, the fingerprint
+// of the key used and the time, never the plaintext:
+//
+//   {"operation":"view","vault":"/srv/secrets/prod/db.vault","fingerprint":"SHA256:...","time":"2026-01-01T00:00:00Z"}
+//
+// the URLs in http_credentials get their Authorization header, failures are
+// reported but never stop the operation
+
+use crate::{
+    config, logging,
+    vault::{policy, remote},
+};
+use ::config::Config;
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use slog::info;
+use std::time::SystemTime;
+use url::Url;
+
+#[derive(Debug, Default, Deserialize)]
+struct Webhook {
+    url: String,
+    #[serde(default)]
+    vaults: Vec<String>,
+    #[serde(default)]
+    operations: Vec<String>,
+}
+
+impl Webhook {
+    fn matches(&self, operation: &str, vault: &str) -> Result<bool> {
+        let operation = if self.operations.is_empty() {
+            operation != "create"
+        } else {
+            self.operations.iter().any(|o| o == operation)
+        };
+
+        Ok(operation
+            && policy::globs(&self.vaults)
+                .with_context(|| format!("Invalid vaults of the webhook {}", self.url))?
+                .is_match(vault))
+    }
+}
+
+/// Notify the webhooks watching the vault, `vault` is its absolute path and
+/// None for stdin and stdout
+pub fn notify(operation: &str, vault: Option<&str>, fingerprint: &str) {
+    let Some(vault) = vault else {
+        return;
+    };
+
+    // get the config from ~/.config/ssh-vault/config.yml
+    let webhooks = config::get().and_then(|config| webhooks(&config));
+
+    match webhooks {
+        Ok(webhooks) => {
+            fire(
+                &webhooks,
+                &payload(SystemTime::now(), operation, vault, fingerprint),
+            );
+        }
+        Err(e) => eprintln!("Could not notify the webhooks: {e}"),
+    }
+}
+
+fn webhooks(config: &Config) -> Result<Vec<Webhook>> {
+    if config.get_array("webhooks").is_err() {
+        return Ok(Vec::new());
+    }
+
+    config
+        .get("webhooks")
+        .context("Invalid webhooks in the config")
+}
+
+fn payload(time: SystemTime, operation: &str, vault: &str, fingerprint: &str) -> Value {
+    json!({
+        "operation": operation,
+        "vault": vault,
+        "fingerprint": fingerprint,
+        "time": humantime::format_rfc3339_seconds(time).to_string(),
+    })
+}
+
+// POST the payload to the matching webhooks, returns how many got it
+fn fire(webhooks: &[Webhook], payload: &Value) -> usize {
+    let operation = payload["operation"].as_str().unwrap_or_default();
+    let vault = payload["vault"].as_str().unwrap_or_default();
+
+    let mut notified = 0;
+
+    for webhook in webhooks {
+        let sent = webhook.matches(operation, vault).and_then(|matches| {
+            if !matches {
+                return Ok(false);
+            }
+
+            let url = Url::parse(&webhook.url)
+                .with_context(|| format!("Invalid webhook URL {}", webhook.url))?;
+
+            remote::post_json(&url, payload)?;
+
+            info!(logging::logger(), "webhook notified";
+                "url" => %url, "operation" => operation);
+
+            Ok(true)
+        });
+
+        match sent {
+            Ok(true) => notified += 1,
+            Ok(false) => {}
+            Err(e) => eprintln!("Could not notify the webhook {}: {e}", webhook.url),
+        }
+    }
+
+    notified
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vault::http;
+    use std::{
+        io::BufReader,
+        net::TcpListener,
+        thread,
+        time::{Duration, UNIX_EPOCH},
+    };
+
+    fn webhook(url: &str, vaults: &[&str], operations: &[&str]) -> Webhook {
+        Webhook {
+            url: url.to_string(),
+            vaults: vaults.iter().map(ToString::to_string).collect(),
+            operations: operations.iter().map(ToString::to_string).collect(),
+        }
+    }
+
+    #[test]
+    fn test_matches() {
+        let all = webhook("https://hooks.example.com", &["/srv/prod/**"], &[]);
+        assert!(all.matches("view", "/srv/prod/db.vault").unwrap());
+        assert!(all.matches("edit", "/srv/prod/app/db.vault").unwrap());
+        assert!(!all.matches("create", "/srv/prod/db.vault").unwrap());
+        assert!(!all.matches("view", "/srv/dev/db.vault").unwrap());
+
+        let views = webhook("https://hooks.example.com", &["**/*.prod.vault"], &["view"]);
+        assert!(views.matches("view", "/home/alice/db.prod.vault").unwrap());
+        assert!(!views.matches("edit", "/home/alice/db.prod.vault").unwrap());
+
+        assert!(!webhook("https://hooks.example.com", &[], &[])
+            .matches("view", "/srv/prod/db.vault")
+            .unwrap());
+        assert!(webhook("https://hooks.example.com", &["[prod"], &[])
+            .matches("view", "/srv/prod/db.vault")
+            .is_err());
+    }
+
+    #[test]
+    fn test_payload() {
+        let time = UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        assert_eq!(
+            payload(time, "view", "/srv/prod/db.vault", "SHA256:abc"),
+            json!({
+                "operation": "view",
+                "vault": "/srv/prod/db.vault",
+                "fingerprint": "SHA256:abc",
+                "time": "2023-11-14T22:13:20Z",
+            })
+        );
+    }
+
+    #[test]
+    fn test_fire() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}/hook", listener.local_addr().unwrap());
+
+        let server = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let request = http::read_request(&mut BufReader::new(&stream)).unwrap();
+            http::write_response(
+                &mut stream,
+                &http::Response::new(200, "text/plain", Vec::new()),
+            )
+            .unwrap();
+            request
+        });
+
+        let payload = payload(
+            SystemTime::now(),
+            "view",
+            "/srv/prod/db.vault",
+            "SHA256:abc",
+        );
+
+        let webhooks = [
+            webhook(&url, &["/srv/prod/**"], &["view"]),
+            webhook(&url, &["/srv/dev/**"], &[]),
+        ];
+
+        assert_eq!(fire(&webhooks, &payload), 1);
+
+        let request = server.join().unwrap();
+        assert_eq!(request.method, "POST");
+        assert_eq!(request.path, "/hook");
+
+        let body: Value = serde_json::from_slice(&request.body).unwrap();
+        assert_eq!(body, payload);
+
+        // unreachable webhooks are reported, not errors
+        let closed = webhook("http://127.0.0.1:1/hook", &["**"], &[]);
+        assert_eq!(fire(&[closed], &payload), 0);
+    }
+}